@@ -0,0 +1,128 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Archive holds settings for moving documents into another collection
+// via Collection.ArchiveTo. Zero values select the defaults documented
+// for each field.
+type Archive struct {
+	// BatchSize is the maximum number of documents moved at once.
+	// Defaults to 1000.
+	BatchSize int
+
+	// Progress, if set, is called with the totals so far after every
+	// batch is moved.
+	Progress func(result ArchiveResult)
+}
+
+// ArchiveResult holds the outcome of moving documents into another
+// collection.
+type ArchiveResult struct {
+	Copied  int // Number of documents written to the destination
+	Removed int // Number of documents removed from the source
+	Batches int // Number of batches moved
+}
+
+// ArchiveTo moves the documents matching selector from the collection
+// into dest, which may be in another database or cluster, as is common
+// for cold storage. This suits archival policies that TTL indexes can't
+// express, such as ones depending on several fields.
+//
+// Documents are moved in batches ordered by _id. Each batch is first
+// copied into dest, replacing documents with the same _id, and then
+// removed from the collection, so documents are never lost if the move
+// is interrupted. Moving is resumed by calling ArchiveTo again with the
+// same parameters, which copies again and removes the documents of the
+// interrupted batch.
+//
+// Documents are removed only if they still match selector, but changes
+// made to them while their batch is moved may be lost. The result is
+// returned even on errors.
+func (c *Collection) ArchiveTo(dest *Collection, selector interface{}, settings *Archive) (*ArchiveResult, error) {
+	var archive Archive
+	if settings != nil {
+		archive = *settings
+	}
+	if archive.BatchSize <= 0 {
+		archive.BatchSize = 1000
+	}
+
+	if selector == nil {
+		selector = bson.D{}
+	}
+
+	var result ArchiveResult
+	var last interface{}
+	for {
+		query := selector
+		if last != nil {
+			// Skip over documents that were copied but no longer match
+			// selector by the time they were to be removed.
+			query = bson.D{{"$and", []interface{}{selector, bson.D{{"_id", bson.D{{"$gt", last}}}}}}}
+		}
+		var docs []bson.Raw
+		err := c.Find(query).Sort("_id").Limit(archive.BatchSize).All(&docs)
+		if err != nil || len(docs) == 0 {
+			return &result, err
+		}
+
+		ids := make([]interface{}, len(docs))
+		bulk := dest.Bulk()
+		for i, doc := range docs {
+			var id struct {
+				Id bson.Raw "_id"
+			}
+			if err := doc.Unmarshal(&id); err != nil {
+				return &result, err
+			}
+			ids[i] = id.Id
+			bulk.Upsert(bson.D{{"_id", id.Id}}, doc)
+		}
+		if _, err := bulk.Run(); err != nil {
+			return &result, err
+		}
+		result.Copied += len(docs)
+
+		remove := bson.D{{"$and", []interface{}{query, bson.D{{"_id", bson.D{{"$in", ids}}}}}}}
+		info, err := c.RemoveAll(remove)
+		if info != nil {
+			result.Removed += info.Removed
+		}
+		if err != nil {
+			return &result, err
+		}
+		result.Batches++
+		if archive.Progress != nil {
+			archive.Progress(result)
+		}
+		last = ids[len(ids)-1]
+	}
+}
@@ -0,0 +1,76 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo_test
+
+import (
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+)
+
+func (s *S) TestArchiveTo(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	cold := session.DB("archive").C("mycoll")
+	for i := 0; i < 250; i++ {
+		err = coll.Insert(M{"_id": i, "old": i%5 != 0})
+		c.Assert(err, IsNil)
+	}
+
+	// A document copied by an interrupted run.
+	err = cold.Insert(M{"_id": 1, "old": true})
+	c.Assert(err, IsNil)
+
+	var progress []mgo.ArchiveResult
+	result, err := coll.ArchiveTo(cold, M{"old": true}, &mgo.Archive{
+		BatchSize: 60,
+		Progress: func(result mgo.ArchiveResult) {
+			progress = append(progress, result)
+		},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(*result, Equals, mgo.ArchiveResult{Copied: 200, Removed: 200, Batches: 4})
+	c.Assert(progress, HasLen, 4)
+	c.Assert(progress[0], Equals, mgo.ArchiveResult{Copied: 60, Removed: 60, Batches: 1})
+
+	n, err := coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 50)
+	n, err = coll.Find(M{"old": true}).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 0)
+	n, err = cold.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 200)
+
+	// Nothing left to move.
+	result, err = coll.ArchiveTo(cold, M{"old": true}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(*result, Equals, mgo.ArchiveResult{})
+}
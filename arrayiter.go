@@ -0,0 +1,137 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ArrayIter iterates over the elements of an array within a single
+// document. See Collection.IterArray.
+type ArrayIter struct {
+	collection *Collection
+	selector   interface{}
+	field      string
+	batch      int
+	skip       int
+	elems      []bson.Raw
+	done       bool
+	err        error
+}
+
+// IterArray returns an iterator over the elements of the array at field
+// (which may be a dotted path) in the first document matching selector,
+// retrieving batch elements at a time. This avoids loading the whole
+// document for reading arrays that grew too large to be handled at
+// once, which is common with legacy schemas holding unbounded arrays.
+// A batch size of zero or less defaults to 100 elements.
+//
+// Each batch is retrieved with an aggregation that projects a window of
+// the array via $slice, so concurrent changes to the array may have
+// elements skipped or seen twice. The iterator stops without an error
+// if the field is missing, and fails with ErrNotFound if no document
+// matches selector. It requires MongoDB 3.2 or later.
+//
+// For example:
+//
+//     iter := collection.IterArray(bson.M{"_id": id}, "events", 1000)
+//     var event Event
+//     for iter.Next(&event) {
+//         fmt.Println(event)
+//     }
+//     if err := iter.Close(); err != nil {
+//         return err
+//     }
+//
+func (c *Collection) IterArray(selector interface{}, field string, batch int) *ArrayIter {
+	if selector == nil {
+		selector = bson.D{}
+	}
+	if batch <= 0 {
+		batch = 100
+	}
+	return &ArrayIter{collection: c, selector: selector, field: field, batch: batch}
+}
+
+// Next retrieves the next element of the array into result, and returns
+// whether an element was retrieved. Once it returns false, see Err for
+// whether the iteration stopped due to an error.
+func (iter *ArrayIter) Next(result interface{}) bool {
+	if iter.err != nil {
+		return false
+	}
+	if len(iter.elems) == 0 {
+		if iter.done {
+			return false
+		}
+		iter.fetch()
+		if iter.err != nil || len(iter.elems) == 0 {
+			return false
+		}
+	}
+	elem := iter.elems[0]
+	iter.elems = iter.elems[1:]
+	if err := elem.Unmarshal(result); err != nil {
+		iter.err = err
+		return false
+	}
+	return true
+}
+
+// fetch retrieves the next batch of elements of the array.
+func (iter *ArrayIter) fetch() {
+	window := []interface{}{"$" + iter.field, iter.skip, iter.batch}
+	pipeline := []bson.D{
+		{{"$match", iter.selector}},
+		{{"$limit", 1}},
+		{{"$project", bson.D{{"_id", 0}, {"elems", bson.D{{"$slice", window}}}}}},
+	}
+	var result struct {
+		Elems []bson.Raw "elems"
+	}
+	if err := iter.collection.Pipe(pipeline).One(&result); err != nil {
+		iter.err = err
+		return
+	}
+	iter.elems = result.Elems
+	iter.skip += len(result.Elems)
+	iter.done = len(result.Elems) < iter.batch
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (iter *ArrayIter) Err() error {
+	return iter.err
+}
+
+// Close stops the iteration and returns the error that stopped it, if
+// any. Retrieving a batch doesn't hold a cursor open on the server, so
+// closing the iterator early is optional.
+func (iter *ArrayIter) Close() error {
+	iter.done = true
+	iter.elems = nil
+	return iter.err
+}
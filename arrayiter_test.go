@@ -0,0 +1,70 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo_test
+
+import (
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+)
+
+func (s *S) TestIterArray(c *C) {
+	if !s.versionAtLeast(3, 2) {
+		c.Skip("$slice in aggregations requires MongoDB 3.2+")
+	}
+
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	var elems []M
+	for i := 0; i < 25; i++ {
+		elems = append(elems, M{"n": i})
+	}
+	err = coll.Insert(M{"_id": 1, "a": M{"elems": elems}}, M{"_id": 2})
+	c.Assert(err, IsNil)
+
+	iter := coll.IterArray(M{"_id": 1}, "a.elems", 10)
+	var elem struct{ N int }
+	var ns []int
+	for iter.Next(&elem) {
+		ns = append(ns, elem.N)
+	}
+	c.Assert(iter.Close(), IsNil)
+	c.Assert(ns, HasLen, 25)
+	c.Assert(ns[0], Equals, 0)
+	c.Assert(ns[24], Equals, 24)
+
+	// Missing fields have no elements.
+	iter = coll.IterArray(M{"_id": 2}, "a.elems", 10)
+	c.Assert(iter.Next(&elem), Equals, false)
+	c.Assert(iter.Close(), IsNil)
+
+	iter = coll.IterArray(M{"_id": 3}, "a.elems", 10)
+	c.Assert(iter.Next(&elem), Equals, false)
+	c.Assert(iter.Close(), Equals, mgo.ErrNotFound)
+}
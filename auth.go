@@ -33,6 +33,7 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"gopkg.in/mgo.v2/bson"
 	"gopkg.in/mgo.v2/internal/scram"
@@ -180,6 +181,7 @@ func (socket *mongoSocket) Login(cred Credential) error {
 
 	debugf("Socket %p to %s: login: db=%q user=%q", socket, socket.addr, cred.Source, cred.Username)
 
+	started := time.Now()
 	var err error
 	switch cred.Mechanism {
 	case "", "MONGODB-CR", "MONGO-CR": // Name changed to MONGODB-CR in SERVER-8501.
@@ -198,6 +200,19 @@ func (socket *mongoSocket) Login(cred Credential) error {
 	} else {
 		debugf("Socket %p to %s: login successful", socket, socket.addr)
 	}
+	if monitor := getMonitor(); monitor != nil && monitor.Login != nil {
+		mechanism := cred.Mechanism
+		if mechanism == "" {
+			mechanism = "MONGODB-CR"
+		}
+		monitor.Login(&LoginEvent{
+			Server:    socket.addr,
+			Mechanism: mechanism,
+			Source:    cred.Source,
+			Duration:  time.Since(started),
+			Err:       err,
+		})
+	}
 	return err
 }
 
@@ -417,6 +432,23 @@ func (socket *mongoSocket) Logout(db string) {
 	socket.Unlock()
 }
 
+// loginKey returns a string identifying the credentials socket is
+// logged in with.
+func (socket *mongoSocket) loginKey() string {
+	socket.Lock()
+	var key []byte
+	for _, cred := range socket.creds {
+		key = append(key, cred.Source...)
+		key = append(key, 0)
+		key = append(key, cred.Username...)
+		key = append(key, 0)
+		key = append(key, cred.Mechanism...)
+		key = append(key, 0)
+	}
+	socket.Unlock()
+	return string(key)
+}
+
 func (socket *mongoSocket) LogoutAll() {
 	socket.Lock()
 	if l := len(socket.creds); l > 0 {
@@ -0,0 +1,106 @@
+// The bench package holds the performance benchmarks of the driver and
+// the baselines they are checked against, so that changes to hot paths
+// such as the socket layer and the BSON codec can be measured.
+//
+// The benchmarks live in the package tests and run with the usual tools:
+//
+//     go test ./bench -run NONE -bench . -benchmem
+//
+// Benchmarks that need a database use the standalone server started by
+// "make startdb", and are skipped when it isn't available. Some of them
+// work on a collection holding a million documents, which is populated
+// once and reused by later runs.
+//
+// The regression gate runs every benchmark that has a baseline and fails
+// if any of them became slower or allocates more than the baseline allows:
+//
+//     go test ./bench -run Baselines -bench.gate
+//
+// Baselines depend on the hardware they were recorded on. After
+// performance-related changes, or to gate on a different machine, they
+// may be recorded again with -bench.update.
+//
+package bench
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Baseline holds the reference figures for a single benchmark.
+type Baseline struct {
+	NsPerOp     int64 `json:"nsPerOp"`
+	AllocsPerOp int64 `json:"allocsPerOp"`
+}
+
+// Baselines holds the reference figures for a set of benchmarks, along
+// with a description of the environment they were recorded in.
+type Baselines struct {
+	Environment string              `json:"environment"`
+	Benchmarks  map[string]Baseline `json:"benchmarks"`
+}
+
+// LoadBaselines reads baselines previously saved into filename. A missing
+// file results in an empty set of baselines.
+func LoadBaselines(filename string) (*Baselines, error) {
+	b := &Baselines{Benchmarks: make(map[string]Baseline)}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, b); err != nil {
+		return nil, fmt.Errorf("cannot parse baselines in %s: %v", filename, err)
+	}
+	if b.Benchmarks == nil {
+		b.Benchmarks = make(map[string]Baseline)
+	}
+	return b, nil
+}
+
+// Save writes the baselines into filename.
+func (b *Baselines) Save(filename string) error {
+	data, err := json.MarshalIndent(b, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, append(data, '\n'), 0644)
+}
+
+// Record sets the baseline for the named benchmark from result.
+func (b *Baselines) Record(name string, result testing.BenchmarkResult) {
+	b.Benchmarks[name] = Baseline{
+		NsPerOp:     result.NsPerOp(),
+		AllocsPerOp: result.AllocsPerOp(),
+	}
+}
+
+// Check compares result against the baseline for the named benchmark.
+// It returns an error if the result is slower than the baseline, or
+// allocates more often, by more than the given tolerance, which is a
+// fraction of the baseline figures (0.2 allows for a 20% slowdown).
+// Benchmarks without a baseline always pass.
+func (b *Baselines) Check(name string, result testing.BenchmarkResult, tolerance float64) error {
+	base, ok := b.Benchmarks[name]
+	if !ok {
+		return nil
+	}
+	if limit := exceed(base.NsPerOp, tolerance); result.NsPerOp() > limit {
+		return fmt.Errorf("%s: %d ns/op exceeds the baseline of %d ns/op by more than %.0f%%",
+			name, result.NsPerOp(), base.NsPerOp, tolerance*100)
+	}
+	if limit := exceed(base.AllocsPerOp, tolerance); result.AllocsPerOp() > limit {
+		return fmt.Errorf("%s: %d allocs/op exceeds the baseline of %d allocs/op by more than %.0f%%",
+			name, result.AllocsPerOp(), base.AllocsPerOp, tolerance*100)
+	}
+	return nil
+}
+
+func exceed(base int64, tolerance float64) int64 {
+	return base + int64(float64(base)*tolerance)
+}
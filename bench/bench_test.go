@@ -0,0 +1,361 @@
+package bench_test
+
+import (
+	"flag"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bench"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	gate      = flag.Bool("bench.gate", false, "Check benchmarks against the recorded baselines")
+	update    = flag.Bool("bench.update", false, "Record new baselines for the benchmarks that run")
+	tolerance = flag.Float64("bench.tolerance", 0.25, "Slowdown tolerated by the gate, as a fraction of the baseline")
+)
+
+const baselinesFile = "baselines.json"
+
+func TestAll(t *testing.T) {
+	TestingT(t)
+}
+
+type S struct{}
+
+var _ = Suite(&S{})
+
+// --------------------------------------------------------------------------
+// Workloads.
+
+type smallDoc struct {
+	Id    int       `bson:"_id"`
+	Name  string    `bson:"name"`
+	Count int64     `bson:"count"`
+	Score float64   `bson:"score"`
+	Tags  []string  `bson:"tags"`
+	When  time.Time `bson:"when"`
+}
+
+type largeDoc struct {
+	Id    bson.ObjectId `bson:"_id"`
+	Items []smallDoc    `bson:"items"`
+	Attrs bson.M        `bson:"attrs"`
+	Blob  []byte        `bson:"blob"`
+}
+
+var when = time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func newSmallDoc(id int) smallDoc {
+	return smallDoc{
+		Id:    id,
+		Name:  "document name",
+		Count: int64(id) * 3,
+		Score: float64(id) / 7,
+		Tags:  []string{"alpha", "beta", "gamma"},
+		When:  when,
+	}
+}
+
+func newLargeDoc() *largeDoc {
+	doc := &largeDoc{
+		Id:    bson.NewObjectId(),
+		Attrs: bson.M{},
+		Blob:  []byte(strings.Repeat("x", 4096)),
+	}
+	for i := 0; i < 100; i++ {
+		doc.Items = append(doc.Items, newSmallDoc(i))
+		doc.Attrs[string(rune('a'+i%26))+strings.Repeat("k", i/26)] = i
+	}
+	return doc
+}
+
+const benchAddr = "localhost:40001"
+
+var (
+	sessionOnce sync.Once
+	session     *mgo.Session
+	sessionErr  error
+)
+
+// benchSession returns a session to the benchmark server, skipping the
+// benchmark if the server is not available.
+func benchSession(b *testing.B) *mgo.Session {
+	sessionOnce.Do(func() {
+		session, sessionErr = mgo.DialWithTimeout(benchAddr, 2*time.Second)
+	})
+	if sessionErr != nil {
+		b.Skipf("cannot reach %s: %v", benchAddr, sessionErr)
+	}
+	return session.Copy()
+}
+
+const millionDocs = 1000000
+
+// millionColl returns a collection holding millionDocs small documents,
+// populating it if necessary.
+func millionColl(b *testing.B, session *mgo.Session) *mgo.Collection {
+	coll := session.DB("bench").C("million")
+	n, err := coll.Count()
+	if err != nil {
+		b.Fatal(err)
+	}
+	if n == millionDocs {
+		return coll
+	}
+	coll.DropCollection()
+	const batch = 1000
+	docs := make([]interface{}, batch)
+	for i := 0; i < millionDocs; i += batch {
+		for j := range docs {
+			docs[j] = newSmallDoc(i + j)
+		}
+		bulk := coll.Bulk()
+		bulk.Unordered()
+		bulk.Insert(docs...)
+		if _, err := bulk.Run(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return coll
+}
+
+func freshColl(b *testing.B, session *mgo.Session, name string) *mgo.Collection {
+	coll := session.DB("bench").C(name)
+	coll.DropCollection()
+	return coll
+}
+
+func BenchmarkInsert(b *testing.B) {
+	session := benchSession(b)
+	defer session.Close()
+	coll := freshColl(b, session, "insert")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := coll.Insert(newSmallDoc(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkInsertBulk inserts 1000 documents per operation.
+func BenchmarkInsertBulk(b *testing.B) {
+	session := benchSession(b)
+	defer session.Close()
+	coll := freshColl(b, session, "insertbulk")
+
+	docs := make([]interface{}, 1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := range docs {
+			docs[j] = newSmallDoc(i*len(docs) + j)
+		}
+		bulk := coll.Bulk()
+		bulk.Unordered()
+		bulk.Insert(docs...)
+		if _, err := bulk.Run(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFindOne(b *testing.B) {
+	session := benchSession(b)
+	defer session.Close()
+	coll := millionColl(b, session)
+
+	var doc smallDoc
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		id := i * 7919 % millionDocs
+		if err := coll.FindId(id).One(&doc); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkIterMillion iterates over the million documents collection,
+// one document per operation.
+func BenchmarkIterMillion(b *testing.B) {
+	session := benchSession(b)
+	defer session.Close()
+	coll := millionColl(b, session)
+
+	var doc smallDoc
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; {
+		iter := coll.Find(nil).Batch(1000).Iter()
+		for n < b.N && iter.Next(&doc) {
+			n++
+		}
+		if err := iter.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchMarshal(b *testing.B, doc interface{}) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := bson.Marshal(doc); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchUnmarshal(b *testing.B, doc, result interface{}) {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := bson.Unmarshal(data, result); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMarshalSmall(b *testing.B) {
+	benchMarshal(b, newSmallDoc(1))
+}
+
+func BenchmarkMarshalLarge(b *testing.B) {
+	benchMarshal(b, newLargeDoc())
+}
+
+func BenchmarkMarshalAppend(b *testing.B) {
+	doc := newSmallDoc(1)
+	var buf []byte
+	var err error
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf, err = bson.MarshalAppend(buf[:0], doc)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalSmall(b *testing.B) {
+	benchUnmarshal(b, newSmallDoc(1), &smallDoc{})
+}
+
+func BenchmarkUnmarshalLarge(b *testing.B) {
+	benchUnmarshal(b, newLargeDoc(), &largeDoc{})
+}
+
+// BenchmarkDecoder decodes a buffer of 100 small documents per operation.
+func BenchmarkDecoder(b *testing.B) {
+	var data []byte
+	for i := 0; i < 100; i++ {
+		var err error
+		data, err = bson.MarshalAppend(data, newSmallDoc(i))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	dec := bson.NewDecoder(nil, nil)
+	var doc smallDoc
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dec.Reset(data)
+		for dec.Decode(&doc) == nil {
+		}
+	}
+}
+
+var benchmarks = []struct {
+	name string
+	fn   func(b *testing.B)
+}{
+	{"Insert", BenchmarkInsert},
+	{"InsertBulk", BenchmarkInsertBulk},
+	{"FindOne", BenchmarkFindOne},
+	{"IterMillion", BenchmarkIterMillion},
+	{"MarshalSmall", BenchmarkMarshalSmall},
+	{"MarshalLarge", BenchmarkMarshalLarge},
+	{"MarshalAppend", BenchmarkMarshalAppend},
+	{"UnmarshalSmall", BenchmarkUnmarshalSmall},
+	{"UnmarshalLarge", BenchmarkUnmarshalLarge},
+	{"Decoder", BenchmarkDecoder},
+}
+
+// --------------------------------------------------------------------------
+// Regression gate.
+
+func (s *S) TestBaselines(c *C) {
+	if !*gate && !*update {
+		c.Skip("-bench.gate or -bench.update not provided")
+	}
+	baselines, err := bench.LoadBaselines(baselinesFile)
+	c.Assert(err, IsNil)
+
+	failed := false
+	for _, b := range benchmarks {
+		result := testing.Benchmark(b.fn)
+		if result.N == 0 {
+			c.Logf("%s: skipped", b.name)
+			continue
+		}
+		c.Logf("%s: %s %s", b.name, result.String(), result.MemString())
+		if *update {
+			baselines.Record(b.name, result)
+		} else if err := baselines.Check(b.name, result, *tolerance); err != nil {
+			c.Error(err)
+			failed = true
+		}
+	}
+	if *update && !failed {
+		baselines.Environment = fmt.Sprintf("%s %s/%s, %d CPUs", runtime.Version(), runtime.GOOS, runtime.GOARCH, runtime.NumCPU())
+		c.Assert(baselines.Save(baselinesFile), IsNil)
+	}
+}
+
+func (s *S) TestCheck(c *C) {
+	baselines := &bench.Baselines{Benchmarks: map[string]bench.Baseline{
+		"A": {NsPerOp: 1000, AllocsPerOp: 10},
+	}}
+	result := func(ns, allocs int64) testing.BenchmarkResult {
+		return testing.BenchmarkResult{N: 10, T: time.Duration(ns * 10), MemAllocs: uint64(allocs * 10)}
+	}
+
+	c.Assert(baselines.Check("A", result(1000, 10), 0.2), IsNil)
+	c.Assert(baselines.Check("A", result(1200, 12), 0.2), IsNil)
+	c.Assert(baselines.Check("A", result(1201, 10), 0.2), ErrorMatches,
+		"A: 1201 ns/op exceeds the baseline of 1000 ns/op by more than 20%")
+	c.Assert(baselines.Check("A", result(900, 13), 0.2), ErrorMatches,
+		"A: 13 allocs/op exceeds the baseline of 10 allocs/op by more than 20%")
+	c.Assert(baselines.Check("B", result(1e9, 1e6), 0.2), IsNil)
+}
+
+func (s *S) TestLoadSaveBaselines(c *C) {
+	filename := c.MkDir() + "/baselines.json"
+	baselines, err := bench.LoadBaselines(filename)
+	c.Assert(err, IsNil)
+	c.Assert(baselines.Benchmarks, HasLen, 0)
+
+	baselines.Environment = "test"
+	baselines.Record("A", testing.BenchmarkResult{N: 2, T: 200, MemAllocs: 6})
+	c.Assert(baselines.Save(filename), IsNil)
+
+	baselines, err = bench.LoadBaselines(filename)
+	c.Assert(err, IsNil)
+	c.Assert(baselines.Environment, Equals, "test")
+	c.Assert(baselines.Benchmarks, DeepEquals, map[string]bench.Baseline{"A": {NsPerOp: 100, AllocsPerOp: 3}})
+}
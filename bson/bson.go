@@ -40,6 +40,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"reflect"
 	"runtime"
@@ -485,10 +486,11 @@ func handleErr(err *error) {
 //     minsize    Marshal an int64 value as an int32, if that's feasible
 //                while preserving the numeric value.
 //
-//     inline     Inline the field, which must be a struct or a map,
-//                causing all of its fields or keys to be processed as if
-//                they were part of the outer struct. For maps, keys must
-//                not conflict with the bson keys of other struct fields.
+//     inline     Inline the field, which must be a struct, a map, or a
+//                Raw value, causing all of its fields or keys to be
+//                processed as if they were part of the outer struct. For
+//                maps and Raw values, keys must not conflict with the
+//                bson keys of other struct fields.
 //
 // Some examples:
 //
@@ -503,7 +505,19 @@ func handleErr(err *error) {
 //
 func Marshal(in interface{}) (out []byte, err error) {
 	defer handleErr(&err)
-	e := &encoder{make([]byte, 0, initialBufferSize)}
+	e := &encoder{make([]byte, 0, initialBufferSize), DefaultRegistry}
+	e.addDoc(reflect.ValueOf(in))
+	return e.out, nil
+}
+
+// MarshalAppend works like Marshal, but appends the serialized document
+// to dst and returns the extended buffer. This allows callers that
+// marshal many documents to reuse the same buffer rather than allocating
+// a new one per document. If an error occurs, dst is returned as-is.
+func MarshalAppend(dst []byte, in interface{}) (out []byte, err error) {
+	out = dst
+	defer handleErr(&err)
+	e := &encoder{dst, DefaultRegistry}
 	e.addDoc(reflect.ValueOf(in))
 	return e.out, nil
 }
@@ -523,11 +537,15 @@ func Marshal(in interface{}) (out []byte, err error) {
 // The following flags are currently supported during unmarshal (see the
 // Marshal method for other flags):
 //
-//     inline     Inline the field, which must be a struct or a map.
-//                Inlined structs are handled as if its fields were part
-//                of the outer struct. An inlined map causes keys that do
-//                not match any other struct field to be inserted in the
-//                map rather than being discarded as usual.
+//     inline     Inline the field, which must be a struct, a map, or a
+//                Raw value. Inlined structs are handled as if its fields
+//                were part of the outer struct. An inlined map causes keys
+//                that do not match any other struct field to be inserted
+//                in the map rather than being discarded as usual. An
+//                inlined Raw value similarly collects such fields as a
+//                raw document, preserving their original encoding so that
+//                they are written back unchanged when the struct is
+//                marshalled again.
 //
 // The target field or element types of out may not necessarily match
 // the BSON values of the provided data.  The following conversions are
@@ -544,9 +562,13 @@ func Marshal(in interface{}) (out []byte, err error) {
 //
 // Pointer values are initialized when necessary.
 func Unmarshal(in []byte, out interface{}) (err error) {
+	return unmarshalDoc(newDecoder(in), out)
+}
+
+func unmarshalDoc(d *decoder, out interface{}) (err error) {
 	if raw, ok := out.(*Raw); ok {
 		raw.Kind = 3
-		raw.Data = in
+		raw.Data = d.in
 		return nil
 	}
 	defer handleErr(&err)
@@ -555,7 +577,6 @@ func Unmarshal(in []byte, out interface{}) (err error) {
 	case reflect.Ptr:
 		fallthrough
 	case reflect.Map:
-		d := newDecoder(in)
 		d.readDocTo(v)
 	case reflect.Struct:
 		return errors.New("Unmarshal can't deal with struct values. Use a pointer.")
@@ -565,6 +586,111 @@ func Unmarshal(in []byte, out interface{}) (err error) {
 	return nil
 }
 
+// FieldMatch defines how document keys are matched against struct fields
+// when unmarshaling. The key of a field is the name given in its bson tag
+// or, when the tag provides no name, the lowercased field name.
+type FieldMatch int
+
+const (
+	// MatchExact matches document keys against field keys exactly.
+	// This is the default.
+	MatchExact FieldMatch = iota
+
+	// MatchCaseInsensitive matches document keys against field keys
+	// exactly when possible, and ignoring case otherwise, so that a
+	// "UserName" key fills a UserName field.
+	MatchCaseInsensitive
+
+	// MatchTagOnly only fills fields that are explicitly named in their
+	// bson tag. Keys that would only match the lowercased name of an
+	// untagged field are treated as unknown.
+	MatchTagOnly
+)
+
+// DecodeOptions tweaks the unmarshaling of documents.
+type DecodeOptions struct {
+	// Registry holds the custom decoders to consult. If nil,
+	// DefaultRegistry is used.
+	Registry *Registry
+
+	// Strict makes unmarshaling fail when documents hold fields that
+	// are not present in the destination struct, when values are not
+	// compatible with their destination and would otherwise be skipped,
+	// and when numeric values would be truncated, overflow, or lose
+	// precision when converted to their destination type. This helps
+	// catching schema drift early. Inlined maps accept any field.
+	Strict bool
+
+	// FieldMatch defines how document keys are matched against struct
+	// fields. The default is MatchExact.
+	FieldMatch FieldMatch
+}
+
+// Unmarshal works like the Unmarshal function, but according to opts.
+func (opts *DecodeOptions) Unmarshal(in []byte, out interface{}) error {
+	d := newDecoder(in)
+	if opts.Registry != nil {
+		d.registry = opts.Registry
+	}
+	d.strict = opts.Strict
+	d.match = opts.FieldMatch
+	return unmarshalDoc(d, out)
+}
+
+// Decoder unmarshals a sequence of documents laid out back to back in a
+// buffer. A Decoder may be reused for further buffers via Reset, so that
+// callers decoding many documents don't allocate decoding state for each
+// one of them.
+type Decoder struct {
+	d decoder
+}
+
+// NewDecoder returns a Decoder that reads documents from in, according to
+// opts. If opts is nil, the defaults used by Unmarshal apply.
+func NewDecoder(in []byte, opts *DecodeOptions) *Decoder {
+	dec := &Decoder{d: *newDecoder(in)}
+	if opts != nil {
+		if opts.Registry != nil {
+			dec.d.registry = opts.Registry
+		}
+		dec.d.strict = opts.Strict
+		dec.d.match = opts.FieldMatch
+	}
+	return dec
+}
+
+// Reset makes dec read documents from in, keeping its options.
+func (dec *Decoder) Reset(in []byte) {
+	dec.d.in = in
+	dec.d.i = 0
+	dec.d.docType = typeM
+}
+
+// Decode unmarshals the next document in the buffer into out, in the
+// same way as Unmarshal does. It returns io.EOF once all documents in
+// the buffer have been read. After any other error, the state of dec is
+// undefined until it is Reset.
+func (dec *Decoder) Decode(out interface{}) (err error) {
+	d := &dec.d
+	if d.i >= len(d.in) {
+		return io.EOF
+	}
+	if raw, ok := out.(*Raw); ok {
+		defer handleErr(&err)
+		start := d.i
+		end := start + int(d.readInt32())
+		if end <= d.i || end > len(d.in) || d.in[end-1] != '\x00' {
+			corrupted()
+		}
+		d.i = end
+		raw.Kind = 3
+		raw.Data = d.in[start:end]
+		return nil
+	}
+	d.docType = typeM
+	return unmarshalDoc(d, out)
+}
+
 // Unmarshal deserializes raw into the out value.  If the out value type
 // is not compatible with raw, a *bson.TypeError is returned.
 //
@@ -591,6 +717,41 @@ func (raw Raw) Unmarshal(out interface{}) (err error) {
 	return nil
 }
 
+// Fields returns the raw values of the requested top-level fields of the
+// document in, skipping over all other fields without decoding them.
+// Fields missing from the document are missing from the returned map.
+// The data of the returned values refers to the in slice rather than a
+// copy of it. Once all requested fields are found, the rest of the
+// document is not inspected.
+//
+// This is useful to look at a few fields of documents at a high rate,
+// without the cost of unmarshaling the whole document.
+func Fields(in []byte, names ...string) (fields map[string]Raw, err error) {
+	defer handleErr(&err)
+	fields = make(map[string]Raw, len(names))
+	d := newDecoder(in)
+	end := int(d.readInt32())
+	if end < 5 || end > len(in) || in[end-1] != '\x00' {
+		corrupted()
+	}
+	for len(fields) < len(names) && in[d.i] != '\x00' {
+		kind := d.readByte()
+		name := d.readCStr()
+		start := d.i
+		d.skipElem(kind)
+		if d.i >= end {
+			corrupted()
+		}
+		for _, want := range names {
+			if want == name {
+				fields[name] = Raw{kind, in[start:d.i]}
+				break
+			}
+		}
+	}
+	return fields, nil
+}
+
 type TypeError struct {
 	Type reflect.Type
 	Kind byte
@@ -607,6 +768,7 @@ type structInfo struct {
 	FieldsMap  map[string]fieldInfo
 	FieldsList []fieldInfo
 	InlineMap  int
+	InlineRaw  int
 	Zero       reflect.Value
 }
 
@@ -616,6 +778,7 @@ type fieldInfo struct {
 	OmitEmpty bool
 	MinSize   bool
 	Inline    []int
+	Tagged    bool
 }
 
 var structMap = make(map[reflect.Type]*structInfo)
@@ -638,6 +801,7 @@ func getStructInfo(st reflect.Type) (*structInfo, error) {
 	fieldsMap := make(map[string]fieldInfo)
 	fieldsList := make([]fieldInfo, 0, n)
 	inlineMap := -1
+	inlineRaw := -1
 	for i := 0; i != n; i++ {
 		field := st.Field(i)
 		if field.PkgPath != "" && !field.Anonymous {
@@ -673,10 +837,18 @@ func getStructInfo(st reflect.Type) (*structInfo, error) {
 			tag = fields[0]
 		}
 
+		if inline && field.Type == typeRaw {
+			if inlineMap >= 0 || inlineRaw >= 0 {
+				return nil, errors.New("Multiple ,inline maps in struct " + st.String())
+			}
+			inlineRaw = info.Num
+			continue
+		}
+
 		if inline {
 			switch field.Type.Kind() {
 			case reflect.Map:
-				if inlineMap >= 0 {
+				if inlineMap >= 0 || inlineRaw >= 0 {
 					return nil, errors.New("Multiple ,inline maps in struct " + st.String())
 				}
 				if field.Type.Key() != reflect.TypeOf("") {
@@ -709,6 +881,7 @@ func getStructInfo(st reflect.Type) (*structInfo, error) {
 
 		if tag != "" {
 			info.Key = tag
+			info.Tagged = true
 		} else {
 			info.Key = strings.ToLower(field.Name)
 		}
@@ -725,6 +898,7 @@ func getStructInfo(st reflect.Type) (*structInfo, error) {
 		fieldsMap,
 		fieldsList,
 		inlineMap,
+		inlineRaw,
 		reflect.New(st).Elem(),
 	}
 	structMapMutex.Lock()
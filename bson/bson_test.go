@@ -33,6 +33,8 @@ import (
 	"encoding/json"
 	"encoding/xml"
 	"errors"
+	"fmt"
+	"io"
 	"net/url"
 	"reflect"
 	"strings"
@@ -1830,3 +1832,432 @@ func (s *S) BenchmarkNewObjectId(c *C) {
 		bson.NewObjectId()
 	}
 }
+
+// --------------------------------------------------------------------------
+// Raw field lookup.
+
+func (s *S) TestFields(c *C) {
+	data, err := bson.Marshal(bson.D{
+		{"a", 1},
+		{"b", "hello"},
+		{"c", bson.M{"d": []interface{}{1.5, nil, bson.Binary{Kind: 0x80, Data: []byte("x")}}}},
+		{"e", bson.RegEx{"a.*", "i"}},
+		{"f", bson.NewObjectId()},
+		{"g", int64(42)},
+	})
+	c.Assert(err, IsNil)
+
+	fields, err := bson.Fields(data, "g", "b", "missing")
+	c.Assert(err, IsNil)
+	c.Assert(fields, HasLen, 2)
+	var g int64
+	c.Assert(fields["g"].Unmarshal(&g), IsNil)
+	c.Assert(g, Equals, int64(42))
+	var b string
+	c.Assert(fields["b"].Unmarshal(&b), IsNil)
+	c.Assert(b, Equals, "hello")
+
+	fields, err = bson.Fields(data, "c")
+	c.Assert(err, IsNil)
+	c.Assert(fields["c"].Kind, Equals, byte(0x03))
+	var sub struct{ D []interface{} }
+	c.Assert(fields["c"].Unmarshal(&sub), IsNil)
+	c.Assert(sub.D, HasLen, 3)
+
+	fields, err = bson.Fields(data)
+	c.Assert(err, IsNil)
+	c.Assert(fields, HasLen, 0)
+
+	_, err = bson.Fields(data[:len(data)-3], "g")
+	c.Assert(err, ErrorMatches, "Document is corrupted")
+	_, err = bson.Fields([]byte(wrapInDoc("\x42a\x00")), "b")
+	c.Assert(err, ErrorMatches, "Unknown element kind \\(0x42\\)")
+}
+
+// --------------------------------------------------------------------------
+// Custom codec registry.
+
+type fixedPoint struct {
+	units int64
+}
+
+func encodeFixedPoint(v interface{}) (interface{}, error) {
+	fp := v.(fixedPoint)
+	return fmt.Sprintf("%d.%02d", fp.units/100, fp.units%100), nil
+}
+
+func decodeFixedPoint(raw bson.Raw, out interface{}) error {
+	var s string
+	if err := raw.Unmarshal(&s); err != nil {
+		return err
+	}
+	var whole, cents int64
+	if _, err := fmt.Sscanf(s, "%d.%d", &whole, &cents); err != nil {
+		return err
+	}
+	out.(*fixedPoint).units = whole*100 + cents
+	return nil
+}
+
+type fixedPointDoc struct {
+	Price  fixedPoint
+	Old    *fixedPoint
+	Prices []fixedPoint
+}
+
+func (s *S) TestRegistry(c *C) {
+	registry := bson.NewRegistry()
+	registry.RegisterEncoder(reflect.TypeOf(fixedPoint{}), encodeFixedPoint)
+	registry.RegisterDecoder(reflect.TypeOf(fixedPoint{}), decodeFixedPoint)
+
+	doc := fixedPointDoc{
+		Price:  fixedPoint{1250},
+		Old:    &fixedPoint{999},
+		Prices: []fixedPoint{{100}, {5}},
+	}
+	data, err := registry.Marshal(&doc)
+	c.Assert(err, IsNil)
+
+	var m bson.M
+	err = bson.Unmarshal(data, &m)
+	c.Assert(err, IsNil)
+	c.Assert(m, DeepEquals, bson.M{"price": "12.50", "old": "9.99", "prices": []interface{}{"1.00", "0.05"}})
+
+	var result fixedPointDoc
+	err = registry.Unmarshal(data, &result)
+	c.Assert(err, IsNil)
+	c.Assert(result, DeepEquals, doc)
+
+	// The default registry is left alone.
+	data, err = bson.Marshal(&doc)
+	c.Assert(err, IsNil)
+	err = bson.Unmarshal(data, &m)
+	c.Assert(err, IsNil)
+	c.Assert(m["price"], DeepEquals, bson.M{})
+
+	// Failing decoders fail unmarshaling, unless with a *TypeError.
+	data, err = bson.Marshal(bson.M{"price": "oops", "old": 1})
+	c.Assert(err, IsNil)
+	result = fixedPointDoc{}
+	err = registry.Unmarshal(data, &result)
+	c.Assert(err, ErrorMatches, "expected integer")
+}
+
+func (s *S) TestDefaultRegistry(c *C) {
+	t := reflect.TypeOf(fixedPoint{})
+	bson.DefaultRegistry.RegisterEncoder(t, encodeFixedPoint)
+	bson.DefaultRegistry.RegisterDecoder(t, decodeFixedPoint)
+	defer bson.DefaultRegistry.RegisterEncoder(t, nil)
+	defer bson.DefaultRegistry.RegisterDecoder(t, nil)
+
+	data, err := bson.Marshal(bson.M{"price": fixedPoint{42}})
+	c.Assert(err, IsNil)
+	var result fixedPointDoc
+	err = bson.Unmarshal(data, &result)
+	c.Assert(err, IsNil)
+	c.Assert(result.Price, Equals, fixedPoint{42})
+
+	fields, err := bson.Fields(data, "price")
+	c.Assert(err, IsNil)
+	var fp fixedPoint
+	err = fields["price"].Unmarshal(&fp)
+	c.Assert(err, IsNil)
+	c.Assert(fp, Equals, fixedPoint{42})
+}
+
+// --------------------------------------------------------------------------
+// Strict decoding.
+
+type strictDoc struct {
+	A int8
+	B uint16
+	C float32
+	D int64
+	E []int
+	F *strictDoc
+	G map[string]int
+	H struct{ X int }
+}
+
+var strictTests = []struct {
+	doc   bson.M
+	error string
+}{
+	{bson.M{"a": 1, "b": 2, "c": 1.5, "d": 3.0, "e": []int{1}}, ""},
+	{bson.M{"f": bson.M{"a": 1}, "g": bson.M{"x": 1}, "h": bson.M{"x": 1}}, ""},
+	{bson.M{"a": 1.0, "b": int64(65535), "c": 16777216, "d": float64(1 << 53)}, ""},
+	{bson.M{"a": true, "d": nil}, ""},
+
+	{bson.M{"z": 1}, `Unknown field "z" for type bson_test.strictDoc`},
+	{bson.M{"f": bson.M{"z": 1}}, `Unknown field "z" for type bson_test.strictDoc`},
+	{bson.M{"h": bson.M{"z": 1}}, `Unknown field "z" for type struct { X int }`},
+	{bson.M{"a": 128}, "BSON value 128 can't be stored in type int8 without loss"},
+	{bson.M{"a": 1.5}, "BSON value 1.5 can't be stored in type int8 without loss"},
+	{bson.M{"b": -1}, "BSON value -1 can't be stored in type uint16 without loss"},
+	{bson.M{"b": 65536}, "BSON value 65536 can't be stored in type uint16 without loss"},
+	{bson.M{"c": 0.1}, "BSON value 0.1 can't be stored in type float32 without loss"},
+	{bson.M{"c": 16777217}, "BSON value 16777217 can't be stored in type float32 without loss"},
+	{bson.M{"d": 1e19}, "BSON value 1e\\+19 can't be stored in type int64 without loss"},
+	{bson.M{"d": "1"}, "BSON kind 0x02 isn't compatible with type int64"},
+	{bson.M{"d": bson.M{}}, "BSON kind 0x03 isn't compatible with type int64"},
+	{bson.M{"e": []interface{}{1, "x"}}, "BSON kind 0x02 isn't compatible with type int"},
+	{bson.M{"g": bson.M{"x": 1.5}}, "BSON value 1.5 can't be stored in type int without loss"},
+}
+
+func (s *S) TestStrictUnmarshal(c *C) {
+	opts := &bson.DecodeOptions{Strict: true}
+	for i, test := range strictTests {
+		data, err := bson.Marshal(test.doc)
+		c.Assert(err, IsNil)
+
+		var result strictDoc
+		err = opts.Unmarshal(data, &result)
+		if test.error == "" {
+			c.Assert(err, IsNil, Commentf("test %d: %#v", i, test.doc))
+		} else {
+			c.Assert(err, ErrorMatches, test.error, Commentf("test %d: %#v", i, test.doc))
+		}
+
+		// Default decoding is lenient.
+		err = bson.Unmarshal(data, &result)
+		c.Assert(err, IsNil)
+	}
+}
+
+func (s *S) TestStrictUnmarshalInlineMap(c *C) {
+	var result struct {
+		A    int
+		Rest bson.M `bson:",inline"`
+	}
+	data, err := bson.Marshal(bson.M{"a": 1, "b": 2})
+	c.Assert(err, IsNil)
+	err = (&bson.DecodeOptions{Strict: true}).Unmarshal(data, &result)
+	c.Assert(err, IsNil)
+	c.Assert(result.Rest, DeepEquals, bson.M{"b": 2})
+}
+
+// --------------------------------------------------------------------------
+// Field matching policies.
+
+type fieldMatchDoc struct {
+	UserName string
+	Email    string `bson:"email"`
+	Age      int    `bson:",omitempty"`
+}
+
+var fieldMatchTests = []struct {
+	match  bson.FieldMatch
+	doc    bson.D
+	result fieldMatchDoc
+}{
+	{bson.MatchExact, bson.D{{"username", "a"}, {"email", "b"}, {"age", 1}}, fieldMatchDoc{"a", "b", 1}},
+	{bson.MatchExact, bson.D{{"UserName", "a"}, {"Email", "b"}}, fieldMatchDoc{}},
+	{bson.MatchCaseInsensitive, bson.D{{"UserName", "a"}, {"EMAIL", "b"}, {"Age", 1}}, fieldMatchDoc{"a", "b", 1}},
+	{bson.MatchCaseInsensitive, bson.D{{"username", "a"}}, fieldMatchDoc{UserName: "a"}},
+	{bson.MatchTagOnly, bson.D{{"username", "a"}, {"email", "b"}, {"age", 1}}, fieldMatchDoc{Email: "b"}},
+	{bson.MatchTagOnly, bson.D{{"Email", "b"}}, fieldMatchDoc{}},
+}
+
+func (s *S) TestUnmarshalFieldMatch(c *C) {
+	for i, test := range fieldMatchTests {
+		data, err := bson.Marshal(test.doc)
+		c.Assert(err, IsNil)
+		var result fieldMatchDoc
+		err = (&bson.DecodeOptions{FieldMatch: test.match}).Unmarshal(data, &result)
+		c.Assert(err, IsNil)
+		c.Assert(result, Equals, test.result, Commentf("test %d", i))
+	}
+}
+
+func (s *S) TestUnmarshalFieldMatchStrict(c *C) {
+	data, err := bson.Marshal(bson.M{"username": "a"})
+	c.Assert(err, IsNil)
+	var result fieldMatchDoc
+	opts := &bson.DecodeOptions{FieldMatch: bson.MatchTagOnly, Strict: true}
+	err = opts.Unmarshal(data, &result)
+	c.Assert(err, ErrorMatches, `Unknown field "username" for type bson_test.fieldMatchDoc`)
+}
+
+// --------------------------------------------------------------------------
+// Inlined Raw remainders.
+
+type inlineRawDoc struct {
+	A    int
+	Rest bson.Raw `bson:",inline"`
+}
+
+func (s *S) TestInlineRawRoundTrip(c *C) {
+	in := bson.D{{"x", "foo"}, {"a", 1}, {"y", bson.D{{"z", []int{1, 2}}}}, {"w", 1.5}}
+	data, err := bson.Marshal(in)
+	c.Assert(err, IsNil)
+
+	var doc inlineRawDoc
+	err = bson.Unmarshal(data, &doc)
+	c.Assert(err, IsNil)
+	c.Assert(doc.A, Equals, 1)
+	c.Assert(doc.Rest.Kind, Equals, byte(0x03))
+
+	var rest bson.D
+	c.Assert(doc.Rest.Unmarshal(&rest), IsNil)
+	c.Assert(rest, DeepEquals, bson.D{{"x", "foo"}, {"y", bson.D{{"z", []interface{}{1, 2}}}}, {"w", 1.5}})
+
+	doc.A = 2
+	data, err = bson.Marshal(&doc)
+	c.Assert(err, IsNil)
+	var out bson.D
+	c.Assert(bson.Unmarshal(data, &out), IsNil)
+	c.Assert(out, DeepEquals, bson.D{{"x", "foo"}, {"y", bson.D{{"z", []interface{}{1, 2}}}}, {"w", 1.5}, {"a", 2}})
+}
+
+func (s *S) TestInlineRawEmpty(c *C) {
+	data, err := bson.Marshal(bson.M{"a": 1})
+	c.Assert(err, IsNil)
+	var doc inlineRawDoc
+	c.Assert(bson.Unmarshal(data, &doc), IsNil)
+	c.Assert(doc.Rest, DeepEquals, bson.Raw{})
+
+	data, err = bson.Marshal(&doc)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc("\x10a\x00\x01\x00\x00\x00"))
+}
+
+func (s *S) TestInlineRawStrict(c *C) {
+	data, err := bson.Marshal(bson.M{"a": 1, "b": 2})
+	c.Assert(err, IsNil)
+	var doc inlineRawDoc
+	err = (&bson.DecodeOptions{Strict: true}).Unmarshal(data, &doc)
+	c.Assert(err, IsNil)
+	var rest bson.M
+	c.Assert(doc.Rest.Unmarshal(&rest), IsNil)
+	c.Assert(rest, DeepEquals, bson.M{"b": 2})
+}
+
+func (s *S) TestInlineRawConflict(c *C) {
+	data, err := bson.Marshal(bson.M{"a": 1})
+	c.Assert(err, IsNil)
+	doc := inlineRawDoc{Rest: bson.Raw{0x03, data}}
+	_, err = bson.Marshal(&doc)
+	c.Assert(err, ErrorMatches, `Can't have key "a" in inlined Raw; conflicts with struct field`)
+
+	doc = inlineRawDoc{Rest: bson.Raw{0x02, []byte("\x02\x00\x00\x00a\x00")}}
+	_, err = bson.Marshal(&doc)
+	c.Assert(err, ErrorMatches, "Inlined Raw value must hold a document, got kind 0x02")
+}
+
+// --------------------------------------------------------------------------
+// Buffer reuse.
+
+func (s *S) TestMarshalAppend(c *C) {
+	buf := []byte("prefix")
+	buf, err := bson.MarshalAppend(buf, bson.M{"a": 1})
+	c.Assert(err, IsNil)
+	buf, err = bson.MarshalAppend(buf, bson.D{{"b", "x"}})
+	c.Assert(err, IsNil)
+
+	one, _ := bson.Marshal(bson.M{"a": 1})
+	two, _ := bson.Marshal(bson.D{{"b", "x"}})
+	c.Assert(string(buf), Equals, "prefix"+string(one)+string(two))
+
+	out, err := bson.MarshalAppend(buf, 1)
+	c.Assert(err, ErrorMatches, "Can't marshal int as a BSON document")
+	c.Assert(string(out), Equals, string(buf))
+}
+
+func (s *S) TestDecoder(c *C) {
+	var buf []byte
+	for i := 0; i < 3; i++ {
+		var err error
+		buf, err = bson.MarshalAppend(buf, bson.D{{"n", i}})
+		c.Assert(err, IsNil)
+	}
+
+	dec := bson.NewDecoder(buf, nil)
+	var doc struct{ N int }
+	for i := 0; i < 3; i++ {
+		c.Assert(dec.Decode(&doc), IsNil)
+		c.Assert(doc.N, Equals, i)
+	}
+	c.Assert(dec.Decode(&doc), Equals, io.EOF)
+
+	dec.Reset(buf)
+	var raw bson.Raw
+	c.Assert(dec.Decode(&raw), IsNil)
+	c.Assert(raw.Data, DeepEquals, buf[:len(buf)/3])
+	var m bson.M
+	c.Assert(dec.Decode(&m), IsNil)
+	c.Assert(m, DeepEquals, bson.M{"n": 1})
+
+	dec.Reset(buf[:5])
+	c.Assert(dec.Decode(&raw), ErrorMatches, "Document is corrupted")
+}
+
+func (s *S) TestDecoderOptions(c *C) {
+	data, err := bson.Marshal(bson.M{"n": 1, "z": 2})
+	c.Assert(err, IsNil)
+	dec := bson.NewDecoder(data, &bson.DecodeOptions{Strict: true})
+	var doc struct{ N int }
+	c.Assert(dec.Decode(&doc), ErrorMatches, `Unknown field "z" for type struct { N int }`)
+}
+
+func (s *S) TestKindString(c *C) {
+	c.Assert(bson.KindString.String(), Equals, "string")
+	c.Assert(bson.KindObjectId.String(), Equals, "objectId")
+	c.Assert(bson.Kind(0x42).String(), Equals, "Kind(0x42)")
+}
+
+func (s *S) TestWalk(c *C) {
+	data, err := bson.Marshal(bson.D{
+		{"a", 1},
+		{"b", bson.D{{"c", "x"}, {"d", []interface{}{true, bson.D{{"e", nil}}}}}},
+		{"f", int64(2)},
+	})
+	c.Assert(err, IsNil)
+
+	var visited []string
+	err = bson.Walk(data, func(path []string, kind bson.Kind, data []byte) error {
+		visited = append(visited, strings.Join(path, ".")+" "+kind.String())
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(visited, DeepEquals, []string{
+		"a int",
+		"b object",
+		"b.c string",
+		"b.d array",
+		"b.d.0 bool",
+		"b.d.1 object",
+		"b.d.1.e null",
+		"f long",
+	})
+
+	// Values are provided raw.
+	var value string
+	err = bson.Walk(data, func(path []string, kind bson.Kind, data []byte) error {
+		if kind == bson.KindString {
+			c.Assert(bson.Raw{byte(kind), data}.Unmarshal(&value), IsNil)
+		}
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, "x")
+
+	// Children may be skipped, and errors stop the walk.
+	visited = nil
+	stop := errors.New("stop")
+	err = bson.Walk(data, func(path []string, kind bson.Kind, data []byte) error {
+		visited = append(visited, strings.Join(path, "."))
+		if path[0] == "f" {
+			return stop
+		}
+		if kind == bson.KindDocument {
+			return bson.SkipChildren
+		}
+		return nil
+	})
+	c.Assert(err, Equals, stop)
+	c.Assert(visited, DeepEquals, []string{"a", "b", "f"})
+
+	// Corrupted documents fail.
+	err = bson.Walk(data[:len(data)-1], func([]string, bson.Kind, []byte) error { return nil })
+	c.Assert(err, ErrorMatches, "Document is corrupted")
+}
@@ -33,20 +33,24 @@ import (
 	"net/url"
 	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 type decoder struct {
-	in      []byte
-	i       int
-	docType reflect.Type
+	in       []byte
+	i        int
+	docType  reflect.Type
+	registry *Registry
+	strict   bool
+	match    FieldMatch
 }
 
 var typeM = reflect.TypeOf(M{})
 
 func newDecoder(in []byte) *decoder {
-	return &decoder{in, 0, typeM}
+	return &decoder{in, 0, typeM, DefaultRegistry, false, MatchExact}
 }
 
 // --------------------------------------------------------------------------
@@ -102,7 +106,17 @@ func setterStyle(outt reflect.Type) int {
 	return style
 }
 
-func getSetter(outt reflect.Type, out reflect.Value) Setter {
+// hasSetter returns whether values of type outt are unmarshaled by a
+// Setter, either implemented by the type or by a registered decoder.
+func (d *decoder) hasSetter(outt reflect.Type) bool {
+	return setterStyle(outt) != setterNone || d.registry.setter(outt, reflect.Value{}) != nil
+}
+
+// getSetter returns the Setter for out, if any.
+func (d *decoder) getSetter(outt reflect.Type, out reflect.Value) Setter {
+	if setter := d.registry.setter(outt, out); setter != nil {
+		return setter
+	}
 	style := setterStyle(outt)
 	if style == setterNone {
 		return nil
@@ -134,7 +148,7 @@ func (d *decoder) readDocTo(out reflect.Value) {
 		if outk == reflect.Ptr && out.IsNil() {
 			out.Set(reflect.New(outt.Elem()))
 		}
-		if setter := getSetter(outt, out); setter != nil {
+		if setter := d.getSetter(outt, out); setter != nil {
 			var raw Raw
 			d.readDocTo(reflect.ValueOf(&raw))
 			err := setter.SetBSON(raw)
@@ -152,8 +166,10 @@ func (d *decoder) readDocTo(out reflect.Value) {
 		break
 	}
 
-	var fieldsMap map[string]fieldInfo
+	var fieldsInfo *structInfo
 	var inlineMap reflect.Value
+	var inlineRaw reflect.Value
+	var rawElems []byte
 	start := d.i
 
 	origout := out
@@ -198,7 +214,7 @@ func (d *decoder) readDocTo(out reflect.Value) {
 			if err != nil {
 				panic(err)
 			}
-			fieldsMap = sinfo.FieldsMap
+			fieldsInfo = sinfo
 			out.Set(sinfo.Zero)
 			if sinfo.InlineMap != -1 {
 				inlineMap = out.Field(sinfo.InlineMap)
@@ -210,6 +226,9 @@ func (d *decoder) readDocTo(out reflect.Value) {
 					d.docType = inlineMap.Type()
 				}
 			}
+			if sinfo.InlineRaw != -1 {
+				inlineRaw = out.Field(sinfo.InlineRaw)
+			}
 		}
 	case reflect.Slice:
 		switch outt.Elem() {
@@ -231,6 +250,7 @@ func (d *decoder) readDocTo(out reflect.Value) {
 		corrupted()
 	}
 	for d.in[d.i] != '\x00' {
+		elemStart := d.i
 		kind := d.readByte()
 		name := d.readCStr()
 		if d.i >= end {
@@ -240,7 +260,7 @@ func (d *decoder) readDocTo(out reflect.Value) {
 		switch outk {
 		case reflect.Map:
 			e := reflect.New(elemType).Elem()
-			if d.readElemTo(e, kind) {
+			if d.readElemToStrict(e, kind) {
 				k := reflect.ValueOf(name)
 				if convertKey {
 					k = k.Convert(keyType)
@@ -251,20 +271,25 @@ func (d *decoder) readDocTo(out reflect.Value) {
 			if outt == typeRaw {
 				d.dropElem(kind)
 			} else {
-				if info, ok := fieldsMap[name]; ok {
+				if info, ok := d.lookupField(fieldsInfo, name); ok {
 					if info.Inline == nil {
-						d.readElemTo(out.Field(info.Num), kind)
+						d.readElemToStrict(out.Field(info.Num), kind)
 					} else {
-						d.readElemTo(out.FieldByIndex(info.Inline), kind)
+						d.readElemToStrict(out.FieldByIndex(info.Inline), kind)
 					}
 				} else if inlineMap.IsValid() {
 					if inlineMap.IsNil() {
 						inlineMap.Set(reflect.MakeMap(inlineMap.Type()))
 					}
 					e := reflect.New(elemType).Elem()
-					if d.readElemTo(e, kind) {
+					if d.readElemToStrict(e, kind) {
 						inlineMap.SetMapIndex(reflect.ValueOf(name), e)
 					}
+				} else if inlineRaw.IsValid() {
+					d.dropElem(kind)
+					rawElems = append(rawElems, d.in[elemStart:d.i]...)
+				} else if d.strict {
+					panic(fmt.Sprintf("Unknown field %q for type %s", name, outt.String()))
 				} else {
 					d.dropElem(kind)
 				}
@@ -282,6 +307,14 @@ func (d *decoder) readDocTo(out reflect.Value) {
 	}
 	d.docType = docType
 
+	if rawElems != nil {
+		e := &encoder{out: make([]byte, 0, len(rawElems)+5)}
+		e.addInt32(int32(len(rawElems) + 5))
+		e.addBytes(rawElems...)
+		e.addBytes(0)
+		inlineRaw.Set(reflect.ValueOf(Raw{0x03, e.out}))
+	}
+
 	if outt == typeRaw {
 		out.Set(reflect.ValueOf(Raw{0x03, d.in[start:d.i]}))
 	}
@@ -307,7 +340,7 @@ func (d *decoder) readArrayDocTo(out reflect.Value) {
 			corrupted()
 		}
 		d.i++
-		d.readElemTo(out.Index(i), kind)
+		d.readElemToStrict(out.Index(i), kind)
 		if d.i >= end {
 			corrupted()
 		}
@@ -345,7 +378,7 @@ func (d *decoder) readSliceDoc(t reflect.Type) interface{} {
 		}
 		d.i++
 		e := reflect.New(elemType).Elem()
-		if d.readElemTo(e, kind) {
+		if d.readElemToStrict(e, kind) {
 			tmp = append(tmp, e)
 		}
 		if d.i >= end {
@@ -425,13 +458,121 @@ func (d *decoder) readDocWith(f func(kind byte, name string)) {
 	}
 }
 
+// skipElem moves past an element of the given kind without decoding it.
+func (d *decoder) skipElem(kind byte) {
+	switch kind {
+	case 0x06, 0x0A, 0x7F, 0xFF: // Undefined, null, max key, min key
+	case 0x08: // Bool
+		d.readBytes(1)
+	case 0x10: // Int32
+		d.readBytes(4)
+	case 0x01, 0x09, 0x11, 0x12: // Float64, timestamp, datetime, int64
+		d.readBytes(8)
+	case 0x07: // ObjectId
+		d.readBytes(12)
+	case 0x13: // Decimal128
+		d.readBytes(16)
+	case 0x02, 0x0D, 0x0E: // String, JavaScript, symbol
+		d.readBytes(d.readInt32())
+	case 0x03, 0x04, 0x0F: // Document, array, JavaScript with scope
+		d.readBytes(d.readInt32() - 4)
+	case 0x05: // Binary
+		d.readBytes(d.readInt32() + 1)
+	case 0x0B: // RegEx
+		d.readCStr()
+		d.readCStr()
+	case 0x0C: // DBPointer
+		d.readBytes(d.readInt32())
+		d.readBytes(12)
+	default:
+		panic(fmt.Sprintf("Unknown element kind (0x%02X)", kind))
+	}
+}
+
 // --------------------------------------------------------------------------
 // Unmarshaling of individual elements within a document.
 
 var blackHole = settableValueOf(struct{}{})
 
 func (d *decoder) dropElem(kind byte) {
+	strict := d.strict
+	d.strict = false
 	d.readElemTo(blackHole, kind)
+	d.strict = strict
+}
+
+// lookupField returns the field of sinfo that the document key name
+// maps to under the decoder's field matching policy.
+func (d *decoder) lookupField(sinfo *structInfo, name string) (fieldInfo, bool) {
+	info, ok := sinfo.FieldsMap[name]
+	switch d.match {
+	case MatchCaseInsensitive:
+		if !ok {
+			for _, info := range sinfo.FieldsList {
+				if strings.EqualFold(info.Key, name) {
+					return info, true
+				}
+			}
+		}
+	case MatchTagOnly:
+		if ok && !info.Tagged {
+			return fieldInfo{}, false
+		}
+	}
+	return info, ok
+}
+
+// readElemToStrict works like readElemTo, but in strict mode it fails
+// rather than skipping values that are incompatible with out.
+func (d *decoder) readElemToStrict(out reflect.Value, kind byte) (good bool) {
+	good = d.readElemTo(out, kind)
+	if !good && d.strict {
+		panic(&TypeError{out.Type(), kind})
+	}
+	return good
+}
+
+// checkLossless fails in strict mode if converting in to a value of type
+// outt would lose information.
+func (d *decoder) checkLossless(in reflect.Value, outt reflect.Type) {
+	if !d.strict {
+		return
+	}
+	lossless := true
+	switch outk := outt.Kind(); {
+	case outk >= reflect.Int && outk <= reflect.Int64:
+		switch in.Kind() {
+		case reflect.Int, reflect.Int64:
+			lossless = !reflect.Zero(outt).OverflowInt(in.Int())
+		case reflect.Float64:
+			f := in.Float()
+			lossless = f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 && !reflect.Zero(outt).OverflowInt(int64(f))
+		}
+	case outk >= reflect.Uint && outk <= reflect.Uintptr:
+		switch in.Kind() {
+		case reflect.Int, reflect.Int64:
+			lossless = in.Int() >= 0 && !reflect.Zero(outt).OverflowUint(uint64(in.Int()))
+		case reflect.Float64:
+			f := in.Float()
+			lossless = f == math.Trunc(f) && f >= 0 && f < math.MaxUint64 && !reflect.Zero(outt).OverflowUint(uint64(f))
+		}
+	case outk == reflect.Float32 || outk == reflect.Float64:
+		switch in.Kind() {
+		case reflect.Int, reflect.Int64:
+			i := in.Int()
+			if outk == reflect.Float32 {
+				lossless = int64(float32(i)) == i
+			} else {
+				lossless = int64(float64(i)) == i
+			}
+		case reflect.Float64:
+			f := in.Float()
+			lossless = outk == reflect.Float64 || f != f || float64(float32(f)) == f
+		}
+	}
+	if !lossless {
+		panic(fmt.Sprintf("BSON value %v can't be stored in type %s without loss", in.Interface(), outt.String()))
+	}
 }
 
 // Attempt to decode an element from the document and put it into out.
@@ -450,7 +591,7 @@ func (d *decoder) readElemTo(out reflect.Value, kind byte) (good bool) {
 			d.readDocTo(out)
 			return true
 		}
-		if setterStyle(outt) != setterNone {
+		if d.hasSetter(outt) {
 			d.readDocTo(out)
 			return true
 		}
@@ -458,12 +599,14 @@ func (d *decoder) readElemTo(out reflect.Value, kind byte) (good bool) {
 			switch outt.Elem() {
 			case typeDocElem:
 				out.Set(d.readDocElems(outt))
+				return true
 			case typeRawDocElem:
 				out.Set(d.readRawDocElems(outt))
-			default:
-				d.readDocTo(blackHole)
+				return true
 			}
-			return true
+		}
+		if d.strict {
+			panic(&TypeError{outt, kind})
 		}
 		d.readDocTo(blackHole)
 		return true
@@ -480,7 +623,7 @@ func (d *decoder) readElemTo(out reflect.Value, kind byte) (good bool) {
 		panic("Can't happen. Handled above.")
 	case 0x04: // Array
 		outt := out.Type()
-		if setterStyle(outt) != setterNone {
+		if d.hasSetter(outt) {
 			// Skip the value so its data is handed to the setter below.
 			d.dropElem(kind)
 			break
@@ -559,7 +702,7 @@ func (d *decoder) readElemTo(out reflect.Value, kind byte) (good bool) {
 		return true
 	}
 
-	if setter := getSetter(outt, out); setter != nil {
+	if setter := d.getSetter(outt, out); setter != nil {
 		err := setter.SetBSON(Raw{kind, d.in[start:d.i]})
 		if err == SetZero {
 			out.Set(reflect.Zero(outt))
@@ -611,6 +754,8 @@ func (d *decoder) readElemTo(out reflect.Value, kind byte) (good bool) {
 		return true
 	}
 
+	d.checkLossless(inv, outt)
+
 	switch outk {
 	case reflect.Interface:
 		out.Set(inv)
@@ -78,11 +78,20 @@ func itoa(i int) string {
 // Marshaling of the document value itself.
 
 type encoder struct {
-	out []byte
+	out      []byte
+	registry *Registry
 }
 
 func (e *encoder) addDoc(v reflect.Value) {
 	for {
+		if enc := e.registry.encoder(v.Type()); enc != nil {
+			encv, err := enc(v.Interface())
+			if err != nil {
+				panic(err)
+			}
+			v = reflect.ValueOf(encv)
+			continue
+		}
 		if vi, ok := v.Interface().(Getter); ok {
 			getv, err := vi.GetBSON()
 			if err != nil {
@@ -151,6 +160,9 @@ func (e *encoder) addStruct(v reflect.Value) {
 			}
 		}
 	}
+	if sinfo.InlineRaw >= 0 {
+		e.addInlineRaw(sinfo, v.Field(sinfo.InlineRaw).Interface().(Raw))
+	}
 	for _, info := range sinfo.FieldsList {
 		if info.Inline == nil {
 			value = v.Field(info.Num)
@@ -164,6 +176,35 @@ func (e *encoder) addStruct(v reflect.Value) {
 	}
 }
 
+// addInlineRaw adds the elements of the raw document held in an inlined
+// Raw field, copying their original encoding.
+func (e *encoder) addInlineRaw(sinfo *structInfo, raw Raw) {
+	if raw.Kind == 0 && raw.Data == nil {
+		return
+	}
+	if raw.Kind != 0x03 {
+		panic(fmt.Sprintf("Inlined Raw value must hold a document, got kind 0x%02x", raw.Kind))
+	}
+	d := newDecoder(raw.Data)
+	end := int(d.readInt32())
+	if end < 5 || end > len(d.in) || d.in[end-1] != '\x00' {
+		corrupted()
+	}
+	for d.in[d.i] != '\x00' {
+		start := d.i
+		kind := d.readByte()
+		name := d.readCStr()
+		if _, found := sinfo.FieldsMap[name]; found {
+			panic(fmt.Sprintf("Can't have key %q in inlined Raw; conflicts with struct field", name))
+		}
+		d.dropElem(kind)
+		if d.i >= end {
+			corrupted()
+		}
+		e.addBytes(d.in[start:d.i]...)
+	}
+}
+
 func isZero(v reflect.Value) bool {
 	switch v.Kind() {
 	case reflect.String:
@@ -251,6 +292,15 @@ func (e *encoder) addElem(name string, v reflect.Value, minSize bool) {
 		return
 	}
 
+	if enc := e.registry.encoder(v.Type()); enc != nil {
+		encv, err := enc(v.Interface())
+		if err != nil {
+			panic(err)
+		}
+		e.addElem(name, reflect.ValueOf(encv), minSize)
+		return
+	}
+
 	if getter, ok := v.Interface().(Getter); ok {
 		getv, err := getter.GetBSON()
 		if err != nil {
@@ -0,0 +1,163 @@
+// BSON library for Go
+//
+// Copyright (c) 2010-2012 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package bson
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// EncoderFunc returns the value to be marshaled in place of v, which
+// holds a value of the type the function was registered for. It works
+// like the GetBSON method of the Getter interface.
+type EncoderFunc func(v interface{}) (interface{}, error)
+
+// DecoderFunc unmarshals raw into out, which is a pointer to a new value
+// of the type the function was registered for. It works like the SetBSON
+// method of the Setter interface, including the handling of SetZero and
+// of *TypeError results.
+type DecoderFunc func(raw Raw, out interface{}) error
+
+// A Registry holds custom encoders and decoders for Go types, which take
+// precedence over the Getter and Setter interfaces and over the built-in
+// handling of the types. It allows customizing the marshaling of types
+// that cannot implement these interfaces, such as decimal types from
+// third-party packages.
+//
+// Registries are safe for concurrent use, but they should be set up
+// before being used for marshaling.
+type Registry struct {
+	m        sync.RWMutex
+	size     int32
+	encoders map[reflect.Type]EncoderFunc
+	decoders map[reflect.Type]DecoderFunc
+}
+
+// DefaultRegistry is the registry used by the Marshal and Unmarshal
+// functions and by the Raw.Unmarshal method. It's initially empty.
+var DefaultRegistry = NewRegistry()
+
+// NewRegistry returns a new empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		encoders: make(map[reflect.Type]EncoderFunc),
+		decoders: make(map[reflect.Type]DecoderFunc),
+	}
+}
+
+// RegisterEncoder sets enc as the encoder for values of type t.
+// A nil enc removes any encoder previously registered for t.
+func (r *Registry) RegisterEncoder(t reflect.Type, enc EncoderFunc) {
+	r.m.Lock()
+	if enc == nil {
+		delete(r.encoders, t)
+	} else {
+		r.encoders[t] = enc
+	}
+	atomic.StoreInt32(&r.size, int32(len(r.encoders)+len(r.decoders)))
+	r.m.Unlock()
+}
+
+// RegisterDecoder sets dec as the decoder for values of type t, which is
+// also used for values of type *t. A nil dec removes any decoder
+// previously registered for t.
+func (r *Registry) RegisterDecoder(t reflect.Type, dec DecoderFunc) {
+	r.m.Lock()
+	if dec == nil {
+		delete(r.decoders, t)
+	} else {
+		r.decoders[t] = dec
+	}
+	atomic.StoreInt32(&r.size, int32(len(r.encoders)+len(r.decoders)))
+	r.m.Unlock()
+}
+
+// Marshal works like the Marshal function, but consults r rather than
+// DefaultRegistry.
+func (r *Registry) Marshal(in interface{}) (out []byte, err error) {
+	defer handleErr(&err)
+	e := &encoder{make([]byte, 0, initialBufferSize), r}
+	e.addDoc(reflect.ValueOf(in))
+	return e.out, nil
+}
+
+// Unmarshal works like the Unmarshal function, but consults r rather
+// than DefaultRegistry.
+func (r *Registry) Unmarshal(in []byte, out interface{}) error {
+	return (&DecodeOptions{Registry: r}).Unmarshal(in, out)
+}
+
+// encoder returns the encoder registered for t, if any.
+func (r *Registry) encoder(t reflect.Type) EncoderFunc {
+	if r == nil || atomic.LoadInt32(&r.size) == 0 {
+		return nil
+	}
+	r.m.RLock()
+	enc := r.encoders[t]
+	r.m.RUnlock()
+	return enc
+}
+
+// setter returns a Setter that unmarshals into out with the decoder
+// registered for outt, or for the element type of outt if it's a pointer.
+func (r *Registry) setter(outt reflect.Type, out reflect.Value) Setter {
+	if r == nil || atomic.LoadInt32(&r.size) == 0 {
+		return nil
+	}
+	r.m.RLock()
+	defer r.m.RUnlock()
+	if dec := r.decoders[outt]; dec != nil {
+		return &decoderSetter{dec, outt, out, false}
+	}
+	if outt.Kind() == reflect.Ptr {
+		if dec := r.decoders[outt.Elem()]; dec != nil {
+			return &decoderSetter{dec, outt.Elem(), out, true}
+		}
+	}
+	return nil
+}
+
+type decoderSetter struct {
+	dec DecoderFunc
+	typ reflect.Type
+	out reflect.Value
+	ptr bool
+}
+
+func (s *decoderSetter) SetBSON(raw Raw) error {
+	v := reflect.New(s.typ)
+	if err := s.dec(raw, v.Interface()); err != nil {
+		return err
+	}
+	if s.ptr {
+		s.out.Set(v)
+	} else {
+		s.out.Set(v.Elem())
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+// BSON library for Go
+//
+// Copyright (c) 2010-2012 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package bson
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kind identifies the kind of a BSON element, as defined by the BSON
+// specification. It's the type of the Kind field of Raw values, which
+// holds it as a plain byte for compatibility.
+type Kind byte
+
+// Element kinds defined by the BSON specification.
+const (
+	KindFloat64             Kind = 0x01
+	KindString              Kind = 0x02
+	KindDocument            Kind = 0x03
+	KindArray               Kind = 0x04
+	KindBinary              Kind = 0x05
+	KindUndefined           Kind = 0x06
+	KindObjectId            Kind = 0x07
+	KindBool                Kind = 0x08
+	KindDateTime            Kind = 0x09
+	KindNull                Kind = 0x0A
+	KindRegEx               Kind = 0x0B
+	KindDBPointer           Kind = 0x0C
+	KindJavaScript          Kind = 0x0D
+	KindSymbol              Kind = 0x0E
+	KindJavaScriptWithScope Kind = 0x0F
+	KindInt32               Kind = 0x10
+	KindTimestamp           Kind = 0x11
+	KindInt64               Kind = 0x12
+	KindDecimal128          Kind = 0x13
+	KindMinKey              Kind = 0xFF
+	KindMaxKey              Kind = 0x7F
+)
+
+var kindNames = map[Kind]string{
+	KindFloat64:             "double",
+	KindString:              "string",
+	KindDocument:            "object",
+	KindArray:               "array",
+	KindBinary:              "binData",
+	KindUndefined:           "undefined",
+	KindObjectId:            "objectId",
+	KindBool:                "bool",
+	KindDateTime:            "date",
+	KindNull:                "null",
+	KindRegEx:               "regex",
+	KindDBPointer:           "dbPointer",
+	KindJavaScript:          "javascript",
+	KindSymbol:              "symbol",
+	KindJavaScriptWithScope: "javascriptWithScope",
+	KindInt32:               "int",
+	KindTimestamp:           "timestamp",
+	KindInt64:               "long",
+	KindDecimal128:          "decimal",
+	KindMinKey:              "minKey",
+	KindMaxKey:              "maxKey",
+}
+
+// String returns the alias MongoDB uses for the kind in $type queries,
+// such as "string" or "objectId".
+func (k Kind) String() string {
+	if name, ok := kindNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("Kind(0x%02X)", byte(k))
+}
+
+// SkipChildren may be returned by a WalkFunc called for a document or
+// array to have Walk skip over the elements within it.
+var SkipChildren = errors.New("skip children")
+
+// WalkFunc is called by Walk for each element visited. The path holds
+// the keys leading to the element, with its own key last, and is only
+// valid during the call. The data holds the element value as in the
+// Data field of Raw, and refers to the walked document rather than a
+// copy of it.
+//
+// If the function returns an error, walking stops and Walk returns it,
+// except for SkipChildren, which skips the elements of the document or
+// array the function was called for.
+type WalkFunc func(path []string, kind Kind, data []byte) error
+
+// Walk calls fn for every element of the document in data, in order,
+// descending into embedded documents and arrays after they're visited
+// themselves. Array elements have their indexes as keys. Values are not
+// decoded, which makes walking suitable for inspecting documents at a
+// high rate, as done by sanitizers and schema inference tools.
+//
+// Walk returns an error if the document is corrupted, in which case fn
+// may have been called for the elements preceding the corruption.
+func Walk(data []byte, fn WalkFunc) (err error) {
+	defer handleErr(&err)
+	return walkDoc(data, make([]string, 0, 8), fn)
+}
+
+func walkDoc(in []byte, path []string, fn WalkFunc) error {
+	d := newDecoder(in)
+	end := int(d.readInt32())
+	if end < 5 || end > len(in) || in[end-1] != '\x00' {
+		corrupted()
+	}
+	for in[d.i] != '\x00' {
+		kind := d.readByte()
+		name := d.readCStr()
+		start := d.i
+		d.skipElem(kind)
+		if d.i >= end {
+			corrupted()
+		}
+		path := append(path, name)
+		err := fn(path, Kind(kind), in[start:d.i])
+		if err == SkipChildren {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if kind == 0x03 || kind == 0x04 {
+			if err := walkDoc(in[start:d.i], path, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
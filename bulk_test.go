@@ -27,6 +27,8 @@
 package mgo_test
 
 import (
+	"strings"
+
 	. "gopkg.in/check.v1"
 	"gopkg.in/mgo.v2"
 )
@@ -131,6 +133,91 @@ func (s *S) TestBulkInsertErrorUnorderedSplitBatch(c *C) {
 	c.Assert(res.Id, Equals, 1500)
 }
 
+func (s *S) TestInsertSplitBySize(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+
+	// 40 documents of 1MB can't fit in a single 16MB write command.
+	const total = 40
+	type doc struct {
+		Id   int `_id`
+		Blob string
+	}
+	blob := strings.Repeat("x", 1024*1024)
+	docs := make([]interface{}, total)
+	for i := 0; i < total; i++ {
+		docs[i] = doc{i, blob}
+	}
+	err = coll.Insert(docs...)
+	c.Assert(err, IsNil)
+
+	n, err := coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, total)
+
+	// Errors in later batches are reported with their index in the
+	// whole operation, and ordered operations stop at the first error.
+	bulk := coll.Bulk()
+	for i := 0; i < total; i++ {
+		bulk.Insert(doc{total + i, blob})
+	}
+	bulk.Insert(doc{total + 35, blob})
+	bulk.Insert(doc{total * 3, blob})
+	_, err = bulk.Run()
+	c.Assert(err, ErrorMatches, ".*duplicate key.*")
+	ecases := err.(*mgo.BulkError).Cases()
+	c.Assert(ecases, HasLen, 1)
+	c.Assert(ecases[0].Index, Equals, total)
+
+	n, err = coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, total*2)
+}
+
+func (s *S) TestBulkUpdateSplitBatch(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+
+	const total = 2500
+	bulk := coll.Bulk()
+	for i := 0; i < total; i++ {
+		bulk.Insert(M{"_id": i, "n": 0})
+	}
+	_, err = bulk.Run()
+	c.Assert(err, IsNil)
+
+	bulk = coll.Bulk()
+	for i := 0; i < total; i++ {
+		bulk.Update(M{"_id": i}, M{"$inc": M{"n": 1}})
+	}
+	r, err := bulk.Run()
+	c.Assert(err, IsNil)
+	c.Assert(r.Matched, Equals, total)
+	c.Assert(r.Modified, Equals, total)
+
+	n, err := coll.Find(M{"n": 1}).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, total)
+
+	bulk = coll.Bulk()
+	for i := 0; i < total; i++ {
+		bulk.Remove(M{"_id": i})
+	}
+	r, err = bulk.Run()
+	c.Assert(err, IsNil)
+	c.Assert(r.Matched, Equals, total)
+
+	n, err = coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 0)
+}
+
 func (s *S) TestBulkErrorString(c *C) {
 	session, err := mgo.Dial("localhost:40001")
 	c.Assert(err, IsNil)
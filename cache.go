@@ -0,0 +1,314 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// QueryCache is implemented by caches holding query results, for use
+// with Session.SetQueryCache and Query.Cache.
+//
+// Keys are derived from the collection name and the normalized query
+// shape and parameters, and values are opaque to the cache. The driver
+// calls Invalidate after every write made through a session holding the
+// cache, so entries for the affected collection are dropped. Writes made
+// elsewhere are only observed once cached entries expire.
+//
+// Implementations must be safe for concurrent use.
+type QueryCache interface {
+	// Get returns the value cached under key, if present and not expired.
+	Get(key string) (value []byte, ok bool)
+
+	// Set caches value under key for the given duration. The collection
+	// is the full name of the collection the key refers to.
+	Set(collection, key string, value []byte, ttl time.Duration)
+
+	// Invalidate drops all entries for the given full collection name.
+	Invalidate(collection string)
+}
+
+// NewQueryCache returns an in-memory QueryCache holding up to maxEntries
+// results, dropping the least recently used ones when full.
+func NewQueryCache(maxEntries int) QueryCache {
+	return &memoryCache{
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		byColl:     make(map[string]map[string]bool),
+		lru:        list.New(),
+	}
+}
+
+type memoryCache struct {
+	m          sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element
+	byColl     map[string]map[string]bool
+	lru        *list.List
+}
+
+type memoryCacheEntry struct {
+	key        string
+	collection string
+	value      []byte
+	expires    time.Time
+}
+
+func (mc *memoryCache) Get(key string) (value []byte, ok bool) {
+	mc.m.Lock()
+	defer mc.m.Unlock()
+	elem := mc.entries[key]
+	if elem == nil {
+		return nil, false
+	}
+	entry := elem.Value.(*memoryCacheEntry)
+	if time.Now().After(entry.expires) {
+		mc.remove(elem)
+		return nil, false
+	}
+	mc.lru.MoveToFront(elem)
+	return entry.value, true
+}
+
+func (mc *memoryCache) Set(collection, key string, value []byte, ttl time.Duration) {
+	mc.m.Lock()
+	defer mc.m.Unlock()
+	if elem := mc.entries[key]; elem != nil {
+		mc.remove(elem)
+	}
+	entry := &memoryCacheEntry{key, collection, value, time.Now().Add(ttl)}
+	mc.entries[key] = mc.lru.PushFront(entry)
+	keys := mc.byColl[collection]
+	if keys == nil {
+		keys = make(map[string]bool)
+		mc.byColl[collection] = keys
+	}
+	keys[key] = true
+	for mc.maxEntries > 0 && mc.lru.Len() > mc.maxEntries {
+		mc.remove(mc.lru.Back())
+	}
+}
+
+func (mc *memoryCache) Invalidate(collection string) {
+	mc.m.Lock()
+	defer mc.m.Unlock()
+	for key := range mc.byColl[collection] {
+		mc.remove(mc.entries[key])
+	}
+}
+
+// remove must be called with mc.m held.
+func (mc *memoryCache) remove(elem *list.Element) {
+	entry := mc.lru.Remove(elem).(*memoryCacheEntry)
+	delete(mc.entries, entry.key)
+	keys := mc.byColl[entry.collection]
+	delete(keys, entry.key)
+	if len(keys) == 0 {
+		delete(mc.byColl, entry.collection)
+	}
+}
+
+// SetQueryCache sets the cache used by queries made with Query.Cache in
+// the session and in sessions later created from it via Copy, Clone, or
+// New. Writes through any of these sessions invalidate cached results
+// for the affected collection. A nil cache disables caching.
+func (s *Session) SetQueryCache(cache QueryCache) {
+	s.m.Lock()
+	s.queryCache = cache
+	s.m.Unlock()
+}
+
+func (s *Session) getQueryCache() QueryCache {
+	s.m.RLock()
+	cache := s.queryCache
+	s.m.RUnlock()
+	return cache
+}
+
+// invalidateCache drops cached query results for the given full
+// collection name, if the session has a query cache.
+func (s *Session) invalidateCache(collection string) {
+	if cache := s.getQueryCache(); cache != nil {
+		cache.Invalidate(collection)
+	}
+}
+
+// Cache enables caching the results of One and All for the given
+// duration in the cache set via Session.SetQueryCache. Identical queries
+// on the same collection share cached results until they expire or a
+// write through the session invalidates them, regardless of the session
+// mode or the server that would run them. Cache has no effect if the
+// session has no cache set.
+func (q *Query) Cache(ttl time.Duration) *Query {
+	q.m.Lock()
+	q.cacheTTL = ttl
+	q.m.Unlock()
+	return q
+}
+
+// cacheKeyDoc holds the query shape and parameters identifying cached results.
+type cacheKeyDoc struct {
+	Collection string
+	Query      interface{}
+	Selector   interface{}
+	Options    queryWrapper
+	Skip       int32
+	Limit      int32
+	One        bool
+}
+
+// cacheEntry is the cached value of query results.
+type cacheEntry struct {
+	Docs bson.Raw "d"
+}
+
+// cachedQuery runs fetch and caches its results if the query has caching
+// enabled, or unmarshals into result the cached results of a previous
+// identical query, if present. The result is unmarshaled from an array
+// of documents, so it must be a pointer to a slice unless one is true.
+func (q *Query) cachedQuery(one bool, result interface{}, fetch func(docs *[]bson.Raw) error) (cached bool, err error) {
+	q.m.Lock()
+	session := q.session
+	op := q.op // Copy.
+	limit := q.limit
+	ttl := q.cacheTTL
+	q.m.Unlock()
+
+	if ttl <= 0 {
+		return false, nil
+	}
+	cache := session.getQueryCache()
+	if cache == nil {
+		return false, nil
+	}
+
+	query, err := normalizeFilter(op.query)
+	if err != nil {
+		return true, err
+	}
+	op.options.Query = nil
+	keyData, err := bson.Marshal(&cacheKeyDoc{op.collection, query, op.selector, op.options, op.skip, limit, one})
+	if err != nil {
+		return true, err
+	}
+	sum := sha256.Sum256(keyData)
+	key := op.collection + ":" + hex.EncodeToString(sum[:])
+
+	data, ok := cache.Get(key)
+	if ok {
+		debugf("Query %p results found in cache", q)
+	} else {
+		var docs []bson.Raw
+		if err := fetch(&docs); err != nil && err != ErrNotFound {
+			return true, err
+		}
+		data, err = bson.Marshal(bson.D{{"d", docs}})
+		if err != nil {
+			return true, err
+		}
+		cache.Set(op.collection, key, data, ttl)
+	}
+
+	var entry cacheEntry
+	if err := bson.Unmarshal(data, &entry); err != nil {
+		return true, err
+	}
+	if !one {
+		return true, entry.Docs.Unmarshal(result)
+	}
+	var docs []bson.Raw
+	if err := entry.Docs.Unmarshal(&docs); err != nil {
+		return true, err
+	}
+	if len(docs) == 0 {
+		return true, ErrNotFound
+	}
+	if result != nil {
+		return true, docs[0].Unmarshal(result)
+	}
+	return true, nil
+}
+
+// normalizeFilter returns the query filter with the order of fields
+// canonicalized wherever it doesn't change the query meaning, so that
+// filters built from maps produce the same cache key. Fields are sorted
+// in the top-level document, in the elements of $and, $or, and $nor, and
+// in documents holding only operators. Other embedded documents may be
+// matched by exact equality, so their field order is preserved.
+func normalizeFilter(filter interface{}) (interface{}, error) {
+	if filter == nil {
+		return nil, nil
+	}
+	data, err := bson.Marshal(filter)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.D
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return normalizeDoc(doc, true), nil
+}
+
+func normalizeDoc(doc bson.D, sortFields bool) bson.D {
+	if !sortFields {
+		for _, elem := range doc {
+			if !strings.HasPrefix(elem.Name, "$") {
+				return doc
+			}
+		}
+	}
+	for i, elem := range doc {
+		switch value := elem.Value.(type) {
+		case bson.D:
+			doc[i].Value = normalizeDoc(value, false)
+		case []interface{}:
+			logical := elem.Name == "$and" || elem.Name == "$or" || elem.Name == "$nor"
+			for j, item := range value {
+				if itemDoc, ok := item.(bson.D); ok {
+					value[j] = normalizeDoc(itemDoc, logical)
+				}
+			}
+		}
+	}
+	sort.Sort(docByName(doc))
+	return doc
+}
+
+type docByName bson.D
+
+func (d docByName) Len() int           { return len(d) }
+func (d docByName) Less(i, j int) bool { return d[i].Name < d[j].Name }
+func (d docByName) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
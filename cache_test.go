@@ -0,0 +1,113 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo_test
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (s *S) TestQueryCacheEntries(c *C) {
+	cache := mgo.NewQueryCache(2)
+
+	cache.Set("db.a", "k1", []byte("v1"), time.Hour)
+	cache.Set("db.a", "k2", []byte("v2"), time.Hour)
+	value, ok := cache.Get("k1")
+	c.Assert(ok, Equals, true)
+	c.Assert(string(value), Equals, "v1")
+
+	// k2 is the least recently used entry.
+	cache.Set("db.b", "k3", []byte("v3"), time.Hour)
+	_, ok = cache.Get("k2")
+	c.Assert(ok, Equals, false)
+
+	cache.Invalidate("db.a")
+	_, ok = cache.Get("k1")
+	c.Assert(ok, Equals, false)
+	_, ok = cache.Get("k3")
+	c.Assert(ok, Equals, true)
+
+	cache.Set("db.b", "k4", []byte("v4"), -time.Second)
+	_, ok = cache.Get("k4")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *S) TestQueryCache(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	session.SetQueryCache(mgo.NewQueryCache(100))
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.Insert(M{"a": 1, "b": 1}, M{"a": 1, "b": 2})
+	c.Assert(err, IsNil)
+
+	var result []M
+	err = coll.Find(M{"a": 1, "b": M{"$gt": 0}}).Sort("b").Cache(time.Hour).All(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result, HasLen, 2)
+
+	// Writes through a different session are not observed...
+	other := session.New()
+	defer other.Close()
+	other.SetQueryCache(nil)
+	err = other.DB("mydb").C("mycoll").Insert(M{"a": 1, "b": 3})
+	c.Assert(err, IsNil)
+
+	err = coll.Find(bson.D{{"b", M{"$gt": 0}}, {"a", 1}}).Sort("b").Cache(time.Hour).All(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result, HasLen, 2)
+
+	// ... unless the query shape differs or caching isn't requested.
+	err = coll.Find(M{"a": 1, "b": M{"$gt": 0}}).Sort("-b").Cache(time.Hour).All(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result, HasLen, 3)
+	err = coll.Find(M{"a": 1}).All(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result, HasLen, 3)
+
+	// Misses are cached as well.
+	var doc M
+	err = coll.Find(M{"a": 2}).Cache(time.Hour).One(&doc)
+	c.Assert(err, Equals, mgo.ErrNotFound)
+
+	// Writes through the session invalidate cached results.
+	err = coll.Insert(M{"a": 2})
+	c.Assert(err, IsNil)
+
+	err = coll.Find(M{"a": 2}).Cache(time.Hour).One(&doc)
+	c.Assert(err, IsNil)
+	c.Assert(doc["a"], Equals, 2)
+
+	err = coll.Find(M{"a": 1, "b": M{"$gt": 0}}).Sort("b").Cache(time.Hour).All(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result, HasLen, 3)
+}
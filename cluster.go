@@ -54,28 +54,42 @@ type mongoCluster struct {
 	masters      mongoServers
 	references   int
 	syncing      bool
-	direct       bool
-	failFast     bool
 	syncCount    uint
-	setName      string
 	cachedIndex  map[string]bool
 	sync         chan bool
+	options      clusterOptions
+	resolver     *addrResolver
+}
+
+// clusterOptions holds the settings of a cluster and of the servers in
+// it, as defined by DialInfo.
+type clusterOptions struct {
+	direct       bool
+	failFast     bool
+	setName      string
 	dial         dialer
+	ping         idlePing
+	dns          dnsPolicy
+	limits       replyLimits
+	msgChecksums bool
+	compression  wireCompression
+	quota        *Quota
 }
 
-func newCluster(userSeeds []string, direct, failFast bool, dial dialer, setName string) *mongoCluster {
+func newCluster(userSeeds []string, options clusterOptions) *mongoCluster {
 	cluster := &mongoCluster{
 		userSeeds:  userSeeds,
 		references: 1,
-		direct:     direct,
-		failFast:   failFast,
-		dial:       dial,
-		setName:    setName,
+		options:    options,
+		resolver:   newAddrResolver(options.dns.cacheTTL),
 	}
 	cluster.serverSynced.L = cluster.RWMutex.RLocker()
 	cluster.sync = make(chan bool, 1)
 	stats.cluster(+1)
 	go cluster.syncServersLoop()
+	if dns := options.dns; dns.resolveInterval > 0 && !dns.remote {
+		go cluster.resolveLoop(dns.resolveInterval)
+	}
 	return cluster
 }
 
@@ -116,6 +130,31 @@ func (cluster *mongoCluster) LiveServers() (servers []string) {
 	return servers
 }
 
+// Topology returns the kind of deployment the cluster is talking to,
+// based on the servers known at the moment.
+func (cluster *mongoCluster) Topology() Topology {
+	cluster.RLock()
+	defer cluster.RUnlock()
+	if cluster.servers.Empty() {
+		return TopologyUnknown
+	}
+	if cluster.options.direct {
+		return TopologySingle
+	}
+	if cluster.servers.HasMongos() {
+		return TopologySharded
+	}
+	for _, server := range cluster.servers.Slice() {
+		if server.Info().SetName != "" {
+			if cluster.masters.Empty() {
+				return TopologyReplicaSetNoPrimary
+			}
+			return TopologyReplicaSetWithPrimary
+		}
+	}
+	return TopologySingle
+}
+
 func (cluster *mongoCluster) removeServer(server *mongoServer) {
 	cluster.Lock()
 	cluster.masters.Remove(server)
@@ -138,11 +177,15 @@ type isMasterResult struct {
 	Msg            string
 	SetName        string `bson:"setName"`
 	MaxWireVersion int    `bson:"maxWireVersion"`
+
+	MaxBSONObjectSize int `bson:"maxBsonObjectSize"`
+	MaxWriteBatchSize int `bson:"maxWriteBatchSize"`
 }
 
 func (cluster *mongoCluster) isMaster(socket *mongoSocket, result *isMasterResult) error {
 	// Monotonic let's it talk to a slave and still hold the socket.
 	session := newSession(Monotonic, cluster, 10*time.Second)
+	session.noQuota = true
 	session.setSocket(socket)
 	err := session.Run("ismaster", result)
 	session.Close()
@@ -155,6 +198,8 @@ type possibleTimeout interface {
 
 var syncSocketTimeout = 5 * time.Second
 
+var errNoReachableServers = errors.New("no reachable servers")
+
 func (cluster *mongoCluster) syncServer(server *mongoServer) (info *mongoServerInfo, hosts []string, err error) {
 	var syncTimeout time.Duration
 	if raceDetector {
@@ -173,7 +218,7 @@ func (cluster *mongoCluster) syncServer(server *mongoServer) (info *mongoServerI
 	var result isMasterResult
 	var tryerr error
 	for retry := 0; ; retry++ {
-		if retry == 3 || retry == 1 && cluster.failFast {
+		if retry == 3 || retry == 1 && cluster.options.failFast {
 			return nil, nil, tryerr
 		}
 		if retry > 0 {
@@ -187,7 +232,7 @@ func (cluster *mongoCluster) syncServer(server *mongoServer) (info *mongoServerI
 
 		// It's not clear what would be a good timeout here. Is it
 		// better to wait longer or to retry?
-		socket, _, err := server.AcquireSocket(0, syncTimeout)
+		socket, _, err := server.AcquireSocket(0, HighPriority, syncTimeout)
 		if err != nil {
 			tryerr = err
 			logf("SYNC Failed to get socket to %s: %v", addr, err)
@@ -204,9 +249,13 @@ func (cluster *mongoCluster) syncServer(server *mongoServer) (info *mongoServerI
 		break
 	}
 
-	if cluster.setName != "" && result.SetName != cluster.setName {
-		logf("SYNC Server %s is not a member of replica set %q", addr, cluster.setName)
-		return nil, nil, fmt.Errorf("server %s is not a member of replica set %q", addr, cluster.setName)
+	if cluster.options.setName != "" && result.SetName != cluster.options.setName {
+		if result.SetName == "" {
+			logf("SYNC Server %s is not a member of replica set %q; rejecting it", addr, cluster.options.setName)
+		} else {
+			logf("SYNC Server %s is a member of replica set %q rather than %q; rejecting it", addr, result.SetName, cluster.options.setName)
+		}
+		return nil, nil, fmt.Errorf("server %s is not a member of replica set %q", addr, cluster.options.setName)
 	}
 
 	if result.IsMaster {
@@ -218,7 +267,7 @@ func (cluster *mongoCluster) syncServer(server *mongoServer) (info *mongoServerI
 		}
 	} else if result.Secondary {
 		debugf("SYNC %s is a slave.", addr)
-	} else if cluster.direct {
+	} else if cluster.options.direct {
 		logf("SYNC %s in unknown state. Pretending it's a slave due to direct connection.", addr)
 	} else {
 		logf("SYNC %s is neither a master nor a slave.", addr)
@@ -232,6 +281,9 @@ func (cluster *mongoCluster) syncServer(server *mongoServer) (info *mongoServerI
 		Tags:           result.Tags,
 		SetName:        result.SetName,
 		MaxWireVersion: result.MaxWireVersion,
+
+		MaxBSONObjectSize: result.MaxBSONObjectSize,
+		MaxWriteBatchSize: result.MaxWriteBatchSize,
 	}
 
 	hosts = make([]string, 0, 1+len(result.Hosts)+len(result.Passives))
@@ -254,6 +306,7 @@ const (
 )
 
 func (cluster *mongoCluster) addServer(server *mongoServer, info *mongoServerInfo, syncKind syncKind) {
+	var elected bool
 	cluster.Lock()
 	current := cluster.servers.Search(server.ResolvedAddr)
 	if current == nil {
@@ -266,6 +319,7 @@ func (cluster *mongoCluster) addServer(server *mongoServer, info *mongoServerInf
 		cluster.servers.Add(server)
 		if info.Master {
 			cluster.masters.Add(server)
+			elected = true
 			log("SYNC Adding ", server.Addr, " to cluster as a master.")
 		} else {
 			log("SYNC Adding ", server.Addr, " to cluster as a slave.")
@@ -278,6 +332,7 @@ func (cluster *mongoCluster) addServer(server *mongoServer, info *mongoServerInf
 			if info.Master {
 				log("SYNC Server ", server.Addr, " is now a master.")
 				cluster.masters.Add(server)
+				elected = true
 			} else {
 				log("SYNC Server ", server.Addr, " is now a slave.")
 				cluster.masters.Remove(server)
@@ -288,6 +343,12 @@ func (cluster *mongoCluster) addServer(server *mongoServer, info *mongoServerInf
 	debugf("SYNC Broadcasting availability of server %s", server.Addr)
 	cluster.serverSynced.Broadcast()
 	cluster.Unlock()
+
+	if elected {
+		if monitor := getMonitor(); monitor != nil && monitor.Primary != nil {
+			monitor.Primary(server.Addr)
+		}
+	}
 }
 
 func (cluster *mongoCluster) getKnownAddrs() []string {
@@ -349,7 +410,7 @@ func (cluster *mongoCluster) syncServersLoop() {
 			break
 		}
 		cluster.references++ // Keep alive while syncing.
-		direct := cluster.direct
+		direct := cluster.options.direct
 		cluster.Unlock()
 
 		cluster.syncServersIteration(direct)
@@ -364,7 +425,7 @@ func (cluster *mongoCluster) syncServersLoop() {
 
 		// Hold off before allowing another sync. No point in
 		// burning CPU looking for down servers.
-		if !cluster.failFast {
+		if !cluster.options.failFast {
 			time.Sleep(syncShortDelay)
 		}
 
@@ -399,14 +460,14 @@ func (cluster *mongoCluster) syncServersLoop() {
 	debugf("SYNC Cluster %p is stopping its sync loop.", cluster)
 }
 
-func (cluster *mongoCluster) server(addr string, tcpaddr *net.TCPAddr) *mongoServer {
+func (cluster *mongoCluster) server(addr, resolvedAddr string, tcpaddr *net.TCPAddr) *mongoServer {
 	cluster.RLock()
-	server := cluster.servers.Search(tcpaddr.String())
+	server := cluster.servers.Search(resolvedAddr)
 	cluster.RUnlock()
 	if server != nil {
 		return server
 	}
-	return newServer(addr, tcpaddr, cluster.sync, cluster.dial)
+	return newServer(addr, resolvedAddr, tcpaddr, cluster.sync, cluster.resolver, &cluster.options)
 }
 
 func resolveAddr(addr string) (*net.TCPAddr, error) {
@@ -490,12 +551,19 @@ func (cluster *mongoCluster) syncServersIteration(direct bool) {
 		go func() {
 			defer wg.Done()
 
-			tcpaddr, err := resolveAddr(addr)
-			if err != nil {
-				log("SYNC Failed to start sync of ", addr, ": ", err.Error())
-				return
+			// With a proxy, host names may only resolve on the far side
+			// of it, so servers are keyed by the address as given.
+			var tcpaddr *net.TCPAddr
+			resolvedAddr := addr
+			if !cluster.options.dns.remote {
+				var err error
+				tcpaddr, err = cluster.resolver.resolve(addr)
+				if err != nil {
+					log("SYNC Failed to start sync of ", addr, ": ", err.Error())
+					return
+				}
+				resolvedAddr = tcpaddr.String()
 			}
-			resolvedAddr := tcpaddr.String()
 
 			m.Lock()
 			if byMaster {
@@ -514,7 +582,7 @@ func (cluster *mongoCluster) syncServersIteration(direct bool) {
 			seen[resolvedAddr] = true
 			m.Unlock()
 
-			server := cluster.server(addr, tcpaddr)
+			server := cluster.server(addr, resolvedAddr, tcpaddr)
 			info, hosts, err := cluster.syncServer(server)
 			if err != nil {
 				cluster.removeServer(server)
@@ -549,6 +617,9 @@ func (cluster *mongoCluster) syncServersIteration(direct bool) {
 	if syncKind == completeSync {
 		logf("SYNC Synchronization was complete (got data from primary).")
 		for _, pending := range notYetAdded {
+			// Servers unknown to the primary might belong to a different
+			// deployment that was reached via a stale or wrong seed list.
+			logf("SYNC Ignoring %s: not present in the primary's replica set configuration.", pending.server.Addr)
 			cluster.removeServer(pending.server)
 		}
 	} else {
@@ -578,9 +649,22 @@ func (cluster *mongoCluster) syncServersIteration(direct bool) {
 // AcquireSocket returns a socket to a server in the cluster.  If slaveOk is
 // true, it will attempt to return a socket to a slave server.  If it is
 // false, the socket will necessarily be to a master server.
-func (cluster *mongoCluster) AcquireSocket(mode Mode, slaveOk bool, syncTimeout time.Duration, socketTimeout time.Duration, serverTags []bson.D, poolLimit int) (s *mongoSocket, err error) {
+//
+// If failNoMaster is true and slaveOk is false, ErrNoPrimary is returned
+// right away when the cluster was synchronized but no master is known,
+// rather than waiting for one to be elected.
+func (cluster *mongoCluster) AcquireSocket(mode Mode, slaveOk bool, syncTimeout time.Duration, socketTimeout time.Duration, serverTags []bson.D, poolLimit int, priority Priority, failNoMaster bool) (s *mongoSocket, err error) {
 	var started time.Time
+	var waiting *mongoServer
+	defer func() {
+		if waiting != nil {
+			waiting.waitPool(-1)
+		}
+	}()
 	var syncCount uint
+	var attempts int
+	var poolWait time.Duration
+	begin := time.Now()
 	warnedLimit := false
 	for {
 		cluster.RLock()
@@ -594,13 +678,19 @@ func (cluster *mongoCluster) AcquireSocket(mode Mode, slaveOk bool, syncTimeout
 			if mastersLen > 0 && mode == Secondary && cluster.masters.HasMongos() {
 				break
 			}
+			if failNoMaster && !slaveOk && mastersLen == 0 && cluster.syncCount > 0 {
+				cluster.RUnlock()
+				// Look for the new master in the background.
+				cluster.syncServers()
+				return nil, ErrNoPrimary
+			}
 			if started.IsZero() {
 				// Initialize after fast path above.
 				started = time.Now()
 				syncCount = cluster.syncCount
-			} else if syncTimeout != 0 && started.Before(time.Now().Add(-syncTimeout)) || cluster.failFast && cluster.syncCount != syncCount {
+			} else if syncTimeout != 0 && started.Before(time.Now().Add(-syncTimeout)) || cluster.options.failFast && cluster.syncCount != syncCount {
 				cluster.RUnlock()
-				return nil, errors.New("no reachable servers")
+				return nil, errNoReachableServers
 			}
 			log("Waiting for servers to synchronize...")
 			cluster.syncServers()
@@ -623,13 +713,22 @@ func (cluster *mongoCluster) AcquireSocket(mode Mode, slaveOk bool, syncTimeout
 			continue
 		}
 
-		s, abended, err := server.AcquireSocket(poolLimit, socketTimeout)
+		attempts++
+		s, abended, err := server.AcquireSocket(poolLimit, priority, socketTimeout)
 		if err == errPoolLimit {
+			if priority == HighPriority && waiting != server {
+				if waiting != nil {
+					waiting.waitPool(-1)
+				}
+				waiting = server
+				waiting.waitPool(+1)
+			}
 			if !warnedLimit {
 				warnedLimit = true
 				log("WARNING: Per-server connection limit reached.")
 			}
 			time.Sleep(100 * time.Millisecond)
+			poolWait += 100 * time.Millisecond
 			continue
 		}
 		if err != nil {
@@ -648,6 +747,19 @@ func (cluster *mongoCluster) AcquireSocket(mode Mode, slaveOk bool, syncTimeout
 				continue
 			}
 		}
+		if monitor := getMonitor(); monitor != nil && monitor.Route != nil {
+			info := s.ServerInfo()
+			monitor.Route(&Route{
+				Server:     server.Addr,
+				Master:     info.Master || info.Mongos,
+				Mode:       mode,
+				SlaveOk:    slaveOk,
+				ServerTags: serverTags,
+				Attempts:   attempts,
+				PoolWait:   poolWait,
+				Duration:   time.Since(begin),
+			})
+		}
 		return s, nil
 	}
 	panic("unreached")
@@ -471,6 +471,51 @@ func (s *S) TestModeStrongFallover(c *C) {
 	c.Assert(err, IsNil)
 }
 
+func (s *S) TestFailFastNoPrimary(c *C) {
+	if *fast {
+		c.Skip("-fast")
+	}
+
+	session, err := mgo.Dial("localhost:40021")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	result := &struct{ Host string }{}
+	err = session.Run("serverStatus", result)
+	c.Assert(err, IsNil)
+
+	// Kill the master.
+	host := result.Host
+	s.Stop(host)
+
+	// This must fail, since the connection was broken.
+	err = session.Run("serverStatus", result)
+	c.Assert(err, Equals, io.EOF)
+
+	session.Refresh()
+	session.SetSyncTimeout(3 * time.Minute)
+	session.SetFailFastNoPrimary(true)
+
+	// With no primary known, writes fail right away rather than
+	// waiting for the election to complete.
+	started := time.Now()
+	coll := session.DB("mydb").C("mycoll")
+	for {
+		err = coll.Insert(M{"n": 42})
+		if err != io.EOF {
+			break
+		}
+		session.Refresh()
+	}
+	c.Assert(err, Equals, mgo.ErrNoPrimary)
+	c.Assert(time.Since(started) < 10*time.Second, Equals, true)
+
+	// Once disabled, the write waits for the new master.
+	session.SetFailFastNoPrimary(false)
+	err = coll.Insert(M{"n": 42})
+	c.Assert(err, IsNil)
+}
+
 func (s *S) TestModePrimaryHiccup(c *C) {
 	if *fast {
 		c.Skip("-fast")
@@ -1046,6 +1091,108 @@ func (s *S) TestSocketTimeout(c *C) {
 	c.Assert(started.After(time.Now().Add(-timeout*2)), Equals, true)
 }
 
+func (s *S) TestIdlePing(c *C) {
+	if *fast {
+		c.Skip("-fast")
+	}
+
+	info := &mgo.DialInfo{
+		Addrs:            []string{"localhost:40001"},
+		Timeout:          5 * time.Second,
+		IdlePingInterval: 200 * time.Millisecond,
+		IdlePingMisses:   2,
+	}
+	session, err := mgo.DialWithInfo(info)
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	// Idle sockets that reply to pings are kept around.
+	err = session.Ping()
+	c.Assert(err, IsNil)
+	session.Refresh()
+	time.Sleep(1 * time.Second)
+	c.Assert(c.GetTestLog(), Not(Matches), "(?s).*missed 2 idle pings.*")
+	err = session.Ping()
+	c.Assert(err, IsNil)
+	session.Refresh()
+
+	// Idle sockets that stop replying are dropped.
+	s.Freeze("localhost:40001")
+	time.Sleep(1 * time.Second)
+	s.Thaw("localhost:40001")
+
+	c.Assert(c.GetTestLog(), Matches, "(?s).*missed 2 idle pings.*")
+	err = session.Ping()
+	c.Assert(err, IsNil)
+}
+
+func (s *S) TestLookupHostCache(c *C) {
+	cached := map[string][]net.IPAddr{"db.invalid": {{IP: net.ParseIP("10.0.0.1")}}}
+	ipaddrs, err := mgo.LookupHost(time.Minute, cached, "db.invalid")
+	c.Assert(err, IsNil)
+	c.Assert(ipaddrs, DeepEquals, cached["db.invalid"])
+
+	// Nothing is cached with caching disabled.
+	_, err = mgo.LookupHost(0, cached, "db.invalid")
+	c.Assert(err, NotNil)
+}
+
+func (s *S) TestResolveInterval(c *C) {
+	var changes []string
+	info := &mgo.DialInfo{
+		Addrs:           []string{"localhost:40001"},
+		Timeout:         5 * time.Second,
+		DNSCacheTTL:     time.Minute,
+		ResolveInterval: 100 * time.Millisecond,
+		AddrChanged: func(addr string, from, to *net.TCPAddr) {
+			changes = append(changes, addr)
+		},
+	}
+	session, err := mgo.DialWithInfo(info)
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	time.Sleep(500 * time.Millisecond)
+	c.Assert(changes, HasLen, 0)
+	c.Assert(c.GetTestLog(), Not(Matches), "(?s).*Address of localhost:40001 changed.*")
+
+	err = session.Ping()
+	c.Assert(err, IsNil)
+	c.Assert(session.LiveServers(), DeepEquals, []string{"localhost:40001"})
+}
+
+func (s *S) TestDialParallel(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	// 192.0.2.1 is reserved for documentation and shouldn't be routed.
+	timeout := 5 * time.Second
+	started := time.Now()
+	conn, err := mgo.DialParallel([]string{"192.0.2.1:40001", l.Addr().String()}, timeout)
+	c.Assert(err, IsNil)
+	conn.Close()
+	c.Assert(conn.RemoteAddr().String(), Equals, l.Addr().String())
+	c.Assert(time.Since(started) < timeout/2, Equals, true)
+
+	// Failures move on to the next address right away.
+	conn, err = mgo.DialParallel([]string{"127.0.0.1:1", l.Addr().String()}, timeout)
+	c.Assert(err, IsNil)
+	conn.Close()
+
+	_, err = mgo.DialParallel([]string{"127.0.0.1:1", "127.0.0.1:2"}, timeout)
+	c.Assert(err, ErrorMatches, ".*connection refused")
+}
+
 func (s *S) TestSocketTimeoutOnDial(c *C) {
 	if *fast {
 		c.Skip("-fast")
@@ -1155,6 +1302,24 @@ func (s *S) TestDialWithReplicaSetName(c *C) {
 
 }
 
+func (s *S) TestDialWithWrongReplicaSetName(c *C) {
+	// Neither a standalone server nor members of another replica set
+	// are accepted when the replica set name doesn't match.
+	for _, addr := range []string{"localhost:40001", "localhost:40021", "localhost:40022"} {
+		info := mgo.DialInfo{
+			Addrs:          []string{addr},
+			Timeout:        2 * time.Second,
+			FailFast:       true,
+			ReplicaSetName: "rs1",
+		}
+		session, err := mgo.DialWithInfo(&info)
+		if session != nil {
+			session.Close()
+		}
+		c.Assert(err, ErrorMatches, "no reachable servers")
+	}
+}
+
 func (s *S) TestDirect(c *C) {
 	session, err := mgo.Dial("localhost:40012?connect=direct")
 	c.Assert(err, IsNil)
@@ -1199,6 +1364,39 @@ func (s *S) TestDirect(c *C) {
 	c.Assert(strings.HasSuffix(result.Host, ":40012"), Equals, true)
 }
 
+func (s *S) TestTopology(c *C) {
+	tests := []struct {
+		url      string
+		topology mgo.Topology
+	}{
+		{"localhost:40001", mgo.TopologySingle},
+		{"localhost:40011", mgo.TopologyReplicaSetWithPrimary},
+		{"localhost:40012?directConnection=true", mgo.TopologySingle},
+		{"localhost:40012?directConnection=false", mgo.TopologyReplicaSetWithPrimary},
+		{"localhost:40201", mgo.TopologySharded},
+	}
+	for _, test := range tests {
+		session, err := mgo.Dial(test.url)
+		c.Assert(err, IsNil)
+		session.SetMode(mgo.Monotonic, true)
+		err = session.Ping()
+		c.Assert(err, IsNil)
+		c.Assert(session.Topology(), Equals, test.topology, Commentf("URL: %s", test.url))
+		session.Close()
+	}
+
+	_, err := mgo.ParseURL("localhost:40011,localhost:40012?directConnection=true")
+	c.Assert(err, ErrorMatches, "directConnection=true requires a single server address")
+	_, err = mgo.ParseURL("localhost:40011?directConnection=yes")
+	c.Assert(err, ErrorMatches, "bad value for directConnection: yes")
+
+	_, err = mgo.ParseURL("localhost:40201?loadBalanced=true")
+	c.Assert(err, ErrorMatches, "loadBalanced=true is not supported: .*")
+	_, err = mgo.ParseURL("localhost:40201?loadBalanced=false")
+	c.Assert(err, IsNil)
+	c.Assert(mgo.TopologyLoadBalanced.String(), Equals, "LoadBalanced")
+}
+
 func (s *S) TestDirectToUnknownStateMember(c *C) {
 	session, err := mgo.Dial("localhost:40041?connect=direct")
 	c.Assert(err, IsNil)
@@ -1596,6 +1794,37 @@ func (s *S) TestPoolLimitSimple(c *C) {
 	}
 }
 
+func (s *S) TestPoolLimitPriority(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+	session.SetPoolLimit(1)
+	c.Assert(session.Priority(), Equals, mgo.HighPriority)
+
+	// Put one socket in use.
+	c.Assert(session.Ping(), IsNil)
+
+	done := make(chan mgo.Priority, 2)
+	ping := func(priority mgo.Priority) {
+		copy := session.Copy()
+		defer copy.Close()
+		copy.SetPriority(priority)
+		c.Check(copy.Ping(), IsNil)
+		done <- priority
+	}
+
+	// Block a high priority session first, so that the low priority
+	// one started afterwards must yield the freed socket to it.
+	go ping(mgo.HighPriority)
+	time.Sleep(300 * time.Millisecond)
+	go ping(mgo.LowPriority)
+	time.Sleep(300 * time.Millisecond)
+
+	session.Refresh()
+	c.Assert(<-done, Equals, mgo.HighPriority)
+	c.Assert(<-done, Equals, mgo.LowPriority)
+}
+
 func (s *S) TestPoolLimitMany(c *C) {
 	if *fast {
 		c.Skip("-fast")
@@ -1639,6 +1868,46 @@ func (s *S) TestPoolLimitMany(c *C) {
 	c.Assert(delay < 6e9, Equals, true)
 }
 
+func (s *S) TestMaxInFlight(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	session.SetMaxInFlight(1)
+
+	coll := session.DB("mydb").C("mycoll")
+	c.Assert(coll.Insert(M{"a": 1}), IsNil)
+
+	// Keep the reserved socket busy with a slow query.
+	done := make(chan error)
+	go func() {
+		done <- coll.Find(M{"$where": "function() { sleep(1000); return true; }"}).One(nil)
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	// The ping must not wait behind the slow query.
+	before := time.Now()
+	c.Assert(session.Ping(), IsNil)
+	delay := time.Now().Sub(before)
+	c.Assert(delay < 500*time.Millisecond, Equals, true, Commentf("Delay: %s", delay))
+
+	c.Assert(<-done, IsNil)
+
+	// Without the limit, the ping queues up on the same socket.
+	session.SetMaxInFlight(0)
+	go func() {
+		done <- coll.Find(M{"$where": "function() { sleep(1000); return true; }"}).One(nil)
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	before = time.Now()
+	c.Assert(session.Ping(), IsNil)
+	delay = time.Now().Sub(before)
+	c.Assert(delay > 500*time.Millisecond, Equals, true, Commentf("Delay: %s", delay))
+
+	c.Assert(<-done, IsNil)
+}
+
 func (s *S) TestSetModeEventualIterBug(c *C) {
 	session1, err := mgo.Dial("localhost:40011")
 	c.Assert(err, IsNil)
@@ -2088,3 +2357,46 @@ func (s *S) TestDoNotFallbackToMonotonic(c *C) {
 		c.Assert(q13b, Equals, q13a)
 	}
 }
+
+func (s *S) TestHealth(c *C) {
+	defer mgo.HackPingDelay(300 * time.Millisecond)()
+
+	session, err := mgo.Dial("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	// Wait for all members to be discovered and pinged.
+	for i := 0; i < 100; i++ {
+		health := session.Health()
+		if len(health.Servers) == 3 && health.Servers[0].RTT > 0 && health.Servers[1].RTT > 0 && health.Servers[2].RTT > 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	c.Assert(session.Ping(), IsNil)
+	health := session.Health()
+	c.Assert(health.Topology, Equals, mgo.TopologyReplicaSetWithPrimary)
+	c.Assert(health.Mode, Equals, mgo.Primary)
+	c.Assert(health.Healthy, Equals, true)
+	c.Assert(health.Servers, HasLen, 3)
+
+	states := map[string]int{}
+	for _, server := range health.Servers {
+		states[server.State]++
+		c.Assert(server.SetName, Equals, "rs1")
+		c.Assert(server.LastHeartbeat.IsZero(), Equals, false)
+		c.Assert(server.RTT > 0, Equals, true)
+		if server.State == "primary" {
+			c.Assert(server.SocketsInUse, Equals, 1)
+		}
+	}
+	c.Assert(states, DeepEquals, map[string]int{"primary": 1, "secondary": 2})
+
+	session.SetMode(mgo.Secondary, true)
+	c.Assert(session.Health().Healthy, Equals, true)
+
+	// No member has the requested tags.
+	session.SelectServers(bson.D{{"dc", "nowhere"}})
+	c.Assert(session.Health().Healthy, Equals, false)
+}
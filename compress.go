@@ -0,0 +1,260 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Compressor implements an algorithm for compressing the messages
+// exchanged with MongoDB 3.4+ servers, as selected via
+// DialInfo.Compressors. The "zlib" compressor is built in, and further
+// ones, such as for snappy or zstd, may be provided via RegisterCompressor.
+type Compressor interface {
+	// Name returns the name the compressor is negotiated with
+	// servers under, such as "zlib".
+	Name() string
+
+	// Id returns the id identifying the compressor in compressed
+	// messages, as assigned by the MongoDB wire protocol.
+	Id() uint8
+
+	// Compress appends the compressed form of src to dst and
+	// returns the resulting slice.
+	Compress(dst, src []byte) ([]byte, error)
+
+	// Decompress decompresses src into dst, and fails if src doesn't
+	// decompress into exactly len(dst) bytes.
+	Decompress(dst, src []byte) error
+}
+
+var (
+	compressorsMutex sync.RWMutex
+	compressors      = map[string]Compressor{"zlib": zlibCompressor{}}
+)
+
+// RegisterCompressor makes c available for use via DialInfo.Compressors
+// under its name, replacing any compressor previously registered under
+// the same name.
+func RegisterCompressor(c Compressor) {
+	compressorsMutex.Lock()
+	compressors[c.Name()] = c
+	compressorsMutex.Unlock()
+}
+
+func lookupCompressor(name string) Compressor {
+	compressorsMutex.RLock()
+	c := compressors[name]
+	compressorsMutex.RUnlock()
+	return c
+}
+
+// wireCompression holds the compressors that may be negotiated with
+// servers, in order of preference, and the size of the messages up to
+// which they're sent uncompressed.
+type wireCompression struct {
+	compressors []Compressor
+	threshold   int
+}
+
+func newWireCompression(names []string, threshold int) (wireCompression, error) {
+	compression := wireCompression{threshold: threshold}
+	for _, name := range names {
+		c := lookupCompressor(name)
+		if c == nil {
+			return compression, errors.New("unknown compressor: " + name)
+		}
+		compression.compressors = append(compression.compressors, c)
+	}
+	return compression, nil
+}
+
+// negotiateCompression agrees with the server on the compressor used
+// for messages sent through the newly connected socket, if any. It must
+// be called before the socket is handed out.
+func (socket *mongoSocket) negotiateCompression() error {
+	names := make([]string, len(socket.compression.compressors))
+	for i, c := range socket.compression.compressors {
+		names[i] = c.Name()
+	}
+	op := &queryOp{
+		collection: "admin.$cmd",
+		query:      bson.D{{"isMaster", 1}, {"compression", names}},
+		flags:      flagSlaveOk,
+		limit:      -1,
+	}
+	data, err := socket.SimpleQuery(op)
+	if err != nil {
+		return err
+	}
+	var result struct{ Compression []string }
+	if err := bson.Unmarshal(data, &result); err != nil {
+		return err
+	}
+	// Servers list the compressors they support in the order provided.
+	for _, name := range result.Compression {
+		for _, c := range socket.compression.compressors {
+			if c.Name() == name {
+				debugf("Socket %p to %s: compressing messages with %s", socket, socket.addr, name)
+				socket.compressor = c
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// compressibleCommand returns whether the command document cmd may be
+// sent compressed. Handshake and authentication commands may not be.
+func compressibleCommand(cmd []byte) bool {
+	name, _ := firstElement(cmd)
+	switch strings.ToLower(name) {
+	case "ismaster", "hello", "saslstart", "saslcontinue", "getnonce", "authenticate",
+		"createuser", "updateuser", "copydbsaslstart", "copydbgetnonce", "copydb":
+		return false
+	}
+	return true
+}
+
+// compressMessages returns the messages in buf with those larger than
+// threshold bytes compressed by c into OP_COMPRESSED messages, except
+// for the ones starting at the positions in uncompressed.
+func compressMessages(c Compressor, threshold int, buf []byte, uncompressed []int) ([]byte, error) {
+	var out []byte
+	var err error
+NextMessage:
+	for pos := 0; pos < len(buf); {
+		size := int(getInt32(buf, pos))
+		msg := buf[pos : pos+size]
+		pos += size
+		if size <= threshold {
+			out = append(out, msg...)
+			continue
+		}
+		for _, start := range uncompressed {
+			if start == pos-size {
+				out = append(out, msg...)
+				continue NextMessage
+			}
+		}
+		start := len(out)
+		out = append(out, msg[:12]...) // Length, request id, and response to.
+		out = addInt32(out, 2012)
+		out = addInt32(out, getInt32(msg, 12)) // Original opcode.
+		out = addInt32(out, int32(size-16))
+		out = append(out, c.Id())
+		out, err = c.Compress(out, msg[16:])
+		if err != nil {
+			return nil, err
+		}
+		setInt32(out, start, int32(len(out)-start))
+	}
+	return out, nil
+}
+
+// decompressMessage reads the rest of an OP_COMPRESSED message whose
+// header was already read from r, and returns a reader for the rest of
+// the original message. The header is patched to describe the original
+// message, whose size is subject to the reply limits.
+func (socket *mongoSocket) decompressMessage(r io.Reader, header []byte) (io.Reader, error) {
+	totalLen := int(getInt32(header, 0))
+	if totalLen < 16+9 {
+		return nil, fmt.Errorf("bad OP_COMPRESSED length %d, corrupted data?", totalLen)
+	}
+	b := make([]byte, totalLen-16)
+	if err := fill(r, b); err != nil {
+		return nil, err
+	}
+	opCode := getInt32(b, 0)
+	size := int(getInt32(b, 4))
+	if size < 0 {
+		return nil, fmt.Errorf("bad OP_COMPRESSED uncompressed size %d, corrupted data?", size)
+	}
+	if err := socket.limits.checkMessage(16 + size); err != nil {
+		return nil, err
+	}
+	var c Compressor
+	for _, candidate := range socket.compression.compressors {
+		if candidate.Id() == b[8] {
+			c = candidate
+			break
+		}
+	}
+	if c == nil {
+		return nil, fmt.Errorf("reply compressed with unknown compressor id %d", b[8])
+	}
+	msg := make([]byte, size)
+	if err := c.Decompress(msg, b[9:]); err != nil {
+		return nil, fmt.Errorf("cannot decompress reply: %v", err)
+	}
+	setInt32(header, 0, int32(16+size))
+	setInt32(header, 12, opCode)
+	return bytes.NewReader(msg), nil
+}
+
+type zlibCompressor struct{}
+
+func (zlibCompressor) Name() string { return "zlib" }
+func (zlibCompressor) Id() uint8    { return 2 }
+
+func (zlibCompressor) Compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	w := zlib.NewWriter(buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (zlibCompressor) Decompress(dst, src []byte) error {
+	r, err := zlib.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(r, dst); err != nil {
+		return err
+	}
+	n, err := r.Read(make([]byte, 1))
+	if n > 0 {
+		return errors.New("decompressed data larger than announced")
+	}
+	if err != io.EOF {
+		return err
+	}
+	return r.Close()
+}
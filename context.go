@@ -0,0 +1,145 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"context"
+	"time"
+)
+
+type contextKey int
+
+const (
+	modeKey contextKey = iota
+	readConcernKey
+	commentKey
+)
+
+// ContextWithMode returns a copy of ctx that makes sessions obtained via
+// Session.WithContext use the given consistency mode.
+func ContextWithMode(ctx context.Context, mode Mode) context.Context {
+	return context.WithValue(ctx, modeKey, mode)
+}
+
+// ContextWithReadConcern returns a copy of ctx that makes sessions
+// obtained via Session.WithContext read with the given read concern
+// level, such as "majority" or "local". Requires MongoDB 3.2+.
+func ContextWithReadConcern(ctx context.Context, level string) context.Context {
+	return context.WithValue(ctx, readConcernKey, level)
+}
+
+// ContextWithComment returns a copy of ctx that makes sessions obtained
+// via Session.WithContext attach the given comment to queries that have
+// none set via Query.Comment, to identify them in the database profiler
+// output.
+func ContextWithComment(ctx context.Context, comment string) context.Context {
+	return context.WithValue(ctx, commentKey, comment)
+}
+
+// WithContext returns a clone of the session, as obtained via Clone,
+// that is bound to ctx and adopts the consistency mode, read concern
+// and comment attached to it via ContextWithMode, ContextWithReadConcern
+// and ContextWithComment. This allows middleware to set routing policy
+// for the operations of a request without plumbing options through every
+// function signature. If ctx has a deadline, the server is told to give
+// up on operations by then (see SetDeadlineCushion). The returned session
+// must be closed when done:
+//
+//     session := db.Session.WithContext(ctx)
+//     defer session.Close()
+//     err := session.DB("mydb").C("mycoll").Find(query).All(&result)
+//
+func (s *Session) WithContext(ctx context.Context) *Session {
+	scopy := s.Clone()
+	if mode, ok := ctx.Value(modeKey).(Mode); ok && mode != scopy.Mode() {
+		scopy.SetMode(mode, true)
+	}
+	scopy.m.Lock()
+	scopy.ctx = ctx
+	if level, ok := ctx.Value(readConcernKey).(string); ok {
+		scopy.readConcernLevel = level
+	}
+	if comment, ok := ctx.Value(commentKey).(string); ok {
+		scopy.comment = comment
+	}
+	scopy.m.Unlock()
+	return scopy
+}
+
+// SetDeadlineCushion sets how long before the deadline of the context the
+// session is bound to via WithContext the server should give up on the
+// operations of the session. While the context has a deadline, queries,
+// counts and distinct operations are sent with a maxTimeMS limit of the
+// time left until the deadline minus the cushion, unless the limit set
+// via Query.SetMaxTime is lower. This makes the server stop working on
+// operations the application is about to give up on, and the cushion
+// accounts for the network round trip. The default cushion is zero.
+func (s *Session) SetDeadlineCushion(d time.Duration) {
+	s.m.Lock()
+	s.deadlineCushion = d
+	s.m.Unlock()
+}
+
+// maxTime returns the maxTimeMS limit for an operation with the given
+// limit of its own, taking the context deadline into account.
+func (s *Session) maxTime(maxTimeMS int) int {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.maxTimeLocked(maxTimeMS)
+}
+
+// maxTimeLocked works like maxTime, but must be called with s.m held.
+func (s *Session) maxTimeLocked(maxTimeMS int) int {
+	if s.ctx == nil {
+		return maxTimeMS
+	}
+	deadline, ok := s.ctx.Deadline()
+	if !ok {
+		return maxTimeMS
+	}
+	ms := int((time.Until(deadline) - s.deadlineCushion) / time.Millisecond)
+	if ms < 1 {
+		// The server would take zero as no limit at all.
+		ms = 1
+	}
+	if maxTimeMS > 0 && maxTimeMS < ms {
+		return maxTimeMS
+	}
+	return ms
+}
+
+// Context returns the context the session was bound to via WithContext,
+// or context.Background if none.
+func (s *Session) Context() context.Context {
+	s.m.RLock()
+	ctx := s.ctx
+	s.m.RUnlock()
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
+}
@@ -0,0 +1,139 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo_test
+
+import (
+	"context"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (s *S) TestSessionWithContext(c *C) {
+	session, err := mgo.Dial("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.Insert(M{"n": 1})
+	c.Assert(err, IsNil)
+
+	ctx := mgo.ContextWithMode(context.Background(), mgo.Nearest)
+	ctx = mgo.ContextWithReadConcern(ctx, "local")
+
+	scopy := session.WithContext(ctx)
+	defer scopy.Close()
+	c.Assert(scopy.Context(), Equals, ctx)
+	c.Assert(scopy.Mode(), Equals, mgo.Nearest)
+	c.Assert(session.Mode(), Equals, mgo.Strong)
+	c.Assert(session.Context(), Equals, context.Background())
+
+	// Reads may land on a secondary that didn't catch up yet.
+	scopy.SetMode(mgo.Strong, false)
+	var result M
+	err = coll.With(scopy).Find(M{"n": 1}).One(&result)
+	c.Assert(err, IsNil)
+	n, err := coll.With(scopy).Find(M{"n": 1}).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	// Contexts without options leave the session settings alone.
+	scopy = session.WithContext(context.Background())
+	defer scopy.Close()
+	c.Assert(scopy.Mode(), Equals, mgo.Strong)
+}
+
+func (s *S) TestSessionWithContextComment(c *C) {
+	if !s.versionAtLeast(3, 2) {
+		c.Skip("find command requires 3.2+")
+	}
+
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+	err = db.Run(bson.M{"profile": 2}, nil)
+	c.Assert(err, IsNil)
+
+	err = db.C("mycoll").Insert(M{"n": 41})
+	c.Assert(err, IsNil)
+
+	scopy := session.WithContext(mgo.ContextWithComment(context.Background(), "from context"))
+	defer scopy.Close()
+
+	err = db.C("mycoll").With(scopy).Find(M{"n": 41}).One(nil)
+	c.Assert(err, IsNil)
+	err = db.C("mycoll").With(scopy).Find(M{"n": 41}).Comment("explicit").One(nil)
+	c.Assert(err, IsNil)
+
+	profile := db.C("system.profile")
+	n, err := profile.Find(M{"query.filter.n": 41, "query.comment": "from context"}).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+	n, err = profile.Find(M{"query.filter.n": 41, "query.comment": "explicit"}).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+}
+
+func (s *S) TestSessionWithContextDeadline(c *C) {
+	if !s.versionAtLeast(2, 6) {
+		c.Skip("SetMaxTime only supported in 2.6+")
+	}
+
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	for i := 0; i < 10; i++ {
+		c.Assert(coll.Insert(M{"n": i}), IsNil)
+	}
+	slow := M{"$where": "function() { sleep(100); return true; }"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	scopy := session.WithContext(ctx)
+	defer scopy.Close()
+	scopy.SetDeadlineCushion(1900 * time.Millisecond)
+
+	// The server gives up before the context deadline.
+	before := time.Now()
+	err = coll.With(scopy).Find(slow).All(nil)
+	c.Assert(err, ErrorMatches, "operation exceeded time limit")
+	c.Assert(time.Since(before) < time.Second, Equals, true)
+
+	_, err = coll.With(scopy).Find(slow).Count()
+	c.Assert(err, ErrorMatches, "operation exceeded time limit")
+
+	// Sessions without deadlines run with no limit.
+	n, err := coll.Find(slow).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 10)
+}
@@ -0,0 +1,215 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// NamespaceDefaults maps namespaces to the write concern, read concern,
+// comment, and index hint their operations are performed with, so that
+// such policy may be kept in one place, in code or in configuration,
+// rather than spread over the call sites operating on each collection.
+//
+// Defaults are consulted by queries, counts, and writes of sessions they
+// are set on via Session.SetNamespaceDefaults. They take precedence over
+// the equivalent session settings, as they are specific to a namespace,
+// but not over settings of individual queries such as Query.Comment and
+// Query.Hint, nor over snapshot reads (see Session.SetSnapshot).
+type NamespaceDefaults struct {
+	m        sync.RWMutex
+	defaults map[string]*namespaceDefault
+}
+
+// NamespaceDefault describes the defaults for a single namespace, as set
+// via NamespaceDefaults.Set and loaded by NamespaceDefaults.Load.
+//
+// The namespace is either "<database>.<collection>", or "<database>.*"
+// for the defaults of all collections in the database without defaults
+// of their own. Unset fields have no default.
+type NamespaceDefault struct {
+	Namespace   string   `json:"namespace"`
+	Safe        *Safe    `json:"safe,omitempty"`        // Write concern, as for Session.SetSafe
+	ReadConcern string   `json:"readConcern,omitempty"` // Read concern level, as for Session.SetReadConcern
+	Comment     string   `json:"comment,omitempty"`     // Comment, as for Query.Comment
+	Hint        []string `json:"hint,omitempty"`        // Index key, as for Query.Hint
+}
+
+type namespaceDefault struct {
+	NamespaceDefault
+	safeOp *queryOp
+	hint   bson.D
+}
+
+// NewNamespaceDefaults returns a new NamespaceDefaults holding no defaults.
+func NewNamespaceDefaults() *NamespaceDefaults {
+	return &NamespaceDefaults{defaults: make(map[string]*namespaceDefault)}
+}
+
+func newNamespaceDefault(d NamespaceDefault) (*namespaceDefault, error) {
+	dot := strings.Index(d.Namespace, ".")
+	if dot <= 0 || dot == len(d.Namespace)-1 {
+		return nil, fmt.Errorf("invalid defaults namespace: %q", d.Namespace)
+	}
+	nd := &namespaceDefault{NamespaceDefault: d}
+	if d.Safe != nil {
+		safe := *d.Safe
+		nd.Safe = &safe
+		nd.safeOp = newSafeOp(newGetLastError(&safe))
+	}
+	if len(d.Hint) > 0 {
+		if strings.HasSuffix(d.Namespace, ".*") {
+			return nil, fmt.Errorf("defaults for %s cannot have a hint", d.Namespace)
+		}
+		keyInfo, err := parseIndexKey(d.Hint)
+		if err != nil {
+			return nil, err
+		}
+		nd.Hint = append([]string(nil), d.Hint...)
+		nd.hint = keyInfo.key
+	}
+	return nd, nil
+}
+
+// Set sets the defaults for the namespace of d, replacing any defaults
+// previously set for it.
+func (n *NamespaceDefaults) Set(d NamespaceDefault) error {
+	nd, err := newNamespaceDefault(d)
+	if err != nil {
+		return err
+	}
+	n.m.Lock()
+	n.defaults[d.Namespace] = nd
+	n.m.Unlock()
+	return nil
+}
+
+// Unset removes the defaults set for namespace, if any.
+func (n *NamespaceDefaults) Unset(namespace string) {
+	n.m.Lock()
+	delete(n.defaults, namespace)
+	n.m.Unlock()
+}
+
+// Get returns the defaults in effect for the collection at namespace,
+// in the form "<database>.<collection>", which are either the ones set
+// for it or the ones set for all collections of its database.
+func (n *NamespaceDefaults) Get(namespace string) (d NamespaceDefault, ok bool) {
+	if nd := n.lookup(namespace); nd != nil {
+		return nd.NamespaceDefault, true
+	}
+	return d, false
+}
+
+func (n *NamespaceDefaults) lookup(namespace string) *namespaceDefault {
+	n.m.RLock()
+	defer n.m.RUnlock()
+	if nd, ok := n.defaults[namespace]; ok {
+		return nd
+	}
+	if dot := strings.Index(namespace, "."); dot > 0 {
+		return n.defaults[namespace[:dot]+".*"]
+	}
+	return nil
+}
+
+// Load replaces all defaults held with the ones read from r, which must
+// hold a JSON array of NamespaceDefault values:
+//
+//     [{"namespace": "mydb.*", "safe": {"wmode": "majority"}},
+//      {"namespace": "mydb.events", "safe": {"w": 1}, "readConcern": "local"},
+//      {"namespace": "mydb.orders", "comment": "orders", "hint": ["status"]}]
+//
+// The defaults held are left unchanged if any of the loaded ones is
+// invalid, so configuration may be reloaded while operations are running.
+func (n *NamespaceDefaults) Load(r io.Reader) error {
+	var loaded []NamespaceDefault
+	if err := json.NewDecoder(r).Decode(&loaded); err != nil {
+		return fmt.Errorf("cannot load namespace defaults: %v", err)
+	}
+	defaults := make(map[string]*namespaceDefault, len(loaded))
+	for _, d := range loaded {
+		nd, err := newNamespaceDefault(d)
+		if err != nil {
+			return err
+		}
+		defaults[d.Namespace] = nd
+	}
+	n.m.Lock()
+	n.defaults = defaults
+	n.m.Unlock()
+	return nil
+}
+
+// SetNamespaceDefaults sets the namespace defaults consulted by the
+// operations performed by the session, with nil meaning that no defaults
+// are consulted. See NamespaceDefaults for details.
+//
+// The defaults are inherited by sessions obtained via Copy, Clone, and
+// New, and may be changed at any time, with later operations seeing the
+// changes.
+func (s *Session) SetNamespaceDefaults(defaults *NamespaceDefaults) {
+	s.m.Lock()
+	s.nsDefaults = defaults
+	s.m.Unlock()
+}
+
+// namespaceDefaultLocked returns the defaults in effect for the collection
+// at namespace, or nil if there are none. It must be called with s.m held.
+func (s *Session) namespaceDefaultLocked(namespace string) *namespaceDefault {
+	if s.nsDefaults == nil || strings.HasSuffix(namespace, ".$cmd") {
+		return nil
+	}
+	return s.nsDefaults.lookup(namespace)
+}
+
+// apply applies the read concern and comment defaults to query op. It
+// must be called after the read concern of the session is set on op, and
+// before its comment is.
+func (nd *namespaceDefault) apply(op *queryOp, snapshot bool) {
+	if nd.ReadConcern != "" && !snapshot {
+		op.readConcern = readConcernDoc(nd.ReadConcern, op.afterClusterTime)
+	}
+	if nd.Comment != "" && op.options.Comment == "" {
+		op.options.Comment = nd.Comment
+		op.hasOptions = true
+	}
+}
+
+// applyHint adds the default hint to query op, unless it has one already.
+func (nd *namespaceDefault) applyHint(op *queryOp) {
+	if nd.hint != nil && op.options.Hint == nil {
+		op.options.Hint = nd.hint
+		op.hasOptions = true
+	}
+}
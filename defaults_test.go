@@ -0,0 +1,125 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo_test
+
+import (
+	"strings"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (s *S) TestNamespaceDefaultsLoad(c *C) {
+	defaults := mgo.NewNamespaceDefaults()
+	err := defaults.Load(strings.NewReader(`[
+		{"namespace": "mydb.mycoll", "safe": {"WMode": "majority"}, "comment": "mycoll", "hint": ["a", "-b"]},
+		{"namespace": "mydb.*", "readConcern": "majority"}
+	]`))
+	c.Assert(err, IsNil)
+
+	d, ok := defaults.Get("mydb.mycoll")
+	c.Assert(ok, Equals, true)
+	c.Assert(d, DeepEquals, mgo.NamespaceDefault{
+		Namespace: "mydb.mycoll",
+		Safe:      &mgo.Safe{WMode: "majority"},
+		Comment:   "mycoll",
+		Hint:      []string{"a", "-b"},
+	})
+	d, ok = defaults.Get("mydb.other")
+	c.Assert(ok, Equals, true)
+	c.Assert(d, DeepEquals, mgo.NamespaceDefault{Namespace: "mydb.*", ReadConcern: "majority"})
+	_, ok = defaults.Get("otherdb.mycoll")
+	c.Assert(ok, Equals, false)
+
+	// Invalid defaults leave the loaded ones untouched.
+	err = defaults.Load(strings.NewReader(`[{"namespace": "mydb", "comment": "mydb"}]`))
+	c.Assert(err, ErrorMatches, `invalid defaults namespace: "mydb"`)
+	err = defaults.Load(strings.NewReader(`[{"namespace": "mydb.*", "hint": ["a"]}]`))
+	c.Assert(err, ErrorMatches, `defaults for mydb.\* cannot have a hint`)
+	err = defaults.Load(strings.NewReader(`[{"namespace": "mydb.mycoll", "hint": ["$text:"]}]`))
+	c.Assert(err, ErrorMatches, "invalid index key: .*")
+	err = defaults.Load(strings.NewReader(`{`))
+	c.Assert(err, ErrorMatches, "cannot load namespace defaults: .*")
+	_, ok = defaults.Get("mydb.mycoll")
+	c.Assert(ok, Equals, true)
+
+	// Loading replaces all defaults.
+	err = defaults.Load(strings.NewReader(`[]`))
+	c.Assert(err, IsNil)
+	_, ok = defaults.Get("mydb.mycoll")
+	c.Assert(ok, Equals, false)
+
+	err = defaults.Set(mgo.NamespaceDefault{Namespace: "mydb.mycoll", Comment: "set"})
+	c.Assert(err, IsNil)
+	d, ok = defaults.Get("mydb.mycoll")
+	c.Assert(ok, Equals, true)
+	c.Assert(d.Comment, Equals, "set")
+	defaults.Unset("mydb.mycoll")
+	_, ok = defaults.Get("mydb.mycoll")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *S) TestNamespaceDefaults(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.Insert(M{"n": 1})
+	c.Assert(err, IsNil)
+	err = coll.EnsureIndexKey("n")
+	c.Assert(err, IsNil)
+
+	var hints []interface{}
+	session.SetPolicy(mgo.PolicyFunc(func(op *mgo.Operation) error {
+		if op.Command == "find" {
+			hints = append(hints, op.Hint)
+		}
+		return nil
+	}))
+
+	defaults := mgo.NewNamespaceDefaults()
+	err = defaults.Set(mgo.NamespaceDefault{Namespace: "mydb.mycoll", Hint: []string{"n"}})
+	c.Assert(err, IsNil)
+	err = defaults.Set(mgo.NamespaceDefault{Namespace: "mydb.*", Safe: &mgo.Safe{WMode: "nonexistent"}})
+	c.Assert(err, IsNil)
+	session.SetNamespaceDefaults(defaults)
+
+	var result M
+	err = coll.Find(M{"n": 1}).One(&result)
+	c.Assert(err, IsNil)
+	err = coll.Find(M{"n": 1}).Hint("_id").One(&result)
+	c.Assert(err, IsNil)
+	c.Assert(hints, DeepEquals, []interface{}{bson.D{{"n", 1}}, bson.D{{"_id", 1}}})
+
+	// The database-wide write concern applies to other collections only.
+	err = coll.Insert(M{"n": 2})
+	c.Assert(err, IsNil)
+	err = session.DB("mydb").C("other").Insert(M{"n": 1})
+	c.Assert(err, NotNil)
+}
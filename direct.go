@@ -0,0 +1,114 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// DirectConn is a single connection to a single server, for tools and
+// health probes that need to run a few commands as quickly as possible.
+// Unlike sessions, it doesn't discover or monitor servers, doesn't pool
+// connections, and doesn't retry or fall over to other servers.
+type DirectConn struct {
+	socket *mongoSocket
+}
+
+// DialDirect connects to the server at addr, waiting at most timeout for
+// the connection to be established and then for each command to run.
+// If the port is not provided in addr, it defaults to 27017. Commands
+// are accepted by secondaries as well, as with the Monotonic mode.
+func DialDirect(addr string, timeout time.Duration) (*DirectConn, error) {
+	if p := strings.LastIndexAny(addr, "]:"); p == -1 || addr[p] != ':' {
+		addr += ":27017"
+	}
+	tcpaddr, err := resolveAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	// The server is never registered with a cluster, and being closed
+	// prevents the socket from being recycled into its pool.
+	server := &mongoServer{
+		Addr:         addr,
+		ResolvedAddr: tcpaddr.String(),
+		tcpaddr:      tcpaddr,
+		info:         &defaultServerInfo,
+		closed:       true,
+		resolver:     newAddrResolver(0),
+	}
+	socket, err := server.Connect(timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &DirectConn{socket}, nil
+}
+
+// Login authenticates with the server using the provided credential.
+func (c *DirectConn) Login(cred *Credential) error {
+	return c.socket.Login(*cred)
+}
+
+// Run issues the provided command on the db database and unmarshals its
+// result into the respective argument, as Database.Run does.
+func (c *DirectConn) Run(db string, cmd interface{}, result interface{}) error {
+	if name, ok := cmd.(string); ok {
+		cmd = bson.D{{name, 1}}
+	}
+	op := queryOp{
+		collection: db + ".$cmd",
+		query:      cmd,
+		flags:      flagSlaveOk,
+		limit:      -1,
+	}
+	data, err := c.socket.SimpleQuery(&op)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return ErrNotFound
+	}
+	if err := checkQueryError(op.collection, data); err != nil {
+		return err
+	}
+	if result != nil {
+		return bson.Unmarshal(data, result)
+	}
+	return nil
+}
+
+// Ping runs a trivial ping command against the server.
+func (c *DirectConn) Ping() error {
+	return c.Run("admin", "ping", nil)
+}
+
+// Close closes the connection.
+func (c *DirectConn) Close() {
+	c.socket.Close()
+}
@@ -0,0 +1,86 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo_test
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (s *S) TestDirectConn(c *C) {
+	// Secondaries accept commands too.
+	conn, err := mgo.DialDirect("localhost:40012", 5*time.Second)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	err = conn.Ping()
+	c.Assert(err, IsNil)
+
+	var result struct {
+		IsMaster  bool
+		Secondary bool
+	}
+	err = conn.Run("admin", "ismaster", &result)
+	c.Assert(err, IsNil)
+	c.Assert(result.IsMaster, Equals, false)
+	c.Assert(result.Secondary, Equals, true)
+
+	err = conn.Run("admin", bson.D{{"unknownCommand", 1}}, nil)
+	c.Assert(err, ErrorMatches, "no such (cmd|command).*")
+
+	// No other connections are established.
+	stats := mgo.GetStats()
+	c.Assert(stats.SocketsAlive, Equals, 1)
+
+	conn.Close()
+	err = conn.Ping()
+	c.Assert(err, ErrorMatches, "Closed explicitly")
+}
+
+func (s *S) TestDirectConnLogin(c *C) {
+	conn, err := mgo.DialDirect("localhost:40002", 5*time.Second)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	err = conn.Run("mydb", bson.D{{"count", "mycoll"}}, nil)
+	c.Assert(err, ErrorMatches, ".*(not authorized|unauthorized|requires authentication).*")
+
+	err = conn.Login(&mgo.Credential{Username: "root", Password: "rapadura"})
+	c.Assert(err, IsNil)
+
+	err = conn.Run("mydb", bson.D{{"count", "mycoll"}}, nil)
+	c.Assert(err, IsNil)
+}
+
+func (s *S) TestDialDirectFailure(c *C) {
+	// 40009 isn't used by the test servers.
+	_, err := mgo.DialDirect("localhost:40009", time.Second)
+	c.Assert(err, ErrorMatches, ".*connection refused")
+}
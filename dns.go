@@ -0,0 +1,198 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// dnsPolicy holds the settings for resolving server host names.
+type dnsPolicy struct {
+	cacheTTL        time.Duration
+	resolveInterval time.Duration
+	addrChanged     func(addr string, from, to *net.TCPAddr)
+
+	// remote is set when a proxy resolves host names, in which case
+	// servers are known only by their unresolved address.
+	remote bool
+}
+
+// addrResolver resolves server addresses, caching the results for ttl.
+type addrResolver struct {
+	m     sync.Mutex
+	ttl   time.Duration
+	cache map[string]cachedAddr
+	hosts map[string]cachedHost
+}
+
+type cachedAddr struct {
+	tcpaddr *net.TCPAddr
+	expires time.Time
+}
+
+type cachedHost struct {
+	ipaddrs []net.IPAddr
+	expires time.Time
+}
+
+func newAddrResolver(ttl time.Duration) *addrResolver {
+	return &addrResolver{ttl: ttl, cache: make(map[string]cachedAddr), hosts: make(map[string]cachedHost)}
+}
+
+// resolve works like resolveAddr, but reuses the address addr resolved
+// to if that happened less than r.ttl ago.
+func (r *addrResolver) resolve(addr string) (*net.TCPAddr, error) {
+	if r.ttl <= 0 {
+		return resolveAddr(addr)
+	}
+	r.m.Lock()
+	cached, ok := r.cache[addr]
+	r.m.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.tcpaddr, nil
+	}
+	tcpaddr, err := resolveAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	r.set(addr, tcpaddr)
+	return tcpaddr, nil
+}
+
+// set caches tcpaddr as the resolution of addr.
+func (r *addrResolver) set(addr string, tcpaddr *net.TCPAddr) {
+	if r.ttl <= 0 {
+		return
+	}
+	r.m.Lock()
+	r.cache[addr] = cachedAddr{tcpaddr, time.Now().Add(r.ttl)}
+	r.m.Unlock()
+}
+
+// lookupHost returns all addresses host resolves to, reusing the ones
+// found less than r.ttl ago. The lookup is abandoned at deadline.
+func (r *addrResolver) lookupHost(host string, deadline time.Time) ([]net.IPAddr, error) {
+	if r.ttl > 0 {
+		r.m.Lock()
+		cached, ok := r.hosts[host]
+		r.m.Unlock()
+		if ok && time.Now().Before(cached.expires) {
+			return cached.ipaddrs, nil
+		}
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	ipaddrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	r.setHost(host, ipaddrs)
+	return ipaddrs, nil
+}
+
+// setHost caches ipaddrs as the addresses host resolves to.
+func (r *addrResolver) setHost(host string, ipaddrs []net.IPAddr) {
+	if r.ttl <= 0 {
+		return
+	}
+	r.m.Lock()
+	r.hosts[host] = cachedHost{ipaddrs, time.Now().Add(r.ttl)}
+	r.m.Unlock()
+}
+
+// resolveLoop re-resolves the host names of all known servers every
+// interval while the cluster is alive, and replaces the servers whose
+// names no longer resolve to the address they are connected to.
+func (cluster *mongoCluster) resolveLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		cluster.RLock()
+		if cluster.references == 0 {
+			cluster.RUnlock()
+			return
+		}
+		servers := append([]*mongoServer(nil), cluster.servers.Slice()...)
+		cluster.RUnlock()
+
+		changed := false
+		for _, server := range servers {
+			if cluster.checkServerAddr(server) {
+				changed = true
+			}
+		}
+		if changed {
+			cluster.syncServers()
+		}
+	}
+}
+
+// checkServerAddr reports whether the host name of server resolves to
+// addresses that no longer include the one it is connected to, in which
+// case the server is removed from the cluster so that the following sync
+// adds it again with its new address.
+func (cluster *mongoCluster) checkServerAddr(server *mongoServer) bool {
+	host, port, err := net.SplitHostPort(server.Addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return false
+	}
+	portnum, err := strconv.Atoi(port)
+	if err != nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ipaddrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	cancel()
+	if err != nil || len(ipaddrs) == 0 {
+		logf("SYNC Failed to re-resolve server address %s: %v", server.Addr, err)
+		return false
+	}
+	cluster.resolver.setHost(host, ipaddrs)
+	var tcpaddr *net.TCPAddr
+	for _, ipaddr := range ipaddrs {
+		candidate := &net.TCPAddr{IP: ipaddr.IP, Port: portnum, Zone: ipaddr.Zone}
+		if candidate.String() == server.ResolvedAddr {
+			return false
+		}
+		// Prefer IPv4, as resolveAddr does.
+		if tcpaddr == nil || tcpaddr.IP.To4() == nil && candidate.IP.To4() != nil {
+			tcpaddr = candidate
+		}
+	}
+
+	logf("SYNC Address of %s changed from %s to %s.", server.Addr, server.ResolvedAddr, tcpaddr)
+	cluster.resolver.set(server.Addr, tcpaddr)
+	cluster.removeServer(server)
+	if addrChanged := cluster.options.dns.addrChanged; addrChanged != nil {
+		addrChanged(server.Addr, server.tcpaddr, tcpaddr)
+	}
+	return true
+}
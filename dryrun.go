@@ -0,0 +1,178 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+// DryRunReport describes a destructive operation that a session in dry
+// run mode counted the affected documents of instead of performing it.
+type DryRunReport struct {
+	Database   string      // Database the operation targets
+	Collection string      // Collection the operation targets, or "" when dropping a database
+	Op         string      // One of "update", "delete", "drop", "dropDatabase", or "dropIndex"
+	Selector   interface{} // Selector of the documents to update or delete
+	Index      string      // Name of the index to drop, for "dropIndex"
+	Matched    int         // Number of documents the operation would have affected
+}
+
+// SetDryRun sets the function that the session reports destructive
+// operations to instead of performing them, with nil meaning that
+// operations are performed as usual. It's meant for verifying migration
+// scripts against real data without risking it.
+//
+// In dry run mode, updates, upserts, and removals, including bulk ones
+// and those made via Query.Apply, count the documents matching their
+// selectors instead, and report these counts via the result of the
+// respective method as if the operations had run. Updated counts equal
+// matched counts, as whether the documents would have been modified
+// isn't known, and upserts matching no documents don't report an
+// upserted id. Query.Apply leaves its result untouched. DropCollection
+// and DropDatabase count the documents in the collection or database,
+// while DropIndex and DropIndexName report the index without dropping
+// it.
+//
+// Inserts are performed as usual, and so are commands sent via Run,
+// including destructive ones such as "delete" or "drop", since they
+// aren't inspected. See SetReadOnly for rejecting inserts instead.
+//
+// The dry run mode is inherited by sessions obtained via Copy, Clone,
+// and New.
+func (s *Session) SetDryRun(report func(r DryRunReport)) {
+	s.m.Lock()
+	s.dryRun = report
+	s.m.Unlock()
+}
+
+// dryRunWrite counts and reports the documents the update or delete op
+// on c would affect. It returns false if op must be performed anyway.
+func (c *Collection) dryRunWrite(report func(r DryRunReport), op interface{}) (lerr *LastError, ok bool, err error) {
+	var ops []interface{}
+	switch op := op.(type) {
+	case *updateOp, *deleteOp:
+		ops = []interface{}{op}
+	case bulkUpdateOp:
+		ops = op
+	case bulkDeleteOp:
+		ops = op
+	default:
+		return nil, false, nil
+	}
+	lerr = &LastError{}
+	for _, op := range ops {
+		r := DryRunReport{Database: c.Database.Name, Collection: c.Name}
+		limit := 0
+		switch op := op.(type) {
+		case *updateOp:
+			r.Op = "update"
+			r.Selector = op.Selector
+			if !op.Multi && op.Flags&2 == 0 {
+				limit = 1
+			}
+		case *deleteOp:
+			r.Op = "delete"
+			r.Selector = op.Selector
+			if op.Limit == 1 || op.Flags&1 != 0 {
+				limit = 1
+			}
+		}
+		r.Matched, err = c.Find(r.Selector).Limit(limit).Count()
+		if err != nil {
+			return nil, true, err
+		}
+		report(r)
+		lerr.N += r.Matched
+		if r.Op == "update" {
+			lerr.modified += r.Matched
+			lerr.UpdatedExisting = lerr.UpdatedExisting || r.Matched > 0
+		}
+	}
+	return lerr, true, nil
+}
+
+// dryRunApply counts and reports the document that Query.Apply would
+// modify with change, failing with ErrNotFound as Apply does when no
+// document matches and change isn't an upsert.
+func (c *Collection) dryRunApply(report func(r DryRunReport), query interface{}, change Change) (info *ChangeInfo, err error) {
+	var op interface{} = &updateOp{Selector: query, Update: change.Update, Upsert: change.Upsert}
+	if change.Remove {
+		op = &deleteOp{Selector: query, Limit: 1}
+	}
+	lerr, _, err := c.dryRunWrite(report, op)
+	if err != nil {
+		return nil, err
+	}
+	info = &ChangeInfo{Matched: lerr.N}
+	switch {
+	case lerr.N > 0 && change.Remove:
+		info.Removed = lerr.N
+	case lerr.N > 0:
+		info.Updated = lerr.N
+	case !change.Upsert:
+		return nil, ErrNotFound
+	}
+	return info, nil
+}
+
+// dryRunDropIndex reports dropping the named index of c. It returns
+// false if the session isn't in dry run mode.
+func (c *Collection) dryRunDropIndex(name string) bool {
+	c.Database.Session.m.RLock()
+	report := c.Database.Session.dryRun
+	c.Database.Session.m.RUnlock()
+	if report == nil {
+		return false
+	}
+	report(DryRunReport{Database: c.Database.Name, Collection: c.Name, Op: "dropIndex", Index: name})
+	return true
+}
+
+// dryRunDrop counts and reports the documents that dropping the given
+// collection, or the whole database if coll is "", would delete. It
+// returns false if the session isn't in dry run mode.
+func (db *Database) dryRunDrop(coll string) (ok bool, err error) {
+	db.Session.m.RLock()
+	report := db.Session.dryRun
+	db.Session.m.RUnlock()
+	if report == nil {
+		return false, nil
+	}
+	r := DryRunReport{Database: db.Name, Collection: coll, Op: "drop"}
+	names := []string{coll}
+	if coll == "" {
+		r.Op = "dropDatabase"
+		if names, err = db.CollectionNames(); err != nil {
+			return true, err
+		}
+	}
+	for _, name := range names {
+		n, err := db.C(name).Count()
+		if err != nil {
+			return true, err
+		}
+		r.Matched += n
+	}
+	report(r)
+	return true, nil
+}
@@ -0,0 +1,120 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo_test
+
+import (
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+)
+
+func (s *S) TestDryRun(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	for i := 0; i < 5; i++ {
+		err = coll.Insert(M{"n": i})
+		c.Assert(err, IsNil)
+	}
+
+	var reports []mgo.DryRunReport
+	session.SetDryRun(func(r mgo.DryRunReport) {
+		reports = append(reports, r)
+	})
+
+	info, err := coll.UpdateAll(M{"n": M{"$gte": 2}}, M{"$set": M{"n": 0}})
+	c.Assert(err, IsNil)
+	c.Assert(info, DeepEquals, &mgo.ChangeInfo{Matched: 3, Updated: 3})
+	err = coll.Update(M{"n": 42}, M{"$set": M{"n": 0}})
+	c.Assert(err, Equals, mgo.ErrNotFound)
+	err = coll.Remove(M{"n": M{"$gte": 2}})
+	c.Assert(err, IsNil)
+	info, err = coll.RemoveAll(M{"n": M{"$lt": 2}})
+	c.Assert(err, IsNil)
+	c.Assert(info, DeepEquals, &mgo.ChangeInfo{Matched: 2, Removed: 2})
+
+	bulk := coll.Bulk()
+	bulk.RemoveAll(M{})
+	bulk.UpdateAll(M{"n": 1}, M{"$set": M{"n": 0}})
+	bresult, err := bulk.Run()
+	c.Assert(err, IsNil)
+	c.Assert(bresult.Matched, Equals, 6)
+
+	var doc M
+	info, err = coll.Find(M{"n": 1}).Apply(mgo.Change{Remove: true}, &doc)
+	c.Assert(err, IsNil)
+	c.Assert(info, DeepEquals, &mgo.ChangeInfo{Matched: 1, Removed: 1})
+	c.Assert(doc, IsNil)
+	_, err = coll.Find(M{"n": 42}).Apply(mgo.Change{Update: M{"$set": M{"n": 0}}}, nil)
+	c.Assert(err, Equals, mgo.ErrNotFound)
+	info, err = coll.Find(M{"n": 42}).Apply(mgo.Change{Update: M{"$set": M{"n": 0}}, Upsert: true}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(info, DeepEquals, &mgo.ChangeInfo{})
+
+	err = coll.EnsureIndexKey("n")
+	c.Assert(err, IsNil)
+	err = coll.DropIndex("n")
+	c.Assert(err, IsNil)
+	err = coll.DropIndexName("n_1")
+	c.Assert(err, IsNil)
+
+	err = coll.DropCollection()
+	c.Assert(err, IsNil)
+	err = session.DB("mydb").DropDatabase()
+	c.Assert(err, IsNil)
+
+	ops := make([]string, len(reports))
+	matched := make([]int, len(reports))
+	for i, r := range reports {
+		ops[i] = r.Op
+		matched[i] = r.Matched
+	}
+	c.Assert(ops, DeepEquals, []string{"update", "update", "delete", "delete", "delete", "update", "delete", "update", "update", "dropIndex", "dropIndex", "drop", "dropDatabase"})
+	c.Assert(matched, DeepEquals, []int{3, 0, 1, 2, 5, 1, 1, 0, 0, 0, 0, 5, 5})
+	c.Assert(reports[9].Index, Equals, "n_1")
+	c.Assert(reports[11].Collection, Equals, "mycoll")
+	c.Assert(reports[12].Collection, Equals, "")
+
+	// Nothing was actually changed.
+	n, err := coll.Find(M{"n": M{"$gte": 2}}).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+	indexes, err := coll.Indexes()
+	c.Assert(err, IsNil)
+	c.Assert(indexes, HasLen, 2)
+
+	// Inserts are performed as usual.
+	err = coll.Insert(M{"n": 5})
+	c.Assert(err, IsNil)
+	session.SetDryRun(nil)
+	err = coll.DropCollection()
+	c.Assert(err, IsNil)
+	n, err = coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 0)
+}
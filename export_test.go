@@ -1,7 +1,10 @@
 package mgo
 
 import (
+	"net"
 	"time"
+
+	"gopkg.in/mgo.v2/bson"
 )
 
 func HackPingDelay(newDelay time.Duration) (restore func()) {
@@ -31,3 +34,70 @@ func HackSyncSocketTimeout(newTimeout time.Duration) (restore func()) {
 	syncSocketTimeout = newTimeout
 	return
 }
+
+var DialParallel = dialParallel
+
+// LookupHost looks up host with a resolver caching addresses for ttl,
+// after caching the addresses in cached.
+func LookupHost(ttl time.Duration, cached map[string][]net.IPAddr, host string) ([]net.IPAddr, error) {
+	r := newAddrResolver(ttl)
+	for name, ipaddrs := range cached {
+		r.setHost(name, ipaddrs)
+	}
+	return r.lookupHost(host, time.Now().Add(5*time.Second))
+}
+
+// AllocRequestIds reserves n request ids on a socket whose last handed
+// out id is last, and returns the first reserved id.
+func AllocRequestIds(last uint32, n int) uint32 {
+	socket := &mongoSocket{nextRequestId: last}
+	return socket.allocRequestIds(n)
+}
+
+func QueryShape(command string, doc interface{}) string {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		panic(err)
+	}
+	return queryShape(command, data)
+}
+
+func (c *Collection) SampleReservoir(n int, result interface{}) error {
+	return c.sampleReservoir(n, result)
+}
+
+func CheckQueryError(fullname string, doc interface{}) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		panic(err)
+	}
+	return checkQueryError(fullname, data)
+}
+
+func QuotaEnter(quota *Quota) func(priority Priority) (leave func(), err error) {
+	return newServerQuota(quota).enter
+}
+
+// AutoBatchSize returns the size of the batch an auto batching iterator
+// with the given window and prefetch would request after receiving docs
+// documents of docSize bytes, with buffered of them not yet consumed.
+func AutoBatchSize(window int, prefetch float64, docSize, docs, buffered int, rtt, perDoc time.Duration) int32 {
+	consumed := docs - buffered
+	iter := &Iter{
+		autoBatch:     window,
+		prefetch:      prefetch,
+		receivedBytes: int64(docSize * docs),
+		receivedDocs:  int64(docs),
+		bufferedBytes: docSize * buffered,
+		rtt:           rtt,
+		consumedDocs:  int64(consumed),
+		consumeTime:   perDoc * time.Duration(consumed),
+	}
+	return iter.autoBatchSize()
+}
+
+func HackPurgeWindowPoll(poll time.Duration) (restore func()) {
+	old := purgeWindowPoll
+	purgeWindowPoll = poll
+	return func() { purgeWindowPoll = old }
+}
@@ -0,0 +1,250 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"reflect"
+	"strconv"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// InQuery finds documents whose field holds any of a list of values that
+// may be too large for a single $in filter to fit in a query document.
+// See Collection.FindIn.
+type InQuery struct {
+	coll     *Collection
+	field    string
+	values   interface{}
+	filter   interface{}
+	selector interface{}
+	maxBytes int
+}
+
+// FindIn prepares a query for the documents in the collection whose field
+// holds any of values, which must be a slice or an array. When the values
+// don't fit comfortably in a single query document, they're split into
+// batches that are sent as consecutive queries with smaller $in filters,
+// so the results of long id lists may be obtained with a single call:
+//
+//     var people []Person
+//     err := collection.FindIn("_id", ids, nil).All(&people)
+//
+// The filter parameter, which may be nil, holds further conditions the
+// documents must match. The results of distinct batches are provided in
+// turn, so documents are not sorted across batches, and documents with
+// an array field holding values of distinct batches are returned once
+// for each of those batches.
+func (c *Collection) FindIn(field string, values interface{}, filter interface{}) *InQuery {
+	v := reflect.ValueOf(values)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		panic("FindIn values must be a slice or an array")
+	}
+	return &InQuery{coll: c, field: field, values: values, filter: filter}
+}
+
+// Select enables selecting which fields should be retrieved for the
+// results found, as done by Query.Select.
+func (q *InQuery) Select(selector interface{}) *InQuery {
+	q.selector = selector
+	return q
+}
+
+// BatchBytes sets the maximum size in bytes of the $in array sent in a
+// single query. It defaults to half of the maximum document size of the
+// server, leaving room for the rest of the query.
+func (q *InQuery) BatchBytes(n int) *InQuery {
+	q.maxBytes = n
+	return q
+}
+
+// queries returns the queries that together find the documents q does.
+func (q *InQuery) queries() ([]*Query, error) {
+	maxBytes := q.maxBytes
+	if maxBytes <= 0 {
+		session := q.coll.Database.Session
+		socket, err := session.acquireSocket(true)
+		if err != nil {
+			return nil, err
+		}
+		maxBytes = socket.ServerInfo().MaxBSONObjectSize
+		socket.Release()
+		if maxBytes <= 0 {
+			maxBytes = defaultMaxBSONObjectSize
+		}
+		maxBytes /= 2
+	}
+	batches, err := splitInValues(reflect.ValueOf(q.values), maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	queries := make([]*Query, len(batches))
+	for i, batch := range batches {
+		var query interface{} = bson.D{{q.field, bson.D{{"$in", batch}}}}
+		if q.filter != nil {
+			query = bson.D{{"$and", []interface{}{query, q.filter}}}
+		}
+		queries[i] = q.coll.Find(query)
+		if q.selector != nil {
+			queries[i].Select(q.selector)
+		}
+	}
+	return queries, nil
+}
+
+// splitInValues marshals the values in v and splits them into batches
+// that fit in arrays of up to maxBytes. A single value larger than that
+// still makes up a batch of its own.
+func splitInValues(v reflect.Value, maxBytes int) ([][]interface{}, error) {
+	var batches [][]interface{}
+	var batch []interface{}
+	size := 5
+	for i := 0; i < v.Len(); i++ {
+		data, err := bson.Marshal(bson.D{{"v", v.Index(i).Interface()}})
+		if err != nil {
+			return nil, err
+		}
+		fields, err := bson.Fields(data, "v")
+		if err != nil {
+			return nil, err
+		}
+		value := fields["v"]
+		// Kind, index key, and value.
+		valueSize := 1 + len(strconv.Itoa(len(batch))) + 1 + len(value.Data)
+		if len(batch) > 0 && size+valueSize > maxBytes {
+			batches = append(batches, batch)
+			batch, size = nil, 5
+			valueSize = 3 + len(value.Data)
+		}
+		batch = append(batch, value)
+		size += valueSize
+	}
+	if len(batch) > 0 || len(batches) == 0 {
+		batches = append(batches, batch)
+	}
+	return batches, nil
+}
+
+// Iter executes the queries and returns an iterator capable of going
+// over all their results in turn.
+func (q *InQuery) Iter() *InIter {
+	queries, err := q.queries()
+	return &InIter{queries: queries, err: err}
+}
+
+// All works like Iter.All.
+func (q *InQuery) All(result interface{}) error {
+	return q.Iter().All(result)
+}
+
+// Count returns the total number of documents found by the queries.
+func (q *InQuery) Count() (n int, err error) {
+	queries, err := q.queries()
+	if err != nil {
+		return 0, err
+	}
+	for _, query := range queries {
+		count, err := query.Count()
+		if err != nil {
+			return 0, err
+		}
+		n += count
+	}
+	return n, nil
+}
+
+// InIter goes over the results of the queries prepared by an InQuery,
+// running them one after the other.
+type InIter struct {
+	queries []*Query
+	iter    *Iter
+	err     error
+}
+
+// Next retrieves the next document from the result set, running the
+// next query once the results of the current one are exhausted, and
+// works like Iter.Next otherwise.
+func (iter *InIter) Next(result interface{}) bool {
+	for iter.err == nil {
+		if iter.iter == nil {
+			if len(iter.queries) == 0 {
+				return false
+			}
+			iter.iter = iter.queries[0].Iter()
+			iter.queries = iter.queries[1:]
+		}
+		if iter.iter.Next(result) {
+			return true
+		}
+		iter.err = iter.iter.Close()
+		iter.iter = nil
+	}
+	return false
+}
+
+// Err returns nil if no errors happened during iteration, or the actual
+// error otherwise.
+func (iter *InIter) Err() error {
+	if iter.err == nil && iter.iter != nil {
+		return iter.iter.Err()
+	}
+	return iter.err
+}
+
+// Close closes the iterator of the query running, if any, and returns
+// nil if no errors happened during iteration, or the actual error
+// otherwise. Queries that didn't run yet are dropped.
+func (iter *InIter) Close() error {
+	if iter.iter != nil {
+		if err := iter.iter.Close(); err != nil && iter.err == nil {
+			iter.err = err
+		}
+		iter.iter = nil
+	}
+	iter.queries = nil
+	return iter.err
+}
+
+// All retrieves all documents from the result set into the provided
+// slice and closes the iterator, as done by Iter.All.
+func (iter *InIter) All(result interface{}) error {
+	resultv := reflect.ValueOf(result)
+	if resultv.Kind() != reflect.Ptr || resultv.Elem().Kind() != reflect.Slice {
+		panic("result argument must be a slice address")
+	}
+	slicev := resultv.Elem().Slice(0, 0)
+	elemt := slicev.Type().Elem()
+	for {
+		elemp := reflect.New(elemt)
+		if !iter.Next(elemp.Interface()) {
+			break
+		}
+		slicev = reflect.Append(slicev, elemp.Elem())
+	}
+	resultv.Elem().Set(slicev)
+	return iter.Close()
+}
@@ -0,0 +1,138 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ServerHealth holds the status of a single server known to a session's
+// cluster.
+type ServerHealth struct {
+	Addr           string
+	State          string // "primary", "secondary", "mongos", or "standalone"
+	SetName        string // Replica set name, if any
+	MaxWireVersion int
+
+	// LastHeartbeat is the time of the latest successful ping or
+	// ismaster exchange with the server.
+	LastHeartbeat time.Time
+
+	// RTT is the round trip time of pings to the server, as the maximum
+	// of the recent measurements. It's zero until the server is pinged.
+	RTT time.Duration
+
+	SocketsInUse int // Sockets reserved by sessions
+	SocketsIdle  int // Sockets waiting in the pool
+}
+
+// Health holds the status of the servers a session talks to, in a shape
+// suitable for reporting from health check endpoints.
+type Health struct {
+	Topology Topology
+	Mode     Mode
+
+	// Healthy reports whether a server suitable for the session's read
+	// preference, including its mode and tags, is currently known.
+	Healthy bool
+
+	Servers []ServerHealth
+}
+
+// Health returns the status of the servers known to the session's
+// cluster, and whether the session's read preference may be served by
+// any of them. Unlike Ping, Health involves no network communication,
+// so it may be called as often as needed. It reflects what was learned
+// by the background pings and cluster synchronizations, which run every
+// 15 seconds or so.
+func (s *Session) Health() *Health {
+	s.m.RLock()
+	cluster := s.cluster()
+	health := &Health{Mode: s.consistency}
+	health.Healthy = cluster.CanServe(s.consistency, s.slaveOk, s.queryConfig.op.serverTags)
+	s.m.RUnlock()
+
+	health.Topology = cluster.Topology()
+	cluster.RLock()
+	servers := cluster.servers.Slice()
+	cluster.RUnlock()
+	for _, server := range servers {
+		health.Servers = append(health.Servers, server.Health())
+	}
+	return health
+}
+
+// Health returns the status of the server.
+func (server *mongoServer) Health() ServerHealth {
+	server.RLock()
+	defer server.RUnlock()
+	health := ServerHealth{
+		Addr:           server.Addr,
+		SetName:        server.info.SetName,
+		MaxWireVersion: server.info.MaxWireVersion,
+		LastHeartbeat:  server.lastHeartbeat,
+		SocketsInUse:   len(server.liveSockets) - len(server.unusedSockets),
+		SocketsIdle:    len(server.unusedSockets),
+	}
+	if server.pingCount > 0 {
+		health.RTT = server.pingValue
+	}
+	switch {
+	case server.info.Mongos:
+		health.State = "mongos"
+	case server.info.SetName == "":
+		health.State = "standalone"
+	case server.info.Master:
+		health.State = "primary"
+	default:
+		health.State = "secondary"
+	}
+	return health
+}
+
+// CanServe returns whether a server suitable for the provided read
+// preference is currently known, following the same rules used by
+// AcquireSocket without waiting for servers to synchronize.
+func (cluster *mongoCluster) CanServe(mode Mode, slaveOk bool, serverTags []bson.D) bool {
+	cluster.RLock()
+	defer cluster.RUnlock()
+	mastersLen := cluster.masters.Len()
+	slavesLen := cluster.servers.Len() - mastersLen
+	switch {
+	case mastersLen > 0 && !(slaveOk && mode == Secondary):
+	case slavesLen > 0 && slaveOk:
+	case mastersLen > 0 && mode == Secondary && cluster.masters.HasMongos():
+	default:
+		return false
+	}
+	if slaveOk {
+		return cluster.servers.BestFit(mode, serverTags) != nil
+	}
+	return cluster.masters.BestFit(mode, nil) != nil
+}
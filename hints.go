@@ -0,0 +1,197 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// HintPins maps query shapes to the index hints queries with those shapes
+// are sent with, so that the plans of problematic queries may be pinned
+// from configuration without changing the code issuing them, and without
+// setting index filters on the server (see Collection.SetPlanCacheFilter).
+//
+// Shapes are the normalized shapes of find commands, as reported in
+// OpEvent.Shape and by QueryShapes for servers running MongoDB 3.2+:
+//
+//     find {status: ?, created: {$gt: ?}} sort {created: -1}
+//
+// Pins are consulted by the queries of sessions they are set on via
+// Session.SetHintPins. Queries that provide a hint via Query.Hint keep it.
+type HintPins struct {
+	m    sync.RWMutex
+	pins map[string]map[string]bson.D
+}
+
+// HintPin describes a single entry of a HintPins configuration, as loaded
+// by HintPins.Load.
+type HintPin struct {
+	Namespace string   `json:"namespace"` // "<database>.<collection>"
+	Shape     string   `json:"shape"`     // Normalized query shape
+	Index     []string `json:"index"`     // Index key, as provided to Query.Hint
+}
+
+// NewHintPins returns a new HintPins holding no pins.
+func NewHintPins() *HintPins {
+	return &HintPins{pins: make(map[string]map[string]bson.D)}
+}
+
+// Pin makes queries with shape on the collection at namespace, in the
+// form "<database>.<collection>", be sent with a hint for the index with
+// the provided key. The key is provided as for Query.Hint.
+func (p *HintPins) Pin(namespace, shape string, indexKey ...string) error {
+	hint, err := pinHint(namespace, indexKey)
+	if err != nil {
+		return err
+	}
+	p.m.Lock()
+	shapes, ok := p.pins[namespace]
+	if !ok {
+		shapes = make(map[string]bson.D)
+		p.pins[namespace] = shapes
+	}
+	shapes[shape] = hint
+	p.m.Unlock()
+	return nil
+}
+
+// Unpin removes the pin for queries with shape on the collection at
+// namespace, if any.
+func (p *HintPins) Unpin(namespace, shape string) {
+	p.m.Lock()
+	if shapes, ok := p.pins[namespace]; ok {
+		delete(shapes, shape)
+		if len(shapes) == 0 {
+			delete(p.pins, namespace)
+		}
+	}
+	p.m.Unlock()
+}
+
+// Hint returns the index key pinned for queries with shape on the
+// collection at namespace, if any.
+func (p *HintPins) Hint(namespace, shape string) (hint bson.D, ok bool) {
+	p.m.RLock()
+	hint, ok = p.pins[namespace][shape]
+	p.m.RUnlock()
+	return hint, ok
+}
+
+// Load replaces all pins held with the ones read from r, which must hold
+// a JSON array of HintPin values:
+//
+//     [{"namespace": "mydb.orders",
+//       "shape": "find {status: ?} sort {created: -1}",
+//       "index": ["status", "-created"]}]
+//
+// The pins held are left unchanged if any of the loaded ones is invalid,
+// so configuration may be reloaded while queries are running.
+func (p *HintPins) Load(r io.Reader) error {
+	var loaded []HintPin
+	if err := json.NewDecoder(r).Decode(&loaded); err != nil {
+		return fmt.Errorf("cannot load hint pins: %v", err)
+	}
+	pins := make(map[string]map[string]bson.D)
+	for _, pin := range loaded {
+		hint, err := pinHint(pin.Namespace, pin.Index)
+		if err != nil {
+			return err
+		}
+		shapes, ok := pins[pin.Namespace]
+		if !ok {
+			shapes = make(map[string]bson.D)
+			pins[pin.Namespace] = shapes
+		}
+		shapes[pin.Shape] = hint
+	}
+	p.m.Lock()
+	p.pins = pins
+	p.m.Unlock()
+	return nil
+}
+
+func pinHint(namespace string, indexKey []string) (bson.D, error) {
+	if strings.Index(namespace, ".") <= 0 {
+		return nil, fmt.Errorf("invalid hint pin namespace: %q", namespace)
+	}
+	keyInfo, err := parseIndexKey(indexKey)
+	if err != nil {
+		return nil, err
+	}
+	return keyInfo.key, nil
+}
+
+// SetHintPins sets the hint pins consulted by queries performed by the
+// session, with nil meaning that no pins are consulted. Queries with a
+// shape pinned have the index hint of the pin added to them, unless they
+// have a hint already.
+//
+// The pins are inherited by sessions obtained via Copy, Clone, and New,
+// and may be changed at any time, with later queries seeing the changes.
+func (s *Session) SetHintPins(pins *HintPins) {
+	s.m.Lock()
+	s.hintPins = pins
+	s.m.Unlock()
+}
+
+// apply adds the hint pinned for the shape of query op, if any.
+func (p *HintPins) apply(op *queryOp) {
+	if op.options.Hint != nil || strings.HasSuffix(op.collection, ".$cmd") {
+		return
+	}
+	p.m.RLock()
+	n := len(p.pins[op.collection])
+	p.m.RUnlock()
+	if n == 0 {
+		return
+	}
+	filter := op.query
+	if filter == nil {
+		filter = bson.D{}
+	}
+	find := bson.D{{"filter", filter}}
+	if op.options.OrderBy != nil {
+		find = append(find, bson.DocElem{"sort", op.options.OrderBy})
+	}
+	if op.selector != nil {
+		find = append(find, bson.DocElem{"projection", op.selector})
+	}
+	data, err := bson.Marshal(find)
+	if err != nil {
+		return
+	}
+	if hint, ok := p.Hint(op.collection, queryShape("find", data)); ok {
+		op.options.Hint = hint
+		op.hasOptions = true
+	}
+}
@@ -0,0 +1,118 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo_test
+
+import (
+	"strings"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (s *S) TestHintPinsLoad(c *C) {
+	pins := mgo.NewHintPins()
+	err := pins.Load(strings.NewReader(`[
+		{"namespace": "mydb.mycoll", "shape": "find {a: ?} sort {b: -1}", "index": ["a", "-b"]},
+		{"namespace": "mydb.other", "shape": "find {}", "index": ["c"]}
+	]`))
+	c.Assert(err, IsNil)
+
+	hint, ok := pins.Hint("mydb.mycoll", "find {a: ?} sort {b: -1}")
+	c.Assert(ok, Equals, true)
+	c.Assert(hint, DeepEquals, bson.D{{"a", 1}, {"b", -1}})
+	hint, ok = pins.Hint("mydb.other", "find {}")
+	c.Assert(ok, Equals, true)
+	c.Assert(hint, DeepEquals, bson.D{{"c", 1}})
+	_, ok = pins.Hint("mydb.mycoll", "find {}")
+	c.Assert(ok, Equals, false)
+
+	// Invalid pins leave the loaded ones untouched.
+	err = pins.Load(strings.NewReader(`[{"namespace": "mydb", "shape": "find {}", "index": ["c"]}]`))
+	c.Assert(err, ErrorMatches, `invalid hint pin namespace: "mydb"`)
+	err = pins.Load(strings.NewReader(`[{"namespace": "mydb.other", "shape": "find {}", "index": []}]`))
+	c.Assert(err, ErrorMatches, "invalid index key: no fields provided")
+	err = pins.Load(strings.NewReader(`{`))
+	c.Assert(err, ErrorMatches, "cannot load hint pins: .*")
+	_, ok = pins.Hint("mydb.other", "find {}")
+	c.Assert(ok, Equals, true)
+
+	// Loading replaces all pins.
+	err = pins.Load(strings.NewReader(`[]`))
+	c.Assert(err, IsNil)
+	_, ok = pins.Hint("mydb.other", "find {}")
+	c.Assert(ok, Equals, false)
+
+	err = pins.Pin("mydb.other", "find {}", "-c")
+	c.Assert(err, IsNil)
+	hint, ok = pins.Hint("mydb.other", "find {}")
+	c.Assert(ok, Equals, true)
+	c.Assert(hint, DeepEquals, bson.D{{"c", -1}})
+	pins.Unpin("mydb.other", "find {}")
+	_, ok = pins.Hint("mydb.other", "find {}")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *S) TestHintPins(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.Insert(M{"n": 1, "m": 1})
+	c.Assert(err, IsNil)
+	err = coll.EnsureIndexKey("n", "-m")
+	c.Assert(err, IsNil)
+
+	var hints []interface{}
+	session.SetPolicy(mgo.PolicyFunc(func(op *mgo.Operation) error {
+		if op.Command == "find" {
+			hints = append(hints, op.Hint)
+		}
+		return nil
+	}))
+
+	pins := mgo.NewHintPins()
+	err = pins.Pin("mydb.mycoll", "find {n: ?} sort {m: -1}", "n", "-m")
+	c.Assert(err, IsNil)
+	session.SetHintPins(pins)
+
+	var result M
+	err = coll.Find(M{"n": 1}).Sort("-m").One(&result)
+	c.Assert(err, IsNil)
+	err = coll.Find(M{"n": 2}).Sort("-m").Iter().Close()
+	c.Assert(err, IsNil)
+
+	// Explicit hints and other shapes are left alone.
+	err = coll.Find(M{"n": 1}).Sort("-m").Hint("_id").One(&result)
+	c.Assert(err, IsNil)
+	err = coll.Find(M{"n": 1}).One(&result)
+	c.Assert(err, IsNil)
+
+	pinned := bson.D{{"n", 1}, {"m", -1}}
+	c.Assert(hints, DeepEquals, []interface{}{pinned, pinned, bson.D{{"_id", 1}}, nil})
+}
@@ -0,0 +1,151 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"sync"
+	"time"
+)
+
+// Histogram counts observed values into buckets. Counts[i] holds the
+// number of values less than or equal to Bounds[i] and greater than the
+// previous bound, and the last element of Counts, which has one more
+// element than Bounds, holds the number of values above all bounds.
+type Histogram struct {
+	Bounds []int64
+	Counts []int64
+	Count  int64 // Total number of values observed
+	Sum    int64 // Sum of all values observed
+}
+
+func newHistogram(bounds []int64) Histogram {
+	return Histogram{Bounds: bounds, Counts: make([]int64, len(bounds)+1)}
+}
+
+func (h *Histogram) observe(value int64) {
+	i := 0
+	for i < len(h.Bounds) && value > h.Bounds[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Count++
+	h.Sum += value
+}
+
+func (h *Histogram) copy() Histogram {
+	counts := make([]int64, len(h.Counts))
+	copy(counts, h.Counts)
+	return Histogram{Bounds: h.Bounds, Counts: counts, Count: h.Count, Sum: h.Sum}
+}
+
+// exponentialBounds returns n bounds starting at first and doubling.
+func exponentialBounds(first int64, n int) []int64 {
+	bounds := make([]int64, n)
+	for i := range bounds {
+		bounds[i] = first << uint(i)
+	}
+	return bounds
+}
+
+var (
+	// From 100 microseconds to about 52 seconds.
+	latencyBounds = exponentialBounds(int64(100*time.Microsecond), 20)
+
+	// From 256 bytes to 32MB.
+	replyBytesBounds = exponentialBounds(256, 18)
+)
+
+// OpStats holds the histograms for operations on a single collection.
+type OpStats struct {
+	Latency    Histogram // In nanoseconds
+	ReplyBytes Histogram // In bytes
+	Errors     int64     // Number of failed operations
+}
+
+// OpHistograms keeps per-collection histograms of operation latencies
+// and reply sizes, so that performance regressions may be observed
+// without external tooling. It's meant to be plugged into a Monitor:
+//
+//     histograms := mgo.NewOpHistograms()
+//     mgo.SetMonitor(&mgo.Monitor{
+//         Op:              histograms.Observe,
+//         SlowOpThreshold: 500 * time.Millisecond,
+//     })
+//
+type OpHistograms struct {
+	m     sync.Mutex
+	stats map[string]*OpStats
+}
+
+// NewOpHistograms returns a new set of empty histograms.
+func NewOpHistograms() *OpHistograms {
+	return &OpHistograms{stats: make(map[string]*OpStats)}
+}
+
+// Observe records the operation described by event.
+func (h *OpHistograms) Observe(event *OpEvent) {
+	ns := event.Database + "." + event.Collection
+	h.m.Lock()
+	stats, ok := h.stats[ns]
+	if !ok {
+		stats = &OpStats{
+			Latency:    newHistogram(latencyBounds),
+			ReplyBytes: newHistogram(replyBytesBounds),
+		}
+		h.stats[ns] = stats
+	}
+	stats.Latency.observe(int64(event.Duration))
+	stats.ReplyBytes.observe(int64(event.ReplyBytes))
+	if event.Err != nil {
+		stats.Errors++
+	}
+	h.m.Unlock()
+}
+
+// Snapshot returns a copy of the histograms for every collection that
+// had operations observed, keyed by "<database>.<collection>". Commands
+// that don't target a collection are keyed by "<database>.".
+func (h *OpHistograms) Snapshot() map[string]OpStats {
+	h.m.Lock()
+	snapshot := make(map[string]OpStats, len(h.stats))
+	for ns, stats := range h.stats {
+		snapshot[ns] = OpStats{
+			Latency:    stats.Latency.copy(),
+			ReplyBytes: stats.ReplyBytes.copy(),
+			Errors:     stats.Errors,
+		}
+	}
+	h.m.Unlock()
+	return snapshot
+}
+
+// Reset discards all observed operations.
+func (h *OpHistograms) Reset() {
+	h.m.Lock()
+	h.stats = make(map[string]*OpStats)
+	h.m.Unlock()
+}
@@ -0,0 +1,193 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"errors"
+	"regexp"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrIndexBuildTimeout is returned by Collection.BuildIndex when the
+// index build was killed for exceeding IndexBuild.Timeout.
+var ErrIndexBuildTimeout = errors.New("index build timed out")
+
+// IndexBuild holds settings for building an index via Collection.BuildIndex.
+// Zero values select the defaults documented for each field.
+type IndexBuild struct {
+	// PollInterval is how often the server is polled for the progress
+	// of the build. Defaults to one second.
+	PollInterval time.Duration
+
+	// Timeout, if positive, is how long the build may run before it's
+	// killed on the server.
+	Timeout time.Duration
+
+	// Progress, if set, is called with the state of the build every
+	// time the server is polled while the build is running.
+	Progress func(progress IndexBuildProgress)
+}
+
+// IndexBuildProgress holds the state of an index build as reported by
+// the server's currentOp command.
+type IndexBuildProgress struct {
+	OpId    interface{}   // Server operation id of the build
+	Done    int64         // Units of work done in the current phase
+	Total   int64         // Total units of work in the current phase
+	Message string        // Description of the current phase
+	Elapsed time.Duration // Time the build has been running for
+}
+
+type indexBuildOp struct {
+	OpId     interface{} "opid"
+	Msg      string      "msg"
+	Micros   int64       "microsecs_running"
+	Progress struct {
+		Done  int64 "done"
+		Total int64 "total"
+	} "progress"
+}
+
+// BuildIndex creates index in the collection like EnsureIndex does, but
+// reports the progress of the build while it runs and kills the build
+// if it takes too long or the session's context is done (see
+// Session.WithContext). It's meant for deploy tooling that needs
+// visibility into the build of indexes on large collections.
+//
+// The build runs in its own connection, while the server is polled for
+// its progress with the currentOp command from another connection.
+// Errors polling for the progress are ignored, and builds that can't
+// be found in currentOp, such as those on servers that don't report
+// the running createIndexes command, can't be killed.
+//
+// Unlike EnsureIndex, BuildIndex always sends the createIndexes command
+// to the server, even if the index was ensured before by the session.
+func (c *Collection) BuildIndex(index Index, settings *IndexBuild) error {
+	var build IndexBuild
+	if settings != nil {
+		build = *settings
+	}
+	if build.PollInterval <= 0 {
+		build.PollInterval = time.Second
+	}
+
+	keyInfo, err := parseIndexKey(index.Key)
+	if err != nil {
+		return err
+	}
+	spec := c.makeIndexSpec(index, keyInfo)
+
+	session := c.Database.Session
+	ctx := session.Context()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	poller := session.Copy()
+	defer poller.Close()
+	poller.SetMode(Strong, false)
+
+	builder := session.Copy()
+	builder.SetMode(Strong, false)
+	builder.EnsureSafe(&Safe{})
+	done := make(chan error, 1)
+	go func() {
+		defer builder.Close()
+		done <- c.createIndex(builder, spec)
+	}()
+
+	var deadline <-chan time.Time
+	if build.Timeout > 0 {
+		timer := time.NewTimer(build.Timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	ticker := time.NewTicker(build.PollInterval)
+	defer ticker.Stop()
+
+	ctxDone := ctx.Done()
+	var cancel error
+	for {
+		select {
+		case err := <-done:
+			if cancel != nil {
+				return cancel
+			}
+			if err == nil {
+				session.cluster().CacheIndex(c.FullName+"\x00"+keyInfo.name, true)
+			}
+			return err
+		case <-deadline:
+			cancel, deadline = ErrIndexBuildTimeout, nil
+		case <-ctxDone:
+			cancel, ctxDone = ctx.Err(), nil
+		case <-ticker.C:
+		}
+
+		op, err := c.findIndexBuild(poller, spec.Name)
+		if err != nil || op == nil {
+			continue
+		}
+		if cancel != nil {
+			err := poller.Run(bson.D{{"killOp", 1}, {"op", op.OpId}}, nil)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if build.Progress != nil {
+			build.Progress(IndexBuildProgress{
+				OpId:    op.OpId,
+				Done:    op.Progress.Done,
+				Total:   op.Progress.Total,
+				Message: op.Msg,
+				Elapsed: time.Duration(op.Micros) * time.Microsecond,
+			})
+		}
+	}
+}
+
+// findIndexBuild returns the running createIndexes command building the
+// index with the given name in the collection, or nil if there's none.
+func (c *Collection) findIndexBuild(session *Session, name string) (*indexBuildOp, error) {
+	var result struct {
+		InProg []indexBuildOp "inprog"
+	}
+	cmd := bson.D{
+		{"currentOp", 1},
+		{"ns", bson.RegEx{Pattern: "^" + regexp.QuoteMeta(c.Database.Name+".")}},
+		{"command.createIndexes", c.Name},
+		{"command.indexes.name", name},
+	}
+	err := session.Run(cmd, &result)
+	if err != nil || len(result.InProg) == 0 {
+		return nil, err
+	}
+	return &result.InProg[0], nil
+}
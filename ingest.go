@@ -0,0 +1,205 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"sort"
+	"sync"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Ingest holds settings for streaming documents into a collection via
+// Collection.Ingest and Collection.IngestFunc. Zero values select the
+// defaults documented for each field.
+type Ingest struct {
+	// BatchSize is the maximum number of documents sent in a single
+	// insert command. Defaults to 1000.
+	BatchSize int
+
+	// BatchBytes is the maximum size in bytes of the documents sent in
+	// a single insert command. Defaults to 8MB.
+	BatchBytes int
+
+	// Workers is the number of insert commands that may run
+	// concurrently, each on its own connection. Defaults to 1.
+	Workers int
+
+	// Unordered has insertion continue past documents that fail to be
+	// inserted. By default, ingestion stops at the first failure.
+	Unordered bool
+}
+
+// IngestResult holds the outcome of ingesting a stream of documents.
+type IngestResult struct {
+	Inserted int // Number of documents inserted
+	Batches  int // Number of insert commands sent
+}
+
+type ingestBatch struct {
+	docs   []interface{}
+	offset int
+}
+
+// Ingest inserts all documents received from docs into the collection,
+// until docs is closed. Documents are grouped into batches that are sent
+// as individual insert commands, so at most about Workers+1 batches are
+// held in memory at any time no matter how many documents are ingested.
+//
+// With more than one worker, batches are inserted concurrently, so the
+// relative order of insertions across batches isn't preserved, and in
+// ordered mode batches already in flight may still be inserted after a
+// failure.
+//
+// In ordered mode Ingest returns as soon as a failure is observed without
+// draining docs, so producers should not block indefinitely on sending.
+// Errors are reported as a *BulkError, with the index of each failing
+// document in the stream. The result is returned even on errors.
+//
+// See also IngestFunc.
+func (c *Collection) Ingest(docs <-chan interface{}, settings *Ingest) (*IngestResult, error) {
+	return c.IngestFunc(func() (interface{}, bool) {
+		doc, ok := <-docs
+		return doc, ok
+	}, settings)
+}
+
+// IngestFunc works like Ingest, but obtains documents by calling next
+// until it returns false.
+func (c *Collection) IngestFunc(next func() (doc interface{}, ok bool), settings *Ingest) (*IngestResult, error) {
+	var ingest Ingest
+	if settings != nil {
+		ingest = *settings
+	}
+	if ingest.BatchSize <= 0 {
+		ingest.BatchSize = 1000
+	}
+	if ingest.BatchBytes <= 0 {
+		ingest.BatchBytes = 8 * 1024 * 1024
+	}
+	if ingest.Workers <= 0 {
+		ingest.Workers = 1
+	}
+
+	var m sync.Mutex
+	var wg sync.WaitGroup
+	var result IngestResult
+	var berr BulkError
+
+	failed := func() bool {
+		m.Lock()
+		defer m.Unlock()
+		return len(berr.ecases) > 0
+	}
+
+	batches := make(chan ingestBatch)
+	for i := 0; i < ingest.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session := c.Database.Session.Copy()
+			defer session.Close()
+			coll := c.With(session)
+			for batch := range batches {
+				if !ingest.Unordered && failed() {
+					// Drop batches handed over before the failure was noticed.
+					continue
+				}
+				op := &insertOp{coll.FullName, batch.docs, 0}
+				if ingest.Unordered {
+					op.flags = 1 // ContinueOnError
+				}
+				lerr, err := coll.writeOp(op, !ingest.Unordered)
+				m.Lock()
+				result.Batches++
+				if err == nil {
+					result.Inserted += len(batch.docs)
+				} else if lerr != nil && len(lerr.ecases) > 0 {
+					result.Inserted += lerr.N
+					for _, ecase := range lerr.ecases {
+						if ecase.Index >= 0 {
+							ecase.Index += batch.offset
+						}
+						berr.ecases = append(berr.ecases, ecase)
+					}
+				} else {
+					berr.ecases = append(berr.ecases, BulkErrorCase{-1, err})
+				}
+				m.Unlock()
+			}
+		}()
+	}
+
+	var docs []interface{}
+	var offset, size int
+	for {
+		doc, ok := next()
+		if !ok {
+			break
+		}
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			m.Lock()
+			berr.ecases = append(berr.ecases, BulkErrorCase{offset + len(docs), err})
+			m.Unlock()
+			if !ingest.Unordered {
+				docs = nil
+				break
+			}
+			// Send pending documents so that following ones keep
+			// their index in the stream.
+			if len(docs) > 0 {
+				batches <- ingestBatch{docs, offset}
+				offset += len(docs)
+				docs, size = nil, 0
+			}
+			offset++
+			continue
+		}
+		if len(docs) > 0 && (len(docs) == ingest.BatchSize || size+len(data) > ingest.BatchBytes) {
+			batches <- ingestBatch{docs, offset}
+			offset += len(docs)
+			docs, size = nil, 0
+			if !ingest.Unordered && failed() {
+				break
+			}
+		}
+		docs = append(docs, bson.Raw{0x03, data})
+		size += len(data)
+	}
+	if len(docs) > 0 && (ingest.Unordered || !failed()) {
+		batches <- ingestBatch{docs, offset}
+	}
+	close(batches)
+	wg.Wait()
+
+	if len(berr.ecases) > 0 {
+		sort.Sort(bulkErrorCases(berr.ecases))
+		return &result, &berr
+	}
+	return &result, nil
+}
@@ -0,0 +1,123 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo_test
+
+import (
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+)
+
+func (s *S) TestIngest(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+
+	const total = 2500
+	docs := make(chan interface{})
+	go func() {
+		for i := 0; i < total; i++ {
+			docs <- M{"_id": i}
+		}
+		close(docs)
+	}()
+
+	result, err := coll.Ingest(docs, &mgo.Ingest{BatchSize: 100, Workers: 4})
+	c.Assert(err, IsNil)
+	c.Assert(result.Inserted, Equals, total)
+	c.Assert(result.Batches, Equals, total/100)
+
+	n, err := coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, total)
+}
+
+func (s *S) TestIngestFuncOrdered(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+
+	i := 0
+	next := func() (interface{}, bool) {
+		if i == 100 {
+			return nil, false
+		}
+		i++
+		if i == 25 {
+			// Duplicates the document at index 3.
+			return M{"_id": 3}, true
+		}
+		return M{"_id": i - 1}, true
+	}
+
+	result, err := coll.IngestFunc(next, &mgo.Ingest{BatchSize: 10})
+	c.Assert(err, ErrorMatches, ".*duplicate key.*")
+	ecases := err.(*mgo.BulkError).Cases()
+	c.Assert(ecases, HasLen, 1)
+	c.Assert(ecases[0].Index, Equals, 24)
+	c.Assert(result.Inserted, Equals, 24)
+
+	// Ingestion stopped at the failing batch.
+	n, err := coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 24)
+}
+
+func (s *S) TestIngestUnordered(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+
+	docs := make(chan interface{}, 100)
+	for i := 0; i < 50; i++ {
+		docs <- M{"_id": i}
+	}
+	docs <- M{"_id": 10}
+	docs <- 42 // Not a document.
+	for i := 50; i < 100; i++ {
+		docs <- M{"_id": i}
+	}
+	close(docs)
+
+	result, err := coll.Ingest(docs, &mgo.Ingest{BatchSize: 7, Unordered: true})
+	c.Assert(err, NotNil)
+	ecases := err.(*mgo.BulkError).Cases()
+	c.Assert(ecases, HasLen, 2)
+	c.Assert(ecases[0].Index, Equals, 50)
+	c.Assert(ecases[0].Err, ErrorMatches, ".*duplicate key.*")
+	c.Assert(ecases[1].Index, Equals, 51)
+	c.Assert(result.Inserted, Equals, 100)
+
+	n, err := coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 100)
+}
@@ -0,0 +1,264 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"reflect"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// JoinIter goes over the documents of an iterator together with the
+// documents of another collection they're related to, which are fetched
+// in batches rather than with one query per document. See Iter.Join.
+type JoinIter struct {
+	parents      *Iter
+	children     *Collection
+	localField   string
+	foreignField string
+	selector     interface{}
+	batchSize    int
+
+	batch   []bson.Raw
+	related []bson.Raw
+	matches map[string][]int
+	err     error
+}
+
+// Join returns an iterator that provides each document of iter together
+// with the documents in the children collection whose foreignField holds
+// the value of the document's localField, as the $lookup aggregation
+// stage does, but joining them on the client side:
+//
+//     iter := orders.Find(query).Iter().Join(customers, "customerId", "_id")
+//     var order Order
+//     var customer []Customer
+//     for iter.Next(&order, &customer) {
+//         ...
+//     }
+//     err := iter.Close()
+//
+// Documents are read from iter in batches, and the children related to
+// each batch are fetched with queries on their foreignField using $in
+// filters (see Collection.FindIn), which avoids sending a query for each
+// document when there are too many of them for $lookup to be practical.
+//
+// Both fields must be top-level fields. When either holds an array, each
+// of its elements is matched on its own. Values are matched by their BSON
+// encoding, so they must have the same type in both collections; for
+// instance, an int64 value won't match an equal int32 one.
+func (iter *Iter) Join(children *Collection, localField, foreignField string) *JoinIter {
+	return &JoinIter{
+		parents:      iter,
+		children:     children,
+		localField:   localField,
+		foreignField: foreignField,
+		batchSize:    100,
+	}
+}
+
+// Batch sets how many documents are read from the parent iterator before
+// the documents related to them are fetched. It defaults to 100.
+func (iter *JoinIter) Batch(n int) *JoinIter {
+	if n < 1 {
+		n = 1
+	}
+	iter.batchSize = n
+	return iter
+}
+
+// Select enables selecting which fields of the related documents should
+// be retrieved, as done by Query.Select. The selector must not leave out
+// the foreign field.
+func (iter *JoinIter) Select(selector interface{}) *JoinIter {
+	iter.selector = selector
+	return iter
+}
+
+// Next unmarshals the next document of the parent iterator into parent,
+// and the documents related to it into children, which must be a pointer
+// to a slice. It returns false once the parent iterator is exhausted or
+// an error happens, as done by Iter.Next.
+func (iter *JoinIter) Next(parent interface{}, children interface{}) bool {
+	childrenv := reflect.ValueOf(children)
+	if childrenv.Kind() != reflect.Ptr || childrenv.Elem().Kind() != reflect.Slice {
+		panic("children argument must be a slice address")
+	}
+	if iter.err != nil {
+		return false
+	}
+	if len(iter.batch) == 0 && !iter.fetch() {
+		return false
+	}
+	doc := iter.batch[0]
+	iter.batch = iter.batch[1:]
+	if iter.err = doc.Unmarshal(parent); iter.err != nil {
+		return false
+	}
+
+	var related []bson.Raw
+	keys, err := joinKeys(doc.Data, iter.localField)
+	if err != nil {
+		iter.err = err
+		return false
+	}
+	seen := make(map[int]bool)
+	for _, key := range keys {
+		for _, i := range iter.matches[key] {
+			// Children matching several keys are provided once.
+			if !seen[i] {
+				seen[i] = true
+				related = append(related, iter.related[i])
+			}
+		}
+	}
+	slicev := reflect.MakeSlice(childrenv.Elem().Type(), len(related), len(related))
+	for i, child := range related {
+		if iter.err = child.Unmarshal(slicev.Index(i).Addr().Interface()); iter.err != nil {
+			return false
+		}
+	}
+	childrenv.Elem().Set(slicev)
+	return true
+}
+
+// fetch reads the next batch of parent documents and the documents
+// related to them, returning false if there are no more parents or an
+// error happened.
+func (iter *JoinIter) fetch() bool {
+	iter.batch = iter.batch[:0]
+	var values []bson.Raw
+	seen := make(map[string]bool)
+	for len(iter.batch) < iter.batchSize {
+		var doc bson.Raw
+		if !iter.parents.Next(&doc) {
+			break
+		}
+		iter.batch = append(iter.batch, doc)
+		fields, err := bson.Fields(doc.Data, iter.localField)
+		if err != nil {
+			iter.err = err
+			return false
+		}
+		for _, value := range joinValues(fields[iter.localField]) {
+			if key := string(value.Kind) + string(value.Data); !seen[key] {
+				seen[key] = true
+				values = append(values, value)
+			}
+		}
+	}
+	if err := iter.parents.Err(); err != nil {
+		iter.err = err
+		return false
+	}
+	if len(iter.batch) == 0 {
+		return false
+	}
+
+	iter.related = iter.related[:0]
+	iter.matches = make(map[string][]int)
+	if len(values) == 0 {
+		return true
+	}
+	query := iter.children.FindIn(iter.foreignField, values, nil)
+	if iter.selector != nil {
+		query.Select(iter.selector)
+	}
+	children := query.Iter()
+	var child bson.Raw
+	for children.Next(&child) {
+		keys, err := joinKeys(child.Data, iter.foreignField)
+		if err != nil {
+			children.Close()
+			iter.err = err
+			return false
+		}
+		for _, key := range keys {
+			iter.matches[key] = append(iter.matches[key], len(iter.related))
+		}
+		iter.related = append(iter.related, child)
+	}
+	if iter.err = children.Close(); iter.err != nil {
+		return false
+	}
+	return true
+}
+
+// joinKeys returns the keys the documents related via field to the
+// document in data are indexed under.
+func joinKeys(data []byte, field string) ([]string, error) {
+	fields, err := bson.Fields(data, field)
+	if err != nil {
+		return nil, err
+	}
+	values := joinValues(fields[field])
+	keys := make([]string, len(values))
+	for i, value := range values {
+		keys[i] = string(value.Kind) + string(value.Data)
+	}
+	return keys, nil
+}
+
+// joinValues returns the values held by a field for matching, which are
+// the elements of arrays, or the value itself otherwise. Missing fields
+// hold no values.
+func joinValues(value bson.Raw) []bson.Raw {
+	switch value.Kind {
+	case 0:
+		return nil
+	case 0x04:
+		var elems bson.RawD
+		if bson.Unmarshal(value.Data, &elems) != nil {
+			return nil
+		}
+		values := make([]bson.Raw, len(elems))
+		for i, elem := range elems {
+			values[i] = elem.Value
+		}
+		return values
+	}
+	return []bson.Raw{value}
+}
+
+// Err returns nil if no errors happened during iteration, or the actual
+// error otherwise.
+func (iter *JoinIter) Err() error {
+	if iter.err == nil {
+		return iter.parents.Err()
+	}
+	return iter.err
+}
+
+// Close closes the parent iterator, and returns nil if no errors happened
+// during iteration, or the actual error otherwise.
+func (iter *JoinIter) Close() error {
+	err := iter.parents.Close()
+	if iter.err == nil {
+		iter.err = err
+	}
+	return iter.err
+}
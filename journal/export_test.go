@@ -0,0 +1,28 @@
+package journal
+
+import (
+	"os"
+)
+
+var IsRejection = isRejection
+
+// Detach makes writes to j be journaled without being delivered, as in
+// store-and-forward mode, but without a forwarder running.
+func Detach(j *Journal) {
+	j.m.Lock()
+	j.kick = make(chan struct{}, 1)
+	j.m.Unlock()
+}
+
+// ReopenFile replaces the file j writes to with its path opened with flag.
+func ReopenFile(j *Journal, flag int) error {
+	file, err := os.OpenFile(j.path, flag, 0600)
+	if err != nil {
+		return err
+	}
+	j.m.Lock()
+	j.file.Close()
+	j.file = file
+	j.m.Unlock()
+	return nil
+}
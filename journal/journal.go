@@ -0,0 +1,625 @@
+// The journal package implements a local write-ahead journal of write
+// operations, for ingestion agents that must not lose data across process
+// crashes, even while MongoDB is unreachable.
+//
+// Every write is appended to an append-only file and synced to disk before
+// being sent to the server, and is only dropped from the journal once the
+// server acknowledged it. Writes that couldn't be delivered, whether due to
+// an outage or to a crash, are replayed in order by later writes and by
+// Replay, so each of them is applied at least once:
+//
+//     j, err := journal.Open("/var/lib/agent/writes.journal")
+//     if err != nil {
+//         return err
+//     }
+//     defer j.Close()
+//     _, err = j.Replay(session)
+//     ...
+//     err = j.Insert(session.DB("metrics").C("samples"), sample)
+//
+// Inserted documents are assigned an _id before being journaled if they
+// don't have one, so that replaying them is idempotent. Updates must be
+// written so that applying them more than once is harmless, for example
+// via $set rather than $inc.
+//
+// For telemetry-style workloads that would rather lose some data than
+// grow the journal indefinitely during a long outage, MaxSize and MaxAge
+// bound the operations kept pending, and Forward switches the journal to
+// store-and-forward mode, where writes are only journaled and delivered in
+// the background, so that they don't wait on an unreachable cluster.
+//
+package journal
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	// ErrFull is reported for operations dropped from the journal to
+	// keep the size of pending operations within MaxSize, and returned
+	// by writes that wouldn't fit into MaxSize on their own.
+	ErrFull = errors.New("journal is full")
+
+	// ErrExpired is reported for operations dropped from the journal
+	// for being pending for longer than MaxAge.
+	ErrExpired = errors.New("journal operation expired")
+)
+
+// Op is a write operation recorded in the journal.
+type Op struct {
+	Seq        int64     `bson:"s"`
+	Time       time.Time `bson:"t"` // When the operation was journaled
+	Kind       string    `bson:"k"` // One of "insert", "update", "updateAll", "upsert", "remove", or "removeAll"
+	Database   string    `bson:"db"`
+	Collection string    `bson:"c"`
+	Selector   bson.Raw  `bson:"q,omitempty"`
+	Doc        bson.Raw  `bson:"d,omitempty"` // Document to insert, or update document
+
+	size int64
+}
+
+type droppedOp struct {
+	op  *Op
+	err error
+}
+
+// record is the on-disk form of journal entries: either an operation,
+// or the acknowledgement of the operation with the given sequence number.
+type record struct {
+	Op  `bson:",inline"`
+	Ack int64 `bson:"a,omitempty"`
+}
+
+// Journal is a write-ahead journal of write operations stored in a file.
+// Journal methods are safe for concurrent use, with operations delivered
+// to the server one at a time, in the order they were journaled.
+type Journal struct {
+	// Rejected, if set, is called with operations that were dropped
+	// from the journal while being replayed because the server rejected
+	// them, along with the respective error. Replaying such operations
+	// would fail the same way every time.
+	Rejected func(op *Op, err error)
+
+	// MaxSize, if positive, bounds the size in bytes of the pending
+	// operations in the journal. Once reached, the oldest operations
+	// are dropped to make room for new ones.
+	MaxSize int64
+
+	// MaxAge, if positive, bounds how long operations may be pending.
+	// Older operations are dropped rather than delivered.
+	MaxAge time.Duration
+
+	// Dropped, if set, is called with operations dropped from the
+	// journal due to MaxSize or MaxAge, along with ErrFull or ErrExpired
+	// respectively.
+	Dropped func(op *Op, err error)
+
+	m        sync.Mutex
+	path     string
+	file     *os.File
+	fileSize int64
+	torn     bool // Whether the file may hold data past fileSize
+	seq      int64
+	size     int64
+	pending  []*Op
+
+	// delivery is held while delivering operations, so that
+	// they're delivered one at a time.
+	delivery sync.Mutex
+
+	// Channels of the forwarder started by Forward, if any.
+	kick chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Open opens the journal stored at path, creating it if necessary.
+// Operations journaled but not acknowledged by the server before the
+// journal was last closed, or before the process crashed, are kept
+// pending until they're replayed. An incomplete entry at the end of the
+// file, as left by a crash while writing it, is discarded.
+func Open(path string) (*Journal, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	j := &Journal{path: path}
+	acked := make(map[int64]bool)
+	var ops []*Op
+	var good int
+	for good+4 <= len(data) {
+		size := int(int32(binary.LittleEndian.Uint32(data[good:])))
+		if size < 5 || good+size > len(data) {
+			break
+		}
+		var rec record
+		if bson.Unmarshal(data[good:good+size], &rec) != nil {
+			break
+		}
+		if rec.Ack != 0 {
+			acked[rec.Ack] = true
+		} else {
+			op := rec.Op
+			op.size = int64(size)
+			ops = append(ops, &op)
+			j.seq = op.Seq
+		}
+		good += size
+	}
+	for _, op := range ops {
+		if !acked[op.Seq] {
+			j.pending = append(j.pending, op)
+			j.size += op.size
+		}
+	}
+
+	j.file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if good < len(data) {
+		if err := j.file.Truncate(int64(good)); err != nil {
+			j.file.Close()
+			return nil, err
+		}
+	}
+	j.fileSize = int64(good)
+	return j, nil
+}
+
+// Close stops the forwarder started by Forward, if any, and closes the
+// journal file. Pending operations remain in the file and are replayed
+// once the journal is opened again.
+func (j *Journal) Close() error {
+	j.m.Lock()
+	stop := j.stop
+	j.stop = nil
+	j.m.Unlock()
+	if stop != nil {
+		close(stop)
+		<-j.done
+	}
+
+	j.m.Lock()
+	defer j.m.Unlock()
+	return j.file.Close()
+}
+
+// Pending returns the number of journaled operations that the server
+// hasn't acknowledged yet.
+func (j *Journal) Pending() int {
+	j.m.Lock()
+	defer j.m.Unlock()
+	return len(j.pending)
+}
+
+// Insert journals the insertion of docs into c, and then delivers all
+// pending operations to the server in order. See Journal.Update.
+func (j *Journal) Insert(c *mgo.Collection, docs ...interface{}) error {
+	ops := make([]*Op, len(docs))
+	for i, doc := range docs {
+		raw, err := withId(doc)
+		if err != nil {
+			return err
+		}
+		ops[i] = &Op{Kind: "insert", Doc: raw}
+	}
+	return j.write(c, ops...)
+}
+
+// Update journals the update of the document matching selector in c,
+// and then delivers all pending operations to the server in order.
+//
+// The returned error is nil once the operation is durably journaled,
+// even if it couldn't be delivered yet, as it's then replayed by further
+// writes and by Replay. If the server rejects the operation, it's
+// dropped from the journal and the error is returned.
+func (j *Journal) Update(c *mgo.Collection, selector, update interface{}) error {
+	return j.writeOp(c, "update", selector, update)
+}
+
+// UpdateAll journals the update of all documents matching selector in c.
+// See Journal.Update.
+func (j *Journal) UpdateAll(c *mgo.Collection, selector, update interface{}) error {
+	return j.writeOp(c, "updateAll", selector, update)
+}
+
+// Upsert journals the upsert of the document matching selector in c.
+// See Journal.Update.
+func (j *Journal) Upsert(c *mgo.Collection, selector, update interface{}) error {
+	return j.writeOp(c, "upsert", selector, update)
+}
+
+// Remove journals the removal of the document matching selector in c.
+// See Journal.Update.
+func (j *Journal) Remove(c *mgo.Collection, selector interface{}) error {
+	return j.writeOp(c, "remove", selector, nil)
+}
+
+// RemoveAll journals the removal of all documents matching selector
+// in c. See Journal.Update.
+func (j *Journal) RemoveAll(c *mgo.Collection, selector interface{}) error {
+	return j.writeOp(c, "removeAll", selector, nil)
+}
+
+// Replay delivers all pending operations to the server via session, in
+// the order they were journaled, and returns how many were delivered.
+// It stops at the first operation that can't be delivered, which is then
+// kept pending and its error returned, as happens as well with errors
+// that are likely transient (see mgo.IsRetryable), such as the server
+// not being the primary during an election. Operations the server
+// rejects otherwise are dropped and reported via the Rejected function,
+// if set.
+func (j *Journal) Replay(session *mgo.Session) (n int, err error) {
+	return j.replay(session, nil)
+}
+
+// Forward switches the journal to store-and-forward mode, in which writes
+// return as soon as their operations are journaled, and a background
+// forwarder delivers pending operations via session as they're written.
+// While operations can't be delivered, the forwarder retries every retry
+// interval. The session should fail fast, so that new writes are
+// delivered promptly once the cluster is reachable again (see
+// mgo.DialInfo.FailFast).
+//
+// In store-and-forward mode, operations rejected by the server are only
+// reported via the Rejected function. Forward must be called at most once,
+// and the forwarder runs until the journal is closed.
+func (j *Journal) Forward(session *mgo.Session, retry time.Duration) {
+	j.m.Lock()
+	j.kick = make(chan struct{}, 1)
+	j.stop = make(chan struct{})
+	j.done = make(chan struct{})
+	j.m.Unlock()
+	go j.forward(session, retry, j.kick, j.stop)
+}
+
+func (j *Journal) forward(session *mgo.Session, retry time.Duration, kick, stop chan struct{}) {
+	defer close(j.done)
+	for {
+		var again <-chan time.Time
+		if _, err := j.Replay(session); err != nil {
+			again = time.After(retry)
+		}
+		select {
+		case <-stop:
+			return
+		case <-kick:
+		case <-again:
+		}
+	}
+}
+
+func (j *Journal) writeOp(c *mgo.Collection, kind string, selector, update interface{}) error {
+	if selector == nil {
+		selector = bson.D{}
+	}
+	op := &Op{Kind: kind}
+	var err error
+	if op.Selector, err = marshal(selector); err != nil {
+		return err
+	}
+	if update != nil {
+		if op.Doc, err = marshal(update); err != nil {
+			return err
+		}
+	}
+	return j.write(c, op)
+}
+
+// write appends ops on c to the journal and, unless in store-and-forward
+// mode, replays all pending operations, returning the error of any of ops
+// that the server rejected.
+func (j *Journal) write(c *mgo.Collection, ops ...*Op) error {
+	now := time.Now()
+	var buf []byte
+	var size int64
+	j.m.Lock()
+	seq := j.seq
+	for _, op := range ops {
+		seq++
+		op.Seq = seq
+		op.Time = now
+		op.Database = c.Database.Name
+		op.Collection = c.Name
+		data, err := bson.Marshal(record{Op: *op})
+		if err != nil {
+			j.m.Unlock()
+			return err
+		}
+		op.size = int64(len(data))
+		size += op.size
+		buf = append(buf, data...)
+	}
+	if j.MaxSize > 0 && size > j.MaxSize {
+		j.m.Unlock()
+		return ErrFull
+	}
+	// Operations are only dropped to make room once the new ones are
+	// journaled, as they'd be lost for nothing otherwise.
+	var dropped []droppedOp
+	err := j.append(buf)
+	if err == nil {
+		j.seq = seq
+		j.size += size
+		j.pending = append(j.pending, ops...)
+		dropped = j.trim(now, 0)
+		j.compact()
+	}
+	kick := j.kick
+	j.m.Unlock()
+	j.reportDropped(dropped)
+	if err != nil {
+		return err
+	}
+
+	if kick != nil {
+		select {
+		case kick <- struct{}{}:
+		default:
+		}
+		return nil
+	}
+
+	// Operations that couldn't be delivered are left pending for later.
+	var opErr error
+	j.replay(c.Database.Session, func(op *Op, err error) {
+		for _, o := range ops {
+			if o == op && opErr == nil {
+				opErr = err
+				return
+			}
+		}
+		if j.Rejected != nil {
+			j.Rejected(op, err)
+		}
+	})
+	return opErr
+}
+
+// replay delivers pending operations in order, calling rejected, or
+// the Rejected function when nil, with each operation the server
+// rejected.
+func (j *Journal) replay(session *mgo.Session, rejected func(op *Op, err error)) (n int, err error) {
+	if rejected == nil {
+		rejected = j.Rejected
+	}
+	j.delivery.Lock()
+	defer j.delivery.Unlock()
+	for {
+		j.m.Lock()
+		dropped := j.trim(time.Now(), 0)
+		if len(j.pending) == 0 {
+			// Nothing is pending, so the journal may start over.
+			j.pending = nil
+			err := j.file.Truncate(0)
+			if err == nil {
+				j.fileSize = 0
+				j.torn = false
+			}
+			j.m.Unlock()
+			j.reportDropped(dropped)
+			return n, err
+		}
+		op := j.pending[0]
+		j.m.Unlock()
+		j.reportDropped(dropped)
+
+		err := apply(session, op)
+		if err != nil && !isRejection(err) {
+			return n, err
+		}
+		j.m.Lock()
+		// Unless dropped meanwhile to make room for further operations.
+		if len(j.pending) > 0 && j.pending[0] == op {
+			if err := j.ack(op); err != nil {
+				j.m.Unlock()
+				return n, err
+			}
+			j.pop()
+		}
+		j.compact()
+		j.m.Unlock()
+		if err != nil {
+			if rejected != nil {
+				rejected(op, err)
+			}
+		} else {
+			n++
+		}
+	}
+}
+
+// trim drops the oldest pending operations while they're older than
+// MaxAge, or while adding extra bytes to the journal would exceed MaxSize.
+// j.m must be held.
+func (j *Journal) trim(now time.Time, extra int64) (dropped []droppedOp) {
+	for len(j.pending) > 0 {
+		op := j.pending[0]
+		var reason error
+		switch {
+		case j.MaxAge > 0 && now.Sub(op.Time) > j.MaxAge:
+			reason = ErrExpired
+		case j.MaxSize > 0 && j.size+extra > j.MaxSize:
+			reason = ErrFull
+		default:
+			return dropped
+		}
+		if j.ack(op) != nil {
+			return dropped
+		}
+		j.pop()
+		dropped = append(dropped, droppedOp{op, reason})
+	}
+	return dropped
+}
+
+// pop removes the oldest pending operation. j.m must be held.
+func (j *Journal) pop() {
+	j.size -= j.pending[0].size
+	j.pending[0] = nil
+	j.pending = j.pending[1:]
+}
+
+func (j *Journal) reportDropped(dropped []droppedOp) {
+	if j.Dropped == nil {
+		return
+	}
+	for _, d := range dropped {
+		j.Dropped(d.op, d.err)
+	}
+}
+
+// append writes data at the end of the journal file and syncs it to disk.
+// On failure, whatever part of data was written is truncated away, since
+// Open discards everything after an incomplete entry. j.m must be held.
+func (j *Journal) append(data []byte) error {
+	if j.torn {
+		if err := j.file.Truncate(j.fileSize); err != nil {
+			return err
+		}
+		j.torn = false
+	}
+	_, err := j.file.Write(data)
+	if err == nil {
+		err = j.file.Sync()
+	}
+	if err != nil {
+		j.torn = j.file.Truncate(j.fileSize) != nil
+		return err
+	}
+	j.fileSize += int64(len(data))
+	return nil
+}
+
+// compact rewrites the journal file with only the pending operations
+// once it grows past twice MaxSize, so that operations acknowledged or
+// dropped during a long outage don't fill the disk. A journal that fails
+// to be compacted is left intact, to be compacted by a later call.
+// j.m must be held.
+func (j *Journal) compact() error {
+	if j.MaxSize <= 0 || j.fileSize <= 2*j.MaxSize {
+		return nil
+	}
+	var buf []byte
+	for _, op := range j.pending {
+		data, err := bson.Marshal(record{Op: *op})
+		if err != nil {
+			return err
+		}
+		buf = append(buf, data...)
+	}
+	tmp := j.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(buf); err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, j.path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	j.file.Close()
+	j.file = file
+	j.fileSize = int64(len(buf))
+	j.torn = false
+	return nil
+}
+
+// ack records that op was acknowledged by the server.
+func (j *Journal) ack(op *Op) error {
+	data, err := bson.Marshal(bson.D{{"a", op.Seq}})
+	if err != nil {
+		return err
+	}
+	return j.append(data)
+}
+
+// apply performs op via session.
+func apply(session *mgo.Session, op *Op) error {
+	c := session.DB(op.Database).C(op.Collection)
+	var err error
+	switch op.Kind {
+	case "insert":
+		err = c.Insert(op.Doc)
+		if mgo.IsDup(err) {
+			// Inserted before the acknowledgement was journaled.
+			err = nil
+		}
+	case "update":
+		err = c.Update(op.Selector, op.Doc)
+	case "updateAll":
+		_, err = c.UpdateAll(op.Selector, op.Doc)
+	case "upsert":
+		_, err = c.Upsert(op.Selector, op.Doc)
+	case "remove":
+		err = c.Remove(op.Selector)
+	case "removeAll":
+		_, err = c.RemoveAll(op.Selector)
+	}
+	if err == mgo.ErrNotFound {
+		// Nothing to update or remove is a valid outcome.
+		err = nil
+	}
+	return err
+}
+
+// isRejection returns whether err was reported by the server about the
+// operation itself, rather than about its delivery. Errors that are
+// likely transient, such as the server not being the primary during an
+// election, are about the delivery, as retrying it may succeed.
+func isRejection(err error) bool {
+	switch e := err.(type) {
+	case *mgo.LastError, *mgo.QueryError:
+		return !mgo.IsRetryable(err)
+	case *mgo.BulkError:
+		for _, ecase := range e.Cases() {
+			if mgo.IsRetryable(ecase.Err) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func marshal(doc interface{}) (bson.Raw, error) {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return bson.Raw{}, err
+	}
+	return bson.Raw{Kind: 0x03, Data: data}, nil
+}
+
+// withId returns doc marshalled with a new _id prepended to it, unless
+// it already has one.
+func withId(doc interface{}) (bson.Raw, error) {
+	raw, err := marshal(doc)
+	if err != nil {
+		return raw, err
+	}
+	var elems bson.RawD
+	if err := raw.Unmarshal(&elems); err != nil {
+		return raw, err
+	}
+	for _, elem := range elems {
+		if elem.Name == "_id" {
+			return raw, nil
+		}
+	}
+	return marshal(append(bson.RawD{{"_id", bson.Raw{Kind: 0x07, Data: []byte(bson.NewObjectId())}}}, elems...))
+}
@@ -0,0 +1,366 @@
+package journal_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/dbtest"
+	"gopkg.in/mgo.v2/journal"
+)
+
+func TestAll(t *testing.T) {
+	TestingT(t)
+}
+
+type S struct {
+	server  dbtest.DBServer
+	session *mgo.Session
+	path    string
+}
+
+var _ = Suite(&S{})
+
+type M map[string]interface{}
+
+func (s *S) SetUpSuite(c *C) {
+	s.server.SetPath(c.MkDir())
+}
+
+func (s *S) TearDownSuite(c *C) {
+	s.server.Stop()
+}
+
+func (s *S) SetUpTest(c *C) {
+	s.server.Wipe()
+	s.session = s.server.Session()
+	s.path = filepath.Join(c.MkDir(), "journal")
+}
+
+func (s *S) TearDownTest(c *C) {
+	s.session.Close()
+}
+
+func (s *S) TestWrite(c *C) {
+	j, err := journal.Open(s.path)
+	c.Assert(err, IsNil)
+	defer j.Close()
+
+	coll := s.session.DB("test").C("samples")
+	c.Assert(j.Insert(coll, M{"n": 1}, M{"n": 2}), IsNil)
+	c.Assert(j.Upsert(coll, M{"n": 3}, M{"$set": M{"m": 3}}), IsNil)
+	c.Assert(j.Update(coll, M{"n": 1}, M{"$set": M{"m": 1}}), IsNil)
+	c.Assert(j.RemoveAll(coll, M{"n": 2}), IsNil)
+	c.Assert(j.Pending(), Equals, 0)
+
+	var docs []M
+	c.Assert(coll.Find(nil).Select(M{"_id": 0}).Sort("n").All(&docs), IsNil)
+	c.Assert(docs, DeepEquals, []M{{"n": 1, "m": 1}, {"n": 3, "m": 3}})
+
+	// Rejected operations are dropped.
+	err = j.Update(coll, M{"n": 1}, M{"$bogus": M{"m": 2}})
+	c.Assert(err, FitsTypeOf, &mgo.LastError{})
+	c.Assert(j.Pending(), Equals, 0)
+
+	info, err := os.Stat(s.path)
+	c.Assert(err, IsNil)
+	c.Assert(info.Size(), Equals, int64(0))
+}
+
+func (s *S) TestReplay(c *C) {
+	j, err := journal.Open(s.path)
+	c.Assert(err, IsNil)
+
+	down := true
+	s.session.SetPolicy(mgo.PolicyFunc(func(op *mgo.Operation) error {
+		if down {
+			return errors.New("unreachable")
+		}
+		return nil
+	}))
+
+	coll := s.session.DB("test").C("samples")
+	c.Assert(j.Insert(coll, M{"n": 1}), IsNil)
+	c.Assert(j.Update(coll, M{"n": 1}, M{"$set": M{"m": 1}}), IsNil)
+	c.Assert(j.Update(coll, M{"n": 1}, M{"$bogus": M{"m": 2}}), IsNil)
+	c.Assert(j.Pending(), Equals, 3)
+	c.Assert(j.Close(), IsNil)
+
+	// An entry cut short by a crash is discarded.
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0)
+	c.Assert(err, IsNil)
+	_, err = f.Write([]byte{100, 0, 0, 0, 3})
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+
+	j, err = journal.Open(s.path)
+	c.Assert(err, IsNil)
+	defer j.Close()
+	c.Assert(j.Pending(), Equals, 3)
+
+	n, err := j.Replay(s.session)
+	c.Assert(err, ErrorMatches, "unreachable")
+	c.Assert(n, Equals, 0)
+	c.Assert(j.Pending(), Equals, 3)
+
+	var rejected []*journal.Op
+	j.Rejected = func(op *journal.Op, err error) {
+		rejected = append(rejected, op)
+	}
+	down = false
+	n, err = j.Replay(s.session)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+	c.Assert(j.Pending(), Equals, 0)
+	c.Assert(rejected, HasLen, 1)
+	c.Assert(rejected[0].Kind, Equals, "update")
+	c.Assert(rejected[0].Seq, Equals, int64(3))
+
+	var docs []M
+	c.Assert(coll.Find(nil).Select(M{"_id": 0}).All(&docs), IsNil)
+	c.Assert(docs, DeepEquals, []M{{"n": 1, "m": 1}})
+
+	// Inserts replayed after being delivered aren't duplicated.
+	down = true
+	c.Assert(j.Insert(coll, M{"n": 2}), IsNil)
+	c.Assert(j.Pending(), Equals, 1)
+	down = false
+	n, err = j.Replay(s.session)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+	count, err := coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 2)
+}
+
+func (s *S) TestForward(c *C) {
+	j, err := journal.Open(s.path)
+	c.Assert(err, IsNil)
+	defer j.Close()
+
+	var dropped []interface{}
+	j.MaxSize = 200
+	j.Dropped = func(op *journal.Op, err error) {
+		var doc M
+		c.Check(op.Doc.Unmarshal(&doc), IsNil)
+		dropped = append(dropped, doc["n"], err)
+	}
+
+	down := make(chan bool, 1)
+	down <- true
+	s.session.SetPolicy(mgo.PolicyFunc(func(op *mgo.Operation) error {
+		d := <-down
+		down <- d
+		if d {
+			return errors.New("unreachable")
+		}
+		return nil
+	}))
+	j.Forward(s.session, 10*time.Millisecond)
+
+	// Writes are spooled while the cluster is down, dropping the
+	// oldest ones once the journal is full.
+	coll := s.session.DB("test").C("samples")
+	for n := 0; n < 5; n++ {
+		c.Assert(j.Insert(coll, M{"n": n}), IsNil)
+	}
+	c.Assert(j.Pending(), Equals, 2)
+	c.Assert(dropped, DeepEquals, []interface{}{0, journal.ErrFull, 1, journal.ErrFull, 2, journal.ErrFull})
+	c.Assert(j.Insert(coll, M{"n": strings.Repeat("x", 200)}), Equals, journal.ErrFull)
+
+	<-down
+	down <- false
+	for i := 0; i < 100 && j.Pending() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(j.Pending(), Equals, 0)
+
+	var docs []M
+	c.Assert(coll.Find(nil).Select(M{"_id": 0}).Sort("n").All(&docs), IsNil)
+	c.Assert(docs, DeepEquals, []M{{"n": 3}, {"n": 4}})
+}
+
+func (s *S) TestMaxAge(c *C) {
+	j, err := journal.Open(s.path)
+	c.Assert(err, IsNil)
+	defer j.Close()
+
+	down := true
+	s.session.SetPolicy(mgo.PolicyFunc(func(op *mgo.Operation) error {
+		if down {
+			return errors.New("unreachable")
+		}
+		return nil
+	}))
+
+	coll := s.session.DB("test").C("samples")
+	c.Assert(j.Insert(coll, M{"n": 1}), IsNil)
+	c.Assert(j.Pending(), Equals, 1)
+
+	var dropped []error
+	j.MaxAge = 10 * time.Millisecond
+	j.Dropped = func(op *journal.Op, err error) {
+		dropped = append(dropped, err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	down = false
+	n, err := j.Replay(s.session)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 0)
+	c.Assert(dropped, DeepEquals, []error{journal.ErrExpired})
+	count, err := coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 0)
+}
+
+// FileS holds the tests that don't need a server, with writes only
+// journaled rather than delivered.
+type FileS struct {
+	path string
+	coll *mgo.Collection
+}
+
+var _ = Suite(&FileS{})
+
+func (s *FileS) SetUpTest(c *C) {
+	s.path = filepath.Join(c.MkDir(), "journal")
+	s.coll = (&mgo.Session{}).DB("test").C("samples")
+}
+
+func (s *FileS) open(c *C) *journal.Journal {
+	j, err := journal.Open(s.path)
+	c.Assert(err, IsNil)
+	journal.Detach(j)
+	return j
+}
+
+func (s *FileS) fileSize(c *C) int64 {
+	info, err := os.Stat(s.path)
+	c.Assert(err, IsNil)
+	return info.Size()
+}
+
+func (s *FileS) TestIsRejection(c *C) {
+	c.Assert(journal.IsRejection(&mgo.QueryError{Code: 11000, Message: "E11000 duplicate key error"}), Equals, true)
+	c.Assert(journal.IsRejection(&mgo.LastError{Code: 2, Err: "bad value"}), Equals, true)
+
+	// Elections and shutdowns fail the delivery, not the operation.
+	c.Assert(journal.IsRejection(&mgo.QueryError{Code: 10107, Message: "not master"}), Equals, false)
+	c.Assert(journal.IsRejection(&mgo.LastError{Code: 189, Err: "primary stepped down"}), Equals, false)
+	c.Assert(journal.IsRejection(&mgo.QueryError{Code: 11602, Message: "interrupted"}), Equals, false)
+	c.Assert(journal.IsRejection(errors.New("connection reset")), Equals, false)
+}
+
+func (s *FileS) TestOpen(c *C) {
+	j := s.open(c)
+	c.Assert(j.Insert(s.coll, M{"n": 1}, M{"n": 2}), IsNil)
+	c.Assert(j.Close(), IsNil)
+	size := s.fileSize(c)
+
+	// An incomplete entry at the end is discarded.
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0600)
+	c.Assert(err, IsNil)
+	_, err = f.Write([]byte{100, 0, 0, 0, 3})
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+
+	j = s.open(c)
+	c.Assert(j.Pending(), Equals, 2)
+	c.Assert(s.fileSize(c), Equals, size)
+	c.Assert(j.Insert(s.coll, M{"n": 3}), IsNil)
+	c.Assert(j.Close(), IsNil)
+
+	j = s.open(c)
+	defer j.Close()
+	c.Assert(j.Pending(), Equals, 3)
+}
+
+func (s *FileS) TestFailedWrite(c *C) {
+	j := s.open(c)
+	c.Assert(j.Insert(s.coll, M{"n": 1}), IsNil)
+	size := s.fileSize(c)
+
+	var dropped []error
+	j.MaxSize = size
+	j.Dropped = func(op *journal.Op, err error) {
+		dropped = append(dropped, err)
+	}
+
+	// Nothing is dropped for a write that fails.
+	c.Assert(journal.ReopenFile(j, os.O_RDONLY), IsNil)
+	c.Assert(j.Insert(s.coll, M{"n": 2}), NotNil)
+	c.Assert(j.Pending(), Equals, 1)
+	c.Assert(dropped, HasLen, 0)
+
+	// Torn data left by the failed write doesn't hide later entries.
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0600)
+	c.Assert(err, IsNil)
+	_, err = f.Write([]byte{100, 0, 0, 0, 3})
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+	c.Assert(journal.ReopenFile(j, os.O_RDWR|os.O_APPEND), IsNil)
+	j.MaxSize = 0
+	c.Assert(j.Insert(s.coll, M{"n": 3}), IsNil)
+	c.Assert(j.Pending(), Equals, 2)
+	c.Assert(j.Close(), IsNil)
+
+	j = s.open(c)
+	defer j.Close()
+	c.Assert(j.Pending(), Equals, 2)
+}
+
+func (s *FileS) TestTrim(c *C) {
+	j := s.open(c)
+	c.Assert(j.Insert(s.coll, M{"n": 1}), IsNil)
+	size := s.fileSize(c)
+
+	var dropped []error
+	j.MaxSize = 2 * size
+	j.Dropped = func(op *journal.Op, err error) {
+		dropped = append(dropped, err)
+	}
+	c.Assert(j.Insert(s.coll, M{"n": 2}), IsNil)
+	c.Assert(j.Insert(s.coll, M{"n": 3}), IsNil)
+	c.Assert(j.Pending(), Equals, 2)
+	c.Assert(dropped, DeepEquals, []error{journal.ErrFull})
+
+	err := j.Insert(s.coll, M{"n": 4}, M{"n": 5}, M{"n": 6})
+	c.Assert(err, Equals, journal.ErrFull)
+	c.Assert(j.Pending(), Equals, 2)
+
+	j.MaxAge = 10 * time.Millisecond
+	time.Sleep(20 * time.Millisecond)
+	c.Assert(j.Insert(s.coll, M{"n": 7}), IsNil)
+	c.Assert(j.Pending(), Equals, 1)
+	c.Assert(dropped, DeepEquals, []error{journal.ErrFull, journal.ErrExpired, journal.ErrExpired})
+	c.Assert(j.Close(), IsNil)
+
+	// Dropped operations stay dropped.
+	j = s.open(c)
+	defer j.Close()
+	c.Assert(j.Pending(), Equals, 1)
+}
+
+func (s *FileS) TestCompact(c *C) {
+	j := s.open(c)
+	c.Assert(j.Insert(s.coll, M{"n": 0}), IsNil)
+	size := s.fileSize(c)
+
+	j.MaxSize = 3 * size
+	for i := 1; i < 20; i++ {
+		c.Assert(j.Insert(s.coll, M{"n": i}), IsNil)
+		c.Assert(s.fileSize(c) <= 2*j.MaxSize, Equals, true)
+	}
+	c.Assert(j.Pending(), Equals, 3)
+	c.Assert(j.Close(), IsNil)
+
+	j = s.open(c)
+	defer j.Close()
+	c.Assert(j.Pending(), Equals, 3)
+}
@@ -0,0 +1,267 @@
+// The kvstore package implements a key/value store with expiring
+// entries on top of a MongoDB collection, suitable for caches and web
+// session storage.
+//
+// Values are marshalled as BSON and may optionally be compressed before
+// being stored. A TTL index is created on first use so that the server
+// reaps expired entries, and entries that expired but were not yet
+// reaped are never returned.
+//
+//     store := kvstore.New(session.DB("app").C("sessions"), 24*time.Hour)
+//     store.Compressor = kvstore.Gzip
+//     err := store.Set(sid, &state)
+//     ...
+//     err = store.Get(sid, &state)
+//
+package kvstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrNotFound is returned by Get when the key is missing or expired.
+var ErrNotFound = mgo.ErrNotFound
+
+// Compressor compresses and decompresses stored values.
+type Compressor interface {
+	// Name identifies the compressor in stored entries, so that
+	// values may be decompressed after the compressor in use changes.
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = make(map[string]Compressor)
+)
+
+// Register makes a compressor available for decompressing stored
+// values by its name. The Gzip compressor is registered by default.
+func Register(c Compressor) {
+	compressorsMu.Lock()
+	compressors[c.Name()] = c
+	compressorsMu.Unlock()
+}
+
+func lookup(name string) (Compressor, error) {
+	compressorsMu.RLock()
+	c, ok := compressors[name]
+	compressorsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown kvstore compressor: %q", name)
+	}
+	return c, nil
+}
+
+func init() {
+	Register(Gzip)
+}
+
+// Gzip is a Compressor using the gzip format at the default level.
+var Gzip Compressor = gzipCompressor{}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Name() string { return "gzip" }
+
+func (gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// ZlibDict returns a Compressor using the zlib format with the preset
+// dictionary dict, identified by name in stored entries.
+//
+// A dictionary holding byte sequences common to stored values, such as
+// a few representative values concatenated with the most common content
+// last, dramatically improves compression ratios for small values that
+// share a schema, which compress poorly on their own. MinCompressSize
+// should be lowered accordingly.
+//
+// Values can only be decompressed with the dictionary they were
+// compressed with, so the name must change whenever the dictionary
+// does, and compressors for dictionaries still in use by stored entries
+// must remain registered, unless set as the Compressor of the store. Decompressing with the wrong dictionary fails
+// rather than producing garbage.
+func ZlibDict(name string, dict []byte) Compressor {
+	return &zlibDictCompressor{name: name, dict: dict}
+}
+
+type zlibDictCompressor struct {
+	name string
+	dict []byte
+}
+
+func (c *zlibDictCompressor) Name() string { return c.name }
+
+func (c *zlibDictCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := zlib.NewWriterLevelDict(&buf, zlib.BestCompression, c.dict)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *zlibDictCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := zlib.NewReaderDict(bytes.NewReader(data), c.dict)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// Store is a key/value store held in a MongoDB collection.
+type Store struct {
+	c   *mgo.Collection
+	ttl time.Duration
+
+	// Compressor, if set, is used to compress values with at least
+	// MinCompressSize bytes once marshalled. Values compressed with a
+	// compressor of a different name are decompressed by the one
+	// registered under that name.
+	Compressor      Compressor
+	MinCompressSize int
+
+	indexOnce sync.Once
+	indexErr  error
+}
+
+type entry struct {
+	Key        string    `bson:"_id"`
+	Value      []byte    `bson:"v"`
+	Compressor string    `bson:"z,omitempty"`
+	Expires    time.Time `bson:"e"`
+}
+
+type wrapper struct {
+	Value interface{} `bson:"v"`
+}
+
+type rawWrapper struct {
+	Value bson.Raw `bson:"v"`
+}
+
+// New returns a store that holds its entries in c, expiring them after
+// ttl unless a different duration is provided when setting them.
+func New(c *mgo.Collection, ttl time.Duration) *Store {
+	return &Store{c: c, ttl: ttl, MinCompressSize: 1024}
+}
+
+// EnsureIndex creates the TTL index used by the server to reap expired
+// entries. It's called automatically before the first write through
+// the store, and may be called explicitly to surface errors early.
+func (s *Store) EnsureIndex() error {
+	s.indexOnce.Do(func() {
+		s.indexErr = s.c.EnsureIndex(mgo.Index{
+			Key:         []string{"e"},
+			ExpireAfter: time.Second,
+		})
+	})
+	return s.indexErr
+}
+
+// Get unmarshals the value stored under key into result. ErrNotFound
+// is returned if the key is missing or has expired.
+func (s *Store) Get(key string, result interface{}) error {
+	var e entry
+	err := s.c.Find(bson.D{{"_id", key}, {"e", bson.D{{"$gt", time.Now()}}}}).One(&e)
+	if err != nil {
+		return err
+	}
+	data := e.Value
+	if e.Compressor != "" {
+		c := s.Compressor
+		if c == nil || c.Name() != e.Compressor {
+			if c, err = lookup(e.Compressor); err != nil {
+				return err
+			}
+		}
+		if data, err = c.Decompress(data); err != nil {
+			return err
+		}
+	}
+	var w rawWrapper
+	if err := bson.Unmarshal(data, &w); err != nil {
+		return err
+	}
+	return w.Value.Unmarshal(result)
+}
+
+// Set stores value under key, expiring after the store's default TTL.
+func (s *Store) Set(key string, value interface{}) error {
+	return s.SetTTL(key, value, s.ttl)
+}
+
+// SetTTL stores value under key, expiring after ttl.
+func (s *Store) SetTTL(key string, value interface{}, ttl time.Duration) error {
+	if err := s.EnsureIndex(); err != nil {
+		return err
+	}
+	data, err := bson.Marshal(wrapper{value})
+	if err != nil {
+		return err
+	}
+	e := entry{Key: key, Value: data, Expires: time.Now().Add(ttl)}
+	if s.Compressor != nil && len(data) >= s.MinCompressSize {
+		if e.Value, err = s.Compressor.Compress(data); err != nil {
+			return err
+		}
+		e.Compressor = s.Compressor.Name()
+	}
+	_, err = s.c.UpsertId(key, &e)
+	return err
+}
+
+// Touch extends the expiration of the entry under key to the store's
+// default TTL from now. ErrNotFound is returned if the key is missing
+// or has expired.
+func (s *Store) Touch(key string) error {
+	now := time.Now()
+	return s.c.Update(
+		bson.D{{"_id", key}, {"e", bson.D{{"$gt", now}}}},
+		bson.D{{"$set", bson.D{{"e", now.Add(s.ttl)}}}},
+	)
+}
+
+// Delete removes the entry under key, if any.
+func (s *Store) Delete(key string) error {
+	err := s.c.RemoveId(key)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
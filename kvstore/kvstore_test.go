@@ -0,0 +1,187 @@
+package kvstore_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/dbtest"
+	"gopkg.in/mgo.v2/kvstore"
+)
+
+func TestAll(t *testing.T) {
+	TestingT(t)
+}
+
+type CompressorSuite struct{}
+
+var _ = Suite(&CompressorSuite{})
+
+func (s *CompressorSuite) TestGzipRoundTrip(c *C) {
+	data := bytes.Repeat([]byte("session data "), 100)
+	compressed, err := kvstore.Gzip.Compress(data)
+	c.Assert(err, IsNil)
+	c.Assert(len(compressed) < len(data), Equals, true)
+	decompressed, err := kvstore.Gzip.Decompress(compressed)
+	c.Assert(err, IsNil)
+	c.Assert(decompressed, DeepEquals, data)
+}
+
+func (s *CompressorSuite) TestZlibDictRoundTrip(c *C) {
+	sample := func(i int) []byte {
+		data, err := bson.Marshal(bson.M{"device": "sensor-" + strings.Repeat("x", i%3), "temperature": 21.5, "humidity": i, "status": "ok"})
+		c.Assert(err, IsNil)
+		return data
+	}
+	dict := append(sample(1), sample(2)...)
+	compressor := kvstore.ZlibDict("telemetry-v1", dict)
+	c.Assert(compressor.Name(), Equals, "telemetry-v1")
+
+	data := sample(7)
+	compressed, err := compressor.Compress(data)
+	c.Assert(err, IsNil)
+	plain, err := kvstore.Gzip.Compress(data)
+	c.Assert(err, IsNil)
+	c.Assert(len(compressed) < len(data)/2, Equals, true)
+	c.Assert(len(compressed) < len(plain)/2, Equals, true)
+
+	decompressed, err := compressor.Decompress(compressed)
+	c.Assert(err, IsNil)
+	c.Assert(decompressed, DeepEquals, data)
+
+	_, err = kvstore.ZlibDict("telemetry-v2", sample(4)).Decompress(compressed)
+	c.Assert(err, NotNil)
+}
+
+type S struct {
+	server  dbtest.DBServer
+	session *mgo.Session
+	c       *mgo.Collection
+	store   *kvstore.Store
+}
+
+var _ = Suite(&S{})
+
+func (s *S) SetUpSuite(c *C) {
+	s.server.SetPath(c.MkDir())
+}
+
+func (s *S) TearDownSuite(c *C) {
+	s.server.Stop()
+}
+
+func (s *S) SetUpTest(c *C) {
+	s.server.Wipe()
+
+	s.session = s.server.Session()
+	s.c = s.session.DB("test").C("kv")
+	s.store = kvstore.New(s.c, time.Hour)
+}
+
+func (s *S) TearDownTest(c *C) {
+	s.session.Close()
+}
+
+type state struct {
+	User  string
+	Items []string
+}
+
+func (s *S) TestSetGetDelete(c *C) {
+	var result state
+	err := s.store.Get("k", &result)
+	c.Assert(err, Equals, kvstore.ErrNotFound)
+
+	err = s.store.Set("k", &state{"joe", []string{"a", "b"}})
+	c.Assert(err, IsNil)
+	err = s.store.Get("k", &result)
+	c.Assert(err, IsNil)
+	c.Assert(result, DeepEquals, state{"joe", []string{"a", "b"}})
+
+	err = s.store.Set("n", 42)
+	c.Assert(err, IsNil)
+	var n int
+	err = s.store.Get("n", &n)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 42)
+
+	c.Assert(s.store.Delete("k"), IsNil)
+	c.Assert(s.store.Delete("k"), IsNil)
+	err = s.store.Get("k", &result)
+	c.Assert(err, Equals, kvstore.ErrNotFound)
+}
+
+func (s *S) TestIndexCreated(c *C) {
+	err := s.store.Set("k", 1)
+	c.Assert(err, IsNil)
+	indexes, err := s.c.Indexes()
+	c.Assert(err, IsNil)
+	c.Assert(indexes, HasLen, 2)
+	c.Assert(indexes[1].ExpireAfter, Equals, time.Second)
+}
+
+func (s *S) TestExpired(c *C) {
+	err := s.store.SetTTL("k", 1, -time.Second)
+	c.Assert(err, IsNil)
+	var n int
+	err = s.store.Get("k", &n)
+	c.Assert(err, Equals, kvstore.ErrNotFound)
+	err = s.store.Touch("k")
+	c.Assert(err, Equals, kvstore.ErrNotFound)
+
+	err = s.store.SetTTL("k", 1, time.Second)
+	c.Assert(err, IsNil)
+	err = s.store.Touch("k")
+	c.Assert(err, IsNil)
+	var e bson.M
+	err = s.c.FindId("k").One(&e)
+	c.Assert(err, IsNil)
+	c.Assert(e["e"].(time.Time).After(time.Now().Add(time.Minute)), Equals, true)
+}
+
+func (s *S) TestCompression(c *C) {
+	s.store.Compressor = kvstore.Gzip
+	s.store.MinCompressSize = 100
+
+	big := strings.Repeat("x", 1000)
+	c.Assert(s.store.Set("small", "x"), IsNil)
+	c.Assert(s.store.Set("big", big), IsNil)
+
+	var e bson.M
+	c.Assert(s.c.FindId("small").One(&e), IsNil)
+	c.Assert(e["z"], IsNil)
+	c.Assert(s.c.FindId("big").One(&e), IsNil)
+	c.Assert(e["z"], Equals, "gzip")
+	c.Assert(len(e["v"].([]byte)) < 1000, Equals, true)
+
+	// Values remain readable after compression is disabled.
+	s.store.Compressor = nil
+	var result string
+	c.Assert(s.store.Get("big", &result), IsNil)
+	c.Assert(result, Equals, big)
+}
+
+func (s *S) TestCompressionDict(c *C) {
+	// The compressor isn't registered, but reads work through the store.
+	s.store.Compressor = kvstore.ZlibDict("test-dict", []byte(`{"name": "", "email": "@example.com"}`))
+	s.store.MinCompressSize = 10
+
+	value := bson.M{"name": "someone", "email": "someone@example.com"}
+	c.Assert(s.store.Set("k", value), IsNil)
+
+	var e bson.M
+	c.Assert(s.c.FindId("k").One(&e), IsNil)
+	c.Assert(e["z"], Equals, "test-dict")
+
+	var result bson.M
+	c.Assert(s.store.Get("k", &result), IsNil)
+	c.Assert(result, DeepEquals, value)
+
+	s.store.Compressor = nil
+	err := s.store.Get("k", &result)
+	c.Assert(err, ErrorMatches, `unknown kvstore compressor: "test-dict"`)
+}
@@ -0,0 +1,529 @@
+// The livemigrate package moves data between MongoDB clusters while
+// applications keep writing to the source cluster.
+//
+// A migration first records the position of the source oplog, then
+// copies the documents and indexes of the migrated collections into the
+// destination cluster, and finally tails the source oplog from the
+// recorded position, applying the changes performed in the meantime
+// until the destination catches up with the source:
+//
+//     m := livemigrate.New(source, dest, &livemigrate.Options{
+//             Namespaces: []string{"app"},
+//             Cutover: func() error {
+//                     // Stop writes to the source cluster.
+//                     ...
+//             },
+//     })
+//     err := m.Run()
+//
+// Once the replication lag falls under Options.MaxLag, the Cutover hook
+// is called so the application may stop writing to the source. When the
+// hook returns, the remaining changes are applied and Run returns, at
+// which point the application may be pointed at the destination.
+//
+// The source must be a replica set member, since its oplog is used to
+// catch up. Collection options such as capped sizes and validators are
+// not migrated, and the collections must be created beforehand in the
+// destination if they matter. Renaming migrated collections while the
+// migration runs makes it fail.
+//
+package livemigrate
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrStopped is returned by Migrator.Run when the migration is
+// interrupted by Migrator.Stop.
+var ErrStopped = errors.New("migration stopped")
+
+// Phase identifies the stage a migration is in.
+type Phase int
+
+const (
+	Copying    Phase = iota + 1 // Copying documents and indexes
+	CatchingUp                  // Applying oplog entries
+	CuttingOver                 // Applying oplog entries after Cutover returned
+	Done                        // Destination caught up with the source
+)
+
+func (p Phase) String() string {
+	switch p {
+	case Copying:
+		return "copying"
+	case CatchingUp:
+		return "catching up"
+	case CuttingOver:
+		return "cutting over"
+	case Done:
+		return "done"
+	}
+	return fmt.Sprintf("Phase(%d)", int(p))
+}
+
+// Progress reports the state of a running migration.
+type Progress struct {
+	Phase     Phase
+	Namespace string        // Collection being copied, while Copying
+	Copied    int64         // Documents copied so far
+	Applied   int64         // Oplog entries applied so far
+	Lag       time.Duration // Replication lag, once catching up
+}
+
+// Options holds settings for a migration. Zero values select the defaults
+// documented for each field.
+type Options struct {
+	// Namespaces holds the databases ("app") and collections ("app.users")
+	// to migrate. If empty, all databases are migrated except for admin,
+	// local, and config.
+	Namespaces []string
+
+	// BatchSize is the number of documents copied at once. Defaults to 1000.
+	BatchSize int
+
+	// MaxLag is the replication lag under which Cutover is called.
+	// Defaults to one second.
+	MaxLag time.Duration
+
+	// Cutover, if set, is called once the destination lags behind the
+	// source by less than MaxLag. It should stop the writes to the source
+	// cluster. Once it returns, the remaining oplog entries are applied
+	// and the migration completes. If Cutover returns an error, the
+	// migration is aborted with it.
+	//
+	// If Cutover is nil, the migration completes as soon as the lag
+	// falls under MaxLag.
+	Cutover func() error
+
+	// Progress, if set, is called as the migration advances.
+	Progress func(p Progress)
+}
+
+// Migrator migrates data from a source cluster into a destination one.
+type Migrator struct {
+	source  *mgo.Session
+	dest    *mgo.Session
+	options Options
+
+	progress Progress
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+// New returns a Migrator copying data from the source session into the
+// dest session. The sessions are copied, so the provided ones may be
+// closed once New returns.
+func New(source, dest *mgo.Session, options *Options) *Migrator {
+	m := &Migrator{
+		source: source.Copy(),
+		dest:   dest.Copy(),
+		stop:   make(chan struct{}),
+	}
+	if options != nil {
+		m.options = *options
+	}
+	if m.options.BatchSize <= 0 {
+		m.options.BatchSize = 1000
+	}
+	if m.options.MaxLag <= 0 {
+		m.options.MaxLag = time.Second
+	}
+	m.source.SetMode(mgo.Monotonic, true)
+	return m
+}
+
+// Stop interrupts a running migration, making Run return ErrStopped.
+func (m *Migrator) Stop() {
+	m.stopOnce.Do(func() { close(m.stop) })
+}
+
+func (m *Migrator) stopped() bool {
+	select {
+	case <-m.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (m *Migrator) report() {
+	if m.options.Progress != nil {
+		m.options.Progress(m.progress)
+	}
+}
+
+// Run performs the migration, returning once the destination caught up
+// with the source, or once the migration fails or is stopped.
+func (m *Migrator) Run() error {
+	defer m.source.Close()
+	defer m.dest.Close()
+
+	start, err := m.lastTimestamp()
+	if err != nil {
+		return err
+	}
+	namespaces, err := m.namespaces()
+	if err != nil {
+		return err
+	}
+	m.progress.Phase = Copying
+	for _, ns := range namespaces {
+		if err := m.copy(ns); err != nil {
+			return err
+		}
+	}
+	if err := m.catchUp(start); err != nil {
+		return err
+	}
+	m.progress.Phase = Done
+	m.report()
+	return nil
+}
+
+type oplogEntry struct {
+	Timestamp bson.MongoTimestamp `bson:"ts"`
+	Op        string              `bson:"op"`
+	Namespace string              `bson:"ns"`
+	Object    bson.D              `bson:"o"`
+	Query     bson.D              `bson:"o2,omitempty"`
+}
+
+func (m *Migrator) oplog() *mgo.Collection {
+	return m.source.DB("local").C("oplog.rs")
+}
+
+// lastTimestamp returns the timestamp of the latest source oplog entry.
+func (m *Migrator) lastTimestamp() (bson.MongoTimestamp, error) {
+	var entry oplogEntry
+	err := m.oplog().Find(nil).Sort("-$natural").Select(bson.M{"ts": 1}).One(&entry)
+	if err == mgo.ErrNotFound {
+		return 0, errors.New("source has no oplog; is it a replica set member?")
+	}
+	if err != nil {
+		return 0, err
+	}
+	return entry.Timestamp, nil
+}
+
+// namespaces returns the collections to copy.
+func (m *Migrator) namespaces() ([]string, error) {
+	dbnames := m.options.Namespaces
+	if len(dbnames) == 0 {
+		names, err := m.source.DatabaseNames()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if !systemDatabase(name) {
+				dbnames = append(dbnames, name)
+			}
+		}
+	}
+	var namespaces []string
+	for _, name := range dbnames {
+		if strings.Contains(name, ".") {
+			namespaces = append(namespaces, name)
+			continue
+		}
+		collnames, err := m.source.DB(name).CollectionNames()
+		if err != nil {
+			return nil, err
+		}
+		for _, collname := range collnames {
+			if !strings.HasPrefix(collname, "system.") {
+				namespaces = append(namespaces, name+"."+collname)
+			}
+		}
+	}
+	return namespaces, nil
+}
+
+func systemDatabase(name string) bool {
+	return name == "admin" || name == "local" || name == "config"
+}
+
+// migrated returns whether changes to the ns namespace are migrated.
+func (m *Migrator) migrated(ns string) bool {
+	db, coll := splitNamespace(ns)
+	if len(m.options.Namespaces) == 0 {
+		return !systemDatabase(db) && !strings.HasPrefix(coll, "system.")
+	}
+	for _, name := range m.options.Namespaces {
+		if name == ns || name == db {
+			return true
+		}
+	}
+	return false
+}
+
+func splitNamespace(ns string) (db, coll string) {
+	if i := strings.Index(ns, "."); i >= 0 {
+		return ns[:i], ns[i+1:]
+	}
+	return ns, ""
+}
+
+func (m *Migrator) collections(ns string) (source, dest *mgo.Collection) {
+	db, coll := splitNamespace(ns)
+	return m.source.DB(db).C(coll), m.dest.DB(db).C(coll)
+}
+
+// copy copies the documents and indexes of the ns collection. Documents
+// are upserted by _id, so copying again a collection is harmless.
+func (m *Migrator) copy(ns string) error {
+	source, dest := m.collections(ns)
+	m.progress.Namespace = ns
+	m.report()
+
+	indexes, err := source.Indexes()
+	if err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		if index.Name == "_id_" {
+			continue
+		}
+		if err := dest.EnsureIndex(index); err != nil {
+			return fmt.Errorf("cannot create index %s on %s: %v", index.Name, ns, err)
+		}
+	}
+
+	iter := source.Find(nil).Batch(m.options.BatchSize).Iter()
+	var doc bson.D
+	var pairs []interface{}
+	flush := func() error {
+		if len(pairs) == 0 {
+			return nil
+		}
+		bulk := dest.Bulk()
+		bulk.Unordered()
+		bulk.Upsert(pairs...)
+		if _, err := bulk.Run(); err != nil {
+			return err
+		}
+		m.progress.Copied += int64(len(pairs) / 2)
+		m.report()
+		pairs = pairs[:0]
+		return nil
+	}
+	for iter.Next(&doc) {
+		if m.stopped() {
+			iter.Close()
+			return ErrStopped
+		}
+		pairs = append(pairs, bson.D{{"_id", lookup(doc, "_id")}}, doc)
+		doc = nil
+		if len(pairs) >= 2*m.options.BatchSize {
+			if err := flush(); err != nil {
+				iter.Close()
+				return err
+			}
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+func lookup(doc bson.D, name string) interface{} {
+	for _, elem := range doc {
+		if elem.Name == name {
+			return elem.Value
+		}
+	}
+	return nil
+}
+
+// catchUp applies the source oplog entries after start until the
+// destination catches up with the source, cutting over in the process.
+func (m *Migrator) catchUp(start bson.MongoTimestamp) error {
+	m.progress.Phase = CatchingUp
+	m.progress.Namespace = ""
+	m.report()
+
+	// Secondaries may lag behind writes acknowledged by the primary,
+	// which would then be missed when cutting over.
+	m.source.SetMode(mgo.Strong, true)
+
+	var final bson.MongoTimestamp
+	applied := start
+	cutover := func() error {
+		if m.options.Cutover == nil {
+			m.progress.Phase = Done
+			return nil
+		}
+		m.progress.Phase = CuttingOver
+		m.report()
+		if err := m.options.Cutover(); err != nil {
+			return err
+		}
+		var err error
+		final, err = m.lastTimestamp()
+		return err
+	}
+	done := func() bool {
+		return m.progress.Phase == Done || m.progress.Phase == CuttingOver && applied >= final
+	}
+
+	query := bson.M{"ts": bson.M{"$gt": start}}
+	iter := m.oplog().Find(query).LogReplay().Batch(m.options.BatchSize).Tail(time.Second)
+	defer func() { iter.Close() }()
+	var entry oplogEntry
+	for {
+		for iter.Next(&entry) {
+			if m.stopped() {
+				return ErrStopped
+			}
+			if err := m.apply(&entry); err != nil {
+				return fmt.Errorf("cannot apply oplog entry on %s: %v", entry.Namespace, err)
+			}
+			applied = entry.Timestamp
+			m.progress.Applied++
+			entry = oplogEntry{}
+			if m.progress.Applied%int64(m.options.BatchSize) == 0 {
+				last, err := m.lastTimestamp()
+				if err != nil {
+					return err
+				}
+				m.progress.Lag = lag(applied, last)
+				m.report()
+				if m.progress.Phase == CatchingUp && m.progress.Lag <= m.options.MaxLag {
+					if err := cutover(); err != nil {
+						return err
+					}
+				}
+			}
+			if done() {
+				return nil
+			}
+		}
+		if !iter.Timeout() {
+			if err := iter.Close(); err != nil {
+				return err
+			}
+			// The cursor died, such as when the oplog rolled over.
+			iter = m.oplog().Find(bson.M{"ts": bson.M{"$gt": applied}}).LogReplay().Batch(m.options.BatchSize).Tail(time.Second)
+			continue
+		}
+		if m.stopped() {
+			return ErrStopped
+		}
+		// Every entry available was applied.
+		m.progress.Lag = 0
+		m.report()
+		if m.progress.Phase == CatchingUp {
+			if err := cutover(); err != nil {
+				return err
+			}
+		}
+		if done() {
+			return nil
+		}
+	}
+}
+
+// lag returns how far behind the applied timestamp is from last.
+func lag(applied, last bson.MongoTimestamp) time.Duration {
+	return time.Duration(int64(last>>32)-int64(applied>>32)) * time.Second
+}
+
+// apply applies the oplog entry to the destination.
+func (m *Migrator) apply(entry *oplogEntry) error {
+	if entry.Op == "c" {
+		return m.applyCommand(entry)
+	}
+	if !m.migrated(entry.Namespace) {
+		return nil
+	}
+	_, dest := m.collections(entry.Namespace)
+	switch entry.Op {
+	case "i":
+		_, err := dest.Upsert(bson.D{{"_id", lookup(entry.Object, "_id")}}, entry.Object)
+		return err
+	case "u":
+		update := make(bson.D, 0, len(entry.Object))
+		for _, elem := range entry.Object {
+			if elem.Name == "$v" {
+				if v, ok := elem.Value.(int); ok && v >= 2 {
+					return errors.New("oplog update entries in the $v 2 format are not supported")
+				}
+				continue
+			}
+			update = append(update, elem)
+		}
+		err := dest.Update(entry.Query, update)
+		if err == mgo.ErrNotFound {
+			// Deleted later on, or never copied.
+			return nil
+		}
+		return err
+	case "d":
+		err := dest.Remove(entry.Object)
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+	// No-ops and unknown entries.
+	return nil
+}
+
+// applyCommand applies the command in the oplog entry to the destination,
+// if it affects a migrated namespace.
+func (m *Migrator) applyCommand(entry *oplogEntry) error {
+	if len(entry.Object) == 0 {
+		return nil
+	}
+	db, _ := splitNamespace(entry.Namespace)
+	cmd := entry.Object[0]
+	switch cmd.Name {
+	case "applyOps":
+		ops, _ := cmd.Value.([]interface{})
+		for _, op := range ops {
+			data, err := bson.Marshal(op)
+			if err != nil {
+				return err
+			}
+			var nested oplogEntry
+			if err := bson.Unmarshal(data, &nested); err != nil {
+				return err
+			}
+			if err := m.apply(&nested); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "dropDatabase":
+		if !m.migrated(db) {
+			return nil
+		}
+	case "renameCollection":
+		from, _ := cmd.Value.(string)
+		to, _ := lookup(entry.Object, "to").(string)
+		if m.migrated(from) || m.migrated(to) {
+			return fmt.Errorf("renaming %s to %s is not supported", from, to)
+		}
+		return nil
+	default:
+		coll, ok := cmd.Value.(string)
+		if !ok || !m.migrated(db+"."+coll) {
+			return nil
+		}
+	}
+	err := m.dest.DB(db).Run(entry.Object, nil)
+	if qerr, ok := err.(*mgo.QueryError); ok && qerr.Code == 26 {
+		// Namespace not found, such as when dropping a collection
+		// that was created and dropped before being copied.
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,133 @@
+package livemigrate_test
+
+import (
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/dbtest"
+	"gopkg.in/mgo.v2/livemigrate"
+)
+
+func TestAll(t *testing.T) {
+	TestingT(t)
+}
+
+// The source must have an oplog, so it's the rs1 replica set started by
+// "make startdb".
+const sourceAddr = "localhost:40011"
+
+type S struct {
+	dest dbtest.DBServer
+
+	source  *mgo.Session
+	session *mgo.Session
+}
+
+var _ = Suite(&S{})
+
+func (s *S) SetUpSuite(c *C) {
+	s.dest.SetPath(c.MkDir())
+}
+
+func (s *S) TearDownSuite(c *C) {
+	s.dest.Stop()
+}
+
+func (s *S) SetUpTest(c *C) {
+	s.dest.Wipe()
+
+	var err error
+	s.source, err = mgo.DialWithTimeout(sourceAddr, 5*time.Second)
+	c.Assert(err, IsNil)
+	s.source.DB("livemigrate").DropDatabase()
+	s.source.DB("other").DropDatabase()
+	s.session = s.dest.Session()
+}
+
+func (s *S) TearDownTest(c *C) {
+	s.source.Close()
+	s.session.Close()
+}
+
+type doc struct {
+	Id int `bson:"_id"`
+	N  int `bson:"n"`
+}
+
+func (s *S) TestMigrate(c *C) {
+	coll := s.source.DB("livemigrate").C("mycoll")
+	for i := 0; i < 10; i++ {
+		c.Assert(coll.Insert(doc{i, i}), IsNil)
+	}
+	c.Assert(coll.EnsureIndexKey("n"), IsNil)
+	c.Assert(s.source.DB("other").C("mycoll").Insert(doc{1, 1}), IsNil)
+
+	var phases []livemigrate.Phase
+	options := &livemigrate.Options{
+		Namespaces: []string{"livemigrate"},
+		BatchSize:  3,
+		Progress: func(p livemigrate.Progress) {
+			if len(phases) == 0 || phases[len(phases)-1] != p.Phase {
+				phases = append(phases, p.Phase)
+			}
+		},
+		Cutover: func() error {
+			// Writes performed before the source is stopped.
+			c.Assert(coll.Insert(doc{10, 10}), IsNil)
+			c.Assert(coll.UpdateId(1, bson.M{"$set": bson.M{"n": 100}}), IsNil)
+			c.Assert(coll.RemoveId(2), IsNil)
+			return nil
+		},
+	}
+	m := livemigrate.New(s.source, s.session, options)
+
+	// Writes performed while the migration runs, after the oplog
+	// position was recorded.
+	c.Assert(coll.RemoveId(3), IsNil)
+
+	c.Assert(m.Run(), IsNil)
+	c.Assert(phases, DeepEquals, []livemigrate.Phase{livemigrate.Copying, livemigrate.CatchingUp, livemigrate.CuttingOver, livemigrate.Done})
+
+	var result []doc
+	err := s.session.DB("livemigrate").C("mycoll").Find(nil).Sort("_id").All(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result, HasLen, 9)
+	c.Assert(result[0], Equals, doc{0, 0})
+	c.Assert(result[1], Equals, doc{1, 100})
+	c.Assert(result[2], Equals, doc{4, 4})
+	c.Assert(result[8], Equals, doc{10, 10})
+
+	indexes, err := s.session.DB("livemigrate").C("mycoll").Indexes()
+	c.Assert(err, IsNil)
+	c.Assert(indexes, HasLen, 2)
+	c.Assert(indexes[1].Key, DeepEquals, []string{"n"})
+
+	names, err := s.session.DatabaseNames()
+	c.Assert(err, IsNil)
+	for _, name := range names {
+		c.Assert(name, Not(Equals), "other")
+	}
+}
+
+func (s *S) TestStop(c *C) {
+	coll := s.source.DB("livemigrate").C("mycoll")
+	c.Assert(coll.Insert(doc{1, 1}), IsNil)
+
+	var m *livemigrate.Migrator
+	m = livemigrate.New(s.source, s.session, &livemigrate.Options{
+		Namespaces: []string{"livemigrate.mycoll"},
+		Cutover: func() error {
+			m.Stop()
+			return coll.Insert(doc{2, 2})
+		},
+	})
+	c.Assert(m.Run(), Equals, livemigrate.ErrStopped)
+}
+
+func (s *S) TestNoOplog(c *C) {
+	m := livemigrate.New(s.session, s.session, nil)
+	c.Assert(m.Run(), ErrorMatches, "source has no oplog; is it a replica set member\\?")
+}
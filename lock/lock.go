@@ -0,0 +1,154 @@
+// The lock package implements distributed locks backed by a MongoDB
+// collection, so that processes running on distinct machines may
+// coordinate exclusive access to shared resources.
+//
+// Locks are leases: a holder that stops renewing its lock before the
+// lease expires loses it, and another process may then acquire it.
+// This guarantees progress when holders die, but also means a holder
+// must renew its lock more often than the lease duration, and must be
+// prepared to find out it has lost the lock.
+//
+//     l := lock.New(session.DB("app").C("locks"), "scheduler", time.Minute)
+//     if err := l.Acquire(); err == lock.ErrHeld {
+//         return // Some other process is the scheduler.
+//     }
+//     defer l.Release()
+//
+package lock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	// ErrHeld is returned when acquiring a lock held by another owner.
+	ErrHeld = errors.New("lock is held by another owner")
+
+	// ErrNotHeld is returned when renewing a lock that is not held,
+	// either because it was never acquired or because its lease
+	// expired and another owner took it over.
+	ErrNotHeld = errors.New("lock is not held")
+)
+
+type lease struct {
+	Name    string    `bson:"_id"`
+	Owner   string    `bson:"o"`
+	Expires time.Time `bson:"e"`
+}
+
+// Lock is a named lease held in a MongoDB collection.
+//
+// Lock values are not safe for concurrent use by multiple goroutines.
+type Lock struct {
+	c       *mgo.Collection
+	name    string
+	owner   string
+	ttl     time.Duration
+	expires time.Time
+}
+
+// New returns a lock with the given name and lease duration, stored in
+// collection c. Locks with the same name in the same collection
+// exclude each other.
+//
+// Each Lock value has its own owner identity, so two values created
+// for the same name will also exclude each other within a process.
+func New(c *mgo.Collection, name string, ttl time.Duration) *Lock {
+	host, _ := os.Hostname()
+	return &Lock{
+		c:     c,
+		name:  name,
+		owner: fmt.Sprintf("%s/%d/%s", host, os.Getpid(), bson.NewObjectId().Hex()),
+		ttl:   ttl,
+	}
+}
+
+// EnsureIndex creates a TTL index on c so that the server garbage
+// collects expired lease documents. Calling it is optional, as expired
+// leases are taken over when acquiring the lock regardless.
+func EnsureIndex(c *mgo.Collection) error {
+	return c.EnsureIndex(mgo.Index{
+		Key:         []string{"e"},
+		ExpireAfter: time.Second,
+	})
+}
+
+// Name returns the name of the lock.
+func (l *Lock) Name() string {
+	return l.name
+}
+
+// Owner returns the identity recorded in the lease document while the
+// lock is held through l.
+func (l *Lock) Owner() string {
+	return l.owner
+}
+
+// Expires returns the time at which the lease obtained by the last
+// successful Acquire or Renew call expires.
+func (l *Lock) Expires() time.Time {
+	return l.expires
+}
+
+// Acquire attempts to obtain the lock, returning ErrHeld if another
+// owner holds a lease that has not expired yet. Acquiring a lock that
+// is already held through l renews it.
+func (l *Lock) Acquire() error {
+	now := time.Now()
+	expires := now.Add(l.ttl)
+	query := bson.D{{"_id", l.name}, {"$or", []bson.D{
+		{{"o", l.owner}},
+		{{"e", bson.D{{"$lt", now}}}},
+	}}}
+	change := mgo.Change{
+		Update:    bson.D{{"$set", bson.D{{"o", l.owner}, {"e", expires}}}},
+		Upsert:    true,
+		ReturnNew: true,
+	}
+	var result lease
+	_, err := l.c.Find(query).Apply(change, &result)
+	if mgo.IsDup(err) {
+		// Lease exists, is held by someone else, and hasn't expired.
+		return ErrHeld
+	}
+	if err != nil {
+		return err
+	}
+	l.expires = expires
+	return nil
+}
+
+// Renew extends the lease on a lock held through l by another lease
+// duration, returning ErrNotHeld if the lock was lost in the meantime.
+func (l *Lock) Renew() error {
+	expires := time.Now().Add(l.ttl)
+	err := l.c.Update(
+		bson.D{{"_id", l.name}, {"o", l.owner}},
+		bson.D{{"$set", bson.D{{"e", expires}}}},
+	)
+	if err == mgo.ErrNotFound {
+		return ErrNotHeld
+	}
+	if err != nil {
+		return err
+	}
+	l.expires = expires
+	return nil
+}
+
+// Release gives up the lock if it is held through l. Releasing a lock
+// that is not held is not an error.
+func (l *Lock) Release() error {
+	l.expires = time.Time{}
+	err := l.c.Remove(bson.D{{"_id", l.name}, {"o", l.owner}})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
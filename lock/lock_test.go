@@ -0,0 +1,117 @@
+package lock_test
+
+import (
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/dbtest"
+	"gopkg.in/mgo.v2/lock"
+)
+
+func TestAll(t *testing.T) {
+	TestingT(t)
+}
+
+type S struct {
+	server  dbtest.DBServer
+	session *mgo.Session
+	lc      *mgo.Collection
+}
+
+var _ = Suite(&S{})
+
+func (s *S) SetUpSuite(c *C) {
+	s.server.SetPath(c.MkDir())
+}
+
+func (s *S) TearDownSuite(c *C) {
+	s.server.Stop()
+}
+
+func (s *S) SetUpTest(c *C) {
+	s.server.Wipe()
+
+	s.session = s.server.Session()
+	s.lc = s.session.DB("test").C("locks")
+}
+
+func (s *S) TearDownTest(c *C) {
+	s.session.Close()
+}
+
+func (s *S) TestAcquireRelease(c *C) {
+	l1 := lock.New(s.lc, "job", time.Minute)
+	l2 := lock.New(s.lc, "job", time.Minute)
+	c.Assert(l1.Owner(), Not(Equals), l2.Owner())
+
+	err := l1.Acquire()
+	c.Assert(err, IsNil)
+	c.Assert(l1.Expires().After(time.Now()), Equals, true)
+
+	// Acquiring again through the same value renews it.
+	err = l1.Acquire()
+	c.Assert(err, IsNil)
+
+	err = l2.Acquire()
+	c.Assert(err, Equals, lock.ErrHeld)
+
+	// Distinct names don't conflict.
+	err = lock.New(s.lc, "other", time.Minute).Acquire()
+	c.Assert(err, IsNil)
+
+	err = l1.Release()
+	c.Assert(err, IsNil)
+	err = l2.Acquire()
+	c.Assert(err, IsNil)
+
+	// Releasing a lock not held is a no-op.
+	err = l1.Release()
+	c.Assert(err, IsNil)
+	err = l1.Acquire()
+	c.Assert(err, Equals, lock.ErrHeld)
+}
+
+func (s *S) TestRenew(c *C) {
+	l := lock.New(s.lc, "job", time.Minute)
+	err := l.Renew()
+	c.Assert(err, Equals, lock.ErrNotHeld)
+
+	err = l.Acquire()
+	c.Assert(err, IsNil)
+	before := l.Expires()
+	time.Sleep(10 * time.Millisecond)
+	err = l.Renew()
+	c.Assert(err, IsNil)
+	c.Assert(l.Expires().After(before), Equals, true)
+}
+
+func (s *S) TestTakeOverExpired(c *C) {
+	l1 := lock.New(s.lc, "job", time.Minute)
+	l2 := lock.New(s.lc, "job", time.Minute)
+
+	err := l1.Acquire()
+	c.Assert(err, IsNil)
+
+	err = s.lc.UpdateId("job", bson.M{"$set": bson.M{"e": time.Now().Add(-time.Second)}})
+	c.Assert(err, IsNil)
+
+	err = l2.Acquire()
+	c.Assert(err, IsNil)
+
+	err = l1.Renew()
+	c.Assert(err, Equals, lock.ErrNotHeld)
+}
+
+func (s *S) TestEnsureIndex(c *C) {
+	err := lock.EnsureIndex(s.lc)
+	c.Assert(err, IsNil)
+
+	indexes, err := s.lc.Indexes()
+	c.Assert(err, IsNil)
+	c.Assert(indexes, HasLen, 2)
+	c.Assert(indexes[1].Key, DeepEquals, []string{"e"})
+	c.Assert(indexes[1].ExpireAfter, Equals, time.Second)
+}
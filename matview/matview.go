@@ -0,0 +1,300 @@
+// The matview package maintains materialized views: collections holding
+// the results of an aggregation over another collection, which are
+// refreshed by re-running the aggregation with a $merge stage into them.
+//
+// Refreshes may be triggered by an external scheduler via Refresh, or by
+// Run on an interval and whenever the source collection changes:
+//
+//     v := matview.New(orders, pipeline, db.C("daily_totals"), &matview.Options{
+//             Interval: time.Hour,
+//             Watch:    true,
+//             Locks:    db.C("locks"),
+//     })
+//     go v.Run()
+//     defer v.Stop()
+//
+// When Options.Locks is set, refreshes hold a distributed lock (see the
+// lock package), so that processes sharing the view never refresh it at
+// the same time. Refreshes attempted while another one is running are
+// skipped with ErrBusy.
+//
+// Views depend on MongoDB 4.2+, which introduced $merge. Watching for
+// changes depends on a replica set or sharded cluster as well.
+//
+package matview
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/lock"
+)
+
+// ErrBusy is returned by Refresh when the view is being refreshed
+// already, by this process or by another one holding its lock.
+var ErrBusy = errors.New("view refresh already running")
+
+// Options holds settings for a view. Zero values select the defaults
+// documented for each field.
+type Options struct {
+	// Merge holds the fields of the $merge stage appended to the pipeline,
+	// other than "into", such as "on", "whenMatched", and "whenNotMatched".
+	// Defaults to the defaults of $merge, which replace matching documents
+	// in the view by _id and insert the others.
+	Merge bson.D
+
+	// Interval is the time between refreshes performed by Run. Zero means
+	// Run only refreshes the view when the source collection changes.
+	Interval time.Duration
+
+	// Watch makes Run refresh the view when the source collection changes.
+	Watch bool
+
+	// Debounce is the minimum time between refreshes triggered by changes,
+	// so that bursts of changes cause a single refresh. Defaults to one
+	// second.
+	Debounce time.Duration
+
+	// Locks, if set, is the collection holding the lock refreshes of the
+	// view acquire. Views are locked by the full name of their collection.
+	Locks *mgo.Collection
+
+	// LockTTL is the lease duration of the lock, which is renewed while
+	// a refresh runs. Defaults to one minute.
+	LockTTL time.Duration
+
+	// Refreshed, if set, is called after every refresh performed by Run,
+	// with the time it took and its error, if any. Refreshes skipped with
+	// ErrBusy are reported as well.
+	Refreshed func(d time.Duration, err error)
+}
+
+// View refreshes a materialized view.
+type View struct {
+	source   *mgo.Collection
+	target   *mgo.Collection
+	pipeline []interface{}
+	options  Options
+
+	running chan struct{}
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+// New returns a View holding the results of running pipeline, which must
+// be a slice of stages, over the source collection into target. The
+// pipeline must not have a $merge or $out stage, as one merging into
+// target is appended to it.
+func New(source *mgo.Collection, pipeline interface{}, target *mgo.Collection, options *Options) *View {
+	v := &View{
+		source:  source,
+		target:  target,
+		running: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+	if options != nil {
+		v.options = *options
+	}
+	if v.options.Debounce <= 0 {
+		v.options.Debounce = time.Second
+	}
+	if v.options.LockTTL <= 0 {
+		v.options.LockTTL = time.Minute
+	}
+	stages := reflect.ValueOf(pipeline)
+	if stages.Kind() != reflect.Slice {
+		panic("pipeline argument must be a slice of stages")
+	}
+	for i := 0; i < stages.Len(); i++ {
+		v.pipeline = append(v.pipeline, stages.Index(i).Interface())
+	}
+	merge := bson.D{{"into", bson.D{{"db", target.Database.Name}, {"coll", target.Name}}}}
+	merge = append(merge, v.options.Merge...)
+	v.pipeline = append(v.pipeline, bson.D{{"$merge", merge}})
+	return v
+}
+
+// Refresh runs the pipeline of the view, merging its results into the
+// view. It returns ErrBusy without running the pipeline if the view is
+// being refreshed already.
+func (v *View) Refresh() error {
+	select {
+	case v.running <- struct{}{}:
+	default:
+		return ErrBusy
+	}
+	defer func() { <-v.running }()
+
+	if v.options.Locks != nil {
+		l := lock.New(v.options.Locks, v.target.FullName, v.options.LockTTL)
+		err := l.Acquire()
+		if err == lock.ErrHeld {
+			return ErrBusy
+		}
+		if err != nil {
+			return err
+		}
+		defer l.Release()
+
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			ticker := time.NewTicker(v.options.LockTTL / 3)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					if l.Renew() != nil {
+						return
+					}
+				}
+			}
+		}()
+	}
+	return v.source.Pipe(v.pipeline).AllowDiskUse().Iter().Close()
+}
+
+// Run refreshes the view on the configured interval and, if watching,
+// whenever the source collection changes, until Stop is called. Errors
+// are reported via Options.Refreshed and don't stop Run.
+func (v *View) Run() {
+	var tick <-chan time.Time
+	if v.options.Interval > 0 {
+		ticker := time.NewTicker(v.options.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	var changed <-chan struct{}
+	if v.options.Watch {
+		ch := make(chan struct{}, 1)
+		w := &watcher{coll: v.source, changed: ch, stop: v.stop}
+		done := make(chan struct{})
+		go func() {
+			w.loop()
+			close(done)
+		}()
+		defer func() { <-done }()
+		changed = ch
+	}
+
+	var last time.Time
+	for {
+		select {
+		case <-v.stop:
+			return
+		case <-tick:
+		case <-changed:
+			if wait := v.options.Debounce - time.Since(last); wait > 0 {
+				select {
+				case <-v.stop:
+					return
+				case <-time.After(wait):
+				}
+			}
+		}
+		last = time.Now()
+		err := v.Refresh()
+		if v.options.Refreshed != nil {
+			v.options.Refreshed(time.Since(last), err)
+		}
+	}
+}
+
+// Stop makes Run return. Refreshes already running are completed.
+func (v *View) Stop() {
+	v.stopOnce.Do(func() { close(v.stop) })
+}
+
+// watcher follows the change stream of a collection, signaling changed
+// whenever changes are reported.
+type watcher struct {
+	coll    *mgo.Collection
+	changed chan struct{}
+	stop    chan struct{}
+}
+
+type cursorData struct {
+	Id         int64
+	FirstBatch []bson.Raw
+	NextBatch  []bson.Raw
+}
+
+// maxAwait is for how long the server waits for changes before replying
+// to each request for them, which bounds how long Run takes to return.
+var maxAwait = time.Second
+
+// maxRetryDelay bounds the delay between attempts to open the change
+// stream, which doubles from maxAwait on each consecutive failure.
+var maxRetryDelay = time.Minute
+
+func (w *watcher) loop() {
+	session := w.coll.Database.Session.Copy()
+	defer session.Close()
+	coll := w.coll.With(session)
+
+	var cursor int64
+	var failures uint
+	defer func() {
+		if cursor != 0 {
+			coll.Database.Run(bson.D{{"killCursors", coll.Name}, {"cursors", []int64{cursor}}}, nil)
+		}
+	}()
+	for {
+		select {
+		case <-w.stop:
+			return
+		default:
+		}
+		var result struct{ Cursor cursorData }
+		var err error
+		if cursor == 0 {
+			err = coll.Database.Run(bson.D{
+				{"aggregate", coll.Name},
+				{"pipeline", []bson.D{{{"$changeStream", bson.D{}}}}},
+				{"cursor", bson.D{}},
+			}, &result)
+		} else {
+			err = coll.Database.Run(bson.D{
+				{"getMore", cursor},
+				{"collection", coll.Name},
+				{"maxTimeMS", int(maxAwait / time.Millisecond)},
+			}, &result)
+		}
+		if err != nil {
+			cursor = 0
+			session.Refresh()
+			delay := maxRetryDelay
+			if failures < 16 && maxAwait<<failures < delay {
+				delay = maxAwait << failures
+			}
+			failures++
+			select {
+			case <-w.stop:
+				return
+			case <-time.After(delay):
+			}
+			continue
+		}
+		cursor = result.Cursor.Id
+		// Changes may have been missed while the stream was broken,
+		// so refresh once it's reopened.
+		if failures > 0 || len(result.Cursor.FirstBatch) > 0 || len(result.Cursor.NextBatch) > 0 {
+			w.signal()
+		}
+		failures = 0
+	}
+}
+
+func (w *watcher) signal() {
+	select {
+	case w.changed <- struct{}{}:
+	default:
+	}
+}
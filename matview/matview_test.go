@@ -0,0 +1,170 @@
+package matview_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/lock"
+	"gopkg.in/mgo.v2/matview"
+)
+
+func TestAll(t *testing.T) {
+	TestingT(t)
+}
+
+// Watching for changes needs a replica set, so it's the rs1 replica set
+// started by "make startdb".
+const addr = "localhost:40011"
+
+type S struct {
+	session *mgo.Session
+	db      *mgo.Database
+}
+
+var _ = Suite(&S{})
+
+func (s *S) SetUpTest(c *C) {
+	var err error
+	s.session, err = mgo.DialWithTimeout(addr, 5*time.Second)
+	c.Assert(err, IsNil)
+	version, err := s.session.MaxWireVersion()
+	c.Assert(err, IsNil)
+	if version < 8 {
+		s.session.Close()
+		s.session = nil
+		c.Skip("$merge requires MongoDB 4.2+")
+	}
+	s.db = s.session.DB("matview")
+	s.db.DropDatabase()
+}
+
+func (s *S) TearDownTest(c *C) {
+	if s.session != nil {
+		s.session.Close()
+	}
+}
+
+type total struct {
+	Id    string `bson:"_id"`
+	Total int    `bson:"total"`
+}
+
+var pipeline = []bson.D{
+	{{"$group", bson.D{{"_id", "$customer"}, {"total", bson.D{{"$sum", "$amount"}}}}}},
+}
+
+func (s *S) insert(c *C, customer string, amount int) {
+	err := s.db.C("orders").Insert(bson.M{"customer": customer, "amount": amount})
+	c.Assert(err, IsNil)
+}
+
+func (s *S) totals(c *C) []total {
+	var totals []total
+	err := s.db.C("totals").Find(nil).Sort("_id").All(&totals)
+	c.Assert(err, IsNil)
+	return totals
+}
+
+func (s *S) TestRefresh(c *C) {
+	s.insert(c, "a", 1)
+	s.insert(c, "a", 2)
+	s.insert(c, "b", 5)
+
+	v := matview.New(s.db.C("orders"), pipeline, s.db.C("totals"), nil)
+	c.Assert(v.Refresh(), IsNil)
+	c.Assert(s.totals(c), DeepEquals, []total{{"a", 3}, {"b", 5}})
+
+	s.insert(c, "b", 1)
+	c.Assert(v.Refresh(), IsNil)
+	c.Assert(s.totals(c), DeepEquals, []total{{"a", 3}, {"b", 6}})
+}
+
+func (s *S) TestRefreshLocked(c *C) {
+	s.insert(c, "a", 1)
+
+	locks := s.db.C("locks")
+	other := lock.New(locks, s.db.C("totals").FullName, time.Minute)
+	c.Assert(other.Acquire(), IsNil)
+
+	v := matview.New(s.db.C("orders"), pipeline, s.db.C("totals"), &matview.Options{Locks: locks})
+	c.Assert(v.Refresh(), Equals, matview.ErrBusy)
+	c.Assert(s.totals(c), HasLen, 0)
+
+	c.Assert(other.Release(), IsNil)
+	c.Assert(v.Refresh(), IsNil)
+	c.Assert(s.totals(c), DeepEquals, []total{{"a", 1}})
+
+	// The lock is released once done.
+	c.Assert(other.Acquire(), IsNil)
+}
+
+func (s *S) TestRunWatch(c *C) {
+	refreshed := make(chan error, 10)
+	v := matview.New(s.db.C("orders"), pipeline, s.db.C("totals"), &matview.Options{
+		Watch:    true,
+		Debounce: 10 * time.Millisecond,
+		Refreshed: func(d time.Duration, err error) {
+			refreshed <- err
+		},
+	})
+	done := make(chan struct{})
+	go func() {
+		v.Run()
+		close(done)
+	}()
+
+	// Give the change stream a moment to be opened.
+	time.Sleep(500 * time.Millisecond)
+	s.insert(c, "a", 1)
+
+	deadline := time.After(10 * time.Second)
+	for len(s.totals(c)) == 0 {
+		select {
+		case err := <-refreshed:
+			c.Assert(err, IsNil)
+		case <-deadline:
+			c.Fatalf("view not refreshed in time")
+		}
+	}
+	c.Assert(s.totals(c), DeepEquals, []total{{"a", 1}})
+
+	v.Stop()
+	<-done
+}
+
+func (s *S) TestRunWatchUnsupported(c *C) {
+	// Standalone servers have no change streams, and failing to watch
+	// must not be mistaken for changes.
+	session, err := mgo.DialWithTimeout("localhost:40001", 5*time.Second)
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	var m sync.Mutex
+	refreshes := 0
+	db := session.DB("matview")
+	v := matview.New(db.C("orders"), pipeline, db.C("totals"), &matview.Options{
+		Watch:    true,
+		Debounce: 10 * time.Millisecond,
+		Refreshed: func(d time.Duration, err error) {
+			m.Lock()
+			refreshes++
+			m.Unlock()
+		},
+	})
+	done := make(chan struct{})
+	go func() {
+		v.Run()
+		close(done)
+	}()
+	time.Sleep(3 * time.Second)
+	v.Stop()
+	<-done
+
+	m.Lock()
+	defer m.Unlock()
+	c.Assert(refreshes, Equals, 0)
+}
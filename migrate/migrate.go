@@ -0,0 +1,273 @@
+// The migrate package implements versioned schema and data migrations
+// for MongoDB databases.
+//
+// Applied migrations are recorded in a collection, and a lock held in a
+// companion collection through the lock package prevents multiple
+// processes from running migrations against the same database
+// concurrently.
+//
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/lock"
+)
+
+// Migration holds a single change to be applied to a database.
+//
+// Up applies the change and Down reverts it. Down may be nil, in which
+// case the migration cannot be reverted.
+type Migration struct {
+	Version     int64
+	Description string
+	Up          func(db *mgo.Database) error
+	Down        func(db *mgo.Database) error
+}
+
+// Status reports whether a known migration has been applied.
+type Status struct {
+	Version     int64
+	Description string
+	Applied     bool
+	AppliedAt   time.Time // Zero if not applied
+}
+
+type record struct {
+	Version     int64     `bson:"_id"`
+	Description string    `bson:"d,omitempty"`
+	AppliedAt   time.Time `bson:"t"`
+}
+
+// ErrLocked is returned when another process holds the migrations lock.
+var ErrLocked = errors.New("migrations locked by another process")
+
+// ErrIrreversible is returned when reverting a migration that has no
+// Down function.
+var ErrIrreversible = errors.New("migration cannot be reverted")
+
+// A Migrator applies and reverts migrations on the database of the
+// collection it was created with.
+type Migrator struct {
+	mc         *mgo.Collection
+	lc         *mgo.Collection
+	migrations []Migration
+
+	// LockTimeout defines for how long the migrations lock is held
+	// before another process may take it over. Defaults to 10 minutes.
+	// The lock is renewed every third of LockTimeout while migrations
+	// run, and no further migrations are run if renewing it fails.
+	LockTimeout time.Duration
+}
+
+// NewMigrator returns a new migrator that records applied migrations
+// in mc. A second collection with the same name of mc but suffixed by
+// ".lock" will be used to prevent concurrent runs.
+//
+// Migrations are run in increasing order of their Version field, which
+// must be unique.
+func NewMigrator(mc *mgo.Collection, migrations []Migration) (*Migrator, error) {
+	sorted := make([]Migration, len(migrations))
+	copy(sorted, migrations)
+	sort.Sort(byVersion(sorted))
+	for i := range sorted {
+		if sorted[i].Up == nil {
+			return nil, fmt.Errorf("migration %d has no Up function", sorted[i].Version)
+		}
+		if i > 0 && sorted[i].Version == sorted[i-1].Version {
+			return nil, fmt.Errorf("duplicated migration version: %d", sorted[i].Version)
+		}
+	}
+	m := &Migrator{
+		mc:          mc,
+		lc:          mc.Database.C(mc.Name + ".lock"),
+		migrations:  sorted,
+		LockTimeout: 10 * time.Minute,
+	}
+	return m, nil
+}
+
+type byVersion []Migration
+
+func (s byVersion) Len() int           { return len(s) }
+func (s byVersion) Less(i, j int) bool { return s[i].Version < s[j].Version }
+func (s byVersion) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Status returns the state of all known migrations, in version order.
+func (m *Migrator) Status() ([]Status, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	status := make([]Status, len(m.migrations))
+	for i, mig := range m.migrations {
+		status[i] = Status{Version: mig.Version, Description: mig.Description}
+		if rec, ok := applied[mig.Version]; ok {
+			status[i].Applied = true
+			status[i].AppliedAt = rec.AppliedAt
+		}
+	}
+	return status, nil
+}
+
+// Up applies all pending migrations in version order.
+func (m *Migrator) Up() error {
+	return m.UpTo(-1)
+}
+
+// UpTo applies pending migrations with a version lower than or equal to
+// the provided one, in version order. A negative version applies all
+// pending migrations.
+func (m *Migrator) UpTo(version int64) error {
+	return m.locked(func(held func() error) error {
+		applied, err := m.applied()
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			if version >= 0 && mig.Version > version {
+				break
+			}
+			if _, ok := applied[mig.Version]; ok {
+				continue
+			}
+			if err := held(); err != nil {
+				return err
+			}
+			if err := mig.Up(m.mc.Database); err != nil {
+				return fmt.Errorf("migration %d failed: %v", mig.Version, err)
+			}
+			rec := record{mig.Version, mig.Description, time.Now()}
+			if err := m.mc.Insert(&rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Down reverts the most recently applied migration, if any.
+func (m *Migrator) Down() error {
+	return m.locked(func(held func() error) error {
+		applied, err := m.applied()
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			if _, ok := applied[m.migrations[i].Version]; ok {
+				if err := held(); err != nil {
+					return err
+				}
+				return m.revert(&m.migrations[i])
+			}
+		}
+		return nil
+	})
+}
+
+// DownTo reverts all applied migrations with a version greater than
+// the provided one, in reverse version order.
+func (m *Migrator) DownTo(version int64) error {
+	return m.locked(func(held func() error) error {
+		applied, err := m.applied()
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0 && m.migrations[i].Version > version; i-- {
+			if _, ok := applied[m.migrations[i].Version]; !ok {
+				continue
+			}
+			if err := held(); err != nil {
+				return err
+			}
+			if err := m.revert(&m.migrations[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (m *Migrator) revert(mig *Migration) error {
+	if mig.Down == nil {
+		return fmt.Errorf("migration %d: %v", mig.Version, ErrIrreversible)
+	}
+	if err := mig.Down(m.mc.Database); err != nil {
+		return fmt.Errorf("migration %d revert failed: %v", mig.Version, err)
+	}
+	return m.mc.RemoveId(mig.Version)
+}
+
+func (m *Migrator) applied() (map[int64]record, error) {
+	var recs []record
+	if err := m.mc.Find(nil).All(&recs); err != nil {
+		return nil, err
+	}
+	applied := make(map[int64]record, len(recs))
+	for _, rec := range recs {
+		applied[rec.Version] = rec
+	}
+	return applied, nil
+}
+
+// locked runs f while holding the migrations lock, renewing it in the
+// background. The held function provided to f returns an error once
+// renewing the lock failed, in which case f must stop migrating.
+func (m *Migrator) locked(f func(held func() error) error) error {
+	timeout := m.LockTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Minute
+	}
+	l := lock.New(m.lc, "migrate", timeout)
+	err := l.Acquire()
+	if err == lock.ErrHeld {
+		return ErrLocked
+	}
+	if err != nil {
+		return err
+	}
+
+	var mu sync.Mutex
+	var lost error
+	held := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return lost
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(timeout / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			if err := l.Renew(); err != nil {
+				mu.Lock()
+				lost = fmt.Errorf("cannot renew migrations lock: %v", err)
+				mu.Unlock()
+				return
+			}
+		}
+	}()
+
+	err = f(held)
+	close(stop)
+	<-done
+	if err == nil {
+		err = held()
+	}
+	if rerr := l.Release(); err == nil {
+		err = rerr
+	}
+	return err
+}
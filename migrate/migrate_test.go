@@ -0,0 +1,211 @@
+package migrate_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/dbtest"
+	"gopkg.in/mgo.v2/migrate"
+)
+
+func TestAll(t *testing.T) {
+	TestingT(t)
+}
+
+type S struct {
+	server  dbtest.DBServer
+	session *mgo.Session
+	db      *mgo.Database
+	mc      *mgo.Collection
+}
+
+var _ = Suite(&S{})
+
+type M map[string]interface{}
+
+func (s *S) SetUpSuite(c *C) {
+	s.server.SetPath(c.MkDir())
+}
+
+func (s *S) TearDownSuite(c *C) {
+	s.server.Stop()
+}
+
+func (s *S) SetUpTest(c *C) {
+	s.server.Wipe()
+
+	s.session = s.server.Session()
+	s.db = s.session.DB("test")
+	s.mc = s.db.C("migrations")
+}
+
+func (s *S) TearDownTest(c *C) {
+	s.session.Close()
+}
+
+func (s *S) migrations(log *[]string) []migrate.Migration {
+	step := func(name string) func(db *mgo.Database) error {
+		return func(db *mgo.Database) error {
+			*log = append(*log, name)
+			return db.C("log").Insert(M{"step": name})
+		}
+	}
+	return []migrate.Migration{
+		{Version: 2, Description: "second", Up: step("up2"), Down: step("down2")},
+		{Version: 1, Description: "first", Up: step("up1"), Down: step("down1")},
+		{Version: 3, Description: "third", Up: step("up3")},
+	}
+}
+
+func (s *S) TestNewMigratorValidates(c *C) {
+	up := func(db *mgo.Database) error { return nil }
+	_, err := migrate.NewMigrator(s.mc, []migrate.Migration{{Version: 1, Up: up}, {Version: 1, Up: up}})
+	c.Assert(err, ErrorMatches, "duplicated migration version: 1")
+	_, err = migrate.NewMigrator(s.mc, []migrate.Migration{{Version: 1}})
+	c.Assert(err, ErrorMatches, "migration 1 has no Up function")
+}
+
+func (s *S) TestUpAndStatus(c *C) {
+	var log []string
+	m, err := migrate.NewMigrator(s.mc, s.migrations(&log))
+	c.Assert(err, IsNil)
+
+	status, err := m.Status()
+	c.Assert(err, IsNil)
+	c.Assert(status, HasLen, 3)
+	for i, st := range status {
+		c.Assert(st.Version, Equals, int64(i+1))
+		c.Assert(st.Applied, Equals, false)
+	}
+
+	err = m.UpTo(2)
+	c.Assert(err, IsNil)
+	c.Assert(log, DeepEquals, []string{"up1", "up2"})
+
+	err = m.Up()
+	c.Assert(err, IsNil)
+	c.Assert(log, DeepEquals, []string{"up1", "up2", "up3"})
+
+	status, err = m.Status()
+	c.Assert(err, IsNil)
+	for _, st := range status {
+		c.Assert(st.Applied, Equals, true)
+		c.Assert(st.AppliedAt.IsZero(), Equals, false)
+	}
+
+	// Nothing left to do.
+	err = m.Up()
+	c.Assert(err, IsNil)
+	c.Assert(log, HasLen, 3)
+}
+
+func (s *S) TestDown(c *C) {
+	var log []string
+	m, err := migrate.NewMigrator(s.mc, s.migrations(&log))
+	c.Assert(err, IsNil)
+
+	err = m.UpTo(2)
+	c.Assert(err, IsNil)
+	err = m.Down()
+	c.Assert(err, IsNil)
+	err = m.DownTo(0)
+	c.Assert(err, IsNil)
+	c.Assert(log, DeepEquals, []string{"up1", "up2", "down2", "down1"})
+
+	n, err := s.mc.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 0)
+
+	err = m.Up()
+	c.Assert(err, IsNil)
+	err = m.Down()
+	c.Assert(err, ErrorMatches, "migration 3: migration cannot be reverted")
+}
+
+func (s *S) TestUpFailure(c *C) {
+	fail := errors.New("boom")
+	m, err := migrate.NewMigrator(s.mc, []migrate.Migration{
+		{Version: 1, Up: func(db *mgo.Database) error { return nil }},
+		{Version: 2, Up: func(db *mgo.Database) error { return fail }},
+	})
+	c.Assert(err, IsNil)
+	err = m.Up()
+	c.Assert(err, ErrorMatches, "migration 2 failed: boom")
+
+	status, err := m.Status()
+	c.Assert(err, IsNil)
+	c.Assert(status[0].Applied, Equals, true)
+	c.Assert(status[1].Applied, Equals, false)
+
+	// The lock must have been released.
+	n, err := s.db.C("migrations.lock").Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 0)
+}
+
+func (s *S) TestLocked(c *C) {
+	var log []string
+	m, err := migrate.NewMigrator(s.mc, s.migrations(&log))
+	c.Assert(err, IsNil)
+
+	lc := s.db.C("migrations.lock")
+	err = lc.Insert(bson.D{{"_id", "migrate"}, {"o", "other"}, {"e", time.Now().Add(time.Hour)}})
+	c.Assert(err, IsNil)
+
+	err = m.Up()
+	c.Assert(err, Equals, migrate.ErrLocked)
+	c.Assert(log, HasLen, 0)
+
+	// Expired leases are taken over.
+	err = lc.UpdateId("migrate", bson.D{{"$set", bson.D{{"e", time.Now().Add(-time.Second)}}}})
+	c.Assert(err, IsNil)
+	err = m.Up()
+	c.Assert(err, IsNil)
+	c.Assert(log, HasLen, 3)
+}
+
+func (s *S) TestLockRenewed(c *C) {
+	lc := s.db.C("migrations.lock")
+	slow := func(db *mgo.Database) error {
+		time.Sleep(300 * time.Millisecond)
+		return nil
+	}
+	other, err := migrate.NewMigrator(s.mc, nil)
+	c.Assert(err, IsNil)
+	m, err := migrate.NewMigrator(s.mc, []migrate.Migration{
+		{Version: 1, Up: slow},
+		{Version: 2, Up: func(db *mgo.Database) error {
+			// The lease outlived its initial timeout.
+			return other.Up()
+		}},
+	})
+	c.Assert(err, IsNil)
+	m.LockTimeout = 150 * time.Millisecond
+	err = m.Up()
+	c.Assert(err, ErrorMatches, "migration 2 failed: "+migrate.ErrLocked.Error())
+
+	// Losing the lock stops further migrations.
+	var log []string
+	m, err = migrate.NewMigrator(s.mc, []migrate.Migration{
+		{Version: 2, Up: func(db *mgo.Database) error {
+			log = append(log, "up2")
+			if _, err := lc.RemoveAll(nil); err != nil {
+				return err
+			}
+			return slow(db)
+		}},
+		{Version: 3, Up: func(db *mgo.Database) error {
+			log = append(log, "up3")
+			return nil
+		}},
+	})
+	c.Assert(err, IsNil)
+	m.LockTimeout = 150 * time.Millisecond
+	err = m.Up()
+	c.Assert(err, ErrorMatches, "cannot renew migrations lock: .*")
+	c.Assert(log, DeepEquals, []string{"up2"})
+}
@@ -0,0 +1,523 @@
+// The mirror package supports live migrations between clusters by
+// mirroring the operations of an application from the cluster it uses,
+// the primary, into a shadow cluster.
+//
+// Writes are performed on the primary cluster, and once they succeed
+// they're replayed asynchronously on the shadow cluster, so the latency
+// and availability of the application don't depend on the shadow. Reads
+// are served by the primary cluster, and a fraction of them may also be
+// run on the shadow cluster in the background, with their results
+// compared to find out whether both clusters diverged:
+//
+//     m := mirror.New(primary, shadow, &mirror.Options{ShadowReads: 0.1})
+//     defer m.Close()
+//
+//     orders := m.C("app", "orders")
+//     err := orders.Insert(order)
+//     ...
+//     err = orders.Find(bson.M{"customer": id}).All(&result)
+//     ...
+//     stats := m.Stats()
+//
+// Writes are replayed in the order they were performed on the primary
+// by a single goroutine, so the shadow cluster lags behind by the time
+// it takes to drain the pending writes.
+//
+package mirror
+
+import (
+	"bytes"
+	"math/rand"
+	"sort"
+	"sync"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Options holds settings for mirroring operations. Zero values select
+// the defaults documented for each field.
+type Options struct {
+	// QueueSize is the maximum number of writes waiting to be replayed
+	// on the shadow cluster. Writes performed when the queue is full are
+	// dropped rather than replayed, and counted in Stats.WritesDropped.
+	// Defaults to 10000.
+	QueueSize int
+
+	// ShadowReads is the fraction of reads, from 0 to 1, that are also
+	// run on the shadow cluster so their results may be compared.
+	ShadowReads float64
+
+	// Divergence, if set, is called from a background goroutine for
+	// every shadowed read that obtained different results from both
+	// clusters.
+	Divergence func(d *Divergence)
+}
+
+// Divergence describes a read that obtained different results from the
+// primary and the shadow clusters.
+type Divergence struct {
+	Database   string
+	Collection string
+	Op         string      // "one", "all", or "count"
+	Query      interface{} // Query filter
+	Primary    interface{} // Result from the primary cluster
+	Shadow     interface{} // Result from the shadow cluster
+}
+
+// Stats holds counters of mirrored operations.
+type Stats struct {
+	WritesQueued   int64 // Writes waiting to be replayed
+	WritesReplayed int64 // Writes replayed successfully on the shadow cluster
+	WriteErrors    int64 // Writes that failed on the shadow cluster
+	WritesDropped  int64 // Writes not replayed because the queue was full
+	ReadsCompared  int64 // Reads run on both clusters and compared
+	ReadsDiverged  int64 // Compared reads with different results
+	ReadErrors     int64 // Shadowed reads that failed on the shadow cluster
+}
+
+// Mirror performs operations on a primary cluster and mirrors them into
+// a shadow cluster.
+type Mirror struct {
+	primary *mgo.Session
+	shadow  *mgo.Session
+	options Options
+
+	m      sync.Mutex
+	stats  Stats
+	rand   *rand.Rand
+	closed bool
+	writes chan func(shadow *mgo.Session) error
+	reads  sync.WaitGroup
+	done   chan struct{}
+}
+
+// New returns a Mirror performing operations on the primary session and
+// replaying them on the shadow session. The sessions are copied, so the
+// provided ones may be closed once New returns. The returned Mirror must
+// be closed when it's not needed anymore.
+func New(primary, shadow *mgo.Session, options *Options) *Mirror {
+	m := &Mirror{
+		primary: primary.Copy(),
+		shadow:  shadow.Copy(),
+		rand:    rand.New(rand.NewSource(rand.Int63())),
+		done:    make(chan struct{}),
+	}
+	if options != nil {
+		m.options = *options
+	}
+	if m.options.QueueSize <= 0 {
+		m.options.QueueSize = 10000
+	}
+	m.writes = make(chan func(shadow *mgo.Session) error, m.options.QueueSize)
+	go m.replay()
+	return m
+}
+
+// Close waits until the pending writes are replayed and the shadowed
+// reads are compared, and releases the resources used by m.
+func (m *Mirror) Close() {
+	m.m.Lock()
+	if !m.closed {
+		m.closed = true
+		close(m.writes)
+	}
+	m.m.Unlock()
+	<-m.done
+	m.reads.Wait()
+	m.primary.Close()
+	m.shadow.Close()
+}
+
+// Stats returns the counters of the operations mirrored so far.
+func (m *Mirror) Stats() Stats {
+	m.m.Lock()
+	stats := m.stats
+	m.m.Unlock()
+	stats.WritesQueued = int64(len(m.writes))
+	return stats
+}
+
+func (m *Mirror) replay() {
+	defer close(m.done)
+	for write := range m.writes {
+		err := write(m.shadow)
+		m.m.Lock()
+		if err == nil {
+			m.stats.WritesReplayed++
+		} else {
+			m.stats.WriteErrors++
+		}
+		m.m.Unlock()
+	}
+}
+
+// queue schedules write to be replayed on the shadow cluster. Writes
+// queued after m is closed are dropped.
+func (m *Mirror) queue(write func(shadow *mgo.Session) error) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	if !m.closed {
+		select {
+		case m.writes <- write:
+			return
+		default:
+		}
+	}
+	m.stats.WritesDropped++
+}
+
+// snapshot returns v marshalled as it is at the time of the call, so
+// that the caller changing it afterwards won't affect replayed writes.
+func snapshot(v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	data, err := bson.Marshal(bson.D{{"v", v}})
+	if err != nil {
+		return nil, err
+	}
+	var doc struct{ V bson.Raw }
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return doc.V, nil
+}
+
+// snapshotPair returns snapshots of selector and update.
+func snapshotPair(selector, update interface{}) (interface{}, interface{}, error) {
+	selector, err := snapshot(selector)
+	if err != nil {
+		return nil, nil, err
+	}
+	update, err = snapshot(update)
+	return selector, update, err
+}
+
+// shadowRead reports whether the next read should be shadowed.
+func (m *Mirror) shadowRead() bool {
+	if m.options.ShadowReads <= 0 {
+		return false
+	}
+	m.m.Lock()
+	defer m.m.Unlock()
+	return m.rand.Float64() < m.options.ShadowReads
+}
+
+// C returns a value representing the named collection on both clusters.
+func (m *Mirror) C(db, name string) *Collection {
+	return &Collection{mirror: m, db: db, name: name}
+}
+
+// Collection performs operations on a collection of the primary cluster
+// and mirrors them into the shadow cluster.
+type Collection struct {
+	mirror *Mirror
+	db     string
+	name   string
+}
+
+// Primary returns the collection in the primary cluster, for operations
+// that aren't mirrored.
+func (c *Collection) Primary() *mgo.Collection {
+	return c.mirror.primary.DB(c.db).C(c.name)
+}
+
+func (c *Collection) shadow(session *mgo.Session) *mgo.Collection {
+	return session.DB(c.db).C(c.name)
+}
+
+// Insert inserts docs into the primary cluster, and replays the insertion
+// on the shadow cluster. Documents missing an _id field get a new object
+// id before being inserted, so that both clusters hold the same _id.
+func (c *Collection) Insert(docs ...interface{}) error {
+	idocs := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		fields, err := bson.Fields(data, "_id")
+		if err != nil {
+			return err
+		}
+		if _, ok := fields["_id"]; ok {
+			idocs[i] = bson.Raw{0x03, data}
+			continue
+		}
+		var d bson.RawD
+		if err := bson.Unmarshal(data, &d); err != nil {
+			return err
+		}
+		id := bson.RawDocElem{"_id", bson.Raw{0x07, []byte(bson.NewObjectId())}}
+		idocs[i] = append(bson.RawD{id}, d...)
+	}
+	if err := c.Primary().Insert(idocs...); err != nil {
+		return err
+	}
+	c.mirror.queue(func(shadow *mgo.Session) error {
+		return c.shadow(shadow).Insert(idocs...)
+	})
+	return nil
+}
+
+// Update works like mgo.Collection.Update, and replays successful updates
+// on the shadow cluster.
+func (c *Collection) Update(selector, update interface{}) error {
+	selector, update, err := snapshotPair(selector, update)
+	if err != nil {
+		return err
+	}
+	if err := c.Primary().Update(selector, update); err != nil {
+		return err
+	}
+	c.mirror.queue(func(shadow *mgo.Session) error {
+		return c.shadow(shadow).Update(selector, update)
+	})
+	return nil
+}
+
+// UpdateAll works like mgo.Collection.UpdateAll, and replays successful
+// updates on the shadow cluster.
+func (c *Collection) UpdateAll(selector, update interface{}) (*mgo.ChangeInfo, error) {
+	selector, update, err := snapshotPair(selector, update)
+	if err != nil {
+		return nil, err
+	}
+	info, err := c.Primary().UpdateAll(selector, update)
+	if err != nil {
+		return info, err
+	}
+	c.mirror.queue(func(shadow *mgo.Session) error {
+		_, err := c.shadow(shadow).UpdateAll(selector, update)
+		return err
+	})
+	return info, nil
+}
+
+// Upsert works like mgo.Collection.Upsert, and replays successful upserts
+// on the shadow cluster. When a document is inserted, the replayed upsert
+// sets the _id generated by the primary cluster.
+func (c *Collection) Upsert(selector, update interface{}) (*mgo.ChangeInfo, error) {
+	selector, update, err := snapshotPair(selector, update)
+	if err != nil {
+		return nil, err
+	}
+	info, err := c.Primary().Upsert(selector, update)
+	if err != nil {
+		return info, err
+	}
+	if info.UpsertedId != nil {
+		selector = bson.D{{"$and", []interface{}{selector, bson.D{{"_id", info.UpsertedId}}}}}
+	}
+	c.mirror.queue(func(shadow *mgo.Session) error {
+		_, err := c.shadow(shadow).Upsert(selector, update)
+		return err
+	})
+	return info, nil
+}
+
+// Remove works like mgo.Collection.Remove, and replays successful removals
+// on the shadow cluster.
+func (c *Collection) Remove(selector interface{}) error {
+	selector, err := snapshot(selector)
+	if err != nil {
+		return err
+	}
+	if err := c.Primary().Remove(selector); err != nil {
+		return err
+	}
+	c.mirror.queue(func(shadow *mgo.Session) error {
+		return c.shadow(shadow).Remove(selector)
+	})
+	return nil
+}
+
+// RemoveAll works like mgo.Collection.RemoveAll, and replays successful
+// removals on the shadow cluster.
+func (c *Collection) RemoveAll(selector interface{}) (*mgo.ChangeInfo, error) {
+	selector, err := snapshot(selector)
+	if err != nil {
+		return nil, err
+	}
+	info, err := c.Primary().RemoveAll(selector)
+	if err != nil {
+		return info, err
+	}
+	c.mirror.queue(func(shadow *mgo.Session) error {
+		_, err := c.shadow(shadow).RemoveAll(selector)
+		return err
+	})
+	return info, nil
+}
+
+// Find prepares a query on the collection of the primary cluster, which
+// may be shadowed on the shadow cluster as well.
+func (c *Collection) Find(query interface{}) *Query {
+	return &Query{c: c, query: query}
+}
+
+// Query holds a query that may be shadowed.
+type Query struct {
+	c     *Collection
+	query interface{}
+	sort  []string
+	limit int
+}
+
+// Sort works like mgo.Query.Sort.
+func (q *Query) Sort(fields ...string) *Query {
+	q.sort = fields
+	return q
+}
+
+// Limit works like mgo.Query.Limit.
+func (q *Query) Limit(n int) *Query {
+	q.limit = n
+	return q
+}
+
+func (q *Query) on(coll *mgo.Collection) *mgo.Query {
+	mq := coll.Find(q.query)
+	if len(q.sort) > 0 {
+		mq.Sort(q.sort...)
+	}
+	if q.limit > 0 {
+		mq.Limit(q.limit)
+	}
+	return mq
+}
+
+// One works like mgo.Query.One.
+func (q *Query) One(result interface{}) error {
+	var doc bson.Raw
+	err := q.on(q.c.Primary()).One(&doc)
+	if err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	var primary interface{}
+	if err == nil {
+		primary = doc
+	}
+	q.compare("one", func(shadow *mgo.Collection) (interface{}, error) {
+		var sdoc bson.Raw
+		err := q.on(shadow).One(&sdoc)
+		if err == mgo.ErrNotFound {
+			return nil, nil
+		}
+		return sdoc, err
+	}, primary)
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		return nil
+	}
+	return doc.Unmarshal(result)
+}
+
+// All works like mgo.Query.All. Unless the query is sorted, results are
+// compared regardless of their order.
+func (q *Query) All(result interface{}) error {
+	var docs []bson.Raw
+	if err := q.on(q.c.Primary()).All(&docs); err != nil {
+		return err
+	}
+	q.compare("all", func(shadow *mgo.Collection) (interface{}, error) {
+		var sdocs []bson.Raw
+		err := q.on(shadow).All(&sdocs)
+		return sdocs, err
+	}, docs)
+	// Unmarshal the documents through an array so that result may be
+	// any slice accepted by mgo.Query.All.
+	data, err := bson.Marshal(bson.D{{"d", docs}})
+	if err != nil {
+		return err
+	}
+	var array struct {
+		D bson.Raw "d"
+	}
+	if err := bson.Unmarshal(data, &array); err != nil {
+		return err
+	}
+	return array.D.Unmarshal(result)
+}
+
+// Count works like mgo.Query.Count.
+func (q *Query) Count() (int, error) {
+	n, err := q.on(q.c.Primary()).Count()
+	if err != nil {
+		return n, err
+	}
+	q.compare("count", func(shadow *mgo.Collection) (interface{}, error) {
+		return q.on(shadow).Count()
+	}, n)
+	return n, nil
+}
+
+// compare runs read on the shadow cluster in the background, if the read
+// is to be shadowed, and compares its result with the primary one.
+func (q *Query) compare(op string, read func(shadow *mgo.Collection) (interface{}, error), primary interface{}) {
+	m := q.c.mirror
+	if !m.shadowRead() {
+		return
+	}
+	m.reads.Add(1)
+	go func() {
+		defer m.reads.Done()
+		shadow, err := read(q.c.shadow(m.shadow))
+		m.m.Lock()
+		if err != nil {
+			m.stats.ReadErrors++
+			m.m.Unlock()
+			return
+		}
+		m.stats.ReadsCompared++
+		diverged := !equal(primary, shadow, len(q.sort) == 0)
+		if diverged {
+			m.stats.ReadsDiverged++
+		}
+		m.m.Unlock()
+		if diverged && m.options.Divergence != nil {
+			m.options.Divergence(&Divergence{
+				Database:   q.c.db,
+				Collection: q.c.name,
+				Op:         op,
+				Query:      q.query,
+				Primary:    primary,
+				Shadow:     shadow,
+			})
+		}
+	}()
+}
+
+// equal returns whether the results a and b are the same. Slices of
+// documents are compared regardless of their order if unordered is set.
+func equal(a, b interface{}, unordered bool) bool {
+	switch a := a.(type) {
+	case bson.Raw:
+		b, ok := b.(bson.Raw)
+		return ok && bytes.Equal(a.Data, b.Data)
+	case []bson.Raw:
+		b, ok := b.([]bson.Raw)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		if unordered {
+			a, b = sorted(a), sorted(b)
+		}
+		for i := range a {
+			if !bytes.Equal(a[i].Data, b[i].Data) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+func sorted(docs []bson.Raw) []bson.Raw {
+	docs = append([]bson.Raw(nil), docs...)
+	sort.Slice(docs, func(i, j int) bool { return bytes.Compare(docs[i].Data, docs[j].Data) < 0 })
+	return docs
+}
@@ -0,0 +1,146 @@
+package mirror_test
+
+import (
+	"sync"
+	"testing"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/dbtest"
+	"gopkg.in/mgo.v2/mirror"
+)
+
+func TestAll(t *testing.T) {
+	TestingT(t)
+}
+
+type S struct {
+	primary dbtest.DBServer
+	shadow  dbtest.DBServer
+
+	psession *mgo.Session
+	ssession *mgo.Session
+}
+
+var _ = Suite(&S{})
+
+func (s *S) SetUpSuite(c *C) {
+	s.primary.SetPath(c.MkDir())
+	s.shadow.SetPath(c.MkDir())
+}
+
+func (s *S) TearDownSuite(c *C) {
+	s.primary.Stop()
+	s.shadow.Stop()
+}
+
+func (s *S) SetUpTest(c *C) {
+	s.primary.Wipe()
+	s.shadow.Wipe()
+
+	s.psession = s.primary.Session()
+	s.ssession = s.shadow.Session()
+}
+
+func (s *S) TearDownTest(c *C) {
+	s.psession.Close()
+	s.ssession.Close()
+}
+
+type doc struct {
+	Id bson.ObjectId `bson:"_id,omitempty"`
+	N  int           `bson:"n"`
+}
+
+func (s *S) contents(c *C, session *mgo.Session) []doc {
+	var result []doc
+	err := session.DB("mydb").C("mycoll").Find(nil).Sort("n").All(&result)
+	c.Assert(err, IsNil)
+	return result
+}
+
+func (s *S) TestWrites(c *C) {
+	m := mirror.New(s.psession, s.ssession, nil)
+	coll := m.C("mydb", "mycoll")
+
+	c.Assert(coll.Insert(doc{N: 1}, doc{N: 2}, bson.M{"_id": bson.NewObjectId(), "n": 3}), IsNil)
+	c.Assert(coll.Update(bson.M{"n": 1}, bson.M{"$set": bson.M{"n": 10}}), IsNil)
+	_, err := coll.UpdateAll(bson.M{"n": bson.M{"$gt": 2}}, bson.M{"$inc": bson.M{"n": 1}})
+	c.Assert(err, IsNil)
+	_, err = coll.Upsert(bson.M{"n": 20}, bson.M{"$set": bson.M{"x": 1}})
+	c.Assert(err, IsNil)
+	selector := bson.M{"n": 2}
+	c.Assert(coll.Remove(selector), IsNil)
+
+	// Changing arguments afterwards doesn't affect replayed writes.
+	selector["n"] = 4
+
+	// Failed writes aren't replayed.
+	c.Assert(coll.Remove(bson.M{"n": 42}), Equals, mgo.ErrNotFound)
+
+	m.Close()
+
+	primary := s.contents(c, s.psession)
+	c.Assert(primary, HasLen, 3)
+	c.Assert(primary[0].N, Equals, 4)
+	c.Assert(primary[1].N, Equals, 11)
+	c.Assert(primary[2].N, Equals, 20)
+	c.Assert(s.contents(c, s.ssession), DeepEquals, primary)
+
+	stats := m.Stats()
+	c.Assert(stats.WritesReplayed, Equals, int64(5))
+	c.Assert(stats.WriteErrors, Equals, int64(0))
+	c.Assert(stats.WritesDropped, Equals, int64(0))
+}
+
+func (s *S) TestShadowReads(c *C) {
+	var mu sync.Mutex
+	var divergences []*mirror.Divergence
+	options := &mirror.Options{
+		ShadowReads: 1,
+		Divergence: func(d *mirror.Divergence) {
+			mu.Lock()
+			divergences = append(divergences, d)
+			mu.Unlock()
+		},
+	}
+	m := mirror.New(s.psession, s.ssession, options)
+	coll := m.C("mydb", "mycoll")
+	c.Assert(coll.Insert(doc{N: 1}, doc{N: 2}), IsNil)
+	m.Close()
+
+	m = mirror.New(s.psession, s.ssession, options)
+	coll = m.C("mydb", "mycoll")
+
+	var result []doc
+	c.Assert(coll.Find(nil).All(&result), IsNil)
+	c.Assert(result, HasLen, 2)
+	n, err := coll.Find(nil).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+	m.Close()
+
+	stats := m.Stats()
+	c.Assert(stats.ReadsCompared, Equals, int64(2))
+	c.Assert(stats.ReadsDiverged, Equals, int64(0))
+	c.Assert(divergences, HasLen, 0)
+
+	// Diverge the shadow cluster behind the mirror's back.
+	err = s.ssession.DB("mydb").C("mycoll").Insert(doc{N: 3})
+	c.Assert(err, IsNil)
+
+	m = mirror.New(s.psession, s.ssession, options)
+	coll = m.C("mydb", "mycoll")
+	var one doc
+	c.Assert(coll.Find(bson.M{"n": 3}).One(&one), Equals, mgo.ErrNotFound)
+	n, err = coll.Find(nil).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+	m.Close()
+
+	stats = m.Stats()
+	c.Assert(stats.ReadsCompared, Equals, int64(2))
+	c.Assert(stats.ReadsDiverged, Equals, int64(2))
+	c.Assert(divergences, HasLen, 2)
+}
@@ -0,0 +1,251 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ---------------------------------------------------------------------------
+// Monitoring integration.
+
+// Monitor holds callbacks that are notified of events happening inside
+// the driver, for debugging and instrumentation purposes. Any of the
+// callbacks may be nil. Callbacks may be run concurrently, and from the
+// driver's internal goroutines, before the operation they report on
+// completes, so they must be safe for concurrent use and return quickly.
+//
+// See SetMonitor.
+type Monitor struct {
+	// Route is called whenever a session selects a server and acquires
+	// a socket to it. Sessions hold on to the selected socket depending
+	// on their consistency mode (see Session.SetMode), so this is not
+	// necessarily called for every operation.
+	Route func(route *Route)
+
+	// Primary is called with the address of a server whenever it's
+	// detected as the primary of its replica set, either when it's
+	// first discovered or when it's elected. Standalone servers and
+	// mongos routers are reported once discovered. See PrewarmOnPrimary
+	// for a ready-made consumer of these events.
+	Primary func(addr string)
+
+	// Connect is called once a new connection to a server is ready for
+	// use, or failed to be established, with the time taken by each
+	// phase of establishing it.
+	Connect func(event *ConnectEvent)
+
+	// Login is called when a connection finishes authenticating with
+	// a credential, which happens when the connection is first used
+	// by a session holding that credential.
+	Login func(event *LoginEvent)
+
+	// Op is called when the reply for a query, command, or getMore
+	// operation sent to a server is received, or when the operation
+	// fails. See OpHistograms for a ready-made consumer of these events.
+	Op func(event *OpEvent)
+
+	// Shapes has the Shape field of OpEvent set for the operations
+	// that have one. Computing shapes requires inspecting the document
+	// of every operation, so it's disabled by default. See QueryShapes
+	// for a ready-made consumer of shapes.
+	Shapes bool
+
+	// Documents has the Document and Reply fields of OpEvent set, and
+	// has slow operations logged with their command document. Documents
+	// are redacted first if a redactor is set (see SetRedactor).
+	Documents bool
+
+	// SlowOpThreshold, if non-zero, has operations taking at least as
+	// long logged as slow operations via the logger set with SetLogger.
+	SlowOpThreshold time.Duration
+}
+
+// OpEvent describes a query, command, or getMore operation that was
+// sent to a server, and the outcome of it.
+type OpEvent struct {
+	Server     string        // Address of the server the operation was sent to
+	Database   string        // Database the operation ran on
+	Collection string        // Collection the operation ran on, if known
+	Command    string        // Command name, or "query" and "getMore" for the legacy operations
+	Duration   time.Duration // Time from sending the operation to receiving the full reply
+	ReplyDocs  int           // Number of documents in the reply
+	ReplyBytes int           // Total size of documents in the reply
+	Err        error         // Error that caused the operation to fail, if any
+	Shape      string        // Normalized query shape, if Monitor.Shapes is set
+	Document   bson.Raw      // Query or command document, if Monitor.Documents is set
+	Reply      bson.Raw      // First reply document, if Monitor.Documents is set
+}
+
+// ConnectEvent describes the establishment of a connection to a server,
+// split into its phases. Phases that didn't take place are zero, such as
+// the TLS handshake for connections that aren't encrypted, or the ones
+// done by a custom dialer (see DialInfo.DialServer), which are all
+// included in Dial.
+type ConnectEvent struct {
+	Server    string        // Address of the server connected to
+	DNS       time.Duration // Resolving the addresses of the server
+	Dial      time.Duration // Connecting to the server via TCP
+	TLS       time.Duration // TLS handshake, if not done while dialing
+	Handshake time.Duration // Negotiating protocol options, such as compression
+	Duration  time.Duration // Total time taken
+	Err       error         // Error that caused the connection to fail, if any
+}
+
+// LoginEvent describes the authentication of a connection to a server.
+type LoginEvent struct {
+	Server    string        // Address of the server the connection is to
+	Mechanism string        // Authentication mechanism used
+	Source    string        // Database the credential is defined in
+	Duration  time.Duration // Time taken, including all round trips
+	Err       error         // Error that caused the login to fail, if any
+}
+
+// Route records how a server was selected for running operations.
+// It's meant to help answering questions such as why a given read was
+// sent to a lagging secondary.
+type Route struct {
+	Server     string        // Address of the selected server
+	Master     bool          // Whether the server was a primary (or a mongos)
+	Mode       Mode          // Consistency mode of the session
+	SlaveOk    bool          // Whether secondaries were acceptable
+	ServerTags []bson.D      // Tag sets considered when selecting secondaries
+	Attempts   int           // Number of servers tried before succeeding
+	PoolWait   time.Duration // Time spent waiting for the per-server pool limit
+	Duration   time.Duration // Total time taken to select the server
+}
+
+var (
+	globalMonitor *Monitor
+	monitorMutex  sync.RWMutex
+)
+
+// SetMonitor sets the callbacks notified of driver events. Providing nil
+// disables monitoring.
+func SetMonitor(monitor *Monitor) {
+	monitorMutex.Lock()
+	globalMonitor = monitor
+	monitorMutex.Unlock()
+}
+
+func getMonitor() *Monitor {
+	monitorMutex.RLock()
+	monitor := globalMonitor
+	monitorMutex.RUnlock()
+	return monitor
+}
+
+// monitorOp returns a replyFunc that reports the operation described by
+// event to the monitor once its reply is complete, and then delegates to
+// replyFunc.
+func monitorOp(monitor *Monitor, event *OpEvent, replyFunc replyFunc) replyFunc {
+	started := time.Now()
+	return func(err error, reply *replyOp, docNum int, docData []byte) {
+		if docNum >= 0 {
+			event.ReplyDocs++
+			event.ReplyBytes += len(docData)
+			if docNum == 0 && monitor.Documents {
+				event.Reply = redact(docData)
+			}
+		}
+		if err != nil || reply == nil || docNum == -1 || docNum == int(reply.replyDocs)-1 {
+			event.Err = err
+			event.Duration = time.Since(started)
+			if monitor.SlowOpThreshold > 0 && event.Duration >= monitor.SlowOpThreshold {
+				var doc bson.D
+				if event.Document.Kind == 0x03 {
+					event.Document.Unmarshal(&doc)
+				}
+				if doc != nil {
+					logf("Slow operation: %s on %s.%s at %s took %v (%d documents, %d bytes): %v",
+						event.Command, event.Database, event.Collection, event.Server, event.Duration, event.ReplyDocs, event.ReplyBytes, doc)
+				} else {
+					logf("Slow operation: %s on %s.%s at %s took %v (%d documents, %d bytes)",
+						event.Command, event.Database, event.Collection, event.Server, event.Duration, event.ReplyDocs, event.ReplyBytes)
+				}
+			}
+			if monitor.Op != nil {
+				monitor.Op(event)
+			}
+		}
+		replyFunc(err, reply, docNum, docData)
+	}
+}
+
+// newOpEvent returns the event describing an operation on the namespace
+// ns. The command document is inspected for commands, to find out the
+// command name and the collection it targets.
+func newOpEvent(server, ns, command string, doc []byte) *OpEvent {
+	event := &OpEvent{Server: server, Command: command}
+	dot := strings.Index(ns, ".")
+	if dot < 0 {
+		event.Database = ns
+		return event
+	}
+	event.Database = ns[:dot]
+	event.Collection = ns[dot+1:]
+	if event.Collection == "$cmd" {
+		event.Command, event.Collection = firstElement(doc)
+		if event.Command == "getMore" {
+			var getMore struct{ Collection string }
+			bson.Unmarshal(doc, &getMore)
+			event.Collection = getMore.Collection
+		}
+	}
+	return event
+}
+
+// firstElement returns the name of the first element in the BSON
+// document doc, and its value if it's a string. Commands wrapped in
+// a $query document are unwrapped.
+func firstElement(doc []byte) (name, value string) {
+	if len(doc) < 6 {
+		return "", ""
+	}
+	kind := doc[4]
+	end := bytes.IndexByte(doc[5:], 0)
+	if end < 0 {
+		return "", ""
+	}
+	name = string(doc[5 : 5+end])
+	data := doc[5+end+1:]
+	switch {
+	case kind == 0x03 && name == "$query":
+		return firstElement(data)
+	case kind == 0x02 && len(data) > 4:
+		l := int(getInt32(data, 0))
+		if l > 0 && 4+l <= len(data) {
+			value = string(data[4 : 4+l-1])
+		}
+	}
+	return name, value
+}
@@ -0,0 +1,430 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo_test
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (s *S) TestMonitorRoute(c *C) {
+	var routes []*mgo.Route
+	mgo.SetMonitor(&mgo.Monitor{Route: func(route *mgo.Route) {
+		routes = append(routes, route)
+	}})
+	defer mgo.SetMonitor(nil)
+
+	session, err := mgo.Dial("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	routes = nil
+
+	err = session.DB("mydb").C("mycoll").Insert(M{"a": 1})
+	c.Assert(err, IsNil)
+
+	c.Assert(routes, HasLen, 1)
+	c.Assert(routes[0].Master, Equals, true)
+	c.Assert(routes[0].Mode, Equals, mgo.Strong)
+	c.Assert(routes[0].SlaveOk, Equals, false)
+	c.Assert(routes[0].Attempts, Equals, 1)
+
+	routes = nil
+
+	session.SetMode(mgo.SecondaryPreferred, true)
+	var result struct{}
+	err = session.Run("ping", &result)
+	c.Assert(err, IsNil)
+
+	// The route tells why the read was sent to a secondary.
+	c.Assert(routes, HasLen, 1)
+	c.Assert(routes[0].Mode, Equals, mgo.SecondaryPreferred)
+	c.Assert(routes[0].SlaveOk, Equals, true)
+	c.Assert(routes[0].Master, Equals, false)
+	c.Assert(routes[0].Server, Not(Equals), "")
+}
+
+func (s *S) TestMonitorPrimary(c *C) {
+	primaries := make(chan string, 10)
+	mgo.SetMonitor(&mgo.Monitor{Primary: func(addr string) {
+		primaries <- addr
+	}})
+	defer mgo.SetMonitor(nil)
+
+	session, err := mgo.Dial("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	err = session.Ping()
+	c.Assert(err, IsNil)
+
+	select {
+	case addr := <-primaries:
+		c.Assert(addr, Matches, ".*:40011")
+	case <-time.After(5 * time.Second):
+		c.Fatalf("primary not reported")
+	}
+}
+
+func (s *S) TestMonitorConnect(c *C) {
+	var m sync.Mutex
+	var connects []*mgo.ConnectEvent
+	var logins []*mgo.LoginEvent
+	mgo.SetMonitor(&mgo.Monitor{
+		Connect: func(event *mgo.ConnectEvent) {
+			m.Lock()
+			connects = append(connects, event)
+			m.Unlock()
+		},
+		Login: func(event *mgo.LoginEvent) {
+			m.Lock()
+			logins = append(logins, event)
+			m.Unlock()
+		},
+	})
+	defer mgo.SetMonitor(nil)
+
+	session, err := mgo.Dial("root:rapadura@localhost:40002")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	err = session.Ping()
+	c.Assert(err, IsNil)
+
+	m.Lock()
+	defer m.Unlock()
+	c.Assert(len(connects) > 0, Equals, true)
+	c.Assert(connects[0].Server, Equals, "localhost:40002")
+	c.Assert(connects[0].Err, IsNil)
+	c.Assert(connects[0].Dial > 0, Equals, true)
+	c.Assert(connects[0].TLS, Equals, time.Duration(0))
+	c.Assert(connects[0].Duration >= connects[0].DNS+connects[0].Dial, Equals, true)
+
+	c.Assert(len(logins) > 0, Equals, true)
+	c.Assert(logins[0].Source, Equals, "admin")
+	c.Assert(logins[0].Err, IsNil)
+	c.Assert(logins[0].Duration > 0, Equals, true)
+}
+
+func (s *S) TestMonitorConnectTLS(c *C) {
+	// The listener doesn't speak TLS, so handshakes fail.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	events := make(chan *mgo.ConnectEvent, 10)
+	mgo.SetMonitor(&mgo.Monitor{Connect: func(event *mgo.ConnectEvent) {
+		events <- event
+	}})
+	defer mgo.SetMonitor(nil)
+
+	info := &mgo.DialInfo{
+		Addrs:   []string{l.Addr().String()},
+		Direct:  true,
+		Timeout: 500 * time.Millisecond,
+		DialServer: func(addr *mgo.ServerAddr) (net.Conn, error) {
+			conn, err := net.Dial("tcp", addr.String())
+			if err != nil {
+				return nil, err
+			}
+			return tls.Client(conn, &tls.Config{InsecureSkipVerify: true}), nil
+		},
+	}
+	_, err = mgo.DialWithInfo(info)
+	c.Assert(err, NotNil)
+
+	event := <-events
+	c.Assert(event.Server, Equals, l.Addr().String())
+	c.Assert(event.Err, NotNil)
+	c.Assert(event.TLS > 0, Equals, true)
+	c.Assert(event.Handshake, Equals, time.Duration(0))
+}
+
+func (s *S) TestMonitorOps(c *C) {
+	var events []*mgo.OpEvent
+	mgo.SetMonitor(&mgo.Monitor{Op: func(event *mgo.OpEvent) {
+		events = append(events, event)
+	}})
+	defer mgo.SetMonitor(nil)
+
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.Insert(M{"a": 1}, M{"a": 2}, M{"a": 3})
+	c.Assert(err, IsNil)
+
+	events = nil
+
+	var result []M
+	err = coll.Find(nil).Batch(2).All(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result, HasLen, 3)
+
+	c.Assert(len(events) >= 2, Equals, true)
+	for _, event := range events {
+		c.Assert(event.Database, Equals, "mydb")
+		c.Assert(event.Collection, Equals, "mycoll")
+		c.Assert(event.Err, IsNil)
+		c.Assert(event.Duration > 0, Equals, true)
+		c.Assert(event.ReplyBytes > 0, Equals, true)
+	}
+	if s.versionAtLeast(3, 2) {
+		c.Assert(events[0].Command, Equals, "find")
+		c.Assert(events[1].Command, Equals, "getMore")
+	} else {
+		c.Assert(events[0].Command, Equals, "query")
+		c.Assert(events[1].Command, Equals, "getMore")
+	}
+
+	events = nil
+
+	err = session.DB("mydb").Run("ping", nil)
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 1)
+	c.Assert(events[0].Command, Equals, "ping")
+	c.Assert(events[0].Collection, Equals, "")
+}
+
+func (s *S) TestMonitorSlowOps(c *C) {
+	mgo.SetMonitor(&mgo.Monitor{SlowOpThreshold: time.Nanosecond})
+	defer mgo.SetMonitor(nil)
+
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	err = session.DB("mydb").Run("ping", nil)
+	c.Assert(err, IsNil)
+	c.Assert(c.GetTestLog(), Matches, "(?s).*Slow operation: ping on mydb\\. at .* took .*")
+}
+
+func (s *S) TestRedactors(c *C) {
+	data, err := bson.Marshal(bson.D{
+		{"find", "users"},
+		{"filter", bson.D{{"status", "active"}, {"email", "joe@example.com"}}},
+		{"limit", 10},
+	})
+	c.Assert(err, IsNil)
+
+	var doc bson.D
+	err = bson.Unmarshal(mgo.RedactValues.Redact(data), &doc)
+	c.Assert(err, IsNil)
+	c.Assert(doc, DeepEquals, bson.D{
+		{"find", "<redacted>"},
+		{"filter", bson.D{{"status", "<redacted>"}, {"email", "<redacted>"}}},
+		{"limit", "<redacted>"},
+	})
+
+	err = bson.Unmarshal(mgo.AllowFields("find", "filter.status").Redact(data), &doc)
+	c.Assert(err, IsNil)
+	c.Assert(doc, DeepEquals, bson.D{
+		{"find", "users"},
+		{"filter", bson.D{{"status", "active"}, {"email", "<redacted>"}}},
+		{"limit", "<redacted>"},
+	})
+
+	doc = nil
+	err = bson.Unmarshal(mgo.RedactAll.Redact(data), &doc)
+	c.Assert(err, IsNil)
+	c.Assert(doc, HasLen, 0)
+}
+
+func (s *S) TestMonitorDocuments(c *C) {
+	var events []*mgo.OpEvent
+	mgo.SetMonitor(&mgo.Monitor{Documents: true, Op: func(event *mgo.OpEvent) {
+		events = append(events, event)
+	}})
+	defer mgo.SetMonitor(nil)
+	mgo.SetRedactor(mgo.AllowFields("ping"))
+	defer mgo.SetRedactor(nil)
+
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	events = nil
+	err = session.DB("mydb").Run(bson.D{{"ping", 1}, {"comment", "secret"}}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 1)
+
+	var doc bson.M
+	err = events[0].Document.Unmarshal(&doc)
+	c.Assert(err, IsNil)
+	c.Assert(doc["ping"], Equals, 1)
+	c.Assert(doc["comment"], Equals, "<redacted>")
+
+	err = events[0].Reply.Unmarshal(&doc)
+	c.Assert(err, IsNil)
+	c.Assert(doc["ok"], Equals, "<redacted>")
+}
+
+func (s *S) TestOpHistograms(c *C) {
+	histograms := mgo.NewOpHistograms()
+	histograms.Observe(&mgo.OpEvent{Database: "db", Collection: "c", Duration: 50 * time.Microsecond, ReplyBytes: 100})
+	histograms.Observe(&mgo.OpEvent{Database: "db", Collection: "c", Duration: 150 * time.Microsecond, ReplyBytes: 300})
+	histograms.Observe(&mgo.OpEvent{Database: "db", Collection: "c", Duration: time.Hour, ReplyBytes: 1 << 30, Err: mgo.ErrNotFound})
+	histograms.Observe(&mgo.OpEvent{Database: "db", Duration: time.Millisecond})
+
+	snapshot := histograms.Snapshot()
+	c.Assert(snapshot, HasLen, 2)
+
+	stats := snapshot["db.c"]
+	c.Assert(stats.Errors, Equals, int64(1))
+	c.Assert(stats.Latency.Count, Equals, int64(3))
+	c.Assert(stats.Latency.Counts[0], Equals, int64(1))
+	c.Assert(stats.Latency.Counts[1], Equals, int64(1))
+	c.Assert(stats.Latency.Counts[len(stats.Latency.Counts)-1], Equals, int64(1))
+	c.Assert(stats.ReplyBytes.Counts[0], Equals, int64(1))
+	c.Assert(stats.ReplyBytes.Counts[1], Equals, int64(1))
+	c.Assert(stats.ReplyBytes.Sum, Equals, int64(100+300+1<<30))
+
+	c.Assert(snapshot["db."].Latency.Count, Equals, int64(1))
+
+	histograms.Reset()
+	c.Assert(histograms.Snapshot(), HasLen, 0)
+}
+
+func (s *S) TestQueryShape(c *C) {
+	tests := []struct {
+		command string
+		doc     interface{}
+		shape   string
+	}{{
+		"find",
+		bson.D{{"find", "c"}, {"filter", bson.D{{"name", "Bob"}, {"age", M{"$gt": 30}}}}, {"sort", bson.D{{"age", -1}}}},
+		"find {name: ?, age: {$gt: ?}} sort {age: -1}",
+	}, {
+		"find",
+		bson.D{{"find", "c"}, {"filter", bson.D{{"$or", []M{{"a": 1}, {"b": "x"}}}, {"c", M{"$in": []int{1, 2, 3}}}}}, {"projection", M{"a": 1}}},
+		"find {$or: [{a: ?}, {b: ?}], c: {$in: ?}} project {a: 1}",
+	}, {
+		"find",
+		bson.D{{"$query", bson.D{{"find", "c"}, {"filter", M{"a": 1}}}}, {"$readPreference", M{"mode": "secondary"}}},
+		"find {a: ?}",
+	}, {
+		"query",
+		bson.D{{"a", 1}, {"b", "x"}},
+		"query {a: ?, b: ?}",
+	}, {
+		"query",
+		bson.D{{"$query", M{"a": 1}}, {"$orderby", M{"b": 1}}},
+		"query {a: ?} sort {b: 1}",
+	}, {
+		"count",
+		bson.D{{"count", "c"}, {"query", M{"a": true}}},
+		"count {a: ?}",
+	}, {
+		"distinct",
+		bson.D{{"distinct", "c"}, {"key", "name"}, {"query", M{"a": 1}}},
+		"distinct key name {a: ?}",
+	}, {
+		"aggregate",
+		bson.D{{"aggregate", "c"}, {"pipeline", []bson.D{{{"$match", M{"a": "x"}}}, {{"$group", bson.D{{"_id", "$b"}, {"n", M{"$sum": 1}}}}}}}},
+		"aggregate [{$match: {a: ?}}, {$group: {_id: $b, n: {$sum: ?}}}]",
+	}, {
+		"ping",
+		bson.D{{"ping", 1}},
+		"",
+	}}
+	for _, test := range tests {
+		c.Logf("Testing %#v", test.doc)
+		c.Assert(mgo.QueryShape(test.command, test.doc), Equals, test.shape)
+	}
+}
+
+func (s *S) TestQueryShapes(c *C) {
+	shapes := mgo.NewQueryShapes(2)
+	observe := func(coll, shape string, d time.Duration) {
+		shapes.Observe(&mgo.OpEvent{Database: "db", Collection: coll, Shape: shape, Duration: d, ReplyDocs: 1})
+	}
+	for i := 0; i < 3; i++ {
+		observe("c", "find {a: ?}", time.Millisecond)
+	}
+	observe("c", "find {b: ?}", time.Second)
+	observe("c", "find {c: ?}", time.Second)
+	observe("d", "count {a: ?}", time.Millisecond)
+	observe("d", "", time.Millisecond)
+
+	top := shapes.Top(0, mgo.ShapesByCount)
+	c.Assert(top, HasLen, 2)
+	c.Assert(top["db.c"], DeepEquals, []mgo.ShapeStats{
+		{Shape: "find {a: ?}", Count: 3, Duration: 3 * time.Millisecond, Max: time.Millisecond, Docs: 3},
+		{Shape: "find {b: ?}", Count: 1, Duration: time.Second, Max: time.Second, Docs: 1},
+	})
+	c.Assert(top["db.d"], HasLen, 1)
+	c.Assert(shapes.Dropped(), Equals, int64(1))
+
+	top = shapes.Top(1, mgo.ShapesByDuration)
+	c.Assert(top["db.c"], HasLen, 1)
+	c.Assert(top["db.c"][0].Shape, Equals, "find {b: ?}")
+
+	shapes.Reset()
+	c.Assert(shapes.Top(0, mgo.ShapesByCount), HasLen, 0)
+	c.Assert(shapes.Dropped(), Equals, int64(0))
+}
+
+func (s *S) TestMonitorShapes(c *C) {
+	shapes := mgo.NewQueryShapes(0)
+	mgo.SetMonitor(&mgo.Monitor{Op: shapes.Observe, Shapes: true})
+	defer mgo.SetMonitor(nil)
+
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	for i := 0; i < 3; i++ {
+		err = coll.Find(M{"a": i}).One(nil)
+		c.Assert(err, Equals, mgo.ErrNotFound)
+	}
+
+	top := shapes.Top(1, mgo.ShapesByCount)["mydb.mycoll"]
+	c.Assert(top, HasLen, 1)
+	c.Assert(top[0].Count, Equals, int64(3))
+	if s.versionAtLeast(3, 2) {
+		c.Assert(top[0].Shape, Equals, "find {a: ?}")
+	} else {
+		c.Assert(top[0].Shape, Equals, "query {a: ?}")
+	}
+}
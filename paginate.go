@@ -0,0 +1,220 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrPageToken is returned by Query.Paginate when the provided token is
+// malformed, or was obtained from a query with a different sort order.
+var ErrPageToken = errors.New("invalid page token")
+
+// Paginate retrieves into the slice pointed to by result the page of up
+// to n documents of the query that follows the position encoded in token,
+// and returns the token to obtain the page after it. An empty token
+// retrieves the first page, and an empty next token is returned once the
+// last page is reached.
+//
+// Rather than skipping over the documents of earlier pages, which gets
+// slower with every page and shifts results around when documents are
+// inserted or removed concurrently, tokens hold the sort key values of
+// the last document of a page, and the next page is found by querying
+// for documents sorted after it. This is known as keyset or seek
+// pagination, and scales well as long as an index supports the sort:
+//
+//     query := collection.Find(bson.M{"status": "active"}).Sort("-created")
+//     next, err := query.Paginate(token, 20, &items)
+//
+// The sort order defined with Query.Sort is extended with the _id field,
+// if missing, so that the order is total, and it defaults to sorting by
+// _id alone. Sort fields should be present in all documents, and must
+// not be sorted by text score. Tokens are opaque URL-safe strings that
+// may be handed to clients, and are only valid for queries with the same
+// sort order as the query they were obtained from.
+func (q *Query) Paginate(token string, n int, result interface{}) (next string, err error) {
+	if n <= 0 {
+		return "", errors.New("Paginate page size must be positive")
+	}
+	q.m.Lock()
+	page := &Query{session: q.session, query: q.query}
+	q.m.Unlock()
+
+	order, err := pageOrder(page.op.options.OrderBy)
+	if err != nil {
+		return "", err
+	}
+	if token != "" {
+		values, err := decodePageToken(token, order)
+		if err != nil {
+			return "", err
+		}
+		filter := bson.D{{"$or", pageFilter(order, values)}}
+		if page.op.query != nil {
+			page.op.query = bson.D{{"$and", []interface{}{page.op.query, filter}}}
+		} else {
+			page.op.query = filter
+		}
+	}
+	page.op.options.OrderBy = order
+	page.op.hasOptions = true
+	page.Limit(n + 1)
+
+	var docs []bson.Raw
+	if err := page.All(&docs); err != nil {
+		return "", err
+	}
+	if len(docs) > n {
+		docs = docs[:n]
+		if next, err = encodePageToken(order, docs[n-1]); err != nil {
+			return "", err
+		}
+	}
+
+	resultv := reflect.ValueOf(result)
+	if resultv.Kind() != reflect.Ptr || resultv.Elem().Kind() != reflect.Slice {
+		panic("result argument must be a slice address")
+	}
+	slicev := reflect.MakeSlice(resultv.Elem().Type(), len(docs), len(docs))
+	for i, doc := range docs {
+		if err := doc.Unmarshal(slicev.Index(i).Addr().Interface()); err != nil {
+			return "", err
+		}
+	}
+	resultv.Elem().Set(slicev)
+	return next, nil
+}
+
+// pageOrder returns the sort order of a paginated query, defined by the
+// query's orderBy option and extended with the _id field.
+func pageOrder(orderBy interface{}) (bson.D, error) {
+	var order bson.D
+	if orderBy != nil {
+		var ok bool
+		if order, ok = orderBy.(bson.D); !ok {
+			return nil, fmt.Errorf("Paginate cannot use sort order %#v", orderBy)
+		}
+	}
+	hasId := false
+	for _, elem := range order {
+		if n, ok := elem.Value.(int); !ok || n != 1 && n != -1 {
+			return nil, fmt.Errorf("Paginate cannot sort by %s: %#v", elem.Name, elem.Value)
+		}
+		hasId = hasId || elem.Name == "_id"
+	}
+	if !hasId {
+		order = append(order[:len(order):len(order)], bson.DocElem{"_id", 1})
+	}
+	return order, nil
+}
+
+// pageFilter returns the conditions matching documents that are sorted
+// after the ones with the provided sort key values.
+func pageFilter(order bson.D, values []bson.Raw) []bson.D {
+	or := make([]bson.D, len(order))
+	for i, elem := range order {
+		cond := make(bson.D, 0, i+1)
+		for j := 0; j < i; j++ {
+			cond = append(cond, bson.DocElem{order[j].Name, values[j]})
+		}
+		op := "$gt"
+		if elem.Value.(int) < 0 {
+			op = "$lt"
+		}
+		or[i] = append(cond, bson.DocElem{elem.Name, bson.D{{op, values[i]}}})
+	}
+	return or
+}
+
+type pageToken struct {
+	Order  bson.Raw   `bson:"o"`
+	Values []bson.Raw `bson:"v"`
+}
+
+// encodePageToken returns the token encoding the values doc holds for
+// the fields in order.
+func encodePageToken(order bson.D, doc bson.Raw) (string, error) {
+	token := pageToken{Values: make([]bson.Raw, len(order))}
+	for i, elem := range order {
+		token.Values[i] = lookupPath(doc, elem.Name)
+	}
+	token.Order = bson.Raw{0x03, nil}
+	var err error
+	if token.Order.Data, err = bson.Marshal(order); err != nil {
+		return "", err
+	}
+	data, err := bson.Marshal(&token)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodePageToken returns the sort key values encoded in token, which
+// must have been obtained with the same order.
+func decodePageToken(token string, order bson.D) ([]bson.Raw, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrPageToken
+	}
+	var t pageToken
+	if bson.Unmarshal(data, &t) != nil || len(t.Values) != len(order) {
+		return nil, ErrPageToken
+	}
+	orderData, err := bson.Marshal(order)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(t.Order.Data, orderData) {
+		return nil, ErrPageToken
+	}
+	return t.Values, nil
+}
+
+// lookupPath returns the value at the dotted path in doc, or null if
+// the path is missing.
+func lookupPath(doc bson.Raw, path string) bson.Raw {
+	for _, name := range strings.Split(path, ".") {
+		if doc.Kind != 0x03 {
+			return bson.Raw{0x0A, nil}
+		}
+		fields, err := bson.Fields(doc.Data, name)
+		value, ok := fields[name]
+		if err != nil || !ok {
+			return bson.Raw{0x0A, nil}
+		}
+		doc = value
+	}
+	return doc
+}
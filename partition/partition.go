@@ -0,0 +1,624 @@
+// The partition package spreads a logical collection over several
+// physical collections, routing each document by a hash of the value
+// of a key field. This helps with collections that outgrew a single
+// collection's write throughput or index size, before moving them to
+// a sharded cluster.
+//
+// Operations whose selector holds an equality condition on the key
+// are routed to the one partition that may hold the matching documents.
+// Other reads are scattered to all partitions, and their results are
+// gathered and merged:
+//
+//     users := partition.New(session.DB("app"), "users", "email", 8)
+//     err := users.Insert(bson.M{"email": "ann@example.com", "age": 42})
+//     ...
+//     err = users.Find(bson.M{"email": "ann@example.com"}).One(&user)  // One partition.
+//     err = users.Find(bson.M{"age": 42}).Sort("-created").All(&users) // All partitions.
+//
+// Documents are placed by the value their key holds when inserted. The
+// key must be a top-level field that is present in every document, and
+// updates must never change it.
+//
+package partition
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrNoKey is returned by operations that must be routed to a single
+// partition when their document or selector lacks the key.
+var ErrNoKey = errors.New("partition key not found")
+
+// Collection routes operations on a logical collection to one of its
+// partitions.
+type Collection struct {
+	Name  string // Name of the logical collection
+	Key   string // Name of the top-level field routing documents
+	parts []*mgo.Collection
+}
+
+// New returns a logical collection with the given name that is spread
+// over n physical collections in db, named "<name>_0" to "<name>_<n-1>".
+// The number of partitions must not change once documents are stored,
+// as that moves the partition most keys are routed to.
+func New(db *mgo.Database, name, key string, n int) *Collection {
+	if n < 1 {
+		panic("partition: a collection must have at least one partition")
+	}
+	c := &Collection{Name: name, Key: key, parts: make([]*mgo.Collection, n)}
+	for i := range c.parts {
+		c.parts[i] = db.C(fmt.Sprintf("%s_%d", name, i))
+	}
+	return c
+}
+
+// With returns a copy of c that uses session s.
+func (c *Collection) With(s *mgo.Session) *Collection {
+	parts := make([]*mgo.Collection, len(c.parts))
+	for i, part := range c.parts {
+		parts[i] = part.With(s)
+	}
+	return &Collection{Name: c.Name, Key: c.Key, parts: parts}
+}
+
+// Partitions returns the physical collections of c, for administrative
+// operations that aren't covered by Collection itself.
+func (c *Collection) Partitions() []*mgo.Collection {
+	return c.parts
+}
+
+// Partition returns the physical collection holding documents with the
+// provided key value.
+func (c *Collection) Partition(key interface{}) (*mgo.Collection, error) {
+	data, err := bson.Marshal(bson.D{{"k", key}})
+	if err != nil {
+		return nil, err
+	}
+	fields, err := bson.Fields(data, "k")
+	if err != nil {
+		return nil, err
+	}
+	return c.parts[partitionOf(fields["k"], len(c.parts))], nil
+}
+
+// partitionOf returns the partition out of n that the key value belongs
+// to. Numbers holding integral values are hashed alike regardless of
+// their BSON type, as the server matches them to each other.
+func partitionOf(key bson.Raw, n int) int {
+	h := fnv.New32a()
+	switch key.Kind {
+	case 0x01:
+		f := math.Float64frombits(binary.LittleEndian.Uint64(key.Data))
+		if f != math.Trunc(f) || f < -(1<<63) || f >= 1<<63 {
+			h.Write([]byte{key.Kind})
+			h.Write(key.Data)
+			break
+		}
+		writeInt64(h, int64(f))
+	case 0x10:
+		writeInt64(h, int64(int32(binary.LittleEndian.Uint32(key.Data))))
+	case 0x12:
+		writeInt64(h, int64(binary.LittleEndian.Uint64(key.Data)))
+	default:
+		h.Write([]byte{key.Kind})
+		h.Write(key.Data)
+	}
+	return int(h.Sum32() % uint32(n))
+}
+
+func writeInt64(w io.Writer, i int64) {
+	var buf [9]byte
+	buf[0] = 0x12
+	binary.LittleEndian.PutUint64(buf[1:], uint64(i))
+	w.Write(buf[:])
+}
+
+// route returns the partition targeted by the equality condition on
+// the key that selector holds, or nil if it holds no such condition.
+func (c *Collection) route(selector interface{}) (*mgo.Collection, error) {
+	if selector == nil {
+		return nil, nil
+	}
+	data, err := bson.Marshal(selector)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := bson.Fields(data, c.Key)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := fields[c.Key]
+	if !ok {
+		return nil, nil
+	}
+	if key.Kind == 0x03 {
+		var cond bson.RawD
+		if err := key.Unmarshal(&cond); err != nil {
+			return nil, err
+		}
+		if len(cond) > 0 && strings.HasPrefix(cond[0].Name, "$") {
+			if len(cond) != 1 || cond[0].Name != "$eq" {
+				return nil, nil
+			}
+			key = cond[0].Value
+		}
+	}
+	if key.Kind == 0x04 || key.Kind == 0x0B {
+		// Arrays and regular expressions match many values.
+		return nil, nil
+	}
+	return c.parts[partitionOf(key, len(c.parts))], nil
+}
+
+// each runs f on every partition concurrently, and returns the first
+// error reported by any of them.
+func (c *Collection) each(f func(i int, part *mgo.Collection) error) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(c.parts))
+	for i, part := range c.parts {
+		wg.Add(1)
+		go func(i int, part *mgo.Collection) {
+			defer wg.Done()
+			errs[i] = f(i, part)
+		}(i, part)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Insert inserts the provided documents into their partitions. Each
+// document must hold the key. Documents routed to the same partition
+// are inserted together.
+func (c *Collection) Insert(docs ...interface{}) error {
+	batches := make([][]interface{}, len(c.parts))
+	for _, doc := range docs {
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		fields, err := bson.Fields(data, c.Key)
+		if err != nil {
+			return err
+		}
+		key, ok := fields[c.Key]
+		if !ok {
+			return ErrNoKey
+		}
+		i := partitionOf(key, len(c.parts))
+		batches[i] = append(batches[i], bson.Raw{0x03, data})
+	}
+	return c.each(func(i int, part *mgo.Collection) error {
+		if len(batches[i]) == 0 {
+			return nil
+		}
+		return part.Insert(batches[i]...)
+	})
+}
+
+// Update finds a single document matching selector and modifies it
+// according to update. If selector doesn't target a single partition,
+// partitions are tried in turn until one of them holds a matching
+// document. If no document matches, ErrNotFound is returned.
+func (c *Collection) Update(selector interface{}, update interface{}) error {
+	part, err := c.route(selector)
+	if err != nil {
+		return err
+	}
+	if part != nil {
+		return part.Update(selector, update)
+	}
+	for _, part := range c.parts {
+		err := part.Update(selector, update)
+		if err != mgo.ErrNotFound {
+			return err
+		}
+	}
+	return mgo.ErrNotFound
+}
+
+// UpdateAll modifies all documents matching selector in every partition
+// that may hold them, and reports the totals of all partitions.
+func (c *Collection) UpdateAll(selector interface{}, update interface{}) (info *mgo.ChangeInfo, err error) {
+	return c.all(selector, func(part *mgo.Collection) (*mgo.ChangeInfo, error) {
+		return part.UpdateAll(selector, update)
+	})
+}
+
+// Upsert works like mgo.Collection.Upsert on the partition targeted by
+// selector, which must hold an equality condition on the key so that
+// inserted documents land in the right partition.
+func (c *Collection) Upsert(selector interface{}, update interface{}) (info *mgo.ChangeInfo, err error) {
+	part, err := c.route(selector)
+	if err != nil {
+		return nil, err
+	}
+	if part == nil {
+		return nil, ErrNoKey
+	}
+	return part.Upsert(selector, update)
+}
+
+// Remove finds a single document matching selector and removes it.
+// Partitions are tried as documented in Update.
+func (c *Collection) Remove(selector interface{}) error {
+	part, err := c.route(selector)
+	if err != nil {
+		return err
+	}
+	if part != nil {
+		return part.Remove(selector)
+	}
+	for _, part := range c.parts {
+		err := part.Remove(selector)
+		if err != mgo.ErrNotFound {
+			return err
+		}
+	}
+	return mgo.ErrNotFound
+}
+
+// RemoveAll removes all documents matching selector in every partition
+// that may hold them, and reports the totals of all partitions.
+func (c *Collection) RemoveAll(selector interface{}) (info *mgo.ChangeInfo, err error) {
+	return c.all(selector, func(part *mgo.Collection) (*mgo.ChangeInfo, error) {
+		return part.RemoveAll(selector)
+	})
+}
+
+func (c *Collection) all(selector interface{}, f func(part *mgo.Collection) (*mgo.ChangeInfo, error)) (*mgo.ChangeInfo, error) {
+	part, err := c.route(selector)
+	if err != nil {
+		return nil, err
+	}
+	if part != nil {
+		return f(part)
+	}
+	infos := make([]*mgo.ChangeInfo, len(c.parts))
+	err = c.each(func(i int, part *mgo.Collection) (err error) {
+		infos[i], err = f(part)
+		return err
+	})
+	total := &mgo.ChangeInfo{}
+	for _, info := range infos {
+		if info != nil {
+			total.Updated += info.Updated
+			total.Removed += info.Removed
+			total.Matched += info.Matched
+		}
+	}
+	return total, err
+}
+
+// EnsureIndex ensures index exists on every partition.
+func (c *Collection) EnsureIndex(index mgo.Index) error {
+	return c.each(func(i int, part *mgo.Collection) error {
+		return part.EnsureIndex(index)
+	})
+}
+
+// DropCollection removes every partition along with their documents
+// and indexes. Partitions that don't exist are ignored.
+func (c *Collection) DropCollection() error {
+	return c.each(func(i int, part *mgo.Collection) error {
+		err := part.DropCollection()
+		if e, ok := err.(*mgo.QueryError); ok && e.Message == "ns not found" {
+			return nil
+		}
+		return err
+	})
+}
+
+// Find prepares a query on the logical collection. The query is run on
+// a single partition if it holds an equality condition on the key, and
+// on every partition otherwise.
+func (c *Collection) Find(query interface{}) *Query {
+	return &Query{c: c, query: query}
+}
+
+// Query holds a query on a partitioned collection. Queries run on all
+// partitions fetch up to the limit of documents from each partition,
+// and then sort and trim the gathered documents.
+type Query struct {
+	c     *Collection
+	query interface{}
+	sort  []string
+	limit int
+}
+
+// Sort asks the results to be ordered by the provided fields, as done
+// by mgo.Query.Sort. When gathering results from several partitions,
+// only top-level fields may be sorted on.
+func (q *Query) Sort(fields ...string) *Query {
+	q.sort = fields
+	return q
+}
+
+// Limit restricts the maximum number of documents retrieved to n.
+func (q *Query) Limit(n int) *Query {
+	q.limit = n
+	return q
+}
+
+func (q *Query) on(part *mgo.Collection) *mgo.Query {
+	mq := part.Find(q.query)
+	if len(q.sort) > 0 {
+		mq.Sort(q.sort...)
+	}
+	if q.limit > 0 {
+		mq.Limit(q.limit)
+	}
+	return mq
+}
+
+// One executes the query and unmarshals the first obtained document into
+// result. If no documents match, ErrNotFound is returned.
+func (q *Query) One(result interface{}) error {
+	part, err := q.c.route(q.query)
+	if err != nil {
+		return err
+	}
+	if part != nil {
+		return q.on(part).One(result)
+	}
+	limit := q.limit
+	q.limit = 1
+	docs, err := q.gather()
+	q.limit = limit
+	if err != nil {
+		return err
+	}
+	if len(docs) == 0 {
+		return mgo.ErrNotFound
+	}
+	if result == nil {
+		return nil
+	}
+	return docs[0].Unmarshal(result)
+}
+
+// All executes the query and unmarshals all obtained documents into the
+// slice pointed to by result.
+func (q *Query) All(result interface{}) error {
+	part, err := q.c.route(q.query)
+	if err != nil {
+		return err
+	}
+	if part != nil {
+		return q.on(part).All(result)
+	}
+	docs, err := q.gather()
+	if err != nil {
+		return err
+	}
+	resultv := reflect.ValueOf(result)
+	if resultv.Kind() != reflect.Ptr || resultv.Elem().Kind() != reflect.Slice {
+		panic("result argument must be a slice address")
+	}
+	slicev := reflect.MakeSlice(resultv.Elem().Type(), len(docs), len(docs))
+	for i, doc := range docs {
+		if err := doc.Unmarshal(slicev.Index(i).Addr().Interface()); err != nil {
+			return err
+		}
+	}
+	resultv.Elem().Set(slicev)
+	return nil
+}
+
+// Count returns the total number of documents that the query would
+// return from all partitions it runs on.
+func (q *Query) Count() (n int, err error) {
+	part, err := q.c.route(q.query)
+	if err != nil {
+		return 0, err
+	}
+	if part != nil {
+		return q.on(part).Count()
+	}
+	counts := make([]int, len(q.c.parts))
+	err = q.c.each(func(i int, part *mgo.Collection) (err error) {
+		counts[i], err = q.on(part).Count()
+		return err
+	})
+	for _, count := range counts {
+		n += count
+	}
+	return n, err
+}
+
+// gather runs the query on all partitions and returns the documents
+// obtained, sorted and limited as requested.
+func (q *Query) gather() ([]bson.Raw, error) {
+	results := make([][]bson.Raw, len(q.c.parts))
+	err := q.c.each(func(i int, part *mgo.Collection) error {
+		return q.on(part).All(&results[i])
+	})
+	if err != nil {
+		return nil, err
+	}
+	var docs []bson.Raw
+	for _, result := range results {
+		docs = append(docs, result...)
+	}
+	if len(q.sort) > 0 {
+		if err := sortDocs(docs, q.sort); err != nil {
+			return nil, err
+		}
+	}
+	if q.limit > 0 && len(docs) > q.limit {
+		docs = docs[:q.limit]
+	}
+	return docs, nil
+}
+
+// sortDocs sorts docs by the provided sort fields, in the format taken
+// by mgo.Query.Sort.
+func sortDocs(docs []bson.Raw, fields []string) error {
+	names := make([]string, len(fields))
+	order := make([]int, len(fields))
+	for i, field := range fields {
+		order[i] = 1
+		switch field[0] {
+		case '+':
+			field = field[1:]
+		case '-':
+			order[i] = -1
+			field = field[1:]
+		}
+		if field == "" || strings.ContainsAny(field, ".$") {
+			return fmt.Errorf("partition: cannot sort results of several partitions by %q", fields[i])
+		}
+		names[i] = field
+	}
+	keys := make([]map[string]bson.Raw, len(docs))
+	for i, doc := range docs {
+		var err error
+		if keys[i], err = bson.Fields(doc.Data, names...); err != nil {
+			return err
+		}
+	}
+	sort.Stable(docSorter{docs, keys, names, order})
+	return nil
+}
+
+type docSorter struct {
+	docs  []bson.Raw
+	keys  []map[string]bson.Raw
+	names []string
+	order []int
+}
+
+func (s docSorter) Len() int { return len(s.docs) }
+
+func (s docSorter) Swap(i, j int) {
+	s.docs[i], s.docs[j] = s.docs[j], s.docs[i]
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+}
+
+func (s docSorter) Less(i, j int) bool {
+	for k, name := range s.names {
+		if c := compareValues(s.keys[i][name], s.keys[j][name]); c != 0 {
+			return c*s.order[k] < 0
+		}
+	}
+	return false
+}
+
+// typeOrder returns the position of kind in the order the server sorts
+// values of distinct BSON types by. Missing values sort as null.
+func typeOrder(kind byte) int {
+	switch kind {
+	case 0xFF: // MinKey
+		return 0
+	case 0x00, 0x06, 0x0A: // Missing, undefined, null
+		return 1
+	case 0x01, 0x10, 0x12, 0x13: // Numbers
+		return 2
+	case 0x02, 0x0E: // Strings and symbols
+		return 3
+	case 0x03:
+		return 4
+	case 0x04:
+		return 5
+	case 0x05:
+		return 6
+	case 0x07:
+		return 7
+	case 0x08:
+		return 8
+	case 0x09:
+		return 9
+	case 0x11:
+		return 10
+	case 0x0B:
+		return 11
+	case 0x7F: // MaxKey
+		return 13
+	}
+	return 12
+}
+
+// compareValues returns -1, 0, or 1 depending on whether a sorts before,
+// alongside, or after b.
+func compareValues(a, b bson.Raw) int {
+	ta, tb := typeOrder(a.Kind), typeOrder(b.Kind)
+	if ta != tb {
+		if ta < tb {
+			return -1
+		}
+		return 1
+	}
+	switch ta {
+	case 2:
+		fa, fb := number(a), number(b)
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	case 3:
+		var sa, sb string
+		a.Unmarshal(&sa)
+		b.Unmarshal(&sb)
+		return strings.Compare(sa, sb)
+	case 8:
+		return int(a.Data[0]) - int(b.Data[0])
+	case 9:
+		return compareInt64(int64(binary.LittleEndian.Uint64(a.Data)), int64(binary.LittleEndian.Uint64(b.Data)))
+	case 10:
+		ta, tb := binary.LittleEndian.Uint64(a.Data), binary.LittleEndian.Uint64(b.Data)
+		switch {
+		case ta < tb:
+			return -1
+		case ta > tb:
+			return 1
+		}
+		return 0
+	}
+	return bytes.Compare(a.Data, b.Data)
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func number(v bson.Raw) float64 {
+	switch v.Kind {
+	case 0x01:
+		return math.Float64frombits(binary.LittleEndian.Uint64(v.Data))
+	case 0x10:
+		return float64(int32(binary.LittleEndian.Uint32(v.Data)))
+	case 0x12:
+		return float64(int64(binary.LittleEndian.Uint64(v.Data)))
+	}
+	var d bson.Decimal128
+	v.Unmarshal(&d)
+	f, _ := strconv.ParseFloat(d.String(), 64)
+	return f
+}
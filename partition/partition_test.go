@@ -0,0 +1,226 @@
+package partition
+
+import (
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/dbtest"
+)
+
+func TestAll(t *testing.T) {
+	TestingT(t)
+}
+
+type RoutingSuite struct{}
+
+var _ = Suite(&RoutingSuite{})
+
+func (s *RoutingSuite) TestPartitionNames(c *C) {
+	coll := New((&mgo.Session{}).DB("app"), "users", "email", 3)
+	c.Assert(coll.Partitions(), HasLen, 3)
+	c.Assert(coll.Partitions()[0].FullName, Equals, "app.users_0")
+	c.Assert(coll.Partitions()[2].FullName, Equals, "app.users_2")
+}
+
+func (s *RoutingSuite) TestNumericKeys(c *C) {
+	coll := New((&mgo.Session{}).DB("app"), "c", "k", 16)
+	for i := 0; i < 100; i++ {
+		want, err := coll.Partition(i)
+		c.Assert(err, IsNil)
+		for _, key := range []interface{}{int32(i), int64(i), float64(i)} {
+			part, err := coll.Partition(key)
+			c.Assert(err, IsNil)
+			c.Assert(part, Equals, want, Commentf("Key %#v", key))
+		}
+	}
+}
+
+func (s *RoutingSuite) TestRoute(c *C) {
+	coll := New((&mgo.Session{}).DB("app"), "c", "k", 16)
+	target, err := coll.Partition("a")
+	c.Assert(err, IsNil)
+
+	tests := []struct {
+		selector interface{}
+		targeted bool
+	}{
+		{nil, false},
+		{bson.M{"k": "a"}, true},
+		{bson.D{{"x", 1}, {"k", "a"}}, true},
+		{bson.M{"k": bson.M{"$eq": "a"}}, true},
+		{bson.M{"k": bson.M{"$in": []string{"a"}}}, false},
+		{bson.M{"k": bson.M{"$gt": "a"}}, false},
+		{bson.M{"k": bson.RegEx{Pattern: "a"}}, false},
+		{bson.M{"x": "a"}, false},
+	}
+	for _, test := range tests {
+		part, err := coll.route(test.selector)
+		c.Assert(err, IsNil)
+		if test.targeted {
+			c.Assert(part, Equals, target, Commentf("Selector %#v", test.selector))
+		} else {
+			c.Assert(part, IsNil, Commentf("Selector %#v", test.selector))
+		}
+	}
+}
+
+func (s *RoutingSuite) TestSortDocs(c *C) {
+	var docs []bson.Raw
+	for _, doc := range []bson.M{
+		{"n": 2, "s": "b"},
+		{"n": 1.5, "s": "a"},
+		{"n": int64(3), "s": "a"},
+		{"s": "c"},
+		{"n": "text", "s": "a"},
+		{"n": time.Unix(1, 0), "s": "a"},
+	} {
+		data, err := bson.Marshal(doc)
+		c.Assert(err, IsNil)
+		docs = append(docs, bson.Raw{0x03, data})
+	}
+	order := func() (ns []interface{}) {
+		for _, doc := range docs {
+			var m bson.M
+			c.Assert(doc.Unmarshal(&m), IsNil)
+			ns = append(ns, m["n"])
+		}
+		return ns
+	}
+
+	c.Assert(sortDocs(docs, []string{"n"}), IsNil)
+	c.Assert(order(), DeepEquals, []interface{}{nil, 1.5, 2, int64(3), "text", time.Unix(1, 0)})
+
+	c.Assert(sortDocs(docs, []string{"s", "-n"}), IsNil)
+	c.Assert(order(), DeepEquals, []interface{}{time.Unix(1, 0), "text", int64(3), 1.5, 2, nil})
+
+	c.Assert(sortDocs(docs, []string{"a.b"}), ErrorMatches, `partition: cannot sort results of several partitions by "a.b"`)
+}
+
+type S struct {
+	server  dbtest.DBServer
+	session *mgo.Session
+	coll    *Collection
+}
+
+var _ = Suite(&S{})
+
+func (s *S) SetUpSuite(c *C) {
+	s.server.SetPath(c.MkDir())
+}
+
+func (s *S) TearDownSuite(c *C) {
+	s.server.Stop()
+}
+
+func (s *S) SetUpTest(c *C) {
+	s.server.Wipe()
+	s.session = s.server.Session()
+	s.coll = New(s.session.DB("test"), "users", "name", 4)
+}
+
+func (s *S) TearDownTest(c *C) {
+	s.session.Close()
+}
+
+type user struct {
+	Name string `bson:"name"`
+	Age  int    `bson:"age"`
+}
+
+func (s *S) insertUsers(c *C) {
+	var docs []interface{}
+	for i := 0; i < 20; i++ {
+		docs = append(docs, user{string(rune('a' + i)), i % 5})
+	}
+	c.Assert(s.coll.Insert(docs...), IsNil)
+}
+
+func (s *S) TestInsertSpreads(c *C) {
+	s.insertUsers(c)
+	total := 0
+	for _, part := range s.coll.Partitions() {
+		n, err := part.Count()
+		c.Assert(err, IsNil)
+		c.Assert(n > 0, Equals, true)
+		total += n
+	}
+	c.Assert(total, Equals, 20)
+
+	err := s.coll.Insert(bson.M{"age": 1})
+	c.Assert(err, Equals, ErrNoKey)
+}
+
+func (s *S) TestFind(c *C) {
+	s.insertUsers(c)
+
+	var result user
+	err := s.coll.Find(bson.M{"name": "c"}).One(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, user{"c", 2})
+
+	var results []user
+	err = s.coll.Find(bson.M{"age": 2}).Sort("-name").All(&results)
+	c.Assert(err, IsNil)
+	c.Assert(results, DeepEquals, []user{{"r", 2}, {"m", 2}, {"h", 2}, {"c", 2}})
+
+	err = s.coll.Find(bson.M{"age": bson.M{"$lt": 2}}).Sort("age", "name").Limit(3).All(&results)
+	c.Assert(err, IsNil)
+	c.Assert(results, DeepEquals, []user{{"a", 0}, {"f", 0}, {"k", 0}})
+
+	err = s.coll.Find(bson.M{"age": 4}).Sort("name").One(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, user{"e", 4})
+
+	err = s.coll.Find(bson.M{"age": 10}).One(&result)
+	c.Assert(err, Equals, mgo.ErrNotFound)
+
+	n, err := s.coll.Find(bson.M{"age": 3}).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 4)
+	n, err = s.coll.Find(nil).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 20)
+}
+
+func (s *S) TestWrites(c *C) {
+	s.insertUsers(c)
+
+	err := s.coll.Update(bson.M{"name": "a"}, bson.M{"$set": bson.M{"age": 10}})
+	c.Assert(err, IsNil)
+	err = s.coll.Update(bson.M{"age": 1}, bson.M{"$set": bson.M{"age": 11}})
+	c.Assert(err, IsNil)
+	err = s.coll.Update(bson.M{"age": 100}, bson.M{"$set": bson.M{"age": 11}})
+	c.Assert(err, Equals, mgo.ErrNotFound)
+
+	info, err := s.coll.UpdateAll(bson.M{"age": 2}, bson.M{"$set": bson.M{"age": 12}})
+	c.Assert(err, IsNil)
+	c.Assert(info.Updated, Equals, 4)
+
+	_, err = s.coll.Upsert(bson.M{"age": 30}, bson.M{"$set": bson.M{"x": 1}})
+	c.Assert(err, Equals, ErrNoKey)
+	_, err = s.coll.Upsert(bson.M{"name": "zz"}, bson.M{"$set": bson.M{"age": 30}})
+	c.Assert(err, IsNil)
+
+	var result user
+	err = s.coll.Find(bson.M{"name": "zz"}).One(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, user{"zz", 30})
+
+	err = s.coll.Remove(bson.M{"age": 10})
+	c.Assert(err, IsNil)
+	info, err = s.coll.RemoveAll(bson.M{"age": 12})
+	c.Assert(err, IsNil)
+	c.Assert(info.Removed, Equals, 4)
+
+	n, err := s.coll.Find(nil).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 16)
+
+	c.Assert(s.coll.DropCollection(), IsNil)
+	n, err = s.coll.Find(nil).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 0)
+}
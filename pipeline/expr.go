@@ -0,0 +1,174 @@
+package pipeline
+
+import (
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Field returns the field path expression referring to the named
+// field of the current document, as in "$name".
+func Field(name string) string {
+	return fieldPath(name)
+}
+
+// Var returns the expression referring to the named variable, as in
+// "$$name".
+func Var(name string) string {
+	return "$$" + name
+}
+
+// Literal returns an expression evaluating to v without parsing it,
+// so that strings starting with "$" are not taken as field paths.
+func Literal(v interface{}) bson.D {
+	return bson.D{{"$literal", v}}
+}
+
+// Expr returns a query filter evaluating the aggregation expression
+// e, for use in find queries and $match stages.
+func Expr(e interface{}) bson.D {
+	return bson.D{{"$expr", e}}
+}
+
+func op(name string, args ...interface{}) bson.D {
+	return bson.D{{name, args}}
+}
+
+// Eq returns an expression that's true when a equals b.
+func Eq(a, b interface{}) bson.D { return op("$eq", a, b) }
+
+// Ne returns an expression that's true when a doesn't equal b.
+func Ne(a, b interface{}) bson.D { return op("$ne", a, b) }
+
+// Gt returns an expression that's true when a is greater than b.
+func Gt(a, b interface{}) bson.D { return op("$gt", a, b) }
+
+// Gte returns an expression that's true when a is greater than or equal to b.
+func Gte(a, b interface{}) bson.D { return op("$gte", a, b) }
+
+// Lt returns an expression that's true when a is less than b.
+func Lt(a, b interface{}) bson.D { return op("$lt", a, b) }
+
+// Lte returns an expression that's true when a is less than or equal to b.
+func Lte(a, b interface{}) bson.D { return op("$lte", a, b) }
+
+// And returns an expression that's true when all provided expressions are true.
+func And(exprs ...interface{}) bson.D { return op("$and", exprs...) }
+
+// Or returns an expression that's true when any provided expression is true.
+func Or(exprs ...interface{}) bson.D { return op("$or", exprs...) }
+
+// Not returns an expression negating e.
+func Not(e interface{}) bson.D { return op("$not", e) }
+
+// In returns an expression that's true when v is an element of array.
+func In(v, array interface{}) bson.D { return op("$in", v, array) }
+
+// Add returns an expression summing the provided expressions.
+func Add(exprs ...interface{}) bson.D { return op("$add", exprs...) }
+
+// Subtract returns an expression subtracting b from a.
+func Subtract(a, b interface{}) bson.D { return op("$subtract", a, b) }
+
+// Multiply returns an expression multiplying the provided expressions.
+func Multiply(exprs ...interface{}) bson.D { return op("$multiply", exprs...) }
+
+// Divide returns an expression dividing a by b.
+func Divide(a, b interface{}) bson.D { return op("$divide", a, b) }
+
+// Concat returns an expression concatenating the provided strings.
+func Concat(exprs ...interface{}) bson.D { return op("$concat", exprs...) }
+
+// Size returns an expression evaluating to the length of array.
+func Size(array interface{}) bson.D { return bson.D{{"$size", array}} }
+
+// IfNull returns an expression evaluating to e, or to replacement if
+// e is null or missing.
+func IfNull(e, replacement interface{}) bson.D { return op("$ifNull", e, replacement) }
+
+// Cond returns an expression evaluating to then if cond is true, and
+// to otherwise if not.
+func Cond(cond, then, otherwise interface{}) bson.D {
+	return bson.D{{"$cond", bson.D{{"if", cond}, {"then", then}, {"else", otherwise}}}}
+}
+
+// Case is a single branch of a Switch expression.
+type Case struct {
+	Case interface{}
+	Then interface{}
+}
+
+// Switch returns an expression evaluating to the Then expression of
+// the first case that's true, or to otherwise if none is. If otherwise
+// is nil and no case is true, the expression fails.
+func Switch(cases []Case, otherwise interface{}) bson.D {
+	branches := make([]bson.D, len(cases))
+	for i, c := range cases {
+		branches[i] = bson.D{{"case", c.Case}, {"then", c.Then}}
+	}
+	spec := bson.D{{"branches", branches}}
+	if otherwise != nil {
+		spec = append(spec, bson.DocElem{"default", otherwise})
+	}
+	return bson.D{{"$switch", spec}}
+}
+
+// DateTrunc is a $dateTrunc expression truncating a date to a unit,
+// available in MongoDB 5.0+.
+type DateTrunc struct {
+	Date        interface{}
+	Unit        string // "year", "quarter", "month", "week", "day", "hour", "minute", "second", or "millisecond"
+	BinSize     int    // Optional
+	Timezone    string // Optional
+	StartOfWeek string // Optional, when Unit is "week"
+}
+
+// Expr returns the $dateTrunc expression document.
+func (d DateTrunc) Expr() bson.D {
+	if d.Unit == "" {
+		panic("pipeline.DateTrunc: Unit must be set")
+	}
+	spec := bson.D{{"date", d.Date}, {"unit", d.Unit}}
+	if d.BinSize != 0 {
+		spec = append(spec, bson.DocElem{"binSize", d.BinSize})
+	}
+	if d.Timezone != "" {
+		spec = append(spec, bson.DocElem{"timezone", d.Timezone})
+	}
+	if d.StartOfWeek != "" {
+		spec = append(spec, bson.DocElem{"startOfWeek", d.StartOfWeek})
+	}
+	return bson.D{{"$dateTrunc", spec}}
+}
+
+// DateToString returns an expression formatting date as a string.
+// The timezone may be empty.
+func DateToString(date interface{}, format, timezone string) bson.D {
+	spec := bson.D{{"date", date}, {"format", format}}
+	if timezone != "" {
+		spec = append(spec, bson.DocElem{"timezone", timezone})
+	}
+	return bson.D{{"$dateToString", spec}}
+}
+
+// Sum returns a $sum accumulator or expression.
+func Sum(e interface{}) bson.D { return bson.D{{"$sum", e}} }
+
+// Avg returns an $avg accumulator or expression.
+func Avg(e interface{}) bson.D { return bson.D{{"$avg", e}} }
+
+// Min returns a $min accumulator or expression.
+func Min(e interface{}) bson.D { return bson.D{{"$min", e}} }
+
+// Max returns a $max accumulator or expression.
+func Max(e interface{}) bson.D { return bson.D{{"$max", e}} }
+
+// First returns a $first accumulator.
+func First(e interface{}) bson.D { return bson.D{{"$first", e}} }
+
+// Last returns a $last accumulator.
+func Last(e interface{}) bson.D { return bson.D{{"$last", e}} }
+
+// Push returns a $push accumulator.
+func Push(e interface{}) bson.D { return bson.D{{"$push", e}} }
+
+// AddToSet returns an $addToSet accumulator.
+func AddToSet(e interface{}) bson.D { return bson.D{{"$addToSet", e}} }
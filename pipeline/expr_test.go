@@ -0,0 +1,71 @@
+package pipeline_test
+
+import (
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/pipeline"
+)
+
+type ExprSuite struct{}
+
+var _ = Suite(&ExprSuite{})
+
+func (s *ExprSuite) TestComparisons(c *C) {
+	p := pipeline.Expr(pipeline.And(
+		pipeline.Gt(pipeline.Field("spent"), pipeline.Field("budget")),
+		pipeline.Not(pipeline.Eq("$status", pipeline.Literal("$closed"))),
+		pipeline.In(pipeline.Var("region"), []string{"eu", "us"}),
+	))
+	c.Assert(p, DeepEquals, bson.D{{"$expr", bson.D{{"$and", []interface{}{
+		bson.D{{"$gt", []interface{}{"$spent", "$budget"}}},
+		bson.D{{"$not", []interface{}{bson.D{{"$eq", []interface{}{"$status", bson.D{{"$literal", "$closed"}}}}}}}},
+		bson.D{{"$in", []interface{}{"$$region", []string{"eu", "us"}}}},
+	}}}}})
+}
+
+func (s *ExprSuite) TestCondAndSwitch(c *C) {
+	e := pipeline.Cond(pipeline.Gte("$qty", 250), 30, 20)
+	c.Assert(e, DeepEquals, bson.D{{"$cond", bson.D{
+		{"if", bson.D{{"$gte", []interface{}{"$qty", 250}}}},
+		{"then", 30},
+		{"else", 20},
+	}}})
+
+	e = pipeline.Switch([]pipeline.Case{
+		{pipeline.Lt("$score", 50), "low"},
+		{pipeline.Lt("$score", 80), "mid"},
+	}, "high")
+	c.Assert(e, DeepEquals, bson.D{{"$switch", bson.D{
+		{"branches", []bson.D{
+			{{"case", bson.D{{"$lt", []interface{}{"$score", 50}}}}, {"then", "low"}},
+			{{"case", bson.D{{"$lt", []interface{}{"$score", 80}}}}, {"then", "mid"}},
+		}},
+		{"default", "high"},
+	}}})
+}
+
+func (s *ExprSuite) TestDates(c *C) {
+	e := pipeline.DateTrunc{Date: "$ts", Unit: "week", BinSize: 2, StartOfWeek: "monday"}.Expr()
+	c.Assert(e, DeepEquals, bson.D{{"$dateTrunc", bson.D{
+		{"date", "$ts"},
+		{"unit", "week"},
+		{"binSize", 2},
+		{"startOfWeek", "monday"},
+	}}})
+	c.Assert(func() { pipeline.DateTrunc{Date: "$ts"}.Expr() }, PanicMatches, "pipeline.DateTrunc: Unit must be set")
+
+	e = pipeline.DateToString("$ts", "%Y-%m-%d", "")
+	c.Assert(e, DeepEquals, bson.D{{"$dateToString", bson.D{{"date", "$ts"}, {"format", "%Y-%m-%d"}}}})
+}
+
+func (s *ExprSuite) TestAccumulators(c *C) {
+	stage := pipeline.Group(pipeline.DateTrunc{Date: "$ts", Unit: "day"}.Expr(), bson.D{
+		{"total", pipeline.Sum(pipeline.Multiply("$price", "$qty"))},
+		{"items", pipeline.Push("$item")},
+	}).Stage()
+	c.Assert(stage, DeepEquals, bson.D{{"$group", bson.D{
+		{"_id", bson.D{{"$dateTrunc", bson.D{{"date", "$ts"}, {"unit", "day"}}}}},
+		{"total", bson.D{{"$sum", bson.D{{"$multiply", []interface{}{"$price", "$qty"}}}}}},
+		{"items", bson.D{{"$push", "$item"}}},
+	}}})
+}
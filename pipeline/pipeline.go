@@ -0,0 +1,273 @@
+// The pipeline package implements typed builders for aggregation
+// pipelines, so that pipelines are composed out of checked values
+// rather than hand-written nested documents.
+//
+// Pipelines are slices of bson.D documents and may be provided as-is
+// to mgo.Collection.Pipe:
+//
+//     p := pipeline.New(
+//         pipeline.Match(bson.M{"status": "paid"}),
+//         pipeline.Lookup{From: "users", LocalField: "user", ForeignField: "_id", As: "user"},
+//         pipeline.Unwind("user"),
+//         pipeline.Group("$user.country", bson.D{{"total", bson.M{"$sum": "$amount"}}}),
+//         pipeline.Sort("-total"),
+//     )
+//     err := orders.Pipe(p).All(&result)
+//
+package pipeline
+
+import (
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Stage is implemented by values that render into a single pipeline
+// stage document.
+type Stage interface {
+	Stage() bson.D
+}
+
+// Pipeline is a sequence of aggregation stages.
+type Pipeline []bson.D
+
+// New returns a pipeline with the provided stages.
+func New(stages ...Stage) Pipeline {
+	return Pipeline(nil).Then(stages...)
+}
+
+// Then returns a new pipeline with the provided stages appended to p.
+func (p Pipeline) Then(stages ...Stage) Pipeline {
+	result := make(Pipeline, len(p), len(p)+len(stages))
+	copy(result, p)
+	for _, s := range stages {
+		result = append(result, s.Stage())
+	}
+	return result
+}
+
+// Raw is a stage document provided verbatim, for stages without a
+// typed builder.
+type Raw bson.D
+
+// Stage returns r as a document.
+func (r Raw) Stage() bson.D {
+	return bson.D(r)
+}
+
+// fieldPath returns the field path expression for the named field,
+// prefixing it with "$" unless already present.
+func fieldPath(field string) string {
+	if strings.HasPrefix(field, "$") {
+		return field
+	}
+	return "$" + field
+}
+
+// Match returns a $match stage filtering documents with filter.
+func Match(filter interface{}) Stage {
+	return Raw{{"$match", filter}}
+}
+
+// Project returns a $project stage with the provided specification.
+func Project(spec interface{}) Stage {
+	return Raw{{"$project", spec}}
+}
+
+// AddFields returns an $addFields stage with the provided fields.
+func AddFields(fields interface{}) Stage {
+	return Raw{{"$addFields", fields}}
+}
+
+// Sort returns a $sort stage ordering by the provided fields, using
+// the same notation as mgo.Query.Sort: a field name prefixed by "-"
+// sorts in descending order.
+func Sort(fields ...string) Stage {
+	var order bson.D
+	for _, field := range fields {
+		n := 1
+		switch {
+		case strings.HasPrefix(field, "+"):
+			field = field[1:]
+		case strings.HasPrefix(field, "-"):
+			n = -1
+			field = field[1:]
+		}
+		if field == "" {
+			panic("pipeline.Sort: empty field name")
+		}
+		order = append(order, bson.DocElem{field, n})
+	}
+	return Raw{{"$sort", order}}
+}
+
+// Limit returns a $limit stage.
+func Limit(n int) Stage {
+	return Raw{{"$limit", n}}
+}
+
+// Skip returns a $skip stage.
+func Skip(n int) Stage {
+	return Raw{{"$skip", n}}
+}
+
+// Count returns a $count stage storing the number of documents in the
+// named field.
+func Count(field string) Stage {
+	return Raw{{"$count", field}}
+}
+
+// Group returns a $group stage grouping documents by the id expression
+// and computing the provided accumulator fields.
+func Group(id interface{}, fields bson.D) Stage {
+	group := make(bson.D, 0, len(fields)+1)
+	group = append(group, bson.DocElem{"_id", id})
+	group = append(group, fields...)
+	return Raw{{"$group", group}}
+}
+
+// Unwind returns an $unwind stage deconstructing the array in the
+// named field. The "$" prefix is added to the field if missing.
+func Unwind(field string) Stage {
+	return Raw{{"$unwind", fieldPath(field)}}
+}
+
+// UnwindOptions is an $unwind stage with options.
+type UnwindOptions struct {
+	Path                       string
+	IncludeArrayIndex          string
+	PreserveNullAndEmptyArrays bool
+}
+
+// Stage returns the $unwind stage document.
+func (u UnwindOptions) Stage() bson.D {
+	spec := bson.D{{"path", fieldPath(u.Path)}}
+	if u.IncludeArrayIndex != "" {
+		spec = append(spec, bson.DocElem{"includeArrayIndex", u.IncludeArrayIndex})
+	}
+	if u.PreserveNullAndEmptyArrays {
+		spec = append(spec, bson.DocElem{"preserveNullAndEmptyArrays", true})
+	}
+	return bson.D{{"$unwind", spec}}
+}
+
+// Lookup is a $lookup stage joining documents from another collection.
+//
+// Either LocalField and ForeignField are set for an equality match, or
+// Pipeline is set, optionally along with Let, to run a pipeline on the
+// joined collection.
+type Lookup struct {
+	From         string
+	LocalField   string
+	ForeignField string
+	Let          bson.D
+	Pipeline     Pipeline
+	As           string
+}
+
+// Stage returns the $lookup stage document.
+func (l Lookup) Stage() bson.D {
+	if l.From == "" || l.As == "" {
+		panic("pipeline.Lookup: From and As must be set")
+	}
+	spec := bson.D{{"from", l.From}}
+	if l.LocalField != "" || l.ForeignField != "" {
+		spec = append(spec, bson.DocElem{"localField", l.LocalField}, bson.DocElem{"foreignField", l.ForeignField})
+	}
+	if l.Let != nil {
+		spec = append(spec, bson.DocElem{"let", l.Let})
+	}
+	if l.Pipeline != nil {
+		spec = append(spec, bson.DocElem{"pipeline", l.Pipeline})
+	}
+	spec = append(spec, bson.DocElem{"as", l.As})
+	return bson.D{{"$lookup", spec}}
+}
+
+// GraphLookup is a $graphLookup stage performing a recursive search
+// on a collection.
+type GraphLookup struct {
+	From             string
+	StartWith        interface{}
+	ConnectFromField string
+	ConnectToField   string
+	As               string
+
+	// MaxDepth limits the recursion depth if non-nil.
+	MaxDepth *int
+
+	DepthField              string
+	RestrictSearchWithMatch interface{}
+}
+
+// Stage returns the $graphLookup stage document.
+func (g GraphLookup) Stage() bson.D {
+	if g.From == "" || g.ConnectFromField == "" || g.ConnectToField == "" || g.As == "" {
+		panic("pipeline.GraphLookup: From, ConnectFromField, ConnectToField, and As must be set")
+	}
+	startWith := g.StartWith
+	if s, ok := startWith.(string); ok {
+		startWith = fieldPath(s)
+	}
+	spec := bson.D{
+		{"from", g.From},
+		{"startWith", startWith},
+		{"connectFromField", g.ConnectFromField},
+		{"connectToField", g.ConnectToField},
+		{"as", g.As},
+	}
+	if g.MaxDepth != nil {
+		spec = append(spec, bson.DocElem{"maxDepth", *g.MaxDepth})
+	}
+	if g.DepthField != "" {
+		spec = append(spec, bson.DocElem{"depthField", g.DepthField})
+	}
+	if g.RestrictSearchWithMatch != nil {
+		spec = append(spec, bson.DocElem{"restrictSearchWithMatch", g.RestrictSearchWithMatch})
+	}
+	return bson.D{{"$graphLookup", spec}}
+}
+
+// Facet is a single named sub-pipeline of a $facet stage.
+type Facet struct {
+	Name     string
+	Pipeline Pipeline
+}
+
+// Facets returns a $facet stage running each sub-pipeline on the same
+// input documents.
+func Facets(facets ...Facet) Stage {
+	spec := make(bson.D, len(facets))
+	for i, f := range facets {
+		spec[i] = bson.DocElem{f.Name, f.Pipeline}
+	}
+	return Raw{{"$facet", spec}}
+}
+
+// Bucket is a $bucket stage categorizing documents into groups based
+// on boundaries.
+type Bucket struct {
+	GroupBy    interface{}
+	Boundaries []interface{}
+	Default    interface{}
+	Output     bson.D
+}
+
+// Stage returns the $bucket stage document.
+func (b Bucket) Stage() bson.D {
+	if len(b.Boundaries) < 2 {
+		panic("pipeline.Bucket: at least two boundaries must be set")
+	}
+	groupBy := b.GroupBy
+	if s, ok := groupBy.(string); ok {
+		groupBy = fieldPath(s)
+	}
+	spec := bson.D{{"groupBy", groupBy}, {"boundaries", b.Boundaries}}
+	if b.Default != nil {
+		spec = append(spec, bson.DocElem{"default", b.Default})
+	}
+	if b.Output != nil {
+		spec = append(spec, bson.DocElem{"output", b.Output})
+	}
+	return bson.D{{"$bucket", spec}}
+}
@@ -0,0 +1,131 @@
+package pipeline_test
+
+import (
+	"testing"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/pipeline"
+)
+
+func TestAll(t *testing.T) {
+	TestingT(t)
+}
+
+type PipelineSuite struct{}
+
+var _ = Suite(&PipelineSuite{})
+
+func (s *PipelineSuite) TestSimpleStages(c *C) {
+	p := pipeline.New(
+		pipeline.Match(bson.M{"a": 1}),
+		pipeline.Sort("a", "-b", "+c"),
+		pipeline.Skip(10),
+		pipeline.Limit(5),
+		pipeline.Unwind("items"),
+		pipeline.Group("$a", bson.D{{"n", bson.M{"$sum": 1}}}),
+		pipeline.Count("total"),
+		pipeline.Raw{{"$sample", bson.D{{"size", 3}}}},
+	)
+	c.Assert(p, DeepEquals, pipeline.Pipeline{
+		{{"$match", bson.M{"a": 1}}},
+		{{"$sort", bson.D{{"a", 1}, {"b", -1}, {"c", 1}}}},
+		{{"$skip", 10}},
+		{{"$limit", 5}},
+		{{"$unwind", "$items"}},
+		{{"$group", bson.D{{"_id", "$a"}, {"n", bson.M{"$sum": 1}}}}},
+		{{"$count", "total"}},
+		{{"$sample", bson.D{{"size", 3}}}},
+	})
+}
+
+func (s *PipelineSuite) TestThenCopies(c *C) {
+	base := pipeline.New(pipeline.Match(bson.M{"a": 1}))
+	p1 := base.Then(pipeline.Limit(1))
+	p2 := base.Then(pipeline.Limit(2))
+	c.Assert(base, HasLen, 1)
+	c.Assert(p1[1], DeepEquals, bson.D{{"$limit", 1}})
+	c.Assert(p2[1], DeepEquals, bson.D{{"$limit", 2}})
+}
+
+func (s *PipelineSuite) TestUnwindOptions(c *C) {
+	stage := pipeline.UnwindOptions{Path: "$items", IncludeArrayIndex: "i", PreserveNullAndEmptyArrays: true}.Stage()
+	c.Assert(stage, DeepEquals, bson.D{{"$unwind", bson.D{
+		{"path", "$items"},
+		{"includeArrayIndex", "i"},
+		{"preserveNullAndEmptyArrays", true},
+	}}})
+}
+
+func (s *PipelineSuite) TestLookup(c *C) {
+	stage := pipeline.Lookup{From: "users", LocalField: "user", ForeignField: "_id", As: "u"}.Stage()
+	c.Assert(stage, DeepEquals, bson.D{{"$lookup", bson.D{
+		{"from", "users"},
+		{"localField", "user"},
+		{"foreignField", "_id"},
+		{"as", "u"},
+	}}})
+
+	stage = pipeline.Lookup{
+		From:     "users",
+		Let:      bson.D{{"uid", "$user"}},
+		Pipeline: pipeline.New(pipeline.Match(bson.M{"$expr": bson.M{"$eq": []string{"$_id", "$$uid"}}})),
+		As:       "u",
+	}.Stage()
+	c.Assert(stage, DeepEquals, bson.D{{"$lookup", bson.D{
+		{"from", "users"},
+		{"let", bson.D{{"uid", "$user"}}},
+		{"pipeline", pipeline.Pipeline{{{"$match", bson.M{"$expr": bson.M{"$eq": []string{"$_id", "$$uid"}}}}}}},
+		{"as", "u"},
+	}}})
+
+	c.Assert(func() { pipeline.Lookup{From: "users"}.Stage() }, PanicMatches, "pipeline.Lookup: From and As must be set")
+}
+
+func (s *PipelineSuite) TestGraphLookup(c *C) {
+	depth := 2
+	stage := pipeline.GraphLookup{
+		From:             "employees",
+		StartWith:        "reportsTo",
+		ConnectFromField: "reportsTo",
+		ConnectToField:   "name",
+		As:               "chain",
+		MaxDepth:         &depth,
+		DepthField:       "level",
+	}.Stage()
+	c.Assert(stage, DeepEquals, bson.D{{"$graphLookup", bson.D{
+		{"from", "employees"},
+		{"startWith", "$reportsTo"},
+		{"connectFromField", "reportsTo"},
+		{"connectToField", "name"},
+		{"as", "chain"},
+		{"maxDepth", 2},
+		{"depthField", "level"},
+	}}})
+}
+
+func (s *PipelineSuite) TestFacetsAndBucket(c *C) {
+	stage := pipeline.Facets(
+		pipeline.Facet{"count", pipeline.New(pipeline.Count("n"))},
+		pipeline.Facet{"prices", pipeline.New(pipeline.Bucket{
+			GroupBy:    "price",
+			Boundaries: []interface{}{0, 100, 200},
+			Default:    "other",
+		})},
+	).Stage()
+	c.Assert(stage, DeepEquals, bson.D{{"$facet", bson.D{
+		{"count", pipeline.Pipeline{{{"$count", "n"}}}},
+		{"prices", pipeline.Pipeline{{{"$bucket", bson.D{
+			{"groupBy", "$price"},
+			{"boundaries", []interface{}{0, 100, 200}},
+			{"default", "other"},
+		}}}}},
+	}}})
+
+	// Pipelines marshal as plain arrays of documents.
+	data, err := bson.Marshal(bson.D{{"pipeline", pipeline.New(pipeline.Limit(1))}})
+	c.Assert(err, IsNil)
+	var result bson.M
+	c.Assert(bson.Unmarshal(data, &result), IsNil)
+	c.Assert(result, DeepEquals, bson.M{"pipeline": []interface{}{bson.M{"$limit": 1}}})
+}
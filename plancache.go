@@ -0,0 +1,117 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"gopkg.in/mgo.v2/bson"
+)
+
+// PlanCacheFilter holds an index filter set on a collection, which
+// restricts the indexes the query planner considers for queries of
+// the given shape.
+//
+// Relevant documentation:
+//
+//     https://docs.mongodb.com/manual/reference/command/planCacheListFilters/
+//
+type PlanCacheFilter struct {
+	Query      bson.Raw   `bson:"query"`
+	Sort       bson.Raw   `bson:"sort"`
+	Projection bson.Raw   `bson:"projection"`
+	Indexes    []bson.Raw `bson:"indexes"`
+}
+
+// PlanCacheFilters returns the index filters set on the collection.
+func (c *Collection) PlanCacheFilters() ([]PlanCacheFilter, error) {
+	var result struct {
+		Filters []PlanCacheFilter `bson:"filters"`
+	}
+	err := c.Database.Run(bson.D{{"planCacheListFilters", c.Name}}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return result.Filters, nil
+}
+
+// SetPlanCacheFilter sets an index filter on the collection so that
+// queries with the shape defined by query, sort, and projection only
+// consider the provided indexes. Each index is either a key document
+// such as bson.D{{"a", 1}} or an index name. The sort and projection
+// parameters may be nil.
+func (c *Collection) SetPlanCacheFilter(query, sort, projection interface{}, indexes ...interface{}) error {
+	cmd := bson.D{{"planCacheSetFilter", c.Name}, {"query", query}}
+	if sort != nil {
+		cmd = append(cmd, bson.DocElem{"sort", sort})
+	}
+	if projection != nil {
+		cmd = append(cmd, bson.DocElem{"projection", projection})
+	}
+	cmd = append(cmd, bson.DocElem{"indexes", indexes})
+	return c.Database.Run(cmd, nil)
+}
+
+// ClearPlanCacheFilters removes all index filters set on the collection.
+func (c *Collection) ClearPlanCacheFilters() error {
+	return c.Database.Run(bson.D{{"planCacheClearFilters", c.Name}}, nil)
+}
+
+// ClearPlanCache removes all cached query plans for the collection.
+//
+// Relevant documentation:
+//
+//     https://docs.mongodb.com/manual/reference/command/planCacheClear/
+//
+func (c *Collection) ClearPlanCache() error {
+	return c.Database.Run(bson.D{{"planCacheClear", c.Name}}, nil)
+}
+
+// ClearPlanCacheQuery removes the cached query plans for queries with
+// the shape defined by query, sort, and projection. The sort and
+// projection parameters may be nil.
+func (c *Collection) ClearPlanCacheQuery(query, sort, projection interface{}) error {
+	cmd := bson.D{{"planCacheClear", c.Name}, {"query", query}}
+	if sort != nil {
+		cmd = append(cmd, bson.DocElem{"sort", sort})
+	}
+	if projection != nil {
+		cmd = append(cmd, bson.DocElem{"projection", projection})
+	}
+	return c.Database.Run(cmd, nil)
+}
+
+// PlanCacheStats returns statistics about the query plans cached for
+// the collection, as reported by the $planCacheStats aggregation stage
+// available in MongoDB 4.2+. The result is unmarshalled into result,
+// which must be a pointer to a slice.
+//
+// Relevant documentation:
+//
+//     https://docs.mongodb.com/manual/reference/operator/aggregation/planCacheStats/
+//
+func (c *Collection) PlanCacheStats(result interface{}) error {
+	return c.Pipe([]bson.D{{{"$planCacheStats", bson.D{}}}}).All(result)
+}
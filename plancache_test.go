@@ -0,0 +1,101 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo_test
+
+import (
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (s *S) TestPlanCacheFilters(c *C) {
+	if !s.versionAtLeast(2, 6) {
+		c.Skip("index filters depend on MongoDB 2.6+")
+	}
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.EnsureIndexKey("a")
+	c.Assert(err, IsNil)
+
+	filters, err := coll.PlanCacheFilters()
+	c.Assert(err, IsNil)
+	c.Assert(filters, HasLen, 0)
+
+	err = coll.SetPlanCacheFilter(M{"a": 1}, nil, nil, bson.D{{"a", 1}})
+	c.Assert(err, IsNil)
+
+	filters, err = coll.PlanCacheFilters()
+	c.Assert(err, IsNil)
+	c.Assert(filters, HasLen, 1)
+	var query M
+	c.Assert(filters[0].Query.Unmarshal(&query), IsNil)
+	c.Assert(query, DeepEquals, M{"a": 1})
+	c.Assert(filters[0].Indexes, HasLen, 1)
+
+	err = coll.ClearPlanCacheFilters()
+	c.Assert(err, IsNil)
+	filters, err = coll.PlanCacheFilters()
+	c.Assert(err, IsNil)
+	c.Assert(filters, HasLen, 0)
+}
+
+func (s *S) TestPlanCacheClearAndStats(c *C) {
+	if !s.versionAtLeast(4, 2) {
+		c.Skip("$planCacheStats depends on MongoDB 4.2+")
+	}
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	c.Assert(coll.EnsureIndexKey("a"), IsNil)
+	c.Assert(coll.EnsureIndexKey("a", "b"), IsNil)
+	for i := 0; i < 10; i++ {
+		c.Assert(coll.Insert(M{"a": i, "b": i}), IsNil)
+	}
+	for i := 0; i < 3; i++ {
+		var result []M
+		c.Assert(coll.Find(M{"a": 1, "b": 1}).All(&result), IsNil)
+	}
+
+	var stats []M
+	err = coll.PlanCacheStats(&stats)
+	c.Assert(err, IsNil)
+	c.Assert(len(stats) > 0, Equals, true)
+
+	err = coll.ClearPlanCacheQuery(M{"a": 1, "b": 1}, nil, nil)
+	c.Assert(err, IsNil)
+	err = coll.ClearPlanCache()
+	c.Assert(err, IsNil)
+
+	err = coll.PlanCacheStats(&stats)
+	c.Assert(err, IsNil)
+	c.Assert(stats, HasLen, 0)
+}
@@ -0,0 +1,128 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Operation describes an operation about to be sent to a server, as
+// provided to a Policy.
+type Operation struct {
+	Database   string      // Database the operation runs on
+	Collection string      // Collection the operation targets, if known
+	Command    string      // Command name, or "find", "insert", "update", and "delete" for the equivalent operations
+	Doc        bson.Raw    // Command document, or the query filter for queries
+	Hint       interface{} // Index hint provided via Query.Hint or HintPins, if any
+}
+
+// Policy decides which operations a session may send to servers. It's
+// meant for platform teams that wrap the driver and want to enforce
+// rules such as forbidding dropDatabase, or requiring queries on large
+// collections to provide an index hint.
+//
+// See Session.SetPolicy.
+type Policy interface {
+	// Allow returns nil if op may be sent to the server, or otherwise
+	// the error that the operation fails with.
+	Allow(op *Operation) error
+}
+
+// The PolicyFunc type is an adapter to allow the use of ordinary
+// functions as policies.
+type PolicyFunc func(op *Operation) error
+
+// Allow returns f(op).
+func (f PolicyFunc) Allow(op *Operation) error {
+	return f(op)
+}
+
+// SetPolicy sets the policy consulted before every query and command
+// is sent to a server, with nil meaning that all operations are allowed.
+// Operations rejected by the policy fail with the error it returns.
+//
+// Queries are described by their filter, and commands by the command
+// document, which includes the write commands used for inserts, updates,
+// and removals. Writes sent to servers older than MongoDB 2.6, which
+// don't support write commands, are described by their kind alone.
+// Operations the driver runs on its own, such as the ones monitoring
+// the cluster topology, are not subject to the policy.
+//
+// The policy is inherited by sessions obtained via Copy, Clone, and New.
+func (s *Session) SetPolicy(policy Policy) {
+	s.m.Lock()
+	s.policy = policy
+	s.m.Unlock()
+}
+
+// checkPolicy returns the error policy rejects the query or command op
+// with, if any.
+func checkPolicy(policy Policy, op *queryOp) error {
+	if policy == nil {
+		return nil
+	}
+	o := &Operation{Command: "find", Hint: op.options.Hint}
+	o.Database, o.Collection = splitNamespace(op.collection)
+	if data, err := addBSON(nil, op.query); err == nil {
+		o.Doc = bson.Raw{0x03, data}
+		if o.Collection == "$cmd" {
+			o.Command, o.Collection = firstElement(data)
+			o.Hint = nil
+		}
+	}
+	return policy.Allow(o)
+}
+
+// checkWritePolicy returns the error the session's policy rejects the
+// legacy write operation op on collection c with, if any.
+func (s *Session) checkWritePolicy(c *Collection, op interface{}) error {
+	s.m.RLock()
+	policy := s.policy
+	s.m.RUnlock()
+	if policy == nil {
+		return nil
+	}
+	o := &Operation{Database: c.Database.Name, Collection: c.Name}
+	switch op.(type) {
+	case *insertOp:
+		o.Command = "insert"
+	case *updateOp, bulkUpdateOp:
+		o.Command = "update"
+	case *deleteOp, bulkDeleteOp:
+		o.Command = "delete"
+	}
+	return policy.Allow(o)
+}
+
+func splitNamespace(ns string) (db, coll string) {
+	if dot := strings.Index(ns, "."); dot >= 0 {
+		return ns[:dot], ns[dot+1:]
+	}
+	return ns, ""
+}
@@ -0,0 +1,99 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo_test
+
+import (
+	"errors"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+)
+
+func (s *S) TestPolicy(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.Insert(M{"n": 1})
+	c.Assert(err, IsNil)
+
+	errDrop := errors.New("dropDatabase is forbidden")
+	errHint := errors.New("queries must provide a hint")
+	var ops []mgo.Operation
+	session.SetPolicy(mgo.PolicyFunc(func(op *mgo.Operation) error {
+		ops = append(ops, *op)
+		switch {
+		case op.Command == "dropDatabase":
+			return errDrop
+		case op.Command == "find" && op.Hint == nil:
+			return errHint
+		}
+		return nil
+	}))
+
+	err = session.DB("mydb").DropDatabase()
+	c.Assert(err, Equals, errDrop)
+	c.Assert(ops, HasLen, 1)
+	c.Assert(ops[0].Database, Equals, "mydb")
+	c.Assert(ops[0].Collection, Equals, "")
+
+	ops = nil
+	err = coll.Find(M{"n": 1}).One(nil)
+	c.Assert(err, Equals, errHint)
+	c.Assert(coll.Find(M{"n": 1}).Iter().Close(), Equals, errHint)
+	c.Assert(ops, HasLen, 2)
+	c.Assert(ops[0].Database, Equals, "mydb")
+	c.Assert(ops[0].Collection, Equals, "mycoll")
+	var filter M
+	c.Assert(ops[0].Doc.Unmarshal(&filter), IsNil)
+	c.Assert(filter, DeepEquals, M{"n": 1})
+
+	var result M
+	err = coll.Find(M{"n": 1}).Hint("_id").One(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result["n"], Equals, 1)
+
+	// Write commands are checked as well.
+	ops = nil
+	err = coll.Insert(M{"n": 2})
+	c.Assert(err, IsNil)
+	c.Assert(ops, HasLen, 1)
+	c.Assert(ops[0].Command, Equals, "insert")
+	c.Assert(ops[0].Collection, Equals, "mycoll")
+
+	// The policy is inherited by copies.
+	scopy := session.Copy()
+	defer scopy.Close()
+	err = scopy.DB("mydb").DropDatabase()
+	c.Assert(err, Equals, errDrop)
+
+	session.SetPolicy(nil)
+	n, err := coll.Find(nil).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+}
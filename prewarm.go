@@ -0,0 +1,178 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Prewarm holds settings for warming up the server's cache via
+// Collection.Prewarm. Zero values select the defaults documented for
+// each field.
+type Prewarm struct {
+	// Index, if set, is the key of the index to traverse with a query
+	// covered by it, which loads the index but not the documents into
+	// the cache. See EnsureIndex for details on the key format. By
+	// default, the documents are scanned in their natural order.
+	Index []string
+
+	// BatchSize is the number of index entries or documents fetched
+	// at once. Defaults to 1000.
+	BatchSize int
+
+	// Pause is how long to wait between batches, to avoid competing
+	// with the application for the server's disk. Defaults to 100
+	// milliseconds, and negative values disable pausing.
+	Pause time.Duration
+
+	// Limit, if positive, is the maximum number of index entries or
+	// documents to fetch.
+	Limit int
+}
+
+// PrewarmResult holds the outcome of warming up a collection via
+// Collection.Prewarm.
+type PrewarmResult struct {
+	Fetched int           // Number of index entries or documents fetched
+	Elapsed time.Duration // Time taken, including pauses
+}
+
+// Prewarm reads through the collection or one of its indexes, so that
+// they are loaded into the server's cache before the application needs
+// them, such as after the server was restarted or a new primary was
+// elected. The session's consistency mode (see Session.SetMode) decides
+// which server is warmed up. Fetching is throttled with pauses between
+// batches (see Prewarm.Pause), and stops early if the session's context
+// is done (see Session.WithContext). The result is returned even on
+// errors.
+//
+// See PrewarmOnPrimary for warming up new primaries automatically.
+func (c *Collection) Prewarm(settings *Prewarm) (*PrewarmResult, error) {
+	var prewarm Prewarm
+	if settings != nil {
+		prewarm = *settings
+	}
+	if prewarm.BatchSize <= 0 {
+		prewarm.BatchSize = 1000
+	}
+	if prewarm.Pause == 0 {
+		prewarm.Pause = 100 * time.Millisecond
+	}
+
+	query := c.Find(nil).Batch(prewarm.BatchSize)
+	if len(prewarm.Index) > 0 {
+		keyInfo, err := parseIndexKey(prewarm.Index)
+		if err != nil {
+			return &PrewarmResult{}, err
+		}
+		fields := bson.D{}
+		hasId := false
+		for _, elem := range keyInfo.key {
+			fields = append(fields, bson.DocElem{elem.Name, 1})
+			hasId = hasId || elem.Name == "_id"
+		}
+		if !hasId {
+			fields = append(fields, bson.DocElem{"_id", 0})
+		}
+		query = query.Hint(prewarm.Index...).Select(fields)
+	} else {
+		query = query.Sort("$natural").Select(bson.D{{"_id", 1}})
+	}
+	if prewarm.Limit > 0 {
+		query = query.Limit(prewarm.Limit)
+	}
+
+	ctx := c.Database.Session.Context()
+	start := time.Now()
+	var result PrewarmResult
+	iter := query.Iter()
+	var doc bson.Raw
+	for iter.Next(&doc) {
+		result.Fetched++
+		if prewarm.Pause > 0 && result.Fetched%prewarm.BatchSize == 0 {
+			select {
+			case <-ctx.Done():
+				iter.Close()
+				result.Elapsed = time.Since(start)
+				return &result, ctx.Err()
+			case <-time.After(prewarm.Pause):
+			}
+		}
+	}
+	err := iter.Close()
+	result.Elapsed = time.Since(start)
+	return &result, err
+}
+
+// PrewarmOnPrimary returns a function for Monitor.Primary that runs warm
+// in the background with a copy of session whenever a new primary is
+// detected, such as to warm up the primary's cache via Collection.Prewarm
+// after a failover. The copy is in Strong mode, so operations run on the
+// primary. Errors returned by warm are logged via the logger set with
+// SetLogger. Primaries detected while warm is still running are skipped,
+// and as monitors are global, so are primaries of clusters other than the
+// one session is connected to.
+//
+// For example:
+//
+//     mgo.SetMonitor(&mgo.Monitor{
+//         Primary: mgo.PrewarmOnPrimary(session, func(session *mgo.Session) error {
+//             _, err := session.DB("mydb").C("mycoll").Prewarm(nil)
+//             return err
+//         }),
+//     })
+//
+func PrewarmOnPrimary(session *Session, warm func(session *Session) error) func(addr string) {
+	var m sync.Mutex
+	running := false
+	return func(addr string) {
+		m.Lock()
+		if running {
+			m.Unlock()
+			logf("Skipping prewarm of primary %s: prewarm already running", addr)
+			return
+		}
+		running = true
+		m.Unlock()
+		go func() {
+			defer func() {
+				m.Lock()
+				running = false
+				m.Unlock()
+			}()
+			scopy := session.Copy()
+			defer scopy.Close()
+			scopy.SetMode(Strong, false)
+			if err := warm(scopy); err != nil {
+				logf("Prewarm of primary %s failed: %v", addr, err)
+			}
+		}()
+	}
+}
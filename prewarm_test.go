@@ -0,0 +1,92 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo_test
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+)
+
+func (s *S) TestPrewarm(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	for i := 0; i < 10; i++ {
+		err = coll.Insert(M{"n": i})
+		c.Assert(err, IsNil)
+	}
+	err = coll.EnsureIndexKey("n")
+	c.Assert(err, IsNil)
+
+	result, err := coll.Prewarm(&mgo.Prewarm{BatchSize: 3, Pause: 20 * time.Millisecond})
+	c.Assert(err, IsNil)
+	c.Assert(result.Fetched, Equals, 10)
+	c.Assert(result.Elapsed >= 60*time.Millisecond, Equals, true)
+
+	result, err = coll.Prewarm(&mgo.Prewarm{Index: []string{"n"}, Limit: 5})
+	c.Assert(err, IsNil)
+	c.Assert(result.Fetched, Equals, 5)
+
+	_, err = coll.Prewarm(&mgo.Prewarm{Index: []string{"missing"}})
+	c.Assert(err, NotNil)
+}
+
+func (s *S) TestPrewarmOnPrimary(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.Insert(M{"n": 1})
+	c.Assert(err, IsNil)
+
+	fetched := make(chan int, 10)
+	mgo.SetMonitor(&mgo.Monitor{
+		Primary: mgo.PrewarmOnPrimary(session, func(session *mgo.Session) error {
+			result, err := coll.With(session).Prewarm(nil)
+			fetched <- result.Fetched
+			return err
+		}),
+	})
+	defer mgo.SetMonitor(nil)
+
+	// Warm up the primary once discovered by a new cluster.
+	other, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer other.Close()
+
+	select {
+	case n := <-fetched:
+		c.Assert(n, Equals, 1)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("primary not warmed up")
+	}
+}
@@ -0,0 +1,296 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyDialer establishes connections to servers through a SOCKS5 or
+// HTTP CONNECT proxy.
+type proxyDialer struct {
+	addr     string
+	protocol string
+	username string
+	password string
+	timeout  time.Duration
+}
+
+func newProxyDialer(info *DialInfo) (*proxyDialer, error) {
+	port := info.ProxyPort
+	protocol := info.ProxyProtocol
+	switch protocol {
+	case "", "socks5":
+		protocol = "socks5"
+		if port == 0 {
+			port = 1080
+		}
+	case "http":
+		if port == 0 {
+			port = 8080
+		}
+	default:
+		return nil, errors.New("unsupported proxy protocol: " + protocol)
+	}
+	if info.ProxyPassword != "" && info.ProxyUsername == "" {
+		return nil, errors.New("proxy password provided without a username")
+	}
+	return &proxyDialer{
+		addr:     net.JoinHostPort(info.ProxyHost, strconv.Itoa(port)),
+		protocol: protocol,
+		username: info.ProxyUsername,
+		password: info.ProxyPassword,
+		timeout:  info.Timeout,
+	}, nil
+}
+
+// DialProxy establishes a connection to the server at addr through the
+// proxy set in info via ProxyHost and the related fields. It enables
+// DialServer functions to wrap proxied connections, such as for TLS:
+//
+//     info.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+//             conn, err := info.DialProxy(addr)
+//             if err != nil {
+//                     return nil, err
+//             }
+//             return tls.Client(conn, tlsConfig), nil
+//     }
+//
+// Since the proxy resolves server host names, addr.TCPAddr returns nil.
+func (info *DialInfo) DialProxy(addr *ServerAddr) (net.Conn, error) {
+	if info.ProxyHost == "" {
+		return nil, errors.New("DialInfo.ProxyHost is not set")
+	}
+	proxy, err := newProxyDialer(info)
+	if err != nil {
+		return nil, err
+	}
+	return proxy.dial(addr)
+}
+
+// dial connects to the server at addr through the proxy. The server
+// name is resolved by the proxy rather than locally.
+func (p *proxyDialer) dial(addr *ServerAddr) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", p.addr, p.timeout)
+	if err != nil {
+		return nil, err
+	}
+	if p.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(p.timeout))
+	}
+	if p.protocol == "http" {
+		err = p.httpConnect(conn, addr.String())
+	} else {
+		err = p.socks5Connect(conn, addr.String())
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %v", p.addr, err)
+	}
+	conn.SetDeadline(time.Time{})
+	if tcpconn, ok := conn.(*net.TCPConn); ok {
+		tcpconn.SetKeepAlive(true)
+	}
+	return conn, nil
+}
+
+const (
+	socks5Version        = 5
+	socks5NoAuth         = 0
+	socks5UserPass       = 2
+	socks5NoAcceptable   = 0xff
+	socks5Connect        = 1
+	socks5AddrIPv4       = 1
+	socks5AddrDomain     = 3
+	socks5AddrIPv6       = 4
+	socks5UserPassVer    = 1
+	socks5UserPassOkay   = 0
+	socks5ReplySucceeded = 0
+)
+
+var socks5Errors = []string{
+	"",
+	"general SOCKS server failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+// socks5Connect negotiates a connection to target over conn as
+// described in RFC 1928, authenticating as described in RFC 1929 if a
+// username is set.
+func (p *proxyDialer) socks5Connect(conn net.Conn, target string) error {
+	host, portstr, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portstr)
+	if err != nil || port < 1 || port > 0xffff {
+		return errors.New("invalid port in address: " + target)
+	}
+
+	buf := []byte{socks5Version, 1, socks5NoAuth}
+	if p.username != "" {
+		buf = []byte{socks5Version, 2, socks5NoAuth, socks5UserPass}
+	}
+	if _, err := conn.Write(buf); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+	switch reply[1] {
+	case socks5NoAuth:
+	case socks5UserPass:
+		if p.username == "" {
+			return errors.New("SOCKS server requires authentication")
+		}
+		if len(p.username) > 255 || len(p.password) > 255 {
+			return errors.New("SOCKS username or password too long")
+		}
+		buf = []byte{socks5UserPassVer, byte(len(p.username))}
+		buf = append(buf, p.username...)
+		buf = append(buf, byte(len(p.password)))
+		buf = append(buf, p.password...)
+		if _, err := conn.Write(buf); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != socks5UserPassOkay {
+			return errors.New("SOCKS authentication failed")
+		}
+	case socks5NoAcceptable:
+		return errors.New("no acceptable SOCKS authentication methods")
+	default:
+		return fmt.Errorf("unexpected SOCKS authentication method %d", reply[1])
+	}
+
+	buf = []byte{socks5Version, socks5Connect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("host name too long: " + host)
+		}
+		buf = append(buf, socks5AddrDomain, byte(len(host)))
+		buf = append(buf, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		buf = append(buf, socks5AddrIPv4)
+		buf = append(buf, ip4...)
+	} else {
+		buf = append(buf, socks5AddrIPv6)
+		buf = append(buf, ip.To16()...)
+	}
+	buf = append(buf, byte(port>>8), byte(port))
+	if _, err := conn.Write(buf); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[0] != socks5Version {
+		return fmt.Errorf("unexpected SOCKS version %d", header[0])
+	}
+	if code := int(header[1]); code != socks5ReplySucceeded {
+		if code < len(socks5Errors) {
+			return errors.New("SOCKS connect to " + target + " failed: " + socks5Errors[code])
+		}
+		return fmt.Errorf("SOCKS connect to %s failed with code %d", target, code)
+	}
+	var skip int
+	switch header[3] {
+	case socks5AddrIPv4:
+		skip = net.IPv4len
+	case socks5AddrIPv6:
+		skip = net.IPv6len
+	case socks5AddrDomain:
+		if _, err := io.ReadFull(conn, header[:1]); err != nil {
+			return err
+		}
+		skip = int(header[0])
+	default:
+		return fmt.Errorf("unexpected SOCKS address type %d", header[3])
+	}
+	// Discard the bound address and port.
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+// httpConnect establishes a tunnel to target over conn with an HTTP
+// CONNECT request.
+func (p *proxyDialer) httpConnect(conn net.Conn, target string) error {
+	req := "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n"
+	if p.username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(p.username + ":" + p.password))
+		req += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	req += "\r\n"
+	if _, err := io.WriteString(conn, req); err != nil {
+		return err
+	}
+
+	// Read the response header byte by byte, so that nothing past it
+	// is consumed from the tunnel.
+	var resp []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(resp, []byte("\r\n\r\n")) {
+		if len(resp) > 8192 {
+			return errors.New("HTTP proxy response header too long")
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return err
+		}
+		resp = append(resp, b[0])
+	}
+	status := string(resp[:bytes.IndexByte(resp, '\r')])
+	fields := strings.SplitN(status, " ", 3)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "HTTP/") {
+		return errors.New("malformed HTTP proxy response: " + status)
+	}
+	if fields[1] != "200" {
+		return errors.New("HTTP proxy CONNECT to " + target + " failed: " + strings.Join(fields[1:], " "))
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+)
+
+// startProxy starts a fake proxy on a random local port that serves each
+// connection with handshake and then tunnels it to the returned target.
+func startProxy(c *C, handshake func(conn net.Conn, r *bufio.Reader) (target string, ok bool)) (addr string, stop func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				target, ok := handshake(conn, r)
+				if !ok {
+					return
+				}
+				server, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer server.Close()
+				go io.Copy(server, r)
+				io.Copy(conn, server)
+			}()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func socks5Handshake(conn net.Conn, r *bufio.Reader) (string, bool) {
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return "", false
+	}
+	methods := make([]byte, buf[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return "", false
+	}
+	conn.Write([]byte{5, 0})
+	if _, err := io.ReadFull(r, buf[:3]); err != nil || buf[1] != 1 {
+		return "", false
+	}
+	atyp, _ := r.ReadByte()
+	var host string
+	switch atyp {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(r, ip)
+		host = net.IP(ip).String()
+	case 3:
+		n, _ := r.ReadByte()
+		name := make([]byte, n)
+		io.ReadFull(r, name)
+		host = string(name)
+	default:
+		conn.Write([]byte{5, 8, 0, 1, 0, 0, 0, 0, 0, 0})
+		return "", false
+	}
+	port := make([]byte, 2)
+	io.ReadFull(r, port)
+	conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), true
+}
+
+func httpConnectHandshake(conn net.Conn, r *bufio.Reader) (string, bool) {
+	req, err := http.ReadRequest(r)
+	if err != nil || req.Method != "CONNECT" {
+		return "", false
+	}
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	return req.Host, true
+}
+
+func (s *S) TestDialSOCKS5Proxy(c *C) {
+	addr, stop := startProxy(c, socks5Handshake)
+	defer stop()
+	host, port, _ := net.SplitHostPort(addr)
+
+	session, err := mgo.Dial("localhost:40001?proxyHost=" + host + "&proxyPort=" + port)
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	err = session.Ping()
+	c.Assert(err, IsNil)
+}
+
+func (s *S) TestDialHTTPProxy(c *C) {
+	addr, stop := startProxy(c, httpConnectHandshake)
+	defer stop()
+	host, port, _ := net.SplitHostPort(addr)
+
+	session, err := mgo.Dial("localhost:40001?proxyProtocol=http&proxyHost=" + host + "&proxyPort=" + port)
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	err = session.Ping()
+	c.Assert(err, IsNil)
+}
+
+func (s *S) TestProxyResolvesHost(c *C) {
+	// The .invalid name never resolves locally, so the dial only works
+	// if the host name is left for the proxy to resolve.
+	addr, stop := startProxy(c, func(conn net.Conn, r *bufio.Reader) (string, bool) {
+		target, ok := socks5Handshake(conn, r)
+		return strings.Replace(target, "mongo.invalid", "localhost", 1), ok
+	})
+	defer stop()
+	host, port, _ := net.SplitHostPort(addr)
+
+	session, err := mgo.Dial("mongo.invalid:40001?connect=direct&proxyHost=" + host + "&proxyPort=" + port)
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	err = session.Ping()
+	c.Assert(err, IsNil)
+	c.Assert(session.LiveServers(), DeepEquals, []string{"mongo.invalid:40001"})
+}
+
+func (s *S) TestDialServerViaProxy(c *C) {
+	addr, stop := startProxy(c, socks5Handshake)
+	defer stop()
+	host, port, _ := net.SplitHostPort(addr)
+	portnum, _ := strconv.Atoi(port)
+
+	var m sync.Mutex
+	var dialed []string
+	info := &mgo.DialInfo{
+		Addrs:     []string{"localhost:40001"},
+		Direct:    true,
+		Timeout:   5 * time.Second,
+		ProxyHost: host,
+		ProxyPort: portnum,
+	}
+	info.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+		// Wrapping the connection, as done for TLS.
+		m.Lock()
+		dialed = append(dialed, addr.String())
+		m.Unlock()
+		return info.DialProxy(addr)
+	}
+	session, err := mgo.DialWithInfo(info)
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	err = session.Ping()
+	c.Assert(err, IsNil)
+	m.Lock()
+	c.Assert(len(dialed) > 0, Equals, true)
+	c.Assert(dialed[0], Equals, "localhost:40001")
+	m.Unlock()
+
+	_, err = (&mgo.DialInfo{}).DialProxy(nil)
+	c.Assert(err, ErrorMatches, "DialInfo.ProxyHost is not set")
+}
+
+func (s *S) TestProxyURLOptions(c *C) {
+	info, err := mgo.ParseURL("localhost:40001?proxyHost=proxy&proxyPort=3128&proxyUsername=u&proxyPassword=p&proxyProtocol=http")
+	c.Assert(err, IsNil)
+	c.Assert(info.ProxyHost, Equals, "proxy")
+	c.Assert(info.ProxyPort, Equals, 3128)
+	c.Assert(info.ProxyUsername, Equals, "u")
+	c.Assert(info.ProxyPassword, Equals, "p")
+	c.Assert(info.ProxyProtocol, Equals, "http")
+
+	_, err = mgo.ParseURL("localhost:40001?proxyHost=proxy&proxyPort=0")
+	c.Assert(err, ErrorMatches, "bad value for proxyPort: 0")
+	_, err = mgo.ParseURL("localhost:40001?proxyHost=proxy&proxyProtocol=socks4")
+	c.Assert(err, ErrorMatches, "bad value for proxyProtocol: socks4")
+	_, err = mgo.ParseURL("localhost:40001?proxyPort=1080")
+	c.Assert(err, ErrorMatches, "proxy options require proxyHost")
+}
+
+func (s *S) TestProxyFailure(c *C) {
+	addr, stop := startProxy(c, func(conn net.Conn, r *bufio.Reader) (string, bool) {
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return "", false
+	})
+	defer stop()
+	host, port, _ := net.SplitHostPort(addr)
+	portnum, _ := strconv.Atoi(port)
+
+	info := &mgo.DialInfo{
+		Addrs:         []string{"localhost:40001"},
+		Timeout:       2 * time.Second,
+		FailFast:      true,
+		ProxyHost:     host,
+		ProxyPort:     portnum,
+		ProxyProtocol: "http",
+	}
+	_, err := mgo.DialWithInfo(info)
+	c.Assert(err, ErrorMatches, "no reachable servers")
+	c.Assert(c.GetTestLog(), Matches, "(?s).*HTTP proxy CONNECT to localhost:40001 failed: 407 Proxy Authentication Required.*")
+}
@@ -0,0 +1,561 @@
+// The pseudonym package implements deterministic pseudonymization of
+// identifier fields, for analytics replicas and exports that must not
+// hold raw personal data but still need to join and group on it.
+//
+// A Pseudonymizer replaces the values of selected fields with a keyed
+// hash of them. The same value always maps into the same pseudonym
+// under the same key, so equality filters, joins, and group stages keep
+// working on the pseudonymized data:
+//
+//     p := pseudonym.New(key, "email", "phone", "contacts.email")
+//     replica := p.C(session.DB("analytics").C("users"))
+//     err := replica.Insert(bson.M{"email": "joe@example.com", "plan": "pro"})
+//     query, err := replica.Find(bson.M{"email": "joe@example.com"})
+//
+// Copying data from a source holding the raw values is done by reading
+// it through Iter:
+//
+//     iter := p.Iter(source.Find(nil).Iter())
+//     var doc bson.M
+//     for iter.Next(&doc) {
+//         err = replica.Collection.Insert(doc)
+//     }
+//
+// The key must be kept secret, as anyone holding it may recover the
+// original values by hashing candidates for them.
+//
+package pseudonym
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Pseudonymizer rewrites the values of a set of fields into keyed hashes
+// of them.
+type Pseudonymizer struct {
+	key    []byte
+	fields map[string]bool
+}
+
+// New returns a Pseudonymizer that hashes the values of the given fields
+// with HMAC-SHA256 under key.
+//
+// Fields are dotted paths, as in "user.email". Paths cross arrays without
+// mentioning their indexes, so "contacts.email" refers to the email field
+// of every document in the contacts array. When the value of a field is
+// itself an array, each of its elements is hashed separately.
+func New(key []byte, fields ...string) *Pseudonymizer {
+	p := &Pseudonymizer{key: key, fields: make(map[string]bool, len(fields))}
+	for _, field := range fields {
+		p.fields[field] = true
+	}
+	return p
+}
+
+// fieldPath returns path without array indexes and positional operators,
+// so that it may be compared with the configured fields.
+func fieldPath(path string) string {
+	parts := strings.Split(path, ".")
+	n := 0
+	for _, part := range parts {
+		if isIndex(part) || strings.HasPrefix(part, "$") {
+			continue
+		}
+		parts[n] = part
+		n++
+	}
+	return strings.Join(parts[:n], ".")
+}
+
+func isIndex(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *Pseudonymizer) match(path string) bool {
+	return p.fields[fieldPath(path)]
+}
+
+// Hash returns the pseudonym for value v, as it's stored in place of v
+// in pseudonymized documents.
+//
+// The hash covers the BSON type of v, so values of distinct types never
+// share a pseudonym. In particular, int64(1) and int32(1) are hashed
+// differently, and Go int values are hashed as either depending on
+// whether they fit in 32 bits, as they are marshalled.
+func (p *Pseudonymizer) Hash(v interface{}) (string, error) {
+	raw, err := rawValue(v)
+	if err != nil {
+		return "", err
+	}
+	return p.hash(raw), nil
+}
+
+func (p *Pseudonymizer) hash(v bson.Raw) string {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte{v.Kind})
+	mac.Write(v.Data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func rawValue(v interface{}) (bson.Raw, error) {
+	data, err := bson.Marshal(bson.D{{"v", v}})
+	if err != nil {
+		return bson.Raw{}, err
+	}
+	var doc struct{ V bson.Raw }
+	err = bson.Unmarshal(data, &doc)
+	return doc.V, err
+}
+
+// value returns the pseudonymized form of v. Null values are preserved
+// so that missing and null fields keep their meaning, and arrays have
+// each of their elements hashed.
+func (p *Pseudonymizer) value(v bson.Raw) (bson.Raw, error) {
+	switch v.Kind {
+	case 0x06, 0x0A:
+		return v, nil
+	case 0x04:
+		var elems bson.RawD
+		if err := bson.Unmarshal(v.Data, &elems); err != nil {
+			return v, err
+		}
+		for i := range elems {
+			value, err := p.value(elems[i].Value)
+			if err != nil {
+				return v, err
+			}
+			elems[i].Value = value
+		}
+		data, err := bson.Marshal(elems)
+		return bson.Raw{Kind: 0x04, Data: data}, err
+	}
+	return rawValue(p.hash(v))
+}
+
+// Document returns a copy of doc with the configured fields pseudonymized.
+func (p *Pseudonymizer) Document(doc interface{}) (bson.Raw, error) {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return bson.Raw{}, err
+	}
+	data, err = p.rewrite(data, "")
+	if err != nil {
+		return bson.Raw{}, err
+	}
+	return bson.Raw{Kind: 0x03, Data: data}, nil
+}
+
+func (p *Pseudonymizer) rewrite(data []byte, prefix string) ([]byte, error) {
+	var elems bson.RawD
+	if err := bson.Unmarshal(data, &elems); err != nil {
+		return nil, err
+	}
+	for i := range elems {
+		elem := &elems[i]
+		path := prefix + elem.Name
+		var err error
+		if p.match(path) {
+			elem.Value, err = p.value(elem.Value)
+		} else if elem.Value.Kind == 0x03 || elem.Value.Kind == 0x04 {
+			elem.Value.Data, err = p.rewrite(elem.Value.Data, path+".")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bson.Marshal(elems)
+}
+
+// Filter returns a copy of the query filter with the values compared
+// against the configured fields pseudonymized, so that it matches the
+// documents those values were pseudonymized in.
+//
+// Only equality, $ne, $in, $nin, $all, $exists and $type conditions may
+// be applied to pseudonymized fields, as ordering and pattern matching
+// are meaningless on hashes. Filter returns an error for other conditions.
+func (p *Pseudonymizer) Filter(query interface{}) (interface{}, error) {
+	if query == nil {
+		return nil, nil
+	}
+	data, err := bson.Marshal(query)
+	if err != nil {
+		return nil, err
+	}
+	data, err = p.filter(data, "")
+	if err != nil {
+		return nil, err
+	}
+	return bson.Raw{Kind: 0x03, Data: data}, nil
+}
+
+func (p *Pseudonymizer) filter(data []byte, prefix string) ([]byte, error) {
+	var elems bson.RawD
+	if err := bson.Unmarshal(data, &elems); err != nil {
+		return nil, err
+	}
+	for i := range elems {
+		elem := &elems[i]
+		var err error
+		switch {
+		case elem.Name == "$and" || elem.Name == "$or" || elem.Name == "$nor":
+			elem.Value.Data, err = p.clauses(elem.Value.Data, prefix)
+		case strings.HasPrefix(elem.Name, "$"):
+		case p.match(prefix + elem.Name):
+			elem.Value, err = p.condition(prefix+elem.Name, elem.Value)
+		case isOperators(elem.Value):
+			elem.Value.Data, err = p.operators(elem.Value.Data, prefix+elem.Name)
+		case elem.Value.Kind == 0x03 || elem.Value.Kind == 0x04:
+			elem.Value.Data, err = p.rewrite(elem.Value.Data, prefix+elem.Name+".")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bson.Marshal(elems)
+}
+
+// clauses rewrites the array of filters provided to $and, $or or $nor.
+func (p *Pseudonymizer) clauses(data []byte, prefix string) ([]byte, error) {
+	var elems bson.RawD
+	if err := bson.Unmarshal(data, &elems); err != nil {
+		return nil, err
+	}
+	for i := range elems {
+		if elems[i].Value.Kind != 0x03 {
+			continue
+		}
+		var err error
+		elems[i].Value.Data, err = p.filter(elems[i].Value.Data, prefix)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bson.Marshal(elems)
+}
+
+// isOperators returns whether v is a document of query operators, such
+// as {$in: [...]}, rather than a document to be matched for equality.
+func isOperators(v bson.Raw) bool {
+	if v.Kind != 0x03 {
+		return false
+	}
+	var elems bson.RawD
+	if err := bson.Unmarshal(v.Data, &elems); err != nil || len(elems) == 0 {
+		return false
+	}
+	return strings.HasPrefix(elems[0].Name, "$")
+}
+
+// operators rewrites the conditions on path, which isn't pseudonymized
+// itself but may hold pseudonymized fields within.
+func (p *Pseudonymizer) operators(data []byte, path string) ([]byte, error) {
+	var elems bson.RawD
+	if err := bson.Unmarshal(data, &elems); err != nil {
+		return nil, err
+	}
+	for i := range elems {
+		elem := &elems[i]
+		if elem.Value.Kind != 0x03 && elem.Value.Kind != 0x04 {
+			continue
+		}
+		var err error
+		switch elem.Name {
+		case "$elemMatch":
+			elem.Value.Data, err = p.filter(elem.Value.Data, path+".")
+		case "$not":
+			elem.Value.Data, err = p.operators(elem.Value.Data, path)
+		case "$eq", "$ne", "$in", "$nin", "$all":
+			elem.Value.Data, err = p.rewrite(elem.Value.Data, path+".")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bson.Marshal(elems)
+}
+
+// condition pseudonymizes the condition v on the pseudonymized path.
+func (p *Pseudonymizer) condition(path string, v bson.Raw) (bson.Raw, error) {
+	if v.Kind == 0x0B {
+		return v, fmt.Errorf("pseudonym: cannot match %s against a regular expression", path)
+	}
+	if !isOperators(v) {
+		return p.value(v)
+	}
+	var elems bson.RawD
+	if err := bson.Unmarshal(v.Data, &elems); err != nil {
+		return v, err
+	}
+	for i := range elems {
+		elem := &elems[i]
+		var err error
+		switch elem.Name {
+		case "$eq", "$ne", "$in", "$nin", "$all":
+			elem.Value, err = p.value(elem.Value)
+		case "$not":
+			elem.Value, err = p.condition(path, elem.Value)
+		case "$exists", "$type":
+		default:
+			err = fmt.Errorf("pseudonym: cannot apply %s to %s", elem.Name, path)
+		}
+		if err != nil {
+			return v, err
+		}
+	}
+	data, err := bson.Marshal(elems)
+	return bson.Raw{Kind: 0x03, Data: data}, err
+}
+
+// Update returns a copy of the update document with the values assigned
+// to the configured fields pseudonymized.
+//
+// Replacement documents are pseudonymized as a whole. Values provided to
+// the $set, $setOnInsert, $push and $addToSet operators are pseudonymized,
+// and other operators are passed through unchanged.
+func (p *Pseudonymizer) Update(update interface{}) (interface{}, error) {
+	data, err := bson.Marshal(update)
+	if err != nil {
+		return nil, err
+	}
+	var elems bson.RawD
+	if err := bson.Unmarshal(data, &elems); err != nil {
+		return nil, err
+	}
+	if len(elems) == 0 || !strings.HasPrefix(elems[0].Name, "$") {
+		return p.Document(update)
+	}
+	for i := range elems {
+		elem := &elems[i]
+		switch elem.Name {
+		case "$set", "$setOnInsert":
+			elem.Value.Data, err = p.rewrite(elem.Value.Data, "")
+		case "$push", "$addToSet":
+			elem.Value.Data, err = p.push(elem.Value.Data)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	data, err = bson.Marshal(elems)
+	if err != nil {
+		return nil, err
+	}
+	return bson.Raw{Kind: 0x03, Data: data}, nil
+}
+
+// push rewrites the fields of a $push or $addToSet operator, which push
+// either a single value or all of those in an $each modifier.
+func (p *Pseudonymizer) push(data []byte) ([]byte, error) {
+	var elems bson.RawD
+	if err := bson.Unmarshal(data, &elems); err != nil {
+		return nil, err
+	}
+	for i := range elems {
+		elem := &elems[i]
+		var err error
+		switch {
+		case p.match(elem.Name) && isOperators(elem.Value):
+			elem.Value.Data, err = p.each(elem.Value.Data)
+		case p.match(elem.Name):
+			elem.Value, err = p.value(elem.Value)
+		case elem.Value.Kind == 0x03 || elem.Value.Kind == 0x04:
+			elem.Value.Data, err = p.rewrite(elem.Value.Data, elem.Name+".")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bson.Marshal(elems)
+}
+
+// each pseudonymizes the values in the $each modifier of a $push or
+// $addToSet operator, leaving other modifiers unchanged.
+func (p *Pseudonymizer) each(data []byte) ([]byte, error) {
+	var mods bson.RawD
+	if err := bson.Unmarshal(data, &mods); err != nil {
+		return nil, err
+	}
+	for i := range mods {
+		if mods[i].Name != "$each" {
+			continue
+		}
+		value, err := p.value(mods[i].Value)
+		if err != nil {
+			return nil, err
+		}
+		mods[i].Value = value
+	}
+	return bson.Marshal(mods)
+}
+
+// C returns a value wrapping c so that documents written through it are
+// pseudonymized, and filters used to read them match the pseudonyms.
+func (p *Pseudonymizer) C(c *mgo.Collection) *Collection {
+	return &Collection{Collection: c, p: p}
+}
+
+// Collection wraps an mgo.Collection holding pseudonymized documents.
+//
+// Only the methods defined on Collection itself pseudonymize their
+// arguments. The underlying mgo.Collection is exposed for other
+// operations, and documents read through either are returned as
+// stored, with their pseudonyms.
+type Collection struct {
+	*mgo.Collection
+
+	p *Pseudonymizer
+}
+
+// Insert works like mgo.Collection.Insert, but pseudonymizes the
+// provided documents before inserting them.
+func (c *Collection) Insert(docs ...interface{}) error {
+	pdocs := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		pdoc, err := c.p.Document(doc)
+		if err != nil {
+			return err
+		}
+		pdocs[i] = pdoc
+	}
+	return c.Collection.Insert(pdocs...)
+}
+
+// Find works like mgo.Collection.Find, but pseudonymizes the values
+// the query compares pseudonymized fields against.
+func (c *Collection) Find(query interface{}) (*mgo.Query, error) {
+	query, err := c.p.Filter(query)
+	if err != nil {
+		return nil, err
+	}
+	return c.Collection.Find(query), nil
+}
+
+// Update works like mgo.Collection.Update, but pseudonymizes both the
+// selector and the update document.
+func (c *Collection) Update(selector interface{}, update interface{}) error {
+	selector, update, err := c.prepare(selector, update)
+	if err != nil {
+		return err
+	}
+	return c.Collection.Update(selector, update)
+}
+
+// UpdateAll works like mgo.Collection.UpdateAll, but pseudonymizes both
+// the selector and the update document.
+func (c *Collection) UpdateAll(selector interface{}, update interface{}) (info *mgo.ChangeInfo, err error) {
+	selector, update, err = c.prepare(selector, update)
+	if err != nil {
+		return nil, err
+	}
+	return c.Collection.UpdateAll(selector, update)
+}
+
+// Upsert works like mgo.Collection.Upsert, but pseudonymizes both the
+// selector and the update document.
+func (c *Collection) Upsert(selector interface{}, update interface{}) (info *mgo.ChangeInfo, err error) {
+	selector, update, err = c.prepare(selector, update)
+	if err != nil {
+		return nil, err
+	}
+	return c.Collection.Upsert(selector, update)
+}
+
+func (c *Collection) prepare(selector, update interface{}) (interface{}, interface{}, error) {
+	selector, err := c.p.Filter(selector)
+	if err != nil {
+		return nil, nil, err
+	}
+	update, err = c.p.Update(update)
+	if err != nil {
+		return nil, nil, err
+	}
+	return selector, update, nil
+}
+
+// Remove works like mgo.Collection.Remove, but pseudonymizes the
+// values the selector compares pseudonymized fields against.
+func (c *Collection) Remove(selector interface{}) error {
+	selector, err := c.p.Filter(selector)
+	if err != nil {
+		return err
+	}
+	return c.Collection.Remove(selector)
+}
+
+// RemoveAll works like mgo.Collection.RemoveAll, but pseudonymizes the
+// values the selector compares pseudonymized fields against.
+func (c *Collection) RemoveAll(selector interface{}) (info *mgo.ChangeInfo, err error) {
+	selector, err = c.p.Filter(selector)
+	if err != nil {
+		return nil, err
+	}
+	return c.Collection.RemoveAll(selector)
+}
+
+// Iter returns an iterator that pseudonymizes the documents read
+// from iter before unmarshalling them.
+func (p *Pseudonymizer) Iter(iter *mgo.Iter) *Iter {
+	return &Iter{iter: iter, p: p}
+}
+
+// Iter iterates over documents of a result set, pseudonymizing them.
+type Iter struct {
+	iter *mgo.Iter
+	p    *Pseudonymizer
+	err  error
+}
+
+// Next works like mgo.Iter.Next, but pseudonymizes the document before
+// unmarshalling it into result.
+func (iter *Iter) Next(result interface{}) bool {
+	if iter.err != nil {
+		return false
+	}
+	var raw bson.Raw
+	if !iter.iter.Next(&raw) {
+		return false
+	}
+	data, err := iter.p.rewrite(raw.Data, "")
+	if err == nil {
+		err = bson.Unmarshal(data, result)
+	}
+	if err != nil {
+		iter.err = err
+		return false
+	}
+	return true
+}
+
+// Err returns nil if no errors happened during iteration, or the actual
+// error otherwise.
+func (iter *Iter) Err() error {
+	if iter.err != nil {
+		return iter.err
+	}
+	return iter.iter.Err()
+}
+
+// Close kills the server cursor used by the iterator, if any, and returns
+// nil if no errors happened during iteration, or the actual error otherwise.
+func (iter *Iter) Close() error {
+	err := iter.iter.Close()
+	if iter.err != nil {
+		return iter.err
+	}
+	return err
+}
@@ -0,0 +1,133 @@
+package pseudonym
+
+import (
+	"testing"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestAll(t *testing.T) {
+	TestingT(t)
+}
+
+type PseudonymSuite struct{}
+
+var _ = Suite(&PseudonymSuite{})
+
+// unmarshal returns the document in v, as returned along with err
+// by the pseudonymizing functions.
+func unmarshal(v interface{}, err error) bson.M {
+	if err != nil {
+		panic(err)
+	}
+	var doc bson.M
+	if err := v.(bson.Raw).Unmarshal(&doc); err != nil {
+		panic(err)
+	}
+	return doc
+}
+
+func (s *PseudonymSuite) TestHash(c *C) {
+	p := New([]byte("key"), "email")
+	h1, err := p.Hash("joe@example.com")
+	c.Assert(err, IsNil)
+	c.Assert(h1, HasLen, 64)
+	h2, err := p.Hash("joe@example.com")
+	c.Assert(err, IsNil)
+	c.Assert(h2, Equals, h1)
+
+	h3, err := New([]byte("other"), "email").Hash("joe@example.com")
+	c.Assert(err, IsNil)
+	c.Assert(h3, Not(Equals), h1)
+
+	h4, err := p.Hash(int64(1))
+	c.Assert(err, IsNil)
+	h5, err := p.Hash(int32(1))
+	c.Assert(err, IsNil)
+	c.Assert(h4, Not(Equals), h5)
+}
+
+func (s *PseudonymSuite) TestDocument(c *C) {
+	p := New([]byte("key"), "email", "tags", "contacts.email", "user.id")
+	email, _ := p.Hash("joe@example.com")
+	other, _ := p.Hash("ann@example.com")
+	tag, _ := p.Hash("vip")
+	id, _ := p.Hash(42)
+
+	doc := unmarshal(p.Document(bson.M{
+		"email":    "joe@example.com",
+		"plan":     "pro",
+		"tags":     []string{"vip"},
+		"contacts": []bson.M{{"email": "ann@example.com", "kind": "work"}},
+		"user":     bson.M{"id": 42, "name": "Joe"},
+		"phone":    nil,
+	}))
+	c.Assert(doc["email"], Equals, email)
+	c.Assert(doc["plan"], Equals, "pro")
+	c.Assert(doc["tags"], DeepEquals, []interface{}{tag})
+	c.Assert(doc["contacts"], DeepEquals, []interface{}{bson.M{"email": other, "kind": "work"}})
+	c.Assert(doc["user"], DeepEquals, bson.M{"id": id, "name": "Joe"})
+	c.Assert(doc["phone"], IsNil)
+
+	doc = unmarshal(p.Document(bson.M{"email": nil}))
+	c.Assert(doc, DeepEquals, bson.M{"email": nil})
+}
+
+func (s *PseudonymSuite) TestFilter(c *C) {
+	p := New([]byte("key"), "email", "contacts.email")
+	joe, _ := p.Hash("joe@example.com")
+	ann, _ := p.Hash("ann@example.com")
+
+	filter, err := p.Filter(nil)
+	c.Assert(err, IsNil)
+	c.Assert(filter, IsNil)
+
+	doc := unmarshal(p.Filter(bson.M{"email": "joe@example.com", "plan": "pro"}))
+	c.Assert(doc, DeepEquals, bson.M{"email": joe, "plan": "pro"})
+
+	doc = unmarshal(p.Filter(bson.M{"email": bson.M{"$in": []string{"joe@example.com", "ann@example.com"}, "$exists": true}}))
+	c.Assert(doc, DeepEquals, bson.M{"email": bson.M{"$in": []interface{}{joe, ann}, "$exists": true}})
+
+	doc = unmarshal(p.Filter(bson.M{"$or": []bson.M{{"email": "joe@example.com"}, {"contacts.email": "ann@example.com"}}}))
+	c.Assert(doc, DeepEquals, bson.M{"$or": []interface{}{bson.M{"email": joe}, bson.M{"contacts.email": ann}}})
+
+	doc = unmarshal(p.Filter(bson.M{"contacts": bson.M{"$elemMatch": bson.M{"email": bson.M{"$ne": "ann@example.com"}}}}))
+	c.Assert(doc, DeepEquals, bson.M{"contacts": bson.M{"$elemMatch": bson.M{"email": bson.M{"$ne": ann}}}})
+
+	_, err = p.Filter(bson.M{"email": bson.M{"$gt": "a"}})
+	c.Assert(err, ErrorMatches, "pseudonym: cannot apply \\$gt to email")
+	_, err = p.Filter(bson.M{"email": bson.RegEx{Pattern: "^joe"}})
+	c.Assert(err, ErrorMatches, "pseudonym: cannot match email against a regular expression")
+}
+
+func (s *PseudonymSuite) TestUpdate(c *C) {
+	p := New([]byte("key"), "email", "tags", "contacts.email")
+	joe, _ := p.Hash("joe@example.com")
+	ann, _ := p.Hash("ann@example.com")
+	vip, _ := p.Hash("vip")
+	fresh, _ := p.Hash("new")
+
+	doc := unmarshal(p.Update(bson.M{"email": "joe@example.com", "plan": "pro"}))
+	c.Assert(doc, DeepEquals, bson.M{"email": joe, "plan": "pro"})
+
+	doc = unmarshal(p.Update(bson.M{
+		"$set":      bson.M{"email": "joe@example.com", "contacts.0.email": "ann@example.com"},
+		"$inc":      bson.M{"visits": 1},
+		"$addToSet": bson.M{"tags": "vip"},
+	}))
+	c.Assert(doc, DeepEquals, bson.M{
+		"$set":      bson.M{"email": joe, "contacts.0.email": ann},
+		"$inc":      bson.M{"visits": 1},
+		"$addToSet": bson.M{"tags": vip},
+	})
+
+	doc = unmarshal(p.Update(bson.M{"$push": bson.M{
+		"tags":     bson.M{"$each": []string{"vip", "new"}, "$slice": -5},
+		"contacts": bson.M{"$each": []bson.M{{"email": "ann@example.com"}}},
+	}}))
+	c.Assert(doc, DeepEquals, bson.M{"$push": bson.M{
+		"tags":     bson.M{"$each": []interface{}{vip, fresh}, "$slice": -5},
+		"contacts": bson.M{"$each": []interface{}{bson.M{"email": ann}}},
+	}})
+}
@@ -0,0 +1,156 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Purge holds settings for deleting documents via Collection.Purge.
+// Zero values select the defaults documented for each field.
+type Purge struct {
+	// BatchSize is the maximum number of documents deleted at once.
+	// Defaults to 100.
+	BatchSize int
+
+	// Pause is how long to wait between batches, to let secondaries
+	// and the server's cache catch up. Defaults to one second, and
+	// negative values disable pausing.
+	Pause time.Duration
+
+	// Window, if set, reports whether deleting is allowed at the given
+	// time, such as during off-peak hours. Outside of the window, the
+	// purge is suspended and resumed once the window opens again. See
+	// DailyWindow.
+	Window func(now time.Time) bool
+
+	// Progress, if set, is called with the totals so far after every
+	// batch is deleted.
+	Progress func(result PurgeResult)
+}
+
+// PurgeResult holds the outcome of deleting documents via Collection.Purge.
+type PurgeResult struct {
+	Removed int // Number of documents removed
+	Batches int // Number of batches deleted
+}
+
+// purgeWindowPoll is how often Purge checks whether a closed window
+// opened again.
+var purgeWindowPoll = time.Minute
+
+// Purge deletes the documents matching selector from the collection in
+// small batches, pausing between them, and optionally only within a time
+// window. This spreads mass deletes, such as purges of expired documents
+// that TTL indexes can't express, over time, to avoid the replication lag
+// and cache pressure that removing all documents at once would cause.
+//
+// Purge blocks until no documents match selector, so it's usually run in
+// its own goroutine. It stops early if the session's context is done (see
+// Session.WithContext). The result is returned even on errors.
+func (c *Collection) Purge(selector interface{}, settings *Purge) (*PurgeResult, error) {
+	var purge Purge
+	if settings != nil {
+		purge = *settings
+	}
+	if purge.BatchSize <= 0 {
+		purge.BatchSize = 100
+	}
+	if purge.Pause == 0 {
+		purge.Pause = time.Second
+	}
+	if selector == nil {
+		selector = bson.D{}
+	}
+
+	ctx := c.Database.Session.Context()
+	var result PurgeResult
+	for {
+		for purge.Window != nil && !purge.Window(time.Now()) {
+			select {
+			case <-ctx.Done():
+				return &result, ctx.Err()
+			case <-time.After(purgeWindowPoll):
+			}
+		}
+
+		var docs []struct {
+			Id interface{} "_id"
+		}
+		err := c.Find(selector).Select(bson.D{{"_id", 1}}).Limit(purge.BatchSize).All(&docs)
+		if err != nil || len(docs) == 0 {
+			return &result, err
+		}
+		ids := make([]interface{}, len(docs))
+		for i, doc := range docs {
+			ids[i] = doc.Id
+		}
+
+		remove := bson.D{{"$and", []interface{}{selector, bson.D{{"_id", bson.D{{"$in", ids}}}}}}}
+		info, err := c.RemoveAll(remove)
+		if info != nil {
+			result.Removed += info.Removed
+		}
+		if err != nil {
+			return &result, err
+		}
+		result.Batches++
+		if purge.Progress != nil {
+			purge.Progress(result)
+		}
+
+		if purge.Pause > 0 {
+			select {
+			case <-ctx.Done():
+				return &result, ctx.Err()
+			case <-time.After(purge.Pause):
+			}
+		}
+	}
+}
+
+// DailyWindow returns a function for Purge.Window that allows purging
+// every day from the time of day start until the time of day end, both
+// measured since midnight in the local time zone. Windows with end before
+// start span midnight.
+//
+// For example, the following window spans from 10pm to 6am:
+//
+//     DailyWindow(22*time.Hour, 6*time.Hour)
+//
+func DailyWindow(start, end time.Duration) func(now time.Time) bool {
+	return func(now time.Time) bool {
+		y, m, d := now.Date()
+		sinceMidnight := now.Sub(time.Date(y, m, d, 0, 0, 0, 0, now.Location()))
+		if start <= end {
+			return sinceMidnight >= start && sinceMidnight < end
+		}
+		return sinceMidnight >= start || sinceMidnight < end
+	}
+}
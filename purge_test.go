@@ -0,0 +1,101 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo_test
+
+import (
+	"context"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+)
+
+func (s *S) TestPurge(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	for i := 0; i < 250; i++ {
+		err = coll.Insert(M{"_id": i, "old": i%5 != 0})
+		c.Assert(err, IsNil)
+	}
+
+	var progress []mgo.PurgeResult
+	start := time.Now()
+	result, err := coll.Purge(M{"old": true}, &mgo.Purge{
+		BatchSize: 60,
+		Pause:     50 * time.Millisecond,
+		Progress: func(result mgo.PurgeResult) {
+			progress = append(progress, result)
+		},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(*result, Equals, mgo.PurgeResult{Removed: 200, Batches: 4})
+	c.Assert(progress, HasLen, 4)
+	c.Assert(progress[0], Equals, mgo.PurgeResult{Removed: 60, Batches: 1})
+	c.Assert(time.Since(start) >= 200*time.Millisecond, Equals, true)
+
+	n, err := coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 50)
+
+	// Nothing is deleted while the window is closed.
+	restore := mgo.HackPurgeWindowPoll(10 * time.Millisecond)
+	defer restore()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	bound := session.WithContext(ctx)
+	defer bound.Close()
+	closed := func(now time.Time) bool { return false }
+	result, err = coll.With(bound).Purge(nil, &mgo.Purge{Window: closed})
+	c.Assert(err, Equals, context.DeadlineExceeded)
+	c.Assert(*result, Equals, mgo.PurgeResult{})
+	n, err = coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 50)
+}
+
+func (s *S) TestDailyWindow(c *C) {
+	at := func(hour, min int) time.Time {
+		return time.Date(2020, 1, 1, hour, min, 0, 0, time.Local)
+	}
+
+	window := mgo.DailyWindow(2*time.Hour, 5*time.Hour+30*time.Minute)
+	c.Assert(window(at(1, 59)), Equals, false)
+	c.Assert(window(at(2, 0)), Equals, true)
+	c.Assert(window(at(5, 29)), Equals, true)
+	c.Assert(window(at(5, 30)), Equals, false)
+
+	// Windows may span midnight.
+	window = mgo.DailyWindow(22*time.Hour, 6*time.Hour)
+	c.Assert(window(at(21, 59)), Equals, false)
+	c.Assert(window(at(23, 0)), Equals, true)
+	c.Assert(window(at(0, 0)), Equals, true)
+	c.Assert(window(at(5, 59)), Equals, true)
+	c.Assert(window(at(6, 0)), Equals, false)
+}
@@ -0,0 +1,222 @@
+// The queue package implements a job queue backed by a MongoDB
+// collection.
+//
+// Reserved jobs become invisible to other consumers for a visibility
+// timeout. Jobs that are not acknowledged before the timeout elapses
+// become visible again and are redelivered, so consumers must be
+// prepared to process the same job more than once. Jobs that fail to
+// be acknowledged too many times are moved into a dead-letter
+// collection for later inspection.
+//
+//     q := queue.New(session.DB("app").C("jobs"))
+//     job, err := q.Reserve()
+//     if err == queue.ErrEmpty {
+//         return
+//     }
+//     ...
+//     err = job.Ack()
+//
+package queue
+
+import (
+	"errors"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	// ErrEmpty is returned by Reserve when no jobs are available.
+	ErrEmpty = errors.New("no jobs available")
+
+	// ErrLost is returned when acting on a reservation that has
+	// expired, and thus the job may have been reserved by another
+	// consumer in the meantime.
+	ErrLost = errors.New("job reservation lost")
+)
+
+// Queue is a job queue stored in a MongoDB collection.
+type Queue struct {
+	c    *mgo.Collection
+	dead *mgo.Collection
+
+	// Visibility defines for how long reserved jobs are hidden from
+	// other consumers. Defaults to 30 seconds.
+	Visibility time.Duration
+
+	// MaxAttempts defines how many times a job may be reserved before
+	// it's moved into the dead-letter collection. Zero means jobs are
+	// retried forever. Defaults to 5.
+	MaxAttempts int
+}
+
+// Job is a unit of work reserved from a queue.
+type Job struct {
+	Id        bson.ObjectId `bson:"_id"`
+	Payload   bson.Raw      `bson:"p"`
+	Attempts  int           `bson:"a"`
+	Created   time.Time     `bson:"t"`
+	Available time.Time     `bson:"v"`
+	Error     string        `bson:"e,omitempty"`
+
+	Token bson.ObjectId `bson:"r,omitempty"`
+
+	q *Queue
+}
+
+// New returns a queue holding its jobs in c. A second collection with
+// the same name of c but suffixed by ".dead" will be used to hold jobs
+// that exceeded the maximum number of attempts.
+func New(c *mgo.Collection) *Queue {
+	return &Queue{
+		c:           c,
+		dead:        c.Database.C(c.Name + ".dead"),
+		Visibility:  30 * time.Second,
+		MaxAttempts: 5,
+	}
+}
+
+// EnsureIndex creates the index used to find available jobs.
+func (q *Queue) EnsureIndex() error {
+	return q.c.EnsureIndexKey("v")
+}
+
+// DeadLetter returns the collection holding jobs that exceeded the
+// maximum number of attempts.
+func (q *Queue) DeadLetter() *mgo.Collection {
+	return q.dead
+}
+
+// Enqueue adds a job with the given payload to the queue, available
+// for immediate reservation.
+func (q *Queue) Enqueue(payload interface{}) (bson.ObjectId, error) {
+	return q.EnqueueAt(payload, time.Now())
+}
+
+// EnqueueAt adds a job with the given payload to the queue, to become
+// available for reservation at the provided time.
+func (q *Queue) EnqueueAt(payload interface{}, at time.Time) (bson.ObjectId, error) {
+	id := bson.NewObjectId()
+	doc := bson.D{{"_id", id}, {"p", payload}, {"a", 0}, {"t", time.Now()}, {"v", at}}
+	if err := q.c.Insert(doc); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Reserve reserves the next available job in the queue, hiding it from
+// other consumers for the visibility timeout. ErrEmpty is returned if
+// no jobs are available.
+func (q *Queue) Reserve() (*Job, error) {
+	for {
+		now := time.Now()
+		token := bson.NewObjectId()
+		change := mgo.Change{
+			Update: bson.D{
+				{"$set", bson.D{{"v", now.Add(q.Visibility)}, {"r", token}}},
+				{"$inc", bson.D{{"a", 1}}},
+			},
+			ReturnNew: true,
+		}
+		job := &Job{q: q}
+		_, err := q.c.Find(bson.D{{"v", bson.D{{"$lte", now}}}}).Sort("v").Apply(change, job)
+		if err == mgo.ErrNotFound {
+			return nil, ErrEmpty
+		}
+		if err != nil {
+			return nil, err
+		}
+		if q.MaxAttempts > 0 && job.Attempts > q.MaxAttempts {
+			if err := job.bury(); err != nil && err != ErrLost {
+				return nil, err
+			}
+			continue
+		}
+		return job, nil
+	}
+}
+
+// Len returns the number of jobs in the queue, including reserved ones
+// and those that are not yet available.
+func (q *Queue) Len() (int, error) {
+	return q.c.Count()
+}
+
+func (j *Job) selector() bson.D {
+	return bson.D{{"_id", j.Id}, {"r", j.Token}}
+}
+
+// Unmarshal unmarshals the job payload into result.
+func (j *Job) Unmarshal(result interface{}) error {
+	return j.Payload.Unmarshal(result)
+}
+
+// Ack acknowledges the job was processed, removing it from the queue.
+func (j *Job) Ack() error {
+	err := j.q.c.Remove(j.selector())
+	if err == mgo.ErrNotFound {
+		return ErrLost
+	}
+	return err
+}
+
+// Extend extends the reservation of the job so that it stays hidden
+// from other consumers for d from now.
+func (j *Job) Extend(d time.Duration) error {
+	available := time.Now().Add(d)
+	err := j.q.c.Update(j.selector(), bson.D{{"$set", bson.D{{"v", available}}}})
+	if err == mgo.ErrNotFound {
+		return ErrLost
+	}
+	if err == nil {
+		j.Available = available
+	}
+	return err
+}
+
+// Release gives up the reservation of the job, making it available
+// again after delay. The provided error, if non-nil, is recorded in
+// the job for inspection.
+func (j *Job) Release(delay time.Duration, failure error) error {
+	set := bson.D{{"v", time.Now().Add(delay)}}
+	if failure != nil {
+		set = append(set, bson.DocElem{"e", failure.Error()})
+	}
+	err := j.q.c.Update(j.selector(), bson.D{{"$set", set}, {"$unset", bson.D{{"r", 1}}}})
+	if err == mgo.ErrNotFound {
+		return ErrLost
+	}
+	return err
+}
+
+// Bury moves the job into the dead-letter collection right away.
+func (j *Job) Bury(failure error) error {
+	if failure != nil {
+		j.Error = failure.Error()
+	}
+	return j.bury()
+}
+
+func (j *Job) bury() error {
+	doc := bson.D{
+		{"_id", j.Id},
+		{"p", j.Payload},
+		{"a", j.Attempts},
+		{"t", j.Created},
+		{"d", time.Now()},
+	}
+	if j.Error != "" {
+		doc = append(doc, bson.DocElem{"e", j.Error})
+	}
+	// Upsert so that a consumer dying between both steps doesn't
+	// prevent a later attempt from succeeding.
+	if _, err := j.q.dead.UpsertId(j.Id, doc); err != nil {
+		return err
+	}
+	err := j.q.c.Remove(j.selector())
+	if err == mgo.ErrNotFound {
+		return ErrLost
+	}
+	return err
+}
@@ -0,0 +1,160 @@
+package queue_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/dbtest"
+	"gopkg.in/mgo.v2/queue"
+)
+
+func TestAll(t *testing.T) {
+	TestingT(t)
+}
+
+type S struct {
+	server  dbtest.DBServer
+	session *mgo.Session
+	q       *queue.Queue
+}
+
+var _ = Suite(&S{})
+
+type M map[string]interface{}
+
+func (s *S) SetUpSuite(c *C) {
+	s.server.SetPath(c.MkDir())
+}
+
+func (s *S) TearDownSuite(c *C) {
+	s.server.Stop()
+}
+
+func (s *S) SetUpTest(c *C) {
+	s.server.Wipe()
+
+	s.session = s.server.Session()
+	s.q = queue.New(s.session.DB("test").C("jobs"))
+	c.Assert(s.q.EnsureIndex(), IsNil)
+}
+
+func (s *S) TearDownTest(c *C) {
+	s.session.Close()
+}
+
+func (s *S) TestEnqueueReserveAck(c *C) {
+	_, err := s.q.Reserve()
+	c.Assert(err, Equals, queue.ErrEmpty)
+
+	id1, err := s.q.Enqueue(M{"n": 1})
+	c.Assert(err, IsNil)
+	id2, err := s.q.Enqueue(M{"n": 2})
+	c.Assert(err, IsNil)
+
+	job, err := s.q.Reserve()
+	c.Assert(err, IsNil)
+	c.Assert(job.Id, Equals, id1)
+	c.Assert(job.Attempts, Equals, 1)
+	var payload struct{ N int }
+	c.Assert(job.Unmarshal(&payload), IsNil)
+	c.Assert(payload.N, Equals, 1)
+
+	job2, err := s.q.Reserve()
+	c.Assert(err, IsNil)
+	c.Assert(job2.Id, Equals, id2)
+
+	_, err = s.q.Reserve()
+	c.Assert(err, Equals, queue.ErrEmpty)
+
+	c.Assert(job.Ack(), IsNil)
+	c.Assert(job.Ack(), Equals, queue.ErrLost)
+
+	n, err := s.q.Len()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+}
+
+func (s *S) TestEnqueueAt(c *C) {
+	_, err := s.q.EnqueueAt(M{"n": 1}, time.Now().Add(time.Hour))
+	c.Assert(err, IsNil)
+	_, err = s.q.Reserve()
+	c.Assert(err, Equals, queue.ErrEmpty)
+}
+
+func (s *S) TestVisibilityTimeout(c *C) {
+	s.q.Visibility = 100 * time.Millisecond
+	id, err := s.q.Enqueue(M{"n": 1})
+	c.Assert(err, IsNil)
+
+	job1, err := s.q.Reserve()
+	c.Assert(err, IsNil)
+	_, err = s.q.Reserve()
+	c.Assert(err, Equals, queue.ErrEmpty)
+
+	time.Sleep(200 * time.Millisecond)
+
+	job2, err := s.q.Reserve()
+	c.Assert(err, IsNil)
+	c.Assert(job2.Id, Equals, id)
+	c.Assert(job2.Attempts, Equals, 2)
+
+	// The first reservation is gone.
+	c.Assert(job1.Ack(), Equals, queue.ErrLost)
+	c.Assert(job1.Extend(time.Minute), Equals, queue.ErrLost)
+	c.Assert(job2.Extend(time.Minute), IsNil)
+	c.Assert(job2.Ack(), IsNil)
+}
+
+func (s *S) TestRelease(c *C) {
+	_, err := s.q.Enqueue(M{"n": 1})
+	c.Assert(err, IsNil)
+
+	job, err := s.q.Reserve()
+	c.Assert(err, IsNil)
+	c.Assert(job.Release(0, errors.New("oops")), IsNil)
+
+	job, err = s.q.Reserve()
+	c.Assert(err, IsNil)
+	c.Assert(job.Error, Equals, "oops")
+	c.Assert(job.Attempts, Equals, 2)
+}
+
+func (s *S) TestDeadLetter(c *C) {
+	s.q.MaxAttempts = 2
+	id, err := s.q.Enqueue(M{"n": 1})
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 2; i++ {
+		job, err := s.q.Reserve()
+		c.Assert(err, IsNil)
+		c.Assert(job.Release(0, errors.New("oops")), IsNil)
+	}
+
+	_, err = s.q.Reserve()
+	c.Assert(err, Equals, queue.ErrEmpty)
+
+	n, err := s.q.Len()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 0)
+
+	var dead M
+	err = s.q.DeadLetter().FindId(id).One(&dead)
+	c.Assert(err, IsNil)
+	c.Assert(dead["e"], Equals, "oops")
+	c.Assert(dead["a"], Equals, 3)
+}
+
+func (s *S) TestBury(c *C) {
+	id, err := s.q.Enqueue(M{"n": 1})
+	c.Assert(err, IsNil)
+	job, err := s.q.Reserve()
+	c.Assert(err, IsNil)
+	c.Assert(job.Bury(errors.New("bad payload")), IsNil)
+
+	n, err := s.q.DeadLetter().FindId(id).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+}
@@ -0,0 +1,205 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// ErrQuotaExceeded is returned by operations shed because the server
+// they'd be sent to is out of quota. See DialInfo.ServerQuota.
+var ErrQuotaExceeded = errors.New("server operation quota exceeded")
+
+// Quota limits the operations the sessions of a cluster send to each of
+// its servers, so that a single runaway caller within the process cannot
+// saturate a server and starve every other user of the shared topology.
+//
+// Operations over the quota wait for up to Wait for room to be made, and
+// are otherwise shed with ErrQuotaExceeded without being sent. Every
+// query, command, write, and iterator batch request counts as an
+// operation. The driver's own monitoring and authentication traffic is
+// not subject to the quota.
+//
+// Operations from sessions with LowPriority only get room while no
+// operation with HighPriority is waiting for it. See Session.SetPriority.
+type Quota struct {
+	// Rate is the sustained number of operations per second allowed per
+	// server. Zero means no rate limit.
+	Rate float64
+
+	// Burst is the number of operations that may be sent at once above
+	// the sustained Rate. Defaults to Rate, and at least 1.
+	Burst int
+
+	// MaxInFlight is the maximum number of operations per server awaiting
+	// their replies at any time. Zero means no limit.
+	MaxInFlight int
+
+	// Wait is for how long operations over the quota wait for room to be
+	// made before being shed. Zero sheds them right away.
+	Wait time.Duration
+}
+
+// serverQuota enforces a Quota on the operations sent to a server,
+// with a token bucket for the rate and a counter for operations in flight.
+type serverQuota struct {
+	m           sync.Mutex
+	quota       Quota
+	burst       float64
+	tokens      float64
+	last        time.Time
+	inflight    int
+	highWaiting int
+	released    chan struct{}
+}
+
+func newServerQuota(quota *Quota) *serverQuota {
+	if quota == nil || quota.Rate <= 0 && quota.MaxInFlight <= 0 {
+		return nil
+	}
+	q := &serverQuota{quota: *quota, released: make(chan struct{})}
+	q.burst = float64(quota.Burst)
+	if quota.Burst <= 0 {
+		q.burst = math.Max(1, quota.Rate)
+	}
+	q.tokens = q.burst
+	q.last = time.Now()
+	return q
+}
+
+// enter waits until an operation fits within the quota, and returns a
+// function to be called once the operation completes. It returns
+// ErrQuotaExceeded if there's no room for the operation by the time the
+// quota allows it to wait for. Operations with LowPriority wait while
+// others with HighPriority are waiting.
+func (q *serverQuota) enter(priority Priority) (leave func(), err error) {
+	var deadline time.Time
+	waiting := false
+	defer func() {
+		if waiting {
+			q.m.Lock()
+			q.highWaiting--
+			q.release()
+			q.m.Unlock()
+		}
+	}()
+	for {
+		q.m.Lock()
+		now := time.Now()
+		var delay time.Duration
+		if q.quota.Rate > 0 {
+			q.tokens = math.Min(q.burst, q.tokens+now.Sub(q.last).Seconds()*q.quota.Rate)
+			q.last = now
+			if q.tokens < 1 {
+				delay = time.Duration((1 - q.tokens) / q.quota.Rate * float64(time.Second))
+			}
+		}
+		full := q.quota.MaxInFlight > 0 && q.inflight >= q.quota.MaxInFlight
+		if priority == LowPriority && q.highWaiting > 0 {
+			full = true
+		}
+		if delay == 0 && !full {
+			if q.quota.Rate > 0 {
+				q.tokens--
+			}
+			q.inflight++
+			q.m.Unlock()
+			return q.leaveFunc(), nil
+		}
+		if priority == HighPriority && !waiting {
+			waiting = true
+			q.highWaiting++
+		}
+		released := q.released
+		q.m.Unlock()
+
+		if deadline.IsZero() {
+			deadline = now.Add(q.quota.Wait)
+		}
+		wait := deadline.Sub(now)
+		if wait <= 0 || !full && delay > wait {
+			stats.shedOps(+1)
+			return nil, ErrQuotaExceeded
+		}
+		if !full {
+			wait = delay
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-released:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// leaveFunc returns a function releasing the room taken by an operation,
+// which may be called more than once.
+func (q *serverQuota) leaveFunc() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.m.Lock()
+			q.inflight--
+			q.release()
+			q.m.Unlock()
+		})
+	}
+}
+
+// release wakes up all operations waiting for room. The quota lock
+// must be held.
+func (q *serverQuota) release() {
+	close(q.released)
+	q.released = make(chan struct{})
+}
+
+func noLeave() {}
+
+// enterQuota waits until the server socket is connected to has quota for
+// an operation, as done by serverQuota.enter.
+func (s *Session) enterQuota(socket *mongoSocket) (leave func(), err error) {
+	server := socket.Server()
+	if s.noQuota || server == nil || server.quota == nil {
+		return noLeave, nil
+	}
+	return server.quota.enter(s.priority)
+}
+
+// quotaReplyFunc returns a replyFunc that calls leave once the reply to
+// an operation is complete, and then delegates to replyFunc.
+func quotaReplyFunc(leave func(), replyFunc replyFunc) replyFunc {
+	return func(err error, reply *replyOp, docNum int, docData []byte) {
+		if err != nil || reply == nil || docNum == -1 || docNum == int(reply.replyDocs)-1 {
+			leave()
+		}
+		replyFunc(err, reply, docNum, docData)
+	}
+}
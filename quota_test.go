@@ -0,0 +1,151 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo_test
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+)
+
+func (s *S) TestQuotaInFlight(c *C) {
+	enter := mgo.QuotaEnter(&mgo.Quota{MaxInFlight: 2})
+	leave1, err := enter(mgo.HighPriority)
+	c.Assert(err, IsNil)
+	leave2, err := enter(mgo.HighPriority)
+	c.Assert(err, IsNil)
+	_, err = enter(mgo.HighPriority)
+	c.Assert(err, Equals, mgo.ErrQuotaExceeded)
+
+	// Leaving more than once makes room only once.
+	leave1()
+	leave1()
+	leave3, err := enter(mgo.HighPriority)
+	c.Assert(err, IsNil)
+	_, err = enter(mgo.HighPriority)
+	c.Assert(err, Equals, mgo.ErrQuotaExceeded)
+	leave2()
+	leave3()
+}
+
+func (s *S) TestQuotaInFlightWait(c *C) {
+	enter := mgo.QuotaEnter(&mgo.Quota{MaxInFlight: 1, Wait: time.Second})
+	leave, err := enter(mgo.HighPriority)
+	c.Assert(err, IsNil)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		leave()
+	}()
+	start := time.Now()
+	_, err = enter(mgo.HighPriority)
+	c.Assert(err, IsNil)
+	c.Assert(time.Since(start) < 500*time.Millisecond, Equals, true)
+}
+
+func (s *S) TestQuotaPriority(c *C) {
+	enter := mgo.QuotaEnter(&mgo.Quota{MaxInFlight: 1, Wait: time.Second})
+	leave, err := enter(mgo.HighPriority)
+	c.Assert(err, IsNil)
+
+	done := make(chan mgo.Priority, 2)
+	wait := func(priority mgo.Priority) {
+		leave, err := enter(priority)
+		c.Check(err, IsNil)
+		done <- priority
+		time.Sleep(50 * time.Millisecond)
+		leave()
+	}
+	go wait(mgo.HighPriority)
+	time.Sleep(50 * time.Millisecond)
+	go wait(mgo.LowPriority)
+	time.Sleep(50 * time.Millisecond)
+
+	// The high priority operation gets the room first, even if both
+	// are woken up together.
+	leave()
+	c.Assert(<-done, Equals, mgo.HighPriority)
+	c.Assert(<-done, Equals, mgo.LowPriority)
+}
+
+func (s *S) TestQuotaRate(c *C) {
+	enter := mgo.QuotaEnter(&mgo.Quota{Rate: 10, Burst: 2})
+	for i := 0; i < 2; i++ {
+		leave, err := enter(mgo.HighPriority)
+		c.Assert(err, IsNil)
+		leave()
+	}
+	_, err := enter(mgo.HighPriority)
+	c.Assert(err, Equals, mgo.ErrQuotaExceeded)
+
+	// A token comes back every 100ms.
+	time.Sleep(110 * time.Millisecond)
+	leave, err := enter(mgo.HighPriority)
+	c.Assert(err, IsNil)
+	leave()
+	_, err = enter(mgo.HighPriority)
+	c.Assert(err, Equals, mgo.ErrQuotaExceeded)
+}
+
+func (s *S) TestQuotaRateWait(c *C) {
+	enter := mgo.QuotaEnter(&mgo.Quota{Rate: 10, Burst: 1, Wait: 50 * time.Millisecond})
+	_, err := enter(mgo.HighPriority)
+	c.Assert(err, IsNil)
+
+	// The next token is 100ms away, longer than the wait.
+	_, err = enter(mgo.HighPriority)
+	c.Assert(err, Equals, mgo.ErrQuotaExceeded)
+
+	enter = mgo.QuotaEnter(&mgo.Quota{Rate: 10, Burst: 1, Wait: time.Second})
+	_, err = enter(mgo.HighPriority)
+	c.Assert(err, IsNil)
+	start := time.Now()
+	_, err = enter(mgo.HighPriority)
+	c.Assert(err, IsNil)
+	elapsed := time.Since(start)
+	c.Assert(elapsed > 50*time.Millisecond && elapsed < 500*time.Millisecond, Equals, true, Commentf("%v", elapsed))
+}
+
+func (s *S) TestServerQuota(c *C) {
+	info := &mgo.DialInfo{
+		Addrs:       []string{"localhost:40001"},
+		ServerQuota: &mgo.Quota{Rate: 1, Burst: 5},
+	}
+	session, err := mgo.DialWithInfo(info)
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	for i := 0; i < 10; i++ {
+		err = coll.Insert(M{"n": i})
+		if err != nil {
+			break
+		}
+	}
+	c.Assert(err, Equals, mgo.ErrQuotaExceeded)
+	c.Assert(mgo.GetStats().ShedOps > 0, Equals, true)
+}
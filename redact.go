@@ -0,0 +1,203 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"fmt"
+	"sync"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Redactor removes sensitive data, such as personally identifiable
+// information, from documents before they reach monitors and logs.
+//
+// Redact is provided with the BSON document in data and returns the
+// document to be shown in its place. It must not modify data.
+//
+// See SetRedactor.
+type Redactor interface {
+	Redact(data []byte) []byte
+}
+
+// The RedactorFunc type is an adapter to allow the use of ordinary
+// functions as redactors.
+type RedactorFunc func(data []byte) []byte
+
+// Redact returns f(data).
+func (f RedactorFunc) Redact(data []byte) []byte {
+	return f(data)
+}
+
+// redactedValue replaces values removed by the built-in redactors.
+const redactedValue = "<redacted>"
+
+// RedactAll is a redactor that replaces every document with an empty one.
+var RedactAll Redactor = RedactorFunc(func(data []byte) []byte {
+	return []byte{5, 0, 0, 0, 0}
+})
+
+// RedactValues is a redactor that keeps the keys of documents, including
+// the ones of embedded documents and arrays, and replaces all values with
+// the "<redacted>" string, so that the structure of operations remains
+// visible.
+var RedactValues Redactor = AllowFields()
+
+// AllowFields returns a redactor that keeps the values of the fields at
+// the provided dotted paths, and otherwise works like RedactValues. An
+// allowed field holding a document or array is kept whole. For instance,
+// this keeps the command name and collection of finds, as well as the
+// fields their filters look at, but not the values looked for:
+//
+//     mgo.AllowFields("find", "limit", "sort")
+//
+// Array elements are matched by their index, as in "items.0.price".
+func AllowFields(paths ...string) Redactor {
+	allowed := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		allowed[path] = true
+	}
+	return RedactorFunc(func(data []byte) []byte {
+		out, err := redactDoc(data, "", allowed)
+		if err != nil {
+			return RedactAll.Redact(data)
+		}
+		return out
+	})
+}
+
+func redactDoc(data []byte, prefix string, allowed map[string]bool) ([]byte, error) {
+	var elems bson.RawD
+	if err := bson.Unmarshal(data, &elems); err != nil {
+		return nil, err
+	}
+	for i := range elems {
+		elem := &elems[i]
+		path := prefix + elem.Name
+		if allowed[path] {
+			continue
+		}
+		switch elem.Value.Kind {
+		case 0x03, 0x04:
+			inner, err := redactDoc(elem.Value.Data, path+".", allowed)
+			if err != nil {
+				return nil, err
+			}
+			elem.Value.Data = inner
+		default:
+			elem.Value = redactedRaw
+		}
+	}
+	return bson.Marshal(elems)
+}
+
+var redactedRaw = func() bson.Raw {
+	data, err := bson.Marshal(bson.M{"v": redactedValue})
+	if err != nil {
+		panic(err)
+	}
+	var doc struct{ V bson.Raw }
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		panic(err)
+	}
+	return doc.V
+}()
+
+var (
+	globalRedactor Redactor
+	redactorMutex  sync.RWMutex
+)
+
+// SetRedactor sets the redactor applied to documents before they reach
+// monitors (see Monitor.Documents) and logs, including debug logs.
+// Providing nil disables redaction.
+//
+// Note that documents are only logged in debug mode, and only reach
+// monitors that ask for them, so no redactor is necessary otherwise.
+func SetRedactor(redactor Redactor) {
+	redactorMutex.Lock()
+	globalRedactor = redactor
+	redactorMutex.Unlock()
+}
+
+func getRedactor() Redactor {
+	redactorMutex.RLock()
+	redactor := globalRedactor
+	redactorMutex.RUnlock()
+	return redactor
+}
+
+// redact returns a copy of the document in data with the redactor set
+// applied to it, if any.
+func redact(data []byte) bson.Raw {
+	if redactor := getRedactor(); redactor != nil {
+		data = redactor.Redact(data)
+	}
+	return bson.Raw{0x03, append([]byte(nil), data...)}
+}
+
+// logDoc returns v for logging it in debug mode, wrapped so that it's
+// formatted redacted if a redactor is set.
+func logDoc(v interface{}) interface{} {
+	if !globalDebug {
+		return v
+	}
+	if redactor := getRedactor(); redactor != nil {
+		return redactedDoc{redactor, v}
+	}
+	return v
+}
+
+// redactedDoc formats a value redacted. Values that can't be marshalled
+// as documents, or that are empty, are formatted by type alone.
+type redactedDoc struct {
+	redactor Redactor
+	value    interface{}
+}
+
+func (d redactedDoc) Format(f fmt.State, verb rune) {
+	var data []byte
+	var err error
+	switch v := d.value.(type) {
+	case bson.Raw:
+		data = v.Data
+	case []byte:
+		data = v
+	default:
+		data, err = bson.Marshal(v)
+	}
+	// Operations marshal as empty documents, as their fields are
+	// unexported, and are better reported by type.
+	if err == nil && len(data) > 5 {
+		var doc bson.D
+		if err = bson.Unmarshal(d.redactor.Redact(data), &doc); err == nil {
+			fmt.Fprintf(f, "%v", doc)
+			return
+		}
+	}
+	fmt.Fprintf(f, "%T %s", d.value, redactedValue)
+}
@@ -0,0 +1,242 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// RetryPolicy decides whether and when operations that failed are
+// retried. See Session.SetRetryPolicy.
+type RetryPolicy interface {
+	// Retry is called after the given attempt of an operation, starting
+	// at 1, failed with err. It returns whether the operation should be
+	// attempted again, and how long to wait before doing so.
+	Retry(attempt int, err error) (delay time.Duration, retry bool)
+}
+
+// Backoff is a RetryPolicy that retries operations failing with
+// retryable errors, waiting exponentially longer between attempts.
+type Backoff struct {
+	// MaxAttempts is the maximum number of times an operation is
+	// attempted, including the first attempt. Defaults to 3.
+	MaxAttempts int
+
+	// Initial is the delay before the first retry. Defaults to 100ms.
+	Initial time.Duration
+
+	// Max caps the delay between attempts. Defaults to 5 seconds.
+	Max time.Duration
+
+	// Multiplier is the factor the delay grows by after each retry.
+	// Defaults to 2.
+	Multiplier float64
+
+	// Jitter randomizes delays by up to the given fraction of them,
+	// between 0 and 1, so that clients that failed together don't
+	// retry together.
+	Jitter float64
+
+	// Retryable reports whether operations failing with err should be
+	// retried. Defaults to IsRetryable.
+	Retryable func(err error) bool
+}
+
+var (
+	backoffRand  = rand.New(rand.NewSource(time.Now().UnixNano()))
+	backoffMutex sync.Mutex
+)
+
+// Retry implements the RetryPolicy interface.
+func (b *Backoff) Retry(attempt int, err error) (delay time.Duration, retry bool) {
+	maxAttempts := b.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 3
+	}
+	retryable := b.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+	if attempt >= maxAttempts || !retryable(err) {
+		return 0, false
+	}
+
+	initial, max, multiplier := b.Initial, b.Max, b.Multiplier
+	if initial <= 0 {
+		initial = 100 * time.Millisecond
+	}
+	if max <= 0 {
+		max = 5 * time.Second
+	}
+	if multiplier < 1 {
+		multiplier = 2
+	}
+	d := float64(initial)
+	for i := 1; i < attempt && d < float64(max); i++ {
+		d *= multiplier
+	}
+	if d > float64(max) {
+		d = float64(max)
+	}
+	if b.Jitter > 0 {
+		backoffMutex.Lock()
+		r := backoffRand.Float64()
+		backoffMutex.Unlock()
+		d -= d * b.Jitter * r
+	}
+	return time.Duration(d), true
+}
+
+// Error codes reported by servers that aren't able to serve an operation
+// at the moment, and that never started running it.
+var notMasterCodes = map[int]bool{
+	10107: true, // NotMaster
+	13435: true, // NotMasterNoSlaveOk
+	13436: true, // NotMasterOrSecondary
+}
+
+// Error codes reported for failures that are likely transient.
+var transientCodes = map[int]bool{
+	6:     true, // HostUnreachable
+	7:     true, // HostNotFound
+	89:    true, // NetworkTimeout
+	91:    true, // ShutdownInProgress
+	189:   true, // PrimarySteppedDown
+	9001:  true, // SocketException
+	11600: true, // InterruptedAtShutdown
+	11602: true, // InterruptedDueToReplStateChange
+}
+
+// Error codes reported for operations interrupted by the server before
+// they completed.
+var interruptedCodes = map[int]bool{
+	91:    true, // ShutdownInProgress
+	175:   true, // QueryPlanKilled
+	237:   true, // CursorKilled
+	11600: true, // InterruptedAtShutdown
+	11601: true, // Interrupted
+	11602: true, // InterruptedDueToReplStateChange
+}
+
+func errorCode(err error) int {
+	switch e := err.(type) {
+	case *QueryError:
+		return e.Code
+	case *LastError:
+		return e.Code
+	}
+	return 0
+}
+
+// IsRetryable returns whether err is likely transient, such as network
+// errors, no servers being reachable, or the server not being a primary
+// as happens during elections.
+func IsRetryable(err error) bool {
+	if isNotRunError(err) || err == io.EOF {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	return transientCodes[errorCode(err)]
+}
+
+// IsInterrupted returns whether err informs that the server interrupted
+// the operation before it completed, as happens when the operation is
+// killed with killOp, or when the server shuts down or steps down. Cursors
+// of interrupted operations are gone from the server.
+//
+// Operations interrupted by a shutdown or a step down are retryable (see
+// IsRetryable), while the ones killed on purpose are not.
+func IsInterrupted(err error) bool {
+	return interruptedCodes[errorCode(err)]
+}
+
+// IsCursorNotFound returns whether err informs that the cursor an iterator
+// was reading from is gone from the server, either because it timed out
+// or because it was killed.
+func IsCursorNotFound(err error) bool {
+	if err == ErrCursor {
+		return true
+	}
+	code := errorCode(err)
+	return code == 43 || code == 237 // CursorNotFound, CursorKilled
+}
+
+// isNotRunError returns whether err ensures the failed operation wasn't
+// run by the server, so that it may be retried even if not idempotent.
+func isNotRunError(err error) bool {
+	return err == errNoReachableServers || err == ErrNoPrimary || notMasterCodes[errorCode(err)]
+}
+
+// SetRetryPolicy sets the policy deciding whether and when operations
+// failing in the session are retried. By default, operations are never
+// retried. See Backoff for a ready-made policy.
+//
+// Reads done via Query.One, Query.All, Query.Count, and Query.Distinct are
+// retried on any error the policy allows for. Query.All restarts the query
+// from scratch, so reads interrupted by a server restart, including their
+// killed cursors, recover transparently. Inserts, updates, and removals,
+// including bulk ones, are only retried when the error ensures they were
+// not applied at all, such as when no servers are reachable or the server
+// is not the primary, so that non-idempotent writes aren't applied twice.
+// Other operations, including iterators, are not retried.
+//
+// Before every retry the session is refreshed (see Session.Refresh), so
+// that the next attempt may pick a different server.
+func (s *Session) SetRetryPolicy(policy RetryPolicy) {
+	s.m.Lock()
+	s.retryPolicy = policy
+	s.m.Unlock()
+}
+
+// retry runs op until it succeeds or the retry policy of the session
+// gives up on it. Besides the error, op returns whether it's safe to
+// retry it.
+func (s *Session) retry(op func() (safe bool, err error)) error {
+	s.m.RLock()
+	policy := s.retryPolicy
+	s.m.RUnlock()
+
+	for attempt := 1; ; attempt++ {
+		safe, err := op()
+		if err == nil || policy == nil || !safe {
+			return err
+		}
+		delay, retry := policy.Retry(attempt, err)
+		if !retry {
+			return err
+		}
+		debugf("Retrying operation after attempt %d failed: %v", attempt, err)
+		s.Refresh()
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,171 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo_test
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+)
+
+func (s *S) TestBackoff(c *C) {
+	b := &mgo.Backoff{MaxAttempts: 5, Initial: time.Second, Max: 3 * time.Second}
+	delays := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second}
+	for i, want := range delays {
+		delay, retry := b.Retry(i+1, io.EOF)
+		c.Assert(retry, Equals, true)
+		c.Assert(delay, Equals, want)
+	}
+	_, retry := b.Retry(5, io.EOF)
+	c.Assert(retry, Equals, false)
+
+	// Non-retryable errors.
+	_, retry = b.Retry(1, mgo.ErrNotFound)
+	c.Assert(retry, Equals, false)
+	_, retry = b.Retry(1, &mgo.LastError{Code: 11000})
+	c.Assert(retry, Equals, false)
+
+	// Custom classifier.
+	b.Retryable = func(err error) bool { return err == mgo.ErrNotFound }
+	_, retry = b.Retry(1, mgo.ErrNotFound)
+	c.Assert(retry, Equals, true)
+	_, retry = b.Retry(1, io.EOF)
+	c.Assert(retry, Equals, false)
+
+	// Jitter only ever shortens delays.
+	b = &mgo.Backoff{Initial: time.Second, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		delay, retry := b.Retry(1, io.EOF)
+		c.Assert(retry, Equals, true)
+		c.Assert(delay >= 500*time.Millisecond && delay <= time.Second, Equals, true)
+	}
+}
+
+func (s *S) TestIsRetryable(c *C) {
+	c.Assert(mgo.IsRetryable(io.EOF), Equals, true)
+	c.Assert(mgo.IsRetryable(mgo.ErrNoPrimary), Equals, true)
+	c.Assert(mgo.IsRetryable(&mgo.QueryError{Code: 10107, Message: "not master"}), Equals, true)
+	c.Assert(mgo.IsRetryable(&mgo.LastError{Code: 11602}), Equals, true)
+	c.Assert(mgo.IsRetryable(&mgo.LastError{Code: 11000}), Equals, false)
+	c.Assert(mgo.IsRetryable(errors.New("some error")), Equals, false)
+}
+
+func (s *S) TestIsInterrupted(c *C) {
+	c.Assert(mgo.IsInterrupted(&mgo.QueryError{Code: 11601, Message: "operation was interrupted"}), Equals, true)
+	c.Assert(mgo.IsInterrupted(&mgo.QueryError{Code: 11600}), Equals, true)
+	c.Assert(mgo.IsInterrupted(&mgo.LastError{Code: 11602}), Equals, true)
+	c.Assert(mgo.IsInterrupted(&mgo.QueryError{Code: 237}), Equals, true)
+	c.Assert(mgo.IsInterrupted(&mgo.QueryError{Code: 43}), Equals, false)
+	c.Assert(mgo.IsInterrupted(io.EOF), Equals, false)
+
+	// Killed on purpose, so not retried.
+	c.Assert(mgo.IsRetryable(&mgo.QueryError{Code: 11601}), Equals, false)
+	c.Assert(mgo.IsRetryable(&mgo.QueryError{Code: 11600}), Equals, true)
+	c.Assert(mgo.IsRetryable(&mgo.QueryError{Code: 175}), Equals, false)
+	c.Assert(mgo.IsRetryable(&mgo.QueryError{Code: 237}), Equals, false)
+}
+
+func (s *S) TestIsCursorNotFound(c *C) {
+	c.Assert(mgo.IsCursorNotFound(mgo.ErrCursor), Equals, true)
+	c.Assert(mgo.IsCursorNotFound(&mgo.QueryError{Code: 43}), Equals, true)
+	c.Assert(mgo.IsCursorNotFound(&mgo.QueryError{Code: 237}), Equals, true)
+	c.Assert(mgo.IsCursorNotFound(&mgo.QueryError{Code: 11601}), Equals, false)
+	c.Assert(mgo.IsCursorNotFound(mgo.ErrNotFound), Equals, false)
+}
+
+type countingPolicy struct {
+	attempts []int
+}
+
+func (p *countingPolicy) Retry(attempt int, err error) (time.Duration, bool) {
+	p.attempts = append(p.attempts, attempt)
+	return 0, attempt < 3
+}
+
+func (s *S) TestRetryPolicyReads(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	policy := &countingPolicy{}
+	session.SetRetryPolicy(policy)
+
+	// Bad queries fail the same way on every attempt.
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.Find(M{"$bad": 1}).One(nil)
+	c.Assert(err, NotNil)
+	c.Assert(policy.attempts, DeepEquals, []int{1, 2, 3})
+
+	policy.attempts = nil
+	var result []M
+	err = coll.Find(M{"$bad": 1}).All(&result)
+	c.Assert(err, NotNil)
+	c.Assert(policy.attempts, DeepEquals, []int{1, 2, 3})
+
+	// Writes are only retried when they weren't applied.
+	policy.attempts = nil
+	err = coll.Insert(M{"_id": 1})
+	c.Assert(err, IsNil)
+	err = coll.Insert(M{"_id": 1})
+	c.Assert(mgo.IsDup(err), Equals, true)
+	c.Assert(policy.attempts, HasLen, 0)
+}
+
+func (s *S) TestRetryPolicyFallover(c *C) {
+	if *fast {
+		c.Skip("-fast")
+	}
+
+	session, err := mgo.Dial("localhost:40021")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	result := &struct{ Host string }{}
+	err = session.Run("serverStatus", result)
+	c.Assert(err, IsNil)
+
+	session.SetSyncTimeout(5 * time.Second)
+	session.SetRetryPolicy(&mgo.Backoff{MaxAttempts: 60, Initial: time.Second, Max: time.Second})
+
+	// Kill the master.
+	s.Stop(result.Host)
+
+	// Writes failing on the broken connection might have been applied,
+	// so they're not retried. Drop the connection as that's known.
+	session.Refresh()
+
+	// The write is retried until a new master is elected.
+	err = session.DB("mydb").C("mycoll").Insert(M{"n": 42})
+	c.Assert(err, IsNil)
+
+	n, err := session.DB("mydb").C("mycoll").Find(M{"n": 42}).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+}
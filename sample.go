@@ -0,0 +1,111 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"errors"
+	"math/rand"
+	"reflect"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Sample retrieves into the slice pointed to by result up to n documents
+// picked at random from the collection, which is handy for tests and for
+// analytics over large collections.
+//
+// On MongoDB 3.2+ the documents are picked by the server with the $sample
+// aggregation stage. On older servers the whole collection is read and
+// the documents are picked with reservoir sampling on the client side,
+// which is only reasonable for small collections.
+//
+// Sample fails if n is negative.
+//
+// Relevant documentation:
+//
+//     https://docs.mongodb.com/manual/reference/operator/aggregation/sample/
+//
+func (c *Collection) Sample(n int, result interface{}) error {
+	if n < 0 {
+		return errNegativeSample
+	}
+	wireVersion, err := c.Database.Session.MaxWireVersion()
+	if err != nil {
+		return err
+	}
+	if wireVersion >= 4 {
+		return c.Pipe([]bson.D{{{"$sample", bson.D{{"size", n}}}}}).All(result)
+	}
+	return c.sampleReservoir(n, result)
+}
+
+var errNegativeSample = errors.New("sample size must not be negative")
+
+// maxSampleCapacity caps the reservoir preallocated by sampleReservoir.
+const maxSampleCapacity = 1024
+
+// sampleReservoir picks n documents from the collection uniformly at
+// random, reading it only once and holding no more than n documents.
+func (c *Collection) sampleReservoir(n int, result interface{}) error {
+	resultv := reflect.ValueOf(result)
+	if resultv.Kind() != reflect.Ptr || resultv.Elem().Kind() != reflect.Slice {
+		panic("result argument must be a slice address")
+	}
+	if n < 0 {
+		return errNegativeSample
+	}
+	// n may well exceed the collection size, so don't trust it blindly
+	// when preallocating.
+	capacity := n
+	if capacity > maxSampleCapacity {
+		capacity = maxSampleCapacity
+	}
+	reservoir := make([]bson.Raw, 0, capacity)
+	iter := c.Find(nil).Iter()
+	var doc bson.Raw
+	for i := 0; iter.Next(&doc); i++ {
+		if i < n {
+			reservoir = append(reservoir, bson.Raw{doc.Kind, append([]byte(nil), doc.Data...)})
+		} else if j := rand.Intn(i + 1); j < n {
+			reservoir[j] = bson.Raw{doc.Kind, append([]byte(nil), doc.Data...)}
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	// The first documents stay in their original order unless replaced.
+	perm := rand.Perm(len(reservoir))
+	slicev := reflect.MakeSlice(resultv.Elem().Type(), len(reservoir), len(reservoir))
+	for i, j := range perm {
+		if err := reservoir[j].Unmarshal(slicev.Index(i).Addr().Interface()); err != nil {
+			return err
+		}
+	}
+	resultv.Elem().Set(slicev)
+	return nil
+}
@@ -0,0 +1,111 @@
+package schema
+
+import (
+	"sort"
+	"strings"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Inference describes the schema inferred from a sample of documents.
+type Inference struct {
+	Docs   int             // Number of documents sampled
+	Fields []InferredField // Fields found, sorted by path
+}
+
+// InferredField describes a field found in sampled documents.
+type InferredField struct {
+	// Path is the dotted path of the field. Elements of arrays have
+	// "[]" in place of their index, so "tags.[]" describes the elements
+	// of the tags array, and "items.[].price" the price field of the
+	// documents in the items array.
+	Path string
+
+	// Types holds the number of values of each kind found.
+	Types map[bson.Kind]int
+
+	// Docs is the number of sampled documents holding the field.
+	Docs int
+
+	// Presence is the fraction of the sampled documents holding the
+	// field, between 0 and 1.
+	Presence float64
+
+	// Examples holds up to MaxExamples distinct values found, for
+	// fields holding values other than documents and arrays.
+	Examples []interface{}
+}
+
+// MaxExamples is the maximum number of example values kept per field.
+var MaxExamples = 3
+
+// Infer samples up to n documents from the collection and infers their
+// schema, which is useful for getting to know undocumented collections.
+// See Collection.Sample for how documents are picked.
+func Infer(c *mgo.Collection, n int) (*Inference, error) {
+	var docs []bson.Raw
+	if err := c.Sample(n, &docs); err != nil {
+		return nil, err
+	}
+	return InferDocs(docs)
+}
+
+// InferDocs infers the schema of the provided documents.
+func InferDocs(docs []bson.Raw) (*Inference, error) {
+	type field struct {
+		InferredField
+		lastDoc  int
+		examples map[string]bool
+	}
+	fields := make(map[string]*field)
+	var kinds []bson.Kind
+	var names []string
+	for i, doc := range docs {
+		err := bson.Walk(doc.Data, func(path []string, kind bson.Kind, data []byte) error {
+			depth := len(path) - 1
+			kinds = append(kinds[:depth], kind)
+			name := path[depth]
+			if depth > 0 && kinds[depth-1] == bson.KindArray {
+				name = "[]"
+			}
+			names = append(names[:depth], name)
+			key := strings.Join(names, ".")
+
+			f, ok := fields[key]
+			if !ok {
+				f = &field{lastDoc: -1, examples: make(map[string]bool)}
+				f.Path = key
+				f.Types = make(map[bson.Kind]int)
+				fields[key] = f
+			}
+			f.Types[kind]++
+			if f.lastDoc != i {
+				f.lastDoc = i
+				f.Docs++
+			}
+			if kind != bson.KindDocument && kind != bson.KindArray && len(f.Examples) < MaxExamples {
+				raw := string(kind) + string(data)
+				var value interface{}
+				if !f.examples[raw] && (bson.Raw{byte(kind), data}).Unmarshal(&value) == nil {
+					f.examples[raw] = true
+					f.Examples = append(f.Examples, value)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	inference := &Inference{Docs: len(docs)}
+	for _, f := range fields {
+		f.Presence = float64(f.Docs) / float64(len(docs))
+		inference.Fields = append(inference.Fields, f.InferredField)
+	}
+	sort.Slice(inference.Fields, func(i, j int) bool {
+		return inference.Fields[i].Path < inference.Fields[j].Path
+	})
+	return inference, nil
+}
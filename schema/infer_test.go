@@ -0,0 +1,61 @@
+package schema
+
+import (
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type InferSuite struct{}
+
+var _ = Suite(&InferSuite{})
+
+func (s *InferSuite) TestInferDocs(c *C) {
+	var docs []bson.Raw
+	for _, doc := range []bson.M{
+		{"_id": 1, "name": "a", "tags": []string{"x", "y"}, "items": []bson.M{{"price": 1}, {"price": 2.5}}},
+		{"_id": 2, "name": "b", "tags": []string{}},
+		{"_id": 3, "name": nil, "extra": bson.M{"n": int64(1)}},
+		{"_id": 4, "name": "a"},
+	} {
+		data, err := bson.Marshal(doc)
+		c.Assert(err, IsNil)
+		docs = append(docs, bson.Raw{0x03, data})
+	}
+
+	inference, err := InferDocs(docs)
+	c.Assert(err, IsNil)
+	c.Assert(inference.Docs, Equals, 4)
+
+	fields := make(map[string]InferredField)
+	var paths []string
+	for _, f := range inference.Fields {
+		fields[f.Path] = f
+		paths = append(paths, f.Path)
+	}
+	c.Assert(paths, DeepEquals, []string{
+		"_id", "extra", "extra.n", "items", "items.[]", "items.[].price", "name", "tags", "tags.[]",
+	})
+
+	name := fields["name"]
+	c.Assert(name.Docs, Equals, 4)
+	c.Assert(name.Presence, Equals, 1.0)
+	c.Assert(name.Types, DeepEquals, map[bson.Kind]int{bson.KindString: 3, bson.KindNull: 1})
+	c.Assert(name.Examples, DeepEquals, []interface{}{"a", "b", nil})
+
+	tags := fields["tags"]
+	c.Assert(tags.Docs, Equals, 2)
+	c.Assert(tags.Presence, Equals, 0.5)
+	c.Assert(tags.Examples, HasLen, 0)
+
+	// Array elements count once per document.
+	elems := fields["tags.[]"]
+	c.Assert(elems.Docs, Equals, 1)
+	c.Assert(elems.Types, DeepEquals, map[bson.Kind]int{bson.KindString: 2})
+
+	price := fields["items.[].price"]
+	c.Assert(price.Presence, Equals, 0.25)
+	c.Assert(price.Types, DeepEquals, map[bson.Kind]int{bson.KindInt32: 1, bson.KindFloat64: 1})
+
+	c.Assert(fields["_id"].Examples, HasLen, MaxExamples)
+	c.Assert(fields["extra.n"].Types, DeepEquals, map[bson.Kind]int{bson.KindInt64: 1})
+}
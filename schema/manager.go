@@ -0,0 +1,243 @@
+package schema
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+// ActionKind identifies a change performed by an IndexManager.
+type ActionKind int
+
+const (
+	CreateCollection ActionKind = iota + 1
+	CreateIndex
+	DropIndex
+)
+
+func (k ActionKind) String() string {
+	switch k {
+	case CreateCollection:
+		return "create collection"
+	case CreateIndex:
+		return "create index"
+	case DropIndex:
+		return "drop index"
+	}
+	return fmt.Sprintf("unknown action kind %d", int(k))
+}
+
+// Action describes a change that converges the database towards the
+// declared schema.
+type Action struct {
+	Kind       ActionKind
+	Collection string
+	Index      *mgo.Index          // For CreateIndex and DropIndex
+	Info       *mgo.CollectionInfo // For CreateCollection, if declared
+}
+
+func (a Action) String() string {
+	s := a.Kind.String() + " " + a.Collection
+	if a.Index != nil {
+		s += " " + IndexKey(a.Index.Key)
+	}
+	return s
+}
+
+// IndexManager converges the indexes in a database to those declared,
+// typically when an application starts.
+type IndexManager struct {
+	db    *mgo.Database
+	colls []Collection
+
+	// DropExtra causes indexes not declared to be dropped. Indexes on
+	// collections that are not declared are never dropped.
+	DropExtra bool
+
+	// Rebuild causes indexes with changed options to be dropped and
+	// created again. Otherwise changed indexes are reported as errors,
+	// as the server refuses to create an index with the same key and
+	// different options.
+	Rebuild bool
+
+	// DryRun causes Converge to report the actions it would perform
+	// without performing them.
+	DryRun bool
+
+	// Concurrency defines how many collections are converged at once.
+	// Defaults to 1.
+	Concurrency int
+
+	// BuildTimeout defines for how long to wait for an index build
+	// started by another client to finish. Defaults to 10 minutes.
+	BuildTimeout time.Duration
+}
+
+// NewIndexManager returns an index manager that converges the indexes
+// in db to those declared in colls.
+func NewIndexManager(db *mgo.Database, colls []Collection) *IndexManager {
+	return &IndexManager{
+		db:           db,
+		colls:        colls,
+		Concurrency:  1,
+		BuildTimeout: 10 * time.Minute,
+	}
+}
+
+// Plan returns the actions Converge would perform.
+func (m *IndexManager) Plan() ([]Action, error) {
+	drifts, err := Diff(m.db, m.colls)
+	if err != nil {
+		return nil, err
+	}
+	return m.plan(drifts)
+}
+
+func (m *IndexManager) plan(drifts []Drift) ([]Action, error) {
+	infos := make(map[string]*mgo.CollectionInfo)
+	indexes := make(map[string][]mgo.Index)
+	for i := range m.colls {
+		infos[m.colls[i].Name] = m.colls[i].Info
+		indexes[m.colls[i].Name] = m.colls[i].Indexes
+	}
+	var actions []Action
+	for _, d := range drifts {
+		switch d.Kind {
+		case MissingCollection:
+			actions = append(actions, Action{Kind: CreateCollection, Collection: d.Collection, Info: infos[d.Collection]})
+			for i := range indexes[d.Collection] {
+				actions = append(actions, Action{Kind: CreateIndex, Collection: d.Collection, Index: &indexes[d.Collection][i]})
+			}
+		case ChangedCollection:
+			return nil, &DriftError{[]Drift{d}}
+		case MissingIndex:
+			actions = append(actions, Action{Kind: CreateIndex, Collection: d.Collection, Index: d.Index})
+		case ExtraIndex:
+			if m.DropExtra {
+				actions = append(actions, Action{Kind: DropIndex, Collection: d.Collection, Index: d.Index})
+			}
+		case ChangedIndex:
+			if !m.Rebuild {
+				return nil, &DriftError{[]Drift{d}}
+			}
+			actions = append(actions,
+				Action{Kind: DropIndex, Collection: d.Collection, Index: d.Index},
+				Action{Kind: CreateIndex, Collection: d.Collection, Index: d.Want},
+			)
+		}
+	}
+	return actions, nil
+}
+
+// Converge performs the actions needed for the database to hold the
+// declared collections and indexes, and returns them. If DryRun is set
+// the actions are returned without being performed.
+//
+// Actions for distinct collections may run concurrently, as defined
+// by the Concurrency field, while actions on the same collection run
+// sequentially in the order returned by Plan.
+func (m *IndexManager) Converge() ([]Action, error) {
+	actions, err := m.Plan()
+	if err != nil || m.DryRun {
+		return actions, err
+	}
+
+	var order []string
+	byColl := make(map[string][]Action)
+	for _, a := range actions {
+		if _, ok := byColl[a.Collection]; !ok {
+			order = append(order, a.Collection)
+		}
+		byColl[a.Collection] = append(byColl[a.Collection], a)
+	}
+
+	n := m.Concurrency
+	if n < 1 {
+		n = 1
+	}
+	sem := make(chan bool, n)
+	errs := make([]error, len(order))
+	var wg sync.WaitGroup
+	for i, name := range order {
+		wg.Add(1)
+		sem <- true
+		go func(i int, actions []Action) {
+			defer func() { <-sem; wg.Done() }()
+			session := m.db.Session.Copy()
+			defer session.Close()
+			db := m.db.With(session)
+			for _, a := range actions {
+				if err := m.perform(db, a); err != nil {
+					errs[i] = fmt.Errorf("cannot %s: %v", a, err)
+					return
+				}
+			}
+		}(i, byColl[name])
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return actions, err
+		}
+	}
+	return actions, nil
+}
+
+func (m *IndexManager) perform(db *mgo.Database, a Action) error {
+	c := db.C(a.Collection)
+	switch a.Kind {
+	case CreateCollection:
+		info := a.Info
+		if info == nil {
+			info = &mgo.CollectionInfo{}
+		}
+		err := c.Create(info)
+		if qerr, ok := err.(*mgo.QueryError); ok && qerr.Code == 48 {
+			// NamespaceExists: created concurrently by someone else.
+			return nil
+		}
+		return err
+	case DropIndex:
+		err := c.DropIndexName(a.Index.Name)
+		if qerr, ok := err.(*mgo.QueryError); ok && qerr.Code == 27 {
+			// IndexNotFound: dropped concurrently by someone else.
+			return nil
+		}
+		return err
+	case CreateIndex:
+		// Drop the cached state as the index may have been dropped
+		// by a previous action.
+		db.Session.ResetIndexCache()
+		err := c.EnsureIndex(*a.Index)
+		if qerr, ok := err.(*mgo.QueryError); ok && qerr.Code == 276 {
+			// IndexBuildAlreadyInProgress: wait for the other build.
+			return m.waitIndex(c, a.Index)
+		}
+		return err
+	}
+	return fmt.Errorf("unknown action kind %d", int(a.Kind))
+}
+
+// waitIndex waits until an index build started by another client
+// finishes, which is when the index is reported by listIndexes.
+func (m *IndexManager) waitIndex(c *mgo.Collection, index *mgo.Index) error {
+	key := IndexKey(index.Key)
+	deadline := time.Now().Add(m.BuildTimeout)
+	for {
+		indexes, err := c.Indexes()
+		if err != nil {
+			return err
+		}
+		for i := range indexes {
+			if IndexKey(indexes[i].Key) == key {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout waiting for index build in progress")
+		}
+		time.Sleep(time.Second)
+	}
+}
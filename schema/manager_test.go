@@ -0,0 +1,170 @@
+package schema
+
+import (
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/dbtest"
+)
+
+type ManagerSuite struct {
+	server  dbtest.DBServer
+	session *mgo.Session
+}
+
+var _ = Suite(&ManagerSuite{})
+
+func (s *ManagerSuite) SetUpSuite(c *C) {
+	s.server.SetPath(c.MkDir())
+}
+
+func (s *ManagerSuite) TearDownSuite(c *C) {
+	s.server.Stop()
+}
+
+func (s *ManagerSuite) SetUpTest(c *C) {
+	s.server.Wipe()
+	s.session = s.server.Session()
+}
+
+func (s *ManagerSuite) TearDownTest(c *C) {
+	s.session.Close()
+}
+
+func indexKeys(c *C, coll *mgo.Collection) []string {
+	indexes, err := coll.Indexes()
+	c.Assert(err, IsNil)
+	var keys []string
+	for i := range indexes {
+		keys = append(keys, IndexKey(indexes[i].Key))
+	}
+	return keys
+}
+
+func (s *ManagerSuite) TestConvergeDryRun(c *C) {
+	db := s.session.DB("mydb")
+	m := NewIndexManager(db, []Collection{{
+		Name:    "a",
+		Indexes: []mgo.Index{{Key: []string{"x"}}, {Key: []string{"-y"}}},
+	}})
+	m.DryRun = true
+
+	actions, err := m.Converge()
+	c.Assert(err, IsNil)
+	c.Assert(actions, HasLen, 3)
+	c.Assert(actions[0].String(), Equals, "create collection a")
+	c.Assert(actions[1].String(), Equals, "create index a x")
+	c.Assert(actions[2].String(), Equals, "create index a -y")
+
+	names, err := db.CollectionNames()
+	c.Assert(err, IsNil)
+	c.Assert(names, HasLen, 0)
+}
+
+func (s *ManagerSuite) TestConverge(c *C) {
+	db := s.session.DB("mydb")
+	colls := []Collection{{
+		Name:    "a",
+		Indexes: []mgo.Index{{Key: []string{"x"}}, {Key: []string{"-y"}}},
+	}, {
+		Name:    "b",
+		Info:    &mgo.CollectionInfo{Capped: true, MaxBytes: 4096},
+		Indexes: []mgo.Index{{Key: []string{"z"}, Unique: true}},
+	}}
+	m := NewIndexManager(db, colls)
+	m.Concurrency = 2
+
+	actions, err := m.Converge()
+	c.Assert(err, IsNil)
+	c.Assert(actions, HasLen, 5)
+	c.Assert(indexKeys(c, db.C("a")), DeepEquals, []string{"_id", "x", "-y"})
+	c.Assert(indexKeys(c, db.C("b")), DeepEquals, []string{"_id", "z"})
+
+	info, err := collectionInfos(db)
+	c.Assert(err, IsNil)
+	c.Assert(info["b"].Capped, Equals, true)
+
+	// Nothing left to do once converged.
+	actions, err = m.Converge()
+	c.Assert(err, IsNil)
+	c.Assert(actions, HasLen, 0)
+}
+
+func (s *ManagerSuite) TestConvergeDrop(c *C) {
+	db := s.session.DB("mydb")
+	coll := db.C("a")
+	c.Assert(coll.EnsureIndexKey("x"), IsNil)
+	c.Assert(coll.EnsureIndexKey("extra"), IsNil)
+
+	m := NewIndexManager(db, []Collection{{
+		Name:    "a",
+		Indexes: []mgo.Index{{Key: []string{"x"}}},
+	}})
+
+	// Extra indexes are left alone by default.
+	actions, err := m.Converge()
+	c.Assert(err, IsNil)
+	c.Assert(actions, HasLen, 0)
+	c.Assert(indexKeys(c, coll), DeepEquals, []string{"_id", "extra", "x"})
+
+	m.DropExtra = true
+	m.DryRun = true
+	actions, err = m.Converge()
+	c.Assert(err, IsNil)
+	c.Assert(actions, HasLen, 1)
+	c.Assert(actions[0].String(), Equals, "drop index a extra")
+	c.Assert(indexKeys(c, coll), DeepEquals, []string{"_id", "extra", "x"})
+
+	m.DryRun = false
+	actions, err = m.Converge()
+	c.Assert(err, IsNil)
+	c.Assert(actions, HasLen, 1)
+	c.Assert(indexKeys(c, coll), DeepEquals, []string{"_id", "x"})
+}
+
+func (s *ManagerSuite) TestConvergeRebuild(c *C) {
+	db := s.session.DB("mydb")
+	coll := db.C("a")
+	c.Assert(coll.EnsureIndexKey("x"), IsNil)
+
+	m := NewIndexManager(db, []Collection{{
+		Name:    "a",
+		Indexes: []mgo.Index{{Key: []string{"x"}, Unique: true}},
+	}})
+	_, err := m.Converge()
+	c.Assert(err, ErrorMatches, "schema drift: changed index a x: unique is false, want true")
+
+	m.Rebuild = true
+	actions, err := m.Converge()
+	c.Assert(err, IsNil)
+	c.Assert(actions, HasLen, 2)
+
+	indexes, err := coll.Indexes()
+	c.Assert(err, IsNil)
+	c.Assert(indexes, HasLen, 2)
+	c.Assert(indexes[1].Key, DeepEquals, []string{"x"})
+	c.Assert(indexes[1].Unique, Equals, true)
+}
+
+func (s *ManagerSuite) TestPerformConcurrent(c *C) {
+	db := s.session.DB("mydb")
+	coll := db.C("a")
+	c.Assert(coll.Create(&mgo.CollectionInfo{}), IsNil)
+
+	// Actions already performed by someone else succeed.
+	m := NewIndexManager(db, nil)
+	c.Assert(m.perform(db, Action{Kind: CreateCollection, Collection: "a"}), IsNil)
+	index := &mgo.Index{Name: "x_1", Key: []string{"x"}}
+	c.Assert(m.perform(db, Action{Kind: DropIndex, Collection: "a", Index: index}), IsNil)
+}
+
+func (s *ManagerSuite) TestWaitIndex(c *C) {
+	db := s.session.DB("mydb")
+	coll := db.C("a")
+	c.Assert(coll.EnsureIndexKey("x"), IsNil)
+
+	m := NewIndexManager(db, nil)
+	m.BuildTimeout = 0
+	c.Assert(m.waitIndex(coll, &mgo.Index{Key: []string{"x"}}), IsNil)
+	err := m.waitIndex(coll, &mgo.Index{Key: []string{"y"}})
+	c.Assert(err, ErrorMatches, "timeout waiting for index build in progress")
+}
@@ -0,0 +1,315 @@
+// The schema package compares collections and indexes declared in
+// code against those found in a MongoDB database, so that deployments
+// may detect drift between both and fail fast.
+//
+//     colls := []schema.Collection{{
+//         Name:    "accounts",
+//         Indexes: []mgo.Index{{Key: []string{"email"}, Unique: true}},
+//     }}
+//     if err := schema.Check(session.DB("app"), colls); err != nil {
+//         log.Fatal(err)
+//     }
+//
+// The package also infers the schema of existing collections from a
+// sample of their documents, which helps with getting to know legacy
+// collections that were never documented. See Infer.
+//
+package schema
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Collection declares a collection and the indexes it must have.
+type Collection struct {
+	Name string
+
+	// Info, if set, declares the capped settings and validator the
+	// collection must have. Fields that only affect how the collection
+	// is created, such as DisableIdIndex, are not compared.
+	Info *mgo.CollectionInfo
+
+	// Indexes declares all indexes in the collection besides the one
+	// on _id. Indexes are matched against existing ones by key.
+	Indexes []mgo.Index
+}
+
+// Kind identifies the kind of drift found between declared and
+// existing schemas.
+type Kind int
+
+const (
+	MissingCollection Kind = iota + 1
+	ChangedCollection
+	MissingIndex
+	ExtraIndex
+	ChangedIndex
+)
+
+func (k Kind) String() string {
+	switch k {
+	case MissingCollection:
+		return "missing collection"
+	case ChangedCollection:
+		return "changed collection"
+	case MissingIndex:
+		return "missing index"
+	case ExtraIndex:
+		return "extra index"
+	case ChangedIndex:
+		return "changed index"
+	}
+	return fmt.Sprintf("unknown drift kind %d", int(k))
+}
+
+// Drift describes a single difference between declared and existing
+// schemas.
+type Drift struct {
+	Kind       Kind
+	Collection string
+
+	// Index holds the existing index for ExtraIndex and ChangedIndex
+	// drifts, and the declared index for MissingIndex drifts.
+	Index *mgo.Index
+
+	// Want holds the declared index for ChangedIndex drifts.
+	Want *mgo.Index
+
+	// Detail describes what differs for changed collections and indexes.
+	Detail string
+}
+
+func (d Drift) String() string {
+	s := d.Kind.String() + " " + d.Collection
+	if d.Index != nil {
+		s += " " + IndexKey(d.Index.Key)
+	}
+	if d.Detail != "" {
+		s += ": " + d.Detail
+	}
+	return s
+}
+
+// DriftError is returned by Check when drift is found.
+type DriftError struct {
+	Drifts []Drift
+}
+
+func (e *DriftError) Error() string {
+	if len(e.Drifts) == 1 {
+		return "schema drift: " + e.Drifts[0].String()
+	}
+	var buf bytes.Buffer
+	buf.WriteString("schema drift:\n")
+	for _, d := range e.Drifts {
+		buf.WriteString("  - ")
+		buf.WriteString(d.String())
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+// Check returns a *DriftError if Diff reports any drift.
+func Check(db *mgo.Database, colls []Collection) error {
+	drifts, err := Diff(db, colls)
+	if err != nil {
+		return err
+	}
+	if len(drifts) > 0 {
+		return &DriftError{drifts}
+	}
+	return nil
+}
+
+// Diff compares the declared collections against those in db, reporting
+// missing collections and missing, extra, or changed indexes.
+// Collections in db that were not declared are not reported.
+func Diff(db *mgo.Database, colls []Collection) ([]Drift, error) {
+	infos, err := collectionInfos(db)
+	if err != nil {
+		return nil, err
+	}
+	var drifts []Drift
+	for i := range colls {
+		coll := &colls[i]
+		info, ok := infos[coll.Name]
+		if !ok {
+			drifts = append(drifts, Drift{Kind: MissingCollection, Collection: coll.Name})
+			continue
+		}
+		if coll.Info != nil {
+			if detail := diffInfo(coll.Info, &info); detail != "" {
+				drifts = append(drifts, Drift{Kind: ChangedCollection, Collection: coll.Name, Detail: detail})
+			}
+		}
+		indexes, err := db.C(coll.Name).Indexes()
+		if err != nil {
+			return nil, err
+		}
+		drifts = append(drifts, diffIndexes(coll.Name, coll.Indexes, indexes)...)
+	}
+	return drifts, nil
+}
+
+type collectionOptions struct {
+	Capped           bool     `bson:"capped"`
+	Size             int      `bson:"size"`
+	Max              int      `bson:"max"`
+	Validator        bson.Raw `bson:"validator"`
+	ValidationLevel  string   `bson:"validationLevel"`
+	ValidationAction string   `bson:"validationAction"`
+}
+
+func collectionInfos(db *mgo.Database) (map[string]collectionOptions, error) {
+	var result struct {
+		Cursor struct {
+			FirstBatch []struct {
+				Name    string
+				Options collectionOptions
+			} `bson:"firstBatch"`
+			Id int64
+		}
+	}
+	// A large batch size is requested so that the cursor is exhausted
+	// in the first batch for any reasonable number of collections.
+	err := db.Run(bson.D{{"listCollections", 1}, {"cursor", bson.D{{"batchSize", 1 << 20}}}}, &result)
+	if err != nil {
+		return nil, err
+	}
+	if result.Cursor.Id != 0 {
+		return nil, fmt.Errorf("too many collections in database %q", db.Name)
+	}
+	infos := make(map[string]collectionOptions)
+	for _, coll := range result.Cursor.FirstBatch {
+		infos[coll.Name] = coll.Options
+	}
+	return infos, nil
+}
+
+func diffInfo(want *mgo.CollectionInfo, have *collectionOptions) string {
+	var diffs []string
+	if want.Capped != have.Capped {
+		diffs = append(diffs, fmt.Sprintf("capped is %v, want %v", have.Capped, want.Capped))
+	} else if want.Capped {
+		if want.MaxBytes != have.Size {
+			diffs = append(diffs, fmt.Sprintf("size is %d, want %d", have.Size, want.MaxBytes))
+		}
+		if want.MaxDocs != have.Max {
+			diffs = append(diffs, fmt.Sprintf("max is %d, want %d", have.Max, want.MaxDocs))
+		}
+	}
+	if want.Validator != nil && !sameDocument(want.Validator, have.Validator.Data) {
+		diffs = append(diffs, "validator differs")
+	}
+	if want.ValidationLevel != "" && want.ValidationLevel != have.ValidationLevel {
+		diffs = append(diffs, fmt.Sprintf("validationLevel is %q, want %q", have.ValidationLevel, want.ValidationLevel))
+	}
+	if want.ValidationAction != "" && want.ValidationAction != have.ValidationAction {
+		diffs = append(diffs, fmt.Sprintf("validationAction is %q, want %q", have.ValidationAction, want.ValidationAction))
+	}
+	return strings.Join(diffs, ", ")
+}
+
+// sameDocument reports whether want marshals into a document equal to
+// the one in data. Both are unmarshalled into maps before comparing, so
+// that the order of fields in documents such as bson.M doesn't matter.
+func sameDocument(want interface{}, data []byte) bool {
+	wdata, err := bson.Marshal(want)
+	if err != nil || len(data) == 0 {
+		return false
+	}
+	var a, b bson.M
+	if bson.Unmarshal(wdata, &a) != nil || bson.Unmarshal(data, &b) != nil {
+		return false
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func diffIndexes(coll string, want, have []mgo.Index) []Drift {
+	var drifts []Drift
+	existing := make(map[string]int)
+	for i := range have {
+		existing[IndexKey(have[i].Key)] = i
+	}
+	declared := make(map[string]bool)
+	for i := range want {
+		w := &want[i]
+		key := IndexKey(w.Key)
+		declared[key] = true
+		j, ok := existing[key]
+		if !ok {
+			drifts = append(drifts, Drift{Kind: MissingIndex, Collection: coll, Index: w})
+			continue
+		}
+		h := &have[j]
+		if detail := diffIndex(w, h); detail != "" {
+			drifts = append(drifts, Drift{Kind: ChangedIndex, Collection: coll, Index: h, Want: w, Detail: detail})
+		}
+	}
+	for i := range have {
+		h := &have[i]
+		key := IndexKey(h.Key)
+		if key == "_id" || declared[key] {
+			continue
+		}
+		drifts = append(drifts, Drift{Kind: ExtraIndex, Collection: coll, Index: h})
+	}
+	return drifts
+}
+
+func diffIndex(want, have *mgo.Index) string {
+	var diffs []string
+	if want.Name != "" && want.Name != have.Name {
+		diffs = append(diffs, fmt.Sprintf("name is %q, want %q", have.Name, want.Name))
+	}
+	if want.Unique != have.Unique {
+		diffs = append(diffs, fmt.Sprintf("unique is %v, want %v", have.Unique, want.Unique))
+	}
+	if want.Sparse != have.Sparse {
+		diffs = append(diffs, fmt.Sprintf("sparse is %v, want %v", have.Sparse, want.Sparse))
+	}
+	if want.ExpireAfter/time.Second != have.ExpireAfter/time.Second {
+		diffs = append(diffs, fmt.Sprintf("expireAfter is %v, want %v", have.ExpireAfter, want.ExpireAfter))
+	}
+	if want.Collation != nil && !sameCollation(want.Collation, have.Collation) {
+		diffs = append(diffs, "collation differs")
+	}
+	return strings.Join(diffs, ", ")
+}
+
+// sameCollation reports whether have matches the settings in want.
+// The server fills in defaults for unset fields, so only fields set in
+// want are compared.
+func sameCollation(want, have *mgo.Collation) bool {
+	if have == nil {
+		return false
+	}
+	return want.Locale == have.Locale &&
+		(want.Strength == 0 || want.Strength == have.Strength) &&
+		(want.CaseFirst == "" || want.CaseFirst == have.CaseFirst) &&
+		(!want.CaseLevel || have.CaseLevel) &&
+		(!want.NumericOrdering || have.NumericOrdering)
+}
+
+// IndexKey returns the declared index key in the canonical form
+// reported by mgo.Collection.Indexes, joined by commas.
+func IndexKey(key []string) string {
+	norm := make([]string, len(key))
+	for i, field := range key {
+		switch {
+		case strings.HasPrefix(field, "+"):
+			field = field[1:]
+		case strings.HasPrefix(field, "@"):
+			field = "$2d:" + field[1:]
+		}
+		norm[i] = field
+	}
+	return strings.Join(norm, ",")
+}
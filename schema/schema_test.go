@@ -0,0 +1,145 @@
+package schema
+
+import (
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestAll(t *testing.T) {
+	TestingT(t)
+}
+
+type DiffSuite struct{}
+
+var _ = Suite(&DiffSuite{})
+
+func (s *DiffSuite) TestIndexKey(c *C) {
+	c.Assert(IndexKey([]string{"+a", "-b", "@loc", "$text:t"}), Equals, "a,-b,$2d:loc,$text:t")
+}
+
+func (s *DiffSuite) TestDiffIndexes(c *C) {
+	want := []mgo.Index{
+		{Key: []string{"email"}, Unique: true},
+		{Key: []string{"+a", "-b"}},
+		{Key: []string{"t"}, ExpireAfter: time.Hour},
+		{Key: []string{"missing"}},
+	}
+	have := []mgo.Index{
+		{Name: "_id_", Key: []string{"_id"}},
+		{Name: "email_1", Key: []string{"email"}},
+		{Name: "a_1_b_-1", Key: []string{"a", "-b"}},
+		{Name: "t_1", Key: []string{"t"}, ExpireAfter: time.Hour},
+		{Name: "extra_1", Key: []string{"extra"}},
+	}
+	drifts := diffIndexes("c", want, have)
+	c.Assert(drifts, HasLen, 3)
+
+	c.Assert(drifts[0].Kind, Equals, ChangedIndex)
+	c.Assert(drifts[0].Index.Name, Equals, "email_1")
+	c.Assert(drifts[0].Want, Equals, &want[0])
+	c.Assert(drifts[0].String(), Equals, "changed index c email: unique is false, want true")
+
+	c.Assert(drifts[1].Kind, Equals, MissingIndex)
+	c.Assert(drifts[1].String(), Equals, "missing index c missing")
+
+	c.Assert(drifts[2].Kind, Equals, ExtraIndex)
+	c.Assert(drifts[2].Index.Name, Equals, "extra_1")
+
+	err := &DriftError{drifts}
+	c.Assert(err.Error(), Equals, "schema drift:\n"+
+		"  - changed index c email: unique is false, want true\n"+
+		"  - missing index c missing\n"+
+		"  - extra index c extra\n")
+}
+
+func (s *DiffSuite) TestDiffIndexOptions(c *C) {
+	want := &mgo.Index{
+		Name:        "custom",
+		Sparse:      true,
+		ExpireAfter: time.Minute,
+		Collation:   &mgo.Collation{Locale: "en", Strength: 2},
+	}
+	have := &mgo.Index{
+		Name:      "other",
+		Collation: &mgo.Collation{Locale: "en", Strength: 3, CaseFirst: "off"},
+	}
+	c.Assert(diffIndex(want, have), Equals, `name is "other", want "custom", `+
+		`sparse is false, want true, expireAfter is 0s, want 1m0s, collation differs`)
+
+	have = &mgo.Index{
+		Name:        "custom",
+		Sparse:      true,
+		ExpireAfter: time.Minute,
+		Collation:   &mgo.Collation{Locale: "en", Strength: 2, CaseFirst: "off"},
+	}
+	c.Assert(diffIndex(want, have), Equals, "")
+}
+
+func (s *DiffSuite) TestDiffInfo(c *C) {
+	validator := bson.M{"a": bson.M{"$exists": true}, "b": 1}
+	data, err := bson.Marshal(bson.D{{"b", 1}, {"a", bson.D{{"$exists", true}}}})
+	c.Assert(err, IsNil)
+	have := &collectionOptions{
+		Capped:    true,
+		Size:      4096,
+		Validator: bson.Raw{Kind: 3, Data: data},
+	}
+	want := &mgo.CollectionInfo{Capped: true, MaxBytes: 4096, Validator: validator}
+	c.Assert(diffInfo(want, have), Equals, "")
+
+	want = &mgo.CollectionInfo{Capped: true, MaxBytes: 8192, MaxDocs: 10, Validator: bson.M{"a": 1}}
+	c.Assert(diffInfo(want, have), Equals, "size is 4096, want 8192, max is 0, want 10, validator differs")
+
+	want = &mgo.CollectionInfo{ValidationLevel: "moderate"}
+	c.Assert(diffInfo(want, have), Equals, `capped is true, want false, validationLevel is "", want "moderate"`)
+}
+
+func (s *DiffSuite) TestPlan(c *C) {
+	colls := []Collection{{
+		Name:    "a",
+		Indexes: []mgo.Index{{Key: []string{"x"}}, {Key: []string{"y"}}},
+	}, {
+		Name: "b",
+	}}
+	m := NewIndexManager(nil, colls)
+
+	drifts := []Drift{
+		{Kind: MissingCollection, Collection: "a"},
+		{Kind: ExtraIndex, Collection: "b", Index: &mgo.Index{Name: "z_1", Key: []string{"z"}}},
+	}
+	actions, err := m.plan(drifts)
+	c.Assert(err, IsNil)
+	c.Assert(actions, HasLen, 3)
+	c.Assert(actions[0].String(), Equals, "create collection a")
+	c.Assert(actions[1].String(), Equals, "create index a x")
+	c.Assert(actions[2].String(), Equals, "create index a y")
+
+	m.DropExtra = true
+	actions, err = m.plan(drifts)
+	c.Assert(err, IsNil)
+	c.Assert(actions, HasLen, 4)
+	c.Assert(actions[3].String(), Equals, "drop index b z")
+
+	changed := []Drift{{
+		Kind:       ChangedIndex,
+		Collection: "a",
+		Index:      &mgo.Index{Name: "x_1", Key: []string{"x"}},
+		Want:       &mgo.Index{Key: []string{"x"}, Unique: true},
+		Detail:     "unique is false, want true",
+	}}
+	_, err = m.plan(changed)
+	c.Assert(err, ErrorMatches, "schema drift: changed index a x: unique is false, want true")
+
+	m.Rebuild = true
+	actions, err = m.plan(changed)
+	c.Assert(err, IsNil)
+	c.Assert(actions, HasLen, 2)
+	c.Assert(actions[0].Kind, Equals, DropIndex)
+	c.Assert(actions[0].Index.Name, Equals, "x_1")
+	c.Assert(actions[1].Kind, Equals, CreateIndex)
+	c.Assert(actions[1].Index.Unique, Equals, true)
+}
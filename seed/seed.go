@@ -0,0 +1,321 @@
+// The seed package generates synthetic documents out of the struct types
+// of an application and inserts them into collections, so that load tests
+// may run against realistic data sets of any size:
+//
+//     type Order struct {
+//         Id       bson.ObjectId `bson:"_id"`
+//         Customer string        `bson:"customer"`
+//         Status   string        `bson:"status"`
+//         Total    float64       `bson:"total"`
+//         Items    []Item        `bson:"items"`
+//     }
+//
+//     seeder := &seed.Seeder{
+//         Cardinality: map[string]int{"customer": 10000, "status": 4},
+//     }
+//     result, err := seeder.Insert(session.DB("load").C("orders"), Order{}, 1000000)
+//
+// Documents are filled field by field with random values of the field
+// types. Fields are identified by their dotted BSON path, as used in
+// queries, so that the values of selected fields may be customized, and
+// the number of distinct values they take may be limited, as that's what
+// determines the selectivity of indexes and queries in the load tests.
+//
+package seed
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Seeder generates synthetic documents. The zero value is ready to use.
+type Seeder struct {
+	// Seed initializes the pseudo-random generator, so that seeders
+	// with the same settings generate the same documents, except for
+	// times, which are based on the current time, and object ids in the
+	// _id field, which are unique.
+	Seed int64
+
+	// Cardinality holds the number of distinct values that fields take,
+	// keyed by their dotted path. Elements of slices, arrays, and maps
+	// share the path of the field holding them. Fields not listed take
+	// a different random value in every document.
+	Cardinality map[string]int
+
+	// Values holds functions returning the values of fields, keyed by
+	// their dotted path. The values must be assignable or convertible to
+	// the type of the field. The function receives the generator in use,
+	// and the index of the document being generated.
+	Values map[string]func(r *rand.Rand, i int) interface{}
+
+	// Ingest holds the settings used for inserting documents.
+	Ingest mgo.Ingest
+}
+
+// Generate appends n documents to the slice of structs, or pointers to
+// structs, pointed to by result.
+func (s *Seeder) Generate(result interface{}, n int) error {
+	resultv := reflect.ValueOf(result)
+	if resultv.Kind() != reflect.Ptr || resultv.Elem().Kind() != reflect.Slice {
+		panic("result argument must be a slice address")
+	}
+	slicev := resultv.Elem()
+	g := s.generator()
+	for i := 0; i < n; i++ {
+		elemp := reflect.New(slicev.Type().Elem())
+		if err := g.fill(elemp.Elem(), "", i); err != nil {
+			return err
+		}
+		slicev = reflect.Append(slicev, elemp.Elem())
+	}
+	resultv.Elem().Set(slicev)
+	return nil
+}
+
+// Insert generates n documents of the struct type of proto and inserts
+// them into coll. Documents are generated while they're inserted, so
+// only the batches being inserted are held in memory.
+func (s *Seeder) Insert(coll *mgo.Collection, proto interface{}, n int) (*mgo.IngestResult, error) {
+	t := reflect.TypeOf(proto)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("seed: cannot generate documents of type %T", proto)
+	}
+	g := s.generator()
+	var err error
+	i := 0
+	result, ierr := coll.IngestFunc(func() (interface{}, bool) {
+		if i == n || err != nil {
+			return nil, false
+		}
+		doc := reflect.New(t)
+		err = g.fill(doc.Elem(), "", i)
+		i++
+		return doc.Interface(), err == nil
+	}, &s.Ingest)
+	if err != nil {
+		return result, err
+	}
+	return result, ierr
+}
+
+func (s *Seeder) generator() *generator {
+	return &generator{
+		seeder: s,
+		rand:   rand.New(rand.NewSource(s.Seed)),
+		now:    time.Now(),
+		open:   make(map[reflect.Type]int),
+	}
+}
+
+type generator struct {
+	seeder *Seeder
+	rand   *rand.Rand
+	now    time.Time
+
+	// open counts the structs of each type being filled at the current
+	// path, so that self-referential types don't recurse forever.
+	open map[reflect.Type]int
+}
+
+// maxNesting is how deep structs of the same type may nest in each other,
+// through pointers, slices, or maps, before those are left empty.
+const maxNesting = 2
+
+// nested reports whether filling values of type t would nest structs of
+// the same type deeper than maxNesting.
+func (g *generator) nested(t reflect.Type) bool {
+	for {
+		switch t.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+			t = t.Elem()
+			continue
+		case reflect.Struct:
+			return g.open[t] >= maxNesting
+		}
+		return false
+	}
+}
+
+var (
+	typeTime     = reflect.TypeOf(time.Time{})
+	typeObjectId = reflect.TypeOf(bson.ObjectId(""))
+	typeBytes    = reflect.TypeOf([]byte(nil))
+)
+
+// fill sets v, found at path in the document with index i, to a random
+// value honoring the settings of the seeder.
+func (g *generator) fill(v reflect.Value, path string, i int) error {
+	if f, ok := g.seeder.Values[path]; ok && path != "" {
+		value := reflect.ValueOf(f(g.rand, i))
+		switch {
+		case !value.IsValid():
+			v.Set(reflect.Zero(v.Type()))
+		case value.Type().AssignableTo(v.Type()):
+			v.Set(value)
+		case value.Type().ConvertibleTo(v.Type()):
+			v.Set(value.Convert(v.Type()))
+		default:
+			return fmt.Errorf("seed: value for %s has type %s; want %s", path, value.Type(), v.Type())
+		}
+		return nil
+	}
+	if k := g.seeder.Cardinality[path]; k > 0 && path != "" {
+		// Pick one of k values, generating it with a generator that is
+		// seeded by the value index, so that it comes out the same in
+		// every document picking it.
+		h := fnv.New64a()
+		fmt.Fprintf(h, "%d %s %d", g.seeder.Seed, path, g.rand.Intn(k))
+		sub := &generator{seeder: g.seeder, rand: rand.New(rand.NewSource(int64(h.Sum64()))), now: g.now, open: g.open}
+		return sub.value(v, path, i)
+	}
+	return g.value(v, path, i)
+}
+
+func (g *generator) value(v reflect.Value, path string, i int) error {
+	r := g.rand
+	switch v.Type() {
+	case typeTime:
+		ago := time.Duration(r.Int63n(int64(365 * 24 * time.Hour)))
+		v.Set(reflect.ValueOf(g.now.Add(-ago).Truncate(time.Millisecond)))
+		return nil
+	case typeObjectId:
+		if path == "_id" {
+			v.Set(reflect.ValueOf(bson.NewObjectId()))
+		} else {
+			id := make([]byte, 12)
+			r.Read(id)
+			v.Set(reflect.ValueOf(bson.ObjectId(id)))
+		}
+		return nil
+	case typeBytes:
+		data := make([]byte, 16)
+		r.Read(data)
+		v.SetBytes(data)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		if path == "_id" {
+			v.SetString(strconv.Itoa(i))
+		} else {
+			v.SetString(randomString(r, 8))
+		}
+	case reflect.Bool:
+		v.SetBool(r.Intn(2) == 1)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if path == "_id" {
+			v.SetInt(int64(i))
+		} else {
+			v.SetInt(r.Int63() >> uint(64-v.Type().Bits()))
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(uint64(r.Int63()) >> uint(64-v.Type().Bits()))
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(float64(r.Intn(100000)) / 100)
+	case reflect.Ptr:
+		if g.nested(v.Type()) {
+			return nil
+		}
+		elem := reflect.New(v.Type().Elem())
+		if err := g.fill(elem.Elem(), path, i); err != nil {
+			return err
+		}
+		v.Set(elem)
+	case reflect.Slice:
+		if g.nested(v.Type()) {
+			return nil
+		}
+		n := r.Intn(4)
+		v.Set(reflect.MakeSlice(v.Type(), n, n))
+		fallthrough
+	case reflect.Array:
+		for j := 0; j < v.Len(); j++ {
+			if err := g.fill(v.Index(j), path, i); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String || g.nested(v.Type()) {
+			return nil
+		}
+		v.Set(reflect.MakeMap(v.Type()))
+		for j := r.Intn(3) + 1; j > 0; j-- {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := g.fill(elem, path, i); err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(randomString(r, 4)).Convert(v.Type().Key()), elem)
+		}
+	case reflect.Struct:
+		g.open[v.Type()]++
+		defer func() { g.open[v.Type()]-- }()
+		return g.fields(v, path, i)
+	}
+	return nil
+}
+
+// fields fills the fields of the struct v found at path, following the
+// same conventions as the bson package for naming and inlining them.
+func (g *generator) fields(v reflect.Value, path string, i int) error {
+	t := v.Type()
+	for j := 0; j < t.NumField(); j++ {
+		field := t.Field(j)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+		tag := field.Tag.Get("bson")
+		if tag == "" && !strings.Contains(string(field.Tag), ":") {
+			tag = string(field.Tag)
+		}
+		if tag == "-" {
+			continue
+		}
+		fields := strings.Split(tag, ",")
+		inline := false
+		for _, flag := range fields[1:] {
+			inline = inline || flag == "inline"
+		}
+		if inline {
+			if field.Type.Kind() == reflect.Struct {
+				if err := g.fields(v.Field(j), path, i); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		name := fields[0]
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		if path != "" {
+			name = path + "." + name
+		}
+		if err := g.fill(v.Field(j), name, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func randomString(r *rand.Rand, n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte('a' + r.Intn(26))
+	}
+	return string(b)
+}
@@ -0,0 +1,159 @@
+package seed_test
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/dbtest"
+	"gopkg.in/mgo.v2/seed"
+)
+
+func TestAll(t *testing.T) {
+	TestingT(t)
+}
+
+type item struct {
+	SKU   string `bson:"sku"`
+	Count uint8  `bson:"count"`
+}
+
+type base struct {
+	Created time.Time `bson:"created"`
+}
+
+type order struct {
+	Id       bson.ObjectId     `bson:"_id"`
+	Customer string            `bson:"customer"`
+	Status   string            `bson:"status"`
+	Total    float64           `bson:"total"`
+	Items    []item            `bson:"items"`
+	Shipping *item             `bson:"shipping,omitempty"`
+	Labels   map[string]string `bson:"labels"`
+	Ignored  string            `bson:"-"`
+	Base     base              `bson:",inline"`
+	Number   int8
+}
+
+type GenerateSuite struct{}
+
+var _ = Suite(&GenerateSuite{})
+
+func (s *GenerateSuite) TestGenerate(c *C) {
+	seeder := &seed.Seeder{
+		Cardinality: map[string]int{"customer": 3, "items.sku": 2},
+		Values: map[string]func(r *rand.Rand, i int) interface{}{
+			"status": func(r *rand.Rand, i int) interface{} { return []string{"new", "paid"}[i%2] },
+		},
+	}
+	var orders []order
+	c.Assert(seeder.Generate(&orders, 100), IsNil)
+	c.Assert(orders, HasLen, 100)
+
+	customers := make(map[string]bool)
+	skus := make(map[string]bool)
+	ids := make(map[bson.ObjectId]bool)
+	for i, o := range orders {
+		customers[o.Customer] = true
+		ids[o.Id] = true
+		c.Assert(o.Status, Equals, []string{"new", "paid"}[i%2])
+		c.Assert(o.Items, Not(HasLen), 4)
+		for _, it := range o.Items {
+			skus[it.SKU] = true
+		}
+		c.Assert(o.Shipping, NotNil)
+		c.Assert(o.Labels, Not(HasLen), 0)
+		c.Assert(o.Ignored, Equals, "")
+		c.Assert(o.Base.Created.IsZero(), Equals, false)
+		c.Assert(o.Number >= 0, Equals, true)
+	}
+	c.Assert(customers, HasLen, 3)
+	c.Assert(skus, HasLen, 2)
+	c.Assert(ids, HasLen, 100)
+
+	// The same seed generates the same documents.
+	var again []*order
+	c.Assert(seeder.Generate(&again, 100), IsNil)
+	for i, o := range again {
+		c.Assert(o.Customer, Equals, orders[i].Customer)
+		c.Assert(o.Total, Equals, orders[i].Total)
+	}
+
+	seeder.Values["total"] = func(r *rand.Rand, i int) interface{} { return "expensive" }
+	err := seeder.Generate(&orders, 1)
+	c.Assert(err, ErrorMatches, "seed: value for total has type string; want float64")
+}
+
+type category struct {
+	Name     string              `bson:"name"`
+	Parent   *category           `bson:"parent"`
+	Children []category          `bson:"children"`
+	Related  map[string]category `bson:"related"`
+}
+
+func (s *GenerateSuite) TestGenerateRecursive(c *C) {
+	var categories []category
+	c.Assert(new(seed.Seeder).Generate(&categories, 10), IsNil)
+	c.Assert(categories, HasLen, 10)
+	for _, cat := range categories {
+		c.Assert(cat.Parent, NotNil)
+		c.Assert(cat.Parent.Name, Not(Equals), "")
+		c.Assert(cat.Parent.Parent, IsNil)
+		c.Assert(cat.Parent.Children, IsNil)
+		c.Assert(cat.Parent.Related, IsNil)
+		for _, child := range cat.Children {
+			c.Assert(child.Parent, IsNil)
+		}
+	}
+}
+
+type S struct {
+	server  dbtest.DBServer
+	session *mgo.Session
+}
+
+var _ = Suite(&S{})
+
+func (s *S) SetUpSuite(c *C) {
+	s.server.SetPath(c.MkDir())
+}
+
+func (s *S) TearDownSuite(c *C) {
+	s.server.Stop()
+}
+
+func (s *S) SetUpTest(c *C) {
+	s.server.Wipe()
+	s.session = s.server.Session()
+}
+
+func (s *S) TearDownTest(c *C) {
+	s.session.Close()
+}
+
+func (s *S) TestInsert(c *C) {
+	coll := s.session.DB("test").C("orders")
+	seeder := &seed.Seeder{
+		Cardinality: map[string]int{"status": 4},
+		Ingest:      mgo.Ingest{BatchSize: 100},
+	}
+	result, err := seeder.Insert(coll, &order{}, 1000)
+	c.Assert(err, IsNil)
+	c.Assert(result.Inserted, Equals, 1000)
+	c.Assert(result.Batches, Equals, 10)
+
+	n, err := coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1000)
+
+	var statuses []string
+	err = coll.Find(nil).Distinct("status", &statuses)
+	c.Assert(err, IsNil)
+	c.Assert(statuses, HasLen, 4)
+
+	_, err = seeder.Insert(coll, 42, 1)
+	c.Assert(err, ErrorMatches, "seed: cannot generate documents of type int")
+}
@@ -0,0 +1,117 @@
+// The sequence package implements monotonically increasing integer
+// sequences backed by a counters collection in MongoDB.
+//
+// Values are allocated atomically through findAndModify, so sequences
+// may be shared across processes. Allocating values in batches reduces
+// round trips to the server, at the cost of gaps in the sequence when
+// a process exits without using all values it allocated.
+//
+//     seq := sequence.New(session.DB("app").C("counters"), "invoice")
+//     seq.BatchSize = 100
+//     n, err := seq.Next()
+//
+package sequence
+
+import (
+	"fmt"
+	"sync"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type counter struct {
+	Name  string `bson:"_id"`
+	Value int64  `bson:"n"`
+}
+
+// Sequence allocates values from a named counter. It is safe for
+// concurrent use by multiple goroutines.
+type Sequence struct {
+	c    *mgo.Collection
+	name string
+
+	// BatchSize defines how many values are allocated from the server
+	// at once by Next. Defaults to 1.
+	BatchSize int64
+
+	mu   sync.Mutex
+	next int64
+	last int64
+}
+
+// New returns a sequence backed by the counter document with the given
+// name in c. The first value allocated from a new counter is 1.
+func New(c *mgo.Collection, name string) *Sequence {
+	return &Sequence{c: c, name: name, BatchSize: 1}
+}
+
+// Next returns the next value of the sequence. Values returned by a
+// single Sequence always increase, but when batching is enabled values
+// handed out by distinct processes sharing the counter interleave.
+func (s *Sequence) Next() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.next == 0 || s.next > s.last {
+		n := s.BatchSize
+		if n < 1 {
+			n = 1
+		}
+		first, err := s.Allocate(n)
+		if err != nil {
+			return 0, err
+		}
+		s.next = first
+		s.last = first + n - 1
+	}
+	v := s.next
+	s.next++
+	return v, nil
+}
+
+// Allocate reserves n consecutive values from the counter, bypassing
+// any values batched locally, and returns the first one.
+func (s *Sequence) Allocate(n int64) (first int64, err error) {
+	if n < 1 {
+		return 0, fmt.Errorf("cannot allocate %d sequence values", n)
+	}
+	change := mgo.Change{
+		Update:    bson.D{{"$inc", bson.D{{"n", n}}}},
+		Upsert:    true,
+		ReturnNew: true,
+	}
+	var result counter
+	_, err = s.c.FindId(s.name).Apply(change, &result)
+	if mgo.IsDup(err) {
+		// Concurrent upserts on a missing counter; the document
+		// exists now, so retry once.
+		_, err = s.c.FindId(s.name).Apply(change, &result)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return result.Value - n + 1, nil
+}
+
+// Current returns the last value allocated from the counter by any
+// process, or zero if no values were allocated yet.
+func (s *Sequence) Current() (int64, error) {
+	var result counter
+	err := s.c.FindId(s.name).One(&result)
+	if err == mgo.ErrNotFound {
+		return 0, nil
+	}
+	return result.Value, err
+}
+
+// Reset sets the counter so that the next value allocated from it is
+// value+1, and discards values batched locally. It's meant for
+// administrative use; resetting a counter to a lower value while it's
+// being used breaks uniqueness of the allocated values.
+func (s *Sequence) Reset(value int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next, s.last = 0, 0
+	_, err := s.c.UpsertId(s.name, bson.D{{"$set", bson.D{{"n", value}}}})
+	return err
+}
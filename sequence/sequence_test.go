@@ -0,0 +1,135 @@
+package sequence_test
+
+import (
+	"sync"
+	"testing"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/dbtest"
+	"gopkg.in/mgo.v2/sequence"
+)
+
+func TestAll(t *testing.T) {
+	TestingT(t)
+}
+
+type S struct {
+	server  dbtest.DBServer
+	session *mgo.Session
+	c       *mgo.Collection
+}
+
+var _ = Suite(&S{})
+
+func (s *S) SetUpSuite(c *C) {
+	s.server.SetPath(c.MkDir())
+}
+
+func (s *S) TearDownSuite(c *C) {
+	s.server.Stop()
+}
+
+func (s *S) SetUpTest(c *C) {
+	s.server.Wipe()
+
+	s.session = s.server.Session()
+	s.c = s.session.DB("test").C("counters")
+}
+
+func (s *S) TearDownTest(c *C) {
+	s.session.Close()
+}
+
+func (s *S) TestNext(c *C) {
+	seq := sequence.New(s.c, "invoice")
+	cur, err := seq.Current()
+	c.Assert(err, IsNil)
+	c.Assert(cur, Equals, int64(0))
+
+	for i := int64(1); i <= 3; i++ {
+		n, err := seq.Next()
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, i)
+	}
+	cur, err = seq.Current()
+	c.Assert(err, IsNil)
+	c.Assert(cur, Equals, int64(3))
+
+	// Counters are independent.
+	n, err := sequence.New(s.c, "order").Next()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(1))
+}
+
+func (s *S) TestBatch(c *C) {
+	seq1 := sequence.New(s.c, "invoice")
+	seq1.BatchSize = 10
+	seq2 := sequence.New(s.c, "invoice")
+	seq2.BatchSize = 10
+
+	n, err := seq1.Next()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(1))
+	n, err = seq2.Next()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(11))
+	n, err = seq1.Next()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(2))
+
+	cur, err := seq1.Current()
+	c.Assert(err, IsNil)
+	c.Assert(cur, Equals, int64(20))
+}
+
+func (s *S) TestAllocate(c *C) {
+	seq := sequence.New(s.c, "invoice")
+	first, err := seq.Allocate(5)
+	c.Assert(err, IsNil)
+	c.Assert(first, Equals, int64(1))
+	first, err = seq.Allocate(5)
+	c.Assert(err, IsNil)
+	c.Assert(first, Equals, int64(6))
+
+	_, err = seq.Allocate(0)
+	c.Assert(err, ErrorMatches, "cannot allocate 0 sequence values")
+}
+
+func (s *S) TestReset(c *C) {
+	seq := sequence.New(s.c, "invoice")
+	seq.BatchSize = 10
+	_, err := seq.Next()
+	c.Assert(err, IsNil)
+
+	err = seq.Reset(100)
+	c.Assert(err, IsNil)
+	n, err := seq.Next()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(101))
+}
+
+func (s *S) TestConcurrent(c *C) {
+	seq := sequence.New(s.c, "invoice")
+	seq.BatchSize = 3
+
+	var mu sync.Mutex
+	seen := make(map[int64]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				n, err := seq.Next()
+				c.Check(err, IsNil)
+				mu.Lock()
+				c.Check(seen[n], Equals, false)
+				seen[n] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	c.Assert(seen, HasLen, 100)
+}
@@ -27,6 +27,8 @@
 package mgo
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"net"
 	"sort"
@@ -55,6 +57,24 @@ type mongoServer struct {
 	pingCount     uint32
 	pingWindow    [6]time.Duration
 	info          *mongoServerInfo
+	limits        replyLimits
+	msgChecksums  bool
+	compression   wireCompression
+	quota         *serverQuota
+	resolver      *addrResolver
+	poolWaiters   int
+	lastHeartbeat time.Time
+	killing       map[string]bool
+	pendingKills  map[string]*killBatch
+}
+
+// killBatch holds the ids of cursors to be killed together in a single
+// killCursors operation, and the outcome of that operation once done
+// is closed.
+type killBatch struct {
+	cursorIds []int64
+	done      chan struct{}
+	err       error
 }
 
 type dialer struct {
@@ -72,21 +92,38 @@ type mongoServerInfo struct {
 	Tags           bson.D
 	MaxWireVersion int
 	SetName        string
+
+	MaxBSONObjectSize int
+	MaxWriteBatchSize int
 }
 
 var defaultServerInfo mongoServerInfo
 
-func newServer(addr string, tcpaddr *net.TCPAddr, sync chan bool, dial dialer) *mongoServer {
+// idlePing holds the settings for pinging idle pooled sockets.
+type idlePing struct {
+	interval  time.Duration
+	maxMisses int
+}
+
+func newServer(addr, resolvedAddr string, tcpaddr *net.TCPAddr, sync chan bool, resolver *addrResolver, options *clusterOptions) *mongoServer {
 	server := &mongoServer{
 		Addr:         addr,
-		ResolvedAddr: tcpaddr.String(),
+		ResolvedAddr: resolvedAddr,
 		tcpaddr:      tcpaddr,
 		sync:         sync,
-		dial:         dial,
+		dial:         options.dial,
 		info:         &defaultServerInfo,
 		pingValue:    time.Hour, // Push it back before an actual ping.
+		limits:       options.limits,
+		msgChecksums: options.msgChecksums,
+		compression:  options.compression,
+		quota:        newServerQuota(options.quota),
+		resolver:     resolver,
 	}
 	go server.pinger(true)
+	if ping := options.ping; ping.interval > 0 {
+		go server.idlePinger(ping)
+	}
 	return server
 }
 
@@ -100,8 +137,9 @@ var errServerClosed = errors.New("server was closed")
 // the same number of times as AcquireSocket + Acquire were called for it.
 // If the poolLimit argument is greater than zero and the number of sockets in
 // use in this server is greater than the provided limit, errPoolLimit is
-// returned.
-func (server *mongoServer) AcquireSocket(poolLimit int, timeout time.Duration) (socket *mongoSocket, abended bool, err error) {
+// returned. With a pool limit, errPoolLimit is also returned to callers with
+// LowPriority while callers with HighPriority are waiting for a socket.
+func (server *mongoServer) AcquireSocket(poolLimit int, priority Priority, timeout time.Duration) (socket *mongoSocket, abended bool, err error) {
 	for {
 		server.Lock()
 		abended = server.abended
@@ -110,7 +148,7 @@ func (server *mongoServer) AcquireSocket(poolLimit int, timeout time.Duration) (
 			return nil, abended, errServerClosed
 		}
 		n := len(server.unusedSockets)
-		if poolLimit > 0 && len(server.liveSockets)-n >= poolLimit {
+		if poolLimit > 0 && (len(server.liveSockets)-n >= poolLimit || priority == LowPriority && server.poolWaiters > 0) {
 			server.Unlock()
 			return nil, false, errPoolLimit
 		}
@@ -146,6 +184,15 @@ func (server *mongoServer) AcquireSocket(poolLimit int, timeout time.Duration) (
 	panic("unreachable")
 }
 
+// waitPool records that a caller with HighPriority started (delta +1) or
+// stopped (delta -1) waiting for a socket, so that callers with LowPriority
+// hold off on taking one in the meantime.
+func (server *mongoServer) waitPool(delta int) {
+	server.Lock()
+	server.poolWaiters += delta
+	server.Unlock()
+}
+
 // Connect establishes a new connection to the server. This should
 // generally be done through server.AcquireSocket().
 func (server *mongoServer) Connect(timeout time.Duration) (*mongoSocket, error) {
@@ -155,13 +202,30 @@ func (server *mongoServer) Connect(timeout time.Duration) (*mongoSocket, error)
 	server.RUnlock()
 
 	logf("Establishing new connection to %s (timeout=%s)...", server.Addr, timeout)
+	event := &ConnectEvent{Server: server.Addr}
+	started := time.Now()
 	var conn net.Conn
 	var err error
 	switch {
 	case !dial.isSet():
 		// Cannot do this because it lacks timeout support. :-(
 		//conn, err = net.DialTCP("tcp", nil, server.tcpaddr)
-		conn, err = net.DialTimeout("tcp", server.ResolvedAddr, timeout)
+		// Resolving host names counts against the connection timeout.
+		var deadline time.Time
+		if timeout > 0 {
+			deadline = started.Add(timeout)
+		}
+		candidates := server.dialCandidates(deadline)
+		event.DNS = time.Since(started)
+		dialTimeout := timeout
+		if timeout > 0 {
+			dialTimeout = time.Until(deadline)
+		}
+		if timeout > 0 && dialTimeout <= 0 {
+			err = &net.OpError{Op: "dial", Net: "tcp", Addr: server.tcpaddr, Err: context.DeadlineExceeded}
+		} else {
+			conn, err = dialParallel(candidates, dialTimeout)
+		}
 		if tcpconn, ok := conn.(*net.TCPConn); ok {
 			tcpconn.SetKeepAlive(true)
 		} else if err == nil {
@@ -174,14 +238,178 @@ func (server *mongoServer) Connect(timeout time.Duration) (*mongoSocket, error)
 	default:
 		panic("dialer is set, but both dial.old and dial.new are nil")
 	}
+	event.Dial = time.Since(started) - event.DNS
+	if err == nil {
+		event.TLS, err = handshakeTLS(conn, timeout)
+	}
 	if err != nil {
 		logf("Connection to %s failed: %v", server.Addr, err.Error())
+		reportConnect(event, started, err)
 		return nil, err
 	}
 	logf("Connection to %s established.", server.Addr)
 
 	stats.conn(+1, master)
-	return newSocket(server, conn, timeout), nil
+	socket := newSocket(server, conn, timeout)
+	if len(server.compression.compressors) > 0 {
+		handshakeStarted := time.Now()
+		err := socket.negotiateCompression()
+		event.Handshake = time.Since(handshakeStarted)
+		if err != nil {
+			logf("Compression negotiation with %s failed: %v", server.Addr, err)
+			socket.Close()
+			reportConnect(event, started, err)
+			return nil, err
+		}
+	}
+	reportConnect(event, started, nil)
+	return socket, nil
+}
+
+// handshakeTLS runs the handshake of TLS connections returned by custom
+// dialers without having done it yet, so that handshake failures and
+// the time taken by it are accounted for when connecting rather than
+// when first sending a request. It returns the time the handshake took,
+// if it ran.
+func handshakeTLS(conn net.Conn, timeout time.Duration) (time.Duration, error) {
+	tlsconn, ok := conn.(*tls.Conn)
+	if !ok || tlsconn.ConnectionState().HandshakeComplete {
+		return 0, nil
+	}
+	started := time.Now()
+	if timeout > 0 {
+		tlsconn.SetDeadline(started.Add(timeout))
+	}
+	err := tlsconn.Handshake()
+	tlsconn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+	}
+	return time.Since(started), err
+}
+
+// reportConnect reports event to the monitor, if one is set, with the
+// connection that started at the given time having failed with err.
+func reportConnect(event *ConnectEvent, started time.Time, err error) {
+	monitor := getMonitor()
+	if monitor == nil || monitor.Connect == nil {
+		return
+	}
+	event.Duration = time.Since(started)
+	event.Err = err
+	monitor.Connect(event)
+}
+
+// dialStagger is the delay between starting connection attempts to the
+// different addresses a server name resolves to, as in RFC 8305.
+var dialStagger = 250 * time.Millisecond
+
+// dialCandidates returns the addresses to attempt connecting to for the
+// server, starting with its resolved address and followed by any other
+// addresses its host name resolves to, as cached by the cluster's
+// resolver. Looking up the addresses is abandoned at deadline, if set.
+func (server *mongoServer) dialCandidates(deadline time.Time) []string {
+	candidates := []string{server.ResolvedAddr}
+	host, port, err := net.SplitHostPort(server.Addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return candidates
+	}
+	if limit := time.Now().Add(10 * time.Second); deadline.IsZero() || deadline.After(limit) {
+		deadline = limit
+	}
+	ipaddrs, err := server.resolver.lookupHost(host, deadline)
+	if err != nil {
+		debugf("Lookup of %s for parallel dialing failed: %v", host, err)
+		return candidates
+	}
+	for _, ipaddr := range ipaddrs {
+		addr := net.JoinHostPort(ipaddr.String(), port)
+		if addr != server.ResolvedAddr {
+			candidates = append(candidates, addr)
+		}
+	}
+	return candidates
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dialParallel connects to the first of the candidate addresses that
+// accepts the connection. Attempts are started dialStagger apart, or as
+// soon as all previous attempts failed, and the ones still in progress
+// once a connection is established are abandoned. This avoids waiting
+// for the full timeout when some of the addresses are blackholed.
+func dialParallel(candidates []string, timeout time.Duration) (net.Conn, error) {
+	if len(candidates) == 1 {
+		return net.DialTimeout("tcp", candidates[0], timeout)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dialer := net.Dialer{Timeout: timeout}
+	if timeout > 0 {
+		dialer.Deadline = time.Now().Add(timeout)
+	}
+
+	results := make(chan dialResult, len(candidates))
+	started, failed := 0, 0
+	start := func() {
+		addr := candidates[started]
+		started++
+		go func() {
+			conn, err := dialer.DialContext(ctx, "tcp", addr)
+			results <- dialResult{conn, err}
+		}()
+	}
+
+	stagger := time.NewTimer(dialStagger)
+	defer stagger.Stop()
+	start()
+
+	var firstErr error
+	for {
+		select {
+		case <-stagger.C:
+			if started < len(candidates) {
+				start()
+				stagger.Reset(dialStagger)
+			}
+		case result := <-results:
+			if result.err == nil {
+				if pending := started - failed - 1; pending > 0 {
+					go closeDialed(results, pending)
+				}
+				return result.conn, nil
+			}
+			failed++
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			if failed == len(candidates) {
+				return nil, firstErr
+			}
+			if failed == started {
+				// Nothing in progress. Don't wait for the next turn.
+				start()
+				if !stagger.Stop() {
+					<-stagger.C
+				}
+				stagger.Reset(dialStagger)
+			}
+		}
+	}
+}
+
+// closeDialed closes connections from abandoned dial attempts that
+// happened to succeed anyway.
+func closeDialed(results chan dialResult, n int) {
+	for i := 0; i < n; i++ {
+		if result := <-results; result.conn != nil {
+			result.conn.Close()
+		}
+	}
 }
 
 // Close forces closing all sockets that are alive, whether
@@ -208,11 +436,22 @@ func (server *mongoServer) Close() {
 func (server *mongoServer) RecycleSocket(socket *mongoSocket) {
 	server.Lock()
 	if !server.closed {
+		socket.idleSince = time.Now()
 		server.unusedSockets = append(server.unusedSockets, socket)
 	}
 	server.Unlock()
 }
 
+// dropSocket closes socket and forgets about it, without flagging the
+// server as abended.
+func (server *mongoServer) dropSocket(socket *mongoSocket, err error) {
+	server.Lock()
+	server.liveSockets = removeSocket(server.liveSockets, socket)
+	server.unusedSockets = removeSocket(server.unusedSockets, socket)
+	server.Unlock()
+	socket.kill(err, false)
+}
+
 func removeSocket(sockets []*mongoSocket, socket *mongoSocket) []*mongoSocket {
 	for i, s := range sockets {
 		if s == socket {
@@ -245,9 +484,54 @@ func (server *mongoServer) AbendSocket(socket *mongoSocket) {
 	}
 }
 
+// KillCursor kills the server cursor with the given id via socket, which
+// must be connected to server. Cursors closed concurrently by sockets
+// logged in with the same credentials are killed together: while one
+// killCursors operation is in flight, further ids are queued and sent in
+// a single operation once it's done, and the respective callers wait for
+// it to complete.
+func (server *mongoServer) KillCursor(socket *mongoSocket, cursorId int64) error {
+	key := socket.loginKey()
+	server.Lock()
+	if server.pendingKills == nil {
+		server.killing = make(map[string]bool)
+		server.pendingKills = make(map[string]*killBatch)
+	}
+	batch := server.pendingKills[key]
+	if batch == nil {
+		batch = &killBatch{done: make(chan struct{})}
+		server.pendingKills[key] = batch
+	}
+	batch.cursorIds = append(batch.cursorIds, cursorId)
+	if server.killing[key] {
+		server.Unlock()
+		<-batch.done
+		return batch.err
+	}
+	server.killing[key] = true
+	server.Unlock()
+
+	// Keep sending batches until no further ids were queued meanwhile.
+	own := batch
+	for {
+		server.Lock()
+		batch := server.pendingKills[key]
+		delete(server.pendingKills, key)
+		if batch == nil {
+			delete(server.killing, key)
+			server.Unlock()
+			return own.err
+		}
+		server.Unlock()
+		batch.err = socket.Query(&killCursorsOp{batch.cursorIds})
+		close(batch.done)
+	}
+}
+
 func (server *mongoServer) SetInfo(info *mongoServerInfo) {
 	server.Lock()
 	server.info = info
+	server.lastHeartbeat = time.Now()
 	server.Unlock()
 }
 
@@ -301,7 +585,7 @@ func (server *mongoServer) pinger(loop bool) {
 			time.Sleep(delay)
 		}
 		op := op
-		socket, _, err := server.AcquireSocket(0, delay)
+		socket, _, err := server.AcquireSocket(0, HighPriority, delay)
 		if err == nil {
 			start := time.Now()
 			_, _ = socket.SimpleQuery(&op)
@@ -322,6 +606,7 @@ func (server *mongoServer) pinger(loop bool) {
 				loop = false
 			}
 			server.pingValue = max
+			server.lastHeartbeat = time.Now()
 			server.Unlock()
 			logf("Ping for %s is %d ms", server.Addr, max/time.Millisecond)
 		} else if err == errServerClosed {
@@ -333,6 +618,115 @@ func (server *mongoServer) pinger(loop bool) {
 	}
 }
 
+var errIdlePingMissed = errors.New("idle socket missed too many pings")
+
+// idlePingState tracks a ping sent to an idle socket taken out of the pool.
+type idlePingState struct {
+	sync.Mutex
+	socket  *mongoSocket
+	done    bool
+	dropped bool
+	misses  int
+}
+
+// idlePinger periodically pings sockets that stayed unused in the pool
+// for at least the ping interval, and drops the ones that fail to reply
+// for ping.maxMisses intervals in a row. Sockets are taken out of the
+// pool while their ping is outstanding, so half-open connections are
+// never handed out.
+func (server *mongoServer) idlePinger(ping idlePing) {
+	maxMisses := ping.maxMisses
+	if maxMisses < 1 {
+		maxMisses = 1
+	}
+	var pending []*idlePingState
+	for {
+		time.Sleep(ping.interval)
+
+		var idle []*mongoSocket
+		server.Lock()
+		if server.closed {
+			server.Unlock()
+			return
+		}
+		cutoff := time.Now().Add(-ping.interval)
+		unused := server.unusedSockets[:0]
+		for _, socket := range server.unusedSockets {
+			if socket.idleSince.Before(cutoff) {
+				idle = append(idle, socket)
+			} else {
+				unused = append(unused, socket)
+			}
+		}
+		for i := len(unused); i < len(server.unusedSockets); i++ {
+			server.unusedSockets[i] = nil // Help GC.
+		}
+		server.unusedSockets = unused
+		server.Unlock()
+
+		outstanding := pending[:0]
+		for _, state := range pending {
+			state.Lock()
+			if !state.done {
+				state.misses++
+				state.dropped = state.misses >= maxMisses
+			}
+			done, dropped, misses := state.done, state.dropped, state.misses
+			state.Unlock()
+			if dropped {
+				logf("Socket %p to %s: missed %d idle pings", state.socket, server.Addr, misses)
+				server.dropSocket(state.socket, errIdlePingMissed)
+			} else if !done {
+				outstanding = append(outstanding, state)
+			}
+		}
+		pending = outstanding
+
+		for _, socket := range idle {
+			if state := server.pingIdleSocket(socket); state != nil {
+				pending = append(pending, state)
+			}
+		}
+	}
+}
+
+// pingIdleSocket sends a ping to a socket taken out of the pool, and
+// puts it back in the pool once the reply arrives. It returns nil if the
+// ping could not be sent, in which case the socket is dropped.
+func (server *mongoServer) pingIdleSocket(socket *mongoSocket) *idlePingState {
+	state := &idlePingState{socket: socket}
+	op := queryOp{
+		collection: "admin.$cmd",
+		query:      bson.D{{"ping", 1}},
+		flags:      flagSlaveOk,
+		limit:      -1,
+	}
+	op.replyFunc = func(err error, reply *replyOp, docNum int, docData []byte) {
+		state.Lock()
+		if state.done {
+			state.Unlock()
+			return
+		}
+		state.done = true
+		dropped := state.dropped
+		state.Unlock()
+		if err == nil && !dropped {
+			server.RecycleSocket(socket)
+		}
+	}
+	// Missed replies are accounted for by the pinger, so the socket
+	// must not time out and die on its own meanwhile.
+	socket.SetTimeout(0)
+	if err := socket.Query(&op); err != nil {
+		state.Lock()
+		state.done = true
+		state.Unlock()
+		server.dropSocket(socket, err)
+		return nil
+	}
+	return state
+}
+
 type mongoServerSlice []*mongoServer
 
 func (s mongoServerSlice) Len() int {
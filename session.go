@@ -27,6 +27,7 @@
 package mgo
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"errors"
@@ -85,12 +86,32 @@ type Session struct {
 	safeOp           *queryOp
 	syncTimeout      time.Duration
 	sockTimeout      time.Duration
+	writeTimeout     time.Duration
 	defaultdb        string
 	sourcedb         string
 	dialCred         *Credential
 	creds            []Credential
 	poolLimit        int
+	maxInFlight      int
 	bypassValidation bool
+	failNoPrimary    bool
+	readOnly         bool
+	dryRun           func(r DryRunReport)
+	noQuota          bool
+	priority         Priority
+	policy           Policy
+	hintPins         *HintPins
+	nsDefaults       *NamespaceDefaults
+	clusterTime      bson.Raw
+	operationTime    bson.MongoTimestamp
+	snapshot         bool
+	snapshotTime     bson.MongoTimestamp
+	retryPolicy      RetryPolicy
+	queryCache       QueryCache
+	ctx              context.Context
+	readConcernLevel string
+	comment          string
+	deadlineCushion  time.Duration
 }
 
 type Database struct {
@@ -111,9 +132,13 @@ type Query struct {
 }
 
 type query struct {
-	op       queryOp
-	prefetch float64
-	limit    int32
+	op           queryOp
+	prefetch     float64
+	limit        int32
+	memoryBudget int
+	autoBatch    int
+	cacheTTL     time.Duration
+	pin          bool
 }
 
 type getLastError struct {
@@ -138,12 +163,51 @@ type Iter struct {
 	docsBeforeMore int
 	timeout        time.Duration
 	timedout       bool
+	tailable       bool
+	noAwait        bool
 	findCmd        bool
+	batchSize      int32
+	memoryBudget   int
+	bufferedBytes  int
+	receivedBytes  int64
+	receivedDocs   int64
+	autoBatch      int
+	moreSent       time.Time
+	rtt            time.Duration
+	lastNext       time.Time
+	consumeTime    time.Duration
+	consumedDocs   int64
+	pinned         *mongoSocket
 }
 
 var (
 	ErrNotFound = errors.New("not found")
 	ErrCursor   = errors.New("invalid cursor")
+
+	// ErrUpdatePipeline is returned when an update is provided as an
+	// aggregation pipeline to a server older than MongoDB 4.2.
+	ErrUpdatePipeline = errors.New("update pipelines require MongoDB 4.2 or later")
+
+	// ErrArrayFilters is returned when an update with array filters is
+	// sent to a server older than MongoDB 3.6.
+	ErrArrayFilters = errors.New("array filters require MongoDB 3.6 or later")
+
+	// ErrReadConcern is returned when a read with a read concern is sent
+	// to a server older than MongoDB 3.2, which would silently ignore it.
+	ErrReadConcern = errors.New("read concerns require MongoDB 3.2 or later")
+
+	// ErrCollation is returned when an index with a collation is created
+	// on a server older than MongoDB 3.4.
+	ErrCollation = errors.New("collations require MongoDB 3.4 or later")
+
+	// ErrNoPrimary is returned by operations that require the primary
+	// server when no primary is known and the session was configured
+	// to fail fast in that case. See Session.SetFailFastNoPrimary.
+	ErrNoPrimary = errors.New("no primary server available")
+
+	// ErrReadOnly is returned by write operations attempted on a session
+	// that was made read-only. See Session.SetReadOnly.
+	ErrReadOnly = errors.New("write operation attempted on read-only session")
 )
 
 const (
@@ -203,6 +267,20 @@ const (
 //  	   Discover replica sets automatically. Default connection behavior.
 //
 //
+//     directConnection=<true|false>
+//
+//         When true, works like connect=direct and requires a single
+//         server to be provided. When false, discovers replica sets
+//         automatically, which is the default connection behavior.
+//
+//
+//     loadBalanced=false
+//
+//         Accepted for compatibility with other drivers. Connecting via a
+//         load balancer in load balanced mode (loadBalanced=true) is not
+//         supported, and rejected with an error.
+//
+//
 //     replicaSet=<setname>
 //
 //         If specified will prevent the obtained session from communicating
@@ -236,6 +314,25 @@ const (
 //        See Session.SetPoolLimit for details.
 //
 //
+//     compressors=<name>[,<name>,...]
+//
+//        Compress messages exchanged with MongoDB 3.4+ servers using the
+//        first of the given compressors that each server supports, such
+//        as zlib. See DialInfo.Compressors for details.
+//
+//
+//     proxyHost=<host>
+//     proxyPort=<port>
+//     proxyUsername=<username>
+//     proxyPassword=<password>
+//     proxyProtocol=<socks5|http>
+//
+//        Establish connections to servers through the given proxy, either
+//        a SOCKS5 proxy (the default, on port 1080 unless provided) or an
+//        HTTP proxy supporting the CONNECT method (on port 8080 unless
+//        provided). See DialInfo.ProxyHost for details.
+//
+//
 // Relevant documentation:
 //
 //     http://docs.mongodb.org/manual/reference/connection-string/
@@ -279,6 +376,12 @@ func ParseURL(url string) (*DialInfo, error) {
 	source := ""
 	setName := ""
 	poolLimit := 0
+	proxyHost := ""
+	proxyPort := 0
+	proxyUsername := ""
+	proxyPassword := ""
+	proxyProtocol := ""
+	var compressors []string
 	for k, v := range uinfo.options {
 		switch k {
 		case "authSource":
@@ -294,6 +397,44 @@ func ParseURL(url string) (*DialInfo, error) {
 			if err != nil {
 				return nil, errors.New("bad value for maxPoolSize: " + v)
 			}
+		case "proxyHost":
+			proxyHost = v
+		case "proxyPort":
+			proxyPort, err = strconv.Atoi(v)
+			if err != nil || proxyPort < 1 || proxyPort > 0xffff {
+				return nil, errors.New("bad value for proxyPort: " + v)
+			}
+		case "compressors":
+			compressors = strings.Split(v, ",")
+		case "proxyUsername":
+			proxyUsername = v
+		case "proxyPassword":
+			proxyPassword = v
+		case "proxyProtocol":
+			if v != "socks5" && v != "http" {
+				return nil, errors.New("bad value for proxyProtocol: " + v)
+			}
+			proxyProtocol = v
+		case "directConnection":
+			switch v {
+			case "true":
+				if len(uinfo.addrs) > 1 {
+					return nil, errors.New("directConnection=true requires a single server address")
+				}
+				direct = true
+			case "false":
+				direct = false
+			default:
+				return nil, errors.New("bad value for directConnection: " + v)
+			}
+		case "loadBalanced":
+			switch v {
+			case "true":
+				return nil, errors.New("loadBalanced=true is not supported: connecting via a load balancer requires load balanced mode, which this driver doesn't implement")
+			case "false":
+			default:
+				return nil, errors.New("bad value for loadBalanced: " + v)
+			}
 		case "connect":
 			if v == "direct" {
 				direct = true
@@ -318,6 +459,15 @@ func ParseURL(url string) (*DialInfo, error) {
 		Source:         source,
 		PoolLimit:      poolLimit,
 		ReplicaSetName: setName,
+		ProxyHost:      proxyHost,
+		ProxyPort:      proxyPort,
+		ProxyUsername:  proxyUsername,
+		ProxyPassword:  proxyPassword,
+		ProxyProtocol:  proxyProtocol,
+		Compressors:    compressors,
+	}
+	if proxyHost == "" && (proxyPort != 0 || proxyUsername != "" || proxyPassword != "" || proxyProtocol != "") {
+		return nil, errors.New("proxy options require proxyHost")
 	}
 	return &info, nil
 }
@@ -384,6 +534,88 @@ type DialInfo struct {
 	// See Session.SetPoolLimit for details.
 	PoolLimit int
 
+	// MaxInFlight defines how many operations may be waiting for replies
+	// on the socket reserved by a session before further operations are
+	// spread over other sockets. See Session.SetMaxInFlight for details.
+	MaxInFlight int
+
+	// MaxReplySize and MaxReplyDocumentSize bound the size of replies,
+	// and of individual documents in them, that are accepted from servers.
+	// The memory for replies is allocated based on sizes announced by the
+	// server, so these limits protect against misbehaving or compromised
+	// servers. Connections receiving larger replies are closed, and the
+	// pending operations fail with a *ReplyTooLargeError. They default to
+	// 48MB and 16MB plus 16KB of overhead, the limits used by MongoDB.
+	MaxReplySize         int
+	MaxReplyDocumentSize int
+
+	// MsgChecksums makes commands sent to MongoDB 3.6+ servers carry a
+	// CRC-32C checksum of their content, which servers verify, for end
+	// to end integrity over lossy or suspect network paths. Checksums
+	// in replies are always verified.
+	MsgChecksums bool
+
+	// Compressors lists the names of the algorithms that messages
+	// exchanged with MongoDB 3.4+ servers may be compressed with, in
+	// order of preference. Each connection uses the first one the server
+	// supports, if any. The "zlib" compressor is built in, and further
+	// ones may be provided via RegisterCompressor.
+	Compressors []string
+
+	// CompressionThreshold is the size in bytes up to which messages are
+	// sent uncompressed when a compressor is in use, as compressing small
+	// messages isn't worth the effort. Replies are compressed at the
+	// discretion of the server.
+	CompressionThreshold int
+
+	// ServerQuota, if set, limits the rate of operations and the number
+	// of operations in flight sent to each server, shedding operations
+	// over the limits. See Quota for details.
+	ServerQuota *Quota
+
+	// IdlePingInterval, if positive, enables pinging sockets that sat
+	// unused in the pool for that long, so that connections silently
+	// broken by middleboxes are dropped before being handed out. Sockets
+	// are out of the pool while their ping is outstanding.
+	IdlePingInterval time.Duration
+
+	// IdlePingMisses is the number of ping intervals a socket may go
+	// without replying to an idle ping before being dropped. Defaults to 1.
+	IdlePingMisses int
+
+	// DNSCacheTTL defines for how long the addresses a server host name
+	// resolves to are reused by the periodic topology synchronization,
+	// and when picking the addresses to connect to. The TTL of DNS
+	// records themselves isn't available to the driver, so it should be
+	// set to at most that. Zero disables caching.
+	DNSCacheTTL time.Duration
+
+	// ResolveInterval, if positive, makes the driver re-resolve the host
+	// names of all known servers at that interval. Servers whose names
+	// stopped resolving to the address they're connected to are replaced
+	// right away, instead of once connections to them start failing.
+	ResolveInterval time.Duration
+
+	// AddrChanged is optionally called when re-resolving the host name
+	// addr of a server finds it moved from one address to another.
+	AddrChanged func(addr string, from, to *net.TCPAddr)
+
+	// ProxyHost, if set, makes connections to servers go through the
+	// proxy at that host. Server host names are provided to the proxy
+	// as-is and are never resolved locally, so servers are identified
+	// by the address as given and ResolveInterval has no effect.
+	// ProxyProtocol selects between a SOCKS5 proxy, the default, and an
+	// HTTP proxy supporting CONNECT ("http"). ProxyPort defaults to 1080
+	// for SOCKS5 and to 8080 for HTTP. ProxyUsername and ProxyPassword
+	// optionally authenticate with the proxy. If DialServer is set, it
+	// must connect through the proxy itself via DialProxy, such as to
+	// establish TLS sessions over the proxied connections.
+	ProxyHost     string
+	ProxyPort     int
+	ProxyUsername string
+	ProxyPassword string
+	ProxyProtocol string
+
 	// DialServer optionally specifies the dial function for establishing
 	// connections with the MongoDB servers.
 	DialServer func(addr *ServerAddr) (net.Conn, error)
@@ -392,6 +624,31 @@ type DialInfo struct {
 	Dial func(addr net.Addr) (net.Conn, error)
 }
 
+// dialInfo has the fields of DialInfo without its methods, so that
+// it may be formatted without recursing into them.
+type dialInfo DialInfo
+
+func (info DialInfo) redacted() dialInfo {
+	if info.Password != "" {
+		info.Password = redactedValue
+	}
+	if info.ProxyPassword != "" {
+		info.ProxyPassword = redactedValue
+	}
+	return dialInfo(info)
+}
+
+// String returns a description of info with its passwords redacted, so
+// that dial details may be logged safely.
+func (info DialInfo) String() string {
+	return fmt.Sprintf("%+v", info.redacted())
+}
+
+// GoString works like String, for formatting info with %#v.
+func (info DialInfo) GoString() string {
+	return strings.Replace(fmt.Sprintf("%#v", info.redacted()), "mgo.dialInfo", "mgo.DialInfo", 1)
+}
+
 // mgo.v3: Drop DialInfo.Dial.
 
 // ServerAddr represents the address for establishing a connection to an
@@ -406,7 +663,8 @@ func (addr *ServerAddr) String() string {
 	return addr.str
 }
 
-// TCPAddr returns the resolved TCP address for the server.
+// TCPAddr returns the resolved TCP address for the server, or nil when
+// connecting through a proxy, which resolves the address itself.
 func (addr *ServerAddr) TCPAddr() *net.TCPAddr {
 	return addr.tcp
 }
@@ -422,7 +680,35 @@ func DialWithInfo(info *DialInfo) (*Session, error) {
 		}
 		addrs[i] = addr
 	}
-	cluster := newCluster(addrs, info.Direct, info.FailFast, dialer{info.Dial, info.DialServer}, info.ReplicaSetName)
+	dial := dialer{info.Dial, info.DialServer}
+	if info.ProxyHost != "" {
+		if info.Dial != nil {
+			return nil, errors.New("DialInfo.ProxyHost cannot be used along with DialInfo.Dial")
+		}
+		proxy, err := newProxyDialer(info)
+		if err != nil {
+			return nil, err
+		}
+		if info.DialServer == nil {
+			dial.new = proxy.dial
+		}
+	}
+	compression, err := newWireCompression(info.Compressors, info.CompressionThreshold)
+	if err != nil {
+		return nil, err
+	}
+	cluster := newCluster(addrs, clusterOptions{
+		direct:       info.Direct,
+		failFast:     info.FailFast,
+		setName:      info.ReplicaSetName,
+		dial:         dial,
+		ping:         idlePing{info.IdlePingInterval, info.IdlePingMisses},
+		dns:          dnsPolicy{info.DNSCacheTTL, info.ResolveInterval, info.AddrChanged, info.ProxyHost != ""},
+		limits:       replyLimits{info.MaxReplySize, info.MaxReplyDocumentSize},
+		msgChecksums: info.MsgChecksums,
+		compression:  compression,
+		quota:        info.ServerQuota,
+	})
 	session := newSession(Eventual, cluster, info.Timeout)
 	session.defaultdb = info.Database
 	if session.defaultdb == "" {
@@ -454,6 +740,9 @@ func DialWithInfo(info *DialInfo) (*Session, error) {
 	if info.PoolLimit > 0 {
 		session.poolLimit = info.PoolLimit
 	}
+	if info.MaxInFlight > 0 {
+		session.maxInFlight = info.MaxInFlight
+	}
 	cluster.Release()
 
 	// People get confused when we return a session that is not actually
@@ -521,6 +810,77 @@ func extractURL(s string) (*urlInfo, error) {
 	return info, nil
 }
 
+// String returns the URL details in info with the password redacted.
+func (info *urlInfo) String() string {
+	pass := ""
+	if info.pass != "" {
+		pass = redactedValue
+	}
+	options := make(map[string]string, len(info.options))
+	for k, v := range info.options {
+		if isSecretOption(k) {
+			v = redactedValue
+		}
+		options[k] = v
+	}
+	return fmt.Sprintf("{addrs: %v, user: %q, pass: %q, db: %q, options: %v}", info.addrs, info.user, pass, info.db, options)
+}
+
+// GoString works like String, for formatting info with %#v.
+func (info *urlInfo) GoString() string {
+	return info.String()
+}
+
+// isSecretOption returns whether the value of the named connection option
+// must be kept out of logs. Besides options with passwords, secrets and
+// tokens in their names, this includes the authentication mechanism
+// properties, which may carry cloud provider credentials.
+func isSecretOption(name string) bool {
+	name = strings.ToLower(name)
+	return name == "authmechanismproperties" ||
+		strings.Contains(name, "password") ||
+		strings.Contains(name, "secret") ||
+		strings.Contains(name, "token")
+}
+
+// SafeURI returns the MongoDB URL url, as accepted by Dial, with the
+// password and the values of options holding secrets replaced, so that
+// it may be logged safely. The rest of the URL is preserved as provided.
+func SafeURI(url string) string {
+	s := url
+	prefix := ""
+	if strings.HasPrefix(s, "mongodb://") {
+		prefix, s = s[:10], s[10:]
+	}
+	query := ""
+	if c := strings.Index(s, "?"); c != -1 {
+		s, query = s[:c], s[c:]
+	}
+	if c := strings.LastIndex(s, "@"); c != -1 {
+		if p := strings.Index(s[:c], ":"); p != -1 {
+			s = s[:p+1] + redactedValue + s[c:]
+		}
+	}
+	buf := []byte(prefix + s)
+	start := 0
+	for i := 0; i <= len(query); i++ {
+		if i < len(query) && query[i] != '&' && query[i] != ';' && (i > 0 || query[i] != '?') {
+			continue
+		}
+		if pair := query[start:i]; pair != "" {
+			if c := strings.Index(pair, "="); c != -1 && isSecretOption(pair[:c]) {
+				pair = pair[:c+1] + redactedValue
+			}
+			buf = append(buf, pair...)
+		}
+		if i < len(query) {
+			buf = append(buf, query[i])
+		}
+		start = i + 1
+	}
+	return string(buf)
+}
+
 func newSession(consistency Mode, cluster *mongoCluster, timeout time.Duration) (session *Session) {
 	cluster.Acquire()
 	session = &Session{
@@ -569,6 +929,60 @@ func (s *Session) LiveServers() (addrs []string) {
 	return addrs
 }
 
+// Topology identifies the kind of deployment a session is talking to.
+type Topology int
+
+const (
+	// TopologyUnknown is reported while no servers are known.
+	TopologyUnknown Topology = iota
+
+	// TopologySingle is a standalone server, or a single member of a
+	// replica set dialed with a direct connection.
+	TopologySingle
+
+	// TopologyReplicaSetWithPrimary is a replica set with a known primary.
+	TopologyReplicaSetWithPrimary
+
+	// TopologyReplicaSetNoPrimary is a replica set without a known primary,
+	// as happens during elections.
+	TopologyReplicaSetNoPrimary
+
+	// TopologySharded is a sharded cluster reached via mongos routers.
+	TopologySharded
+
+	// TopologyLoadBalanced is a deployment reached via a load balancer
+	// in front of mongos routers. Connecting in load balanced mode isn't
+	// supported yet, and the loadBalanced=true URL option is rejected,
+	// so this is not reported for now.
+	TopologyLoadBalanced
+)
+
+var topologyNames = []string{
+	TopologyUnknown:               "Unknown",
+	TopologySingle:                "Single",
+	TopologyReplicaSetWithPrimary: "ReplicaSetWithPrimary",
+	TopologyReplicaSetNoPrimary:   "ReplicaSetNoPrimary",
+	TopologySharded:               "Sharded",
+	TopologyLoadBalanced:          "LoadBalanced",
+}
+
+func (t Topology) String() string {
+	if t >= 0 && int(t) < len(topologyNames) {
+		return topologyNames[t]
+	}
+	return "Topology(" + strconv.Itoa(int(t)) + ")"
+}
+
+// Topology returns the kind of deployment the session is talking to,
+// as detected from the servers currently known to the session's cluster.
+// Sessions dialed with a direct connection always report TopologySingle.
+func (s *Session) Topology() Topology {
+	s.m.RLock()
+	topology := s.cluster().Topology()
+	s.m.RUnlock()
+	return topology
+}
+
 // DB returns a value representing the named database. If name
 // is empty, the database name provided in the dialed URL is
 // used instead. If that is also empty, "test" is used as a
@@ -682,6 +1096,27 @@ type Credential struct {
 	Mechanism string
 }
 
+// credential has the fields of Credential without its methods, so
+// that it may be formatted without recursing into them.
+type credential Credential
+
+func (cred Credential) redacted() credential {
+	if cred.Password != "" {
+		cred.Password = redactedValue
+	}
+	return credential(cred)
+}
+
+// String returns a description of cred with its password redacted.
+func (cred Credential) String() string {
+	return fmt.Sprintf("%+v", cred.redacted())
+}
+
+// GoString works like String, for formatting cred with %#v.
+func (cred Credential) GoString() string {
+	return strings.Replace(fmt.Sprintf("%#v", cred.redacted()), "mgo.credential", "mgo.Credential", 1)
+}
+
 // Login authenticates with MongoDB using the provided credential.  The
 // authentication is valid for the whole session and will stay valid until
 // Logout is explicitly called for the same database, or the session is
@@ -695,7 +1130,7 @@ func (db *Database) Login(user, pass string) error {
 // Logout is explicitly called for the same database, or the session is
 // closed.
 func (s *Session) Login(cred *Credential) error {
-	socket, err := s.acquireSocket(true)
+	socket, err := s.acquireReservedSocket(true)
 	if err != nil {
 		return err
 	}
@@ -1276,6 +1711,45 @@ func (c *Collection) EnsureIndex(index Index) error {
 		return nil
 	}
 
+	spec := c.makeIndexSpec(index, keyInfo)
+
+	cloned := session.Clone()
+	defer cloned.Close()
+	cloned.SetMode(Strong, false)
+	cloned.EnsureSafe(&Safe{})
+
+	err = c.createIndex(cloned, spec)
+	if err == nil {
+		session.cluster().CacheIndex(cacheKey, true)
+	}
+	return err
+}
+
+// createIndex creates the index described by spec through session.
+func (c *Collection) createIndex(session *Session, spec indexSpec) error {
+	if spec.Collation != nil {
+		wireVersion, err := session.MaxWireVersion()
+		if err != nil {
+			return err
+		}
+		if wireVersion < 5 {
+			return ErrCollation
+		}
+	}
+
+	// Try with a command first.
+	db := c.Database.With(session)
+	err := db.Run(bson.D{{"createIndexes", c.Name}, {"indexes", []indexSpec{spec}}}, nil)
+	if isNoCmd(err) {
+		// Command not yet supported. Insert into the indexes collection instead.
+		err = db.C("system.indexes").Insert(&spec)
+	}
+	return err
+}
+
+// makeIndexSpec returns the specification for creating index in the
+// collection, with keyInfo as parsed from the index key.
+func (c *Collection) makeIndexSpec(index Index, keyInfo *indexKeyInfo) indexSpec {
 	spec := indexSpec{
 		Name:             keyInfo.name,
 		NS:               c.FullName,
@@ -1314,23 +1788,7 @@ NextField:
 		}
 		panic("weight provided for field that is not part of index key: " + name)
 	}
-
-	cloned := session.Clone()
-	defer cloned.Close()
-	cloned.SetMode(Strong, false)
-	cloned.EnsureSafe(&Safe{})
-	db := c.Database.With(cloned)
-
-	// Try with a command first.
-	err = db.Run(bson.D{{"createIndexes", c.Name}, {"indexes", []indexSpec{spec}}}, nil)
-	if isNoCmd(err) {
-		// Command not yet supported. Insert into the indexes collection instead.
-		err = db.C("system.indexes").Insert(&spec)
-	}
-	if err == nil {
-		session.cluster().CacheIndex(cacheKey, true)
-	}
-	return err
+	return spec
 }
 
 // DropIndex drops the index with the provided key from the c collection.
@@ -1347,6 +1805,9 @@ func (c *Collection) DropIndex(key ...string) error {
 	if err != nil {
 		return err
 	}
+	if c.dryRunDropIndex(keyInfo.name) {
+		return nil
+	}
 
 	session := c.Database.Session
 	cacheKey := c.FullName + "\x00" + keyInfo.name
@@ -1378,6 +1839,9 @@ func (c *Collection) DropIndex(key ...string) error {
 //     err := collection.DropIndex("customIndexName")
 //
 func (c *Collection) DropIndexName(name string) error {
+	if c.dryRunDropIndex(name) {
+		return nil
+	}
 	session := c.Database.Session
 
 	session = session.Clone()
@@ -1726,6 +2190,26 @@ func (s *Session) SetSocketTimeout(d time.Duration) {
 	s.m.Unlock()
 }
 
+// SetWriteTimeout sets the amount of time to wait for a non-responding
+// socket to accept requests sent to the database before it is forcefully
+// closed, separately from the socket timeout that then applies to waiting
+// for replies. This allows failing fast on a server that hung without
+// limiting how long the server may take to run slow operations.
+//
+// The default value of zero uses the socket timeout for writes as well.
+// See SetSocketTimeout.
+func (s *Session) SetWriteTimeout(d time.Duration) {
+	s.m.Lock()
+	s.writeTimeout = d
+	if s.masterSocket != nil {
+		s.masterSocket.SetWriteTimeout(d)
+	}
+	if s.slaveSocket != nil {
+		s.slaveSocket.SetWriteTimeout(d)
+	}
+	s.m.Unlock()
+}
+
 // SetCursorTimeout changes the standard timeout period that the server
 // enforces on created cursors. The only supported value right now is
 // 0, which disables the timeout. The standard server timeout is 10 minutes.
@@ -1754,6 +2238,91 @@ func (s *Session) SetPoolLimit(limit int) {
 	s.m.Unlock()
 }
 
+// Priority is the scheduling lane of the operations performed by a session.
+// See Session.SetPriority.
+type Priority int
+
+const (
+	// HighPriority is the default lane, meant for interactive work.
+	HighPriority Priority = iota
+
+	// LowPriority is meant for background work, such as migrations and
+	// exports, which must not delay interactive work in the same process.
+	LowPriority
+)
+
+// SetPriority sets the scheduling lane of operations performed by the
+// session and its copies. When the pool limit of a server is reached (see
+// SetPoolLimit), sessions with LowPriority don't take a socket to it while
+// sessions with HighPriority are waiting for one. Likewise, they don't get
+// room within a server quota while operations with HighPriority are waiting
+// for it (see DialInfo.ServerQuota).
+//
+// Both lanes share the same sockets and servers otherwise, so a session with
+// LowPriority still progresses whenever there's spare capacity.
+func (s *Session) SetPriority(priority Priority) {
+	s.m.Lock()
+	s.priority = priority
+	s.m.Unlock()
+}
+
+// Priority returns the scheduling lane of operations performed by the
+// session. See SetPriority.
+func (s *Session) Priority() Priority {
+	s.m.RLock()
+	priority := s.priority
+	s.m.RUnlock()
+	return priority
+}
+
+// SetMaxInFlight sets the maximum number of operations that may be waiting
+// for replies on the socket reserved by the session before further
+// operations are performed on other sockets to the same server. Sessions
+// in Strong and Monotonic modes otherwise send all operations through
+// their reserved socket, so goroutines sharing a session queue up behind
+// any slow operation already on it.
+//
+// Operations moved to other sockets are still sent to the same server,
+// and the reserved socket is used anyway if no other socket is available
+// within the pool limit. Zero, the default, disables the limit.
+func (s *Session) SetMaxInFlight(limit int) {
+	s.m.Lock()
+	s.maxInFlight = limit
+	s.m.Unlock()
+}
+
+// SetFailFastNoPrimary sets whether operations that require the primary
+// server, such as writes and reads in Strong mode, should fail right away
+// with ErrNoPrimary when no primary is known, as happens during an
+// election, rather than blocking until a new primary is elected or the
+// sync timeout is reached (see SetSyncTimeout).
+//
+// This is useful for latency-critical services that prefer shedding load
+// to queueing it while the cluster has no primary. The cluster is
+// resynchronized in the background when ErrNoPrimary is returned, so
+// later operations succeed once a new primary is found.
+func (s *Session) SetFailFastNoPrimary(failFast bool) {
+	s.m.Lock()
+	s.failNoPrimary = failFast
+	s.m.Unlock()
+}
+
+// SetReadOnly sets whether the session rejects operations that might
+// modify the database with ErrReadOnly before sending them to the server.
+// This covers inserts, updates, and removals, as well as commands that
+// modify data, indexes, collections, users, or roles, such as those run
+// by DropCollection, EnsureIndex, Query.Apply, map/reduce jobs with an
+// output collection, and pipelines with a $out or $merge stage.
+//
+// This is a safety rail for services that must never mutate the data
+// they read, such as analytics jobs running against production clusters.
+// It's not a replacement for proper access control on the server side.
+func (s *Session) SetReadOnly(readOnly bool) {
+	s.m.Lock()
+	s.readOnly = readOnly
+	s.m.Unlock()
+}
+
 // SetBypassValidation sets whether the server should bypass the registered
 // validation expressions executed when documents are inserted or modified,
 // in the interest of preserving invariants in the collection being modified.
@@ -1961,7 +2530,7 @@ func (s *Session) ensureSafe(safe *Safe) {
 
 	var cmd getLastError
 	if s.safeOp == nil {
-		cmd = getLastError{1, w, safe.WTimeout, safe.FSync, safe.J}
+		cmd = newGetLastError(safe)
 	} else {
 		// Copy.  We don't want to mutate the existing query.
 		cmd = *(s.safeOp.query.(*getLastError))
@@ -1982,7 +2551,23 @@ func (s *Session) ensureSafe(safe *Safe) {
 			cmd.J = true
 		}
 	}
-	s.safeOp = &queryOp{
+	s.safeOp = newSafeOp(cmd)
+}
+
+// newGetLastError returns the getLastError command enforcing safe.
+func newGetLastError(safe *Safe) getLastError {
+	var w interface{}
+	if safe.WMode != "" {
+		w = safe.WMode
+	} else if safe.W > 0 {
+		w = safe.W
+	}
+	return getLastError{1, w, safe.WTimeout, safe.FSync, safe.J}
+}
+
+// newSafeOp returns the operation used to check writes with cmd.
+func newSafeOp(cmd getLastError) *queryOp {
+	return &queryOp{
 		query:      &cmd,
 		collection: "admin.$cmd",
 		limit:      -1,
@@ -2100,10 +2685,9 @@ func (s *Session) FsyncUnlock() error {
 //
 // In case the resulting document includes a field named $err or errmsg, which
 // are standard ways for MongoDB to return query errors, the returned err will
-// be set to a *QueryError value including the Err message and the Code.  In
-// those cases, the result argument is still unmarshalled into with the
-// received document so that any other custom values may be obtained if
-// desired.
+// be set to a *QueryError value including the Err message and the Code, and
+// the result argument is left untouched so that the error document is never
+// mistaken for data.
 //
 // Relevant documentation:
 //
@@ -2175,11 +2759,12 @@ type Pipe struct {
 }
 
 type pipeCmd struct {
-	Aggregate string
-	Pipeline  interface{}
-	Cursor    *pipeCmdCursor ",omitempty"
-	Explain   bool           ",omitempty"
-	AllowDisk bool           "allowDiskUse,omitempty"
+	Aggregate   string
+	Pipeline    interface{}
+	Cursor      *pipeCmdCursor ",omitempty"
+	Explain     bool           ",omitempty"
+	AllowDisk   bool           "allowDiskUse,omitempty"
+	ReadConcern interface{}    "readConcern,omitempty"
 }
 
 type pipeCmdCursor struct {
@@ -2229,10 +2814,11 @@ func (p *Pipe) Iter() *Iter {
 	}
 
 	cmd := pipeCmd{
-		Aggregate: c.Name,
-		Pipeline:  p.pipeline,
-		AllowDisk: p.allowDisk,
-		Cursor:    &pipeCmdCursor{p.batchSize},
+		Aggregate:   c.Name,
+		Pipeline:    p.pipeline,
+		AllowDisk:   p.allowDisk,
+		Cursor:      &pipeCmdCursor{p.batchSize},
+		ReadConcern: p.session.readConcern(0),
 	}
 	err := c.Database.Run(cmd, &result)
 	if e, ok := err.(*QueryError); ok && e.Message == `unrecognized field "cursor` {
@@ -2301,7 +2887,7 @@ func (c *Collection) NewIter(session *Session, firstBatch []bson.Raw, cursorId i
 	}
 	iter.gotReply.L = &iter.m
 	for _, doc := range firstBatch {
-		iter.docData.Push(doc.Data)
+		iter.pushDoc(doc.Data)
 	}
 	if cursorId != 0 {
 		iter.op.cursorId = cursorId
@@ -2444,10 +3030,18 @@ func (c *Collection) Insert(docs ...interface{}) error {
 // returned if a document isn't found, or a value of type *LastError
 // when some other error is detected.
 //
+// The update may also be an aggregation pipeline, provided as a slice
+// of stages such as []bson.M{{"$set": bson.M{"total": bson.M{"$add":
+// []string{"$a", "$b"}}}}}, which allows computing fields from other
+// fields in the document. Update pipelines depend on MongoDB 4.2+, and
+// ErrUpdatePipeline is returned with earlier servers. The same holds
+// for the other update methods, for Bulk, and for Query.Apply.
+//
 // Relevant documentation:
 //
 //     http://www.mongodb.org/display/DOCS/Updating
 //     http://www.mongodb.org/display/DOCS/Atomic+Operations
+//     https://docs.mongodb.com/manual/tutorial/update-documents-with-aggregation-pipeline/
 //
 func (c *Collection) Update(selector interface{}, update interface{}) error {
 	if selector == nil {
@@ -2498,23 +3092,139 @@ type ChangeInfo struct {
 //     http://www.mongodb.org/display/DOCS/Atomic+Operations
 //
 func (c *Collection) UpdateAll(selector interface{}, update interface{}) (info *ChangeInfo, err error) {
+	return c.UpdateWithArrayFilters(selector, update, nil, true)
+}
+
+// UpdateWithArrayFilters finds documents matching the provided selector
+// document and modifies them according to the update document, using
+// arrayFilters to select which array elements are modified by the
+// filtered positional operator $[<identifier>] in update. If multi is
+// false only the first matching document is updated.
+//
+// This example increments the score of all grades of at least 85 in
+// the document with id 1:
+//
+//     update := bson.M{"$inc": bson.M{mgo.PositionalFiltered("grades", "g") + ".score": 1}}
+//     filters := []interface{}{bson.M{"g.grade": bson.M{"$gte": 85}}}
+//     info, err := coll.UpdateWithArrayFilters(bson.M{"_id": 1}, update, filters, false)
+//
+// If the session is in safe mode (see SetSafe) details of the executed
+// operation are returned in info or an error of type *LastError when
+// some problem is detected. Unlike Update, it is not an error for the
+// update to not be applied on any documents.
+//
+// Array filters depend on MongoDB 3.6+, and ErrArrayFilters is returned
+// with earlier servers.
+//
+// Relevant documentation:
+//
+//     https://docs.mongodb.com/manual/reference/operator/update/positional-filtered/
+//
+func (c *Collection) UpdateWithArrayFilters(selector, update interface{}, arrayFilters []interface{}, multi bool) (info *ChangeInfo, err error) {
+	if selector == nil {
+		selector = bson.D{}
+	}
+	op := updateOp{
+		Collection:   c.FullName,
+		Selector:     selector,
+		Update:       update,
+		ArrayFilters: arrayFilters,
+	}
+	if multi {
+		op.Flags = 2
+		op.Multi = true
+	}
+	lerr, err := c.writeOp(&op, true)
+	if err == nil && lerr != nil {
+		info = &ChangeInfo{Updated: lerr.modified, Matched: lerr.N}
+	}
+	return info, err
+}
+
+// ReplaceOne finds a single document matching the provided selector
+// document and replaces it entirely with replacement, preserving its
+// _id. If upsert is true and no document matches the selector, the
+// replacement is inserted instead.
+//
+// Unlike Update, ReplaceOne fails if the replacement holds top-level
+// keys starting with "$", so that an update document is never applied
+// as a replacement by mistake, and ReplaceOne is not an error for the
+// replacement to not be applied because the selector doesn't match.
+//
+// If the session is in safe mode (see SetSafe) details of the executed
+// operation are returned in info or an error of type *LastError when
+// some problem is detected.
+func (c *Collection) ReplaceOne(selector, replacement interface{}, upsert bool) (info *ChangeInfo, err error) {
+	if err := checkReplacement(replacement); err != nil {
+		return nil, err
+	}
 	if selector == nil {
 		selector = bson.D{}
 	}
 	op := updateOp{
 		Collection: c.FullName,
 		Selector:   selector,
-		Update:     update,
-		Flags:      2,
-		Multi:      true,
+		Update:     replacement,
+	}
+	if upsert {
+		op.Flags = 1
+		op.Upsert = true
 	}
 	lerr, err := c.writeOp(&op, true)
 	if err == nil && lerr != nil {
-		info = &ChangeInfo{Updated: lerr.modified, Matched: lerr.N}
+		info = &ChangeInfo{}
+		if lerr.UpdatedExisting {
+			info.Matched = lerr.N
+			info.Updated = lerr.modified
+		} else if upsert {
+			info.UpsertedId = lerr.UpsertedId
+		}
 	}
 	return info, err
 }
 
+// checkReplacement returns an error if replacement is not a document
+// suitable for replacing another one, as when it holds update operators
+// or is an update pipeline.
+func checkReplacement(replacement interface{}) error {
+	if isUpdatePipeline(replacement) {
+		return errors.New("replacement must be a document, not a pipeline")
+	}
+	data, err := bson.Marshal(replacement)
+	if err != nil {
+		return err
+	}
+	var doc bson.RawD
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	for _, elem := range doc {
+		if strings.HasPrefix(elem.Name, "$") {
+			return fmt.Errorf("replacement document contains update operator %q", elem.Name)
+		}
+	}
+	return nil
+}
+
+// PositionalFirst returns the path for updating the first element of
+// the named array field that matches the query, as in "field.$".
+func PositionalFirst(field string) string {
+	return field + ".$"
+}
+
+// PositionalAll returns the path for updating all elements of the
+// named array field, as in "field.$[]".
+func PositionalAll(field string) string {
+	return field + ".$[]"
+}
+
+// PositionalFiltered returns the path for updating the elements of the
+// named array field that match the array filter for identifier, as in
+// "field.$[identifier]". See UpdateWithArrayFilters.
+func PositionalFiltered(field, identifier string) string {
+	return field + ".$[" + identifier + "]"
+}
+
 // Upsert finds a single document matching the provided selector document
 // and modifies it according to the update document.  If no document matching
 // the selector is found, the update document is applied to the selector
@@ -2621,12 +3331,19 @@ func (c *Collection) RemoveAll(selector interface{}) (info *ChangeInfo, err erro
 
 // DropDatabase removes the entire database including all of its collections.
 func (db *Database) DropDatabase() error {
+	if ok, err := db.dryRunDrop(""); ok {
+		return err
+	}
 	return db.Run(bson.D{{"dropDatabase", 1}}, nil)
 }
 
 // DropCollection removes the entire collection including all of its documents.
 func (c *Collection) DropCollection() error {
-	return c.Database.Run(bson.D{{"drop", c.Name}}, nil)
+	if ok, err := c.Database.dryRunDrop(c.Name); ok {
+		return err
+	}
+	defer c.Database.Session.invalidateCache(c.FullName)
+	return c.Database.Run(bson.D{{"drop", c.Name}}, nil)
 }
 
 // The CollectionInfo type holds metadata about a collection.
@@ -2758,6 +3475,82 @@ func (q *Query) Prefetch(p float64) *Query {
 	return q
 }
 
+// MemoryBudget sets the approximate amount of memory, in bytes, that an
+// iterator obtained from the query may use for holding documents received
+// from the server but not yet consumed via Next. Once the average size of
+// documents received is known, the size of following batches is reduced
+// as necessary for the buffered documents to fit within the budget, which
+// prevents queries that unexpectedly return very large documents from
+// exhausting memory, in particular when prefetching.
+//
+// At least two documents are always requested per batch, so the budget
+// may be exceeded when documents are larger than half of it. The size of
+// the first batch is not affected, as document sizes aren't known at that
+// point; use Batch to constrain it as well.
+//
+// By default there is no memory budget.
+func (q *Query) MemoryBudget(n int) *Query {
+	q.m.Lock()
+	q.memoryBudget = n
+	q.m.Unlock()
+	return q
+}
+
+// AutoBatch makes iterators obtained from the query pick the size of each
+// batch requested after the first one from the average size of documents
+// received so far and the rate at which they are consumed via Next, rather
+// than using the fixed size set via Batch.
+//
+// Batches are sized for the documents buffered by the iterator plus those
+// requested to stay within window bytes, and otherwise to hold just enough
+// documents for the consumer to keep busy while the next batch is on its
+// way from the server, given the Prefetch setting. Slow consumers thus get
+// small batches and hold little memory, while fast ones get batches as
+// large as the window allows and wait as little as possible for them.
+//
+// At least two documents are always requested per batch. The size of the
+// first batch is set via Batch as usual. When combined with MemoryBudget,
+// the smaller of the two batch sizes is used.
+//
+// By default auto batching is disabled.
+func (q *Query) AutoBatch(window int) *Query {
+	q.m.Lock()
+	q.autoBatch = window
+	q.m.Unlock()
+	return q
+}
+
+// Pin makes iterators obtained from the query send all follow up requests
+// for the cursor, including the final killCursors, through the very socket
+// that ran the query, rather than through any socket to the same server.
+// The socket is held by the iterator until the cursor is exhausted or the
+// iterator is closed, so iterators of pinned queries must always be closed.
+// If the pinned socket breaks, further requests go through other sockets
+// to the server holding the cursor as usual.
+func (q *Query) Pin() *Query {
+	q.m.Lock()
+	q.pin = true
+	q.m.Unlock()
+	return q
+}
+
+// AfterWrite makes the query wait until the server it runs against has
+// caught up with the point in time identified by token, as obtained via
+// Session.WriteToken, before reading. This allows observing a write made
+// by a different session or process, even when reading from a secondary.
+//
+// The cluster time in token is also provided to the query's session, so
+// that servers will accept waiting for it. A zero token has no effect.
+//
+// Requires MongoDB 3.6+ running as a replica set or sharded cluster.
+func (q *Query) AfterWrite(token WriteToken) *Query {
+	q.session.AdvanceClusterTime(token.ClusterTime)
+	q.m.Lock()
+	q.op.afterClusterTime = token.OperationTime
+	q.m.Unlock()
+	return q
+}
+
 // Skip skips over the n initial documents from the query results.  Note that
 // this only makes sense with capped collections where documents are naturally
 // ordered by insertion time, or with sorted results.
@@ -3033,10 +3826,10 @@ func (q *Query) LogReplay() *Query {
 
 func checkQueryError(fullname string, d []byte) error {
 	l := len(d)
-	if l < 16 {
+	if l < 5 {
 		return nil
 	}
-	if d[5] == '$' && d[6] == 'e' && d[7] == 'r' && d[8] == 'r' && d[9] == '\x00' && d[4] == '\x02' {
+	if l >= 16 && d[5] == '$' && d[6] == 'e' && d[7] == 'r' && d[8] == 'r' && d[9] == '\x00' && d[4] == '\x02' {
 		goto Error
 	}
 	if len(fullname) < 5 || fullname[len(fullname)-5:] != ".$cmd" {
@@ -3047,7 +3840,7 @@ func checkQueryError(fullname string, d []byte) error {
 			goto Error
 		}
 	}
-	return nil
+	return checkCommandOk(d)
 
 Error:
 	result := &queryError{}
@@ -3064,6 +3857,38 @@ Error:
 	return &QueryError{Code: result.Code, Message: result.ErrMsg}
 }
 
+// checkCommandOk returns a *QueryError if the command reply d reports a
+// failure with ok: 0 alone, without an errmsg field explaining it.
+func checkCommandOk(d []byte) error {
+	var reply struct {
+		Ok       interface{} "ok"
+		Code     int
+		CodeName string "codeName"
+	}
+	if bson.Unmarshal(d, &reply) != nil {
+		return nil
+	}
+	var failed bool
+	switch ok := reply.Ok.(type) {
+	case bool:
+		failed = !ok
+	case float64:
+		failed = ok == 0
+	case int:
+		failed = ok == 0
+	case int64:
+		failed = ok == 0
+	}
+	if !failed {
+		return nil
+	}
+	msg := reply.CodeName
+	if msg == "" {
+		msg = "command failed"
+	}
+	return &QueryError{Code: reply.Code, Message: msg}
+}
+
 // One executes the query and unmarshals the first obtained document into the
 // result argument.  The result must be a struct or map value capable of being
 // unmarshalled into by gobson.  This function blocks until either a result
@@ -3073,12 +3898,33 @@ Error:
 //
 // In case the resulting document includes a field named $err or errmsg, which
 // are standard ways for MongoDB to return query errors, the returned err will
-// be set to a *QueryError value including the Err message and the Code.  In
-// those cases, the result argument is still unmarshalled into with the
-// received document so that any other custom values may be obtained if
-// desired.
+// be set to a *QueryError value including the Err message and the Code, and
+// the result argument is left untouched so that the error document is never
+// mistaken for data.
 //
 func (q *Query) One(result interface{}) (err error) {
+	q.m.Lock()
+	session := q.session
+	q.m.Unlock()
+	cached, err := q.cachedQuery(true, result, func(docs *[]bson.Raw) error {
+		var doc bson.Raw
+		err := session.retry(func() (bool, error) {
+			return true, q.one(&doc)
+		})
+		if err == nil {
+			*docs = append(*docs, doc)
+		}
+		return err
+	})
+	if cached {
+		return err
+	}
+	return session.retry(func() (bool, error) {
+		return true, q.one(result)
+	})
+}
+
+func (q *Query) one(result interface{}) (err error) {
 	q.m.Lock()
 	session := q.session
 	op := q.op // Copy.
@@ -3092,10 +3938,22 @@ func (q *Query) One(result interface{}) (err error) {
 
 	op.limit = -1
 
-	session.prepareQuery(&op)
+	if err := session.prepareQuery(&op); err != nil {
+		return err
+	}
+
+	if err := checkReadConcern(op.readConcern, socket.ServerInfo().MaxWireVersion); err != nil {
+		return err
+	}
 
 	expectFindReply := prepareFindOp(socket, &op, 1)
 
+	leave, err := session.enterQuota(socket)
+	if err != nil {
+		return err
+	}
+	defer leave()
+
 	data, err := socket.SimpleQuery(&op)
 	if err != nil {
 		return err
@@ -3105,15 +3963,20 @@ func (q *Query) One(result interface{}) (err error) {
 	}
 	if expectFindReply {
 		var findReply struct {
-			Ok     bool
-			Code   int
-			Errmsg string
-			Cursor cursorData
+			Ok          bool
+			Code        int
+			Errmsg      string
+			Cursor      cursorData
+			causalReply `bson:",inline"`
 		}
 		err = bson.Unmarshal(data, &findReply)
 		if err != nil {
 			return err
 		}
+		if findReply.AtClusterTime == 0 {
+			findReply.AtClusterTime = findReply.Cursor.AtClusterTime
+		}
+		session.observeReply(&findReply.causalReply)
 		if !findReply.Ok && findReply.Errmsg != "" {
 			return &QueryError{Code: findReply.Code, Message: findReply.Errmsg}
 		}
@@ -3121,17 +3984,19 @@ func (q *Query) One(result interface{}) (err error) {
 			return ErrNotFound
 		}
 		data = findReply.Cursor.FirstBatch[0].Data
+	} else if err := checkQueryError(op.collection, data); err != nil {
+		return err
 	}
 	if result != nil {
 		err = bson.Unmarshal(data, result)
 		if err == nil {
-			debugf("Query %p document unmarshaled: %#v", q, result)
+			debugf("Query %p document unmarshaled: %#v", q, logDoc(result))
 		} else {
 			debugf("Query %p document unmarshaling failed: %#v", q, err)
 			return err
 		}
 	}
-	return checkQueryError(op.collection, data)
+	return nil
 }
 
 // prepareFindOp translates op from being an old-style wire protocol query into
@@ -3161,6 +4026,10 @@ func prepareFindOp(socket *mongoSocket, op *queryOp, limit int32) bool {
 		Comment:     op.options.Comment,
 		Snapshot:    op.options.Snapshot,
 		OplogReplay: op.flags&flagLogReplay != 0,
+		ReadConcern: op.readConcern,
+	}
+	if op.clusterTime.Kind != 0 && socket.ServerInfo().MaxWireVersion >= 6 {
+		find.ClusterTime = op.clusterTime
 	}
 	if op.limit < 0 {
 		find.BatchSize = -op.limit
@@ -3186,10 +4055,11 @@ func prepareFindOp(socket *mongoSocket, op *queryOp, limit int32) bool {
 }
 
 type cursorData struct {
-	FirstBatch []bson.Raw "firstBatch"
-	NextBatch  []bson.Raw "nextBatch"
-	NS         string
-	Id         int64
+	FirstBatch    []bson.Raw "firstBatch"
+	NextBatch     []bson.Raw "nextBatch"
+	NS            string
+	Id            int64
+	AtClusterTime bson.MongoTimestamp "atClusterTime"
 }
 
 // findCmd holds the command used for performing queries on MongoDB 3.2+.
@@ -3222,6 +4092,7 @@ type findCmd struct {
 	OplogReplay         bool        `bson:"oplogReplay,omitempty"`
 	NoCursorTimeout     bool        `bson:"noCursorTimeout,omitempty"`
 	AllowPartialResults bool        `bson:"allowPartialResults,omitempty"`
+	ClusterTime         interface{} `bson:"$clusterTime,omitempty"`
 }
 
 // getMoreCmd holds the command used for requesting more query results on MongoDB 3.2+.
@@ -3250,14 +4121,26 @@ func (db *Database) run(socket *mongoSocket, cmd, result interface{}) (err error
 	session := db.Session
 	session.m.RLock()
 	op := session.queryConfig.op // Copy.
+	readOnly := session.readOnly
 	session.m.RUnlock()
-	op.query = cmd
+	if readOnly && isWriteCommand(cmd) {
+		return ErrReadOnly
+	}
+	op.query = session.gossipClusterTime(socket, cmd)
 	op.collection = db.Name + ".$cmd"
 
 	// Query.One:
-	session.prepareQuery(&op)
+	if err := session.prepareQuery(&op); err != nil {
+		return err
+	}
 	op.limit = -1
 
+	leave, err := session.enterQuota(socket)
+	if err != nil {
+		return err
+	}
+	defer leave()
+
 	data, err := socket.SimpleQuery(&op)
 	if err != nil {
 		return err
@@ -3265,19 +4148,131 @@ func (db *Database) run(socket *mongoSocket, cmd, result interface{}) (err error
 	if data == nil {
 		return ErrNotFound
 	}
+	if socket.ServerInfo().MaxWireVersion >= 6 {
+		var reply struct {
+			causalReply `bson:",inline"`
+			Cursor      struct {
+				AtClusterTime bson.MongoTimestamp "atClusterTime"
+			}
+		}
+		if bson.Unmarshal(data, &reply) == nil {
+			if reply.AtClusterTime == 0 {
+				reply.AtClusterTime = reply.Cursor.AtClusterTime
+			}
+			session.observeReply(&reply.causalReply)
+		}
+	}
+	if err := checkQueryError(op.collection, data); err != nil {
+		return err
+	}
 	if result != nil {
 		err = bson.Unmarshal(data, result)
 		if err != nil {
-			debugf("Run command unmarshaling: %#v, error: %#v", op, err)
+			debugf("Run command unmarshaling: %#v, error: %#v", logDoc(op), err)
 			return err
 		}
 		if globalDebug && globalLogger != nil {
 			var res bson.M
 			bson.Unmarshal(data, &res)
-			debugf("Run command unmarshaled: %#v, result: %#v", op, res)
+			debugf("Run command unmarshaled: %#v, result: %#v", logDoc(op), logDoc(res))
 		}
 	}
-	return checkQueryError(op.collection, data)
+	return nil
+}
+
+// writeCommands holds the lowercased names of commands that may modify
+// data, indexes, collections, users, or roles.
+var writeCommands = map[string]bool{
+	"insert":                   true,
+	"update":                   true,
+	"delete":                   true,
+	"findandmodify":            true,
+	"create":                   true,
+	"createindexes":            true,
+	"drop":                     true,
+	"dropdatabase":             true,
+	"dropindexes":              true,
+	"deleteindexes":            true,
+	"reindex":                  true,
+	"renamecollection":         true,
+	"collmod":                  true,
+	"converttocapped":          true,
+	"clonecollectionascapped":  true,
+	"clonecollection":          true,
+	"clone":                    true,
+	"copydb":                   true,
+	"compact":                  true,
+	"repairdatabase":           true,
+	"emptycapped":              true,
+	"applyops":                 true,
+	"eval":                     true,
+	"$eval":                    true,
+	"createuser":               true,
+	"updateuser":               true,
+	"dropuser":                 true,
+	"dropallusersfromdatabase": true,
+	"grantrolestouser":         true,
+	"revokerolesfromuser":      true,
+	"createrole":               true,
+	"updaterole":               true,
+	"droprole":                 true,
+	"dropallrolesfromdatabase": true,
+	"grantprivilegestorole":    true,
+	"revokeprivilegesfromrole": true,
+	"grantrolestorole":         true,
+	"revokerolesfromrole":      true,
+}
+
+// isWriteCommand returns whether running cmd may modify the database.
+// Aggregations are writes if their pipeline has a $out or $merge stage,
+// and map/reduce jobs are writes unless their results are inlined.
+func isWriteCommand(cmd interface{}) bool {
+	data, err := bson.Marshal(cmd)
+	if err != nil {
+		// Commands that can't be marshalled are never sent.
+		return false
+	}
+	var elems bson.RawD
+	if bson.Unmarshal(data, &elems) != nil || len(elems) == 0 {
+		return false
+	}
+	if elems[0].Name == "$query" && elems[0].Value.Kind == 0x03 {
+		if bson.Unmarshal(elems[0].Value.Data, &elems) != nil || len(elems) == 0 {
+			return false
+		}
+	}
+	name := strings.ToLower(elems[0].Name)
+	switch name {
+	case "aggregate":
+		for _, elem := range elems {
+			if elem.Name != "pipeline" {
+				continue
+			}
+			var stages []bson.RawD
+			if elem.Value.Unmarshal(&stages) != nil {
+				return false
+			}
+			for _, stage := range stages {
+				if len(stage) > 0 && (stage[0].Name == "$out" || stage[0].Name == "$merge") {
+					return true
+				}
+			}
+		}
+		return false
+	case "mapreduce":
+		for _, elem := range elems {
+			if elem.Name != "out" {
+				continue
+			}
+			var out bson.RawD
+			if elem.Value.Kind != 0x03 || elem.Value.Unmarshal(&out) != nil {
+				return true
+			}
+			return len(out) == 0 || out[0].Name != "inline"
+		}
+		return false
+	}
+	return writeCommands[name]
 }
 
 // The DBRef type implements support for the database reference MongoDB
@@ -3429,13 +4424,19 @@ func (q *Query) Iter() *Iter {
 	op := q.op
 	prefetch := q.prefetch
 	limit := q.limit
+	memoryBudget := q.memoryBudget
+	autoBatch := q.autoBatch
+	pin := q.pin
 	q.m.Unlock()
 
 	iter := &Iter{
-		session:  session,
-		prefetch: prefetch,
-		limit:    limit,
-		timeout:  -1,
+		session:      session,
+		prefetch:     prefetch,
+		limit:        limit,
+		timeout:      -1,
+		batchSize:    op.limit,
+		memoryBudget: memoryBudget,
+		autoBatch:    autoBatch,
 	}
 	iter.gotReply.L = &iter.m
 	iter.op.collection = op.collection
@@ -3450,20 +4451,38 @@ func (q *Query) Iter() *Iter {
 	}
 	defer socket.Release()
 
-	session.prepareQuery(&op)
+	if err := session.prepareQuery(&op); err != nil {
+		iter.err = err
+		return iter
+	}
 	op.replyFunc = iter.op.replyFunc
 
+	if err := checkReadConcern(op.readConcern, socket.ServerInfo().MaxWireVersion); err != nil {
+		iter.err = err
+		return iter
+	}
 	if prepareFindOp(socket, &op, limit) {
 		iter.findCmd = true
 	}
 
+	leave, err := session.enterQuota(socket)
+	if err != nil {
+		iter.err = err
+		return iter
+	}
+	op.replyFunc = quotaReplyFunc(leave, op.replyFunc)
+
 	iter.server = socket.Server()
 	err = socket.Query(&op)
 	if err != nil {
+		// The reply to a query failing this way may never arrive.
+		leave()
 		// Must lock as the query is already out and it may call replyFunc.
 		iter.m.Lock()
 		iter.err = err
 		iter.m.Unlock()
+	} else if pin {
+		iter.pin(socket)
 	}
 
 	return iter
@@ -3521,44 +4540,87 @@ func (q *Query) Tail(timeout time.Duration) *Iter {
 	session := q.session
 	op := q.op
 	prefetch := q.prefetch
+	pin := q.pin
 	q.m.Unlock()
 
 	iter := &Iter{session: session, prefetch: prefetch}
 	iter.gotReply.L = &iter.m
 	iter.timeout = timeout
+	iter.tailable = true
 	iter.op.collection = op.collection
 	iter.op.limit = op.limit
 	iter.op.replyFunc = iter.replyFunc()
 	iter.docsToReceive++
-	session.prepareQuery(&op)
+	err := session.prepareQuery(&op)
 	op.replyFunc = iter.op.replyFunc
 	op.flags |= flagTailable | flagAwaitData
 
-	socket, err := session.acquireSocket(true)
+	var socket *mongoSocket
+	if err == nil {
+		socket, err = session.acquireSocket(true)
+	}
+	var leave func()
+	if err == nil {
+		leave, err = session.enterQuota(socket)
+		if err != nil {
+			socket.Release()
+		}
+	}
 	if err != nil {
 		iter.err = err
 	} else {
+		op.replyFunc = quotaReplyFunc(leave, op.replyFunc)
 		iter.server = socket.Server()
 		err = socket.Query(&op)
 		if err != nil {
+			// The reply to a query failing this way may never arrive.
+			leave()
 			// Must lock as the query is already out and it may call replyFunc.
 			iter.m.Lock()
 			iter.err = err
 			iter.m.Unlock()
+		} else if pin {
+			iter.pin(socket)
 		}
 		socket.Release()
 	}
 	return iter
 }
 
-func (s *Session) prepareQuery(op *queryOp) {
+// prepareQuery applies the session settings to op, and returns the error
+// the session policy rejects op with, if any.
+func (s *Session) prepareQuery(op *queryOp) error {
 	s.m.RLock()
 	op.mode = s.consistency
 	if s.slaveOk {
 		op.flags |= flagSlaveOk
 	}
+	op.readConcern = s.readConcernLocked(op.afterClusterTime)
+	if s.clusterTime.Kind != 0 {
+		op.clusterTime = s.clusterTime
+	}
+	nsDefault := s.namespaceDefaultLocked(op.collection)
+	if nsDefault != nil {
+		nsDefault.apply(op, s.snapshot)
+	}
+	if s.comment != "" && op.options.Comment == "" {
+		op.options.Comment = s.comment
+		op.hasOptions = true
+	}
+	op.options.MaxTimeMS = s.maxTimeLocked(op.options.MaxTimeMS)
+	if op.options.MaxTimeMS > 0 {
+		op.hasOptions = true
+	}
+	policy := s.policy
+	hintPins := s.hintPins
 	s.m.RUnlock()
-	return
+	if hintPins != nil {
+		hintPins.apply(op)
+	}
+	if nsDefault != nil {
+		nsDefault.applyHint(op)
+	}
+	return checkPolicy(policy, op)
 }
 
 // Err returns nil if no errors happened during iteration, or the actual
@@ -3599,17 +4661,26 @@ func (iter *Iter) Close() error {
 	err := iter.err
 	iter.m.Unlock()
 	if cursorId == 0 {
+		iter.unpin()
 		if err == ErrNotFound {
 			return nil
 		}
 		return err
 	}
+	iter.m.Lock()
+	pinned := iter.pinned != nil
+	iter.m.Unlock()
 	socket, err := iter.acquireSocket()
 	if err == nil {
-		// TODO Batch kills.
-		err = socket.Query(&killCursorsOp{[]int64{cursorId}})
+		if pinned {
+			// The cursor may only be known to the pinned connection.
+			err = socket.Query(&killCursorsOp{[]int64{cursorId}})
+		} else {
+			err = socket.Server().KillCursor(socket, cursorId)
+		}
 		socket.Release()
 	}
+	iter.unpin()
 
 	iter.m.Lock()
 	if err != nil && (iter.err == nil || iter.err == ErrNotFound) {
@@ -3680,10 +4751,19 @@ func (iter *Iter) Timeout() bool {
 //        return err
 //    }
 //
+// noAwaitDelay is how long Next waits before asking again for data on a
+// tailable cursor whose server doesn't support awaiting for it.
+var noAwaitDelay = 100 * time.Millisecond
+
 func (iter *Iter) Next(result interface{}) bool {
 	iter.m.Lock()
 	iter.timedout = false
 	timeout := time.Time{}
+	if !iter.lastNext.IsZero() {
+		// Time spent by the consumer with the previous document.
+		iter.consumeTime += time.Since(iter.lastNext)
+		iter.lastNext = time.Time{}
+	}
 	for iter.err == nil && iter.docData.Len() == 0 && (iter.docsToReceive > 0 || iter.op.cursorId != 0) {
 		if iter.docsToReceive == 0 {
 			if iter.timeout >= 0 {
@@ -3696,6 +4776,16 @@ func (iter *Iter) Next(result interface{}) bool {
 					return false
 				}
 			}
+			if iter.tailable && iter.noAwait {
+				// The server returns right away rather than awaiting
+				// data, so don't poll it in a busy loop.
+				iter.m.Unlock()
+				time.Sleep(noAwaitDelay)
+				iter.m.Lock()
+				if iter.err != nil || iter.docData.Len() > 0 || iter.docsToReceive > 0 {
+					continue
+				}
+			}
 			iter.getMore()
 			if iter.err != nil {
 				break
@@ -3706,6 +4796,11 @@ func (iter *Iter) Next(result interface{}) bool {
 
 	// Exhaust available data before reporting any errors.
 	if docData, ok := iter.docData.Pop().([]byte); ok {
+		iter.bufferedBytes -= len(docData)
+		if iter.autoBatch > 0 {
+			iter.consumedDocs++
+			iter.lastNext = time.Now()
+		}
 		close := false
 		if iter.limit > 0 {
 			iter.limit--
@@ -3729,20 +4824,12 @@ func (iter *Iter) Next(result interface{}) bool {
 		if close {
 			iter.Close()
 		}
-		err := bson.Unmarshal(docData, result)
-		if err != nil {
-			debugf("Iter %p document unmarshaling failed: %#v", iter, err)
-			iter.m.Lock()
-			if iter.err == nil {
-				iter.err = err
-			}
-			iter.m.Unlock()
-			return false
+		err := checkQueryError(iter.op.collection, docData)
+		if err == nil {
+			err = bson.Unmarshal(docData, result)
 		}
-		debugf("Iter %p document unmarshaled: %#v", iter, result)
-		// XXX Only have to check first document for a query error?
-		err = checkQueryError(iter.op.collection, docData)
 		if err != nil {
+			debugf("Iter %p document unmarshaling failed: %#v", iter, err)
 			iter.m.Lock()
 			if iter.err == nil {
 				iter.err = err
@@ -3750,15 +4837,21 @@ func (iter *Iter) Next(result interface{}) bool {
 			iter.m.Unlock()
 			return false
 		}
+		debugf("Iter %p document unmarshaled: %#v", iter, logDoc(result))
 		return true
 	} else if iter.err != nil {
 		debugf("Iter %p returning false: %s", iter, iter.err)
+		done := iter.op.cursorId == 0
 		iter.m.Unlock()
+		if done {
+			iter.unpin()
+		}
 		return false
 	} else if iter.op.cursorId == 0 {
 		iter.err = ErrNotFound
 		debugf("Iter %p exhausted with cursor=0", iter)
 		iter.m.Unlock()
+		iter.unpin()
 		return false
 	}
 
@@ -3815,7 +4908,18 @@ func (iter *Iter) All(result interface{}) error {
 
 // All works like Iter.All.
 func (q *Query) All(result interface{}) error {
-	return q.Iter().All(result)
+	cached, err := q.cachedQuery(false, result, func(docs *[]bson.Raw) error {
+		return q.Iter().All(docs)
+	})
+	if cached {
+		return err
+	}
+	q.m.Lock()
+	session := q.session
+	q.m.Unlock()
+	return session.retry(func() (bool, error) {
+		return true, q.Iter().All(result)
+	})
 }
 
 // The For method is obsolete and will be removed in a future release.
@@ -3860,6 +4964,20 @@ func (iter *Iter) For(result interface{}, f func() error) (err error) {
 // socket depends on the cluster sync loop, and the cluster sync loop might
 // attempt actions which cause replyFunc to be called, inducing a deadlock.
 func (iter *Iter) acquireSocket() (*mongoSocket, error) {
+	iter.m.Lock()
+	pinned := iter.pinned
+	if pinned != nil {
+		pinned.Acquire()
+	}
+	iter.m.Unlock()
+	if pinned != nil {
+		if !pinned.Dead() {
+			return pinned, nil
+		}
+		pinned.Release()
+		iter.unpin()
+	}
+
 	socket, err := iter.session.acquireSocket(true)
 	if err != nil {
 		return nil, err
@@ -3871,12 +4989,14 @@ func (iter *Iter) acquireSocket() (*mongoSocket, error) {
 		// to primary. Our cursor is in a specific server, though.
 		iter.session.m.Lock()
 		sockTimeout := iter.session.sockTimeout
+		writeTimeout := iter.session.writeTimeout
 		iter.session.m.Unlock()
 		socket.Release()
-		socket, _, err = iter.server.AcquireSocket(0, sockTimeout)
+		socket, _, err = iter.server.AcquireSocket(0, HighPriority, sockTimeout)
 		if err != nil {
 			return nil, err
 		}
+		socket.SetWriteTimeout(writeTimeout)
 		err := iter.session.socketLogin(socket)
 		if err != nil {
 			socket.Release()
@@ -3886,12 +5006,40 @@ func (iter *Iter) acquireSocket() (*mongoSocket, error) {
 	return socket, nil
 }
 
+// pin holds socket for all further requests on the iterator's cursor.
+func (iter *Iter) pin(socket *mongoSocket) {
+	socket.Acquire()
+	iter.m.Lock()
+	iter.pinned = socket
+	iter.m.Unlock()
+}
+
+// unpin releases the socket pinned by the iterator, if any.
+//
+// WARNING: This method must not be called with iter.m locked.
+func (iter *Iter) unpin() {
+	iter.m.Lock()
+	socket := iter.pinned
+	iter.pinned = nil
+	iter.m.Unlock()
+	if socket != nil {
+		socket.Release()
+	}
+}
+
 func (iter *Iter) getMore() {
 	// Increment now so that unlocking the iterator won't cause a
 	// different goroutine to get here as well.
 	iter.docsToReceive++
 	iter.m.Unlock()
 	socket, err := iter.acquireSocket()
+	var leave func()
+	if err == nil {
+		leave, err = iter.session.enterQuota(socket)
+		if err != nil {
+			socket.Release()
+		}
+	}
 	iter.m.Lock()
 	if err != nil {
 		iter.err = err
@@ -3900,6 +5048,15 @@ func (iter *Iter) getMore() {
 	defer socket.Release()
 
 	debugf("Iter %p requesting more documents", iter)
+	if iter.autoBatch > 0 {
+		iter.op.limit = iter.autoBatchSize()
+		iter.moreSent = time.Now()
+	}
+	if iter.memoryBudget > 0 {
+		if n := iter.memoryBatch(); iter.autoBatch == 0 || n < iter.op.limit {
+			iter.op.limit = n
+		}
+	}
 	if iter.limit > 0 {
 		// The -1 below accounts for the fact docsToReceive was incremented above.
 		limit := iter.limit - int32(iter.docsToReceive-1) - int32(iter.docData.Len())
@@ -3909,16 +5066,105 @@ func (iter *Iter) getMore() {
 	}
 	var op interface{}
 	if iter.findCmd {
-		op = iter.getMoreCmd()
+		cmd := iter.getMoreCmd()
+		cmd.replyFunc = quotaReplyFunc(leave, cmd.replyFunc)
+		op = cmd
 	} else {
-		op = &iter.op
+		gop := iter.op
+		gop.replyFunc = quotaReplyFunc(leave, gop.replyFunc)
+		op = &gop
 	}
 	if err := socket.Query(op); err != nil {
+		leave()
 		iter.docsToReceive--
 		iter.err = err
 	}
 }
 
+// pushDoc queues a received document for delivery by Next.
+// It must be called with iter.m held.
+func (iter *Iter) pushDoc(docData []byte) {
+	iter.docData.Push(docData)
+	iter.bufferedBytes += len(docData)
+	iter.receivedBytes += int64(len(docData))
+	iter.receivedDocs++
+}
+
+// memoryBatch returns the size of the next batch to request so that the
+// documents buffered by the iterator stay within its memory budget.
+// It must be called with iter.m held.
+func (iter *Iter) memoryBatch() int32 {
+	if iter.receivedDocs == 0 {
+		return iter.batchSize
+	}
+	avgSize := iter.receivedBytes / iter.receivedDocs
+	if avgSize == 0 {
+		avgSize = 1
+	}
+	n := int64(iter.memoryBudget-iter.bufferedBytes) / avgSize
+	if n < 2 {
+		// Server interprets 1 as -1 and closes the cursor.
+		n = 2
+	}
+	if iter.batchSize > 0 && n > int64(iter.batchSize) {
+		n = int64(iter.batchSize)
+	} else if n > math.MaxInt32 {
+		n = math.MaxInt32
+	}
+	return int32(n)
+}
+
+// autoBatchSize returns the size of the next batch to request so that the
+// documents buffered and requested by the iterator stay within its auto
+// batching window, and so that the consumer doesn't run out of documents
+// while waiting for the following batch. It must be called with iter.m held.
+func (iter *Iter) autoBatchSize() int32 {
+	if iter.receivedDocs == 0 {
+		return iter.batchSize
+	}
+	avgSize := iter.receivedBytes / iter.receivedDocs
+	if avgSize == 0 {
+		avgSize = 1
+	}
+	n := int64(iter.autoBatch-iter.bufferedBytes) / avgSize
+	if iter.rtt > 0 && iter.consumedDocs > 0 {
+		perDoc := iter.consumeTime / time.Duration(iter.consumedDocs)
+		if perDoc <= 0 {
+			perDoc = 1
+		}
+		// Documents consumed during a round trip must fit in the part of
+		// the batch left when the next one is requested.
+		want := int64(iter.rtt / perDoc)
+		if iter.prefetch > 0 {
+			want = int64(float64(want) / iter.prefetch)
+		} else {
+			want *= 2
+		}
+		if want < n {
+			n = want
+		}
+	}
+	if n < 2 {
+		// Server interprets 1 as -1 and closes the cursor.
+		n = 2
+	} else if n > math.MaxInt32 {
+		n = math.MaxInt32
+	}
+	return int32(n)
+}
+
+// observeRTT updates the estimated round trip time of getMore requests
+// with the one just replied to. It must be called with iter.m held.
+func (iter *Iter) observeRTT() {
+	rtt := time.Since(iter.moreSent)
+	iter.moreSent = time.Time{}
+	if iter.rtt == 0 {
+		iter.rtt = rtt
+	} else {
+		iter.rtt = (3*iter.rtt + rtt) / 4
+	}
+}
+
 func (iter *Iter) getMoreCmd() *queryOp {
 	// TODO: Define the query statically in the Iter type, next to getMoreOp.
 	nameDot := strings.Index(iter.op.collection, ".")
@@ -3941,10 +5187,13 @@ func (iter *Iter) getMoreCmd() *queryOp {
 }
 
 type countCmd struct {
-	Count string
-	Query interface{}
-	Limit int32 ",omitempty"
-	Skip  int32 ",omitempty"
+	Count       string
+	Query       interface{}
+	Limit       int32       ",omitempty"
+	Skip        int32       ",omitempty"
+	ReadConcern interface{} "readConcern,omitempty"
+	ClusterTime interface{} "$clusterTime,omitempty"
+	MaxTimeMS   int         "maxTimeMS,omitempty"
 }
 
 // Count returns the total number of documents in the result set.
@@ -3967,7 +5216,30 @@ func (q *Query) Count() (n int, err error) {
 		query = bson.D{}
 	}
 	result := struct{ N int }{}
-	err = session.DB(dbname).Run(countCmd{cname, query, limit, op.skip}, &result)
+	err = session.retry(func() (bool, error) {
+		cmd := countCmd{
+			Count: cname,
+			Query: query,
+			Limit: limit,
+			Skip:  op.skip,
+		}
+		// Count doesn't support snapshot reads.
+		session.m.RLock()
+		level := session.readConcernLevel
+		if nsDefault := session.namespaceDefaultLocked(op.collection); nsDefault != nil && nsDefault.ReadConcern != "" {
+			level = nsDefault.ReadConcern
+		}
+		cmd.ReadConcern = readConcernDoc(level, op.afterClusterTime)
+		cmd.MaxTimeMS = session.maxTimeLocked(op.options.MaxTimeMS)
+		session.m.RUnlock()
+		if err := session.checkReadConcern(cmd.ReadConcern); err != nil {
+			return false, err
+		}
+		if op.afterClusterTime != 0 {
+			cmd.ClusterTime = session.gossipedClusterTime()
+		}
+		return true, session.DB(dbname).Run(cmd, &result)
+	})
 	return result.N, err
 }
 
@@ -3977,9 +5249,12 @@ func (c *Collection) Count() (n int, err error) {
 }
 
 type distinctCmd struct {
-	Collection string "distinct"
-	Key        string
-	Query      interface{} ",omitempty"
+	Collection  string "distinct"
+	Key         string
+	Query       interface{} ",omitempty"
+	ReadConcern interface{} "readConcern,omitempty"
+	ClusterTime interface{} "$clusterTime,omitempty"
+	MaxTimeMS   int         "maxTimeMS,omitempty"
 }
 
 // Distinct unmarshals into result the list of distinct values for the given key.
@@ -4008,7 +5283,20 @@ func (q *Query) Distinct(key string, result interface{}) error {
 	cname := op.collection[c+1:]
 
 	var doc struct{ Values bson.Raw }
-	err := session.DB(dbname).Run(distinctCmd{cname, key, op.query}, &doc)
+	err := session.retry(func() (bool, error) {
+		cmd := distinctCmd{
+			Collection:  cname,
+			Key:         key,
+			Query:       op.query,
+			ReadConcern: session.readConcern(op.afterClusterTime),
+			ClusterTime: session.gossipedClusterTime(),
+			MaxTimeMS:   session.maxTime(op.options.MaxTimeMS),
+		}
+		if err := session.checkReadConcern(cmd.ReadConcern); err != nil {
+			return false, err
+		}
+		return true, session.DB(dbname).Run(cmd, &doc)
+	})
 	if err != nil {
 		return err
 	}
@@ -4229,16 +5517,22 @@ func fixMROut(out interface{}) interface{} {
 // Change holds fields for running a findAndModify MongoDB command via
 // the Query.Apply method.
 type Change struct {
-	Update    interface{} // The update document
+	Update    interface{} // The update document or pipeline
 	Upsert    bool        // Whether to insert in case the document isn't found
 	Remove    bool        // Whether to remove the document found rather than updating
 	ReturnNew bool        // Should the modified document be returned rather than the old one
+
+	// ArrayFilters selects which array elements are modified by the
+	// filtered positional operator in Update. Depends on MongoDB 3.6+.
+	// See UpdateWithArrayFilters.
+	ArrayFilters []interface{}
 }
 
 type findModifyCmd struct {
-	Collection                  string      "findAndModify"
-	Query, Update, Sort, Fields interface{} ",omitempty"
-	Upsert, Remove, New         bool        ",omitempty"
+	Collection                  string        "findAndModify"
+	Query, Update, Sort, Fields interface{}   ",omitempty"
+	Upsert, Remove, New         bool          ",omitempty"
+	ArrayFilters                []interface{} "arrayFilters,omitempty"
 }
 
 type valueResult struct {
@@ -4296,12 +5590,35 @@ func (q *Query) Apply(change Change, result interface{}) (info *ChangeInfo, err
 		Query:      op.query,
 		Sort:       op.options.OrderBy,
 		Fields:     op.selector,
+
+		ArrayFilters: change.ArrayFilters,
 	}
 
 	session = session.Clone()
 	defer session.Close()
 	session.SetMode(Strong, false)
 
+	session.m.RLock()
+	dryRun := session.dryRun
+	session.m.RUnlock()
+	if dryRun != nil {
+		return session.DB(dbname).C(cname).dryRunApply(dryRun, op.query, change)
+	}
+	defer session.invalidateCache(op.collection)
+
+	if isUpdatePipeline(change.Update) || len(change.ArrayFilters) > 0 {
+		socket, err := session.acquireSocket(false)
+		if err != nil {
+			return nil, err
+		}
+		wireVersion := socket.ServerInfo().MaxWireVersion
+		socket.Release()
+		err = checkUpdateOp(&updateOp{Update: change.Update, ArrayFilters: change.ArrayFilters}, wireVersion)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	var doc valueResult
 	for i := 0; i < maxUpsertRetries; i++ {
 		err = session.DB(dbname).Run(&cmd, &doc)
@@ -4341,6 +5658,22 @@ func (q *Query) Apply(change Change, result interface{}) (info *ChangeInfo, err
 	return info, nil
 }
 
+// FindOneAndReplace runs the findAndModify MongoDB command to replace
+// the first document matching the query with change.Update, atomically
+// returning either the old or the new version of the document as
+// defined by change.ReturnNew. It works like Apply, but fails if the
+// replacement holds update operators, as explained in ReplaceOne, and
+// if change.Remove is set.
+func (q *Query) FindOneAndReplace(change Change, result interface{}) (info *ChangeInfo, err error) {
+	if change.Remove {
+		return nil, errors.New("cannot remove and replace a document at once")
+	}
+	if err := checkReplacement(change.Update); err != nil {
+		return nil, err
+	}
+	return q.Apply(change, result)
+}
+
 // The BuildInfo type encapsulates details about the running MongoDB server.
 //
 // Note that the VersionArray field was introduced in MongoDB 2.0+, but it is
@@ -4399,10 +5732,295 @@ func (s *Session) BuildInfo() (info BuildInfo, err error) {
 	return
 }
 
+// MaxWireVersion returns the maximum wire protocol version supported by
+// the server the session would run a query with, which identifies the
+// features available in that server independently of how its version
+// string is formatted. For reference, MongoDB 3.6 reports version 6,
+// 4.0 reports version 7, and 4.2 reports version 8.
+//
+// Servers with older wire versions are still supported: queries and
+// getMore requests fall back to the legacy OP_QUERY and OP_GET_MORE
+// messages below version 4, and writes are sent as legacy operations
+// followed by getLastError below version 2. Features that cannot be
+// expressed that way, such as read concerns, collations, array filters,
+// and update pipelines, fail with a specific error (ErrReadConcern,
+// ErrCollation, ErrArrayFilters, ErrUpdatePipeline) rather than being
+// silently dropped.
+func (s *Session) MaxWireVersion() (int, error) {
+	info, err := s.serverInfo()
+	if err != nil {
+		return 0, err
+	}
+	return info.MaxWireVersion, nil
+}
+
+// SupportsChangeStreams returns whether the deployment the session is
+// connected to supports change streams, which depend on MongoDB 3.6+
+// running as a replica set or sharded cluster.
+func (s *Session) SupportsChangeStreams() (bool, error) {
+	info, err := s.serverInfo()
+	if err != nil {
+		return false, err
+	}
+	return info.MaxWireVersion >= 6 && (info.SetName != "" || info.Mongos), nil
+}
+
+// SupportsTransactions returns whether the deployment the session is
+// connected to supports multi-document transactions, which depend on
+// MongoDB 4.0+ running as a replica set, or MongoDB 4.2+ running as a
+// sharded cluster.
+func (s *Session) SupportsTransactions() (bool, error) {
+	info, err := s.serverInfo()
+	if err != nil {
+		return false, err
+	}
+	if info.Mongos {
+		return info.MaxWireVersion >= 8, nil
+	}
+	return info.MaxWireVersion >= 7 && info.SetName != "", nil
+}
+
+func (s *Session) serverInfo() (*mongoServerInfo, error) {
+	socket, err := s.acquireSocket(true)
+	if err != nil {
+		return nil, err
+	}
+	defer socket.Release()
+	return socket.ServerInfo(), nil
+}
+
+// ClusterTime returns the most recent $clusterTime document observed in
+// server replies on MongoDB 3.6+, or a zero bson.Raw value if none was
+// observed yet. The document is opaque and includes a signature, so it
+// must be provided back to AdvanceClusterTime as-is.
+//
+// Together with OperationTime, this allows stateless services to hand
+// causal consistency tokens to their clients and continue from the same
+// point on a different session, possibly in a different process.
+func (s *Session) ClusterTime() bson.Raw {
+	s.m.RLock()
+	clusterTime := s.clusterTime
+	s.m.RUnlock()
+	return clusterTime
+}
+
+// AdvanceClusterTime updates the $clusterTime document known to the
+// session and sent along with commands to MongoDB 3.6+ servers, unless
+// the session already knows of a later cluster time.
+func (s *Session) AdvanceClusterTime(clusterTime bson.Raw) {
+	s.m.Lock()
+	s.advanceClusterTime(clusterTime)
+	s.m.Unlock()
+}
+
+// OperationTime returns the time of the most recent operation observed
+// in server replies on MongoDB 3.6+, or zero if none was observed yet.
+func (s *Session) OperationTime() bson.MongoTimestamp {
+	s.m.RLock()
+	operationTime := s.operationTime
+	s.m.RUnlock()
+	return operationTime
+}
+
+// AdvanceOperationTime updates the operation time known to the session,
+// unless it already knows of a later one.
+func (s *Session) AdvanceOperationTime(operationTime bson.MongoTimestamp) {
+	s.m.Lock()
+	if operationTime > s.operationTime {
+		s.operationTime = operationTime
+	}
+	s.m.Unlock()
+}
+
+// WriteToken identifies a point in the history of a MongoDB 3.6+
+// deployment, as observed by a session after one of its writes.
+// It may be serialized and handed to a different session, possibly in a
+// different process, so that queries made with Query.AfterWrite observe
+// that write even when reading from a secondary.
+type WriteToken struct {
+	OperationTime bson.MongoTimestamp `bson:"operationTime"`
+	ClusterTime   bson.Raw            `bson:"clusterTime,omitempty"`
+}
+
+// IsZero returns whether the token holds no operation time, which is the
+// case for sessions that did not yet talk to a MongoDB 3.6+ server.
+func (t WriteToken) IsZero() bool {
+	return t.OperationTime == 0
+}
+
+// WriteToken returns a token for the most recent operation observed by
+// the session. When obtained right after a write, queries made with
+// Query.AfterWrite and the returned token will observe that write.
+func (s *Session) WriteToken() WriteToken {
+	s.m.RLock()
+	token := WriteToken{s.operationTime, s.clusterTime}
+	s.m.RUnlock()
+	return token
+}
+
+type clusterTimeDoc struct {
+	ClusterTime bson.MongoTimestamp `bson:"clusterTime"`
+}
+
+// advanceClusterTime must be called with s.m held for writing.
+func (s *Session) advanceClusterTime(clusterTime bson.Raw) {
+	if clusterTime.Kind != 0x03 {
+		return
+	}
+	if s.clusterTime.Kind == 0x03 {
+		var current, next clusterTimeDoc
+		if clusterTime.Unmarshal(&next) != nil {
+			return
+		}
+		if s.clusterTime.Unmarshal(&current) == nil && next.ClusterTime <= current.ClusterTime {
+			return
+		}
+	}
+	s.clusterTime = clusterTime
+}
+
+// causalReply holds the causal consistency fields of command replies.
+type causalReply struct {
+	OperationTime bson.MongoTimestamp `bson:"operationTime"`
+	ClusterTime   bson.Raw            `bson:"$clusterTime"`
+	AtClusterTime bson.MongoTimestamp `bson:"atClusterTime"`
+}
+
+// observeReply records the causal consistency fields of a command reply.
+func (s *Session) observeReply(reply *causalReply) {
+	if reply.OperationTime == 0 && reply.ClusterTime.Kind == 0 && reply.AtClusterTime == 0 {
+		return
+	}
+	s.m.Lock()
+	if reply.OperationTime > s.operationTime {
+		s.operationTime = reply.OperationTime
+	}
+	s.advanceClusterTime(reply.ClusterTime)
+	if s.snapshot && s.snapshotTime == 0 && reply.AtClusterTime != 0 {
+		s.snapshotTime = reply.AtClusterTime
+	}
+	s.m.Unlock()
+}
+
+// SetSnapshot enables or disables snapshot reads for the session, which
+// requires MongoDB 5.0+.
+//
+// With snapshot reads enabled, queries, aggregations, and distinct
+// operations observe the data as of a single point in time. The
+// point in time is picked by the server on the first read, and all later
+// reads in the session reuse it, so that consistent data is read across
+// multiple collections without running a transaction. Enabling snapshot
+// reads again, even if already enabled, has the session pick a new point
+// in time on its next read.
+//
+// Snapshot reads should be done with the session in Monotonic or Strong
+// mode, since the server must retain history for the chosen point in
+// time. Writes are not affected, and neither is Count, which the server
+// doesn't support with snapshot reads.
+func (s *Session) SetSnapshot(enabled bool) {
+	s.m.Lock()
+	s.snapshot = enabled
+	s.snapshotTime = 0
+	s.m.Unlock()
+}
+
+// SnapshotTime returns the point in time observed by snapshot reads in
+// the session, or zero if snapshot reads are disabled or no read was
+// made yet. See SetSnapshot.
+func (s *Session) SnapshotTime() bson.MongoTimestamp {
+	s.m.RLock()
+	snapshotTime := s.snapshotTime
+	s.m.RUnlock()
+	return snapshotTime
+}
+
+// readConcernLocked returns the read concern for reads in the session
+// that must observe all writes up to afterClusterTime, if not zero.
+// It must be called with s.m held.
+func (s *Session) readConcernLocked(afterClusterTime bson.MongoTimestamp) interface{} {
+	if s.snapshot {
+		if s.snapshotTime == 0 {
+			return bson.D{{"level", "snapshot"}}
+		}
+		return bson.D{{"level", "snapshot"}, {"atClusterTime", s.snapshotTime}}
+	}
+	return readConcernDoc(s.readConcernLevel, afterClusterTime)
+}
+
+// readConcernDoc returns the read concern document for the given level
+// and cluster time, or nil if both are unset.
+func readConcernDoc(level string, afterClusterTime bson.MongoTimestamp) interface{} {
+	var doc bson.D
+	if level != "" {
+		doc = append(doc, bson.DocElem{"level", level})
+	}
+	if afterClusterTime != 0 {
+		doc = append(doc, bson.DocElem{"afterClusterTime", afterClusterTime})
+	}
+	if doc == nil {
+		return nil
+	}
+	return doc
+}
+
+// readConcern returns the read concern for reads in the session, if any.
+func (s *Session) readConcern(afterClusterTime bson.MongoTimestamp) interface{} {
+	s.m.RLock()
+	readConcern := s.readConcernLocked(afterClusterTime)
+	s.m.RUnlock()
+	return readConcern
+}
+
+// gossipedClusterTime returns the cluster time known to the session, to
+// be provided along with commands, or nil if none is known.
+func (s *Session) gossipedClusterTime() interface{} {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	if s.clusterTime.Kind == 0 {
+		return nil
+	}
+	return s.clusterTime
+}
+
+// gossipClusterTime returns cmd with the cluster time known to the
+// session appended to it, if the server supports it and cmd is a
+// bson.D value. The provided document is not modified.
+func (s *Session) gossipClusterTime(socket *mongoSocket, cmd interface{}) interface{} {
+	doc, ok := cmd.(bson.D)
+	if !ok || socket.ServerInfo().MaxWireVersion < 6 {
+		return cmd
+	}
+	s.m.RLock()
+	clusterTime := s.clusterTime
+	s.m.RUnlock()
+	if clusterTime.Kind == 0 {
+		return cmd
+	}
+	for _, elem := range doc {
+		if elem.Name == "$clusterTime" {
+			return cmd
+		}
+	}
+	gossip := make(bson.D, len(doc), len(doc)+1)
+	copy(gossip, doc)
+	return append(gossip, bson.DocElem{"$clusterTime", clusterTime})
+}
+
 // ---------------------------------------------------------------------------
 // Internal session handling helpers.
 
 func (s *Session) acquireSocket(slaveOk bool) (*mongoSocket, error) {
+	return s.acquireSocketBalanced(slaveOk, true)
+}
+
+// acquireReservedSocket works like acquireSocket, but never moves the
+// operation away from the socket reserved by the session. It's used for
+// operations that change the state of the socket itself, such as logins.
+func (s *Session) acquireReservedSocket(slaveOk bool) (*mongoSocket, error) {
+	return s.acquireSocketBalanced(slaveOk, false)
+}
+
+func (s *Session) acquireSocketBalanced(slaveOk, balance bool) (*mongoSocket, error) {
 
 	// Read-only lock to check for previously reserved socket.
 	s.m.RLock()
@@ -4411,12 +6029,18 @@ func (s *Session) acquireSocket(slaveOk bool) (*mongoSocket, error) {
 	if s.slaveSocket != nil && s.slaveOk && slaveOk && (s.masterSocket == nil || s.consistency != PrimaryPreferred && s.consistency != Monotonic) {
 		socket := s.slaveSocket
 		socket.Acquire()
+		if balance {
+			socket = s.balanceSocket(socket)
+		}
 		s.m.RUnlock()
 		return socket, nil
 	}
 	if s.masterSocket != nil {
 		socket := s.masterSocket
 		socket.Acquire()
+		if balance {
+			socket = s.balanceSocket(socket)
+		}
 		s.m.RUnlock()
 		return socket, nil
 	}
@@ -4429,18 +6053,25 @@ func (s *Session) acquireSocket(slaveOk bool) (*mongoSocket, error) {
 
 	if s.slaveSocket != nil && s.slaveOk && slaveOk && (s.masterSocket == nil || s.consistency != PrimaryPreferred && s.consistency != Monotonic) {
 		s.slaveSocket.Acquire()
+		if balance {
+			return s.balanceSocket(s.slaveSocket), nil
+		}
 		return s.slaveSocket, nil
 	}
 	if s.masterSocket != nil {
 		s.masterSocket.Acquire()
+		if balance {
+			return s.balanceSocket(s.masterSocket), nil
+		}
 		return s.masterSocket, nil
 	}
 
 	// Still not good.  We need a new socket.
-	sock, err := s.cluster().AcquireSocket(s.consistency, slaveOk && s.slaveOk, s.syncTimeout, s.sockTimeout, s.queryConfig.op.serverTags, s.poolLimit)
+	sock, err := s.cluster().AcquireSocket(s.consistency, slaveOk && s.slaveOk, s.syncTimeout, s.sockTimeout, s.queryConfig.op.serverTags, s.poolLimit, s.priority, s.failNoPrimary)
 	if err != nil {
 		return nil, err
 	}
+	sock.SetWriteTimeout(s.writeTimeout)
 
 	// Authenticate the new socket.
 	if err = s.socketLogin(sock); err != nil {
@@ -4465,6 +6096,33 @@ func (s *Session) acquireSocket(slaveOk bool) (*mongoSocket, error) {
 	return sock, nil
 }
 
+// balanceSocket returns the acquired reserved socket, unless it already
+// has s.maxInFlight operations waiting for replies, in which case it is
+// released and another socket to the same server is acquired instead.
+// The session lock must be held.
+func (s *Session) balanceSocket(socket *mongoSocket) *mongoSocket {
+	if s.maxInFlight <= 0 || socket.InFlight() < s.maxInFlight {
+		return socket
+	}
+	server := socket.Server()
+	if server == nil {
+		return socket
+	}
+	other, _, err := server.AcquireSocket(s.poolLimit, s.priority, s.sockTimeout)
+	if err != nil {
+		debugf("Session %p: keeping busy socket %p: %v", s, socket, err)
+		return socket
+	}
+	other.SetWriteTimeout(s.writeTimeout)
+	if err := s.socketLogin(other); err != nil {
+		other.Release()
+		return socket
+	}
+	debugf("Session %p: socket %p has %d operations in flight; using socket %p", s, socket, s.maxInFlight, other)
+	socket.Release()
+	return other
+}
+
 // setSocket binds socket to this section.
 func (s *Session) setSocket(socket *mongoSocket) {
 	info := socket.Acquire()
@@ -4497,32 +6155,50 @@ func (iter *Iter) replyFunc() replyFunc {
 	return func(err error, op *replyOp, docNum int, docData []byte) {
 		iter.m.Lock()
 		iter.docsToReceive--
+		if !iter.moreSent.IsZero() {
+			iter.observeRTT()
+		}
+		if op != nil && !iter.findCmd {
+			iter.noAwait = op.flags&replyAwaitCapable == 0
+		}
 		if err != nil {
 			iter.err = err
+			if IsCursorNotFound(err) || IsInterrupted(err) {
+				// The cursor timed out or was killed, so it's gone
+				// from the server.
+				iter.op.cursorId = 0
+			}
 			debugf("Iter %p received an error: %s", iter, err.Error())
 		} else if docNum == -1 {
 			debugf("Iter %p received no documents (cursor=%d).", iter, op.cursorId)
 			if op != nil && op.cursorId != 0 {
 				// It's a tailable cursor.
 				iter.op.cursorId = op.cursorId
-			} else if op != nil && op.cursorId == 0 && op.flags&1 == 1 {
-				// Cursor likely timed out.
-				iter.err = ErrCursor
 			} else {
 				iter.err = ErrNotFound
 			}
 		} else if iter.findCmd {
 			debugf("Iter %p received reply document %d/%d (cursor=%d)", iter, docNum+1, int(op.replyDocs), op.cursorId)
 			var findReply struct {
-				Ok     bool
-				Code   int
-				Errmsg string
-				Cursor cursorData
+				Ok          bool
+				Code        int
+				Errmsg      string
+				Cursor      cursorData
+				causalReply `bson:",inline"`
+			}
+			err := bson.Unmarshal(docData, &findReply)
+			if findReply.AtClusterTime == 0 {
+				findReply.AtClusterTime = findReply.Cursor.AtClusterTime
 			}
-			if err := bson.Unmarshal(docData, &findReply); err != nil {
+			iter.session.observeReply(&findReply.causalReply)
+			if err != nil {
 				iter.err = err
 			} else if !findReply.Ok && findReply.Errmsg != "" {
 				iter.err = &QueryError{Code: findReply.Code, Message: findReply.Errmsg}
+				if IsInterrupted(iter.err) || IsCursorNotFound(iter.err) {
+					// The cursor is gone from the server.
+					iter.op.cursorId = 0
+				}
 			} else if len(findReply.Cursor.FirstBatch) == 0 && len(findReply.Cursor.NextBatch) == 0 {
 				iter.err = ErrNotFound
 			} else {
@@ -4532,7 +6208,7 @@ func (iter *Iter) replyFunc() replyFunc {
 				}
 				rdocs := len(batch)
 				for _, raw := range batch {
-					iter.docData.Push(raw.Data)
+					iter.pushDoc(raw.Data)
 				}
 				iter.docsToReceive = 0
 				docsToProcess := iter.docData.Len()
@@ -4556,7 +6232,7 @@ func (iter *Iter) replyFunc() replyFunc {
 				iter.op.cursorId = op.cursorId
 			}
 			debugf("Iter %p received reply document %d/%d (cursor=%d)", iter, docNum+1, rdocs, op.cursorId)
-			iter.docData.Push(docData)
+			iter.pushDoc(docData)
 		}
 		iter.gotReply.Broadcast()
 		iter.m.Unlock()
@@ -4599,6 +6275,31 @@ func (r *writeCmdResult) BulkErrorCases() []BulkErrorCase {
 // LastError result is made available in lerr, and if lerr.Err is set it
 // will also be returned as err.
 func (c *Collection) writeOp(op interface{}, ordered bool) (lerr *LastError, err error) {
+	s := c.Database.Session
+	s.m.RLock()
+	readOnly := s.readOnly
+	dryRun := s.dryRun
+	s.m.RUnlock()
+	if readOnly {
+		return nil, ErrReadOnly
+	}
+	if dryRun != nil {
+		if lerr, ok, err := c.dryRunWrite(dryRun, op); ok {
+			return lerr, err
+		}
+	}
+
+	defer s.invalidateCache(c.FullName)
+	err = s.retry(func() (bool, error) {
+		lerr, err = c.writeOpOnce(op, ordered)
+		// Retry only if nothing at all was written.
+		safe := isNotRunError(err) && (lerr == nil || lerr.N == 0 && lerr.modified == 0)
+		return safe, err
+	})
+	return lerr, err
+}
+
+func (c *Collection) writeOpOnce(op interface{}, ordered bool) (lerr *LastError, err error) {
 	s := c.Database.Session
 	socket, err := s.acquireSocket(c.Database.Name == "local")
 	if err != nil {
@@ -4608,41 +6309,56 @@ func (c *Collection) writeOp(op interface{}, ordered bool) (lerr *LastError, err
 
 	s.m.RLock()
 	safeOp := s.safeOp
+	if nsDefault := s.namespaceDefaultLocked(c.FullName); nsDefault != nil && nsDefault.safeOp != nil {
+		safeOp = nsDefault.safeOp
+	}
 	bypassValidation := s.bypassValidation
 	s.m.RUnlock()
 
+	if err := checkUpdateOp(op, socket.ServerInfo().MaxWireVersion); err != nil {
+		return nil, err
+	}
+	if socket.ServerInfo().MaxWireVersion < 2 {
+		// Write commands are checked when run.
+		if err := s.checkWritePolicy(c, op); err != nil {
+			return nil, err
+		}
+	}
+
 	if socket.ServerInfo().MaxWireVersion >= 2 {
 		// Servers with a more recent write protocol benefit from write commands.
-		if op, ok := op.(*insertOp); ok && len(op.documents) > 1000 {
-			var lerr LastError
-
-			// Maximum batch size is 1000. Must split out in separate operations for compatibility.
-			all := op.documents
-			for i := 0; i < len(all); i += 1000 {
-				l := i + 1000
-				if l > len(all) {
-					l = len(all)
+		batches, err := splitWriteOp(op, socket.ServerInfo())
+		if err != nil {
+			return nil, err
+		}
+		if len(batches) == 1 {
+			return c.writeOpCommand(socket, safeOp, batches[0].op, ordered, bypassValidation)
+		}
+
+		stopOnError := ordered
+		if op, ok := op.(*insertOp); ok {
+			stopOnError = op.flags&1 == 0
+		}
+
+		var lerr LastError
+		for _, batch := range batches {
+			oplerr, err := c.writeOpCommand(socket, safeOp, batch.op, ordered, bypassValidation)
+			lerr.N += oplerr.N
+			lerr.modified += oplerr.modified
+			if err != nil {
+				for ei := range oplerr.ecases {
+					oplerr.ecases[ei].Index += batch.offset
 				}
-				op.documents = all[i:l]
-				oplerr, err := c.writeOpCommand(socket, safeOp, op, ordered, bypassValidation)
-				lerr.N += oplerr.N
-				lerr.modified += oplerr.modified
-				if err != nil {
-					for ei := range oplerr.ecases {
-						oplerr.ecases[ei].Index += i
-					}
-					lerr.ecases = append(lerr.ecases, oplerr.ecases...)
-					if op.flags&1 == 0 {
-						return &lerr, err
-					}
+				lerr.ecases = append(lerr.ecases, oplerr.ecases...)
+				if stopOnError {
+					return &lerr, err
 				}
 			}
-			if len(lerr.ecases) != 0 {
-				return &lerr, lerr.ecases[0].Err
-			}
-			return &lerr, nil
 		}
-		return c.writeOpCommand(socket, safeOp, op, ordered, bypassValidation)
+		if len(lerr.ecases) != 0 {
+			return &lerr, lerr.ecases[0].Err
+		}
+		return &lerr, nil
 	} else if updateOps, ok := op.(bulkUpdateOp); ok {
 		var lerr LastError
 		for i, updateOp := range updateOps {
@@ -4681,7 +6397,157 @@ func (c *Collection) writeOp(op interface{}, ordered bool) (lerr *LastError, err
 	return c.writeOpQuery(socket, safeOp, op, ordered)
 }
 
+// writeBatch is a portion of a write operation that is sent to the
+// server as a single write command.
+type writeBatch struct {
+	op     interface{}
+	offset int // Index of the first document of the batch in the whole operation
+}
+
+const (
+	defaultMaxBSONObjectSize = 16 * 1024 * 1024
+	defaultMaxWriteBatchSize = 1000
+)
+
+// splitWriteOp splits the insert, update, or delete operation op into as
+// many batches as necessary for each batch to fit in a single write
+// command, given the document size and count limits of the server.
+// Other operations are returned as a single batch.
+func splitWriteOp(op interface{}, info *mongoServerInfo) ([]writeBatch, error) {
+	var docs []interface{}
+	switch op := op.(type) {
+	case *insertOp:
+		docs = op.documents
+	case bulkUpdateOp:
+		docs = op
+	case bulkDeleteOp:
+		docs = op
+	}
+	maxCount := info.MaxWriteBatchSize
+	if maxCount <= 0 {
+		maxCount = defaultMaxWriteBatchSize
+	}
+	if len(docs) < 2 {
+		return []writeBatch{{op, 0}}, nil
+	}
+
+	maxBytes := info.MaxBSONObjectSize
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxBSONObjectSize
+	}
+
+	// Marshal documents upfront to find out their sizes, and hand the
+	// marshaled data over so that it's not marshaled again.
+	raws := make([]interface{}, len(docs))
+	var batches []writeBatch
+	start, size := 0, 0
+	for i, doc := range docs {
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		raws[i] = bson.Raw{0x03, data}
+
+		// Account for the array element type and index key as well.
+		docSize := len(data) + 2 + len(strconv.Itoa(i-start))
+		if i > start && (i-start == maxCount || size+docSize > maxBytes) {
+			batches = append(batches, writeBatch{offset: start})
+			start, size = i, 0
+			docSize = len(data) + 3
+		}
+		size += docSize
+	}
+	batches = append(batches, writeBatch{offset: start})
+
+	for i := range batches {
+		end := len(raws)
+		if i+1 < len(batches) {
+			end = batches[i+1].offset
+		}
+		batch := raws[batches[i].offset:end]
+		switch op := op.(type) {
+		case *insertOp:
+			batches[i].op = &insertOp{op.collection, batch, op.flags}
+		case bulkUpdateOp:
+			batches[i].op = bulkUpdateOp(batch)
+		case bulkDeleteOp:
+			batches[i].op = bulkDeleteOp(batch)
+		}
+	}
+	return batches, nil
+}
+
+// checkUpdateOp returns an error if op is an update operation, or a
+// bulk of them, relying on features not supported by a server with
+// the given wire version.
+func checkUpdateOp(op interface{}, wireVersion int) error {
+	var uops []interface{}
+	switch op := op.(type) {
+	case *updateOp:
+		uops = []interface{}{op}
+	case bulkUpdateOp:
+		uops = op
+	}
+	for _, uop := range uops {
+		uop := uop.(*updateOp)
+		if wireVersion < 8 && isUpdatePipeline(uop.Update) {
+			return ErrUpdatePipeline
+		}
+		if wireVersion < 6 && len(uop.ArrayFilters) > 0 {
+			return ErrArrayFilters
+		}
+	}
+	return nil
+}
+
+// checkReadConcern returns ErrReadConcern if readConcern is set and the
+// server with the given wire version would ignore it. Such servers only
+// understand legacy OP_QUERY reads, which have no way to convey it.
+func checkReadConcern(readConcern interface{}, wireVersion int) error {
+	if readConcern != nil && wireVersion < 4 {
+		return ErrReadConcern
+	}
+	return nil
+}
+
+// checkReadConcern is like the checkReadConcern function, for commands
+// run without a socket at hand.
+func (s *Session) checkReadConcern(readConcern interface{}) error {
+	if readConcern == nil {
+		return nil
+	}
+	wireVersion, err := s.MaxWireVersion()
+	if err != nil {
+		return err
+	}
+	return checkReadConcern(readConcern, wireVersion)
+}
+
+// isUpdatePipeline returns whether update is an aggregation pipeline
+// rather than an update or replacement document.
+func isUpdatePipeline(update interface{}) bool {
+	switch update := update.(type) {
+	case nil, bson.D, bson.RawD, *bson.D, *bson.RawD:
+		return false
+	case bson.Raw:
+		return update.Kind == 0x04
+	case *bson.Raw:
+		return update.Kind == 0x04
+	}
+	v := reflect.ValueOf(update)
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	return v.Kind() == reflect.Slice || v.Kind() == reflect.Array
+}
+
 func (c *Collection) writeOpQuery(socket *mongoSocket, safeOp *queryOp, op interface{}, ordered bool) (lerr *LastError, err error) {
+	leave, err := c.Database.Session.enterQuota(socket)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+
 	if safeOp == nil {
 		return nil, socket.Query(op)
 	}
@@ -4714,7 +6580,7 @@ func (c *Collection) writeOpQuery(socket *mongoSocket, safeOp *queryOp, op inter
 	}
 	result := &LastError{}
 	bson.Unmarshal(replyData, &result)
-	debugf("Result from writing query: %#v", result)
+	debugf("Result from writing query: %#v", logDoc(result))
 	if result.Err != "" {
 		result.ecases = []BulkErrorCase{{Index: 0, Err: result}}
 		if insert, ok := op.(*insertOp); ok && len(insert.documents) > 1 {
@@ -4784,7 +6650,7 @@ func (c *Collection) writeOpCommand(socket *mongoSocket, safeOp *queryOp, op int
 
 	var result writeCmdResult
 	err = c.Database.run(socket, cmd, &result)
-	debugf("Write command result: %#v (err=%v)", result, err)
+	debugf("Write command result: %#v (err=%v)", logDoc(result), err)
 	ecases := result.BulkErrorCases()
 	lerr = &LastError{
 		UpdatedExisting: result.N > 0 && len(result.Upserted) == 0,
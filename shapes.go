@@ -0,0 +1,362 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ShapeStats holds statistics for the operations of a single query shape.
+type ShapeStats struct {
+	Shape    string        // Normalized shape, as in OpEvent.Shape
+	Count    int64         // Number of operations observed
+	Errors   int64         // Number of failed operations
+	Duration time.Duration // Total time taken by the operations
+	Max      time.Duration // Time taken by the slowest operation
+	Docs     int64         // Number of documents returned
+}
+
+// ShapeOrder defines how QueryShapes.Top ranks query shapes.
+type ShapeOrder int
+
+const (
+	// ShapesByCount ranks shapes by the number of operations observed.
+	ShapesByCount ShapeOrder = iota
+
+	// ShapesByDuration ranks shapes by the total time taken by their
+	// operations, so that cheap but frequent shapes rank alongside
+	// rare but slow ones.
+	ShapesByDuration
+)
+
+// QueryShapes aggregates operations per collection and query shape, so
+// that the most frequent or most expensive shapes may be reported for
+// capacity planning. It's meant to be plugged into a Monitor that has
+// shapes enabled:
+//
+//     shapes := mgo.NewQueryShapes(1000)
+//     mgo.SetMonitor(&mgo.Monitor{
+//         Op:     shapes.Observe,
+//         Shapes: true,
+//     })
+//     ...
+//     for ns, top := range shapes.Top(10, mgo.ShapesByDuration) {
+//         ...
+//     }
+//
+// Operations without a shape, such as getMore operations and most
+// commands, are ignored.
+type QueryShapes struct {
+	m       sync.Mutex
+	max     int
+	shapes  map[string]map[string]*ShapeStats
+	dropped int64
+}
+
+// NewQueryShapes returns a new QueryShapes that tracks up to max distinct
+// shapes per collection. Operations with new shapes observed once that
+// limit is reached are not tracked, and are reported by Dropped instead.
+// A max of zero means no limit.
+func NewQueryShapes(max int) *QueryShapes {
+	return &QueryShapes{max: max, shapes: make(map[string]map[string]*ShapeStats)}
+}
+
+// Observe records the operation described by event.
+func (q *QueryShapes) Observe(event *OpEvent) {
+	if event.Shape == "" {
+		return
+	}
+	ns := event.Database + "." + event.Collection
+	q.m.Lock()
+	defer q.m.Unlock()
+	shapes, ok := q.shapes[ns]
+	if !ok {
+		shapes = make(map[string]*ShapeStats)
+		q.shapes[ns] = shapes
+	}
+	stats, ok := shapes[event.Shape]
+	if !ok {
+		if q.max > 0 && len(shapes) >= q.max {
+			q.dropped++
+			return
+		}
+		stats = &ShapeStats{Shape: event.Shape}
+		shapes[event.Shape] = stats
+	}
+	stats.Count++
+	if event.Err != nil {
+		stats.Errors++
+	}
+	stats.Duration += event.Duration
+	if event.Duration > stats.Max {
+		stats.Max = event.Duration
+	}
+	stats.Docs += int64(event.ReplyDocs)
+}
+
+// Top returns up to n shapes for every collection that had operations
+// observed, keyed by "<database>.<collection>" and ranked according to
+// order. A non-positive n returns all shapes.
+func (q *QueryShapes) Top(n int, order ShapeOrder) map[string][]ShapeStats {
+	q.m.Lock()
+	top := make(map[string][]ShapeStats, len(q.shapes))
+	for ns, shapes := range q.shapes {
+		list := make([]ShapeStats, 0, len(shapes))
+		for _, stats := range shapes {
+			list = append(list, *stats)
+		}
+		top[ns] = list
+	}
+	q.m.Unlock()
+
+	for ns, list := range top {
+		sort.Sort(shapeSlice{list, order})
+		if n > 0 && len(list) > n {
+			top[ns] = list[:n]
+		}
+	}
+	return top
+}
+
+// Dropped returns the number of operations that were not tracked
+// because their collection already had the maximum number of shapes.
+func (q *QueryShapes) Dropped() int64 {
+	q.m.Lock()
+	defer q.m.Unlock()
+	return q.dropped
+}
+
+// Reset discards all observed operations.
+func (q *QueryShapes) Reset() {
+	q.m.Lock()
+	q.shapes = make(map[string]map[string]*ShapeStats)
+	q.dropped = 0
+	q.m.Unlock()
+}
+
+type shapeSlice struct {
+	list  []ShapeStats
+	order ShapeOrder
+}
+
+func (s shapeSlice) Len() int      { return len(s.list) }
+func (s shapeSlice) Swap(i, j int) { s.list[i], s.list[j] = s.list[j], s.list[i] }
+
+func (s shapeSlice) Less(i, j int) bool {
+	a, b := &s.list[i], &s.list[j]
+	switch {
+	case s.order == ShapesByDuration && a.Duration != b.Duration:
+		return a.Duration > b.Duration
+	case a.Count != b.Count:
+		return a.Count > b.Count
+	}
+	return a.Shape < b.Shape
+}
+
+// ---------------------------------------------------------------------------
+// Shape normalization.
+
+// queryShape returns the normalized shape of the query or command in doc,
+// or an empty string if command has no shape. Shapes hold the command
+// name followed by the parts of the operation that matter for planning,
+// with values in filters replaced by "?" so that operations that only
+// differ in the values they look for share the same shape:
+//
+//     find {name: ?, age: {$gt: ?}} sort {age: -1}
+//
+func queryShape(command string, doc []byte) string {
+	var parts bson.RawD
+	if bson.Unmarshal(doc, &parts) != nil {
+		return ""
+	}
+	filter := bson.Raw{0x03, doc}
+	if len(parts) > 0 && parts[0].Name == "$query" && parts[0].Value.Kind == 0x03 {
+		filter = parts[0].Value
+		if command != "query" && bson.Unmarshal(filter.Data, &parts) != nil {
+			return ""
+		}
+	}
+	if command == "query" {
+		// Legacy queries hold the filter itself, or wrap it in $query.
+		parts = append(bson.RawD{{"filter", filter}}, parts...)
+	}
+
+	var fields []shapeField
+	switch command {
+	case "query":
+		fields = []shapeField{{"filter", "", false}, {"$orderby", "sort", true}}
+	case "find":
+		fields = []shapeField{{"filter", "", false}, {"sort", "sort", true}, {"projection", "project", true}}
+	case "count":
+		fields = []shapeField{{"query", "", false}}
+	case "distinct":
+		fields = []shapeField{{"key", "key", true}, {"query", "", false}}
+	case "findAndModify", "findandmodify":
+		fields = []shapeField{{"query", "", false}, {"sort", "sort", true}}
+	case "aggregate":
+		fields = []shapeField{{"pipeline", "", false}}
+	default:
+		return ""
+	}
+
+	w := &shapeWriter{pipeline: command == "aggregate"}
+	w.buf = append(w.buf, command...)
+	for _, field := range fields {
+		for _, part := range parts {
+			if part.Name != field.name {
+				continue
+			}
+			w.buf = append(w.buf, ' ')
+			if field.label != "" {
+				w.buf = append(w.buf, field.label...)
+				w.buf = append(w.buf, ' ')
+			}
+			w.literal = field.literal
+			w.value(part.Value)
+			break
+		}
+	}
+	return string(w.buf)
+}
+
+type shapeField struct {
+	name    string
+	label   string
+	literal bool
+}
+
+// shapeWriter renders BSON values into query shapes. Values are replaced
+// by "?" unless literal is set, in which case they're kept as they are.
+// Aggregation pipelines keep field paths such as "$name", as those are
+// part of their shape.
+type shapeWriter struct {
+	buf      []byte
+	literal  bool
+	pipeline bool
+}
+
+func (w *shapeWriter) value(raw bson.Raw) {
+	switch raw.Kind {
+	case 0x03:
+		w.document(raw.Data, '{', '}', true)
+		return
+	case 0x04:
+		if w.literal || isDocArray(raw.Data) {
+			w.document(raw.Data, '[', ']', false)
+			return
+		}
+	case 0x02:
+		var s string
+		if (w.literal || w.pipeline) && raw.Unmarshal(&s) == nil && (w.literal || strings.HasPrefix(s, "$")) {
+			w.buf = append(w.buf, s...)
+			return
+		}
+	default:
+		var v interface{}
+		if w.literal && raw.Unmarshal(&v) == nil {
+			w.buf = append(w.buf, fmt.Sprint(v)...)
+			return
+		}
+	}
+	w.buf = append(w.buf, '?')
+}
+
+func (w *shapeWriter) document(data []byte, open, close byte, names bool) {
+	var elems bson.RawD
+	if bson.Unmarshal(data, &elems) != nil {
+		w.buf = append(w.buf, '?')
+		return
+	}
+	w.buf = append(w.buf, open)
+	for i, elem := range elems {
+		if i > 0 {
+			w.buf = append(w.buf, ", "...)
+		}
+		if names {
+			w.buf = append(w.buf, elem.Name...)
+			w.buf = append(w.buf, ": "...)
+		}
+		w.value(elem.Value)
+	}
+	w.buf = append(w.buf, close)
+}
+
+// isDocArray returns whether the array in data is not empty and holds
+// documents only, as the arrays of $and and $or operators do.
+func isDocArray(data []byte) bool {
+	var elems bson.RawD
+	if bson.Unmarshal(data, &elems) != nil || len(elems) == 0 {
+		return false
+	}
+	for _, elem := range elems {
+		if elem.Value.Kind != 0x03 {
+			return false
+		}
+	}
+	return true
+}
+
+// ---------------------------------------------------------------------------
+// Server-side query statistics.
+
+// QueryStats returns an iterator over the statistics the server keeps
+// for each query shape, as reported by the $queryStats aggregation stage.
+// The options document, which may be nil, is provided to the stage as-is.
+// The $queryStats stage is only available in MongoDB 7.1+, and requires
+// the queryStatsRead privilege on the cluster.
+//
+// Relevant documentation:
+//
+//     https://www.mongodb.com/docs/manual/reference/operator/aggregation/queryStats/
+//
+func (s *Session) QueryStats(options interface{}) *Iter {
+	if options == nil {
+		options = bson.D{}
+	}
+	cloned := s.nonEventual()
+	defer cloned.Close()
+
+	var result struct{ Cursor cursorData }
+	cmd := bson.D{
+		{"aggregate", 1},
+		{"pipeline", []bson.D{{{"$queryStats", options}}}},
+		{"cursor", bson.D{}},
+	}
+	db := cloned.DB("admin")
+	err := db.Run(cmd, &result)
+	coll := db.C("$cmd.aggregate")
+	if ns := strings.SplitN(result.Cursor.NS, ".", 2); len(ns) == 2 {
+		coll = cloned.DB(ns[0]).C(ns[1])
+	}
+	return coll.NewIter(s, result.Cursor.FirstBatch, result.Cursor.Id, err)
+}
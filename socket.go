@@ -27,10 +27,16 @@
 package mgo
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"net"
+	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"gopkg.in/mgo.v2/bson"
@@ -43,8 +49,9 @@ type mongoSocket struct {
 	server        *mongoServer // nil when cached
 	conn          net.Conn
 	timeout       time.Duration
+	writeTimeout  time.Duration
 	addr          string // For debugging only.
-	nextRequestId uint32
+	nextRequestId uint32 // Accessed atomically.
 	replyFuncs    map[uint32]replyFunc
 	references    int
 	creds         []Credential
@@ -53,6 +60,11 @@ type mongoSocket struct {
 	gotNonce      sync.Cond
 	dead          error
 	serverInfo    *mongoServerInfo
+	idleSince     time.Time // Guarded by the server lock.
+	limits        replyLimits
+	msgChecksums  bool
+	compression   wireCompression
+	compressor    Compressor // Negotiated with the server, if any.
 }
 
 type queryOpFlags uint32
@@ -75,10 +87,14 @@ type queryOp struct {
 	flags      queryOpFlags
 	replyFunc  replyFunc
 
-	mode       Mode
-	options    queryWrapper
-	hasOptions bool
-	serverTags []bson.D
+	mode        Mode
+	options     queryWrapper
+	hasOptions  bool
+	serverTags  []bson.D
+	readConcern interface{}
+
+	afterClusterTime bson.MongoTimestamp
+	clusterTime      bson.Raw
 }
 
 type queryWrapper struct {
@@ -95,23 +111,7 @@ type queryWrapper struct {
 
 func (op *queryOp) finalQuery(socket *mongoSocket) interface{} {
 	if op.flags&flagSlaveOk != 0 && socket.ServerInfo().Mongos {
-		var modeName string
-		switch op.mode {
-		case Strong:
-			modeName = "primary"
-		case Monotonic, Eventual:
-			modeName = "secondaryPreferred"
-		case PrimaryPreferred:
-			modeName = "primaryPreferred"
-		case Secondary:
-			modeName = "secondary"
-		case SecondaryPreferred:
-			modeName = "secondaryPreferred"
-		case Nearest:
-			modeName = "nearest"
-		default:
-			panic(fmt.Sprintf("unsupported read mode: %d", op.mode))
-		}
+		modeName := readPreferenceMode(op.mode)
 		op.hasOptions = true
 		op.options.ReadPreference = make(bson.D, 0, 2)
 		op.options.ReadPreference = append(op.options.ReadPreference, bson.DocElem{"mode", modeName})
@@ -126,12 +126,151 @@ func (op *queryOp) finalQuery(socket *mongoSocket) interface{} {
 		} else {
 			op.options.Query = op.query
 		}
-		debugf("final query is %#v\n", &op.options)
+		debugf("final query is %#v\n", logDoc(&op.options))
 		return &op.options
 	}
 	return op.query
 }
 
+// msgOp is a command sent as an OP_MSG message, which MongoDB 3.6+
+// (wire version 6) accepts in place of commands sent with OP_QUERY.
+// The body goes in a kind 0 section, followed by fields holding the
+// generic command arguments, and each document sequence goes in a
+// kind 1 section of its own.
+type msgOp struct {
+	collection string // "database.$cmd", for monitoring only.
+	flags      uint32
+	body       interface{}
+	fields     bson.D
+	sequences  []msgSequence
+	replyFunc  replyFunc
+}
+
+// msgSequence is a kind 1 section of an OP_MSG message, holding the
+// documents of a command field outside of its body.
+type msgSequence struct {
+	identifier string
+	documents  []interface{}
+}
+
+// msgSequenceFields maps write commands to the field holding their
+// documents, which are sent as a document sequence so that the server
+// doesn't have to parse them as an array in the body.
+var msgSequenceFields = map[string]string{
+	"insert": "documents",
+	"update": "updates",
+	"delete": "deletes",
+}
+
+// msgOp returns op as an OP_MSG message, or nil if op must be sent with
+// OP_QUERY, either because the server doesn't support OP_MSG or because
+// op isn't a command or uses query modifiers that have no equivalent.
+func (op *queryOp) msgOp(socket *mongoSocket) *msgOp {
+	serverInfo := socket.ServerInfo()
+	if serverInfo.MaxWireVersion < 6 || op.query == nil || op.selector != nil || op.limit != -1 {
+		return nil
+	}
+	if !strings.HasSuffix(op.collection, ".$cmd") {
+		return nil
+	}
+	options := op.options
+	if options.OrderBy != nil || options.Hint != nil || options.Explain || options.Snapshot || options.MaxScan != 0 {
+		return nil
+	}
+	msg := &msgOp{
+		collection: op.collection,
+		body:       op.query,
+		replyFunc:  op.replyFunc,
+	}
+	if socket.msgChecksums {
+		msg.flags |= msgFlagChecksumPresent
+	}
+	if cmd, ok := op.query.(bson.D); ok && len(cmd) > 0 {
+		if field, ok := msgSequenceFields[cmd[0].Name]; ok {
+			msg.splitSequence(cmd, field)
+		}
+	}
+	if options.MaxTimeMS > 0 || options.Comment != "" {
+		// These are query modifiers with OP_QUERY, and generic
+		// arguments with OP_MSG unless the command has them already.
+		var args struct {
+			MaxTimeMS interface{} "maxTimeMS"
+			Comment   interface{} "comment"
+		}
+		data, err := bson.Marshal(op.query)
+		if err != nil {
+			return nil
+		}
+		bson.Unmarshal(data, &args)
+		if options.MaxTimeMS > 0 && args.MaxTimeMS == nil {
+			msg.fields = append(msg.fields, bson.DocElem{"maxTimeMS", options.MaxTimeMS})
+		}
+		// Comments are only accepted by all commands as of 4.4.
+		if options.Comment != "" && args.Comment == nil && serverInfo.MaxWireVersion >= 9 {
+			msg.fields = append(msg.fields, bson.DocElem{"comment", options.Comment})
+		}
+	}
+	if op.flags&flagSlaveOk != 0 {
+		// OP_MSG has no slaveOk flag. The read preference tells
+		// secondaries the command may run on them.
+		modeName := readPreferenceMode(op.mode)
+		if modeName == "primary" {
+			modeName = "primaryPreferred"
+		}
+		readPreference := bson.D{{"mode", modeName}}
+		if len(op.serverTags) > 0 {
+			readPreference = append(readPreference, bson.DocElem{"tags", op.serverTags})
+		}
+		msg.fields = append(msg.fields, bson.DocElem{"$readPreference", readPreference})
+	}
+	msg.fields = append(msg.fields, bson.DocElem{"$db", op.collection[:len(op.collection)-5]})
+	return msg
+}
+
+// splitSequence moves the documents in the named field of the write
+// command cmd into a document sequence.
+func (msg *msgOp) splitSequence(cmd bson.D, field string) {
+	for i, elem := range cmd {
+		if elem.Name != field {
+			continue
+		}
+		v := reflect.ValueOf(elem.Value)
+		if v.Kind() != reflect.Slice {
+			return
+		}
+		documents := make([]interface{}, v.Len())
+		for j := range documents {
+			documents[j] = v.Index(j).Interface()
+		}
+		body := make(bson.D, 0, len(cmd)-1)
+		body = append(body, cmd[:i]...)
+		body = append(body, cmd[i+1:]...)
+		msg.body = body
+		msg.sequences = []msgSequence{{field, documents}}
+		return
+	}
+}
+
+// readPreferenceMode returns the name of the read preference mode
+// equivalent to mode.
+func readPreferenceMode(mode Mode) string {
+	switch mode {
+	case Strong:
+		return "primary"
+	case Monotonic, Eventual:
+		return "secondaryPreferred"
+	case PrimaryPreferred:
+		return "primaryPreferred"
+	case Secondary:
+		return "secondary"
+	case SecondaryPreferred:
+		return "secondaryPreferred"
+	case Nearest:
+		return "nearest"
+	}
+	panic(fmt.Sprintf("unsupported read mode: %d", mode))
+}
+
 type getMoreOp struct {
 	collection string
 	limit      int32
@@ -144,6 +283,79 @@ type replyOp struct {
 	cursorId  int64
 	firstDoc  int32
 	replyDocs int32
+	msgFlags  uint32 // Flag bits of OP_MSG replies.
+}
+
+// Flag bits of OP_REPLY messages.
+const (
+	replyCursorNotFound = 1 << 0 // The getMore cursor is gone from the server
+	replyQueryFailure   = 1 << 1 // The single document returned holds an $err
+	replyAwaitCapable   = 1 << 3 // The server supports the AwaitData query flag
+)
+
+// Flag bits of OP_MSG messages.
+const (
+	msgFlagChecksumPresent = 1 << 0
+	msgFlagMoreToCome      = 1 << 1
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var errMsgChecksum = errors.New("OP_MSG checksum mismatch, corrupted data?")
+
+// replyLimits bounds the size of replies accepted from servers.
+type replyLimits struct {
+	maxMessage  int
+	maxDocument int
+}
+
+const (
+	defaultMaxReplySize         = 48 * 1000 * 1000
+	defaultMaxReplyDocumentSize = 16*1024*1024 + 16*1024
+)
+
+// ReplyTooLargeError is returned when a server reply, or a document in
+// it, is larger than allowed by DialInfo.MaxReplySize or
+// DialInfo.MaxReplyDocumentSize.
+type ReplyTooLargeError struct {
+	Size     int
+	Limit    int
+	Document bool // Whether a single document exceeded the limit.
+}
+
+func (e *ReplyTooLargeError) Error() string {
+	if e.Document {
+		return fmt.Sprintf("reply document of %d bytes exceeds the limit of %d bytes", e.Size, e.Limit)
+	}
+	return fmt.Sprintf("reply of %d bytes exceeds the limit of %d bytes", e.Size, e.Limit)
+}
+
+// checkMessage returns an error if a reply of size bytes is not acceptable.
+func (limits replyLimits) checkMessage(size int) error {
+	limit := limits.maxMessage
+	if limit <= 0 {
+		limit = defaultMaxReplySize
+	}
+	if size > limit {
+		return &ReplyTooLargeError{Size: size, Limit: limit}
+	}
+	return nil
+}
+
+// checkDocument returns an error if a document of size bytes is not
+// acceptable in a reply.
+func (limits replyLimits) checkDocument(size int) error {
+	if size < 5 {
+		return fmt.Errorf("bad document size %d, corrupted data?", size)
+	}
+	limit := limits.maxDocument
+	if limit <= 0 {
+		limit = defaultMaxReplyDocumentSize
+	}
+	if size > limit {
+		return &ReplyTooLargeError{Size: size, Limit: limit, Document: true}
+	}
+	return nil
 }
 
 type insertOp struct {
@@ -153,12 +365,13 @@ type insertOp struct {
 }
 
 type updateOp struct {
-	Collection string      `bson:"-"` // "database.collection"
-	Selector   interface{} `bson:"q"`
-	Update     interface{} `bson:"u"`
-	Flags      uint32      `bson:"-"`
-	Multi      bool        `bson:"multi,omitempty"`
-	Upsert     bool        `bson:"upsert,omitempty"`
+	Collection   string        `bson:"-"` // "database.collection"
+	Selector     interface{}   `bson:"q"`
+	Update       interface{}   `bson:"u"`
+	Flags        uint32        `bson:"-"`
+	Multi        bool          `bson:"multi,omitempty"`
+	Upsert       bool          `bson:"upsert,omitempty"`
+	ArrayFilters []interface{} `bson:"arrayFilters,omitempty"`
 }
 
 type deleteOp struct {
@@ -174,15 +387,57 @@ type killCursorsOp struct {
 
 type requestInfo struct {
 	bufferPos int
+	requestId uint32
 	replyFunc replyFunc
+	checksum  bool // Whether the message ends with a CRC-32C checksum.
+}
+
+// queryScratch holds the space used by Query to serialize operations.
+// It is pooled so that queries don't allocate it on every call.
+type queryScratch struct {
+	buf      []byte
+	requests []requestInfo
+}
+
+// maxPooledQueryBuffer is the largest buffer kept around for reuse, so
+// that the occasional large insert doesn't pin its memory indefinitely.
+const maxPooledQueryBuffer = 64 * 1024
+
+var queryScratchPool = sync.Pool{
+	New: func() interface{} {
+		return &queryScratch{buf: make([]byte, 0, 256), requests: make([]requestInfo, 0, 4)}
+	},
+}
+
+func getQueryScratch(ops int) *queryScratch {
+	scratch := queryScratchPool.Get().(*queryScratch)
+	if cap(scratch.requests) < ops {
+		scratch.requests = make([]requestInfo, ops)
+	}
+	scratch.requests = scratch.requests[:ops]
+	return scratch
+}
+
+func putQueryScratch(scratch *queryScratch, buf []byte) {
+	if cap(buf) > maxPooledQueryBuffer {
+		return
+	}
+	for i := range scratch.requests {
+		scratch.requests[i] = requestInfo{}
+	}
+	scratch.buf = buf[:0]
+	queryScratchPool.Put(scratch)
 }
 
 func newSocket(server *mongoServer, conn net.Conn, timeout time.Duration) *mongoSocket {
 	socket := &mongoSocket{
-		conn:       conn,
-		addr:       server.Addr,
-		server:     server,
-		replyFuncs: make(map[uint32]replyFunc),
+		conn:         conn,
+		addr:         server.Addr,
+		server:       server,
+		replyFuncs:   make(map[uint32]replyFunc),
+		limits:       server.limits,
+		msgChecksums: server.msgChecksums,
+		compression:  server.compression,
 	}
 	socket.gotNonce.L = &socket.Mutex
 	if err := socket.InitialAcquire(server.Info(), timeout); err != nil {
@@ -204,6 +459,23 @@ func (socket *mongoSocket) Server() *mongoServer {
 	return server
 }
 
+// Dead returns whether the socket was closed or broke.
+func (socket *mongoSocket) Dead() bool {
+	socket.Lock()
+	dead := socket.dead != nil
+	socket.Unlock()
+	return dead
+}
+
+// InFlight returns the number of operations sent through socket that are
+// still waiting for replies.
+func (socket *mongoSocket) InFlight() int {
+	socket.Lock()
+	n := len(socket.replyFuncs)
+	socket.Unlock()
+	return n
+}
+
 // ServerInfo returns details for the server at the time the socket
 // was initially acquired.
 func (socket *mongoSocket) ServerInfo() *mongoServerInfo {
@@ -229,6 +501,7 @@ func (socket *mongoSocket) InitialAcquire(serverInfo *mongoServerInfo, timeout t
 	socket.references++
 	socket.serverInfo = serverInfo
 	socket.timeout = timeout
+	socket.writeTimeout = 0
 	stats.socketsInUse(+1)
 	stats.socketRefs(+1)
 	socket.Unlock()
@@ -282,6 +555,14 @@ func (socket *mongoSocket) SetTimeout(d time.Duration) {
 	socket.Unlock()
 }
 
+// SetWriteTimeout changes the timeout used on socket writes. Zero uses
+// the timeout set via SetTimeout for writes as well.
+func (socket *mongoSocket) SetWriteTimeout(d time.Duration) {
+	socket.Lock()
+	socket.writeTimeout = d
+	socket.Unlock()
+}
+
 type deadlineType int
 
 const (
@@ -290,9 +571,13 @@ const (
 )
 
 func (socket *mongoSocket) updateDeadline(which deadlineType) {
+	timeout := socket.timeout
+	if which == writeDeadline && socket.writeTimeout > 0 {
+		timeout = socket.writeTimeout
+	}
 	var when time.Time
-	if socket.timeout > 0 {
-		when = time.Now().Add(socket.timeout)
+	if timeout > 0 {
+		when = time.Now().Add(timeout)
 	}
 	whichstr := ""
 	switch which {
@@ -308,7 +593,7 @@ func (socket *mongoSocket) updateDeadline(which deadlineType) {
 	default:
 		panic("invalid parameter to updateDeadline")
 	}
-	debugf("Socket %p to %s: updated %s deadline to %s ahead (%s)", socket, socket.addr, whichstr, socket.timeout, when)
+	debugf("Socket %p to %s: updated %s deadline to %s ahead (%s)", socket, socket.addr, whichstr, timeout, when)
 }
 
 // Close terminates the socket use.
@@ -350,14 +635,16 @@ func (socket *mongoSocket) SimpleQuery(op *queryOp) (data []byte, err error) {
 	wait.Lock()
 	op.replyFunc = func(err error, reply *replyOp, docNum int, docData []byte) {
 		change.Lock()
-		if !replyDone {
-			replyDone = true
-			replyErr = err
-			if err == nil {
-				replyData = docData
-			}
+		defer change.Unlock()
+		if replyDone {
+			// Further replies to the request, as with moreToCome.
+			return
+		}
+		replyDone = true
+		replyErr = err
+		if err == nil {
+			replyData = docData
 		}
-		change.Unlock()
 		wait.Unlock()
 	}
 	err = socket.Query(op)
@@ -378,20 +665,36 @@ func (socket *mongoSocket) Query(ops ...interface{}) (err error) {
 		ops = append(lops, ops...)
 	}
 
-	buf := make([]byte, 0, 256)
+	scratch := getQueryScratch(len(ops))
+	buf := scratch.buf
+	defer func() { putQueryScratch(scratch, buf) }()
+
+	monitor := getMonitor()
+	if monitor != nil && monitor.Op == nil && monitor.SlowOpThreshold == 0 {
+		monitor = nil
+	}
 
 	// Serialize operations synchronously to avoid interrupting
 	// other goroutines while we can't really be sending data.
 	// Also, record id positions so that we can compute request
 	// ids at once later with the lock already held.
-	requests := make([]requestInfo, len(ops))
+	requests := scratch.requests
 	requestCount := 0
 
+	// Set before the socket is handed out, so no locking is needed.
+	compressor := socket.compressor
+	var uncompressed []int // Starts of messages that must not be compressed.
+
 	for _, op := range ops {
-		debugf("Socket %p to %s: serializing op: %#v", socket, socket.addr, op)
+		debugf("Socket %p to %s: serializing op: %#v", socket, socket.addr, logDoc(op))
 		if qop, ok := op.(*queryOp); ok {
 			if cmd, ok := qop.query.(*findCmd); ok {
-				debugf("Socket %p to %s: find command: %#v", socket, socket.addr, cmd)
+				debugf("Socket %p to %s: find command: %#v", socket, socket.addr, logDoc(cmd))
+			}
+		}
+		if qop, ok := op.(*queryOp); ok {
+			if msg := qop.msgOp(socket); msg != nil {
+				op = msg
 			}
 		}
 		start := len(buf)
@@ -403,12 +706,12 @@ func (socket *mongoSocket) Query(ops ...interface{}) (err error) {
 			buf = addInt32(buf, 0) // Reserved
 			buf = addCString(buf, op.Collection)
 			buf = addInt32(buf, int32(op.Flags))
-			debugf("Socket %p to %s: serializing selector document: %#v", socket, socket.addr, op.Selector)
+			debugf("Socket %p to %s: serializing selector document: %#v", socket, socket.addr, logDoc(op.Selector))
 			buf, err = addBSON(buf, op.Selector)
 			if err != nil {
 				return err
 			}
-			debugf("Socket %p to %s: serializing update document: %#v", socket, socket.addr, op.Update)
+			debugf("Socket %p to %s: serializing update document: %#v", socket, socket.addr, logDoc(op.Update))
 			buf, err = addBSON(buf, op.Update)
 			if err != nil {
 				return err
@@ -419,7 +722,7 @@ func (socket *mongoSocket) Query(ops ...interface{}) (err error) {
 			buf = addInt32(buf, int32(op.flags))
 			buf = addCString(buf, op.collection)
 			for _, doc := range op.documents {
-				debugf("Socket %p to %s: serializing document for insertion: %#v", socket, socket.addr, doc)
+				debugf("Socket %p to %s: serializing document for insertion: %#v", socket, socket.addr, logDoc(doc))
 				buf, err = addBSON(buf, doc)
 				if err != nil {
 					return err
@@ -432,17 +735,77 @@ func (socket *mongoSocket) Query(ops ...interface{}) (err error) {
 			buf = addCString(buf, op.collection)
 			buf = addInt32(buf, op.skip)
 			buf = addInt32(buf, op.limit)
+			queryStart := len(buf)
 			buf, err = addBSON(buf, op.finalQuery(socket))
 			if err != nil {
 				return err
 			}
+			if compressor != nil && strings.HasSuffix(op.collection, ".$cmd") && !compressibleCommand(buf[queryStart:]) {
+				uncompressed = append(uncompressed, start)
+			}
+			if monitor != nil && op.replyFunc != nil {
+				event := newOpEvent(socket.addr, op.collection, "query", buf[queryStart:])
+				if monitor.Shapes {
+					event.Shape = queryShape(event.Command, buf[queryStart:])
+				}
+				if monitor.Documents {
+					event.Document = redact(buf[queryStart:])
+				}
+				replyFunc = monitorOp(monitor, event, op.replyFunc)
+			} else {
+				replyFunc = op.replyFunc
+			}
 			if op.selector != nil {
 				buf, err = addBSON(buf, op.selector)
 				if err != nil {
 					return err
 				}
 			}
-			replyFunc = op.replyFunc
+
+		case *msgOp:
+			buf = addHeader(buf, 2013)
+			buf = addInt32(buf, int32(op.flags))
+			buf = append(buf, 0) // Body section
+			bodyStart := len(buf)
+			buf, err = addBSON(buf, op.body)
+			if err == nil {
+				buf, err = appendFields(buf, bodyStart, op.fields)
+			}
+			if err != nil {
+				return err
+			}
+			if compressor != nil && !compressibleCommand(buf[bodyStart:]) {
+				uncompressed = append(uncompressed, start)
+			}
+			if monitor != nil && op.replyFunc != nil {
+				event := newOpEvent(socket.addr, op.collection, "query", buf[bodyStart:])
+				if monitor.Shapes {
+					event.Shape = queryShape(event.Command, buf[bodyStart:])
+				}
+				if monitor.Documents {
+					event.Document = redact(buf[bodyStart:])
+				}
+				replyFunc = monitorOp(monitor, event, op.replyFunc)
+			} else {
+				replyFunc = op.replyFunc
+			}
+			for _, seq := range op.sequences {
+				buf = append(buf, 1) // Document sequence section
+				seqStart := len(buf)
+				buf = addInt32(buf, 0)
+				buf = addCString(buf, seq.identifier)
+				for _, doc := range seq.documents {
+					debugf("Socket %p to %s: serializing document for %s: %#v", socket, socket.addr, seq.identifier, logDoc(doc))
+					buf, err = addBSON(buf, doc)
+					if err != nil {
+						return err
+					}
+				}
+				setInt32(buf, seqStart, int32(len(buf)-seqStart))
+			}
+			if op.flags&msgFlagChecksumPresent != 0 {
+				buf = addInt32(buf, 0) // Set once the request id is known.
+			}
 
 		case *getMoreOp:
 			buf = addHeader(buf, 2005)
@@ -450,14 +813,19 @@ func (socket *mongoSocket) Query(ops ...interface{}) (err error) {
 			buf = addCString(buf, op.collection)
 			buf = addInt32(buf, op.limit)
 			buf = addInt64(buf, op.cursorId)
-			replyFunc = op.replyFunc
+			if monitor != nil && op.replyFunc != nil {
+				event := newOpEvent(socket.addr, op.collection, "getMore", nil)
+				replyFunc = monitorOp(monitor, event, op.replyFunc)
+			} else {
+				replyFunc = op.replyFunc
+			}
 
 		case *deleteOp:
 			buf = addHeader(buf, 2006)
 			buf = addInt32(buf, 0) // Reserved
 			buf = addCString(buf, op.Collection)
 			buf = addInt32(buf, int32(op.Flags))
-			debugf("Socket %p to %s: serializing selector document: %#v", socket, socket.addr, op.Selector)
+			debugf("Socket %p to %s: serializing selector document: %#v", socket, socket.addr, logDoc(op.Selector))
 			buf, err = addBSON(buf, op.Selector)
 			if err != nil {
 				return err
@@ -477,15 +845,44 @@ func (socket *mongoSocket) Query(ops ...interface{}) (err error) {
 
 		setInt32(buf, start, int32(len(buf)-start))
 
+		checksum := false
+		if msg, ok := op.(*msgOp); ok {
+			checksum = msg.flags&msgFlagChecksumPresent != 0
+		}
 		if replyFunc != nil {
 			request := &requests[requestCount]
 			request.replyFunc = replyFunc
 			request.bufferPos = start
+			request.checksum = checksum
 			requestCount++
+		} else if checksum {
+			setMsgChecksum(buf[start:])
+		}
+	}
+
+	// Buffer is ready for the pipe. Allocate and patch in the request
+	// ids before locking, so the lock is only held while enqueuing.
+	if requestCount > 0 {
+		requestId := socket.allocRequestIds(requestCount)
+		for i := 0; i != requestCount; i++ {
+			request := &requests[i]
+			request.requestId = requestId
+			setInt32(buf, request.bufferPos+4, int32(requestId))
+			if request.checksum {
+				pos := request.bufferPos
+				setMsgChecksum(buf[pos : pos+int(getInt32(buf, pos))])
+			}
+			requestId++
 		}
 	}
 
-	// Buffer is ready for the pipe.  Lock, allocate ids, and enqueue.
+	wire := buf
+	if compressor != nil {
+		wire, err = compressMessages(compressor, socket.compression.threshold, buf, uncompressed)
+		if err != nil {
+			return err
+		}
+	}
 
 	socket.Lock()
 	if socket.dead != nil {
@@ -505,50 +902,68 @@ func (socket *mongoSocket) Query(ops ...interface{}) (err error) {
 
 	wasWaiting := len(socket.replyFuncs) > 0
 
-	// Reserve id 0 for requests which should have no responses.
-	requestId := socket.nextRequestId + 1
-	if requestId == 0 {
-		requestId++
-	}
-	socket.nextRequestId = requestId + uint32(requestCount)
 	for i := 0; i != requestCount; i++ {
 		request := &requests[i]
-		setInt32(buf, request.bufferPos+4, int32(requestId))
-		socket.replyFuncs[requestId] = request.replyFunc
-		requestId++
+		socket.replyFuncs[request.requestId] = request.replyFunc
 	}
 
-	debugf("Socket %p to %s: sending %d op(s) (%d bytes)", socket, socket.addr, len(ops), len(buf))
+	debugf("Socket %p to %s: sending %d op(s) (%d bytes)", socket, socket.addr, len(ops), len(wire))
 	stats.sentOps(len(ops))
 
 	socket.updateDeadline(writeDeadline)
-	_, err = socket.conn.Write(buf)
-	if !wasWaiting && requestCount > 0 {
+	_, err = socket.conn.Write(wire)
+	if err != nil {
+		// The error is returned to the caller, so the requests must not
+		// be failed through their replyFuncs as well. These may lock
+		// what the caller holds while querying, as Iter.getMore does.
+		for i := 0; i != requestCount; i++ {
+			delete(socket.replyFuncs, requests[i].requestId)
+		}
+	} else if !wasWaiting && requestCount > 0 {
 		socket.updateDeadline(readDeadline)
 	}
 	socket.Unlock()
+	if err != nil {
+		// The request may have been partially written, which leaves
+		// nothing else to be sent on the connection.
+		socket.kill(err, true)
+	}
 	return err
 }
 
-func fill(r net.Conn, b []byte) error {
-	l := len(b)
-	n, err := r.Read(b)
-	for n != l && err == nil {
-		var ni int
-		ni, err = r.Read(b[n:])
-		n += ni
+// allocRequestIds reserves n > 0 consecutive request ids and returns the
+// first of them. Id 0 is never handed out, as it's reserved for requests
+// which should have no responses.
+func (socket *mongoSocket) allocRequestIds(n int) uint32 {
+	for {
+		last := atomic.AddUint32(&socket.nextRequestId, uint32(n))
+		first := last - uint32(n) + 1
+		if first != 0 && first <= last {
+			return first
+		}
 	}
+}
+
+// fill reads exactly len(b) bytes from r into b. Running out of data
+// midway fails with io.ErrUnexpectedEOF.
+func fill(r io.Reader, b []byte) error {
+	_, err := io.ReadFull(r, b)
 	return err
 }
 
-// Estimated minimum cost per socket: 1 goroutine + memory for the largest
-// document ever seen.
+// readBufferSize is the size of the buffer readLoop reads replies
+// through, so that headers and small documents are read together
+// rather than with a system call each.
+const readBufferSize = 16 * 1024
+
+// Estimated minimum cost per socket: 1 goroutine + the read buffer +
+// memory for the largest document ever seen.
 func (socket *mongoSocket) readLoop() {
 	p := make([]byte, 36) // 16 from header + 20 from OP_REPLY fixed fields
 	s := make([]byte, 4)
-	conn := socket.conn // No locking, conn never changes.
+	conn := bufio.NewReaderSize(socket.conn, readBufferSize) // No locking, conn never changes.
 	for {
-		err := fill(conn, p)
+		err := fill(conn, p[:16])
 		if err != nil {
 			socket.kill(err, true)
 			return
@@ -562,10 +977,41 @@ func (socket *mongoSocket) readLoop() {
 		// locked and socket.server may go away.
 		debugf("Socket %p to %s: got reply (%d bytes)", socket, socket.addr, totalLen)
 
-		_ = totalLen
+		if err = socket.limits.checkMessage(int(totalLen)); err != nil {
+			socket.kill(err, true)
+			return
+		}
+
+		// Compressed replies are read from their decompressed form,
+		// with the header patched to describe it.
+		var r io.Reader = conn
+		if opCode == 2012 {
+			r, err = socket.decompressMessage(conn, p[:16])
+			if err != nil {
+				socket.kill(err, true)
+				return
+			}
+			opCode = getInt32(p, 12)
+		}
 
-		if opCode != 1 {
-			socket.kill(errors.New("opcode != 1, corrupted data?"), true)
+		switch opCode {
+		case 1:
+			if getInt32(p, 0) < 36 {
+				err = fmt.Errorf("bad OP_REPLY length %d, corrupted data?", getInt32(p, 0))
+				break
+			}
+			err = fill(r, p[16:])
+		case 2013:
+			err = socket.readMsg(r, p[:16])
+			if err == nil {
+				socket.resetReadDeadline()
+				continue
+			}
+		default:
+			err = fmt.Errorf("unexpected opcode %d, corrupted data?", opCode)
+		}
+		if err != nil {
+			socket.kill(err, true)
 			return
 		}
 
@@ -586,11 +1032,18 @@ func (socket *mongoSocket) readLoop() {
 		}
 		socket.Unlock()
 
+		// Bytes of the message left for documents.
+		left := int(getInt32(p, 0)) - 36
+
 		if replyFunc != nil && reply.replyDocs == 0 {
-			replyFunc(nil, &reply, -1, nil)
+			if reply.flags&replyCursorNotFound != 0 {
+				replyFunc(ErrCursor, &reply, -1, nil)
+			} else {
+				replyFunc(nil, &reply, -1, nil)
+			}
 		} else {
 			for i := 0; i != int(reply.replyDocs); i++ {
-				err := fill(conn, s)
+				err := fill(r, s)
 				if err != nil {
 					if replyFunc != nil {
 						replyFunc(err, nil, -1, nil)
@@ -599,7 +1052,20 @@ func (socket *mongoSocket) readLoop() {
 					return
 				}
 
-				b := make([]byte, int(getInt32(s, 0)))
+				size := int(getInt32(s, 0))
+				err = socket.limits.checkDocument(size)
+				if err == nil && size > left {
+					err = errors.New("reply document exceeds the message length, corrupted data?")
+				}
+				left -= size
+				if err != nil {
+					if replyFunc != nil {
+						replyFunc(err, nil, -1, nil)
+					}
+					socket.kill(err, true)
+					return
+				}
+				b := make([]byte, size)
 
 				// copy(b, s) in an efficient way.
 				b[0] = s[0]
@@ -607,7 +1073,7 @@ func (socket *mongoSocket) readLoop() {
 				b[2] = s[2]
 				b[3] = s[3]
 
-				err = fill(conn, b[4:])
+				err = fill(r, b[4:])
 				if err != nil {
 					if replyFunc != nil {
 						replyFunc(err, nil, -1, nil)
@@ -619,29 +1085,153 @@ func (socket *mongoSocket) readLoop() {
 				if globalDebug && globalLogger != nil {
 					m := bson.M{}
 					if err := bson.Unmarshal(b, m); err == nil {
-						debugf("Socket %p to %s: received document: %#v", socket, socket.addr, m)
+						debugf("Socket %p to %s: received document: %#v", socket, socket.addr, logDoc(m))
 					}
 				}
 
-				if replyFunc != nil {
+				if replyFunc != nil && reply.flags&replyQueryFailure != 0 {
+					// Don't hand the $err document over as if it were data.
+					replyFunc(queryFailure(b), &reply, -1, nil)
+					replyFunc = nil
+				} else if replyFunc != nil {
 					replyFunc(nil, &reply, i, b)
 				}
+			}
+		}
+		if left != 0 {
+			socket.kill(errors.New("reply documents don't match the message length, corrupted data?"), true)
+			return
+		}
+
+		socket.resetReadDeadline()
+	}
+}
+
+// queryFailure returns the error reported by the document of a reply
+// flagged with QueryFailure.
+func queryFailure(doc []byte) error {
+	if err := checkQueryError("", doc); err != nil {
+		return err
+	}
+	return &QueryError{Message: "query failure"}
+}
+
+// resetReadDeadline disables the read deadline if no more replies are
+// expected, and renews it otherwise.
+func (socket *mongoSocket) resetReadDeadline() {
+	socket.Lock()
+	if len(socket.replyFuncs) == 0 {
+		// Nothing else to read for now. Disable deadline.
+		socket.conn.SetReadDeadline(time.Time{})
+	} else {
+		socket.updateDeadline(readDeadline)
+	}
+	socket.Unlock()
+}
+
+// readMsg reads the rest of an OP_MSG reply whose header was already read,
+// and hands its body document to the replyFunc registered for the request
+// it responds to. Replies flagged with moreToCome leave the replyFunc
+// registered, as further replies to the same request follow, as happens
+// with exhaust cursors.
+func (socket *mongoSocket) readMsg(r io.Reader, header []byte) error {
+	totalLen := getInt32(header, 0)
+	responseTo := getInt32(header, 8)
+
+	// Header, flag bits, and at least one section with an empty document.
+	if totalLen < 16+4+1+5 {
+		return fmt.Errorf("bad OP_MSG length %d, corrupted data?", totalLen)
+	}
+	b := make([]byte, int(totalLen)-16)
+	if err := fill(r, b); err != nil {
+		return err
+	}
+	flags := uint32(getInt32(b, 0))
+	end := len(b)
+	if flags&msgFlagChecksumPresent != 0 {
+		end -= 4
+		crc := crc32.Update(crc32.Checksum(header, castagnoli), castagnoli, b[:end])
+		if crc != uint32(getInt32(b, end)) {
+			return errMsgChecksum
+		}
+	}
 
-				// XXX Do bound checking against totalLen.
+	var body []byte
+	for i := 4; i < end; {
+		kind := b[i]
+		i++
+		if i+4 > end {
+			return errors.New("truncated OP_MSG section, corrupted data?")
+		}
+		size := int(getInt32(b, i))
+		if size < 4 || i+size > end {
+			return errors.New("bad OP_MSG section size, corrupted data?")
+		}
+		switch kind {
+		case 0:
+			if err := socket.limits.checkDocument(size); err != nil {
+				return err
 			}
+			body = b[i : i+size]
+		case 1:
+			// Document sequences aren't used in replies.
+		default:
+			return fmt.Errorf("unknown OP_MSG section kind %d, corrupted data?", kind)
 		}
+		i += size
+	}
+	if body == nil {
+		return errors.New("OP_MSG reply without a body, corrupted data?")
+	}
 
-		socket.Lock()
-		if len(socket.replyFuncs) == 0 {
-			// Nothing else to read for now. Disable deadline.
-			socket.conn.SetReadDeadline(time.Time{})
-		} else {
-			socket.updateDeadline(readDeadline)
+	stats.receivedOps(+1)
+	stats.receivedDocs(1)
+
+	socket.Lock()
+	replyFunc, ok := socket.replyFuncs[uint32(responseTo)]
+	if ok && flags&msgFlagMoreToCome == 0 {
+		delete(socket.replyFuncs, uint32(responseTo))
+	}
+	socket.Unlock()
+
+	if globalDebug && globalLogger != nil {
+		m := bson.M{}
+		if err := bson.Unmarshal(body, m); err == nil {
+			debugf("Socket %p to %s: received document: %#v (flags=%#x)", socket, socket.addr, logDoc(m), flags)
 		}
-		socket.Unlock()
+	}
+
+	if replyFunc != nil {
+		replyFunc(nil, &replyOp{replyDocs: 1, msgFlags: flags}, 0, body)
+	}
+	return nil
+}
 
-		// XXX Do bound checking against totalLen.
+// setMsgChecksum sets the CRC-32C checksum in the last four bytes of
+// the OP_MSG message msg, covering the rest of it.
+func setMsgChecksum(msg []byte) {
+	end := len(msg) - 4
+	setInt32(msg, end, int32(crc32.Checksum(msg[:end], castagnoli)))
+}
+
+// appendFields appends the elements of fields to the document that
+// starts at docStart and ends the buffer b.
+func appendFields(b []byte, docStart int, fields bson.D) ([]byte, error) {
+	if len(fields) == 0 {
+		return b, nil
 	}
+	// Marshal the fields as a document right after the one they're
+	// appended to, and move its elements over the terminator of the
+	// latter.
+	end := len(b) - 1
+	b, err := bson.MarshalAppend(b, fields)
+	if err != nil {
+		return nil, err
+	}
+	n := copy(b[end:], b[end+1+4:len(b)-1])
+	b = append(b[:end+n], 0)
+	setInt32(b, docStart, int32(len(b)-docStart))
+	return b, nil
 }
 
 var emptyHeader = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
@@ -674,11 +1264,7 @@ func addBSON(b []byte, doc interface{}) ([]byte, error) {
 	if doc == nil {
 		return append(b, 5, 0, 0, 0, 0), nil
 	}
-	data, err := bson.Marshal(doc)
-	if err != nil {
-		return b, err
-	}
-	return append(b, data...), nil
+	return bson.MarshalAppend(b, doc)
 }
 
 func setInt32(b []byte, pos int, i int32) {
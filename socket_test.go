@@ -0,0 +1,665 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2012 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type SockS struct{}
+
+var _ = Suite(&SockS{})
+
+// discardConn is a connection that accepts and drops all writes.
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (discardConn) SetDeadline(t time.Time) error      { return nil }
+func (discardConn) SetReadDeadline(t time.Time) error  { return nil }
+func (discardConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func benchmarkQueryInsert(c *C, docs int) {
+	socket := &mongoSocket{
+		conn:       discardConn{},
+		addr:       "discard",
+		replyFuncs: make(map[uint32]replyFunc),
+		serverInfo: &mongoServerInfo{},
+	}
+	op := &insertOp{collection: "mydb.mycoll"}
+	for i := 0; i < docs; i++ {
+		op.documents = append(op.documents, bson.D{{"_id", i}, {"name", "a short string"}, {"n", 1.5}})
+	}
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		if err := socket.Query(op); err != nil {
+			c.Fatal(err)
+		}
+	}
+}
+
+func (s *SockS) BenchmarkQueryInsert(c *C) {
+	benchmarkQueryInsert(c, 1)
+}
+
+func (s *SockS) BenchmarkQueryInsertBatch(c *C) {
+	benchmarkQueryInsert(c, 1000)
+}
+
+// startFakeServer starts a server on a random local port which answers
+// every request read from its connections with the messages returned by
+// reply for the request id and the whole request message. Nonce requests issued by the
+// driver when connecting are answered by the server itself.
+func startFakeServer(c *C, reply func(requestId int32, msg []byte) [][]byte) (addr string, stop func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				header := make([]byte, 16)
+				for {
+					if _, err := io.ReadFull(conn, header); err != nil {
+						return
+					}
+					rest := make([]byte, binary.LittleEndian.Uint32(header)-16)
+					if _, err := io.ReadFull(conn, rest); err != nil {
+						return
+					}
+					requestId := int32(binary.LittleEndian.Uint32(header[4:]))
+					if bytes.Contains(rest, []byte("getnonce")) {
+						conn.Write(fakeMsg(requestId, 0, msgBody(c, bson.M{"ok": 1, "nonce": "abcd"})))
+						continue
+					}
+					for _, msg := range reply(requestId, append(header, rest...)) {
+						conn.Write(msg)
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+// fakeMsg returns an OP_MSG reply to responseTo with the given flag bits
+// and sections, each made of a kind byte followed by its payload.
+func fakeMsg(responseTo int32, flags uint32, sections ...[]byte) []byte {
+	msg := make([]byte, 20)
+	binary.LittleEndian.PutUint32(msg[8:], uint32(responseTo))
+	binary.LittleEndian.PutUint32(msg[12:], 2013)
+	binary.LittleEndian.PutUint32(msg[16:], flags)
+	for _, section := range sections {
+		msg = append(msg, section...)
+	}
+	binary.LittleEndian.PutUint32(msg, uint32(len(msg)))
+	return msg
+}
+
+func msgBody(c *C, doc interface{}) []byte {
+	data, err := bson.Marshal(doc)
+	c.Assert(err, IsNil)
+	return append([]byte{0}, data...)
+}
+
+func (s *SockS) TestDirectConnMsgReply(c *C) {
+	requests := 0
+	addr, stop := startFakeServer(c, func(requestId int32, msg []byte) [][]byte {
+		requests++
+		switch requests {
+		case 1:
+			// Further replies are flagged with moreToCome.
+			return [][]byte{
+				fakeMsg(requestId, 2, msgBody(c, bson.M{"ok": 1, "n": 1})),
+				fakeMsg(requestId, 2, msgBody(c, bson.M{"ok": 1, "n": 2})),
+				fakeMsg(requestId, 0, msgBody(c, bson.M{"ok": 1, "n": 3})),
+			}
+		case 2:
+			// Document sequences are skipped.
+			seq := append([]byte{1, 9, 0, 0, 0}, "docs\x00"...)
+			return [][]byte{fakeMsg(requestId, 0, seq, msgBody(c, bson.M{"ok": 1, "n": 4}))}
+		}
+		return [][]byte{fakeMsg(requestId, 0, []byte{5, 5, 0, 0, 0, 0})}
+	})
+	defer stop()
+
+	conn, err := DialDirect(addr, 5*time.Second)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	var result struct{ N int }
+	err = conn.Run("admin", "ping", &result)
+	c.Assert(err, IsNil)
+	c.Assert(result.N, Equals, 1)
+
+	// The stream was fully consumed before the following reply.
+	err = conn.Run("admin", "ping", &result)
+	c.Assert(err, IsNil)
+	c.Assert(result.N, Equals, 4)
+
+	err = conn.Run("admin", "ping", &result)
+	c.Assert(err, ErrorMatches, "unknown OP_MSG section kind 5, corrupted data\\?")
+}
+
+// checksummed adds a CRC-32C checksum to the OP_MSG message msg.
+func checksummed(msg []byte) []byte {
+	msg = append(msg, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(msg, uint32(len(msg)))
+	msg[16] |= 1
+	crc := crc32.Checksum(msg[:len(msg)-4], crc32.MakeTable(crc32.Castagnoli))
+	binary.LittleEndian.PutUint32(msg[len(msg)-4:], crc)
+	return msg
+}
+
+func (s *SockS) TestDirectConnMsgChecksum(c *C) {
+	requests := 0
+	addr, stop := startFakeServer(c, func(requestId int32, msg []byte) [][]byte {
+		requests++
+		reply := checksummed(fakeMsg(requestId, 0, msgBody(c, bson.M{"ok": 1, "n": requests})))
+		if requests == 2 {
+			reply[len(reply)-5] ^= 0xff
+		}
+		return [][]byte{reply}
+	})
+	defer stop()
+
+	conn, err := DialDirect(addr, 5*time.Second)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	var result struct{ N int }
+	err = conn.Run("admin", "ping", &result)
+	c.Assert(err, IsNil)
+	c.Assert(result.N, Equals, 1)
+
+	err = conn.Run("admin", "ping", &result)
+	c.Assert(err, ErrorMatches, "OP_MSG checksum mismatch, corrupted data\\?")
+}
+
+func (s *SockS) TestReplyLimits(c *C) {
+	addr, stop := startFakeServer(c, func(requestId int32, msg []byte) [][]byte {
+		reply := bson.M{"ok": 1, "ismaster": true, "maxWireVersion": 2}
+		if bytes.Contains(msg, []byte("bigreply")) {
+			reply["data"] = strings.Repeat("x", 1024)
+		}
+		return [][]byte{fakeMsg(requestId, 0, msgBody(c, reply))}
+	})
+	defer stop()
+
+	for _, test := range []struct {
+		info  DialInfo
+		error string
+	}{
+		{DialInfo{MaxReplyDocumentSize: 512}, "reply document of 10[0-9]{2} bytes exceeds the limit of 512 bytes"},
+		{DialInfo{MaxReplySize: 1000}, "reply of 1[0-9]{3} bytes exceeds the limit of 1000 bytes"},
+		{DialInfo{}, ""},
+	} {
+		info := test.info
+		info.Addrs = []string{addr}
+		info.Direct = true
+		info.Timeout = 5 * time.Second
+		session, err := DialWithInfo(&info)
+		c.Assert(err, IsNil)
+
+		err = session.Run("bigreply", nil)
+		if test.error == "" {
+			c.Assert(err, IsNil)
+		} else {
+			c.Assert(err, ErrorMatches, test.error)
+			_, ok := err.(*ReplyTooLargeError)
+			c.Assert(ok, Equals, true)
+		}
+
+		// Smaller replies are still fine, over new connections.
+		session.Refresh()
+		c.Assert(session.Ping(), IsNil)
+		session.Close()
+	}
+}
+
+// msgSections returns the sections of the OP_MSG request msg, keyed by
+// their kind and sequence identifier. The checksum is verified if present.
+func msgSections(c *C, msg []byte) map[string][]bson.M {
+	c.Assert(binary.LittleEndian.Uint32(msg[12:]), Equals, uint32(2013))
+	flags := binary.LittleEndian.Uint32(msg[16:])
+	end := len(msg)
+	if flags&1 != 0 {
+		end -= 4
+		crc := crc32.Checksum(msg[:end], crc32.MakeTable(crc32.Castagnoli))
+		c.Assert(binary.LittleEndian.Uint32(msg[end:]), Equals, crc)
+	}
+	sections := make(map[string][]bson.M)
+	for i := 20; i < end; {
+		kind := msg[i]
+		size := int(binary.LittleEndian.Uint32(msg[i+1:]))
+		if kind == 0 {
+			var doc bson.M
+			c.Assert(bson.Unmarshal(msg[i+1:i+1+size], &doc), IsNil)
+			sections["body"] = []bson.M{doc}
+		} else {
+			c.Assert(kind, Equals, byte(1))
+			seq := msg[i+5 : i+1+size]
+			id := string(seq[:bytes.IndexByte(seq, 0)])
+			for seq = seq[len(id)+1:]; len(seq) > 0; {
+				n := int(binary.LittleEndian.Uint32(seq))
+				var doc bson.M
+				c.Assert(bson.Unmarshal(seq[:n], &doc), IsNil)
+				sections[id] = append(sections[id], doc)
+				seq = seq[n:]
+			}
+		}
+		i += 1 + size
+	}
+	return sections
+}
+
+func (s *SockS) TestMsgOp(c *C) {
+	var m sync.Mutex
+	var requests [][]byte
+	addr, stop := startFakeServer(c, func(requestId int32, msg []byte) [][]byte {
+		reply := bson.M{"ok": 1, "ismaster": true, "maxWireVersion": 6}
+		if bytes.Contains(msg, []byte("mydb")) {
+			m.Lock()
+			requests = append(requests, msg)
+			m.Unlock()
+			reply = bson.M{"ok": 1, "n": 2}
+		}
+		return [][]byte{fakeMsg(requestId, 0, msgBody(c, reply))}
+	})
+	defer stop()
+
+	info := &DialInfo{Addrs: []string{addr}, Direct: true, Timeout: 5 * time.Second, MsgChecksums: true}
+	dialed, err := DialWithInfo(info)
+	c.Assert(err, IsNil)
+	defer dialed.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	session := dialed.WithContext(ctx)
+	defer session.Close()
+	session.SetMode(Monotonic, true)
+
+	err = session.DB("mydb").Run(bson.D{{"ping", 1}}, nil)
+	c.Assert(err, IsNil)
+	err = session.DB("mydb").C("mycoll").Insert(bson.M{"a": 1}, bson.M{"a": 2})
+	c.Assert(err, IsNil)
+
+	m.Lock()
+	defer m.Unlock()
+	c.Assert(requests, HasLen, 2)
+
+	sections := msgSections(c, requests[0])
+	maxTimeMS, _ := sections["body"][0]["maxTimeMS"].(int)
+	c.Assert(maxTimeMS > 0 && maxTimeMS <= 60000, Equals, true)
+	delete(sections["body"][0], "maxTimeMS")
+	c.Assert(sections, DeepEquals, map[string][]bson.M{"body": {{
+		"ping":            1,
+		"$readPreference": bson.M{"mode": "secondaryPreferred"},
+		"$db":             "mydb",
+	}}})
+
+	sections = msgSections(c, requests[1])
+	c.Assert(sections["documents"], DeepEquals, []bson.M{{"a": 1}, {"a": 2}})
+	body := sections["body"][0]
+	c.Assert(body["insert"], Equals, "mycoll")
+	c.Assert(body["$db"], Equals, "mydb")
+	c.Assert(body["documents"], IsNil)
+}
+
+// compressed returns msg as an OP_COMPRESSED message compressed with zlib.
+func compressed(c *C, msg []byte) []byte {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	_, err := w.Write(msg[16:])
+	c.Assert(err, IsNil)
+	c.Assert(w.Close(), IsNil)
+	out := append([]byte(nil), msg[:16]...)
+	binary.LittleEndian.PutUint32(out[12:], 2012)
+	out = append(out, msg[12:16]...)
+	out = append(out, 0, 0, 0, 0, 2)
+	binary.LittleEndian.PutUint32(out[20:], uint32(len(msg)-16))
+	out = append(out, buf.Bytes()...)
+	binary.LittleEndian.PutUint32(out, uint32(len(out)))
+	return out
+}
+
+func (s *SockS) TestCompression(c *C) {
+	var m sync.Mutex
+	compressedCmds := make(map[string]bool)
+	addr, stop := startFakeServer(c, func(requestId int32, msg []byte) [][]byte {
+		wasCompressed := binary.LittleEndian.Uint32(msg[12:]) == 2012
+		if wasCompressed {
+			c.Assert(msg[24], Equals, byte(2))
+			r, err := zlib.NewReader(bytes.NewReader(msg[25:]))
+			c.Assert(err, IsNil)
+			body, err := ioutil.ReadAll(r)
+			c.Assert(err, IsNil)
+			c.Assert(body, HasLen, int(binary.LittleEndian.Uint32(msg[20:])))
+			msg = append(append(msg[:12:12], msg[16:20]...), body...)
+		}
+		var cmd bson.M
+		if binary.LittleEndian.Uint32(msg[12:]) == 2004 {
+			// Legacy OP_QUERY, sent before the server version is known.
+			doc := msg[20+bytes.IndexByte(msg[20:], 0)+9:]
+			c.Assert(bson.Unmarshal(doc[:binary.LittleEndian.Uint32(doc)], &cmd), IsNil)
+		} else {
+			cmd = msgSections(c, msg)["body"][0]
+		}
+		for name := range cmd {
+			if name == "ismaster" || name == "isMaster" || name == "bigcmd" || name == "ping" {
+				m.Lock()
+				compressedCmds[name] = wasCompressed
+				m.Unlock()
+			}
+		}
+		reply := bson.M{"ok": 1, "ismaster": true, "maxWireVersion": 6}
+		if cmd["compression"] != nil {
+			reply["compression"] = []string{"zlib"}
+		}
+		if cmd["bigcmd"] != nil {
+			reply["data"] = strings.Repeat("y", 2048)
+			return [][]byte{compressed(c, fakeMsg(requestId, 0, msgBody(c, reply)))}
+		}
+		return [][]byte{fakeMsg(requestId, 0, msgBody(c, reply))}
+	})
+	defer stop()
+
+	info := &DialInfo{
+		Addrs:                []string{addr},
+		Direct:               true,
+		Timeout:              5 * time.Second,
+		Compressors:          []string{"zlib"},
+		CompressionThreshold: 512,
+	}
+	session, err := DialWithInfo(info)
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	var result struct{ Data string }
+	err = session.Run(bson.D{{"bigcmd", 1}, {"data", strings.Repeat("x", 1024)}}, &result)
+	c.Assert(err, IsNil)
+	c.Assert(result.Data, HasLen, 2048)
+	c.Assert(session.Run("ping", nil), IsNil)
+
+	m.Lock()
+	defer m.Unlock()
+	c.Assert(compressedCmds, DeepEquals, map[string]bool{"isMaster": false, "ismaster": false, "bigcmd": true, "ping": false})
+
+	info.Compressors = []string{"zlib", "snappy"}
+	_, err = DialWithInfo(info)
+	c.Assert(err, ErrorMatches, "unknown compressor: snappy")
+}
+
+// fakeReply returns an OP_REPLY to responseTo holding docs, with the
+// message length adjusted by delta.
+func fakeReply(c *C, responseTo int32, delta int, docs ...interface{}) []byte {
+	msg := make([]byte, 36)
+	binary.LittleEndian.PutUint32(msg[8:], uint32(responseTo))
+	binary.LittleEndian.PutUint32(msg[12:], 1)
+	binary.LittleEndian.PutUint32(msg[32:], uint32(len(docs)))
+	for _, doc := range docs {
+		data, err := bson.Marshal(doc)
+		c.Assert(err, IsNil)
+		msg = append(msg, data...)
+	}
+	binary.LittleEndian.PutUint32(msg, uint32(len(msg)+delta))
+	return msg
+}
+
+func (s *SockS) TestReplyLengthMismatch(c *C) {
+	addr, stop := startFakeServer(c, func(requestId int32, msg []byte) [][]byte {
+		reply := bson.M{"ok": 1, "ismaster": true, "maxWireVersion": 2}
+		switch {
+		case bytes.Contains(msg, []byte("short")):
+			return [][]byte{fakeReply(c, requestId, -4, reply)}
+		case bytes.Contains(msg, []byte("long")):
+			return [][]byte{fakeReply(c, requestId, 4, reply), make([]byte, 4)}
+		case bytes.Contains(msg, []byte("tiny")):
+			return [][]byte{fakeReply(c, requestId, -10)}
+		}
+		return [][]byte{fakeReply(c, requestId, 0, reply)}
+	})
+	defer stop()
+
+	session, err := DialWithInfo(&DialInfo{Addrs: []string{addr}, Direct: true, Timeout: 5 * time.Second})
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	// Broken replies kill the connection, and fail the request if
+	// still possible, without affecting further requests.
+	err = session.Run("short", nil)
+	c.Assert(err, ErrorMatches, "reply document exceeds the message length, corrupted data\\?")
+	session.Refresh()
+	err = session.Run("long", nil)
+	c.Assert(err, IsNil)
+	session.Refresh()
+	err = session.Run("tiny", nil)
+	c.Assert(err, ErrorMatches, "bad OP_REPLY length 26, corrupted data\\?")
+	session.Refresh()
+	c.Assert(session.Ping(), IsNil)
+}
+
+func (s *SockS) TestBuildIndexLegacy(c *C) {
+	var m sync.Mutex
+	var inserted bool
+	addr, stop := startFakeServer(c, func(requestId int32, msg []byte) [][]byte {
+		reply := bson.M{"ok": 1, "ismaster": true, "maxWireVersion": 2}
+		switch {
+		case bytes.Contains(msg, []byte("createIndexes")):
+			reply = bson.M{"ok": 0, "code": 59, "errmsg": "no such cmd: createIndexes"}
+		case bytes.Contains(msg, []byte("system.indexes")):
+			m.Lock()
+			inserted = true
+			m.Unlock()
+			reply = bson.M{"ok": 1, "n": 1}
+		}
+		return [][]byte{fakeReply(c, requestId, 0, reply)}
+	})
+	defer stop()
+
+	session, err := DialWithInfo(&DialInfo{Addrs: []string{addr}, Direct: true, Timeout: 5 * time.Second})
+	c.Assert(err, IsNil)
+	defer session.Close()
+	coll := session.DB("mydb").C("mycoll")
+
+	index := Index{Key: []string{"name"}, Collation: &Collation{Locale: "en"}}
+	err = coll.BuildIndex(index, nil)
+	c.Assert(err, Equals, ErrCollation)
+
+	// Servers without createIndexes get the index inserted instead.
+	err = coll.BuildIndex(Index{Key: []string{"name"}}, nil)
+	c.Assert(err, IsNil)
+	m.Lock()
+	c.Assert(inserted, Equals, true)
+	m.Unlock()
+}
+
+func (s *SockS) TestWriteTimeout(c *C) {
+	stalled := make(chan bool)
+	defer close(stalled)
+	addr, stop := startFakeServer(c, func(requestId int32, msg []byte) [][]byte {
+		if bytes.Contains(msg, []byte("stall")) {
+			// Stop reading requests, so that writes back up.
+			<-stalled
+		}
+		return [][]byte{fakeReply(c, requestId, 0, bson.M{"ok": 1, "ismaster": true, "maxWireVersion": 2})}
+	})
+	defer stop()
+
+	session, err := DialWithInfo(&DialInfo{Addrs: []string{addr}, Direct: true, Timeout: 5 * time.Second})
+	c.Assert(err, IsNil)
+	defer session.Close()
+	session.SetSocketTimeout(time.Minute)
+	session.SetWriteTimeout(100 * time.Millisecond)
+
+	stallErr := make(chan error, 1)
+	go func() {
+		stallErr <- session.Run("stall", nil)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Unacknowledged writes fail only once the socket buffers are full.
+	start := time.Now()
+	session.SetSafe(nil)
+	data := strings.Repeat("x", 8*1024*1024)
+	for i := 0; i < 100 && err == nil; i++ {
+		err = session.DB("mydb").C("mycoll").Insert(bson.M{"data": data})
+	}
+	c.Assert(err, ErrorMatches, ".*i/o timeout")
+	c.Assert(<-stallErr, ErrorMatches, ".*i/o timeout")
+	c.Assert(time.Since(start) < 10*time.Second, Equals, true)
+}
+
+func (s *SockS) TestReplyFragmented(c *C) {
+	addr, stop := startFakeServer(c, func(requestId int32, msg []byte) [][]byte {
+		reply := fakeReply(c, requestId, 0, bson.M{"ok": 1, "ismaster": true, "maxWireVersion": 2}, bson.M{"n": 2})
+		// Send the reply a byte at a time.
+		var parts [][]byte
+		for i := range reply {
+			parts = append(parts, reply[i:i+1])
+		}
+		return parts
+	})
+	defer stop()
+
+	session, err := DialWithInfo(&DialInfo{Addrs: []string{addr}, Direct: true, Timeout: 5 * time.Second})
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	var result struct{ Ok int }
+	err = session.Run("ping", &result)
+	c.Assert(err, IsNil)
+	c.Assert(result.Ok, Equals, 1)
+}
+
+// stallConn fails all writes with a timeout once stalled is set.
+type stallConn struct {
+	net.Conn
+	stalled *int32
+}
+
+func (conn stallConn) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(conn.stalled) != 0 {
+		return 0, &net.OpError{Op: "write", Net: "tcp", Err: errors.New("i/o timeout")}
+	}
+	return conn.Conn.Write(b)
+}
+
+func (s *SockS) TestGetMoreWriteTimeout(c *C) {
+	addr, stop := startFakeServer(c, func(requestId int32, msg []byte) [][]byte {
+		if bytes.Contains(msg, []byte("mydb.mycoll")) {
+			reply := fakeReply(c, requestId, 0, bson.M{"n": 1})
+			binary.LittleEndian.PutUint64(reply[20:], 42) // Cursor id.
+			return [][]byte{reply}
+		}
+		return [][]byte{fakeReply(c, requestId, 0, bson.M{"ok": 1, "ismaster": true, "maxWireVersion": 2})}
+	})
+	defer stop()
+
+	var stalled int32
+	info := &DialInfo{
+		Addrs:   []string{addr},
+		Direct:  true,
+		Timeout: 5 * time.Second,
+		DialServer: func(addr *ServerAddr) (net.Conn, error) {
+			conn, err := net.DialTCP("tcp", nil, addr.TCPAddr())
+			if err != nil {
+				return nil, err
+			}
+			return stallConn{conn, &stalled}, nil
+		},
+	}
+	session, err := DialWithInfo(info)
+	c.Assert(err, IsNil)
+	defer session.Close()
+	session.SetPrefetch(0)
+
+	iter := session.DB("mydb").C("mycoll").Find(nil).Batch(1).Iter()
+	var result struct{ N int }
+	c.Assert(iter.Next(&result), Equals, true)
+	c.Assert(result.N, Equals, 1)
+
+	// The getMore fails to be written, and the iterator must not be
+	// notified of the failure while holding its own lock.
+	atomic.StoreInt32(&stalled, 1)
+	done := make(chan bool)
+	go func() {
+		done <- iter.Next(&result)
+	}()
+	select {
+	case ok := <-done:
+		c.Assert(ok, Equals, false)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("iterator deadlocked on a failed getMore")
+	}
+	c.Assert(iter.Err(), ErrorMatches, "write tcp: i/o timeout")
+}
+
+func (s *SockS) TestQuotaQueryError(c *C) {
+	addr, stop := startFakeServer(c, func(requestId int32, msg []byte) [][]byte {
+		return [][]byte{fakeReply(c, requestId, 0, bson.M{"ok": 1, "ismaster": true, "maxWireVersion": 2})}
+	})
+	defer stop()
+
+	info := &DialInfo{
+		Addrs:       []string{addr},
+		Direct:      true,
+		Timeout:     5 * time.Second,
+		ServerQuota: &Quota{MaxInFlight: 1},
+	}
+	session, err := DialWithInfo(info)
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	// Queries failing before being sent give their room back.
+	coll := session.DB("mydb").C("mycoll")
+	for i := 0; i < 3; i++ {
+		iter := coll.Find(bson.M{"f": func() {}}).Iter()
+		c.Assert(iter.Close(), ErrorMatches, ".*Can't marshal func.*")
+	}
+	var result bson.M
+	c.Assert(coll.Find(nil).One(&result), IsNil)
+	c.Assert(coll.Find(nil).Iter().Close(), IsNil)
+}
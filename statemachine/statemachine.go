@@ -0,0 +1,172 @@
+// The statemachine package implements guarded state transitions of
+// documents in a MongoDB collection.
+//
+// Each transition moves a document from an expected state into a new
+// one atomically through findAndModify, recording when and by whom it
+// was done. Transitions fail with a *ConflictError when the document is
+// no longer in the expected state, as happens when concurrent processes
+// race to move the same document:
+//
+//     orders := statemachine.New(session.DB("app").C("orders"))
+//     orders.Allow("pending", "paid", "cancelled")
+//     orders.Allow("paid", "shipped", "refunded")
+//     ...
+//     err := orders.Transition(id, "pending", "paid", "billing", &order)
+//     if conflict, ok := err.(*statemachine.ConflictError); ok {
+//             // The order was cancelled in the meantime.
+//     }
+//
+package statemachine
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrNotFound is returned by transitions of documents that don't exist.
+var ErrNotFound = mgo.ErrNotFound
+
+// ConflictError is returned by transitions of documents that are not in
+// the expected state.
+type ConflictError struct {
+	Id       interface{} // _id of the document
+	Expected string      // State the transition expected
+	Actual   string      // State the document is in
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("document %v is in state %q rather than %q", e.Id, e.Actual, e.Expected)
+}
+
+// InvalidTransitionError is returned by transitions that are not allowed
+// by the machine, without the document being looked at.
+type InvalidTransitionError struct {
+	From, To string
+}
+
+func (e *InvalidTransitionError) Error() string {
+	return fmt.Sprintf("transition from state %q to %q is not allowed", e.From, e.To)
+}
+
+// Event records a transition in the history of a document.
+type Event struct {
+	From  string    `bson:"from"`
+	To    string    `bson:"to"`
+	At    time.Time `bson:"at"`
+	Actor string    `bson:"by,omitempty"`
+}
+
+// Machine performs state transitions of documents in a collection. It is
+// safe for concurrent use by multiple goroutines once configured.
+type Machine struct {
+	c *mgo.Collection
+
+	// Field is the document field holding the state. The time and actor
+	// of the last transition are held in the fields with the same name
+	// suffixed by "At" and "By". Defaults to "state".
+	Field string
+
+	// History is the number of transitions kept in the history of each
+	// document, in the field with the name of Field suffixed by "History",
+	// with older ones dropped first. Zero, the default, keeps no history.
+	History int
+
+	mu      sync.RWMutex
+	allowed map[string]map[string]bool
+}
+
+// New returns a machine performing transitions of documents in c.
+// All transitions are allowed until Allow is called.
+func New(c *mgo.Collection) *Machine {
+	return &Machine{c: c, Field: "state"}
+}
+
+// Allow allows transitions from state into each of the to states. Once
+// Allow is called, transitions that were not allowed fail with an
+// *InvalidTransitionError.
+func (m *Machine) Allow(from string, to ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.allowed == nil {
+		m.allowed = make(map[string]map[string]bool)
+	}
+	if m.allowed[from] == nil {
+		m.allowed[from] = make(map[string]bool)
+	}
+	for _, state := range to {
+		m.allowed[from][state] = true
+	}
+}
+
+// Allowed returns whether the transition from state into state to is
+// allowed by the machine.
+func (m *Machine) Allowed(from, to string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.allowed == nil || m.allowed[from][to]
+}
+
+// Transition moves the document with the given id from state from into
+// state to, recording actor as the one performing it, and unmarshals
+// the updated document into result, if not nil.
+func (m *Machine) Transition(id interface{}, from, to, actor string, result interface{}) error {
+	return m.TransitionWith(id, from, to, actor, nil, result)
+}
+
+// TransitionWith works like Transition, and also sets the fields in set,
+// if not nil, as part of the same update.
+func (m *Machine) TransitionWith(id interface{}, from, to, actor string, set bson.M, result interface{}) error {
+	if !m.Allowed(from, to) {
+		return &InvalidTransitionError{From: from, To: to}
+	}
+	now := time.Now()
+	fields := bson.M{
+		m.Field:        to,
+		m.Field + "At": now,
+		m.Field + "By": actor,
+	}
+	for name, value := range set {
+		fields[name] = value
+	}
+	update := bson.M{"$set": fields}
+	if m.History > 0 {
+		update["$push"] = bson.M{m.Field + "History": bson.M{
+			"$each":  []Event{{From: from, To: to, At: now, Actor: actor}},
+			"$slice": -m.History,
+		}}
+	}
+	if result == nil {
+		result = &bson.M{}
+	}
+	change := mgo.Change{Update: update, ReturnNew: true}
+	_, err := m.c.Find(bson.D{{"_id", id}, {m.Field, from}}).Apply(change, result)
+	if err == mgo.ErrNotFound {
+		return m.conflict(id, from)
+	}
+	return err
+}
+
+// State returns the state the document with the given id is in.
+func (m *Machine) State(id interface{}) (string, error) {
+	var doc bson.M
+	err := m.c.FindId(id).Select(bson.M{m.Field: 1}).One(&doc)
+	if err != nil {
+		return "", err
+	}
+	state, _ := doc[m.Field].(string)
+	return state, nil
+}
+
+// conflict returns the error for a transition of the document with
+// the given id from state expected that didn't match it.
+func (m *Machine) conflict(id interface{}, expected string) error {
+	actual, err := m.State(id)
+	if err != nil {
+		return err
+	}
+	return &ConflictError{Id: id, Expected: expected, Actual: actual}
+}
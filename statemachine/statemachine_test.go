@@ -0,0 +1,140 @@
+package statemachine_test
+
+import (
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/dbtest"
+	"gopkg.in/mgo.v2/statemachine"
+)
+
+func TestAll(t *testing.T) {
+	TestingT(t)
+}
+
+type S struct {
+	server  dbtest.DBServer
+	session *mgo.Session
+	orders  *mgo.Collection
+}
+
+var _ = Suite(&S{})
+
+func (s *S) SetUpSuite(c *C) {
+	s.server.SetPath(c.MkDir())
+}
+
+func (s *S) TearDownSuite(c *C) {
+	s.server.Stop()
+}
+
+func (s *S) SetUpTest(c *C) {
+	s.server.Wipe()
+
+	s.session = s.server.Session()
+	s.orders = s.session.DB("test").C("orders")
+}
+
+func (s *S) TearDownTest(c *C) {
+	s.session.Close()
+}
+
+type order struct {
+	Id      int                  `bson:"_id"`
+	State   string               `bson:"state"`
+	StateAt time.Time            `bson:"stateAt"`
+	StateBy string               `bson:"stateBy"`
+	History []statemachine.Event `bson:"stateHistory"`
+	Paid    int                  `bson:"paid"`
+}
+
+func (s *S) TestTransition(c *C) {
+	c.Assert(s.orders.Insert(bson.M{"_id": 1, "state": "pending"}), IsNil)
+
+	m := statemachine.New(s.orders)
+	var o order
+	before := time.Now().Add(-time.Second)
+	err := m.TransitionWith(1, "pending", "paid", "billing", bson.M{"paid": 10}, &o)
+	c.Assert(err, IsNil)
+	c.Assert(o.State, Equals, "paid")
+	c.Assert(o.StateBy, Equals, "billing")
+	c.Assert(o.StateAt.After(before), Equals, true)
+	c.Assert(o.Paid, Equals, 10)
+	c.Assert(o.History, HasLen, 0)
+
+	state, err := m.State(1)
+	c.Assert(err, IsNil)
+	c.Assert(state, Equals, "paid")
+
+	// Without a result.
+	err = m.Transition(1, "paid", "shipped", "warehouse", nil)
+	c.Assert(err, IsNil)
+	state, err = m.State(1)
+	c.Assert(err, IsNil)
+	c.Assert(state, Equals, "shipped")
+}
+
+func (s *S) TestConflict(c *C) {
+	c.Assert(s.orders.Insert(bson.M{"_id": 1, "state": "cancelled"}), IsNil)
+
+	m := statemachine.New(s.orders)
+	err := m.Transition(1, "pending", "paid", "billing", nil)
+	c.Assert(err, DeepEquals, &statemachine.ConflictError{Id: 1, Expected: "pending", Actual: "cancelled"})
+	c.Assert(err, ErrorMatches, `document 1 is in state "cancelled" rather than "pending"`)
+
+	err = m.Transition(2, "pending", "paid", "billing", nil)
+	c.Assert(err, Equals, statemachine.ErrNotFound)
+}
+
+func (s *S) TestAllow(c *C) {
+	c.Assert(s.orders.Insert(bson.M{"_id": 1, "state": "pending"}), IsNil)
+
+	m := statemachine.New(s.orders)
+	c.Assert(m.Allowed("pending", "shipped"), Equals, true)
+	m.Allow("pending", "paid", "cancelled")
+	m.Allow("paid", "shipped")
+	c.Assert(m.Allowed("pending", "shipped"), Equals, false)
+	c.Assert(m.Allowed("paid", "shipped"), Equals, true)
+
+	err := m.Transition(1, "pending", "shipped", "warehouse", nil)
+	c.Assert(err, DeepEquals, &statemachine.InvalidTransitionError{From: "pending", To: "shipped"})
+	c.Assert(err, ErrorMatches, `transition from state "pending" to "shipped" is not allowed`)
+
+	c.Assert(m.Transition(1, "pending", "paid", "billing", nil), IsNil)
+	c.Assert(m.Transition(1, "paid", "shipped", "warehouse", nil), IsNil)
+}
+
+func (s *S) TestHistory(c *C) {
+	c.Assert(s.orders.Insert(bson.M{"_id": 1, "state": "a"}), IsNil)
+
+	m := statemachine.New(s.orders)
+	m.History = 2
+	var o order
+	c.Assert(m.Transition(1, "a", "b", "x", &o), IsNil)
+	c.Assert(m.Transition(1, "b", "c", "y", &o), IsNil)
+	c.Assert(m.Transition(1, "c", "d", "z", &o), IsNil)
+
+	c.Assert(o.History, HasLen, 2)
+	c.Assert(o.History[0].From, Equals, "b")
+	c.Assert(o.History[0].To, Equals, "c")
+	c.Assert(o.History[0].Actor, Equals, "y")
+	c.Assert(o.History[1].From, Equals, "c")
+	c.Assert(o.History[1].To, Equals, "d")
+	c.Assert(o.History[1].Actor, Equals, "z")
+}
+
+func (s *S) TestCustomField(c *C) {
+	c.Assert(s.orders.Insert(bson.M{"_id": 1, "status": "open"}), IsNil)
+
+	m := statemachine.New(s.orders)
+	m.Field = "status"
+	var doc bson.M
+	c.Assert(m.Transition(1, "open", "closed", "me", &doc), IsNil)
+	c.Assert(doc["status"], Equals, "closed")
+	c.Assert(doc["statusBy"], Equals, "me")
+	_, ok := doc["statusAt"].(time.Time)
+	c.Assert(ok, Equals, true)
+}
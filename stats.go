@@ -76,6 +76,7 @@ type Stats struct {
 	SocketsAlive int
 	SocketsInUse int
 	SocketRefs   int
+	ShedOps      int
 }
 
 func (stats *Stats) cluster(delta int) {
@@ -106,6 +107,14 @@ func (stats *Stats) sentOps(delta int) {
 	}
 }
 
+func (stats *Stats) shedOps(delta int) {
+	if stats != nil {
+		statsMutex.Lock()
+		stats.ShedOps += delta
+		statsMutex.Unlock()
+	}
+}
+
 func (stats *Stats) receivedOps(delta int) {
 	if stats != nil {
 		statsMutex.Lock()
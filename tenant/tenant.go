@@ -0,0 +1,370 @@
+// The tenant package implements routing of collections on a per-tenant
+// basis, so that application code may stay unaware of how data for
+// different tenants is isolated within MongoDB.
+//
+// A Router maps a tenant key into either a dedicated database, a
+// dedicated collection, or a field that is injected into every filter
+// and inserted document of a shared collection:
+//
+//     router := &tenant.Router{Mode: tenant.SharedCollection, Database: "app"}
+//     c, err := router.C(session, "acme", "orders")
+//     if err != nil {
+//         return err
+//     }
+//     err = c.Insert(bson.M{"item": "anvil"}) // Stored with tenant: "acme".
+//     n, err := c.Find(nil).Count()          // Counts acme's orders only.
+//
+package tenant
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Mode defines how data for distinct tenants is isolated.
+type Mode int
+
+const (
+	// DatabasePerTenant stores each tenant's collections in a database
+	// named after the tenant key.
+	DatabasePerTenant Mode = iota + 1
+
+	// CollectionPerTenant stores each tenant's collections in a shared
+	// database, with collection names prefixed by the tenant key.
+	CollectionPerTenant
+
+	// SharedCollection stores all tenants in the same collections and
+	// tells their documents apart through a field holding the tenant key.
+	SharedCollection
+)
+
+// ErrInvalidTenant is returned when a tenant key cannot be used to
+// derive database or collection names.
+var ErrInvalidTenant = errors.New("invalid tenant key")
+
+// Router maps tenant keys into databases, collections, or filters.
+type Router struct {
+	// Mode selects how tenants are isolated from each other.
+	Mode Mode
+
+	// Database is the database holding the tenant collections in the
+	// CollectionPerTenant and SharedCollection modes. In the
+	// DatabasePerTenant mode it is used as a prefix for the tenant key.
+	// If empty, the session's default database is used for the
+	// shared modes.
+	Database string
+
+	// Field is the name of the document field holding the tenant key
+	// in the SharedCollection mode. Defaults to "tenant".
+	Field string
+
+	// DatabaseName and CollectionName optionally override how names
+	// are derived from the tenant key in the DatabasePerTenant and
+	// CollectionPerTenant modes, respectively.
+	DatabaseName   func(tenant string) string
+	CollectionName func(tenant, name string) string
+}
+
+func (r *Router) field() string {
+	if r.Field == "" {
+		return "tenant"
+	}
+	return r.Field
+}
+
+func checkTenant(tenant string) error {
+	if tenant == "" || strings.ContainsAny(tenant, "/\\. \"$*<>:|?\x00") {
+		return fmt.Errorf("%v: %q", ErrInvalidTenant, tenant)
+	}
+	return nil
+}
+
+// DB returns the database holding collections for the given tenant.
+func (r *Router) DB(session *mgo.Session, tenant string) (*mgo.Database, error) {
+	if err := checkTenant(tenant); err != nil {
+		return nil, err
+	}
+	switch r.Mode {
+	case DatabasePerTenant:
+		if r.DatabaseName != nil {
+			return session.DB(r.DatabaseName(tenant)), nil
+		}
+		return session.DB(r.Database + tenant), nil
+	case CollectionPerTenant, SharedCollection:
+		return session.DB(r.Database), nil
+	}
+	return nil, fmt.Errorf("unknown tenant routing mode: %d", r.Mode)
+}
+
+// C returns a value representing the named logical collection for the
+// given tenant. Operations performed through the returned value only
+// observe and modify data belonging to the tenant.
+func (r *Router) C(session *mgo.Session, tenant, name string) (*Collection, error) {
+	db, err := r.DB(session, tenant)
+	if err != nil {
+		return nil, err
+	}
+	switch r.Mode {
+	case CollectionPerTenant:
+		if r.CollectionName != nil {
+			name = r.CollectionName(tenant, name)
+		} else {
+			name = tenant + "." + name
+		}
+		return &Collection{coll: db.C(name)}, nil
+	case SharedCollection:
+		return &Collection{coll: db.C(name), tenant: tenant, field: r.field()}, nil
+	}
+	return &Collection{coll: db.C(name)}, nil
+}
+
+// Collection wraps an mgo.Collection so that filters and inserted
+// documents are scoped to a single tenant.
+//
+// In the SharedCollection mode, replacement documents provided to the
+// update methods obtain the tenant field like inserted documents do,
+// and update operators modifying the tenant field are rejected. Queries
+// returned by Find may still modify documents via Query.Apply, which
+// must not be used to change the tenant field.
+type Collection struct {
+	coll   *mgo.Collection
+	tenant string
+	field  string
+}
+
+// Name returns the name of the underlying collection.
+func (c *Collection) Name() string {
+	return c.coll.Name
+}
+
+// FullName returns the "db.collection" namespace of the underlying
+// collection.
+func (c *Collection) FullName() string {
+	return c.coll.FullName
+}
+
+// Unscoped returns the underlying mgo.Collection for administrative
+// operations such as index management. In the SharedCollection mode
+// it observes and modifies data of all tenants, so it must be used
+// with care.
+func (c *Collection) Unscoped() *mgo.Collection {
+	return c.coll
+}
+
+// Tenant returns the tenant key injected into filters and documents,
+// or an empty string if the collection is not shared between tenants.
+func (c *Collection) Tenant() string {
+	return c.tenant
+}
+
+// filter returns query restricted to documents of the tenant.
+func (c *Collection) filter(query interface{}) interface{} {
+	if c.field == "" {
+		return query
+	}
+	if query == nil {
+		return bson.D{{c.field, c.tenant}}
+	}
+	return bson.D{{"$and", []interface{}{bson.D{{c.field, c.tenant}}, query}}}
+}
+
+// document returns doc with the tenant field set. It's an error for
+// doc to hold a different tenant key already.
+func (c *Collection) document(doc interface{}) (interface{}, error) {
+	if c.field == "" {
+		return doc, nil
+	}
+	d, err := docElems(doc)
+	if err != nil {
+		return nil, err
+	}
+	for _, elem := range d {
+		if elem.Name == c.field {
+			if elem.Value != c.tenant {
+				return nil, fmt.Errorf("document has %s %#v; want %q", c.field, elem.Value, c.tenant)
+			}
+			return d, nil
+		}
+	}
+	return append(d, bson.DocElem{c.field, c.tenant}), nil
+}
+
+// update returns update prepared for documents of the tenant. A
+// replacement document has the tenant field set as done by document,
+// while update operators must not modify the tenant field. When
+// upsert is true, operators are extended to set the tenant field in
+// inserted documents.
+func (c *Collection) update(update interface{}, upsert bool) (interface{}, error) {
+	if c.field == "" {
+		return update, nil
+	}
+	d, err := docElems(update)
+	if err != nil {
+		return nil, err
+	}
+	if len(d) == 0 || !strings.HasPrefix(d[0].Name, "$") {
+		return c.document(d)
+	}
+	onInsert := bson.D{{c.field, c.tenant}}
+	for i, op := range d {
+		args, ok := op.Value.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("update operator %s must hold a document", op.Name)
+		}
+		for _, arg := range args {
+			target, _ := arg.Value.(string)
+			if c.isField(arg.Name) || op.Name == "$rename" && c.isField(target) {
+				return nil, fmt.Errorf("update must not modify the %s field", c.field)
+			}
+		}
+		if op.Name == "$setOnInsert" && upsert {
+			d[i].Value = append(args, onInsert...)
+			upsert = false
+		}
+	}
+	if upsert {
+		d = append(d, bson.DocElem{"$setOnInsert", onInsert})
+	}
+	return d, nil
+}
+
+// isField returns whether the path refers to the tenant field or to
+// anything within it.
+func (c *Collection) isField(path string) bool {
+	return path == c.field || strings.HasPrefix(path, c.field+".")
+}
+
+func docElems(doc interface{}) (bson.D, error) {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	var d bson.D
+	if err := bson.Unmarshal(data, &d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Find works like mgo.Collection.Find, but only matches documents
+// belonging to the tenant.
+func (c *Collection) Find(query interface{}) *mgo.Query {
+	return c.coll.Find(c.filter(query))
+}
+
+// FindId works like mgo.Collection.FindId, but only matches documents
+// belonging to the tenant.
+func (c *Collection) FindId(id interface{}) *mgo.Query {
+	return c.Find(bson.D{{"_id", id}})
+}
+
+// Count returns the number of documents in the collection that belong
+// to the tenant.
+func (c *Collection) Count() (n int, err error) {
+	return c.Find(nil).Count()
+}
+
+// Insert works like mgo.Collection.Insert, but sets the tenant field
+// in the provided documents before inserting them.
+func (c *Collection) Insert(docs ...interface{}) error {
+	if c.field != "" {
+		tdocs := make([]interface{}, len(docs))
+		for i, doc := range docs {
+			tdoc, err := c.document(doc)
+			if err != nil {
+				return err
+			}
+			tdocs[i] = tdoc
+		}
+		docs = tdocs
+	}
+	return c.coll.Insert(docs...)
+}
+
+// Update works like mgo.Collection.Update, but only matches documents
+// belonging to the tenant. The tenant field is set in replacement
+// documents, and update operators may not modify it.
+func (c *Collection) Update(selector interface{}, update interface{}) error {
+	update, err := c.update(update, false)
+	if err != nil {
+		return err
+	}
+	return c.coll.Update(c.filter(selector), update)
+}
+
+// UpdateId works like mgo.Collection.UpdateId, but only matches documents
+// belonging to the tenant.
+func (c *Collection) UpdateId(id interface{}, update interface{}) error {
+	return c.Update(bson.D{{"_id", id}}, update)
+}
+
+// UpdateAll works like mgo.Collection.UpdateAll, but only matches documents
+// belonging to the tenant. Update operators may not modify the tenant field.
+func (c *Collection) UpdateAll(selector interface{}, update interface{}) (info *mgo.ChangeInfo, err error) {
+	update, err = c.update(update, false)
+	if err != nil {
+		return nil, err
+	}
+	return c.coll.UpdateAll(c.filter(selector), update)
+}
+
+// Upsert works like mgo.Collection.Upsert, but only matches documents
+// belonging to the tenant. Inserted documents obtain the tenant field
+// from the replacement document, or via $setOnInsert for updates made
+// with operators, which may not modify the tenant field.
+func (c *Collection) Upsert(selector interface{}, update interface{}) (info *mgo.ChangeInfo, err error) {
+	update, err = c.update(update, true)
+	if err != nil {
+		return nil, err
+	}
+	return c.coll.Upsert(c.filter(selector), update)
+}
+
+// UpsertId works like mgo.Collection.UpsertId, but only matches documents
+// belonging to the tenant.
+func (c *Collection) UpsertId(id interface{}, update interface{}) (info *mgo.ChangeInfo, err error) {
+	return c.Upsert(bson.D{{"_id", id}}, update)
+}
+
+// Remove works like mgo.Collection.Remove, but only matches documents
+// belonging to the tenant.
+func (c *Collection) Remove(selector interface{}) error {
+	return c.coll.Remove(c.filter(selector))
+}
+
+// RemoveId works like mgo.Collection.RemoveId, but only matches documents
+// belonging to the tenant.
+func (c *Collection) RemoveId(id interface{}) error {
+	return c.Remove(bson.D{{"_id", id}})
+}
+
+// RemoveAll works like mgo.Collection.RemoveAll, but only matches documents
+// belonging to the tenant.
+func (c *Collection) RemoveAll(selector interface{}) (info *mgo.ChangeInfo, err error) {
+	return c.coll.RemoveAll(c.filter(selector))
+}
+
+// Pipe works like mgo.Collection.Pipe, but prepends a $match stage to
+// the pipeline so that only documents belonging to the tenant are
+// aggregated. The pipeline must be a slice of stages.
+func (c *Collection) Pipe(pipeline interface{}) *mgo.Pipe {
+	if c.field == "" {
+		return c.coll.Pipe(pipeline)
+	}
+	stages := []interface{}{bson.D{{"$match", bson.D{{c.field, c.tenant}}}}}
+	if pipeline != nil {
+		v := reflect.ValueOf(pipeline)
+		if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+			panic("tenant: pipeline must be a slice of stages")
+		}
+		for i := 0; i < v.Len(); i++ {
+			stages = append(stages, v.Index(i).Interface())
+		}
+	}
+	return c.coll.Pipe(stages)
+}
@@ -0,0 +1,248 @@
+package tenant
+
+import (
+	"testing"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/dbtest"
+)
+
+func TestAll(t *testing.T) {
+	TestingT(t)
+}
+
+type RouterSuite struct{}
+
+var _ = Suite(&RouterSuite{})
+
+func (s *RouterSuite) TestDatabasePerTenant(c *C) {
+	session := &mgo.Session{}
+	r := &Router{Mode: DatabasePerTenant, Database: "app_"}
+	coll, err := r.C(session, "acme", "orders")
+	c.Assert(err, IsNil)
+	c.Assert(coll.FullName(), Equals, "app_acme.orders")
+	c.Assert(coll.Tenant(), Equals, "")
+
+	r.DatabaseName = func(tenant string) string { return "t-" + tenant }
+	coll, err = r.C(session, "acme", "orders")
+	c.Assert(err, IsNil)
+	c.Assert(coll.FullName(), Equals, "t-acme.orders")
+}
+
+func (s *RouterSuite) TestCollectionPerTenant(c *C) {
+	session := &mgo.Session{}
+	r := &Router{Mode: CollectionPerTenant, Database: "app"}
+	coll, err := r.C(session, "acme", "orders")
+	c.Assert(err, IsNil)
+	c.Assert(coll.FullName(), Equals, "app.acme.orders")
+
+	r.CollectionName = func(tenant, name string) string { return name + "_" + tenant }
+	coll, err = r.C(session, "acme", "orders")
+	c.Assert(err, IsNil)
+	c.Assert(coll.FullName(), Equals, "app.orders_acme")
+}
+
+func (s *RouterSuite) TestInvalidTenant(c *C) {
+	session := &mgo.Session{}
+	r := &Router{Mode: DatabasePerTenant}
+	for _, tenant := range []string{"", "a.b", "a/b", "a b", "$a"} {
+		_, err := r.C(session, tenant, "orders")
+		c.Assert(err, ErrorMatches, "invalid tenant key: .*", Commentf("Tenant %q", tenant))
+	}
+	r = &Router{}
+	_, err := r.C(session, "acme", "orders")
+	c.Assert(err, ErrorMatches, "unknown tenant routing mode: 0")
+}
+
+func (s *RouterSuite) TestSharedFilter(c *C) {
+	coll := &Collection{tenant: "acme", field: "tenant"}
+	c.Assert(coll.filter(nil), DeepEquals, bson.D{{"tenant", "acme"}})
+	c.Assert(coll.filter(bson.M{"a": 1}), DeepEquals, bson.D{{"$and", []interface{}{
+		bson.D{{"tenant", "acme"}},
+		bson.M{"a": 1},
+	}}})
+
+	coll = &Collection{}
+	c.Assert(coll.filter(bson.M{"a": 1}), DeepEquals, bson.M{"a": 1})
+}
+
+func (s *RouterSuite) TestSharedDocument(c *C) {
+	coll := &Collection{tenant: "acme", field: "owner"}
+	doc, err := coll.document(bson.M{"a": 1})
+	c.Assert(err, IsNil)
+	c.Assert(doc, DeepEquals, bson.D{{"a", 1}, {"owner", "acme"}})
+
+	doc, err = coll.document(bson.D{{"owner", "acme"}, {"a", 1}})
+	c.Assert(err, IsNil)
+	c.Assert(doc, DeepEquals, bson.D{{"owner", "acme"}, {"a", 1}})
+
+	_, err = coll.document(bson.M{"owner": "other"})
+	c.Assert(err, ErrorMatches, `document has owner "other"; want "acme"`)
+}
+
+func (s *RouterSuite) TestSharedDefaultField(c *C) {
+	session := &mgo.Session{}
+	r := &Router{Mode: SharedCollection, Database: "app"}
+	coll, err := r.C(session, "acme", "orders")
+	c.Assert(err, IsNil)
+	c.Assert(coll.FullName(), Equals, "app.orders")
+	c.Assert(coll.Tenant(), Equals, "acme")
+	c.Assert(coll.field, Equals, "tenant")
+}
+
+func (s *RouterSuite) TestSharedUpdate(c *C) {
+	coll := &Collection{tenant: "acme", field: "tenant"}
+	update, err := coll.update(bson.M{"a": 1}, false)
+	c.Assert(err, IsNil)
+	c.Assert(update, DeepEquals, bson.D{{"a", 1}, {"tenant", "acme"}})
+
+	_, err = coll.update(bson.M{"tenant": "other"}, false)
+	c.Assert(err, ErrorMatches, `document has tenant "other"; want "acme"`)
+
+	update, err = coll.update(bson.M{"$set": bson.M{"a": 1}}, false)
+	c.Assert(err, IsNil)
+	c.Assert(update, DeepEquals, bson.D{{"$set", bson.D{{"a", 1}}}})
+
+	update, err = coll.update(bson.M{"$set": bson.M{"a": 1}}, true)
+	c.Assert(err, IsNil)
+	c.Assert(update, DeepEquals, bson.D{{"$set", bson.D{{"a", 1}}}, {"$setOnInsert", bson.D{{"tenant", "acme"}}}})
+
+	update, err = coll.update(bson.D{{"$setOnInsert", bson.D{{"a", 1}}}}, true)
+	c.Assert(err, IsNil)
+	c.Assert(update, DeepEquals, bson.D{{"$setOnInsert", bson.D{{"a", 1}, {"tenant", "acme"}}}})
+
+	for _, bad := range []bson.M{
+		{"$set": bson.M{"tenant": "other"}},
+		{"$set": bson.M{"tenant.id": "other"}},
+		{"$unset": bson.M{"tenant": 1}},
+		{"$rename": bson.M{"tenant": "owner"}},
+		{"$rename": bson.M{"owner": "tenant"}},
+	} {
+		_, err = coll.update(bad, false)
+		c.Assert(err, ErrorMatches, "update must not modify the tenant field", Commentf("Update %v", bad))
+	}
+
+	coll = &Collection{}
+	update, err = coll.update(bson.M{"$set": bson.M{"tenant": "other"}}, false)
+	c.Assert(err, IsNil)
+	c.Assert(update, DeepEquals, bson.M{"$set": bson.M{"tenant": "other"}})
+}
+
+type SharedSuite struct {
+	server  dbtest.DBServer
+	session *mgo.Session
+	acme    *Collection
+	other   *Collection
+}
+
+var _ = Suite(&SharedSuite{})
+
+func (s *SharedSuite) SetUpSuite(c *C) {
+	s.server.SetPath(c.MkDir())
+}
+
+func (s *SharedSuite) TearDownSuite(c *C) {
+	s.server.Stop()
+}
+
+func (s *SharedSuite) SetUpTest(c *C) {
+	s.server.Wipe()
+
+	s.session = s.server.Session()
+	r := &Router{Mode: SharedCollection, Database: "app"}
+	var err error
+	s.acme, err = r.C(s.session, "acme", "orders")
+	c.Assert(err, IsNil)
+	s.other, err = r.C(s.session, "other", "orders")
+	c.Assert(err, IsNil)
+}
+
+func (s *SharedSuite) TearDownTest(c *C) {
+	s.session.Close()
+}
+
+func (s *SharedSuite) tenantOf(c *C, id interface{}) string {
+	var doc struct{ Tenant string }
+	err := s.acme.Unscoped().FindId(id).One(&doc)
+	c.Assert(err, IsNil)
+	return doc.Tenant
+}
+
+func (s *SharedSuite) TestInsertFind(c *C) {
+	err := s.acme.Insert(bson.M{"_id": 1}, bson.M{"_id": 2})
+	c.Assert(err, IsNil)
+	err = s.other.Insert(bson.M{"_id": 3})
+	c.Assert(err, IsNil)
+
+	n, err := s.acme.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+	err = s.acme.FindId(3).One(nil)
+	c.Assert(err, Equals, mgo.ErrNotFound)
+	c.Assert(s.tenantOf(c, 3), Equals, "other")
+
+	err = s.acme.Insert(bson.M{"_id": 4, "tenant": "other"})
+	c.Assert(err, ErrorMatches, `document has tenant "other"; want "acme"`)
+}
+
+func (s *SharedSuite) TestUpdateReplacement(c *C) {
+	err := s.acme.Insert(bson.M{"_id": 1, "n": 1})
+	c.Assert(err, IsNil)
+
+	err = s.acme.UpdateId(1, bson.M{"n": 2})
+	c.Assert(err, IsNil)
+	c.Assert(s.tenantOf(c, 1), Equals, "acme")
+
+	err = s.other.UpdateId(1, bson.M{"n": 3})
+	c.Assert(err, Equals, mgo.ErrNotFound)
+
+	_, err = s.acme.UpsertId(2, bson.M{"n": 1})
+	c.Assert(err, IsNil)
+	c.Assert(s.tenantOf(c, 2), Equals, "acme")
+}
+
+func (s *SharedSuite) TestUpdateOperators(c *C) {
+	err := s.acme.Insert(bson.M{"_id": 1, "n": 1})
+	c.Assert(err, IsNil)
+
+	err = s.acme.UpdateId(1, bson.M{"$set": bson.M{"tenant": "other"}})
+	c.Assert(err, ErrorMatches, "update must not modify the tenant field")
+	_, err = s.acme.UpdateAll(nil, bson.M{"$unset": bson.M{"tenant": 1}})
+	c.Assert(err, ErrorMatches, "update must not modify the tenant field")
+	c.Assert(s.tenantOf(c, 1), Equals, "acme")
+
+	info, err := s.acme.UpdateAll(nil, bson.M{"$inc": bson.M{"n": 1}})
+	c.Assert(err, IsNil)
+	c.Assert(info.Updated, Equals, 1)
+
+	_, err = s.acme.UpsertId(2, bson.M{"$set": bson.M{"n": 1}})
+	c.Assert(err, IsNil)
+	c.Assert(s.tenantOf(c, 2), Equals, "acme")
+	_, err = s.other.Upsert(bson.M{"n": 5}, bson.M{"$setOnInsert": bson.M{"m": 1}})
+	c.Assert(err, IsNil)
+
+	var doc struct{ Tenant string }
+	err = s.other.Find(bson.M{"n": 5}).One(&doc)
+	c.Assert(err, IsNil)
+	c.Assert(doc.Tenant, Equals, "other")
+}
+
+func (s *SharedSuite) TestRemovePipe(c *C) {
+	err := s.acme.Insert(bson.M{"_id": 1}, bson.M{"_id": 2})
+	c.Assert(err, IsNil)
+	err = s.other.Insert(bson.M{"_id": 3})
+	c.Assert(err, IsNil)
+
+	err = s.other.RemoveId(1)
+	c.Assert(err, Equals, mgo.ErrNotFound)
+	info, err := s.other.RemoveAll(nil)
+	c.Assert(err, IsNil)
+	c.Assert(info.Removed, Equals, 1)
+
+	var result []bson.M
+	err = s.acme.Pipe([]bson.M{{"$sort": bson.M{"_id": 1}}}).All(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result, HasLen, 2)
+}
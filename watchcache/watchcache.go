@@ -0,0 +1,386 @@
+// The watchcache package keeps an in-process copy of a small MongoDB
+// collection, such as one holding feature flags or configuration, fresh
+// by following its change stream.
+//
+// The whole collection is loaded when the cache is created, and changes
+// performed on it afterwards are applied as they're reported by the
+// server, so reads are served from memory:
+//
+//     flags, err := watchcache.New(session.DB("app").C("flags"), nil)
+//     if err != nil {
+//             return err
+//     }
+//     defer flags.Close()
+//     ...
+//     var flag Flag
+//     err = flags.Get("new-checkout", &flag)
+//
+// If the change stream breaks, it's resumed from the last change seen.
+// When it can't be resumed, as happens when the change is no longer in
+// the oplog or the collection was dropped or renamed, the collection is
+// reloaded in full.
+//
+// Change streams depend on MongoDB 3.6+ running as a replica set or
+// sharded cluster.
+//
+package watchcache
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrNotFound is returned by Get when no document has the provided id.
+var ErrNotFound = mgo.ErrNotFound
+
+// ErrClosed is returned by Get and All once the cache is closed.
+var ErrClosed = errors.New("cache closed")
+
+// Options holds settings for a cache. Zero values select the defaults
+// documented for each field.
+type Options struct {
+	// MaxAwait is for how long the server waits for changes before
+	// replying to each request for them. Defaults to one second.
+	MaxAwait time.Duration
+
+	// RetryDelay is for how long to wait before reloading the collection
+	// again after a failed reload. Defaults to one second.
+	RetryDelay time.Duration
+
+	// Reload, if set, is called after the collection is reloaded in full
+	// in the background, with the error that caused the reload and the
+	// error of the reload itself, if any. Until a reload succeeds, the
+	// cache keeps serving the documents it held before.
+	Reload func(cause, err error)
+}
+
+// Stats holds statistics about a cache.
+type Stats struct {
+	Docs    int   // Documents held
+	Changes int64 // Changes applied
+	Resumes int64 // Times the change stream was resumed
+	Reloads int64 // Times the collection was reloaded in full after New
+}
+
+// Cache holds the documents of a collection, indexed by _id.
+type Cache struct {
+	session  *mgo.Session
+	coll     *mgo.Collection
+	options  Options
+	maxAwait int
+
+	m     sync.RWMutex
+	docs  map[string]bson.Raw
+	stats Stats
+
+	cursor int64
+	token  interface{}
+
+	closeOnce sync.Once
+	closing   chan struct{}
+	done      chan struct{}
+}
+
+// New loads all documents of coll and returns a cache holding them,
+// which is kept fresh in the background until it's closed. The session
+// of coll is copied, so it may be closed once New returns.
+func New(coll *mgo.Collection, options *Options) (*Cache, error) {
+	session := coll.Database.Session.Copy()
+	c := &Cache{
+		session: session,
+		coll:    coll.With(session),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if options != nil {
+		c.options = *options
+	}
+	if c.options.MaxAwait <= 0 {
+		c.options.MaxAwait = time.Second
+	}
+	if c.options.RetryDelay <= 0 {
+		c.options.RetryDelay = time.Second
+	}
+	c.maxAwait = int(c.options.MaxAwait / time.Millisecond)
+	if c.maxAwait == 0 {
+		c.maxAwait = 1
+	}
+	if err := c.reload(); err != nil {
+		session.Close()
+		return nil, err
+	}
+	go c.loop()
+	return c, nil
+}
+
+// Close stops following changes and releases the resources held by the
+// cache. It may block for up to Options.MaxAwait, while the server is
+// waiting for changes.
+func (c *Cache) Close() {
+	c.closeOnce.Do(func() {
+		close(c.closing)
+		<-c.done
+		c.m.Lock()
+		c.docs = nil
+		c.m.Unlock()
+		c.session.Close()
+	})
+}
+
+// Get unmarshals into result the document with the provided id, which
+// must have the same BSON type as the _id stored.
+func (c *Cache) Get(id interface{}, result interface{}) error {
+	key, err := idKey(id)
+	if err != nil {
+		return err
+	}
+	c.m.RLock()
+	docs := c.docs
+	doc, ok := docs[key]
+	c.m.RUnlock()
+	if docs == nil {
+		return ErrClosed
+	}
+	if !ok {
+		return ErrNotFound
+	}
+	return doc.Unmarshal(result)
+}
+
+// All unmarshals all documents held into result, which must be a pointer
+// to a slice. Documents are provided in no particular order.
+func (c *Cache) All(result interface{}) error {
+	resultv := reflect.ValueOf(result)
+	if resultv.Kind() != reflect.Ptr || resultv.Elem().Kind() != reflect.Slice {
+		panic("result argument must be a slice address")
+	}
+	c.m.RLock()
+	if c.docs == nil {
+		c.m.RUnlock()
+		return ErrClosed
+	}
+	docs := make([]bson.Raw, 0, len(c.docs))
+	for _, doc := range c.docs {
+		docs = append(docs, doc)
+	}
+	c.m.RUnlock()
+
+	slicev := reflect.MakeSlice(resultv.Elem().Type(), len(docs), len(docs))
+	for i, doc := range docs {
+		if err := doc.Unmarshal(slicev.Index(i).Addr().Interface()); err != nil {
+			return err
+		}
+	}
+	resultv.Elem().Set(slicev)
+	return nil
+}
+
+// Stats returns statistics about the cache.
+func (c *Cache) Stats() Stats {
+	c.m.RLock()
+	stats := c.stats
+	stats.Docs = len(c.docs)
+	c.m.RUnlock()
+	return stats
+}
+
+// idKey returns the key documents with the provided _id are held under.
+func idKey(id interface{}) (string, error) {
+	data, err := bson.Marshal(bson.D{{"_id", id}})
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+type cursorData struct {
+	Id                   int64
+	FirstBatch           []bson.Raw
+	NextBatch            []bson.Raw
+	PostBatchResumeToken bson.Raw
+}
+
+type changeEvent struct {
+	Id            bson.Raw `bson:"_id"`
+	OperationType string   `bson:"operationType"`
+	FullDocument  bson.Raw `bson:"fullDocument"`
+	DocumentKey   struct {
+		Id bson.Raw `bson:"_id"`
+	} `bson:"documentKey"`
+}
+
+// errInvalidated reports that the change stream can't go on because
+// the collection was dropped or renamed.
+var errInvalidated = errors.New("change stream invalidated")
+
+// watch opens a change stream on the collection, resuming it after the
+// change identified by token if not nil, and applies the changes in its
+// first batch to docs.
+func (c *Cache) watch(docs map[string]bson.Raw, token interface{}) error {
+	stage := bson.D{{"fullDocument", "updateLookup"}}
+	if token != nil {
+		stage = append(stage, bson.DocElem{"resumeAfter", token})
+	}
+	var result struct{ Cursor cursorData }
+	err := c.coll.Database.Run(bson.D{
+		{"aggregate", c.coll.Name},
+		{"pipeline", []bson.D{{{"$changeStream", stage}}}},
+		{"cursor", bson.D{}},
+	}, &result)
+	if err != nil {
+		return err
+	}
+	c.cursor = result.Cursor.Id
+	c.token = token
+	return c.apply(docs, result.Cursor.FirstBatch, result.Cursor.PostBatchResumeToken)
+}
+
+// next waits for the following batch of changes and applies it.
+func (c *Cache) next() error {
+	var result struct{ Cursor cursorData }
+	err := c.coll.Database.Run(bson.D{
+		{"getMore", c.cursor},
+		{"collection", c.coll.Name},
+		{"maxTimeMS", c.maxAwait},
+	}, &result)
+	if err != nil {
+		return err
+	}
+	c.cursor = result.Cursor.Id
+	return c.apply(nil, result.Cursor.NextBatch, result.Cursor.PostBatchResumeToken)
+}
+
+// apply applies the changes in batch to docs, or to the documents held
+// if docs is nil, and records the point the change stream may be resumed
+// from.
+func (c *Cache) apply(docs map[string]bson.Raw, batch []bson.Raw, postBatchToken bson.Raw) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if docs == nil {
+		docs = c.docs
+	}
+	for _, raw := range batch {
+		var event changeEvent
+		if err := raw.Unmarshal(&event); err != nil {
+			return err
+		}
+		c.token = event.Id
+		key, err := idKey(event.DocumentKey.Id)
+		if err != nil {
+			return err
+		}
+		switch event.OperationType {
+		case "insert", "replace", "update":
+			if event.FullDocument.Kind == 0x03 {
+				docs[key] = event.FullDocument
+			} else {
+				// Deleted before the update was looked up.
+				delete(docs, key)
+			}
+		case "delete":
+			delete(docs, key)
+		case "drop", "rename", "dropDatabase", "invalidate":
+			return errInvalidated
+		default:
+			continue
+		}
+		c.stats.Changes++
+	}
+	if postBatchToken.Kind == 0x03 {
+		c.token = postBatchToken
+	}
+	return nil
+}
+
+// reload opens a new change stream and loads all documents of the
+// collection, replacing the ones held once they're all loaded. The stream
+// is opened first so that no changes performed while loading are missed.
+// Changes replayed over documents loaded afterwards are harmless, as they
+// carry the full documents and converge to their latest versions.
+func (c *Cache) reload() error {
+	c.killCursor()
+	docs := make(map[string]bson.Raw)
+	err := c.watch(docs, nil)
+	if err != nil {
+		return err
+	}
+	iter := c.coll.Find(nil).Iter()
+	var doc bson.Raw
+	for err == nil && iter.Next(&doc) {
+		var id struct {
+			Id bson.Raw `bson:"_id"`
+		}
+		var key string
+		if err = doc.Unmarshal(&id); err == nil {
+			key, err = idKey(id.Id)
+			docs[key] = doc
+		}
+	}
+	if iterErr := iter.Close(); err == nil {
+		err = iterErr
+	}
+	if err != nil {
+		c.killCursor()
+		return err
+	}
+	c.m.Lock()
+	c.docs = docs
+	c.m.Unlock()
+	return nil
+}
+
+// killCursor kills the change stream cursor, if any.
+func (c *Cache) killCursor() {
+	if c.cursor != 0 {
+		c.coll.Database.Run(bson.D{{"killCursors", c.coll.Name}, {"cursors", []int64{c.cursor}}}, nil)
+		c.cursor = 0
+	}
+}
+
+// loop follows the change stream until the cache is closed, resuming it
+// or reloading the collection whenever it breaks.
+func (c *Cache) loop() {
+	defer close(c.done)
+	for {
+		select {
+		case <-c.closing:
+			c.killCursor()
+			return
+		default:
+		}
+		err := c.next()
+		if err == nil {
+			continue
+		}
+		c.session.Refresh()
+		if err != errInvalidated && c.token != nil && c.watch(nil, c.token) == nil {
+			c.m.Lock()
+			c.stats.Resumes++
+			c.m.Unlock()
+			continue
+		}
+		for {
+			reloadErr := c.reload()
+			if c.options.Reload != nil {
+				c.options.Reload(err, reloadErr)
+			}
+			if reloadErr == nil {
+				c.m.Lock()
+				c.stats.Reloads++
+				c.m.Unlock()
+				break
+			}
+			select {
+			case <-c.closing:
+				return
+			case <-time.After(c.options.RetryDelay):
+			}
+			c.session.Refresh()
+		}
+	}
+}
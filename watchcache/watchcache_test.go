@@ -0,0 +1,157 @@
+package watchcache_test
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/watchcache"
+)
+
+func TestAll(t *testing.T) {
+	TestingT(t)
+}
+
+// Change streams need a replica set, so it's the rs1 replica set
+// started by "make startdb".
+const addr = "localhost:40011"
+
+type S struct {
+	session *mgo.Session
+	coll    *mgo.Collection
+}
+
+var _ = Suite(&S{})
+
+func (s *S) SetUpTest(c *C) {
+	var err error
+	s.session, err = mgo.DialWithTimeout(addr, 5*time.Second)
+	c.Assert(err, IsNil)
+	ok, err := s.session.SupportsChangeStreams()
+	c.Assert(err, IsNil)
+	if !ok {
+		s.session.Close()
+		c.Skip("change streams not supported")
+	}
+	s.session.DB("watchcache").DropDatabase()
+	s.coll = s.session.DB("watchcache").C("flags")
+}
+
+func (s *S) TearDownTest(c *C) {
+	if s.session != nil {
+		s.session.Close()
+	}
+}
+
+type flag struct {
+	Id string `bson:"_id"`
+	On bool   `bson:"on"`
+}
+
+var options = &watchcache.Options{
+	MaxAwait:   100 * time.Millisecond,
+	RetryDelay: 100 * time.Millisecond,
+}
+
+// waitFor waits for cond to hold, failing the test after a few seconds.
+func waitFor(c *C, cond func() bool) {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.Fatalf("condition not met in time")
+}
+
+func (s *S) TestLoad(c *C) {
+	c.Assert(s.coll.Insert(flag{"a", true}, flag{"b", false}), IsNil)
+
+	cache, err := watchcache.New(s.coll, options)
+	c.Assert(err, IsNil)
+	defer cache.Close()
+
+	var f flag
+	c.Assert(cache.Get("a", &f), IsNil)
+	c.Assert(f, Equals, flag{"a", true})
+	c.Assert(cache.Get("c", &f), Equals, watchcache.ErrNotFound)
+
+	var all []flag
+	c.Assert(cache.All(&all), IsNil)
+	sort.Slice(all, func(i, j int) bool { return all[i].Id < all[j].Id })
+	c.Assert(all, DeepEquals, []flag{{"a", true}, {"b", false}})
+	c.Assert(cache.Stats().Docs, Equals, 2)
+}
+
+func (s *S) TestChanges(c *C) {
+	c.Assert(s.coll.Insert(flag{"a", true}), IsNil)
+
+	cache, err := watchcache.New(s.coll, options)
+	c.Assert(err, IsNil)
+	defer cache.Close()
+
+	c.Assert(s.coll.Insert(flag{"b", true}), IsNil)
+	c.Assert(s.coll.UpdateId("a", bson.M{"$set": bson.M{"on": false}}), IsNil)
+	c.Assert(s.coll.RemoveId("b"), IsNil)
+	c.Assert(s.coll.Insert(flag{"c", true}), IsNil)
+
+	waitFor(c, func() bool {
+		var f flag
+		return cache.Get("c", &f) == nil
+	})
+	var f flag
+	c.Assert(cache.Get("a", &f), IsNil)
+	c.Assert(f, Equals, flag{"a", false})
+	c.Assert(cache.Get("b", &f), Equals, watchcache.ErrNotFound)
+
+	stats := cache.Stats()
+	c.Assert(stats.Docs, Equals, 2)
+	c.Assert(stats.Changes, Equals, int64(4))
+	c.Assert(stats.Reloads, Equals, int64(0))
+}
+
+func (s *S) TestReloadOnDrop(c *C) {
+	c.Assert(s.coll.Insert(flag{"a", true}), IsNil)
+
+	var m sync.Mutex
+	var causes []error
+	opts := *options
+	opts.Reload = func(cause, err error) {
+		m.Lock()
+		causes = append(causes, cause)
+		m.Unlock()
+	}
+	cache, err := watchcache.New(s.coll, &opts)
+	c.Assert(err, IsNil)
+	defer cache.Close()
+
+	c.Assert(s.coll.DropCollection(), IsNil)
+	c.Assert(s.coll.Insert(flag{"b", true}), IsNil)
+
+	waitFor(c, func() bool {
+		var f flag
+		return cache.Get("b", &f) == nil && cache.Get("a", &f) == watchcache.ErrNotFound
+	})
+	c.Assert(cache.Stats().Reloads > 0, Equals, true)
+	m.Lock()
+	c.Assert(len(causes) > 0, Equals, true)
+	m.Unlock()
+}
+
+func (s *S) TestClose(c *C) {
+	c.Assert(s.coll.Insert(flag{"a", true}), IsNil)
+
+	cache, err := watchcache.New(s.coll, options)
+	c.Assert(err, IsNil)
+	cache.Close()
+	cache.Close()
+
+	var f flag
+	c.Assert(cache.Get("a", &f), Equals, watchcache.ErrClosed)
+	var all []flag
+	c.Assert(cache.All(&all), Equals, watchcache.ErrClosed)
+}